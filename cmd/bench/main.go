@@ -0,0 +1,179 @@
+package main
+
+import (
+	"blueis/internal/kvstore"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bench drives a single in-process KeyValueService configuration and prints
+// throughput, latency and allocation figures. Run it once per configuration
+// to compare engines and execution models.
+func main() {
+	op := flag.String("op", "set", "operation to benchmark (set, get, delete, mixed)")
+	engineName := flag.String("engine", "memory", "storage engine (memory, disk, tiered, sharded)")
+	dataDir := flag.String("data-dir", "", "directory for disk-backed engines (defaults to a temporary directory)")
+	direct := flag.Bool("direct-execution", false, "execute commands on the caller's goroutine (requires -engine=sharded)")
+	concurrentReads := flag.Bool("concurrent-reads", false, "serve reads outside the store loop")
+	concurrency := flag.Int("concurrency", 16, "number of concurrent clients")
+	valueSize := flag.Int("value-size", 64, "value size in bytes")
+	keySpace := flag.Int("keys", 10000, "number of distinct keys")
+	duration := flag.Duration("duration", 5*time.Second, "how long to run")
+	flag.Parse()
+
+	if *dataDir == "" {
+		dir, err := os.MkdirTemp("", "blueis-bench-")
+		if err != nil {
+			log.Fatalf("Failed to create data directory: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		*dataDir = dir
+	}
+
+	engine, err := newStorageEngine(*engineName, *dataDir)
+	if err != nil {
+		log.Fatalf("Failed to initialise storage engine: %v", err)
+	}
+	execution := kvstore.ActorExecution
+	if *direct {
+		execution = kvstore.DirectExecution
+	}
+
+	kv := kvstore.NewKeyValueService(context.Background(),
+		kvstore.WithEngine(engine),
+		kvstore.WithExecution(execution),
+		kvstore.WithConcurrentReads(*concurrentReads),
+	)
+	defer kv.Close()
+
+	keys := make([]string, *keySpace)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	value := strings.Repeat("x", *valueSize)
+	for _, key := range keys {
+		if _, err := kv.Set(key, value); err != nil {
+			log.Fatalf("Failed to preload key %s: %v", key, err)
+		}
+	}
+
+	run, err := operation(*op, kv, keys, value)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var ops atomic.Uint64
+	var errs atomic.Uint64
+	latencies := make([][]time.Duration, *concurrency)
+
+	var before runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	deadline := time.Now().Add(*duration)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for worker := range *concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := worker; time.Now().Before(deadline); i += *concurrency {
+				opStart := time.Now()
+				if err := run(i); err != nil {
+					errs.Add(1)
+				}
+				latencies[worker] = append(latencies[worker], time.Since(opStart))
+				ops.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+
+	all := slices.Concat(latencies...)
+	slices.Sort(all)
+	total := ops.Load()
+
+	fmt.Printf("op=%s engine=%s direct=%t concurrent-reads=%t concurrency=%d value-size=%d keys=%d\n",
+		*op, *engineName, *direct, *concurrentReads, *concurrency, *valueSize, *keySpace)
+	fmt.Printf("ops:        %d in %s (%d errors)\n", total, elapsed.Round(time.Millisecond), errs.Load())
+	fmt.Printf("throughput: %.0f ops/sec\n", float64(total)/elapsed.Seconds())
+	fmt.Printf("latency:    p50=%s p99=%s max=%s\n", percentile(all, 0.50), percentile(all, 0.99), percentile(all, 1))
+	fmt.Printf("allocs:     %.2f allocs/op, %.1f B/op\n",
+		float64(after.Mallocs-before.Mallocs)/float64(total), float64(after.TotalAlloc-before.TotalAlloc)/float64(total))
+}
+
+func operation(name string, kv *kvstore.KeyValueService, keys []string, value string) (func(i int) error, error) {
+	switch name {
+	case "set":
+		return func(i int) error {
+			_, err := kv.Set(keys[i%len(keys)], value)
+			return err
+		}, nil
+	case "get":
+		return func(i int) error {
+			_, err := kv.Get(keys[i%len(keys)])
+			return err
+		}, nil
+	case "delete":
+		// Re-set every deleted key so the keyspace stays populated
+		return func(i int) error {
+			key := keys[i%len(keys)]
+			if _, err := kv.Delete(key); err != nil {
+				return err
+			}
+			_, err := kv.Set(key, value)
+			return err
+		}, nil
+	case "mixed":
+		// 90% reads, 10% writes
+		return func(i int) error {
+			key := keys[i%len(keys)]
+			if i%10 == 0 {
+				_, err := kv.Set(key, value)
+				return err
+			}
+			_, err := kv.Get(key)
+			return err
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown operation %q", name)
+}
+
+func newStorageEngine(name string, dataDir string) (kvstore.StorageEngine, error) {
+	switch name {
+	case "memory":
+		return kvstore.NewMemoryEngine(), nil
+	case "disk":
+		return kvstore.NewDiskEngine(dataDir)
+	case "tiered":
+		cold, err := kvstore.NewDiskEngine(dataDir)
+		if err != nil {
+			return nil, err
+		}
+		return kvstore.NewTieredEngine(1000, cold), nil
+	case "sharded":
+		return kvstore.NewShardedEngine(kvstore.DefaultShardCount), nil
+	}
+	return nil, fmt.Errorf("unknown storage engine %q", name)
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(float64(len(sorted)-1) * p)
+	return sorted[idx]
+}
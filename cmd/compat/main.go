@@ -0,0 +1,63 @@
+package main
+
+import (
+	"blueis/internal/compat"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// compat runs a corpus of Redis commands against a blueis node's RESP
+// listener and a real Redis server, and reports every reply that differs
+// and how often each command matched. It exits with status 1 if a case
+// expected to match did not. Both servers should be scratch instances:
+// keys are prefixed per run, but not deleted afterwards.
+func main() {
+	blueisAddr := flag.String("blueis", "localhost:6380", "address of the blueis node's RESP listener (-resp-addr)")
+	redisAddr := flag.String("redis", "localhost:6379", "address of the Redis server to compare with")
+	corpusPath := flag.String("corpus", "", "file of cases to run (defaults to the corpus kept with the harness)")
+	prefix := flag.String("prefix", "", "prefix for the keys the cases use (defaults to one unique to the run)")
+	timeout := flag.Duration("timeout", 5*time.Second, "how long each server may take to answer a command")
+	flag.Parse()
+
+	var corpus io.Reader = strings.NewReader(compat.DefaultCorpus)
+	if *corpusPath != "" {
+		file, err := os.Open(*corpusPath)
+		if err != nil {
+			log.Fatalf("Failed to open corpus: %v", err)
+		}
+		defer file.Close()
+		corpus = file
+	}
+	cases, err := compat.ParseCorpus(corpus)
+	if err != nil {
+		log.Fatalf("Invalid corpus: %v", err)
+	}
+	if *prefix == "" {
+		*prefix = fmt.Sprintf("compat:%d:", time.Now().UnixNano())
+	}
+
+	blueis, err := compat.Dial(*blueisAddr, *timeout)
+	if err != nil {
+		log.Fatalf("Failed to connect to blueis: %v", err)
+	}
+	defer blueis.Close()
+	redis, err := compat.Dial(*redisAddr, *timeout)
+	if err != nil {
+		log.Fatalf("Failed to connect to Redis: %v", err)
+	}
+	defer redis.Close()
+
+	results, err := compat.Run(blueis, redis, cases, *prefix)
+	compat.WriteReport(os.Stdout, results)
+	if err != nil {
+		log.Fatalf("Run stopped early: %v", err)
+	}
+	if len(compat.Regressions(results)) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"blueis/cmd/coordinator/internal/backup"
+	"blueis/cmd/coordinator/internal/node"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type backupResponse struct {
+	Success bool              `json:"success"`
+	Backup  *backup.Manifest  `json:"backup,omitempty"`
+	Backups []backup.Manifest `json:"backups,omitempty"`
+	Error   string            `json:"error,omitempty"`
+}
+
+type restoreRequest struct {
+	ID string     `json:"id"`
+	At *time.Time `json:"at"`
+}
+
+// ringTopology returns the ring's epoch and ranges as backups record them.
+func ringTopology(mu *sync.RWMutex, ring *node.NodeService) func() (uint64, []backup.Range) {
+	return func() (uint64, []backup.Range) {
+		mu.RLock()
+		defer mu.RUnlock()
+		var ranges []backup.Range
+		for _, r := range ring.Ranges() {
+			ranges = append(ranges, backup.Range{Start: r.Start, End: r.End, Node: r.URL})
+		}
+		return ring.Epoch(), ranges
+	}
+}
+
+func backupStatus(err error) int {
+	switch {
+	case errors.Is(err, backup.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, backup.ErrTopologyChanged), errors.Is(err, backup.ErrIncrementalUnavailable),
+		errors.Is(err, backup.ErrNotArchived):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// handleBackup backs up the whole cluster, POST /admin/backup, replying
+// once every node's backup is stored with the backup's manifest. It lists
+// the backups taken so far, GET /admin/backup, or describes one,
+// GET /admin/backup?id=<id>. A backup taken while keys moved between nodes
+// is discarded and answered with 409.
+//
+// POST /admin/backup?incremental=true backs up only the keys changed since
+// the newest backup. It is answered with 409 when keys have moved since
+// that backup or a node no longer has every change since, and a full
+// backup has to be taken instead.
+func handleBackup(w http.ResponseWriter, r *http.Request, backups *backup.Store, topology func() (uint64, []backup.Range)) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case http.MethodGet:
+		if id := r.URL.Query().Get("id"); id != "" {
+			manifest, err := backups.Load(id)
+			if err != nil {
+				w.WriteHeader(backupStatus(err))
+				_ = json.NewEncoder(w).Encode(backupResponse{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+			_ = json.NewEncoder(w).Encode(backupResponse{
+				Success: true,
+				Backup:  &manifest,
+			})
+			return
+		}
+		manifests, err := backups.List()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_ = json.NewEncoder(w).Encode(backupResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(backupResponse{
+			Success: true,
+			Backups: manifests,
+		})
+	case http.MethodPost:
+		create := backups.Create
+		if r.URL.Query().Get("incremental") == "true" {
+			create = backups.CreateIncremental
+		}
+		manifest, err := create(topology)
+		if err != nil {
+			log.Printf("Backing up the cluster: %v", err)
+			w.WriteHeader(backupStatus(err))
+			_ = json.NewEncoder(w).Encode(backupResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return
+		}
+		keys := 0
+		for _, n := range manifest.Nodes {
+			keys += n.Keys
+		}
+		if manifest.Parent != "" {
+			log.Printf("Backed up %d keys changed on %d nodes since %s as %s", keys, len(manifest.Nodes), manifest.Parent, manifest.ID)
+		} else {
+			log.Printf("Backed up %d keys from %d nodes at epoch %d as %s", keys, len(manifest.Nodes), manifest.Epoch, manifest.ID)
+		}
+		_ = json.NewEncoder(w).Encode(backupResponse{
+			Success: true,
+			Backup:  &manifest,
+		})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(backupResponse{
+			Success: false,
+			Error:   "method not allowed",
+		})
+	}
+}
+
+// handleRestore puts every node back as it was in a backup:
+// POST /admin/restore {"id":"<id>"}, or as it was at a point in time:
+// POST /admin/restore {"at":"<RFC 3339 time>"}, which restores the newest
+// backup taken before then and replays the changes each node archived
+// since, and is answered with 409 if a node's change log does not cover
+// them. The ring must give each node the ranges it had when the backup
+// was taken; if not, or if a backup file is corrupt, no node is touched.
+// Clients should be held off until it replies.
+func handleRestore(w http.ResponseWriter, r *http.Request, backups *backup.Store, topology func() (uint64, []backup.Range)) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(backupResponse{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+	var req restoreRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.ID == "") == (req.At == nil) {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(backupResponse{
+			Success: false,
+			Error:   "body must be {\"id\":\"<backup id>\"} or {\"at\":\"<time>\"}",
+		})
+		return
+	}
+
+	var manifest backup.Manifest
+	var err error
+	if req.At != nil {
+		log.Printf("Restoring the cluster to %s", req.At.Format(time.RFC3339Nano))
+		manifest, err = backups.RestoreAt(*req.At, topology)
+		req.ID = manifest.ID
+	} else {
+		log.Printf("Restoring the cluster from backup %s", req.ID)
+		manifest, err = backups.Restore(req.ID, topology)
+	}
+	if err != nil {
+		log.Printf("Restoring backup %s: %v", req.ID, err)
+		w.WriteHeader(backupStatus(err))
+		_ = json.NewEncoder(w).Encode(backupResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+	log.Printf("Restored the cluster from backup %s", req.ID)
+	_ = json.NewEncoder(w).Encode(backupResponse{
+		Success: true,
+		Backup:  &manifest,
+	})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"blueis/cmd/coordinator/internal/flush"
+	"blueis/cmd/coordinator/internal/node"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+type flushRequest struct {
+	Token string `json:"token"`
+}
+
+type nodeFlushResult struct {
+	Node    string `json:"node"`
+	Deleted int    `json:"deleted"`
+	Error   string `json:"error,omitempty"`
+}
+
+type flushResponse struct {
+	Success bool `json:"success"`
+	// DryRun says nothing was flushed, and each result's Deleted is how many
+	// keys the node would have deleted
+	DryRun    bool              `json:"dryRun,omitempty"`
+	Token     string            `json:"token,omitempty"`
+	ExpiresMs int64             `json:"expiresMs,omitempty"`
+	Nodes     []string          `json:"nodes,omitempty"`
+	Results   []nodeFlushResult `json:"results,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// ringNodes returns the nodes owning keys on the ring.
+func ringNodes(mu *sync.RWMutex, ring *node.NodeService) []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	var nodes []string
+	for _, r := range ring.Ranges() {
+		nodes = append(nodes, r.URL)
+	}
+	return nodes
+}
+
+// parseDryRun reads the dryRun query parameter. A value that is not a
+// boolean is an error rather than false, so a mistyped dry run is refused
+// instead of carried out.
+func parseDryRun(r *http.Request) (bool, error) {
+	value := r.URL.Query().Get("dryRun")
+	if value == "" {
+		return false, nil
+	}
+	dryRun, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.New("'dryRun' must be true or false")
+	}
+	return dryRun, nil
+}
+
+// handleFlush deletes every key in the cluster, in two steps. POST
+// /admin/flush with no body replies with a token and the nodes that would
+// be flushed; POST /admin/flush {"token":"<token>"} within -flush-window
+// flushes them all and reports each node's result. A token can be used
+// once, and is refused if the ring's nodes changed since it was issued.
+// POST /admin/flush?dryRun=true flushes nothing and issues no token, but
+// reports how many keys each node would delete.
+func handleFlush(w http.ResponseWriter, r *http.Request, flusher *flush.Flusher, nodes func() []string) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(flushResponse{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+	var req flushRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(flushResponse{
+			Success: false,
+			Error:   "invalid JSON body",
+		})
+		return
+	}
+	dryRun, err := parseDryRun(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(flushResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+	if dryRun {
+		writeFlushResults(w, flusher.Preview(nodes()), true)
+		return
+	}
+
+	if req.Token == "" {
+		confirmation, err := flusher.Request(nodes())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_ = json.NewEncoder(w).Encode(flushResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return
+		}
+		log.Printf("Flush of %d nodes requested, awaiting confirmation until %s", len(confirmation.Nodes), confirmation.Expires.Format("15:04:05"))
+		_ = json.NewEncoder(w).Encode(flushResponse{
+			Success:   true,
+			Token:     confirmation.Token,
+			ExpiresMs: confirmation.Expires.UnixMilli(),
+			Nodes:     confirmation.Nodes,
+		})
+		return
+	}
+
+	results, err := flusher.Confirm(req.Token, nodes())
+	if err != nil {
+		status := http.StatusForbidden
+		if errors.Is(err, flush.ErrNodesChanged) {
+			status = http.StatusConflict
+		}
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(flushResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	writeFlushResults(w, results, false)
+}
+
+// writeFlushResults reports each node's result, with 207 if any failed.
+func writeFlushResults(w http.ResponseWriter, results []flush.Result, dryRun bool) {
+	res := flushResponse{Success: true, DryRun: dryRun, Results: make([]nodeFlushResult, len(results))}
+	failed, deleted := 0, 0
+	for i, result := range results {
+		res.Nodes = append(res.Nodes, result.Node)
+		res.Results[i] = nodeFlushResult{Node: result.Node, Deleted: result.Deleted}
+		deleted += result.Deleted
+		if result.Err != nil {
+			res.Results[i].Error = result.Err.Error()
+			failed++
+		}
+	}
+	if dryRun {
+		log.Printf("Dry run of a flush: %d keys would be deleted, %d of %d nodes failed", deleted, failed, len(results))
+	} else {
+		log.Printf("Flushed the cluster: %d keys deleted, %d of %d nodes failed", deleted, failed, len(results))
+	}
+	if failed > 0 {
+		res.Success = false
+		res.Error = fmt.Sprintf("%d of %d nodes failed", failed, len(results))
+		w.WriteHeader(http.StatusMultiStatus)
+	}
+	_ = json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"blueis/cmd/coordinator/internal/failover"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+type nodeHealthResponse struct {
+	Node        string `json:"node"`
+	Up          bool   `json:"up"`
+	SinceMs     int64  `json:"sinceMs"`
+	Flaps       int    `json:"flaps"`
+	Quarantined bool   `json:"quarantined"`
+}
+
+type healthResponse struct {
+	Success bool                 `json:"success"`
+	Nodes   []nodeHealthResponse `json:"nodes,omitempty"`
+	Error   string               `json:"error,omitempty"`
+}
+
+type readmitRequest struct {
+	Node string `json:"node"`
+}
+
+type readmitResponse struct {
+	Success    bool   `json:"success"`
+	Readmitted bool   `json:"readmitted"`
+	Error      string `json:"error,omitempty"`
+}
+
+// handleHealth lists the health of every node in a group with replicas, as
+// of the latest checks: GET /admin/health. Flaps counts the times a node
+// came back within -quarantine-window.
+func handleHealth(w http.ResponseWriter, r *http.Request, monitor *failover.Monitor) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(healthResponse{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	res := healthResponse{Success: true}
+	if monitor != nil {
+		for _, health := range monitor.Health() {
+			res.Nodes = append(res.Nodes, nodeHealthResponse{
+				Node:        health.Node,
+				Up:          health.Up,
+				SinceMs:     health.Since.UnixMilli(),
+				Flaps:       health.Flaps,
+				Quarantined: health.Quarantined,
+			})
+		}
+	}
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// handleReadmit lets a quarantined node be promoted and read from again:
+// POST /admin/readmit {"node":"http://replica:8080"}.
+func handleReadmit(w http.ResponseWriter, r *http.Request, monitor *failover.Monitor) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(readmitResponse{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+	var req readmitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Node == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(readmitResponse{
+			Success: false,
+			Error:   "body must be {\"node\":\"<base URL>\"}",
+		})
+		return
+	}
+
+	readmitted := monitor != nil && monitor.Readmit(strings.TrimRight(req.Node, "/"))
+	_ = json.NewEncoder(w).Encode(readmitResponse{
+		Success:    true,
+		Readmitted: readmitted,
+	})
+}
@@ -0,0 +1,492 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// manifestFile is the file in a backup's directory describing it. It is
+// written last, so a directory without one holds an unfinished backup.
+const manifestFile = "manifest.json"
+
+var (
+	// ErrTopologyChanged is returned when ownership of keys changed while a
+	// backup was taken, or differs from the backup's when restoring it.
+	ErrTopologyChanged = errors.New("topology changed")
+	ErrNotFound        = errors.New("backup not found")
+	// ErrIncrementalUnavailable is returned when a node no longer has every
+	// change since the backup an incremental one was to follow, because it
+	// restarted or made more changes than it keeps, and a full backup has
+	// to be taken instead.
+	ErrIncrementalUnavailable = errors.New("incremental backup unavailable")
+	// ErrNotArchived is returned when restoring to a point in time and a
+	// node's change log does not cover the time since the backup.
+	ErrNotArchived = errors.New("changes since the backup are not archived")
+)
+
+// Snapshot describes a node's backup.
+type Snapshot struct {
+	Keys int
+	// At is when the node took the snapshot the backup was made from
+	At time.Time
+	// Run and Offset are the node's position as of the backup, which an
+	// incremental backup after it starts from
+	Run    string
+	Offset uint64
+}
+
+// Node is a node whose data can be backed up and restored.
+type Node interface {
+	// Backup writes a snapshot of the node's data to w
+	Backup(w io.Writer) (Snapshot, error)
+	// BackupSince writes the keys changed since the backup taken at run
+	// and offset to w, or fails with ErrIncrementalUnavailable
+	BackupSince(w io.Writer, run string, offset uint64) (Snapshot, error)
+	// Restore replaces the node's data with a backup read from r and
+	// returns how many keys it restored
+	Restore(r io.Reader) (int, error)
+	// Apply applies an incremental backup read from r to the node's data
+	// and returns how many keys it changed
+	Apply(r io.Reader) (int, error)
+	// Replay applies the changes the node archived after run and offset,
+	// up to until, and returns how many it applied
+	Replay(run string, offset uint64, until time.Time) (int, error)
+}
+
+// Range is the keys whose hash lies in (Start, End] and the node owning
+// them.
+type Range struct {
+	Start uint32 `json:"start"`
+	End   uint32 `json:"end"`
+	Node  string `json:"node"`
+}
+
+// NodeBackup is a node's part of a backup, kept in File within the
+// backup's directory.
+type NodeBackup struct {
+	Node       string    `json:"node"`
+	File       string    `json:"file"`
+	Keys       int       `json:"keys"`
+	Bytes      int64     `json:"bytes"`
+	SHA256     string    `json:"sha256"`
+	SnapshotAt time.Time `json:"snapshotAt"`
+	Run        string    `json:"run,omitempty"`
+	Offset     uint64    `json:"offset,omitempty"`
+}
+
+// Manifest describes a backup of the whole cluster: the topology it was
+// taken at, and each node's part of it. An incremental backup holds only
+// the keys changed since Parent, the backup before it, and is restored on
+// top of the chain of backups back to Base, the full backup it started
+// from.
+type Manifest struct {
+	ID      string       `json:"id"`
+	Created time.Time    `json:"created"`
+	Epoch   uint64       `json:"epoch"`
+	Ranges  []Range      `json:"ranges"`
+	Nodes   []NodeBackup `json:"nodes"`
+	Parent  string       `json:"parent,omitempty"`
+	Base    string       `json:"base,omitempty"`
+}
+
+// backupFunc writes a node's part of a backup to w.
+type backupFunc func(node Node, w io.Writer, backup NodeBackup) (Snapshot, error)
+
+// Store keeps backups of the cluster, each in its own directory under dir.
+// It takes one backup or restore at a time.
+type Store struct {
+	dir  string
+	dial func(address string) Node
+	now  func() time.Time
+
+	mu sync.Mutex
+}
+
+func NewStore(dir string, dial func(address string) Node) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir, dial: dial, now: time.Now}, nil
+}
+
+// Create backs up every node owning keys, asking them all at once so their
+// snapshots are taken at about the same point. topology returns the ring's
+// epoch and ranges; it is read before and after, and the backup is thrown
+// away with ErrTopologyChanged if keys changed hands in between, since a
+// moved range could then be missing from both nodes' snapshots or in both.
+func (store *Store) Create(topology func() (uint64, []Range)) (Manifest, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	epoch, ranges := topology()
+	manifest := store.newManifest(epoch, ranges)
+	for _, r := range ranges {
+		if !slices.ContainsFunc(manifest.Nodes, func(n NodeBackup) bool { return n.Node == r.Node }) {
+			manifest.Nodes = append(manifest.Nodes, NodeBackup{
+				Node: r.Node,
+				File: fmt.Sprintf("node-%d.backup", len(manifest.Nodes)),
+			})
+		}
+	}
+	return store.take(manifest, topology, func(node Node, w io.Writer, _ NodeBackup) (Snapshot, error) {
+		return node.Backup(w)
+	})
+}
+
+// CreateIncremental backs up the keys each node changed since the newest
+// backup, as Create does. The ring must give each node the ranges it had
+// then, as keys that moved since would be in neither; if it does not, or
+// a node no longer has every change since, a full backup has to be taken
+// instead.
+func (store *Store) CreateIncremental(topology func() (uint64, []Range)) (Manifest, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	manifests, err := store.list()
+	if err != nil {
+		return Manifest{}, err
+	}
+	if len(manifests) == 0 {
+		return Manifest{}, fmt.Errorf("%w: an incremental backup needs a backup to follow", ErrNotFound)
+	}
+	parent := manifests[len(manifests)-1]
+	epoch, ranges := topology()
+	if !slices.Equal(ranges, parent.Ranges) {
+		return Manifest{}, fmt.Errorf("%w since backup %s, taken at epoch %d", ErrTopologyChanged, parent.ID, parent.Epoch)
+	}
+
+	manifest := store.newManifest(epoch, ranges)
+	manifest.Parent, manifest.Base = parent.ID, parent.Base
+	if manifest.Base == "" {
+		manifest.Base = parent.ID
+	}
+	for _, backup := range parent.Nodes {
+		manifest.Nodes = append(manifest.Nodes, NodeBackup{Node: backup.Node, File: backup.File, Run: backup.Run, Offset: backup.Offset})
+	}
+	return store.take(manifest, topology, func(node Node, w io.Writer, since NodeBackup) (Snapshot, error) {
+		return node.BackupSince(w, since.Run, since.Offset)
+	})
+}
+
+func (store *Store) newManifest(epoch uint64, ranges []Range) Manifest {
+	created := store.now().UTC()
+	return Manifest{
+		ID:      created.Format("20060102T150405.000Z"),
+		Created: created,
+		Epoch:   epoch,
+		Ranges:  ranges,
+	}
+}
+
+// take backs up every node in manifest with backup, and writes the
+// manifest once all of them are stored.
+func (store *Store) take(manifest Manifest, topology func() (uint64, []Range), backup backupFunc) (Manifest, error) {
+	epoch := manifest.Epoch
+	dir := filepath.Join(store.dir, manifest.ID)
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		return Manifest{}, err
+	}
+	errs := make([]error, len(manifest.Nodes))
+	var wg sync.WaitGroup
+	for i := range manifest.Nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := store.backupNode(dir, &manifest.Nodes[i], backup); err != nil {
+				errs[i] = fmt.Errorf("backing up %s: %w", manifest.Nodes[i].Node, err)
+			}
+		}()
+	}
+	wg.Wait()
+	err := errors.Join(errs...)
+	if after, _ := topology(); err == nil && after != epoch {
+		err = fmt.Errorf("%w from epoch %d to %d during the backup", ErrTopologyChanged, epoch, after)
+	}
+	if err == nil {
+		err = writeManifest(dir, manifest)
+	}
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return Manifest{}, err
+	}
+	return manifest, nil
+}
+
+func (store *Store) backupNode(dir string, backup *NodeBackup, take backupFunc) error {
+	file, err := os.Create(filepath.Join(dir, backup.File))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(file, hash)}
+	snapshot, err := take(store.dial(backup.Node), counter, *backup)
+	if err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	backup.Keys = snapshot.Keys
+	backup.SnapshotAt = snapshot.At
+	backup.Run, backup.Offset = snapshot.Run, snapshot.Offset
+	backup.Bytes = counter.n
+	backup.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return nil
+}
+
+// Restore puts every node back as it was in the backup id. The ring must
+// give each node the ranges it had when the backup was taken, as otherwise
+// keys would be restored to nodes that no longer own them; topology
+// returns the ring's epoch and ranges. An incremental backup is restored
+// by restoring its base and applying each incremental after it in turn.
+// Every file is checked against its manifest's checksum before any node
+// is touched. Clients should be held off while the cluster is restored.
+func (store *Store) Restore(id string, topology func() (uint64, []Range)) (Manifest, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.restore(id, topology, time.Time{})
+}
+
+// RestoreAt puts every node back as it was at a point in time: it restores
+// the newest backup taken before then, as Restore does, then has each node
+// replay the changes it archived since the backup up to at. Every node
+// must keep a change log covering the time since that backup.
+func (store *Store) RestoreAt(at time.Time, topology func() (uint64, []Range)) (Manifest, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	manifests, err := store.list()
+	if err != nil {
+		return Manifest{}, err
+	}
+	var id string
+	for _, manifest := range manifests {
+		if takenBy(manifest, at) {
+			id = manifest.ID
+		}
+	}
+	if id == "" {
+		return Manifest{}, fmt.Errorf("%w: no backup was taken before %s", ErrNotFound, at.UTC().Format(time.RFC3339Nano))
+	}
+	return store.restore(id, topology, at)
+}
+
+// takenBy reports whether every node's part of a backup was taken by at.
+func takenBy(manifest Manifest, at time.Time) bool {
+	for _, backup := range manifest.Nodes {
+		if backup.SnapshotAt.After(at) {
+			return false
+		}
+	}
+	return len(manifest.Nodes) > 0
+}
+
+// restore restores the backup id, then, unless until is zero, replays each
+// node's changes after it up to until.
+func (store *Store) restore(id string, topology func() (uint64, []Range), until time.Time) (Manifest, error) {
+	chain, err := store.chain(id)
+	if err != nil {
+		return Manifest{}, err
+	}
+	manifest := chain[len(chain)-1]
+	if _, ranges := topology(); !slices.Equal(ranges, manifest.Ranges) {
+		return Manifest{}, fmt.Errorf("%w: the ring no longer matches backup %s, taken at epoch %d", ErrTopologyChanged, id, manifest.Epoch)
+	}
+	for _, link := range chain {
+		for _, backup := range link.Nodes {
+			if err := verify(filepath.Join(store.dir, link.ID, backup.File), backup.SHA256); err != nil {
+				return Manifest{}, fmt.Errorf("backup %s of %s: %w", link.ID, backup.Node, err)
+			}
+		}
+	}
+
+	errs := make([]error, len(manifest.Nodes))
+	var wg sync.WaitGroup
+	for i, backup := range manifest.Nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := store.restoreNode(chain, backup.Node); err != nil {
+				errs[i] = fmt.Errorf("restoring %s: %w", backup.Node, err)
+				return
+			}
+			if until.IsZero() {
+				return
+			}
+			if _, err := store.dial(backup.Node).Replay(backup.Run, backup.Offset, until); err != nil {
+				errs[i] = fmt.Errorf("replaying %s up to %s: %w", backup.Node, until.UTC().Format(time.RFC3339Nano), err)
+			}
+		}()
+	}
+	wg.Wait()
+	return manifest, errors.Join(errs...)
+}
+
+// chain returns the backups restoring id takes, from its base to id.
+func (store *Store) chain(id string) ([]Manifest, error) {
+	var chain []Manifest
+	for {
+		manifest, err := store.load(id)
+		if err != nil {
+			if len(chain) > 0 {
+				return nil, fmt.Errorf("backup %s follows %s: %w", chain[0].ID, id, err)
+			}
+			return nil, err
+		}
+		chain = append([]Manifest{manifest}, chain...)
+		if manifest.Parent == "" {
+			return chain, nil
+		}
+		id = manifest.Parent
+	}
+}
+
+// restoreNode restores node's part of the first backup in chain, then
+// applies its part of each one after.
+func (store *Store) restoreNode(chain []Manifest, node string) error {
+	for link, manifest := range chain {
+		i := slices.IndexFunc(manifest.Nodes, func(n NodeBackup) bool { return n.Node == node })
+		if i < 0 {
+			return fmt.Errorf("backup %s has nothing of %s", manifest.ID, node)
+		}
+		file, err := os.Open(filepath.Join(store.dir, manifest.ID, manifest.Nodes[i].File))
+		if err != nil {
+			return err
+		}
+		if link == 0 {
+			_, err = store.dial(node).Restore(file)
+		} else {
+			_, err = store.dial(node).Apply(file)
+		}
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("backup %s: %w", manifest.ID, err)
+		}
+	}
+	return nil
+}
+
+// Load returns the manifest of the backup id.
+func (store *Store) Load(id string) (Manifest, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.load(id)
+}
+
+func (store *Store) load(id string) (Manifest, error) {
+	// Backups are only looked for in the store's own directory
+	if id == "" || id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+		return Manifest{}, fmt.Errorf("%w: %q", ErrNotFound, id)
+	}
+	data, err := os.ReadFile(filepath.Join(store.dir, id, manifestFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return Manifest{}, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	if err != nil {
+		return Manifest{}, err
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return Manifest{}, fmt.Errorf("decoding manifest of %s: %w", id, err)
+	}
+	return manifest, nil
+}
+
+// List returns the manifests of every finished backup, oldest first.
+func (store *Store) List() ([]Manifest, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.list()
+}
+
+func (store *Store) list() ([]Manifest, error) {
+	entries, err := os.ReadDir(store.dir)
+	if err != nil {
+		return nil, err
+	}
+	var manifests []Manifest
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		manifest, err := store.load(entry.Name())
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, manifest)
+	}
+	slices.SortFunc(manifests, func(a, b Manifest) int {
+		return a.Created.Compare(b.Created)
+	})
+	return manifests, nil
+}
+
+// writeManifest writes manifest into dir, through a temporary file so a
+// crash never leaves a torn one.
+func writeManifest(dir string, manifest Manifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, manifestFile))
+}
+
+// verify checks that the file at path has the SHA-256 checksum want.
+func verify(path string, want string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); got != want {
+		return fmt.Errorf("%s has checksum %s, want %s", filepath.Base(path), got, want)
+	}
+	return nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (writer *countingWriter) Write(p []byte) (int, error) {
+	n, err := writer.w.Write(p)
+	writer.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,329 @@
+package backup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNode backs up its data as is and restores whatever it is sent. Its
+// incremental backups hold changes, and each takes its offset one further.
+type fakeNode struct {
+	mu       sync.Mutex
+	data     string
+	changes  string
+	restored string
+	applied  []string
+	// since is the offset the last incremental backup followed
+	since uint64
+	// restarted makes incremental backups unavailable
+	restarted bool
+	// replayed records the replays asked for, and unarchived fails them
+	replayed   []string
+	unarchived bool
+	// during runs while the node is being backed up
+	during func()
+}
+
+func (node *fakeNode) Backup(w io.Writer) (Snapshot, error) {
+	if node.during != nil {
+		node.during()
+	}
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if _, err := io.WriteString(w, node.data); err != nil {
+		return Snapshot{}, err
+	}
+	return Snapshot{Keys: len(node.data), At: time.Unix(100, 0), Run: "run", Offset: 1}, nil
+}
+
+func (node *fakeNode) BackupSince(w io.Writer, run string, offset uint64) (Snapshot, error) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if node.restarted || run != "run" {
+		return Snapshot{}, ErrIncrementalUnavailable
+	}
+	node.since = offset
+	if _, err := io.WriteString(w, node.changes); err != nil {
+		return Snapshot{}, err
+	}
+	return Snapshot{Keys: len(node.changes), At: time.Unix(200, 0), Run: run, Offset: offset + 1}, nil
+}
+
+func (node *fakeNode) Apply(r io.Reader) (int, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.applied = append(node.applied, string(data))
+	return len(data), nil
+}
+
+func (node *fakeNode) Replay(run string, offset uint64, until time.Time) (int, error) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if node.unarchived {
+		return 0, ErrNotArchived
+	}
+	node.replayed = append(node.replayed, fmt.Sprintf("%s/%d until %d", run, offset, until.Unix()))
+	return 1, nil
+}
+
+func (node *fakeNode) Restore(r io.Reader) (int, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.restored = string(data)
+	return len(data), nil
+}
+
+// testRing is a ring of nodes a and b at an epoch that can be changed.
+type testRing struct {
+	mu     sync.Mutex
+	epoch  uint64
+	ranges []Range
+}
+
+func (ring *testRing) topology() (uint64, []Range) {
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+	return ring.epoch, append([]Range(nil), ring.ranges...)
+}
+
+func newTestStore(t *testing.T) (*Store, map[string]*fakeNode, *testRing) {
+	t.Helper()
+	nodes := map[string]*fakeNode{"a": {data: "aaa"}, "b": {data: "bbbbb"}}
+	store, err := NewStore(t.TempDir(), func(address string) Node { return nodes[address] })
+	if err != nil {
+		t.Fatalf("NewStore returned error: %v", err)
+	}
+	ring := &testRing{epoch: 7, ranges: []Range{{0, 100, "a"}, {100, 200, "b"}, {200, 0, "a"}}}
+	return store, nodes, ring
+}
+
+func TestStore_BacksUpEveryNodeWithAManifest(t *testing.T) {
+	store, _, ring := newTestStore(t)
+
+	manifest, err := store.Create(ring.topology)
+	if err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	if manifest.Epoch != 7 || len(manifest.Ranges) != 3 || len(manifest.Nodes) != 2 {
+		t.Fatalf("Create = %+v, want epoch 7, the ring's 3 ranges and a backup of each of its 2 nodes", manifest)
+	}
+	for _, backup := range manifest.Nodes {
+		data, err := os.ReadFile(filepath.Join(store.dir, manifest.ID, backup.File))
+		if err != nil {
+			t.Fatalf("reading the backup of %s: %v", backup.Node, err)
+		}
+		if want := strings.Repeat(backup.Node, backup.Keys); string(data) != want || backup.Bytes != int64(len(want)) {
+			t.Fatalf("backup of %s holds %q in %d bytes, want %q", backup.Node, data, backup.Bytes, want)
+		}
+		if len(backup.SHA256) != 64 || !backup.SnapshotAt.Equal(time.Unix(100, 0)) {
+			t.Fatalf("backup of %s = %+v, want a checksum and the snapshot time", backup.Node, backup)
+		}
+	}
+
+	listed, err := store.List()
+	if err != nil || len(listed) != 1 || listed[0].ID != manifest.ID {
+		t.Fatalf("List = %+v, %v, want the backup just taken", listed, err)
+	}
+}
+
+func TestStore_DiscardsBackupsTakenWhileTheTopologyChanged(t *testing.T) {
+	store, nodes, ring := newTestStore(t)
+	nodes["b"].during = func() {
+		ring.mu.Lock()
+		ring.epoch++
+		ring.mu.Unlock()
+	}
+
+	if _, err := store.Create(ring.topology); !errors.Is(err, ErrTopologyChanged) {
+		t.Fatalf("Create returned %v, want ErrTopologyChanged", err)
+	}
+	if listed, _ := store.List(); len(listed) != 0 {
+		t.Fatalf("List = %+v, want no backups", listed)
+	}
+	if entries, _ := os.ReadDir(store.dir); len(entries) != 0 {
+		t.Fatalf("backup directory holds %d entries, want the unfinished backup removed", len(entries))
+	}
+}
+
+func TestStore_RestoresEveryNode(t *testing.T) {
+	store, nodes, ring := newTestStore(t)
+	manifest, err := store.Create(ring.topology)
+	if err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+
+	// Epochs move on, but the ring gives each node the same ranges
+	ring.epoch = 12
+	if _, err := store.Restore(manifest.ID, ring.topology); err != nil {
+		t.Fatalf("Restore returned error: %v", err)
+	}
+	if nodes["a"].restored != "aaa" || nodes["b"].restored != "bbbbb" {
+		t.Fatalf("restored a=%q b=%q, want each node's own backup", nodes["a"].restored, nodes["b"].restored)
+	}
+}
+
+func TestStore_RefusesToRestoreToAChangedRing(t *testing.T) {
+	store, nodes, ring := newTestStore(t)
+	manifest, err := store.Create(ring.topology)
+	if err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+
+	ring.ranges[1].Node = "a"
+	if _, err := store.Restore(manifest.ID, ring.topology); !errors.Is(err, ErrTopologyChanged) {
+		t.Fatalf("Restore returned %v, want ErrTopologyChanged", err)
+	}
+	if nodes["a"].restored != "" || nodes["b"].restored != "" {
+		t.Fatalf("a node was restored to a ring that no longer matches the backup")
+	}
+}
+
+func TestStore_RefusesToRestoreCorruptBackups(t *testing.T) {
+	store, nodes, ring := newTestStore(t)
+	manifest, err := store.Create(ring.topology)
+	if err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	path := filepath.Join(store.dir, manifest.ID, manifest.Nodes[1].File)
+	if err := os.WriteFile(path, bytes.ToUpper([]byte(nodes["b"].data)), 0o644); err != nil {
+		t.Fatalf("corrupting the backup: %v", err)
+	}
+
+	if _, err := store.Restore(manifest.ID, ring.topology); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("Restore returned %v, want a checksum error", err)
+	}
+	// No node is restored unless every backup is intact
+	if nodes["a"].restored != "" {
+		t.Fatalf("a was restored although b's backup is corrupt")
+	}
+}
+
+func TestStore_LoadsOnlyItsOwnBackups(t *testing.T) {
+	store, _, _ := newTestStore(t)
+	for _, id := range []string{"", "..", "../other", "missing"} {
+		if _, err := store.Load(id); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Load(%q) returned %v, want ErrNotFound", id, err)
+		}
+	}
+}
+
+func TestStore_ChainsIncrementalBackupsToTheirBase(t *testing.T) {
+	store, nodes, ring := newTestStore(t)
+	base, err := store.Create(ring.topology)
+	if err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+
+	nodes["a"].changes, nodes["b"].changes = "1", "22"
+	store.now = func() time.Time { return time.Now().Add(time.Second) }
+	first, err := store.CreateIncremental(ring.topology)
+	if err != nil {
+		t.Fatalf("CreateIncremental returned error: %v", err)
+	}
+	nodes["a"].changes, nodes["b"].changes = "3", ""
+	store.now = func() time.Time { return time.Now().Add(2 * time.Second) }
+	second, err := store.CreateIncremental(ring.topology)
+	if err != nil {
+		t.Fatalf("CreateIncremental returned error: %v", err)
+	}
+	if first.Parent != base.ID || first.Base != base.ID || second.Parent != first.ID || second.Base != base.ID {
+		t.Fatalf("incrementals follow %s and %s from %s and %s, want a chain from %s", first.Parent, second.Parent, first.Base, second.Base, base.ID)
+	}
+	// Each incremental carries on from where the one before left off
+	if nodes["a"].since != 2 || second.Nodes[0].Offset != 3 || second.Nodes[0].Keys != 1 {
+		t.Fatalf("second incremental of a followed offset %d = %+v, want to follow 2 up to 3", nodes["a"].since, second.Nodes[0])
+	}
+
+	if _, err := store.Restore(second.ID, ring.topology); err != nil {
+		t.Fatalf("Restore returned error: %v", err)
+	}
+	if nodes["a"].restored != "aaa" || strings.Join(nodes["a"].applied, ",") != "1,3" {
+		t.Fatalf("a restored %q then applied %q, want the base then both incrementals", nodes["a"].restored, nodes["a"].applied)
+	}
+	if nodes["b"].restored != "bbbbb" || strings.Join(nodes["b"].applied, ",") != "22," {
+		t.Fatalf("b restored %q then applied %q, want the base then both incrementals", nodes["b"].restored, nodes["b"].applied)
+	}
+}
+
+func TestStore_IncrementalBackupsNeedTheirChanges(t *testing.T) {
+	store, nodes, ring := newTestStore(t)
+	if _, err := store.CreateIncremental(ring.topology); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("CreateIncremental without a backup returned %v, want ErrNotFound", err)
+	}
+	if _, err := store.Create(ring.topology); err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+
+	nodes["b"].restarted = true
+	store.now = func() time.Time { return time.Now().Add(time.Second) }
+	if _, err := store.CreateIncremental(ring.topology); !errors.Is(err, ErrIncrementalUnavailable) {
+		t.Fatalf("CreateIncremental after a restart returned %v, want ErrIncrementalUnavailable", err)
+	}
+	nodes["b"].restarted = false
+	ring.ranges[1].Node = "a"
+	if _, err := store.CreateIncremental(ring.topology); !errors.Is(err, ErrTopologyChanged) {
+		t.Fatalf("CreateIncremental after keys moved returned %v, want ErrTopologyChanged", err)
+	}
+	if listed, _ := store.List(); len(listed) != 1 {
+		t.Fatalf("List = %+v, want only the full backup", listed)
+	}
+}
+
+func TestStore_RestoresToAPointInTime(t *testing.T) {
+	store, nodes, ring := newTestStore(t)
+	if _, err := store.RestoreAt(time.Unix(150, 0), ring.topology); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("RestoreAt without a backup returned %v, want ErrNotFound", err)
+	}
+	base, err := store.Create(ring.topology)
+	if err != nil {
+		t.Fatalf("Create returned error: %v", err)
+	}
+	nodes["a"].changes, nodes["b"].changes = "1", "22"
+	store.now = func() time.Time { return time.Now().Add(time.Second) }
+	if _, err := store.CreateIncremental(ring.topology); err != nil {
+		t.Fatalf("CreateIncremental returned error: %v", err)
+	}
+
+	// The incremental was snapshotted at 200, after the time asked for
+	restored, err := store.RestoreAt(time.Unix(150, 0), ring.topology)
+	if err != nil {
+		t.Fatalf("RestoreAt returned error: %v", err)
+	}
+	if restored.ID != base.ID || len(nodes["a"].applied) != 0 {
+		t.Fatalf("RestoreAt restored %s and applied %q, want only the full backup %s", restored.ID, nodes["a"].applied, base.ID)
+	}
+	if got := strings.Join(nodes["a"].replayed, ","); got != "run/1 until 150" {
+		t.Fatalf("a replayed %q, want the changes after the full backup up to 150", got)
+	}
+
+	if _, err := store.RestoreAt(time.Unix(250, 0), ring.topology); err != nil {
+		t.Fatalf("RestoreAt returned error: %v", err)
+	}
+	if got := nodes["b"].replayed[1]; got != "run/2 until 250" || strings.Join(nodes["b"].applied, ",") != "22" {
+		t.Fatalf("b applied %q and replayed %q, want the incremental then the changes after it", nodes["b"].applied, got)
+	}
+
+	if _, err := store.RestoreAt(time.Unix(50, 0), ring.topology); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("RestoreAt before every backup returned %v, want ErrNotFound", err)
+	}
+	nodes["a"].unarchived = true
+	if _, err := store.RestoreAt(time.Unix(250, 0), ring.topology); !errors.Is(err, ErrNotArchived) {
+		t.Fatalf("RestoreAt without the changes archived returned %v, want ErrNotArchived", err)
+	}
+}
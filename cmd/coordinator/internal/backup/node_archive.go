@@ -0,0 +1,122 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	backupKeysTrailer  = "X-Blueis-Backup-Keys"
+	backupTimeHeader   = "X-Blueis-Backup-Time"
+	backupRunHeader    = "X-Blueis-Backup-Run"
+	backupOffsetHeader = "X-Blueis-Backup-Offset"
+)
+
+// NodeArchive is a Node backed by a blueis node's /backup routes.
+type NodeArchive struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewNodeArchive(baseURL string, client *http.Client) *NodeArchive {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &NodeArchive{baseURL, client}
+}
+
+type nodeRestoreResponse struct {
+	Success bool   `json:"success"`
+	Keys    int    `json:"keys"`
+	Error   string `json:"error,omitempty"`
+	Code    string `json:"code,omitempty"`
+}
+
+func (archive *NodeArchive) Backup(w io.Writer) (Snapshot, error) {
+	return archive.backup(w, "/backup")
+}
+
+func (archive *NodeArchive) BackupSince(w io.Writer, run string, offset uint64) (Snapshot, error) {
+	query := url.Values{"run": {run}, "since": {strconv.FormatUint(offset, 10)}}
+	return archive.backup(w, "/backup?"+query.Encode())
+}
+
+func (archive *NodeArchive) backup(w io.Writer, path string) (Snapshot, error) {
+	resp, err := archive.client.Get(archive.baseURL + path)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var res nodeRestoreResponse
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			return Snapshot{}, fmt.Errorf("decoding response from %s: %w", archive.baseURL, err)
+		}
+		if res.Code == "CHANGES_UNAVAILABLE" {
+			return Snapshot{}, fmt.Errorf("%w: %s: %s", ErrIncrementalUnavailable, archive.baseURL, res.Error)
+		}
+		return Snapshot{}, fmt.Errorf("%s: %s", archive.baseURL, res.Error)
+	}
+	at, err := time.Parse(time.RFC3339Nano, resp.Header.Get(backupTimeHeader))
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("%s sent no snapshot time: %w", archive.baseURL, err)
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return Snapshot{}, err
+	}
+	// The trailer is only sent once every key has been
+	keys, err := strconv.Atoi(resp.Trailer.Get(backupKeysTrailer))
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("%s stopped before the end of its backup", archive.baseURL)
+	}
+	offset, _ := strconv.ParseUint(resp.Header.Get(backupOffsetHeader), 10, 64)
+	return Snapshot{Keys: keys, At: at, Run: resp.Header.Get(backupRunHeader), Offset: offset}, nil
+}
+
+func (archive *NodeArchive) Restore(r io.Reader) (int, error) {
+	return archive.restore(r, "/backup/restore", "application/octet-stream")
+}
+
+func (archive *NodeArchive) Apply(r io.Reader) (int, error) {
+	return archive.restore(r, "/backup/restore?incremental=true", "application/octet-stream")
+}
+
+func (archive *NodeArchive) restore(r io.Reader, path string, contentType string) (int, error) {
+	resp, err := archive.client.Post(archive.baseURL+path, contentType, r)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var res nodeRestoreResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return 0, fmt.Errorf("decoding response from %s: %w", archive.baseURL, err)
+	}
+	if !res.Success {
+		if res.Code == "NOT_COVERED" {
+			return res.Keys, fmt.Errorf("%w: %s: %s", ErrNotArchived, archive.baseURL, res.Error)
+		}
+		return res.Keys, fmt.Errorf("%s: %s", archive.baseURL, res.Error)
+	}
+	return res.Keys, nil
+}
+
+type nodeReplayRequest struct {
+	Run   string    `json:"run"`
+	Since uint64    `json:"since"`
+	Until time.Time `json:"until"`
+}
+
+func (archive *NodeArchive) Replay(run string, offset uint64, until time.Time) (int, error) {
+	body, err := json.Marshal(nodeReplayRequest{Run: run, Since: offset, Until: until})
+	if err != nil {
+		return 0, err
+	}
+	return archive.restore(bytes.NewReader(body), "/backup/replay", "application/json")
+}
@@ -0,0 +1,112 @@
+package failover
+
+import (
+	"log"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Quarantine says when a node that keeps going down and coming back is
+// kept out of promotion and replica reads, so a flapping node cannot drag
+// its group through failover after failover.
+type Quarantine struct {
+	// Flaps is how many times a node must come back up within Window to be
+	// quarantined; 0 disables quarantine
+	Flaps  int
+	Window time.Duration
+	// After is how long a quarantined node must then stay up before it is
+	// readmitted; 0 leaves readmission to Readmit
+	After time.Duration
+}
+
+// NodeHealth is a node's recent health as the monitor has seen it.
+type NodeHealth struct {
+	Node string
+	Up   bool
+	// Since is when the node last went up or down
+	Since time.Time
+	// Flaps counts the times it came back up within the quarantine window
+	Flaps       int
+	Quarantined bool
+}
+
+type health struct {
+	up    bool
+	since time.Time
+	// recoveries are the times the node came back up, oldest first
+	recoveries  []time.Time
+	quarantined bool
+}
+
+// observe records whether node answered a health check, quarantining or
+// readmitting it as the policy says. The caller must hold mu.
+func (monitor *Monitor) observe(node string, up bool) {
+	now := monitor.now()
+	h, seen := monitor.health[node]
+	if !seen {
+		h = &health{up: up, since: now}
+		monitor.health[node] = h
+	}
+	policy := monitor.quarantine
+
+	if seen && up != h.up {
+		h.up, h.since = up, now
+		if up {
+			h.recoveries = append(h.recoveries, now)
+		}
+	}
+	h.recoveries = slices.DeleteFunc(h.recoveries, func(at time.Time) bool {
+		return now.Sub(at) > policy.Window
+	})
+
+	switch {
+	case policy.Flaps <= 0:
+	case !h.quarantined && len(h.recoveries) >= policy.Flaps:
+		h.quarantined = true
+		log.Printf("Quarantined %s after it came back %d times within %v", node, len(h.recoveries), policy.Window)
+	case h.quarantined && h.up && policy.After > 0 && now.Sub(h.since) >= policy.After:
+		h.quarantined = false
+		h.recoveries = nil
+		log.Printf("Readmitted %s after %v up", node, policy.After)
+	}
+}
+
+// quarantined reports whether node is quarantined. The caller must hold
+// mu.
+func (monitor *Monitor) quarantined(node string) bool {
+	h, ok := monitor.health[node]
+	return ok && h.quarantined
+}
+
+// Readmit lets a quarantined node be promoted and read from again, and
+// forgets its flaps. It reports whether node was quarantined.
+func (monitor *Monitor) Readmit(node string) bool {
+	monitor.mu.Lock()
+	defer monitor.mu.Unlock()
+
+	h, ok := monitor.health[node]
+	if !ok || !h.quarantined {
+		return false
+	}
+	h.quarantined = false
+	h.recoveries = nil
+	log.Printf("Readmitted %s", node)
+	return true
+}
+
+// Health returns the health of every node the monitor has checked, sorted
+// by node.
+func (monitor *Monitor) Health() []NodeHealth {
+	monitor.mu.RLock()
+	defer monitor.mu.RUnlock()
+
+	nodes := make([]NodeHealth, 0, len(monitor.health))
+	for node, h := range monitor.health {
+		nodes = append(nodes, NodeHealth{node, h.up, h.since, len(h.recoveries), h.quarantined})
+	}
+	slices.SortFunc(nodes, func(a, b NodeHealth) int {
+		return strings.Compare(a.Node, b.Node)
+	})
+	return nodes
+}
@@ -0,0 +1,249 @@
+package failover
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+const (
+	RolePrimary = "primary"
+	RoleReplica = "replica"
+)
+
+// Status is what a node reports about its part in replication.
+type Status struct {
+	Role string
+	// Primary is the node a replica follows
+	Primary string
+	// PrimaryReplicationID and PrimaryOffset say how far a replica has
+	// caught up with its primary; offsets are only comparable between
+	// replicas reporting the same ID
+	PrimaryReplicationID string
+	PrimaryOffset        uint64
+	// Synced is false while a replica is still copying its primary's data
+	Synced bool
+	// Lag counts the changes a replica has yet to apply, and LagSeconds is
+	// how long ago it last had all of them
+	Lag        uint64
+	LagSeconds float64
+}
+
+// Node is a node the monitor can check and reconfigure.
+type Node interface {
+	Status() (Status, error)
+	Promote() error
+	ReplicaOf(primary string) error
+}
+
+// Group is a primary and the replicas that follow it.
+type Group struct {
+	Primary  string
+	Replicas []string
+}
+
+type group struct {
+	Group
+	failures int
+}
+
+// Monitor health-checks the primary of each group and, once one has failed
+// failAfter checks in a row, promotes the replica that has caught up the
+// furthest and points the rest of the group at it. The old primary stays in
+// the group as a replica, so when it comes back it is made to follow the new
+// primary and its stale data is replaced by a full sync. The replicas'
+// statuses from the latest checks also decide which may serve reads, and
+// nodes that keep flapping are quarantined from both promotion and reads.
+type Monitor struct {
+	dial       func(address string) Node
+	failAfter  int
+	quarantine Quarantine
+	onFailover func(old, new string)
+	now        func() time.Time
+
+	// checking serialises Check, which is the only writer of groups
+	checking sync.Mutex
+	mu       sync.RWMutex
+	groups   []*group
+	// statuses holds the latest status of each reachable replica
+	statuses map[string]Status
+	health   map[string]*health
+}
+
+// NewMonitor returns a monitor for groups. onFailover is called after a
+// replica has been promoted so the caller can route the old primary's keys
+// to the new one.
+func NewMonitor(groups []Group, failAfter int, quarantine Quarantine, dial func(address string) Node, onFailover func(old, new string)) *Monitor {
+	monitor := &Monitor{
+		dial:       dial,
+		failAfter:  max(failAfter, 1),
+		quarantine: quarantine,
+		onFailover: onFailover,
+		now:        time.Now,
+		statuses:   make(map[string]Status),
+		health:     make(map[string]*health),
+	}
+	for _, g := range groups {
+		monitor.groups = append(monitor.groups, &group{Group: Group{g.Primary, append([]string(nil), g.Replicas...)}})
+	}
+	return monitor
+}
+
+// Groups returns the groups as they are now, with any failovers applied.
+func (monitor *Monitor) Groups() []Group {
+	monitor.mu.RLock()
+	defer monitor.mu.RUnlock()
+	groups := make([]Group, len(monitor.groups))
+	for i, g := range monitor.groups {
+		groups[i] = Group{g.Primary, append([]string(nil), g.Replicas...)}
+	}
+	return groups
+}
+
+// Check runs one round of health checks, failing over any primary that has
+// now failed too many in a row, and repointing replicas that follow the
+// wrong node. It is meant to be called periodically.
+func (monitor *Monitor) Check() error {
+	monitor.checking.Lock()
+	defer monitor.checking.Unlock()
+
+	var errs []error
+	for _, g := range monitor.groups {
+		if err := monitor.check(g); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (monitor *Monitor) check(g *group) error {
+	status, err := monitor.dial(g.Primary).Status()
+	monitor.mu.Lock()
+	monitor.observe(g.Primary, err == nil)
+	monitor.mu.Unlock()
+	if err == nil && status.Role == RolePrimary {
+		g.failures = 0
+		return monitor.repoint(g)
+	}
+	if err == nil {
+		err = fmt.Errorf("%s reports role %q", g.Primary, status.Role)
+	}
+	g.failures++
+	if g.failures < monitor.failAfter {
+		// Keep the replicas' lag current for ReadNode
+		for _, replica := range g.Replicas {
+			_, _ = monitor.status(replica)
+		}
+		return nil
+	}
+	log.Printf("Primary %s failed %d health checks: %v", g.Primary, g.failures, err)
+	return monitor.failover(g)
+}
+
+// ReadNode picks a node to read from for the group whose primary is
+// primary: at random, one of its replicas that is in sync, was no more than
+// maxLag behind at the latest check and is not quarantined, or the primary
+// itself if there is none.
+func (monitor *Monitor) ReadNode(primary string, maxLag time.Duration) string {
+	monitor.mu.RLock()
+	defer monitor.mu.RUnlock()
+
+	var eligible []string
+	for _, g := range monitor.groups {
+		if g.Primary != primary {
+			continue
+		}
+		for _, replica := range g.Replicas {
+			status, ok := monitor.statuses[replica]
+			if ok && status.Role == RoleReplica && status.Primary == primary && status.Synced && status.LagSeconds <= maxLag.Seconds() && !monitor.quarantined(replica) {
+				eligible = append(eligible, replica)
+			}
+		}
+	}
+	if len(eligible) == 0 {
+		return primary
+	}
+	return eligible[rand.IntN(len(eligible))]
+}
+
+// status asks a replica for its status and records the answer for ReadNode.
+func (monitor *Monitor) status(replica string) (Status, error) {
+	status, err := monitor.dial(replica).Status()
+	monitor.mu.Lock()
+	defer monitor.mu.Unlock()
+	monitor.observe(replica, err == nil)
+	if err != nil {
+		delete(monitor.statuses, replica)
+	} else {
+		monitor.statuses[replica] = status
+	}
+	return status, err
+}
+
+// failover promotes the synced replica of g with the highest offset,
+// passing over quarantined ones.
+func (monitor *Monitor) failover(g *group) error {
+	best := -1
+	var bestStatus Status
+	for i, replica := range g.Replicas {
+		status, err := monitor.status(replica)
+		if err != nil || status.Role != RoleReplica || status.Primary != g.Primary || !status.Synced {
+			continue
+		}
+		monitor.mu.RLock()
+		quarantined := monitor.quarantined(replica)
+		monitor.mu.RUnlock()
+		if quarantined {
+			continue
+		}
+		if best < 0 || status.PrimaryReplicationID == bestStatus.PrimaryReplicationID && status.PrimaryOffset > bestStatus.PrimaryOffset {
+			best, bestStatus = i, status
+		}
+	}
+	if best < 0 {
+		return fmt.Errorf("primary %s is down and no replica is in sync and out of quarantine to replace it", g.Primary)
+	}
+
+	promoted := g.Replicas[best]
+	if err := monitor.dial(promoted).Promote(); err != nil {
+		return fmt.Errorf("promoting %s: %w", promoted, err)
+	}
+	log.Printf("Promoted %s (offset %d) to replace primary %s", promoted, bestStatus.PrimaryOffset, g.Primary)
+
+	monitor.mu.Lock()
+	old := g.Primary
+	g.Replicas[best] = old
+	g.Primary = promoted
+	g.failures = 0
+	delete(monitor.statuses, promoted)
+	monitor.mu.Unlock()
+	if monitor.onFailover != nil {
+		monitor.onFailover(old, promoted)
+	}
+	return monitor.repoint(g)
+}
+
+// repoint makes every reachable replica of g follow g.Primary. This is also
+// how an old primary that comes back is demoted.
+func (monitor *Monitor) repoint(g *group) error {
+	var errs []error
+	for _, replica := range g.Replicas {
+		status, err := monitor.status(replica)
+		if err != nil {
+			// Down; it is repointed once it is back
+			continue
+		}
+		if status.Role == RoleReplica && status.Primary == g.Primary {
+			continue
+		}
+		if err := monitor.dial(replica).ReplicaOf(g.Primary); err != nil {
+			errs = append(errs, fmt.Errorf("pointing %s at %s: %w", replica, g.Primary, err))
+			continue
+		}
+		log.Printf("Pointed %s at primary %s", replica, g.Primary)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,246 @@
+package failover
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeNode is a node in an in-memory cluster.
+type fakeNode struct {
+	status Status
+	down   bool
+}
+
+type fakeCluster map[string]*fakeNode
+
+func (cluster fakeCluster) dial(address string) Node {
+	return fakeNodeClient{cluster[address]}
+}
+
+type fakeNodeClient struct{ node *fakeNode }
+
+func (client fakeNodeClient) Status() (Status, error) {
+	if client.node.down {
+		return Status{}, errors.New("unreachable")
+	}
+	return client.node.status, nil
+}
+
+func (client fakeNodeClient) Promote() error {
+	if client.node.down {
+		return errors.New("unreachable")
+	}
+	client.node.status = Status{Role: RolePrimary}
+	return nil
+}
+
+func (client fakeNodeClient) ReplicaOf(primary string) error {
+	if client.node.down {
+		return errors.New("unreachable")
+	}
+	// The replica syncs again from scratch
+	client.node.status = Status{Role: RoleReplica, Primary: primary, PrimaryReplicationID: primary + "-run", Synced: true}
+	return nil
+}
+
+func newFakeCluster() fakeCluster {
+	return fakeCluster{
+		"p":  {status: Status{Role: RolePrimary}},
+		"r1": {status: Status{Role: RoleReplica, Primary: "p", PrimaryReplicationID: "run", PrimaryOffset: 10, Synced: true}},
+		"r2": {status: Status{Role: RoleReplica, Primary: "p", PrimaryReplicationID: "run", PrimaryOffset: 12, Synced: true}},
+	}
+}
+
+func TestMonitor_PromotesMostUpToDateReplica(t *testing.T) {
+	cluster := newFakeCluster()
+	var old, promoted string
+	monitor := NewMonitor([]Group{{"p", []string{"r1", "r2"}}}, 3, Quarantine{}, cluster.dial, func(from, to string) {
+		old, promoted = from, to
+	})
+
+	cluster["p"].down = true
+	for range 2 {
+		if err := monitor.Check(); err != nil {
+			t.Fatalf("Check: %v", err)
+		}
+	}
+	if got := monitor.Groups()[0].Primary; got != "p" {
+		t.Fatalf("failed over to %s before enough failed checks", got)
+	}
+
+	if err := monitor.Check(); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if old != "p" || promoted != "r2" {
+		t.Fatalf("failover = %s -> %s, want p -> r2", old, promoted)
+	}
+	if role := cluster["r2"].status.Role; role != RolePrimary {
+		t.Fatalf("r2 role = %s, want primary", role)
+	}
+	if primary := cluster["r1"].status.Primary; primary != "r2" {
+		t.Fatalf("r1 follows %s, want r2", primary)
+	}
+	group := monitor.Groups()[0]
+	if group.Primary != "r2" || len(group.Replicas) != 2 || group.Replicas[0] != "r1" || group.Replicas[1] != "p" {
+		t.Fatalf("group = %+v, want r2 with replicas r1 and p", group)
+	}
+}
+
+func TestMonitor_FailureCountResetsOnSuccess(t *testing.T) {
+	cluster := newFakeCluster()
+	monitor := NewMonitor([]Group{{"p", []string{"r1", "r2"}}}, 2, Quarantine{}, cluster.dial, nil)
+
+	for range 3 {
+		cluster["p"].down = true
+		_ = monitor.Check()
+		cluster["p"].down = false
+		_ = monitor.Check()
+	}
+	if got := monitor.Groups()[0].Primary; got != "p" {
+		t.Fatalf("failed over to %s after intermittent failures", got)
+	}
+}
+
+func TestMonitor_SkipsUnsyncedReplicas(t *testing.T) {
+	cluster := newFakeCluster()
+	cluster["r2"].status.Synced = false
+	cluster["r1"].down = true
+	monitor := NewMonitor([]Group{{"p", []string{"r1", "r2"}}}, 1, Quarantine{}, cluster.dial, func(string, string) {
+		t.Fatal("failed over with no replica in sync")
+	})
+
+	cluster["p"].down = true
+	if err := monitor.Check(); err == nil {
+		t.Fatal("Check succeeded with no replica to promote")
+	}
+	if role := cluster["r2"].status.Role; role != RoleReplica {
+		t.Fatalf("unsynced r2 role = %s, want replica", role)
+	}
+}
+
+func TestMonitor_DemotesReturningPrimary(t *testing.T) {
+	cluster := newFakeCluster()
+	monitor := NewMonitor([]Group{{"p", []string{"r1", "r2"}}}, 1, Quarantine{}, cluster.dial, nil)
+
+	cluster["p"].down = true
+	if err := monitor.Check(); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+
+	// p restarts still believing it is the primary
+	cluster["p"].down = false
+	if err := monitor.Check(); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	status := cluster["p"].status
+	if status.Role != RoleReplica || status.Primary != "r2" {
+		t.Fatalf("old primary status = %+v, want a replica of r2", status)
+	}
+}
+
+func TestMonitor_ReadNodeExcludesLaggingReplicas(t *testing.T) {
+	cluster := newFakeCluster()
+	cluster["r1"].status.LagSeconds = 0.5
+	cluster["r2"].status.LagSeconds = 30
+	monitor := NewMonitor([]Group{{"p", []string{"r1", "r2"}}}, 3, Quarantine{}, cluster.dial, nil)
+
+	// Nothing is known about the replicas before the first check
+	if got := monitor.ReadNode("p", time.Second); got != "p" {
+		t.Fatalf("ReadNode before checking = %s, want p", got)
+	}
+
+	if err := monitor.Check(); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	for range 10 {
+		if got := monitor.ReadNode("p", time.Second); got != "r1" {
+			t.Fatalf("ReadNode(1s) = %s, want r1", got)
+		}
+	}
+	if got := monitor.ReadNode("p", 0); got != "p" {
+		t.Fatalf("ReadNode(0) = %s, want p", got)
+	}
+
+	// A replica that stops answering is no longer read from
+	cluster["r1"].down = true
+	if err := monitor.Check(); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if got := monitor.ReadNode("p", time.Second); got != "p" {
+		t.Fatalf("ReadNode with r1 down = %s, want p", got)
+	}
+}
+
+func TestMonitor_QuarantinesFlappingReplica(t *testing.T) {
+	cluster := newFakeCluster()
+	cluster["r1"].status.LagSeconds = 30
+	var promoted string
+	monitor := NewMonitor([]Group{{"p", []string{"r1", "r2"}}}, 1, Quarantine{Flaps: 2, Window: time.Minute}, cluster.dial, func(_, to string) {
+		promoted = to
+	})
+
+	for range 2 {
+		cluster["r2"].down = true
+		_ = monitor.Check()
+		cluster["r2"].down = false
+		_ = monitor.Check()
+	}
+	if health := monitor.Health(); len(health) != 3 || health[2].Node != "r2" || !health[2].Quarantined || health[2].Flaps != 2 {
+		t.Fatalf("Health = %+v, want r2 quarantined after 2 flaps", health)
+	}
+	if got := monitor.ReadNode("p", time.Minute); got == "r2" {
+		t.Fatalf("ReadNode chose quarantined r2")
+	}
+
+	// r2 is further ahead, but r1 is promoted in its place
+	cluster["p"].down = true
+	if err := monitor.Check(); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if promoted != "r1" {
+		t.Fatalf("promoted %s, want r1", promoted)
+	}
+
+	if !monitor.Readmit("r2") {
+		t.Fatalf("Readmit(r2) = false, want true")
+	}
+	if monitor.Readmit("r2") {
+		t.Fatalf("Readmit of a readmitted node = true, want false")
+	}
+}
+
+func TestMonitor_ReadmitsNodeThatStaysUp(t *testing.T) {
+	cluster := newFakeCluster()
+	monitor := NewMonitor([]Group{{"p", []string{"r1", "r2"}}}, 3, Quarantine{Flaps: 1, Window: time.Minute, After: 10 * time.Second}, cluster.dial, nil)
+	now := time.Now()
+	monitor.now = func() time.Time { return now }
+	quarantined := func() bool {
+		for _, health := range monitor.Health() {
+			if health.Node == "r1" {
+				return health.Quarantined
+			}
+		}
+		return false
+	}
+
+	_ = monitor.Check()
+	cluster["r1"].down = true
+	_ = monitor.Check()
+	cluster["r1"].down = false
+	_ = monitor.Check()
+	if !quarantined() {
+		t.Fatalf("r1 not quarantined after coming back")
+	}
+
+	now = now.Add(5 * time.Second)
+	_ = monitor.Check()
+	if !quarantined() {
+		t.Fatalf("r1 readmitted after 5s, want 10s")
+	}
+	now = now.Add(5 * time.Second)
+	_ = monitor.Check()
+	if quarantined() {
+		t.Fatalf("r1 still quarantined after staying up for 10s")
+	}
+}
@@ -0,0 +1,79 @@
+package failover
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// NodeReplica is a Node backed by a blueis node's /replication routes.
+type NodeReplica struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewNodeReplica(baseURL string, client *http.Client) *NodeReplica {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &NodeReplica{baseURL, client}
+}
+
+type nodeReplicationResponse struct {
+	Success              bool    `json:"success"`
+	Role                 string  `json:"role"`
+	Primary              string  `json:"primary"`
+	PrimaryReplicationID string  `json:"primaryReplicationId"`
+	PrimaryOffset        uint64  `json:"primaryOffset"`
+	Synced               bool    `json:"synced"`
+	Lag                  uint64  `json:"lag"`
+	LagSeconds           float64 `json:"lagSeconds"`
+	Error                string  `json:"error,omitempty"`
+}
+
+func (replica *NodeReplica) Status() (Status, error) {
+	resp, err := replica.client.Get(replica.baseURL + "/replication/info")
+	if err != nil {
+		return Status{}, err
+	}
+	res, err := replica.decode(resp)
+	if err != nil {
+		return Status{}, err
+	}
+	return Status{res.Role, res.Primary, res.PrimaryReplicationID, res.PrimaryOffset, res.Synced, res.Lag, res.LagSeconds}, nil
+}
+
+func (replica *NodeReplica) Promote() error {
+	return replica.post("/replication/promote", nil)
+}
+
+func (replica *NodeReplica) ReplicaOf(primary string) error {
+	return replica.post("/replication/replicaof", map[string]string{"primary": primary})
+}
+
+func (replica *NodeReplica) post(path string, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := replica.client.Post(replica.baseURL+path, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	_, err = replica.decode(resp)
+	return err
+}
+
+func (replica *NodeReplica) decode(resp *http.Response) (nodeReplicationResponse, error) {
+	defer resp.Body.Close()
+
+	var res nodeReplicationResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return res, fmt.Errorf("decoding response from %s: %w", replica.baseURL, err)
+	}
+	if !res.Success {
+		return res, fmt.Errorf("%s: %s", replica.baseURL, res.Error)
+	}
+	return res, nil
+}
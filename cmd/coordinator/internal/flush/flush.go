@@ -0,0 +1,141 @@
+package flush
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DefaultWindow is how long a flush can be confirmed for once requested.
+const DefaultWindow = time.Minute
+
+var (
+	// ErrInvalidToken is returned when confirming a flush with a token that
+	// was never issued, has expired or was already used.
+	ErrInvalidToken = errors.New("invalid or expired confirmation token")
+	// ErrNodesChanged is returned when the nodes to flush are no longer the
+	// ones the token was issued for.
+	ErrNodesChanged = errors.New("nodes changed since the flush was requested")
+)
+
+// Node is a node whose keys can all be deleted.
+type Node interface {
+	// Flush deletes every key the node holds and returns how many it
+	// deleted. A dry run deletes nothing and returns how many it would
+	// have deleted
+	Flush(dryRun bool) (int, error)
+}
+
+// Confirmation is a requested flush waiting to be confirmed with Token
+// before Expires.
+type Confirmation struct {
+	Token   string
+	Expires time.Time
+	Nodes   []string
+}
+
+// Result is the outcome of flushing one node. For a preview, Deleted is
+// how many keys the node would delete.
+type Result struct {
+	Node    string
+	Deleted int
+	Err     error
+}
+
+// Flusher flushes every node of the cluster in two steps: Request issues a
+// token naming the nodes that would be flushed, and Confirm flushes them
+// if given that token within the window. Tokens can be used once.
+type Flusher struct {
+	dial   func(address string) Node
+	window time.Duration
+	now    func() time.Time
+
+	mu      sync.Mutex
+	pending map[string]Confirmation
+}
+
+func NewFlusher(dial func(address string) Node, window time.Duration) *Flusher {
+	if window <= 0 {
+		window = DefaultWindow
+	}
+	return &Flusher{
+		dial:    dial,
+		window:  window,
+		now:     time.Now,
+		pending: make(map[string]Confirmation),
+	}
+}
+
+// Request issues a token for flushing nodes, valid for the flusher's
+// window.
+func (flusher *Flusher) Request(nodes []string) (Confirmation, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return Confirmation{}, fmt.Errorf("generating confirmation token: %w", err)
+	}
+	nodes = slices.Sorted(slices.Values(nodes))
+	nodes = slices.Compact(nodes)
+
+	flusher.mu.Lock()
+	defer flusher.mu.Unlock()
+	now := flusher.now()
+	for token, pending := range flusher.pending {
+		if !now.Before(pending.Expires) {
+			delete(flusher.pending, token)
+		}
+	}
+	confirmation := Confirmation{
+		Token:   hex.EncodeToString(b[:]),
+		Expires: now.Add(flusher.window),
+		Nodes:   nodes,
+	}
+	flusher.pending[confirmation.Token] = confirmation
+	return confirmation, nil
+}
+
+// Confirm flushes every node the token was issued for, all at once, and
+// returns each node's result in the order of the confirmation's nodes.
+// nodes are the nodes that would be flushed now; if they differ from the
+// token's, nothing is flushed. The token is used up either way.
+func (flusher *Flusher) Confirm(token string, nodes []string) ([]Result, error) {
+	flusher.mu.Lock()
+	confirmation, ok := flusher.pending[token]
+	delete(flusher.pending, token)
+	flusher.mu.Unlock()
+	if !ok || !flusher.now().Before(confirmation.Expires) {
+		return nil, ErrInvalidToken
+	}
+	nodes = slices.Sorted(slices.Values(nodes))
+	if !slices.Equal(slices.Compact(nodes), confirmation.Nodes) {
+		return nil, ErrNodesChanged
+	}
+	return flusher.flush(confirmation.Nodes, false), nil
+}
+
+// Preview asks every node in nodes how many keys a flush would delete,
+// without deleting any or issuing a token, and returns each node's result
+// in the order Request would list them.
+func (flusher *Flusher) Preview(nodes []string) []Result {
+	nodes = slices.Sorted(slices.Values(nodes))
+	return flusher.flush(slices.Compact(nodes), true)
+}
+
+// flush flushes nodes all at once, returning their results in order.
+func (flusher *Flusher) flush(nodes []string, dryRun bool) []Result {
+	results := make([]Result, len(nodes))
+	var wg sync.WaitGroup
+	for i, address := range nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			deleted, err := flusher.dial(address).Flush(dryRun)
+			results[i] = Result{Node: address, Deleted: deleted, Err: err}
+		}()
+	}
+	wg.Wait()
+	return results
+}
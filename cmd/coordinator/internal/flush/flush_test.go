@@ -0,0 +1,124 @@
+package flush
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNode counts its flushes, failing them if err is set.
+type fakeNode struct {
+	mu      sync.Mutex
+	keys    int
+	flushes int
+	err     error
+}
+
+func (node *fakeNode) Flush(dryRun bool) (int, error) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if node.err != nil {
+		return 0, node.err
+	}
+	if dryRun {
+		return node.keys, nil
+	}
+	node.flushes++
+	deleted := node.keys
+	node.keys = 0
+	return deleted, nil
+}
+
+func newTestFlusher() (*Flusher, map[string]*fakeNode, *time.Time) {
+	nodes := map[string]*fakeNode{"a": {keys: 3}, "b": {keys: 5}}
+	now := time.Unix(1000, 0)
+	flusher := NewFlusher(func(address string) Node { return nodes[address] }, time.Minute)
+	flusher.now = func() time.Time { return now }
+	return flusher, nodes, &now
+}
+
+func TestFlusher_FlushesEveryNodeOnceConfirmed(t *testing.T) {
+	flusher, nodes, _ := newTestFlusher()
+	nodes["b"].err = errors.New("read-only")
+
+	confirmation, err := flusher.Request([]string{"b", "a", "b"})
+	if err != nil {
+		t.Fatalf("Request returned error: %v", err)
+	}
+	if len(confirmation.Token) != 32 || len(confirmation.Nodes) != 2 {
+		t.Fatalf("Request = %+v, want a token for nodes a and b", confirmation)
+	}
+	if nodes["a"].flushes != 0 {
+		t.Fatalf("a was flushed before the flush was confirmed")
+	}
+
+	results, err := flusher.Confirm(confirmation.Token, []string{"a", "b"})
+	if err != nil {
+		t.Fatalf("Confirm returned error: %v", err)
+	}
+	if len(results) != 2 || results[0].Node != "a" || results[0].Deleted != 3 || results[0].Err != nil {
+		t.Fatalf("result for a = %+v, want 3 keys deleted", results)
+	}
+	if results[1].Node != "b" || results[1].Err == nil {
+		t.Fatalf("result for b = %+v, want its error", results[1])
+	}
+}
+
+func TestFlusher_TokensAreUsedOnce(t *testing.T) {
+	flusher, nodes, _ := newTestFlusher()
+	confirmation, _ := flusher.Request([]string{"a", "b"})
+
+	if _, err := flusher.Confirm(confirmation.Token, []string{"a", "b"}); err != nil {
+		t.Fatalf("Confirm returned error: %v", err)
+	}
+	if _, err := flusher.Confirm(confirmation.Token, []string{"a", "b"}); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("second Confirm returned %v, want ErrInvalidToken", err)
+	}
+	if _, err := flusher.Confirm("made-up", []string{"a", "b"}); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("Confirm with an unknown token returned %v, want ErrInvalidToken", err)
+	}
+	if nodes["a"].flushes != 1 {
+		t.Fatalf("a was flushed %d times, want once", nodes["a"].flushes)
+	}
+}
+
+func TestFlusher_TokensExpire(t *testing.T) {
+	flusher, nodes, now := newTestFlusher()
+	confirmation, _ := flusher.Request([]string{"a", "b"})
+
+	*now = now.Add(time.Minute)
+	if _, err := flusher.Confirm(confirmation.Token, []string{"a", "b"}); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("Confirm after the window returned %v, want ErrInvalidToken", err)
+	}
+	if nodes["a"].flushes != 0 || nodes["b"].flushes != 0 {
+		t.Fatalf("nodes were flushed with an expired token")
+	}
+}
+
+func TestFlusher_RefusesWhenTheNodesChanged(t *testing.T) {
+	flusher, nodes, _ := newTestFlusher()
+	confirmation, _ := flusher.Request([]string{"a", "b"})
+
+	if _, err := flusher.Confirm(confirmation.Token, []string{"a", "b", "c"}); !errors.Is(err, ErrNodesChanged) {
+		t.Fatalf("Confirm returned %v, want ErrNodesChanged", err)
+	}
+	if nodes["a"].flushes != 0 {
+		t.Fatalf("a was flushed although a node joined since the request")
+	}
+}
+
+func TestFlusher_PreviewDeletesNothing(t *testing.T) {
+	flusher, nodes, _ := newTestFlusher()
+
+	results := flusher.Preview([]string{"b", "a", "b"})
+	if len(results) != 2 || results[0].Node != "a" || results[0].Deleted != 3 || results[1].Node != "b" || results[1].Deleted != 5 {
+		t.Fatalf("Preview = %+v, want 3 keys on a and 5 on b", results)
+	}
+	if nodes["a"].flushes != 0 || nodes["b"].flushes != 0 || nodes["a"].keys != 3 {
+		t.Fatalf("a preview flushed the nodes")
+	}
+	if len(flusher.pending) != 0 {
+		t.Fatalf("a preview issued a token")
+	}
+}
@@ -0,0 +1,52 @@
+package flush
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// NodeFlusher is a Node backed by a blueis node's /admin/flush route.
+type NodeFlusher struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewNodeFlusher(baseURL string, client *http.Client) *NodeFlusher {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &NodeFlusher{baseURL, client}
+}
+
+type nodeFlushResponse struct {
+	Success bool   `json:"success"`
+	DryRun  bool   `json:"dryRun"`
+	Deleted int    `json:"deleted"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (flusher *NodeFlusher) Flush(dryRun bool) (int, error) {
+	path := "/admin/flush"
+	if dryRun {
+		path += "?dryRun=true"
+	}
+	resp, err := flusher.client.Post(flusher.baseURL+path, "application/json", nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var res nodeFlushResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return 0, fmt.Errorf("decoding response from %s: %w", flusher.baseURL, err)
+	}
+	if !res.Success {
+		return res.Deleted, fmt.Errorf("%s: %s", flusher.baseURL, res.Error)
+	}
+	// A node that predates dry runs ignores the parameter and flushes
+	if dryRun && !res.DryRun {
+		return res.Deleted, fmt.Errorf("%s flushed its keys instead of a dry run", flusher.baseURL)
+	}
+	return res.Deleted, nil
+}
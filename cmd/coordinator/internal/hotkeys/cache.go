@@ -0,0 +1,301 @@
+package hotkeys
+
+import (
+	"blueis/cmd/coordinator/internal/planner"
+	"blueis/internal/sketch"
+	"container/list"
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Event types a Feed reports. EventDropped means the node lost events
+// before sending them, so any of its keys may have changed.
+const (
+	EventSet       = "set"
+	EventDel       = "del"
+	EventExpired   = "expired"
+	EventHeartbeat = "heartbeat"
+	EventDropped   = "dropped"
+)
+
+// Sketch dimensions used to count reads per key within a window.
+const (
+	sketchWidth = 4096
+	sketchDepth = 4
+)
+
+// Event is a notification from a node.
+type Event struct {
+	Type string `json:"type"`
+	Key  string `json:"key,omitempty"`
+}
+
+// Feed streams a node's keyspace notifications, calling handle with each
+// one until ctx is done or the stream breaks. The first event must come
+// once the node is reporting changes, so every change after it reaches
+// handle.
+type Feed interface {
+	Follow(ctx context.Context, handle func(Event)) error
+}
+
+// Config says how many keys the cache holds and which keys are hot enough
+// to be cached.
+type Config struct {
+	// Capacity is the most keys cached; the least recently read is evicted
+	// to make room
+	Capacity int
+	// Threshold is how many times a key must be read within Window before
+	// it is cached
+	Threshold int
+	Window    time.Duration
+}
+
+// Stats describe what the cache has done since it was created.
+type Stats struct {
+	Keys          int    `json:"keys"`
+	Hits          uint64 `json:"hits"`
+	Misses        uint64 `json:"misses"`
+	Invalidations uint64 `json:"invalidations"`
+}
+
+type entry struct {
+	key   string
+	value string
+	node  string
+	epoch uint64
+}
+
+// fill tracks reads of a key whose value will be cached once they return.
+// A change to the key while they are in flight makes the value they return
+// stale, so it is not cached.
+type fill struct {
+	node  string
+	reads int
+	stale bool
+}
+
+// pending is a read of a hot key that is to be cached.
+type pending struct {
+	key   string
+	node  string
+	epoch uint64
+	fill  *fill
+}
+
+// Cache keeps the values of the hottest keys at the coordinator, so a key
+// read far more often than its node can serve is answered without reaching
+// it. Only keys of nodes the cache is following are cached, and they are
+// dropped as soon as the node reports them changed, when it may have
+// missed reporting a change, when the cache stops following it and when
+// the topology changes.
+type Cache struct {
+	config Config
+	route  func(key string) (string, uint64)
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// recent holds entries, most recently read first
+	recent      *list.List
+	reads       *sketch.CountMin
+	windowStart time.Time
+	fills       map[string]*fill
+	following   map[string]bool
+	stats       Stats
+}
+
+func NewCache(config Config, route func(key string) (string, uint64)) *Cache {
+	cache := &Cache{
+		config:    config,
+		route:     route,
+		now:       time.Now,
+		entries:   make(map[string]*list.Element),
+		recent:    list.New(),
+		fills:     make(map[string]*fill),
+		following: make(map[string]bool),
+	}
+	cache.reads, _ = sketch.NewCountMin(sketchWidth, sketchDepth)
+	return cache
+}
+
+// MGet reads keys like fetch does, answering cached keys itself and
+// fetching the rest, then caches those that are hot.
+func (cache *Cache) MGet(keys []string, fetch func(keys []string) []planner.Result) []planner.Result {
+	results := make([]planner.Result, len(keys))
+	var missing []int
+	var fetches []string
+	var fills []*pending
+
+	cache.mu.Lock()
+	if now := cache.now(); now.Sub(cache.windowStart) >= cache.config.Window {
+		cache.reads, _ = sketch.NewCountMin(sketchWidth, sketchDepth)
+		cache.windowStart = now
+	}
+	for i, key := range keys {
+		node, epoch := cache.route(key)
+		hot := int(cache.reads.Add(key, 1)) >= cache.config.Threshold
+		if element, ok := cache.entries[key]; ok {
+			e := element.Value.(*entry)
+			if e.node == node && e.epoch == epoch {
+				cache.recent.MoveToFront(element)
+				cache.stats.Hits++
+				value := e.value
+				results[i] = planner.Result{Key: key, Value: &value}
+				continue
+			}
+			cache.remove(element)
+		}
+		cache.stats.Misses++
+		missing = append(missing, i)
+		fetches = append(fetches, key)
+		var p *pending
+		if hot && cache.following[node] {
+			f, ok := cache.fills[key]
+			if !ok {
+				f = &fill{node: node}
+				cache.fills[key] = f
+			}
+			f.reads++
+			p = &pending{key, node, epoch, f}
+		}
+		fills = append(fills, p)
+	}
+	cache.mu.Unlock()
+
+	if len(missing) == 0 {
+		return results
+	}
+	fetched := fetch(fetches)
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	for j, i := range missing {
+		results[i] = fetched[j]
+		p := fills[j]
+		if p == nil {
+			continue
+		}
+		if p.fill.reads--; p.fill.reads == 0 {
+			delete(cache.fills, p.key)
+		}
+		result := fetched[j]
+		if p.fill.stale || result.Err != nil || result.Value == nil || !cache.following[p.node] {
+			continue
+		}
+		cache.add(&entry{p.key, *result.Value, p.node, p.epoch})
+	}
+	return results
+}
+
+// add caches e, evicting the least recently read entry if the cache is
+// full. The caller must hold mu.
+func (cache *Cache) add(e *entry) {
+	if cache.config.Capacity <= 0 {
+		return
+	}
+	if element, ok := cache.entries[e.key]; ok {
+		cache.remove(element)
+	}
+	if cache.recent.Len() >= cache.config.Capacity {
+		cache.remove(cache.recent.Back())
+	}
+	cache.entries[e.key] = cache.recent.PushFront(e)
+}
+
+// remove drops an entry. The caller must hold mu.
+func (cache *Cache) remove(element *list.Element) {
+	delete(cache.entries, element.Value.(*entry).key)
+	cache.recent.Remove(element)
+}
+
+// Invalidate drops key, and keeps reads of it already in flight from
+// caching what they return.
+func (cache *Cache) Invalidate(key string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.invalidate(key)
+}
+
+func (cache *Cache) invalidate(key string) {
+	if f, ok := cache.fills[key]; ok {
+		f.stale = true
+	}
+	if element, ok := cache.entries[key]; ok {
+		cache.remove(element)
+		cache.stats.Invalidations++
+	}
+}
+
+// forget drops every key of node, and keeps reads of its keys already in
+// flight from caching what they return. The caller must hold mu.
+func (cache *Cache) forget(node string) {
+	for _, f := range cache.fills {
+		if f.node == node {
+			f.stale = true
+		}
+	}
+	for element := cache.recent.Front(); element != nil; {
+		next := element.Next()
+		if element.Value.(*entry).node == node {
+			cache.remove(element)
+			cache.stats.Invalidations++
+		}
+		element = next
+	}
+}
+
+// Follow keeps the cache in step with the node at address through feed
+// until ctx is done, reconnecting every retry while the feed is down. The
+// node's keys are cached only while the feed is up.
+func (cache *Cache) Follow(ctx context.Context, address string, feed Feed, retry time.Duration) {
+	for attempt := 1; ; attempt++ {
+		err := feed.Follow(ctx, func(event Event) {
+			cache.observe(address, event)
+		})
+
+		cache.mu.Lock()
+		followed := cache.following[address]
+		if followed {
+			delete(cache.following, address)
+			cache.forget(address)
+		}
+		cache.mu.Unlock()
+
+		if ctx.Err() != nil {
+			return
+		}
+		// A node that stays down is only reported once
+		if followed || attempt == 1 {
+			log.Printf("Not caching hot keys of %s until it can report changes: %v", address, err)
+			attempt = 1
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+	}
+}
+
+func (cache *Cache) observe(address string, event Event) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.following[address] = true
+	switch event.Type {
+	case EventSet, EventDel, EventExpired:
+		cache.invalidate(event.Key)
+	case EventDropped:
+		cache.forget(address)
+	}
+}
+
+func (cache *Cache) Stats() Stats {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	stats := cache.stats
+	stats.Keys = cache.recent.Len()
+	return stats
+}
@@ -0,0 +1,242 @@
+package hotkeys
+
+import (
+	"blueis/cmd/coordinator/internal/planner"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStore serves reads of its values and counts the keys it was asked
+// for.
+type fakeStore struct {
+	mu      sync.Mutex
+	values  map[string]string
+	fetched map[string]int
+	// during runs while a read is in flight
+	during func()
+}
+
+func newFakeStore(values map[string]string) *fakeStore {
+	return &fakeStore{values: values, fetched: make(map[string]int)}
+}
+
+func (store *fakeStore) fetch(keys []string) []planner.Result {
+	if store.during != nil {
+		store.during()
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	results := make([]planner.Result, len(keys))
+	for i, key := range keys {
+		store.fetched[key]++
+		results[i] = planner.Result{Key: key}
+		if value, ok := store.values[key]; ok {
+			results[i].Value = &value
+		}
+	}
+	return results
+}
+
+// testRing routes every key to node a at an epoch that can be changed.
+type testRing struct {
+	mu    sync.Mutex
+	epoch uint64
+}
+
+func (ring *testRing) route(key string) (string, uint64) {
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+	return "a", ring.epoch
+}
+
+func newTestCache(config Config) (*Cache, *testRing) {
+	if config.Window == 0 {
+		config.Window = time.Hour
+	}
+	ring := &testRing{epoch: 1}
+	cache := NewCache(config, ring.route)
+	// The cache follows node a
+	cache.observe("a", Event{Type: EventHeartbeat})
+	return cache, ring
+}
+
+func readValue(t *testing.T, cache *Cache, store *fakeStore, key string) string {
+	t.Helper()
+	result := cache.MGet([]string{key}, store.fetch)[0]
+	if result.Err != nil || result.Value == nil {
+		t.Fatalf("MGet of %s = %+v, want a value", key, result)
+	}
+	return *result.Value
+}
+
+func TestCache_CachesOnlyHotKeys(t *testing.T) {
+	cache, _ := newTestCache(Config{Capacity: 10, Threshold: 3})
+	store := newFakeStore(map[string]string{"hot": "1", "cold": "2"})
+
+	for range 5 {
+		readValue(t, cache, store, "hot")
+	}
+	readValue(t, cache, store, "cold")
+	readValue(t, cache, store, "cold")
+
+	// The third read made the key hot and cached what it fetched
+	if store.fetched["hot"] != 3 || store.fetched["cold"] != 2 {
+		t.Fatalf("fetched hot %d times and cold %d times, want 3 and 2", store.fetched["hot"], store.fetched["cold"])
+	}
+	if stats := cache.Stats(); stats.Keys != 1 || stats.Hits != 2 || stats.Misses != 5 {
+		t.Fatalf("Stats = %+v, want 1 key, 2 hits and 5 misses", stats)
+	}
+
+	// Keys that do not exist are not cached
+	for range 5 {
+		if result := cache.MGet([]string{"missing"}, store.fetch)[0]; result.Value != nil {
+			t.Fatalf("MGet of a missing key = %+v, want no value", result)
+		}
+	}
+	if store.fetched["missing"] != 5 {
+		t.Fatalf("fetched missing %d times, want 5", store.fetched["missing"])
+	}
+}
+
+func TestCache_DropsKeysTheNodeReportsChanged(t *testing.T) {
+	cache, _ := newTestCache(Config{Capacity: 10, Threshold: 1})
+	store := newFakeStore(map[string]string{"a": "1", "b": "2", "c": "3"})
+	for _, key := range []string{"a", "b", "c"} {
+		readValue(t, cache, store, key)
+	}
+
+	store.values["a"] = "changed"
+	cache.observe("a", Event{Type: EventSet, Key: "a"})
+	cache.observe("a", Event{Type: EventDel, Key: "b"})
+	cache.observe("a", Event{Type: EventExpired, Key: "c"})
+
+	if value := readValue(t, cache, store, "a"); value != "changed" {
+		t.Fatalf("a = %s after it was set, want changed", value)
+	}
+	if result := cache.MGet([]string{"b", "c"}, store.fetch); store.fetched["b"] != 2 || store.fetched["c"] != 2 {
+		t.Fatalf("MGet of deleted and expired keys = %+v without reaching the node", result)
+	}
+}
+
+func TestCache_DoesNotCacheValuesChangedWhileRead(t *testing.T) {
+	cache, _ := newTestCache(Config{Capacity: 10, Threshold: 1})
+	store := newFakeStore(map[string]string{"a": "old"})
+	// The key changes after the node has answered but before the answer
+	// is cached
+	store.during = func() {
+		store.during = nil
+		cache.observe("a", Event{Type: EventSet, Key: "a"})
+	}
+
+	readValue(t, cache, store, "a")
+	readValue(t, cache, store, "a")
+	if store.fetched["a"] != 2 {
+		t.Fatalf("fetched a %d times, want the value read during a change not cached", store.fetched["a"])
+	}
+}
+
+func TestCache_EvictsLeastRecentlyRead(t *testing.T) {
+	cache, _ := newTestCache(Config{Capacity: 2, Threshold: 1})
+	store := newFakeStore(map[string]string{"a": "1", "b": "2", "c": "3"})
+
+	readValue(t, cache, store, "a")
+	readValue(t, cache, store, "b")
+	readValue(t, cache, store, "a")
+	readValue(t, cache, store, "c")
+
+	// b was read least recently when c was cached
+	for _, key := range []string{"a", "c", "b"} {
+		readValue(t, cache, store, key)
+	}
+	if store.fetched["a"] != 1 || store.fetched["b"] != 2 || store.fetched["c"] != 1 {
+		t.Fatalf("fetched a, b and c %d, %d and %d times, want 1, 2 and 1", store.fetched["a"], store.fetched["b"], store.fetched["c"])
+	}
+}
+
+func TestCache_DropsKeysWhenTheTopologyChanges(t *testing.T) {
+	cache, ring := newTestCache(Config{Capacity: 10, Threshold: 1})
+	store := newFakeStore(map[string]string{"a": "1"})
+	readValue(t, cache, store, "a")
+
+	ring.mu.Lock()
+	ring.epoch++
+	ring.mu.Unlock()
+	readValue(t, cache, store, "a")
+	if store.fetched["a"] != 2 {
+		t.Fatalf("fetched a %d times, want it read again at the new epoch", store.fetched["a"])
+	}
+}
+
+// fakeFeed passes on the events sent to it until it is broken.
+type fakeFeed struct {
+	events chan Event
+}
+
+// send hands event to the cache and waits until it has been handled.
+func (feed *fakeFeed) send(event Event) {
+	feed.events <- event
+	// The feed takes the next event only once it has handled the last
+	feed.events <- Event{Type: EventHeartbeat}
+}
+
+func (feed *fakeFeed) Follow(ctx context.Context, handle func(Event)) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event, ok := <-feed.events:
+			if !ok {
+				return errors.New("stream broken")
+			}
+			handle(event)
+		}
+	}
+}
+
+func TestCache_CachesOnlyWhileFollowing(t *testing.T) {
+	cache := NewCache(Config{Capacity: 10, Threshold: 1, Window: time.Hour}, (&testRing{epoch: 1}).route)
+	store := newFakeStore(map[string]string{"a": "1"})
+
+	// Nothing is cached before the node's feed is up
+	readValue(t, cache, store, "a")
+	readValue(t, cache, store, "a")
+	if store.fetched["a"] != 2 {
+		t.Fatalf("fetched a %d times before following, want every read to reach the node", store.fetched["a"])
+	}
+
+	feed := &fakeFeed{events: make(chan Event)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		cache.Follow(ctx, "a", feed, time.Hour)
+		close(done)
+	}()
+	feed.send(Event{Type: EventHeartbeat})
+
+	readValue(t, cache, store, "a")
+	readValue(t, cache, store, "a")
+	if store.fetched["a"] != 3 {
+		t.Fatalf("fetched a %d times while following, want 3", store.fetched["a"])
+	}
+
+	// Missed events leave the node's keys untrusted
+	feed.send(Event{Type: EventDropped})
+	readValue(t, cache, store, "a")
+	if store.fetched["a"] != 4 {
+		t.Fatalf("fetched a %d times after missed events, want 4", store.fetched["a"])
+	}
+
+	// and so does losing the feed
+	close(feed.events)
+	cancel()
+	<-done
+	readValue(t, cache, store, "a")
+	readValue(t, cache, store, "a")
+	if store.fetched["a"] != 6 {
+		t.Fatalf("fetched a %d times after the feed broke, want 6", store.fetched["a"])
+	}
+}
@@ -0,0 +1,77 @@
+package hotkeys
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// feedTimeout is how long a node's stream may go without a line, heartbeats
+// included, before the node is taken to be unreachable.
+const feedTimeout = 5 * time.Second
+
+// maxLine bounds a notification, which is mostly its key.
+const maxLine = 1 << 20
+
+// NodeFeed is a Feed backed by a blueis node's /notifications route.
+type NodeFeed struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewNodeFeed(baseURL string, client *http.Client) *NodeFeed {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &NodeFeed{baseURL, client}
+}
+
+func (feed *NodeFeed) Follow(ctx context.Context, handle func(Event)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, feed.baseURL+"/notifications?events=set,del,expired", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := feed.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", feed.baseURL, strings.TrimSpace(string(body)))
+	}
+
+	// A node that goes quiet, heartbeats and all, is as good as gone
+	var quiet atomic.Bool
+	idle := time.AfterFunc(feedTimeout, func() {
+		quiet.Store(true)
+		cancel()
+	})
+	defer idle.Stop()
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, maxLine)
+	for scanner.Scan() {
+		idle.Reset(feedTimeout)
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return fmt.Errorf("decoding notification from %s: %w", feed.baseURL, err)
+		}
+		handle(event)
+	}
+	if quiet.Load() {
+		return fmt.Errorf("%s sent nothing for %v", feed.baseURL, feedTimeout)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("%s closed the notification stream", feed.baseURL)
+}
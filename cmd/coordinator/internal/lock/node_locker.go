@@ -0,0 +1,70 @@
+package lock
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// NodeLocker is a Locker backed by a blueis node's /lock and /unlock routes.
+type NodeLocker struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewNodeLocker(baseURL string, client *http.Client) *NodeLocker {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &NodeLocker{baseURL, client}
+}
+
+type nodeLockResponse struct {
+	Success  bool   `json:"success"`
+	Acquired bool   `json:"acquired"`
+	Released bool   `json:"released"`
+	Token    uint64 `json:"token,omitempty,string"`
+	Error    string `json:"error,omitempty"`
+}
+
+func (locker *NodeLocker) Lock(key string, ttl time.Duration) (uint64, bool, error) {
+	res, err := locker.post("/lock", key, map[string]any{"ttlMs": ttl.Milliseconds()})
+	if err != nil {
+		return 0, false, err
+	}
+	return res.Token, res.Acquired, nil
+}
+
+func (locker *NodeLocker) Unlock(key string, token uint64) (bool, error) {
+	res, err := locker.post("/unlock", key, map[string]any{"token": fmt.Sprint(token)})
+	if err != nil {
+		return false, err
+	}
+	return res.Released, nil
+}
+
+func (locker *NodeLocker) post(path string, key string, body any) (nodeLockResponse, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nodeLockResponse{}, err
+	}
+
+	target := locker.baseURL + path + "?key=" + url.QueryEscape(key)
+	resp, err := locker.client.Post(target, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nodeLockResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	var res nodeLockResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nodeLockResponse{}, fmt.Errorf("decoding response from %s: %w", locker.baseURL, err)
+	}
+	if !res.Success {
+		return nodeLockResponse{}, fmt.Errorf("%s: %s", locker.baseURL, res.Error)
+	}
+	return res, nil
+}
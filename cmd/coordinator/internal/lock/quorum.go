@@ -0,0 +1,114 @@
+package lock
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Locker is a single lock service, such as one blueis node. It is satisfied
+// by NodeLocker and by an in-process kvstore.KeyValueService.
+type Locker interface {
+	Lock(key string, ttl time.Duration) (token uint64, acquired bool, err error)
+	Unlock(key string, token uint64) (bool, error)
+}
+
+// DefaultClockDrift is the fraction of a lock's TTL assumed lost to clock
+// drift between nodes.
+const DefaultClockDrift = 0.01
+
+// QuorumLocker acquires a lock on a majority of independent nodes, in the
+// manner of Redlock, so the lock survives a minority of nodes failing.
+type QuorumLocker struct {
+	lockers    []Locker
+	clockDrift float64
+}
+
+// Lease is a lock held on a quorum of nodes.
+type Lease struct {
+	Key string
+	// Token is the largest fencing token issued by the nodes holding the
+	// lock. Each node's tokens only increase, and node tokens are seeded
+	// from their clocks, so quorum tokens increase across acquisitions
+	// as long as node clocks stay roughly in sync. Use a single node's
+	// lock where strictly monotonic tokens are required.
+	Token uint64
+	// Validity is how long the lock can be relied on, measured from when
+	// Lock returned.
+	Validity time.Duration
+	tokens   []uint64
+}
+
+func NewQuorumLocker(lockers []Locker, clockDrift float64) *QuorumLocker {
+	return &QuorumLocker{lockers, clockDrift}
+}
+
+// Lock tries to acquire key on every node at once and succeeds if a majority
+// granted it with time to spare before the TTL runs out. Otherwise any
+// partial acquisitions are released and acquired is false.
+func (quorum *QuorumLocker) Lock(key string, ttl time.Duration) (lease *Lease, acquired bool, err error) {
+	if len(quorum.lockers) == 0 {
+		return nil, false, fmt.Errorf("no lock nodes configured")
+	}
+
+	start := time.Now()
+	tokens := make([]uint64, len(quorum.lockers))
+	errs := make([]error, len(quorum.lockers))
+	var wg sync.WaitGroup
+	for i, locker := range quorum.lockers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, ok, err := locker.Lock(key, ttl)
+			if ok {
+				tokens[i] = token
+			}
+			errs[i] = err
+		}()
+	}
+	wg.Wait()
+
+	held := 0
+	var maxToken uint64
+	for _, token := range tokens {
+		if token != 0 {
+			held++
+			maxToken = max(maxToken, token)
+		}
+	}
+
+	drift := time.Duration(float64(ttl)*quorum.clockDrift) + 2*time.Millisecond
+	validity := ttl - time.Since(start) - drift
+	lease = &Lease{Key: key, Token: maxToken, Validity: validity, tokens: tokens}
+	if held > len(quorum.lockers)/2 && validity > 0 {
+		return lease, true, nil
+	}
+
+	quorum.Unlock(lease)
+	if held <= len(quorum.lockers)/2 {
+		// Report node errors, which may be why there was no quorum
+		for _, err := range errs {
+			if err != nil {
+				return nil, false, fmt.Errorf("acquiring lock %s on a quorum: %w", key, err)
+			}
+		}
+	}
+	return nil, false, nil
+}
+
+// Unlock releases the lease on every node that granted it. Nodes that fail
+// to respond keep the lock until its TTL expires.
+func (quorum *QuorumLocker) Unlock(lease *Lease) {
+	var wg sync.WaitGroup
+	for i, locker := range quorum.lockers {
+		if lease.tokens[i] == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = locker.Unlock(lease.Key, lease.tokens[i])
+		}()
+	}
+	wg.Wait()
+}
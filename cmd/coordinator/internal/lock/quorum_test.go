@@ -0,0 +1,136 @@
+package lock
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLocker is an in-memory single-node lock service.
+type fakeLocker struct {
+	mu     sync.Mutex
+	held   map[string]uint64
+	next   uint64
+	failed bool
+}
+
+func newFakeLocker() *fakeLocker {
+	return &fakeLocker{held: make(map[string]uint64)}
+}
+
+func (locker *fakeLocker) Lock(key string, ttl time.Duration) (uint64, bool, error) {
+	locker.mu.Lock()
+	defer locker.mu.Unlock()
+	if locker.failed {
+		return 0, false, errors.New("node unreachable")
+	}
+	if _, ok := locker.held[key]; ok {
+		return 0, false, nil
+	}
+	locker.next++
+	locker.held[key] = locker.next
+	return locker.next, true, nil
+}
+
+func (locker *fakeLocker) Unlock(key string, token uint64) (bool, error) {
+	locker.mu.Lock()
+	defer locker.mu.Unlock()
+	if locker.held[key] != token {
+		return false, nil
+	}
+	delete(locker.held, key)
+	return true, nil
+}
+
+func (locker *fakeLocker) isHeld(key string) bool {
+	locker.mu.Lock()
+	defer locker.mu.Unlock()
+	_, ok := locker.held[key]
+	return ok
+}
+
+func TestQuorumLocker_AcquiresWithMajority(t *testing.T) {
+	nodes := []*fakeLocker{newFakeLocker(), newFakeLocker(), newFakeLocker()}
+	nodes[2].failed = true
+	quorum := NewQuorumLocker([]Locker{nodes[0], nodes[1], nodes[2]}, DefaultClockDrift)
+
+	lease, acquired, err := quorum.Lock("job", time.Minute)
+	if err != nil || !acquired {
+		t.Fatalf("Lock = (%t, %v), want (true, nil)", acquired, err)
+	}
+	if lease.Token == 0 || lease.Validity <= 0 || lease.Validity > time.Minute {
+		t.Fatalf("lease = %+v, want a token and a validity below the TTL", lease)
+	}
+
+	if _, acquired, _ := quorum.Lock("job", time.Minute); acquired {
+		t.Fatalf("second Lock acquired a held lock")
+	}
+
+	quorum.Unlock(lease)
+	if nodes[0].isHeld("job") || nodes[1].isHeld("job") {
+		t.Fatalf("Unlock left the lock held on a node")
+	}
+}
+
+func TestQuorumLocker_ReleasesPartialAcquisitions(t *testing.T) {
+	nodes := []*fakeLocker{newFakeLocker(), newFakeLocker(), newFakeLocker()}
+	nodes[1].failed = true
+	nodes[2].failed = true
+	quorum := NewQuorumLocker([]Locker{nodes[0], nodes[1], nodes[2]}, DefaultClockDrift)
+
+	_, acquired, err := quorum.Lock("job", time.Minute)
+	if acquired || err == nil {
+		t.Fatalf("Lock without quorum = (%t, %v), want (false, error)", acquired, err)
+	}
+	if nodes[0].isHeld("job") {
+		t.Fatalf("lock acquired on a minority was not released")
+	}
+}
+
+func TestQuorumLocker_FailsWhenTTLUsedUp(t *testing.T) {
+	nodes := []*fakeLocker{newFakeLocker()}
+	quorum := NewQuorumLocker([]Locker{nodes[0]}, 0.5)
+
+	// Drift allowance alone exceeds the TTL
+	if _, acquired, err := quorum.Lock("job", time.Millisecond); acquired || err != nil {
+		t.Fatalf("Lock with no validity left = (%t, %v), want (false, nil)", acquired, err)
+	}
+	if nodes[0].isHeld("job") {
+		t.Fatalf("lock with no validity left was not released")
+	}
+}
+
+func TestNodeLocker_TalksToNodeRoutes(t *testing.T) {
+	var gotTTL int64
+	var gotToken string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("key") != "job" {
+			t.Errorf("key = %q, want job", r.URL.Query().Get("key"))
+		}
+		var body map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		switch r.URL.Path {
+		case "/lock":
+			gotTTL = int64(body["ttlMs"].(float64))
+			_, _ = w.Write([]byte(`{"success":true,"acquired":true,"token":"1792053720381633339"}`))
+		case "/unlock":
+			gotToken = body["token"].(string)
+			_, _ = w.Write([]byte(`{"success":true,"released":true}`))
+		}
+	}))
+	defer server.Close()
+
+	locker := NewNodeLocker(server.URL, nil)
+	token, acquired, err := locker.Lock("job", 1500*time.Millisecond)
+	if err != nil || !acquired || token != 1792053720381633339 || gotTTL != 1500 {
+		t.Fatalf("Lock = (%d, %t, %v) with ttlMs %d, want the node's token", token, acquired, err, gotTTL)
+	}
+	released, err := locker.Unlock("job", token)
+	if err != nil || !released || gotToken != "1792053720381633339" {
+		t.Fatalf("Unlock = (%t, %v) with token %q, want the token sent as a string", released, err, gotToken)
+	}
+}
@@ -1,15 +1,19 @@
-package node
-
-type Node struct {
-	id  int
-	url string
-}
-
-func MakeNode(id int, url string) Node {
-	return Node{id, url}
-}
-
-type VNode struct {
-	nodeId int
-	hash   uint32
-}
+package node
+
+type Node struct {
+	id  int
+	url string
+}
+
+func MakeNode(id int, url string) Node {
+	return Node{id, url}
+}
+
+func (node Node) URL() string {
+	return node.url
+}
+
+type VNode struct {
+	nodeId int
+	hash   uint32
+}
@@ -1,67 +1,229 @@
-package node
-
-import (
-	"fmt"
-	"hash/fnv"
-	"sort"
-)
-
-type NodeService struct {
-	nodesPerWeight int
-	nodes          map[int]Node
-	vnodes         []VNode
-	latestNodeId   int
-}
-
-func fnv32(data []byte) uint32 {
-	h := fnv.New32a()
-	_, _ = h.Write(data)
-	return h.Sum32()
-}
-
-func MakeNodeService(nodesPerWeight int) NodeService {
-	return NodeService{nodesPerWeight, make(map[int]Node), make([]VNode, 0), 0}
-}
-
-func (nodeService *NodeService) AddNode(url string, weight int) {
-	numVNodes := weight * nodeService.nodesPerWeight
-	id := nodeService.latestNodeId
-	nodeService.latestNodeId += 1
-	for i := range numVNodes {
-		key := fmt.Sprintf("%d-%d", id, i)
-		hash := fnv32([]byte(key))
-		nodeService.vnodes = append(nodeService.vnodes, VNode{id, hash})
-	}
-
-	sort.Slice(nodeService.vnodes, func(i, j int) bool {
-		return nodeService.vnodes[i].hash < nodeService.vnodes[j].hash
-	})
-	nodeService.nodes[id] = MakeNode(id, url)
-}
-
-func (nodeService *NodeService) RemoveNode(id int) {
-	out := make([]VNode, 0)
-	for _, vn := range nodeService.vnodes {
-		if id != vn.nodeId {
-			out = append(out, vn)
-		}
-	}
-	nodeService.vnodes = out
-	delete(nodeService.nodes, id)
-}
-
-func (nodeService *NodeService) FindNode(hash uint32) Node {
-	// First vnode with hash >= given hash
-	idx := sort.Search(len(nodeService.vnodes), func(i int) bool {
-		return nodeService.vnodes[i].hash >= hash
-	})
-
-	// Wrap around if necessary
-	if idx == len(nodeService.vnodes) {
-		idx = 0
-	}
-
-	vn := nodeService.vnodes[idx]
-	node := nodeService.nodes[vn.nodeId]
-	return node
-}
+package node
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+type NodeService struct {
+	nodesPerWeight int
+	nodes          map[int]Node
+	vnodes         []VNode
+	latestNodeId   int
+	// epoch counts the changes made to the ring
+	epoch uint64
+}
+
+// Range is the keys whose hash lies in (Start, End], wrapping past the top
+// of the hash space when Start >= End, and the URL of the node owning them.
+type Range struct {
+	Start uint32
+	End   uint32
+	URL   string
+}
+
+func fnv32(data []byte) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write(data)
+	return h.Sum32()
+}
+
+func MakeNodeService(nodesPerWeight int) NodeService {
+	return NodeService{nodesPerWeight, make(map[int]Node), make([]VNode, 0), 0, 0}
+}
+
+func (nodeService *NodeService) AddNode(url string, weight int) {
+	numVNodes := weight * nodeService.nodesPerWeight
+	id := nodeService.latestNodeId
+	nodeService.latestNodeId += 1
+	for i := range numVNodes {
+		key := fmt.Sprintf("%d-%d", id, i)
+		hash := fnv32([]byte(key))
+		nodeService.vnodes = append(nodeService.vnodes, VNode{id, hash})
+	}
+
+	sort.Slice(nodeService.vnodes, func(i, j int) bool {
+		return nodeService.vnodes[i].hash < nodeService.vnodes[j].hash
+	})
+	nodeService.nodes[id] = MakeNode(id, url)
+	nodeService.epoch++
+}
+
+func (nodeService *NodeService) RemoveNode(id int) {
+	out := make([]VNode, 0)
+	for _, vn := range nodeService.vnodes {
+		if id != vn.nodeId {
+			out = append(out, vn)
+		}
+	}
+	nodeService.vnodes = out
+	delete(nodeService.nodes, id)
+	nodeService.epoch++
+}
+
+func (nodeService *NodeService) FindNode(hash uint32) Node {
+	// First vnode with hash >= given hash
+	idx := sort.Search(len(nodeService.vnodes), func(i int) bool {
+		return nodeService.vnodes[i].hash >= hash
+	})
+
+	// Wrap around if necessary
+	if idx == len(nodeService.vnodes) {
+		idx = 0
+	}
+
+	vn := nodeService.vnodes[idx]
+	node := nodeService.nodes[vn.nodeId]
+	return node
+}
+
+// FindNodeForKey returns the node that owns key.
+func (nodeService *NodeService) FindNodeForKey(key string) Node {
+	return nodeService.FindNode(fnv32([]byte(key)))
+}
+
+// HasNode reports whether a node on the ring has url.
+func (nodeService *NodeService) HasNode(url string) bool {
+	for _, node := range nodeService.nodes {
+		if node.url == url {
+			return true
+		}
+	}
+	return false
+}
+
+// ReplaceURL points the node at oldURL to newURL, keeping its place on the
+// ring, as when a replica is promoted to replace a failed primary. It
+// reports whether a node had oldURL.
+func (nodeService *NodeService) ReplaceURL(oldURL string, newURL string) bool {
+	for id, node := range nodeService.nodes {
+		if node.url == oldURL {
+			nodeService.nodes[id] = MakeNode(id, newURL)
+			nodeService.epoch++
+			return true
+		}
+	}
+	return false
+}
+
+// Epoch returns how many times the ring has changed. It only increases, so
+// a routing decision made at an older epoch may be out of date.
+func (nodeService *NodeService) Epoch() uint64 {
+	return nodeService.epoch
+}
+
+// AdvanceEpoch moves the epoch past epoch if it is not already, as when
+// nodes have been told of epochs from before the ring was rebuilt.
+func (nodeService *NodeService) AdvanceEpoch(epoch uint64) {
+	if nodeService.epoch <= epoch {
+		nodeService.epoch = epoch + 1
+	}
+}
+
+// Ranges lists the ranges of hashes on the ring in order, each with the
+// node that owns it. Neighbouring ranges owned by the same node are merged.
+func (nodeService *NodeService) Ranges() []Range {
+	n := len(nodeService.vnodes)
+	var ranges []Range
+	for i, vn := range nodeService.vnodes {
+		start := nodeService.vnodes[(i+n-1)%n].hash
+		url := nodeService.nodes[vn.nodeId].url
+		if last := len(ranges) - 1; last >= 0 && ranges[last].URL == url {
+			ranges[last].End = vn.hash
+			continue
+		}
+		ranges = append(ranges, Range{start, vn.hash, url})
+	}
+	// The last range wraps around to the first
+	if last := len(ranges) - 1; last > 0 && ranges[last].URL == ranges[0].URL {
+		ranges[0].Start = ranges[last].Start
+		ranges = ranges[:last]
+	}
+	return ranges
+}
+
+// Position is where a vnode sits on the ring and the URL of the node it
+// belongs to. The vnode owns the keys whose hash lies between the previous
+// vnode's position and its own.
+type Position struct {
+	Hash uint32
+	URL  string
+}
+
+// Positions lists the vnodes on the ring in hash order.
+func (nodeService *NodeService) Positions() []Position {
+	positions := make([]Position, len(nodeService.vnodes))
+	for i, vn := range nodeService.vnodes {
+		positions[i] = Position{vn.hash, nodeService.nodes[vn.nodeId].url}
+	}
+	return positions
+}
+
+// inRange reports whether hash lies in (start, end], wrapping when
+// start >= end.
+func inRange(hash uint32, start uint32, end uint32) bool {
+	if start < end {
+		return start < hash && hash <= end
+	}
+	return hash > start || hash <= end
+}
+
+// RangeOwner returns the URL of the node that owns every key in
+// (start, end], or an error if several nodes own parts of it.
+func (nodeService *NodeService) RangeOwner(start uint32, end uint32) (string, error) {
+	if len(nodeService.vnodes) == 0 {
+		return "", errors.New("the ring has no nodes")
+	}
+	// Keys in the range belong to the vnodes inside it and to the first
+	// vnode at or after its end
+	owner := nodeService.FindNode(end).url
+	for _, vn := range nodeService.vnodes {
+		if inRange(vn.hash, start, end) && nodeService.nodes[vn.nodeId].url != owner {
+			return "", fmt.Errorf("range (%d, %d] is split between %s and %s", start, end, owner, nodeService.nodes[vn.nodeId].url)
+		}
+	}
+	return owner, nil
+}
+
+// MoveRange assigns every key in (start, end] to the node at url, leaving
+// the rest of the ring as it was.
+func (nodeService *NodeService) MoveRange(start uint32, end uint32, url string) error {
+	if start == end {
+		return errors.New("cannot move the whole ring")
+	}
+	target := -1
+	for id, node := range nodeService.nodes {
+		if node.url == url {
+			target = id
+		}
+	}
+	if target < 0 {
+		return fmt.Errorf("no node has URL %s", url)
+	}
+
+	// Mark where the range starts so the keys before it stay with their
+	// owner, then replace the vnodes inside it with one for the target at
+	// its end
+	before := nodeService.FindNode(start).id
+	vnodes := make([]VNode, 0, len(nodeService.vnodes)+2)
+	startMarked := false
+	for _, vn := range nodeService.vnodes {
+		if inRange(vn.hash, start, end) {
+			continue
+		}
+		startMarked = startMarked || vn.hash == start
+		vnodes = append(vnodes, vn)
+	}
+	if !startMarked {
+		vnodes = append(vnodes, VNode{before, start})
+	}
+	vnodes = append(vnodes, VNode{target, end})
+	sort.Slice(vnodes, func(i, j int) bool {
+		return vnodes[i].hash < vnodes[j].hash
+	})
+	nodeService.vnodes = vnodes
+	nodeService.epoch++
+	return nil
+}
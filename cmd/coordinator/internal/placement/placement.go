@@ -0,0 +1,161 @@
+package placement
+
+import (
+	"blueis/cmd/coordinator/internal/node"
+	"blueis/cmd/coordinator/internal/topology"
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// hashSpace is how many hashes there are on the ring.
+const hashSpace = 1 << 32
+
+// Config says how far nodes may drift from the share of keys their
+// capacity earns them, and how much is moved at once to bring them back.
+type Config struct {
+	// Step is the largest fraction of the hash space one move takes, so
+	// placement changes gradually rather than in one large migration
+	Step float64
+	// Tolerance is how far past its target, as a fraction of it, a node's
+	// load may go before keys are moved off it
+	Tolerance float64
+	// MinKeys is how many keys the cluster must hold before load is
+	// measured by the nodes' key counts rather than by their share of the
+	// hash space
+	MinKeys int
+}
+
+// NodeBalance is a node's capacity, the share of keys it earns and the
+// share it has.
+type NodeBalance struct {
+	Node     string
+	Capacity topology.Capacity
+	// Weight is the node's capacity relative to the average node's
+	Weight float64
+	// Target is the fraction of keys the node should hold
+	Target float64
+	// Share is the fraction of the hash space the node owns
+	Share float64
+	// Load is the fraction of keys the node holds, or Share when keys are
+	// not being counted
+	Load float64
+}
+
+// Move hands the keys whose hash lies in (Start, End] from one node to
+// another.
+type Move struct {
+	Start uint32
+	End   uint32
+	From  string
+	To    string
+}
+
+// Balance weighs every node on the ring by the capacity it reported and
+// compares the keys it holds with those it should, sorted by node. A
+// node's weight is its CPUs relative to the average node's or, when every
+// node knows its memory limit, that relative to the average limit if it is
+// smaller, as whichever runs out first bounds what the node can take. It
+// fails if a node on the ring has not reported its capacity.
+func Balance(ranges []node.Range, capacities map[string]topology.Capacity, config Config) ([]NodeBalance, error) {
+	index := make(map[string]int)
+	var nodes []NodeBalance
+	for _, r := range ranges {
+		i, ok := index[r.URL]
+		if !ok {
+			capacity, reported := capacities[r.URL]
+			if !reported || capacity.CPUs <= 0 {
+				return nil, fmt.Errorf("%s has not reported its capacity", r.URL)
+			}
+			i = len(nodes)
+			index[r.URL] = i
+			nodes = append(nodes, NodeBalance{Node: r.URL, Capacity: capacity})
+		}
+		nodes[i].Share += arcSize(r.Start, r.End) / hashSpace
+	}
+	slices.SortFunc(nodes, func(a, b NodeBalance) int {
+		return strings.Compare(a.Node, b.Node)
+	})
+
+	var cpus, memory float64
+	keys := 0
+	limited, counted := true, true
+	for _, n := range nodes {
+		cpus += float64(n.Capacity.CPUs)
+		memory += float64(n.Capacity.MemoryLimit)
+		keys += n.Capacity.Keys
+		limited = limited && n.Capacity.MemoryLimit > 0
+		counted = counted && n.Capacity.Keys >= 0
+	}
+	counted = counted && keys > 0 && keys >= config.MinKeys
+
+	var weights float64
+	for i := range nodes {
+		n := &nodes[i]
+		n.Weight = float64(n.Capacity.CPUs) / cpus * float64(len(nodes))
+		if limited {
+			n.Weight = min(n.Weight, float64(n.Capacity.MemoryLimit)/memory*float64(len(nodes)))
+		}
+		weights += n.Weight
+		n.Load = n.Share
+		if counted {
+			n.Load = float64(n.Capacity.Keys) / float64(keys)
+		}
+	}
+	for i := range nodes {
+		nodes[i].Target = nodes[i].Weight / weights
+	}
+	return nodes, nil
+}
+
+// Plan picks the next move towards every node holding its target share of
+// keys: part of the largest arc of the node furthest over its target goes
+// to the node furthest under its own. It reports false when no node is
+// over its target by more than the tolerance.
+func Plan(ranges []node.Range, capacities map[string]topology.Capacity, config Config) (Move, bool, error) {
+	nodes, err := Balance(ranges, capacities, config)
+	if err != nil || len(nodes) < 2 {
+		return Move{}, false, err
+	}
+	ratio := func(n NodeBalance) float64 {
+		return n.Load / n.Target
+	}
+	from := slices.MaxFunc(nodes, func(a, b NodeBalance) int {
+		return cmp.Compare(ratio(a), ratio(b))
+	})
+	to := slices.MinFunc(nodes, func(a, b NodeBalance) int {
+		return cmp.Compare(ratio(a), ratio(b))
+	})
+	if from.Load <= from.Target*(1+config.Tolerance) {
+		return Move{}, false, nil
+	}
+
+	// Move what takes the nodes nearest their targets, turned from keys
+	// into hashes by the density of keys on the node they come from
+	excess := min(from.Load-from.Target, to.Target-to.Load)
+	size := uint64(min(excess*from.Share/from.Load, config.Step) * hashSpace)
+	if size == 0 {
+		return Move{}, false, nil
+	}
+	var arc node.Range
+	largest := 0.0
+	for _, r := range ranges {
+		if r.URL == from.Node && arcSize(r.Start, r.End) > largest {
+			arc, largest = r, arcSize(r.Start, r.End)
+		}
+	}
+	// The whole ring cannot be moved at once
+	size = min(size, uint64(largest), hashSpace-1)
+	return Move{arc.End - uint32(size), arc.End, from.Node, to.Node}, true, nil
+}
+
+// arcSize is how many hashes lie in (start, end], which is the whole ring
+// when start == end.
+func arcSize(start uint32, end uint32) float64 {
+	if start == end {
+		return hashSpace
+	}
+	// Wraps past the top of the hash space when start > end
+	return float64(end - start)
+}
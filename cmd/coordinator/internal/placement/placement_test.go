@@ -0,0 +1,126 @@
+package placement
+
+import (
+	"blueis/cmd/coordinator/internal/node"
+	"blueis/cmd/coordinator/internal/topology"
+	"math"
+	"strings"
+	"testing"
+)
+
+const quarter = hashSpace / 4
+
+// halves gives a and b half of the ring each.
+var halves = []node.Range{
+	{Start: 0, End: 2 * quarter, URL: "a"},
+	{Start: 2 * quarter, End: 0, URL: "b"},
+}
+
+func near(got float64, want float64) bool {
+	return math.Abs(got-want) < 1e-9
+}
+
+func TestBalance_WeighsNodesByCapacity(t *testing.T) {
+	capacities := map[string]topology.Capacity{
+		"a": {CPUs: 2, Keys: -1},
+		"b": {CPUs: 6, Keys: -1},
+	}
+	nodes, err := Balance(halves, capacities, Config{})
+	if err != nil {
+		t.Fatalf("Balance returned error: %v", err)
+	}
+	if !near(nodes[0].Target, 0.25) || !near(nodes[1].Target, 0.75) {
+		t.Fatalf("Balance = %+v, want a and b to earn a quarter and three quarters", nodes)
+	}
+	if !near(nodes[0].Load, 0.5) || !near(nodes[0].Share, 0.5) {
+		t.Fatalf("Balance = %+v, want a's load to be its half of the ring without key counts", nodes)
+	}
+
+	// With the same memory, b runs out of memory long before CPUs while a
+	// is still bounded by its CPUs
+	capacities["a"] = topology.Capacity{CPUs: 2, MemoryLimit: 1 << 30, Keys: -1}
+	capacities["b"] = topology.Capacity{CPUs: 6, MemoryLimit: 1 << 30, Keys: -1}
+	nodes, _ = Balance(halves, capacities, Config{})
+	if !near(nodes[0].Weight, 0.5) || !near(nodes[1].Weight, 1) || !near(nodes[0].Target, 1.0/3) {
+		t.Fatalf("Balance = %+v, want a to weigh 0.5 by CPUs and b 1 by memory", nodes)
+	}
+
+	// A memory limit only some nodes know of is not compared
+	capacities["a"] = topology.Capacity{CPUs: 2, Keys: -1}
+	nodes, _ = Balance(halves, capacities, Config{})
+	if !near(nodes[0].Target, 0.25) {
+		t.Fatalf("Balance = %+v, want memory left out when a has no limit", nodes)
+	}
+}
+
+func TestBalance_MeasuresLoadByKeysOnceThereAreEnough(t *testing.T) {
+	capacities := map[string]topology.Capacity{
+		"a": {CPUs: 1, Keys: 90},
+		"b": {CPUs: 1, Keys: 10},
+	}
+	nodes, _ := Balance(halves, capacities, Config{MinKeys: 100})
+	if !near(nodes[0].Load, 0.9) {
+		t.Fatalf("Balance = %+v, want a's load to be its share of keys", nodes)
+	}
+	nodes, _ = Balance(halves, capacities, Config{MinKeys: 1000})
+	if !near(nodes[0].Load, 0.5) {
+		t.Fatalf("Balance = %+v, want a's load to be its share of the ring with few keys", nodes)
+	}
+}
+
+func TestBalance_RequiresEveryNodeToReport(t *testing.T) {
+	_, err := Balance(halves, map[string]topology.Capacity{"a": {CPUs: 1}}, Config{})
+	if err == nil || !strings.Contains(err.Error(), "b has not reported") {
+		t.Fatalf("Balance returned %v, want an error naming b", err)
+	}
+}
+
+func TestPlan_MovesPartOfTheLargestArcOfTheMostLoadedNode(t *testing.T) {
+	ranges := []node.Range{
+		{Start: 0, End: quarter, URL: "a"},
+		{Start: quarter, End: 2 * quarter, URL: "b"},
+		{Start: 2 * quarter, End: 0, URL: "a"},
+	}
+	capacities := map[string]topology.Capacity{
+		"a": {CPUs: 1, Keys: -1},
+		"b": {CPUs: 1, Keys: -1},
+	}
+
+	// a owns three quarters of the ring and should own half; a step of an
+	// eighth takes it part of the way from the end of its larger arc
+	move, ok, err := Plan(ranges, capacities, Config{Step: 0.125, Tolerance: 0.1})
+	if err != nil || !ok {
+		t.Fatalf("Plan = %+v, %v, %v, want a move", move, ok, err)
+	}
+	want := Move{Start: hashSpace - hashSpace/8, End: 0, From: "a", To: "b"}
+	if move != want {
+		t.Fatalf("Plan = %+v, want %+v", move, want)
+	}
+
+	// A large step moves only what balances the nodes
+	move, _, _ = Plan(ranges, capacities, Config{Step: 1, Tolerance: 0.1})
+	if want := (Move{Start: 3 * quarter, End: 0, From: "a", To: "b"}); move != want {
+		t.Fatalf("Plan = %+v, want %+v", move, want)
+	}
+}
+
+func TestPlan_LeavesNodesWithinTolerance(t *testing.T) {
+	capacities := map[string]topology.Capacity{
+		"a": {CPUs: 1, Keys: 52},
+		"b": {CPUs: 1, Keys: 48},
+	}
+	if move, ok, err := Plan(halves, capacities, Config{Step: 0.1, Tolerance: 0.1}); ok || err != nil {
+		t.Fatalf("Plan = %+v, %v, %v, want no move for a node 4%% over its target", move, ok, err)
+	}
+
+	// Key counts can show imbalance the ring does not
+	capacities["a"] = topology.Capacity{CPUs: 1, Keys: 80}
+	capacities["b"] = topology.Capacity{CPUs: 1, Keys: 20}
+	move, ok, _ := Plan(halves, capacities, Config{Step: 1, Tolerance: 0.1})
+	// a holds 0.8 of the keys on half the ring, so 0.3 of the keys lie on
+	// 0.1875 of the ring
+	size := 2*quarter - float64(move.Start)
+	if !ok || move.End != 2*quarter || move.From != "a" || move.To != "b" || math.Abs(size-0.1875*hashSpace) > 1 {
+		t.Fatalf("Plan = %+v, %v, want the last 0.1875 of a's arc moved to b", move, ok)
+	}
+}
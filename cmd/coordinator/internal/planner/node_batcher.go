@@ -0,0 +1,107 @@
+package planner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// epochHeader tells a node the epoch its keys were routed at.
+const epochHeader = "X-Blueis-Epoch"
+
+// NodeBatcher is a Node backed by a blueis node's /kv/mget and /kv/mset
+// routes.
+type NodeBatcher struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewNodeBatcher(baseURL string, client *http.Client) *NodeBatcher {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &NodeBatcher{baseURL, client}
+}
+
+type nodeEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type nodeMultiKeyRequest struct {
+	Keys    []string    `json:"keys,omitempty"`
+	Entries []nodeEntry `json:"entries,omitempty"`
+}
+
+type nodeMultiKeyResult struct {
+	Key       string  `json:"key"`
+	Value     *string `json:"value,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	Misrouted bool    `json:"misrouted,omitempty"`
+}
+
+type nodeMultiKeyResponse struct {
+	Success bool                 `json:"success"`
+	Results []nodeMultiKeyResult `json:"results,omitempty"`
+	Error   string               `json:"error,omitempty"`
+}
+
+func (batcher *NodeBatcher) MGet(epoch uint64, keys []string) ([]Result, error) {
+	return batcher.post("/kv/mget", epoch, nodeMultiKeyRequest{Keys: keys})
+}
+
+func (batcher *NodeBatcher) MSet(epoch uint64, entries []Entry) ([]Result, error) {
+	body := nodeMultiKeyRequest{Entries: make([]nodeEntry, len(entries))}
+	for i, entry := range entries {
+		body.Entries[i] = nodeEntry{entry.Key, entry.Value}
+	}
+	return batcher.post("/kv/mset", epoch, body)
+}
+
+// post sends body to path, with epoch in its header unless it is 0.
+func (batcher *NodeBatcher) post(path string, epoch uint64, body nodeMultiKeyRequest) ([]Result, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, batcher.baseURL+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if epoch > 0 {
+		req.Header.Set(epochHeader, strconv.FormatUint(epoch, 10))
+	}
+	resp, err := batcher.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var res nodeMultiKeyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("decoding response from %s: %w", batcher.baseURL, err)
+	}
+	// The node has been told of a newer topology
+	if resp.StatusCode == http.StatusMisdirectedRequest {
+		return nil, fmt.Errorf("%w: %s: %s", ErrMisrouted, batcher.baseURL, res.Error)
+	}
+	if !res.Success {
+		return nil, fmt.Errorf("%s: %s", batcher.baseURL, res.Error)
+	}
+
+	results := make([]Result, len(res.Results))
+	for i, result := range res.Results {
+		results[i] = Result{Key: result.Key, Value: result.Value}
+		switch {
+		case result.Misrouted:
+			results[i].Err = fmt.Errorf("%w: %s: %s", ErrMisrouted, batcher.baseURL, result.Error)
+		case result.Error != "":
+			results[i].Err = fmt.Errorf("%s: %s", batcher.baseURL, result.Error)
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,183 @@
+package planner
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// ErrMisrouted is returned by nodes for keys they do not own at the epoch
+// the keys were routed at, either for a whole batch or for single keys.
+var ErrMisrouted = errors.New("node does not own the keys it was sent")
+
+// maxRouteAttempts is how many times a key is routed before giving up on a
+// topology that keeps changing under it.
+const maxRouteAttempts = 3
+
+// Entry is a key and the value to write to it.
+type Entry struct {
+	Key   string
+	Value string
+}
+
+// Result is the outcome for one key. Reads of keys that do not exist have
+// neither a Value nor an Err.
+type Result struct {
+	Key   string
+	Value *string
+	Err   error
+}
+
+// Node reads and writes batches of keys on one node, returning a Result per
+// key in the order they were sent, or an error if the batch as a whole
+// failed. It is told the epoch the keys were routed at.
+type Node interface {
+	MGet(epoch uint64, keys []string) ([]Result, error)
+	MSet(epoch uint64, entries []Entry) ([]Result, error)
+}
+
+// Limits bound the requests a multi-key operation sends.
+type Limits struct {
+	// BatchSize is the most keys sent to a node in one request; 0 sends
+	// each node's keys in a single request
+	BatchSize int
+	// Parallel is the most requests one operation has in flight at once;
+	// 0 sends them one at a time
+	Parallel int
+}
+
+// Planner runs reads and writes of many keys by grouping the keys by the
+// node route returns for them, splitting each node's keys into batches and
+// sending the batches in parallel. A failure only fails the keys it
+// affects, and keys a node turns away because the topology changed are
+// routed again.
+type Planner struct {
+	route  func(key string) (string, uint64)
+	dial   func(address string) Node
+	limits Limits
+}
+
+func NewPlanner(route func(key string) (string, uint64), dial func(address string) Node, limits Limits) *Planner {
+	return &Planner{route, dial, limits}
+}
+
+// batch is the keys sent to a node in one request, by their index in the
+// operation.
+type batch struct {
+	address string
+	epoch   uint64
+	indexes []int
+}
+
+// MGet reads keys, returning a Result for each in the same order.
+func (planner *Planner) MGet(keys []string) []Result {
+	return planner.run(keys, func(node Node, epoch uint64, indexes []int) ([]Result, error) {
+		batchKeys := make([]string, len(indexes))
+		for i, index := range indexes {
+			batchKeys[i] = keys[index]
+		}
+		return node.MGet(epoch, batchKeys)
+	})
+}
+
+// MSet writes entries, returning a Result for each in the same order. The
+// writes are not atomic: some may be applied while others fail.
+func (planner *Planner) MSet(entries []Entry) []Result {
+	keys := make([]string, len(entries))
+	for i, entry := range entries {
+		keys[i] = entry.Key
+	}
+	return planner.run(keys, func(node Node, epoch uint64, indexes []int) ([]Result, error) {
+		batchEntries := make([]Entry, len(indexes))
+		for i, index := range indexes {
+			batchEntries[i] = entries[index]
+		}
+		return node.MSet(epoch, batchEntries)
+	})
+}
+
+// run plans keys into batches and sends each with send, routing misrouted
+// keys again until they land or maxRouteAttempts is reached.
+func (planner *Planner) run(keys []string, send func(node Node, epoch uint64, indexes []int) ([]Result, error)) []Result {
+	results := make([]Result, len(keys))
+	pending := make([]int, len(keys))
+	for i := range pending {
+		pending[i] = i
+	}
+
+	parallel := max(planner.limits.Parallel, 1)
+	for attempt := 1; len(pending) > 0; attempt++ {
+		var mu sync.Mutex
+		var misrouted []int
+		var wg sync.WaitGroup
+		slots := make(chan struct{}, parallel)
+
+		for _, b := range planner.plan(keys, pending) {
+			slots <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-slots }()
+
+				batchResults, err := send(planner.dial(b.address), b.epoch, b.indexes)
+				if err == nil && len(batchResults) != len(b.indexes) {
+					err = fmt.Errorf("%s returned %d results for %d keys", b.address, len(batchResults), len(b.indexes))
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				for i, index := range b.indexes {
+					result := Result{Err: err}
+					if err == nil {
+						result = batchResults[i]
+					}
+					result.Key = keys[index]
+					if errors.Is(result.Err, ErrMisrouted) && attempt < maxRouteAttempts {
+						misrouted = append(misrouted, index)
+						continue
+					}
+					results[index] = result
+				}
+			}()
+		}
+		wg.Wait()
+
+		slices.Sort(misrouted)
+		pending = misrouted
+	}
+	return results
+}
+
+// plan groups the keys at indexes by the node that owns them, in the order
+// each node first appears, and splits each node's keys into batches of at
+// most BatchSize. A batch carries the oldest epoch any of its keys was
+// routed at.
+func (planner *Planner) plan(keys []string, indexes []int) []batch {
+	var addresses []string
+	byAddress := make(map[string]*batch)
+	for _, index := range indexes {
+		address, epoch := planner.route(keys[index])
+		b, ok := byAddress[address]
+		if !ok {
+			b = &batch{address: address, epoch: epoch}
+			byAddress[address] = b
+			addresses = append(addresses, address)
+		}
+		b.epoch = min(b.epoch, epoch)
+		b.indexes = append(b.indexes, index)
+	}
+
+	var batches []batch
+	for _, address := range addresses {
+		b := byAddress[address]
+		size := planner.limits.BatchSize
+		if size <= 0 {
+			size = len(b.indexes)
+		}
+		for chunk := range slices.Chunk(b.indexes, size) {
+			batches = append(batches, batch{address, b.epoch, chunk})
+		}
+	}
+	return batches
+}
@@ -0,0 +1,269 @@
+package planner
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNode stores keys in a map and records the batches sent to it.
+type fakeNode struct {
+	mu      sync.Mutex
+	values  map[string]string
+	batches [][]string
+	down    bool
+	// epoch is the newest epoch the node has been told of
+	epoch uint64
+	// moved are keys the node turns away one by one
+	moved map[string]bool
+	// misrouted is called whenever the node turns keys away
+	misrouted func()
+	// delay holds each batch, so overlapping batches can be seen
+	delay    time.Duration
+	inFlight *inFlight
+}
+
+// inFlight counts batches being served across nodes.
+type inFlight struct {
+	mu      sync.Mutex
+	current int
+	peak    int
+}
+
+func newFakeNode() *fakeNode {
+	return &fakeNode{values: make(map[string]string), moved: make(map[string]bool)}
+}
+
+func (node *fakeNode) serve(epoch uint64, keys []string, apply func(i int, key string) Result) ([]Result, error) {
+	if node.inFlight != nil {
+		node.inFlight.mu.Lock()
+		node.inFlight.current++
+		node.inFlight.peak = max(node.inFlight.peak, node.inFlight.current)
+		node.inFlight.mu.Unlock()
+		defer func() {
+			node.inFlight.mu.Lock()
+			node.inFlight.current--
+			node.inFlight.mu.Unlock()
+		}()
+	}
+	time.Sleep(node.delay)
+
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if node.down {
+		return nil, errors.New("unreachable")
+	}
+	if epoch < node.epoch {
+		node.turnedAway()
+		return nil, ErrMisrouted
+	}
+	node.batches = append(node.batches, keys)
+	results := make([]Result, len(keys))
+	for i, key := range keys {
+		if node.moved[key] {
+			node.turnedAway()
+			results[i] = Result{Key: key, Err: fmt.Errorf("%w: %s", ErrMisrouted, key)}
+			continue
+		}
+		results[i] = apply(i, key)
+	}
+	return results, nil
+}
+
+func (node *fakeNode) turnedAway() {
+	if node.misrouted != nil {
+		node.misrouted()
+	}
+}
+
+func (node *fakeNode) MGet(epoch uint64, keys []string) ([]Result, error) {
+	return node.serve(epoch, keys, func(_ int, key string) Result {
+		value, ok := node.values[key]
+		if !ok {
+			return Result{Key: key}
+		}
+		return Result{Key: key, Value: &value}
+	})
+}
+
+func (node *fakeNode) MSet(epoch uint64, entries []Entry) ([]Result, error) {
+	keys := make([]string, len(entries))
+	for i, entry := range entries {
+		keys[i] = entry.Key
+	}
+	return node.serve(epoch, keys, func(i int, key string) Result {
+		node.values[key] = entries[i].Value
+		return Result{Key: key}
+	})
+}
+
+// testCluster routes keys by their first letter to nodes a, b and c. The
+// route can be changed with reroute.
+type testCluster struct {
+	mu    sync.Mutex
+	nodes map[string]*fakeNode
+	owner func(key string) string
+	epoch uint64
+}
+
+func newTestCluster() *testCluster {
+	return &testCluster{
+		nodes: map[string]*fakeNode{"a": newFakeNode(), "b": newFakeNode(), "c": newFakeNode()},
+		owner: func(key string) string { return key[:1] },
+		epoch: 1,
+	}
+}
+
+func (cluster *testCluster) route(key string) (string, uint64) {
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	return cluster.owner(key), cluster.epoch
+}
+
+func (cluster *testCluster) reroute(owner func(key string) string) {
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	cluster.owner = owner
+	cluster.epoch++
+}
+
+func (cluster *testCluster) planner(limits Limits) *Planner {
+	return NewPlanner(cluster.route, func(address string) Node { return cluster.nodes[address] }, limits)
+}
+
+func keysOf(prefixes string, count int) []string {
+	var keys []string
+	for i := range count {
+		for _, prefix := range prefixes {
+			keys = append(keys, fmt.Sprintf("%c%d", prefix, i))
+		}
+	}
+	return keys
+}
+
+func TestPlanner_GroupsKeysByOwnerInBatches(t *testing.T) {
+	cluster := newTestCluster()
+	planner := cluster.planner(Limits{BatchSize: 4, Parallel: 2})
+
+	keys := keysOf("abc", 10)
+	entries := make([]Entry, len(keys))
+	for i, key := range keys {
+		entries[i] = Entry{key, "v" + key}
+	}
+	for _, result := range planner.MSet(entries) {
+		if result.Err != nil {
+			t.Fatalf("MSet of %s returned error: %v", result.Key, result.Err)
+		}
+	}
+
+	// Each node's 10 keys go in batches of 4, 4 and 2
+	for name, node := range cluster.nodes {
+		if len(node.batches) != 3 {
+			t.Fatalf("node %s got %d batches, want 3", name, len(node.batches))
+		}
+		for _, batch := range node.batches {
+			if len(batch) > 4 {
+				t.Fatalf("node %s got a batch of %d keys, want at most 4", name, len(batch))
+			}
+			for _, key := range batch {
+				if !strings.HasPrefix(key, name) {
+					t.Fatalf("node %s was sent %s", name, key)
+				}
+			}
+		}
+	}
+
+	results := planner.MGet(append(keys, "a-missing"))
+	for i, key := range keys {
+		if results[i].Key != key || results[i].Err != nil || results[i].Value == nil || *results[i].Value != "v"+key {
+			t.Fatalf("MGet result %d = %+v, want %s = v%s", i, results[i], key, key)
+		}
+	}
+	if missing := results[len(keys)]; missing.Value != nil || missing.Err != nil {
+		t.Fatalf("MGet of a missing key = %+v, want no value and no error", missing)
+	}
+}
+
+func TestPlanner_CapsBatchesInFlight(t *testing.T) {
+	cluster := newTestCluster()
+	counter := &inFlight{}
+	for _, node := range cluster.nodes {
+		node.delay = 10 * time.Millisecond
+		node.inFlight = counter
+	}
+
+	cluster.planner(Limits{BatchSize: 1, Parallel: 3}).MGet(keysOf("abc", 4))
+	if counter.peak != 3 {
+		t.Fatalf("%d batches were in flight at once, want 3", counter.peak)
+	}
+}
+
+func TestPlanner_ReportsFailuresPerKey(t *testing.T) {
+	cluster := newTestCluster()
+	cluster.nodes["a"].values["a0"] = "1"
+	cluster.nodes["c"].values["c0"] = "3"
+	cluster.nodes["b"].down = true
+
+	results := cluster.planner(Limits{Parallel: 3}).MGet([]string{"a0", "b0", "c0", "b1"})
+	for _, i := range []int{0, 2} {
+		if results[i].Err != nil || results[i].Value == nil {
+			t.Fatalf("MGet of %s = %+v, want its value", results[i].Key, results[i])
+		}
+	}
+	for _, i := range []int{1, 3} {
+		if results[i].Err == nil || results[i].Key != fmt.Sprintf("b%d", i/2) {
+			t.Fatalf("MGet result %d = %+v, want b%d failed", i, results[i], i/2)
+		}
+	}
+}
+
+func TestPlanner_RoutesAgainAfterTopologyChange(t *testing.T) {
+	cluster := newTestCluster()
+	// Node a has been told of a newer topology that gives its keys to c
+	cluster.nodes["a"].epoch = 2
+	// and node b has already handed b1 over to c
+	cluster.nodes["b"].moved["b1"] = true
+	var once sync.Once
+	reroute := func() {
+		once.Do(func() {
+			cluster.reroute(func(key string) string {
+				if key == "b1" || key[:1] == "a" {
+					return "c"
+				}
+				return key[:1]
+			})
+		})
+	}
+	cluster.nodes["a"].misrouted = reroute
+	cluster.nodes["b"].misrouted = reroute
+
+	results := cluster.planner(Limits{Parallel: 2}).MSet([]Entry{{"a0", "1"}, {"b0", "2"}, {"b1", "3"}})
+	for _, result := range results {
+		if result.Err != nil {
+			t.Fatalf("MSet of %s returned error: %v", result.Key, result.Err)
+		}
+	}
+	c := cluster.nodes["c"]
+	if len(cluster.nodes["a"].batches) != 0 || len(c.batches) != 1 {
+		t.Fatalf("a took %d batches and c %d, want a's and b's turned away keys sent on to c together", len(cluster.nodes["a"].batches), len(c.batches))
+	}
+	if c.values["a0"] != "1" || c.values["b1"] != "3" || cluster.nodes["b"].values["b0"] != "2" {
+		t.Fatalf("c holds %v and b holds %v, want a0 and b1 on c and b0 on b", c.values, cluster.nodes["b"].values)
+	}
+}
+
+func TestPlanner_GivesUpOnMisroutedKeys(t *testing.T) {
+	cluster := newTestCluster()
+	cluster.nodes["a"].moved["a0"] = true
+
+	results := cluster.planner(Limits{}).MGet([]string{"a0"})
+	if !errors.Is(results[0].Err, ErrMisrouted) {
+		t.Fatalf("MGet of a key no node owns returned %v, want ErrMisrouted", results[0].Err)
+	}
+	if len(cluster.nodes["a"].batches) != maxRouteAttempts {
+		t.Fatalf("a0 was sent %d times, want %d", len(cluster.nodes["a"].batches), maxRouteAttempts)
+	}
+}
@@ -0,0 +1,178 @@
+package reshard
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+var ErrDigestMismatch = errors.New("source and target hold different data for the range")
+
+// Range is the keys whose hash lies in (Start, End], wrapping past the top
+// of the hash space when Start >= End.
+type Range struct {
+	Start uint32
+	End   uint32
+}
+
+// Digest summarises the keys a node holds in a range: how many there are
+// and a checksum of their keys and values that does not depend on order.
+type Digest struct {
+	Keys int
+	Sum  uint64
+}
+
+// Node is a node ranges of keys can be moved to and from.
+type Node interface {
+	// Import starts copying r from source and keeping it up to date
+	Import(source string, r Range) error
+	// Imported reports whether the copy of r has finished its initial sync,
+	// and the source offset it has caught up to
+	Imported(r Range) (offset uint64, synced bool, err error)
+	// EndImport stops copying r, deleting the copy unless keep is set
+	EndImport(r Range, keep bool) error
+	// Offset is the offset of the last change the node has made
+	Offset() (uint64, error)
+	// Fence refuses writes to r until Unfence or Release
+	Fence(r Range) error
+	Unfence(r Range) error
+	// Release deletes r and redirects requests for it to owner
+	Release(r Range, owner string) error
+	Digest(r Range) (Digest, error)
+}
+
+// Mover moves ranges of keys between nodes without losing writes made
+// during the move. Moves run one at a time.
+type Mover struct {
+	dial    func(address string) Node
+	timeout time.Duration
+	// poll is how often progress is checked while waiting on a node
+	poll time.Duration
+	// verifyAttempts is how many times a digest mismatch is waited out
+	// before the move is abandoned
+	verifyAttempts int
+
+	moving sync.Mutex
+}
+
+// NewMover returns a mover that gives each stage of a move up to timeout
+// to finish.
+func NewMover(dial func(address string) Node, timeout time.Duration) *Mover {
+	return &Mover{dial: dial, timeout: timeout, poll: 50 * time.Millisecond, verifyAttempts: 3}
+}
+
+// Move moves r from source, which must own all of it, to target:
+//
+//  1. target imports r from source, following source's changes to it;
+//  2. once target has synced, source fences r, refusing writes to it;
+//  3. once target has caught up, the digests of both copies are compared;
+//  4. flip routes r to target, bumping the ring's epoch;
+//  5. target stops importing, and source releases r, deleting its copy and
+//     redirecting requests for r to target.
+//
+// Clients writing to r on source between steps 2 and 5 are told to retry,
+// and by then are routed to target. If the move fails before flip, source
+// is unfenced and target's copy deleted, so nothing has changed. If it
+// fails after, r already belongs to target but source still holds a fenced
+// copy; ending the import on target and then releasing r on source, in
+// that order, finish the move.
+func (mover *Mover) Move(source string, target string, r Range, flip func() error) error {
+	mover.moving.Lock()
+	defer mover.moving.Unlock()
+
+	from, to := mover.dial(source), mover.dial(target)
+	if err := to.Import(source, r); err != nil {
+		return fmt.Errorf("starting import on %s: %w", target, err)
+	}
+	abort := func(err error) error {
+		if unfenceErr := from.Unfence(r); unfenceErr != nil {
+			log.Printf("Unfencing range (%d, %d] on %s: %v", r.Start, r.End, source, unfenceErr)
+		}
+		if endErr := to.EndImport(r, false); endErr != nil {
+			log.Printf("Abandoning import of range (%d, %d] on %s: %v", r.Start, r.End, target, endErr)
+		}
+		return err
+	}
+
+	if err := mover.until(func() (bool, error) {
+		_, synced, err := to.Imported(r)
+		return synced, err
+	}); err != nil {
+		return abort(fmt.Errorf("waiting for %s to sync: %w", target, err))
+	}
+	if err := from.Fence(r); err != nil {
+		return abort(fmt.Errorf("fencing range on %s: %w", source, err))
+	}
+
+	// Writes already under way when the fence went up can still land, so
+	// a mismatch is waited out a few times before giving up
+	for attempt := 1; ; attempt++ {
+		offset, err := from.Offset()
+		if err != nil {
+			return abort(err)
+		}
+		if err := mover.until(func() (bool, error) {
+			imported, _, err := to.Imported(r)
+			return imported >= offset, err
+		}); err != nil {
+			return abort(fmt.Errorf("waiting for %s to catch up: %w", target, err))
+		}
+		want, err := from.Digest(r)
+		if err != nil {
+			return abort(err)
+		}
+		got, err := to.Digest(r)
+		if err != nil {
+			return abort(err)
+		}
+		if got == want {
+			break
+		}
+		if attempt == mover.verifyAttempts {
+			return abort(fmt.Errorf("%w: %d keys on %s, %d on %s", ErrDigestMismatch, want.Keys, source, got.Keys, target))
+		}
+	}
+
+	if err := flip(); err != nil {
+		return abort(fmt.Errorf("routing range to %s: %w", target, err))
+	}
+	// Stop importing before the source deletes its copy, or the deletes
+	// would be imported too
+	if err := to.EndImport(r, true); err != nil {
+		return fmt.Errorf("range moved, but ending import on %s: %w", target, err)
+	}
+	if err := from.Release(r, target); err != nil {
+		return fmt.Errorf("range moved, but releasing it on %s: %w", source, err)
+	}
+	return nil
+}
+
+// until polls done until it reports true, fails, or the timeout elapses.
+func (mover *Mover) until(done func() (bool, error)) error {
+	deadline := time.Now().Add(mover.timeout)
+	for {
+		ok, err := done()
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %v", mover.timeout)
+		}
+		time.Sleep(mover.poll)
+	}
+}
+
+// Count returns how many keys source holds in r, which are the keys a move
+// of r would copy. Nothing is changed on source.
+func (mover *Mover) Count(source string, r Range) (int, error) {
+	digest, err := mover.dial(source).Digest(r)
+	if err != nil {
+		return 0, fmt.Errorf("counting keys on %s: %w", source, err)
+	}
+	return digest.Keys, nil
+}
@@ -0,0 +1,214 @@
+package reshard
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+)
+
+// fakeNode holds the keys of a single range, so the range arguments are
+// ignored.
+type fakeNode struct {
+	data   map[string]string
+	offset uint64
+	fenced bool
+	// importing names the node being imported from, and imported the
+	// offset the import has caught up to
+	importing string
+	imported  uint64
+	// corrupt makes the node's digest disagree with its data
+	corrupt    bool
+	fenceErr   error
+	releasedTo string
+}
+
+// fakeCluster records the operations its nodes receive, in order.
+type fakeCluster struct {
+	nodes map[string]*fakeNode
+	log   []string
+}
+
+func (cluster *fakeCluster) dial(address string) Node {
+	return fakeNodeClient{cluster, address}
+}
+
+type fakeNodeClient struct {
+	cluster *fakeCluster
+	name    string
+}
+
+func (client fakeNodeClient) node() *fakeNode {
+	return client.cluster.nodes[client.name]
+}
+
+func (client fakeNodeClient) record(op string) {
+	client.cluster.log = append(client.cluster.log, client.name+" "+op)
+}
+
+func (client fakeNodeClient) Import(source string, r Range) error {
+	client.record("import")
+	client.node().importing = source
+	return nil
+}
+
+// Imported catches the import up with its source straight away.
+func (client fakeNodeClient) Imported(r Range) (uint64, bool, error) {
+	node := client.node()
+	if node.importing == "" {
+		return 0, false, errors.New("not importing")
+	}
+	source := client.cluster.nodes[node.importing]
+	maps.Copy(node.data, source.data)
+	node.imported = source.offset
+	return node.imported, true, nil
+}
+
+func (client fakeNodeClient) EndImport(r Range, keep bool) error {
+	if keep {
+		client.record("end import")
+	} else {
+		client.record("abandon import")
+		clear(client.node().data)
+	}
+	client.node().importing = ""
+	return nil
+}
+
+func (client fakeNodeClient) Offset() (uint64, error) {
+	return client.node().offset, nil
+}
+
+func (client fakeNodeClient) Fence(r Range) error {
+	if err := client.node().fenceErr; err != nil {
+		return err
+	}
+	client.record("fence")
+	client.node().fenced = true
+	return nil
+}
+
+func (client fakeNodeClient) Unfence(r Range) error {
+	client.node().fenced = false
+	return nil
+}
+
+func (client fakeNodeClient) Release(r Range, owner string) error {
+	client.record("release")
+	node := client.node()
+	clear(node.data)
+	node.fenced = false
+	node.releasedTo = owner
+	return nil
+}
+
+func (client fakeNodeClient) Digest(r Range) (Digest, error) {
+	node := client.node()
+	digest := Digest{Keys: len(node.data)}
+	for key, value := range node.data {
+		digest.Sum += uint64(len(key)*31 + len(value))
+	}
+	if node.corrupt {
+		digest.Sum++
+	}
+	return digest, nil
+}
+
+func newFakeCluster() *fakeCluster {
+	return &fakeCluster{nodes: map[string]*fakeNode{
+		"a": {data: map[string]string{"k1": "v1", "k2": "v2"}, offset: 7},
+		"b": {data: make(map[string]string)},
+	}}
+}
+
+func newTestMover(cluster *fakeCluster) *Mover {
+	mover := NewMover(cluster.dial, time.Second)
+	mover.poll = time.Millisecond
+	return mover
+}
+
+func TestMover_MovesRange(t *testing.T) {
+	cluster := newFakeCluster()
+	mover := newTestMover(cluster)
+
+	err := mover.Move("a", "b", Range{1, 2}, func() error {
+		cluster.log = append(cluster.log, "flip")
+		if !cluster.nodes["a"].fenced {
+			t.Fatalf("flipped while the source accepted writes")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Move returned error: %v", err)
+	}
+
+	want := []string{"b import", "a fence", "flip", "b end import", "a release"}
+	if !slices.Equal(cluster.log, want) {
+		t.Fatalf("operations = %q, want %q", cluster.log, want)
+	}
+	if got := cluster.nodes["b"].data; len(got) != 2 || got["k1"] != "v1" {
+		t.Fatalf("target data = %v, want the source's keys", got)
+	}
+	if a := cluster.nodes["a"]; len(a.data) != 0 || a.releasedTo != "b" {
+		t.Fatalf("source still holds %v, released to %q", a.data, a.releasedTo)
+	}
+}
+
+func TestMover_AbandonsMoveOnDigestMismatch(t *testing.T) {
+	cluster := newFakeCluster()
+	cluster.nodes["b"].corrupt = true
+	mover := newTestMover(cluster)
+
+	flipped := false
+	err := mover.Move("a", "b", Range{1, 2}, func() error {
+		flipped = true
+		return nil
+	})
+	if !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("Move returned %v, want ErrDigestMismatch", err)
+	}
+	if flipped {
+		t.Fatalf("routed the range to a target with different data")
+	}
+	if a := cluster.nodes["a"]; a.fenced || len(a.data) != 2 {
+		t.Fatalf("source fenced = %v with %d keys, want unfenced with 2", a.fenced, len(a.data))
+	}
+	if b := cluster.nodes["b"]; b.importing != "" || len(b.data) != 0 {
+		t.Fatalf("target still importing %q with %d keys", b.importing, len(b.data))
+	}
+}
+
+func TestMover_AbandonsMoveWhenSourceCannotFence(t *testing.T) {
+	cluster := newFakeCluster()
+	cluster.nodes["a"].fenceErr = errors.New("transaction prepared")
+	mover := newTestMover(cluster)
+
+	err := mover.Move("a", "b", Range{1, 2}, func() error {
+		t.Fatalf("flipped without fencing the source")
+		return nil
+	})
+	if err == nil {
+		t.Fatalf("Move succeeded without fencing the source")
+	}
+	want := []string{"b import", "b abandon import"}
+	if !slices.Equal(cluster.log, want) {
+		t.Fatalf("operations = %q, want %q", cluster.log, want)
+	}
+}
+
+func TestMover_CountLeavesTheRangeInPlace(t *testing.T) {
+	cluster := newFakeCluster()
+	mover := newTestMover(cluster)
+
+	keys, err := mover.Count("a", Range{1, 2})
+	if err != nil {
+		t.Fatalf("Count returned error: %v", err)
+	}
+	if keys != 2 {
+		t.Fatalf("Count = %d, want 2", keys)
+	}
+	if len(cluster.log) != 0 || len(cluster.nodes["b"].data) != 0 {
+		t.Fatalf("Count changed the cluster: %q", cluster.log)
+	}
+}
@@ -0,0 +1,134 @@
+package reshard
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// NodeMigrator is a Node backed by a blueis node's /migration routes.
+type NodeMigrator struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewNodeMigrator(baseURL string, client *http.Client) *NodeMigrator {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &NodeMigrator{baseURL, client}
+}
+
+type migrationRequest struct {
+	Start  uint32 `json:"start"`
+	End    uint32 `json:"end"`
+	Source string `json:"source,omitempty"`
+	Owner  string `json:"owner,omitempty"`
+	Keep   bool   `json:"keep,omitempty"`
+}
+
+type rangeImportResponse struct {
+	Start  uint32 `json:"start"`
+	End    uint32 `json:"end"`
+	Synced bool   `json:"synced"`
+	Offset uint64 `json:"offset"`
+}
+
+// migrationResponse decodes the replies of the /migration routes, and of
+// /replication/info for Offset.
+type migrationResponse struct {
+	Success bool                  `json:"success"`
+	Imports []rangeImportResponse `json:"imports"`
+	Keys    int                   `json:"keys"`
+	Digest  uint64                `json:"digest"`
+	Offset  uint64                `json:"offset"`
+	Error   string                `json:"error,omitempty"`
+}
+
+func (migrator *NodeMigrator) Import(source string, r Range) error {
+	return migrator.post("/migration/import", migrationRequest{Start: r.Start, End: r.End, Source: source})
+}
+
+func (migrator *NodeMigrator) Imported(r Range) (uint64, bool, error) {
+	var res migrationResponse
+	if err := migrator.get("/migration/status", &res); err != nil {
+		return 0, false, err
+	}
+	for _, imported := range res.Imports {
+		if imported.Start == r.Start && imported.End == r.End {
+			return imported.Offset, imported.Synced, nil
+		}
+	}
+	return 0, false, fmt.Errorf("%s is not importing range (%d, %d]", migrator.baseURL, r.Start, r.End)
+}
+
+func (migrator *NodeMigrator) EndImport(r Range, keep bool) error {
+	return migrator.post("/migration/endimport", migrationRequest{Start: r.Start, End: r.End, Keep: keep})
+}
+
+func (migrator *NodeMigrator) Offset() (uint64, error) {
+	var res migrationResponse
+	if err := migrator.get("/replication/info", &res); err != nil {
+		return 0, err
+	}
+	return res.Offset, nil
+}
+
+func (migrator *NodeMigrator) Fence(r Range) error {
+	return migrator.post("/migration/fence", migrationRequest{Start: r.Start, End: r.End})
+}
+
+func (migrator *NodeMigrator) Unfence(r Range) error {
+	return migrator.post("/migration/unfence", migrationRequest{Start: r.Start, End: r.End})
+}
+
+func (migrator *NodeMigrator) Release(r Range, owner string) error {
+	return migrator.post("/migration/release", migrationRequest{Start: r.Start, End: r.End, Owner: owner})
+}
+
+func (migrator *NodeMigrator) Digest(r Range) (Digest, error) {
+	query := url.Values{}
+	query.Set("hashStart", strconv.FormatUint(uint64(r.Start), 10))
+	query.Set("hashEnd", strconv.FormatUint(uint64(r.End), 10))
+	var res migrationResponse
+	if err := migrator.get("/migration/digest?"+query.Encode(), &res); err != nil {
+		return Digest{}, err
+	}
+	return Digest{res.Keys, res.Digest}, nil
+}
+
+func (migrator *NodeMigrator) get(path string, res *migrationResponse) error {
+	resp, err := migrator.client.Get(migrator.baseURL + path)
+	if err != nil {
+		return err
+	}
+	return migrator.decode(resp, res)
+}
+
+func (migrator *NodeMigrator) post(path string, body migrationRequest) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := migrator.client.Post(migrator.baseURL+path, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	var res migrationResponse
+	return migrator.decode(resp, &res)
+}
+
+func (migrator *NodeMigrator) decode(resp *http.Response, res *migrationResponse) error {
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return fmt.Errorf("decoding response from %s: %w", migrator.baseURL, err)
+	}
+	if !res.Success {
+		return fmt.Errorf("%s: %s", migrator.baseURL, res.Error)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package topology
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"sync"
+	"time"
+)
+
+// ErrSplitBrain is returned when a node has been told the same epoch by
+// another coordinator.
+var ErrSplitBrain = errors.New("another coordinator announced the same epoch")
+
+// State is the newest epoch a node knows and the coordinator that
+// announced it.
+type State struct {
+	Epoch       uint64
+	Coordinator string
+}
+
+// Capacity is what a node reports it has to hold and serve keys with, in
+// reply to every announcement. A Capacity without CPUs was not reported.
+type Capacity struct {
+	CPUs int
+	// MemoryLimit is the most memory the node may use, 0 if it has no
+	// limit it knows of
+	MemoryLimit uint64
+	MemoryUsed  uint64
+	// Keys is how many keys the node held at KeysAt, -1 if it cannot count
+	// them
+	Keys   int
+	KeysAt time.Time
+}
+
+// Report is the capacity a node last reported and when.
+type Report struct {
+	Capacity
+	At time.Time
+}
+
+// Node is a node that is told the ring's epoch.
+type Node interface {
+	// Announce tells the node that coordinator is at epoch and returns the
+	// state it is in afterwards, which is newer if another coordinator
+	// has already told it of a newer epoch, and the capacity it reports
+	Announce(epoch uint64, coordinator string) (State, Capacity, error)
+}
+
+// Announcer tells nodes the ring's epoch, so they can turn away requests
+// routed at an older one. Nodes keep the newest epoch they have been told,
+// so announcing the same epoch again, or announcements overtaking each
+// other, is harmless.
+type Announcer struct {
+	id        string
+	dial      func(address string) Node
+	addresses []string
+
+	mu      sync.Mutex
+	reports map[string]Report
+}
+
+// NewAnnouncer returns an announcer for the coordinator named id and the
+// nodes at addresses, which should include replicas and nodes that have
+// left the ring, since clients may still be routed to them.
+func NewAnnouncer(id string, dial func(address string) Node, addresses []string) *Announcer {
+	return &Announcer{
+		id:        id,
+		dial:      dial,
+		addresses: append([]string(nil), addresses...),
+		reports:   make(map[string]Report),
+	}
+}
+
+// Announce tells every node epoch and returns the newest state any of them
+// is in. A newer epoch means the nodes were told of a ring this
+// coordinator has not seen, either by its own previous run or by another
+// coordinator. Nodes that cannot be reached are named in the error and
+// should be told again later; the error wraps ErrSplitBrain if a node was
+// told epoch by another coordinator.
+func (announcer *Announcer) Announce(epoch uint64) (State, error) {
+	states := make([]State, len(announcer.addresses))
+	errs := make([]error, len(announcer.addresses))
+	var wg sync.WaitGroup
+	for i, address := range announcer.addresses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			state, capacity, err := announcer.dial(address).Announce(epoch, announcer.id)
+			states[i] = state
+			if err != nil {
+				errs[i] = fmt.Errorf("announcing epoch %d to %s: %w", epoch, address, err)
+			}
+			if capacity.CPUs > 0 {
+				announcer.mu.Lock()
+				announcer.reports[address] = Report{capacity, time.Now()}
+				announcer.mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	newest := State{epoch, announcer.id}
+	for _, state := range states {
+		if state.Epoch > newest.Epoch {
+			newest = state
+		}
+	}
+	return newest, errors.Join(errs...)
+}
+
+// Reports returns the capacity each node last reported, by address. Nodes
+// that have never reported are left out.
+func (announcer *Announcer) Reports() map[string]Report {
+	announcer.mu.Lock()
+	defer announcer.mu.Unlock()
+	return maps.Clone(announcer.reports)
+}
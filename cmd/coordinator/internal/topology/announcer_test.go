@@ -0,0 +1,121 @@
+package topology
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeNode keeps the newest epoch it is told, like a node does, and
+// reports capacity.
+type fakeNode struct {
+	mu       sync.Mutex
+	state    State
+	capacity Capacity
+	down     bool
+}
+
+func (node *fakeNode) Announce(epoch uint64, coordinator string) (State, Capacity, error) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if node.down {
+		return State{}, Capacity{}, errors.New("unreachable")
+	}
+	switch {
+	case epoch > node.state.Epoch:
+		node.state = State{epoch, coordinator}
+	case epoch == node.state.Epoch && coordinator != node.state.Coordinator:
+		return node.state, node.capacity, fmt.Errorf("%w: %s was first", ErrSplitBrain, node.state.Coordinator)
+	}
+	return node.state, node.capacity, nil
+}
+
+func newTestAnnouncer(id string, nodes map[string]*fakeNode) *Announcer {
+	var addresses []string
+	for address := range nodes {
+		addresses = append(addresses, address)
+	}
+	return NewAnnouncer(id, func(address string) Node { return nodes[address] }, addresses)
+}
+
+func TestAnnouncer_TellsEveryReachableNode(t *testing.T) {
+	nodes := map[string]*fakeNode{"a": {}, "b": {}, "c": {down: true}}
+	announcer := newTestAnnouncer("c1", nodes)
+
+	newest, err := announcer.Announce(3)
+	if err == nil || !strings.Contains(err.Error(), " c: ") {
+		t.Fatalf("Announce returned %v, want an error naming c", err)
+	}
+	want := State{3, "c1"}
+	if newest != want || nodes["a"].state != want || nodes["b"].state != want {
+		t.Fatalf("Announce = %+v with a at %+v and b at %+v, want all %+v", newest, nodes["a"].state, nodes["b"].state, want)
+	}
+
+	nodes["c"].down = false
+	if _, err := announcer.Announce(3); err != nil {
+		t.Fatalf("Announce returned error: %v", err)
+	}
+	if nodes["c"].state != want {
+		t.Fatalf("c is at %+v after coming back, want %+v", nodes["c"].state, want)
+	}
+}
+
+func TestAnnouncer_ReportsNewerEpochs(t *testing.T) {
+	// b was told epoch 9 by another coordinator
+	nodes := map[string]*fakeNode{"a": {state: State{2, "c1"}}, "b": {state: State{9, "c2"}}}
+	announcer := newTestAnnouncer("c1", nodes)
+
+	newest, err := announcer.Announce(4)
+	if err != nil {
+		t.Fatalf("Announce returned error: %v", err)
+	}
+	if want := (State{9, "c2"}); newest != want {
+		t.Fatalf("Announce = %+v, want %+v", newest, want)
+	}
+	if nodes["a"].state.Epoch != 4 || nodes["b"].state.Epoch != 9 {
+		t.Fatalf("epochs are a=%d b=%d, want a=4 b=9", nodes["a"].state.Epoch, nodes["b"].state.Epoch)
+	}
+}
+
+func TestAnnouncer_DetectsSplitBrain(t *testing.T) {
+	nodes := map[string]*fakeNode{"a": {}, "b": {}}
+	if _, err := newTestAnnouncer("c1", nodes).Announce(5); err != nil {
+		t.Fatalf("Announce returned error: %v", err)
+	}
+
+	// A second coordinator has reached the same epoch with its own ring
+	_, err := newTestAnnouncer("c2", nodes).Announce(5)
+	if !errors.Is(err, ErrSplitBrain) {
+		t.Fatalf("Announce returned %v, want ErrSplitBrain", err)
+	}
+	if nodes["a"].state.Coordinator != "c1" {
+		t.Fatalf("a follows %s, want c1", nodes["a"].state.Coordinator)
+	}
+}
+
+func TestAnnouncer_KeepsLastReportedCapacity(t *testing.T) {
+	nodes := map[string]*fakeNode{
+		"a": {capacity: Capacity{CPUs: 4, Keys: 10}},
+		"b": {capacity: Capacity{CPUs: 8, Keys: 20}},
+		// c does not report capacity
+		"c": {},
+	}
+	announcer := newTestAnnouncer("c1", nodes)
+	if _, err := announcer.Announce(1); err != nil {
+		t.Fatalf("Announce returned error: %v", err)
+	}
+
+	nodes["a"].capacity.Keys = 11
+	nodes["b"].down = true
+	_, _ = announcer.Announce(1)
+
+	reports := announcer.Reports()
+	if len(reports) != 2 {
+		t.Fatalf("Reports = %+v, want reports from a and b only", reports)
+	}
+	if reports["a"].Keys != 11 || reports["b"].Keys != 20 {
+		t.Fatalf("Reports = %+v, want a's latest and b's last report", reports)
+	}
+}
@@ -0,0 +1,75 @@
+package topology
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// NodeAnnouncer is a Node backed by a blueis node's /topology route.
+type NodeAnnouncer struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewNodeAnnouncer(baseURL string, client *http.Client) *NodeAnnouncer {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &NodeAnnouncer{baseURL, client}
+}
+
+type nodeTopologyRequest struct {
+	Epoch       uint64 `json:"epoch"`
+	Coordinator string `json:"coordinator"`
+}
+
+type nodeCapacityResponse struct {
+	CPUs        int    `json:"cpus"`
+	MemoryLimit uint64 `json:"memoryLimit"`
+	MemoryUsed  uint64 `json:"memoryUsed"`
+	Keys        *int   `json:"keys"`
+	KeysAt      int64  `json:"keysAt"`
+}
+
+type nodeTopologyResponse struct {
+	Success     bool                  `json:"success"`
+	Epoch       uint64                `json:"epoch"`
+	Coordinator string                `json:"coordinator"`
+	Capacity    *nodeCapacityResponse `json:"capacity"`
+	Error       string                `json:"error,omitempty"`
+}
+
+func (announcer *NodeAnnouncer) Announce(epoch uint64, coordinator string) (State, Capacity, error) {
+	data, err := json.Marshal(nodeTopologyRequest{epoch, coordinator})
+	if err != nil {
+		return State{}, Capacity{}, err
+	}
+	resp, err := announcer.client.Post(announcer.baseURL+"/topology", "application/json", bytes.NewReader(data))
+	if err != nil {
+		return State{}, Capacity{}, err
+	}
+	defer resp.Body.Close()
+
+	var res nodeTopologyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return State{}, Capacity{}, fmt.Errorf("decoding response from %s: %w", announcer.baseURL, err)
+	}
+	state := State{res.Epoch, res.Coordinator}
+	var capacity Capacity
+	if c := res.Capacity; c != nil {
+		capacity = Capacity{c.CPUs, c.MemoryLimit, c.MemoryUsed, -1, time.Time{}}
+		if c.Keys != nil {
+			capacity.Keys, capacity.KeysAt = *c.Keys, time.UnixMilli(c.KeysAt)
+		}
+	}
+	if resp.StatusCode == http.StatusConflict {
+		return state, capacity, fmt.Errorf("%w: %s: %s", ErrSplitBrain, announcer.baseURL, res.Error)
+	}
+	if !res.Success {
+		return state, capacity, fmt.Errorf("%s: %s", announcer.baseURL, res.Error)
+	}
+	return state, capacity, nil
+}
@@ -0,0 +1,249 @@
+package txn
+
+import (
+	"blueis/internal/twophase"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+const (
+	decisionCommit = "commit"
+	decisionAbort  = "abort"
+)
+
+var (
+	ErrAborted = errors.New("transaction aborted")
+	// ErrMisrouted is returned by participants asked to prepare keys they
+	// do not own at the epoch the keys were routed at
+	ErrMisrouted = errors.New("node does not own the keys it was sent")
+)
+
+// maxRouteAttempts is how many times a transaction is routed before giving
+// up on a topology that keeps changing under it.
+const maxRouteAttempts = 3
+
+// Participant is a node taking part in a transaction. Prepare is told the
+// epoch its keys were routed at; decisions go to whichever nodes prepared,
+// whatever the topology has since become.
+type Participant interface {
+	Prepare(id string, epoch uint64, operations []twophase.Operation) error
+	Commit(id string) error
+	Abort(id string) error
+}
+
+// record is what the coordinator logs for a transaction that is not yet
+// finished. A record without a decision belongs to a transaction that was
+// still preparing, which recovery aborts.
+type record struct {
+	Decision     string   `json:"decision,omitempty"`
+	Participants []string `json:"participants"`
+}
+
+// Coordinator runs transactions that span nodes with two-phase commit. It
+// logs each transaction's participants before preparing and its decision
+// before announcing it, so Recover can finish every transaction a crash
+// interrupted. Each key lives on the single node route returns for it, at
+// the epoch route returns with it.
+type Coordinator struct {
+	log   *twophase.Log
+	route func(key string) (string, uint64)
+	dial  func(address string) Participant
+
+	mu sync.Mutex
+	// running holds transactions that Execute is still driving, which
+	// Recover must leave alone
+	running map[string]struct{}
+}
+
+func NewCoordinator(txnLog *twophase.Log, route func(key string) (string, uint64), dial func(address string) Participant) *Coordinator {
+	return &Coordinator{log: txnLog, route: route, dial: dial, running: make(map[string]struct{})}
+}
+
+// Execute applies operations atomically across the nodes that own their
+// keys and returns the transaction id. It returns an error wrapping
+// ErrAborted if a node voted no, in which case nothing was applied. Once
+// every node has voted yes the transaction is committed even if some nodes
+// cannot be told yet; Recover keeps retrying them. A transaction a node
+// turns away because the topology changed after it was routed is aborted
+// and routed again.
+func (coordinator *Coordinator) Execute(operations []twophase.Operation) (string, error) {
+	if len(operations) == 0 {
+		return "", fmt.Errorf("transaction has no operations")
+	}
+	for _, operation := range operations {
+		if err := operation.Validate(); err != nil {
+			return "", err
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		id, err := coordinator.execute(operations)
+		if !errors.Is(err, ErrMisrouted) || attempt == maxRouteAttempts {
+			return id, err
+		}
+	}
+}
+
+func (coordinator *Coordinator) execute(operations []twophase.Operation) (string, error) {
+	id, err := newID()
+	if err != nil {
+		return "", err
+	}
+	coordinator.mu.Lock()
+	coordinator.running[id] = struct{}{}
+	coordinator.mu.Unlock()
+	defer func() {
+		coordinator.mu.Lock()
+		delete(coordinator.running, id)
+		coordinator.mu.Unlock()
+	}()
+
+	addresses, byAddress, epoch := coordinator.split(operations)
+	if err := coordinator.write(id, record{Participants: addresses}); err != nil {
+		return "", err
+	}
+
+	if err := coordinator.prepare(id, epoch, addresses, byAddress); err != nil {
+		if abortErr := coordinator.finish(id, record{decisionAbort, addresses}); abortErr != nil {
+			log.Printf("Transaction %s aborted but not yet on every node: %v", id, abortErr)
+		}
+		return id, fmt.Errorf("%w: %w", ErrAborted, err)
+	}
+
+	// The transaction is committed once this decision is logged
+	if err := coordinator.write(id, record{decisionCommit, addresses}); err != nil {
+		_ = coordinator.finish(id, record{decisionAbort, addresses})
+		return id, fmt.Errorf("%w: %w", ErrAborted, err)
+	}
+	if err := coordinator.finish(id, record{decisionCommit, addresses}); err != nil {
+		log.Printf("Transaction %s committed but not yet on every node: %v", id, err)
+	}
+	return id, nil
+}
+
+// Recover finishes every logged transaction that is not running: committed
+// ones are committed on every participant and the rest are aborted. It
+// returns how many it finished; transactions whose participants cannot be
+// reached stay logged for the next call.
+func (coordinator *Coordinator) Recover() (int, error) {
+	records, err := coordinator.log.Records()
+	if err != nil {
+		return 0, err
+	}
+
+	finished := 0
+	var errs []error
+	for id, data := range records {
+		coordinator.mu.Lock()
+		_, running := coordinator.running[id]
+		coordinator.mu.Unlock()
+		if running {
+			continue
+		}
+
+		var rec record
+		if err := json.Unmarshal(data, &rec); err != nil {
+			errs = append(errs, fmt.Errorf("decoding transaction %s: %w", id, err))
+			continue
+		}
+		if rec.Decision != decisionCommit {
+			rec.Decision = decisionAbort
+		}
+		if err := coordinator.finish(id, rec); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		finished++
+	}
+	return finished, errors.Join(errs...)
+}
+
+// split groups operations by the node that owns their key, keeping their
+// order within each node. It also returns the oldest epoch the keys were
+// routed at, so a change to the topology part way through is caught by the
+// nodes.
+func (coordinator *Coordinator) split(operations []twophase.Operation) ([]string, map[string][]twophase.Operation, uint64) {
+	var addresses []string
+	byAddress := make(map[string][]twophase.Operation)
+	var oldest uint64
+	for i, operation := range operations {
+		address, epoch := coordinator.route(operation.Key)
+		if i == 0 || epoch < oldest {
+			oldest = epoch
+		}
+		if _, ok := byAddress[address]; !ok {
+			addresses = append(addresses, address)
+		}
+		byAddress[address] = append(byAddress[address], operation)
+	}
+	return addresses, byAddress, oldest
+}
+
+func (coordinator *Coordinator) prepare(id string, epoch uint64, addresses []string, byAddress map[string][]twophase.Operation) error {
+	errs := make([]error, len(addresses))
+	var wg sync.WaitGroup
+	for i, address := range addresses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := coordinator.dial(address).Prepare(id, epoch, byAddress[address]); err != nil {
+				errs[i] = fmt.Errorf("preparing on %s: %w", address, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// finish sends rec's decision to every participant and removes the
+// transaction from the log once they have all acknowledged it.
+func (coordinator *Coordinator) finish(id string, rec record) error {
+	if err := coordinator.write(id, rec); err != nil {
+		return err
+	}
+
+	errs := make([]error, len(rec.Participants))
+	var wg sync.WaitGroup
+	for i, address := range rec.Participants {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			participant := coordinator.dial(address)
+			var err error
+			if rec.Decision == decisionCommit {
+				err = participant.Commit(id)
+			} else {
+				err = participant.Abort(id)
+			}
+			if err != nil {
+				errs[i] = fmt.Errorf("sending %s of transaction %s to %s: %w", rec.Decision, id, address, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	return coordinator.log.Remove(id)
+}
+
+func (coordinator *Coordinator) write(id string, rec record) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return coordinator.log.Write(id, data)
+}
+
+func newID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("generating transaction id: %w", err)
+	}
+	return hex.EncodeToString(b[:]), nil
+}
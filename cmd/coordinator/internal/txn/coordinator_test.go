@@ -0,0 +1,217 @@
+package txn
+
+import (
+	"blueis/internal/twophase"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeParticipant records the transactions sent to it.
+type fakeParticipant struct {
+	mu        sync.Mutex
+	prepared  map[string][]twophase.Operation
+	committed map[string][]twophase.Operation
+	aborted   map[string]bool
+	voteNo    bool
+	// lost makes decisions fail, as if the node went down after voting
+	lost bool
+	// epoch is the newest epoch the node has been told of
+	epoch uint64
+}
+
+func newFakeParticipant() *fakeParticipant {
+	return &fakeParticipant{
+		prepared:  make(map[string][]twophase.Operation),
+		committed: make(map[string][]twophase.Operation),
+		aborted:   make(map[string]bool),
+	}
+}
+
+func (p *fakeParticipant) Prepare(id string, epoch uint64, operations []twophase.Operation) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if epoch < p.epoch {
+		return ErrMisrouted
+	}
+	if p.voteNo {
+		return errors.New("key held by another transaction")
+	}
+	p.prepared[id] = operations
+	return nil
+}
+
+func (p *fakeParticipant) Commit(id string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.lost {
+		return errors.New("unreachable")
+	}
+	if operations, ok := p.prepared[id]; ok {
+		p.committed[id] = operations
+		delete(p.prepared, id)
+	}
+	return nil
+}
+
+func (p *fakeParticipant) Abort(id string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.lost {
+		return errors.New("unreachable")
+	}
+	delete(p.prepared, id)
+	p.aborted[id] = true
+	return nil
+}
+
+// newTestCoordinator routes keys starting with "a" to node a and the rest
+// to node b.
+func newTestCoordinator(t *testing.T, dir string) (*Coordinator, map[string]*fakeParticipant) {
+	t.Helper()
+
+	txnLog, err := twophase.OpenLog(dir)
+	if err != nil {
+		t.Fatalf("OpenLog returned error: %v", err)
+	}
+	nodes := map[string]*fakeParticipant{"a": newFakeParticipant(), "b": newFakeParticipant()}
+	route := func(key string) (string, uint64) {
+		if strings.HasPrefix(key, "a") {
+			return "a", 1
+		}
+		return "b", 1
+	}
+	dial := func(address string) Participant { return nodes[address] }
+	return NewCoordinator(txnLog, route, dial), nodes
+}
+
+var testOperations = []twophase.Operation{
+	{Op: twophase.OpSet, Key: "a1", Value: "1"},
+	{Op: twophase.OpSet, Key: "b1", Value: "2"},
+	{Op: twophase.OpDelete, Key: "a2"},
+}
+
+func logSize(t *testing.T, coordinator *Coordinator) int {
+	t.Helper()
+	records, err := coordinator.log.Records()
+	if err != nil {
+		t.Fatalf("Records returned error: %v", err)
+	}
+	return len(records)
+}
+
+func TestCoordinator_CommitsOnEveryNode(t *testing.T) {
+	coordinator, nodes := newTestCoordinator(t, t.TempDir())
+
+	id, err := coordinator.Execute(testOperations)
+	if err != nil {
+		t.Fatalf("Execute returned error: %v", err)
+	}
+	if got := nodes["a"].committed[id]; len(got) != 2 || got[0].Key != "a1" || got[1].Key != "a2" {
+		t.Fatalf("node a committed %+v, want a1 then a2", got)
+	}
+	if got := nodes["b"].committed[id]; len(got) != 1 || got[0].Key != "b1" {
+		t.Fatalf("node b committed %+v, want b1", got)
+	}
+	if size := logSize(t, coordinator); size != 0 {
+		t.Fatalf("log holds %d records after commit, want 0", size)
+	}
+}
+
+func TestCoordinator_AbortsWhenANodeVotesNo(t *testing.T) {
+	coordinator, nodes := newTestCoordinator(t, t.TempDir())
+	nodes["b"].voteNo = true
+
+	id, err := coordinator.Execute(testOperations)
+	if !errors.Is(err, ErrAborted) {
+		t.Fatalf("Execute returned %v, want ErrAborted", err)
+	}
+	if len(nodes["a"].committed) != 0 || !nodes["a"].aborted[id] {
+		t.Fatalf("node a did not abort the transaction")
+	}
+	if len(nodes["a"].prepared) != 0 {
+		t.Fatalf("node a still holds the prepared transaction")
+	}
+}
+
+func TestCoordinator_RoutesAgainAfterTopologyChange(t *testing.T) {
+	coordinator, nodes := newTestCoordinator(t, t.TempDir())
+	// The topology changes to epoch 2, and node b is told, just after the
+	// first attempt has been routed
+	nodes["b"].epoch = 2
+	routed := 0
+	route := coordinator.route
+	coordinator.route = func(key string) (string, uint64) {
+		address, _ := route(key)
+		routed++
+		if routed <= len(testOperations) {
+			return address, 1
+		}
+		return address, 2
+	}
+
+	id, err := coordinator.Execute(testOperations)
+	if err != nil {
+		t.Fatalf("Execute returned error: %v", err)
+	}
+	if len(nodes["a"].aborted) != 1 {
+		t.Fatalf("node a aborted %d transactions, want the misrouted attempt", len(nodes["a"].aborted))
+	}
+	if _, ok := nodes["b"].committed[id]; !ok || len(nodes["a"].committed[id]) != 2 {
+		t.Fatalf("the transaction routed again was not committed on both nodes")
+	}
+	if size := logSize(t, coordinator); size != 0 {
+		t.Fatalf("log holds %d records, want 0", size)
+	}
+}
+
+func TestCoordinator_RecoverRetriesCommitOnLostNode(t *testing.T) {
+	coordinator, nodes := newTestCoordinator(t, t.TempDir())
+	nodes["b"].lost = true
+
+	id, err := coordinator.Execute(testOperations)
+	if err != nil {
+		t.Fatalf("Execute returned error: %v", err)
+	}
+	if _, ok := nodes["b"].committed[id]; ok {
+		t.Fatalf("lost node b committed the transaction")
+	}
+	if _, err := coordinator.Recover(); err == nil {
+		t.Fatalf("Recover with node b still lost succeeded, want error")
+	}
+
+	nodes["b"].lost = false
+	if finished, err := coordinator.Recover(); err != nil || finished != 1 {
+		t.Fatalf("Recover = (%d, %v), want (1, nil)", finished, err)
+	}
+	if _, ok := nodes["b"].committed[id]; !ok {
+		t.Fatalf("Recover did not commit the transaction on node b")
+	}
+	if size := logSize(t, coordinator); size != 0 {
+		t.Fatalf("log holds %d records after recovery, want 0", size)
+	}
+}
+
+func TestCoordinator_RecoverAbortsUndecidedTransactions(t *testing.T) {
+	dir := t.TempDir()
+	crashed, nodes := newTestCoordinator(t, dir)
+
+	// A coordinator that crashed while preparing leaves a record with no
+	// decision and a prepared transaction on node a
+	if err := crashed.write("tx1", record{Participants: []string{"a", "b"}}); err != nil {
+		t.Fatalf("write returned error: %v", err)
+	}
+	if err := nodes["a"].Prepare("tx1", 1, testOperations[:1]); err != nil {
+		t.Fatalf("Prepare returned error: %v", err)
+	}
+
+	restarted, _ := newTestCoordinator(t, dir)
+	restarted.dial = crashed.dial
+	if finished, err := restarted.Recover(); err != nil || finished != 1 {
+		t.Fatalf("Recover = (%d, %v), want (1, nil)", finished, err)
+	}
+	if !nodes["a"].aborted["tx1"] || !nodes["b"].aborted["tx1"] || len(nodes["a"].prepared) != 0 {
+		t.Fatalf("Recover did not abort the undecided transaction on every node")
+	}
+}
@@ -0,0 +1,84 @@
+package txn
+
+import (
+	"blueis/internal/twophase"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// epochHeader tells a node the epoch its keys were routed at.
+const epochHeader = "X-Blueis-Epoch"
+
+// NodeParticipant is a Participant backed by a blueis node's /txn routes.
+type NodeParticipant struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewNodeParticipant(baseURL string, client *http.Client) *NodeParticipant {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &NodeParticipant{baseURL, client}
+}
+
+type nodeTransactionRequest struct {
+	ID         string               `json:"id"`
+	Operations []twophase.Operation `json:"ops,omitempty"`
+}
+
+type nodeTransactionResponse struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (participant *NodeParticipant) Prepare(id string, epoch uint64, operations []twophase.Operation) error {
+	return participant.post("/txn/prepare", epoch, nodeTransactionRequest{id, operations})
+}
+
+func (participant *NodeParticipant) Commit(id string) error {
+	return participant.post("/txn/commit", 0, nodeTransactionRequest{ID: id})
+}
+
+func (participant *NodeParticipant) Abort(id string) error {
+	return participant.post("/txn/abort", 0, nodeTransactionRequest{ID: id})
+}
+
+// post sends body to path, with epoch in its header unless it is 0.
+func (participant *NodeParticipant) post(path string, epoch uint64, body nodeTransactionRequest) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, participant.baseURL+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if epoch > 0 {
+		req.Header.Set(epochHeader, strconv.FormatUint(epoch, 10))
+	}
+	resp, err := participant.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var res nodeTransactionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return fmt.Errorf("decoding response from %s: %w", participant.baseURL, err)
+	}
+	// The node has been told of a newer topology, or no longer holds the
+	// keys
+	if resp.StatusCode == http.StatusMisdirectedRequest {
+		return fmt.Errorf("%w: %s: %s", ErrMisrouted, participant.baseURL, res.Error)
+	}
+	if !res.Success {
+		return fmt.Errorf("%s: %s", participant.baseURL, res.Error)
+	}
+	return nil
+}
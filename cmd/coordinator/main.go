@@ -1,9 +1,505 @@
-package main
-
-import (
-	"fmt"
-)
-
-func main() {
-	fmt.Println("hello world")
-}
+package main
+
+import (
+	"blueis/cmd/coordinator/internal/backup"
+	"blueis/cmd/coordinator/internal/failover"
+	"blueis/cmd/coordinator/internal/flush"
+	"blueis/cmd/coordinator/internal/hotkeys"
+	"blueis/cmd/coordinator/internal/node"
+	"blueis/cmd/coordinator/internal/placement"
+	"blueis/cmd/coordinator/internal/planner"
+	"blueis/cmd/coordinator/internal/reshard"
+	"blueis/cmd/coordinator/internal/topology"
+	"blueis/cmd/coordinator/internal/txn"
+	"blueis/internal/acl"
+	"blueis/internal/faults"
+	"blueis/internal/logging"
+	"blueis/internal/twophase"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type transactionRequest struct {
+	Operations []twophase.Operation `json:"ops"`
+}
+
+type routeResponse struct {
+	Success bool   `json:"success"`
+	Node    string `json:"node,omitempty"`
+	Epoch   uint64 `json:"epoch,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type transactionResponse struct {
+	Success bool   `json:"success"`
+	ID      string `json:"id,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+func main() {
+	addr := flag.String("addr", ":9090", "address the coordinator listens on")
+	id := flag.String("id", "", "name the coordinator gives nodes when announcing the topology, unique among coordinators (default a new name each start)")
+	nodeURLs := flag.String("nodes", "", "comma-separated base URLs of the nodes, e.g. http://localhost:8080")
+	vnodes := flag.Int("vnodes", 100, "virtual nodes per node on the hash ring")
+	dataDir := flag.String("data-dir", "coordinator-data", "directory for the coordinator's transaction log")
+	flushWindow := flag.Duration("flush-window", flush.DefaultWindow, "how long a requested cluster flush can be confirmed for")
+	backupDir := flag.String("backup-dir", "", "directory cluster backups are kept in (default <data-dir>/backups)")
+	recoverInterval := flag.Duration("recover-interval", 5*time.Second, "how often unfinished transactions are retried")
+	healthInterval := flag.Duration("health-interval", time.Second, "how often primaries with replicas are health-checked")
+	maxReplicaLag := flag.Duration("max-replica-lag", 5*time.Second, "how far behind a replica may be and still be chosen for replica reads")
+	moveTimeout := flag.Duration("move-timeout", time.Minute, "how long each stage of moving a range between nodes may take before the move is abandoned")
+	announceInterval := flag.Duration("announce-interval", time.Second, "how often every node is told the current topology epoch, catching up nodes that missed a change")
+	batchSize := flag.Int("batch-size", 100, "most keys of an /mget or /mset sent to one node in a single request")
+	batchParallel := flag.Int("batch-parallel", 8, "most requests one /mget or /mset has in flight at once")
+	hotKeyCache := flag.Int("hot-key-cache", 0, "most hot keys /mget answers from the coordinator instead of their node (0 disables the cache)")
+	hotKeyThreshold := flag.Int("hot-key-threshold", 1000, "reads of a key within -hot-key-window that make it hot enough to cache")
+	hotKeyWindow := flag.Duration("hot-key-window", time.Second, "window in which reads are counted towards -hot-key-threshold")
+	autoWeights := flag.Duration("auto-weights", 0, "how often keys are moved towards the share each node's reported capacity earns it (0 disables)")
+	weightStep := flag.Float64("weight-step", 0.01, "largest fraction of the hash space moved at once by -auto-weights")
+	weightTolerance := flag.Float64("weight-tolerance", 0.1, "how far past its share, as a fraction of it, a node may go before -auto-weights moves keys off it")
+	weightMinKeys := flag.Int("weight-min-keys", 10000, "keys the cluster must hold before -auto-weights balances key counts rather than shares of the hash space")
+	failoverAfter := flag.Int("failover-after", 3, "consecutive failed health checks before a primary's replica is promoted")
+	quarantineFlaps := flag.Int("quarantine-flaps", 3, "times a node may come back within -quarantine-window before it is no longer promoted or read from (0 disables quarantine)")
+	quarantineWindow := flag.Duration("quarantine-window", 10*time.Minute, "window in which a node's returns are counted towards -quarantine-flaps")
+	quarantineFor := flag.Duration("quarantine-for", 10*time.Minute, "how long a quarantined node must stay up before it is readmitted (0 waits for POST /admin/readmit)")
+	replicas := make(map[string][]string)
+	flag.Func("replicas", "a primary's replicas as primary=replica,replica; repeat for each primary", func(value string) error {
+		primary, urls, ok := strings.Cut(value, "=")
+		if !ok || urls == "" {
+			return errors.New("want primary=replica,replica")
+		}
+		primary = strings.TrimRight(strings.TrimSpace(primary), "/")
+		for _, url := range strings.Split(urls, ",") {
+			replicas[primary] = append(replicas[primary], strings.TrimRight(strings.TrimSpace(url), "/"))
+		}
+		return nil
+	})
+	authKeyFile := flag.String("auth-key-file", "", "file holding the API key, or hmac <id> <secret> to sign requests with, the coordinator sends to nodes that use -acl-file; its user needs the admin and dangerous categories on every key")
+	logRoutes := flag.String("log", "", "comma-separated component=level[@sink] log routes, e.g. coordinator=info@file:/var/log/blueis/coordinator.log; levels are debug, info, warn, error and off, sinks stderr (the default), stdout, file:<path> and syslog[:<tag>]")
+	logMaxSize := flag.Int64("log-max-size", 100<<20, "bytes a log file may grow to before it is rotated (0 disables rotation)")
+	logBackups := flag.Int("log-backups", 5, "rotated files kept for each log file")
+	faultInjection := flag.Bool("fault-injection", false, "serve /admin/faults, to drop, delay and blackhole requests, slow transaction log syncs and crash, for chaos tests")
+	flag.Parse()
+
+	logs, err := logging.NewRouter(*logRoutes, logging.Rotation{MaxBytes: *logMaxSize, Backups: *logBackups})
+	if err != nil {
+		log.Fatalf("Invalid -log: %v", err)
+	}
+	defer logs.Close()
+	logs.Logger("coordinator").SetStandard()
+
+	if *nodeURLs == "" {
+		log.Fatalf("-nodes is required")
+	}
+	if *id == "" {
+		*id = newCoordinatorID()
+	}
+	// Every request to a node goes through nodeClient, or a client sharing
+	// its transport, so it carries the coordinator's API key
+	nodeClient := &http.Client{}
+	if *authKeyFile != "" {
+		credentials, err := acl.ReadCredentials(*authKeyFile)
+		if err != nil {
+			log.Fatalf("Invalid -auth-key-file: %v", err)
+		}
+		nodeClient.Transport = acl.NewTransport(credentials, nil)
+	}
+	// Fault injection wraps the transport before any client copies it, so
+	// a blackholed node is unreachable from all of them
+	var injector *faults.Injector
+	if *faultInjection {
+		injector = newFaultInjector()
+		nodeClient.Transport = injector.Transport(nodeClient.Transport)
+	}
+	// ring and participants change when a replica replaces a failed primary
+	var mu sync.RWMutex
+	ring := node.MakeNodeService(*vnodes)
+	participants := make(map[string]txn.Participant)
+	var groups []failover.Group
+	// members is every node, including those that leave the ring, which
+	// clients may still be routed to
+	var members []string
+	for _, url := range strings.Split(*nodeURLs, ",") {
+		url = strings.TrimRight(strings.TrimSpace(url), "/")
+		ring.AddNode(url, 1)
+		participants[url] = txn.NewNodeParticipant(url, nodeClient)
+		members = append(members, url)
+		if len(replicas[url]) > 0 {
+			groups = append(groups, failover.Group{Primary: url, Replicas: replicas[url]})
+			members = append(members, replicas[url]...)
+			delete(replicas, url)
+		}
+	}
+	for primary := range replicas {
+		log.Fatalf("-replicas names %s, which is not in -nodes", primary)
+	}
+
+	route := func(key string) (string, uint64) {
+		mu.RLock()
+		defer mu.RUnlock()
+		return ring.FindNodeForKey(key).URL(), ring.Epoch()
+	}
+
+	// Nodes turn away requests routed at an older epoch than they know, so
+	// they are told of every change and, in case they missed one, told the
+	// current epoch again every -announce-interval
+	announceClient := &http.Client{Transport: nodeClient.Transport, Timeout: *announceInterval}
+	announcer := topology.NewAnnouncer(*id, func(address string) topology.Node {
+		return topology.NewNodeAnnouncer(address, announceClient)
+	}, members)
+	// Start past the epochs nodes already know, so this run never claims
+	// one a previous run used for a different ring
+	if known, err := announcer.Announce(0); err != nil {
+		log.Printf("Learning the topology epoch: %v", err)
+	} else if known.Epoch > 0 {
+		ring.AdvanceEpoch(known.Epoch)
+		log.Printf("Nodes know epoch %d, carrying on from %d", known.Epoch, ring.Epoch())
+	}
+	announce := func() {
+		for {
+			mu.RLock()
+			epoch := ring.Epoch()
+			mu.RUnlock()
+			newest, err := announcer.Announce(epoch)
+			if err != nil {
+				log.Printf("Announcing topology: %v", err)
+			}
+			switch {
+			case errors.Is(err, topology.ErrSplitBrain):
+				// Nodes refuse writes until they are told a newer epoch.
+				// Moving past it means the other coordinator finds itself
+				// overtaken and stops
+			case newest.Epoch <= epoch, newest.Coordinator == *id:
+				// A concurrent announcement may have got further
+				return
+			default:
+				log.Fatalf("Coordinator %s has announced epoch %d, past this coordinator's %d; stopping so clients are not routed by a stale ring", newest.Coordinator, newest.Epoch, epoch)
+			}
+			mu.Lock()
+			ring.AdvanceEpoch(newest.Epoch)
+			mu.Unlock()
+		}
+	}
+	announce()
+	go func() {
+		for range time.Tick(*announceInterval) {
+			announce()
+		}
+	}()
+
+	txnLog, err := twophase.OpenLog(*dataDir)
+	if err != nil {
+		log.Fatalf("Failed to open transaction log: %v", err)
+	}
+	if injector != nil {
+		txnLog.OnSync(injector.Sync)
+	}
+	coordinator := txn.NewCoordinator(
+		txnLog,
+		route,
+		func(address string) txn.Participant {
+			mu.RLock()
+			defer mu.RUnlock()
+			return participants[address]
+		},
+	)
+
+	// Finish transactions interrupted by a previous run before taking new
+	// ones, then keep retrying any whose nodes were unreachable
+	if finished, err := coordinator.Recover(); err != nil {
+		log.Printf("Recovered %d transactions, some are still unfinished: %v", finished, err)
+	} else if finished > 0 {
+		log.Printf("Recovered %d transactions", finished)
+	}
+	go func() {
+		for range time.Tick(*recoverInterval) {
+			if _, err := coordinator.Recover(); err != nil {
+				log.Printf("Retrying unfinished transactions: %v", err)
+			}
+		}
+	}()
+
+	var monitor *failover.Monitor
+	if len(groups) > 0 {
+		// A node that hangs counts as down rather than stalling the checks
+		healthClient := &http.Client{Transport: nodeClient.Transport, Timeout: *healthInterval}
+		monitor = failover.NewMonitor(
+			groups,
+			*failoverAfter,
+			failover.Quarantine{Flaps: *quarantineFlaps, Window: *quarantineWindow, After: *quarantineFor},
+			func(address string) failover.Node { return failover.NewNodeReplica(address, healthClient) },
+			func(old, new string) {
+				mu.Lock()
+				defer mu.Unlock()
+				ring.ReplaceURL(old, new)
+				// Transactions logged against the old primary still finish
+				// there once it is reachable again
+				participants[new] = txn.NewNodeParticipant(new, nodeClient)
+				go announce()
+			},
+		)
+		go func() {
+			for range time.Tick(*healthInterval) {
+				if err := monitor.Check(); err != nil {
+					log.Printf("Health checks: %v", err)
+				}
+			}
+		}()
+	}
+
+	mover := reshard.NewMover(func(address string) reshard.Node {
+		return reshard.NewNodeMigrator(address, nodeClient)
+	}, *moveTimeout)
+
+	// Nodes report their capacity in reply to every announcement
+	placementTuner := &tuner{
+		config:    placement.Config{Step: *weightStep, Tolerance: *weightTolerance, MinKeys: *weightMinKeys},
+		announcer: announcer,
+		maxAge:    3 * *announceInterval,
+		mu:        &mu,
+		ring:      &ring,
+		mover:     mover,
+		announce:  announce,
+	}
+	if *autoWeights > 0 {
+		go placementTuner.run(*autoWeights)
+	}
+
+	if *backupDir == "" {
+		*backupDir = filepath.Join(*dataDir, "backups")
+	}
+	backups, err := backup.NewStore(*backupDir, func(address string) backup.Node {
+		return backup.NewNodeArchive(address, nodeClient)
+	})
+	if err != nil {
+		log.Fatalf("Failed to open backup directory: %v", err)
+	}
+
+	flusher := flush.NewFlusher(func(address string) flush.Node {
+		return flush.NewNodeFlusher(address, nodeClient)
+	}, *flushWindow)
+
+	keys := planner.NewPlanner(route, func(address string) planner.Node {
+		return planner.NewNodeBatcher(address, nodeClient)
+	}, planner.Limits{BatchSize: *batchSize, Parallel: *batchParallel})
+
+	// Cached keys are dropped as soon as their node reports them changed,
+	// and none of a node's keys are cached while it cannot report changes
+	var cache *hotkeys.Cache
+	if *hotKeyCache > 0 {
+		cache = hotkeys.NewCache(hotkeys.Config{
+			Capacity:  *hotKeyCache,
+			Threshold: *hotKeyThreshold,
+			Window:    *hotKeyWindow,
+		}, route)
+		for _, address := range members {
+			go cache.Follow(context.Background(), address, hotkeys.NewNodeFeed(address, nodeClient), time.Second)
+		}
+	}
+
+	mux := http.NewServeMux()
+	handleTxn := func(w http.ResponseWriter, r *http.Request) {
+		handleTransaction(w, r, coordinator)
+	}
+	handleMSet := func(w http.ResponseWriter, r *http.Request) {
+		handleMultiKey(w, r, keys, cache, "mset")
+	}
+	if injector != nil {
+		handleTxn, handleMSet = countWrites(injector, handleTxn), countWrites(injector, handleMSet)
+	}
+	mux.HandleFunc("/txn", handleTxn)
+	mux.HandleFunc("/mset", handleMSet)
+	mux.HandleFunc("/mget", func(w http.ResponseWriter, r *http.Request) {
+		handleMultiKey(w, r, keys, cache, "mget")
+	})
+	mux.HandleFunc("/admin/hotkeys", func(w http.ResponseWriter, r *http.Request) {
+		handleHotKeys(w, r, cache)
+	})
+	mux.HandleFunc("/ranges", func(w http.ResponseWriter, r *http.Request) {
+		handleRanges(w, r, &mu, &ring)
+	})
+	mux.HandleFunc("/cluster/ring", func(w http.ResponseWriter, r *http.Request) {
+		handleRing(w, r, &mu, &ring)
+	})
+	mux.HandleFunc("/admin/move", func(w http.ResponseWriter, r *http.Request) {
+		handleMove(w, r, &mu, &ring, mover, announce)
+	})
+	mux.HandleFunc("/admin/placement", func(w http.ResponseWriter, r *http.Request) {
+		handlePlacement(w, r, placementTuner, *autoWeights > 0)
+	})
+	mux.HandleFunc("/admin/backup", func(w http.ResponseWriter, r *http.Request) {
+		handleBackup(w, r, backups, ringTopology(&mu, &ring))
+	})
+	mux.HandleFunc("/admin/restore", func(w http.ResponseWriter, r *http.Request) {
+		handleRestore(w, r, backups, ringTopology(&mu, &ring))
+	})
+	mux.HandleFunc("/admin/flush", func(w http.ResponseWriter, r *http.Request) {
+		handleFlush(w, r, flusher, func() []string { return ringNodes(&mu, &ring) })
+	})
+	mux.HandleFunc("/admin/health", func(w http.ResponseWriter, r *http.Request) {
+		handleHealth(w, r, monitor)
+	})
+	mux.HandleFunc("/admin/readmit", func(w http.ResponseWriter, r *http.Request) {
+		handleReadmit(w, r, monitor)
+	})
+	mux.HandleFunc("/route", func(w http.ResponseWriter, r *http.Request) {
+		handleRoute(w, r, route, monitor, *maxReplicaLag)
+	})
+
+	var handler http.Handler = mux
+	if injector != nil {
+		mux.HandleFunc("/admin/faults", func(w http.ResponseWriter, r *http.Request) {
+			handleFaults(w, r, injector)
+		})
+		handler = injector.Handler(mux, "/admin/faults")
+	}
+
+	log.Printf("Coordinator listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, handler))
+}
+
+// handleRoute tells a client which node to send a key's requests to:
+// GET /route?key=a for the primary that owns it, or
+// GET /route?key=a&read=replica&maxLagMs=1000 for a node to read it from,
+// which is one of the primary's replicas no further behind than maxLagMs
+// (default -max-replica-lag) when there is one, and the primary otherwise.
+// The reply carries the epoch the decision was made at, which clients send
+// to the node in the X-Blueis-Epoch header; a node that knows a newer epoch
+// replies 421 and the client should route the key again.
+func handleRoute(w http.ResponseWriter, r *http.Request, route func(key string) (string, uint64), monitor *failover.Monitor, maxLag time.Duration) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(routeResponse{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+	query := r.URL.Query()
+	key := query.Get("key")
+	if key == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(routeResponse{
+			Success: false,
+			Error:   "missing 'key' query parameter",
+		})
+		return
+	}
+	if value := query.Get("maxLagMs"); value != "" {
+		ms, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || ms < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(routeResponse{
+				Success: false,
+				Error:   "'maxLagMs' must be a non-negative integer",
+			})
+			return
+		}
+		maxLag = time.Duration(ms) * time.Millisecond
+	}
+
+	node, epoch := route(key)
+	switch query.Get("read") {
+	case "", "primary":
+	case "replica":
+		if monitor != nil {
+			node = monitor.ReadNode(node, maxLag)
+		}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(routeResponse{
+			Success: false,
+			Error:   "'read' must be primary or replica",
+		})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(routeResponse{
+		Success: true,
+		Node:    node,
+		Epoch:   epoch,
+	})
+}
+
+// handleTransaction runs a multi-key transaction:
+// POST /txn {"ops":[{"op":"set","key":"a","value":"1"},{"op":"delete","key":"b"}]}.
+func handleTransaction(w http.ResponseWriter, r *http.Request, coordinator *txn.Coordinator) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(transactionResponse{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+	var req transactionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(transactionResponse{
+			Success: false,
+			Error:   "invalid JSON body",
+		})
+		return
+	}
+
+	if len(req.Operations) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(transactionResponse{
+			Success: false,
+			Error:   "body must set 'ops'",
+		})
+		return
+	}
+	for _, operation := range req.Operations {
+		if err := operation.Validate(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(transactionResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return
+		}
+	}
+
+	id, err := coordinator.Execute(req.Operations)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, txn.ErrAborted) {
+			status = http.StatusConflict
+		}
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(transactionResponse{
+			Success: false,
+			ID:      id,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(transactionResponse{
+		Success: true,
+		ID:      id,
+	})
+}
+
+func newCoordinatorID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Fatalf("Failed to generate coordinator id: %v", err)
+	}
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"blueis/cmd/coordinator/internal/hotkeys"
+	"blueis/cmd/coordinator/internal/planner"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+type multiKeyEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type multiKeyRequest struct {
+	Keys    []string        `json:"keys,omitempty"`
+	Entries []multiKeyEntry `json:"entries,omitempty"`
+}
+
+type multiKeyResult struct {
+	Key   string  `json:"key"`
+	Value *string `json:"value,omitempty"`
+	Error string  `json:"error,omitempty"`
+}
+
+type multiKeyResponse struct {
+	Success bool             `json:"success"`
+	Results []multiKeyResult `json:"results,omitempty"`
+	Error   string           `json:"error,omitempty"`
+}
+
+// handleMultiKey reads or writes keys spread over any number of nodes:
+// POST /mget {"keys":["a","b"]} or
+// POST /mset {"entries":[{"key":"a","value":"1"}]}. Each key gets a result,
+// in the order sent; a key that does not exist has no value. Writes are not
+// atomic, use /txn for that. If some keys failed the reply is 207 and says
+// how many. With -hot-key-cache, reads of hot keys may be answered from the
+// cache.
+func handleMultiKey(w http.ResponseWriter, r *http.Request, keys *planner.Planner, cache *hotkeys.Cache, op string) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(multiKeyResponse{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+	var req multiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(multiKeyResponse{
+			Success: false,
+			Error:   "invalid JSON body",
+		})
+		return
+	}
+
+	var results []planner.Result
+	switch {
+	case op == "mget" && len(req.Keys) > 0 && cache != nil:
+		results = cache.MGet(req.Keys, keys.MGet)
+	case op == "mget" && len(req.Keys) > 0:
+		results = keys.MGet(req.Keys)
+	case op == "mset" && len(req.Entries) > 0:
+		entries := make([]planner.Entry, len(req.Entries))
+		for i, entry := range req.Entries {
+			entries[i] = planner.Entry{Key: entry.Key, Value: entry.Value}
+		}
+		results = keys.MSet(entries)
+		// The nodes report the writes too, but a client reading its own
+		// writes straight away must not be answered from the cache
+		if cache != nil {
+			for _, entry := range entries {
+				cache.Invalidate(entry.Key)
+			}
+		}
+	default:
+		field := map[string]string{"mget": "keys", "mset": "entries"}[op]
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(multiKeyResponse{
+			Success: false,
+			Error:   fmt.Sprintf("body must set '%s'", field),
+		})
+		return
+	}
+
+	res := multiKeyResponse{Success: true, Results: make([]multiKeyResult, len(results))}
+	failed := 0
+	for i, result := range results {
+		res.Results[i] = multiKeyResult{Key: result.Key, Value: result.Value}
+		if result.Err != nil {
+			res.Results[i].Error = result.Err.Error()
+			failed++
+		}
+	}
+	if failed > 0 {
+		res.Success = false
+		res.Error = fmt.Sprintf("%d of %d keys failed", failed, len(results))
+		w.WriteHeader(http.StatusMultiStatus)
+	}
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+type hotKeysResponse struct {
+	Success bool           `json:"success"`
+	Enabled bool           `json:"enabled"`
+	Stats   *hotkeys.Stats `json:"stats,omitempty"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// handleHotKeys reports what the hot key cache has done: GET /admin/hotkeys.
+func handleHotKeys(w http.ResponseWriter, r *http.Request, cache *hotkeys.Cache) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(hotKeysResponse{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	res := hotKeysResponse{Success: true, Enabled: cache != nil}
+	if cache != nil {
+		stats := cache.Stats()
+		res.Stats = &stats
+	}
+	_ = json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"blueis/cmd/coordinator/internal/node"
+	"blueis/cmd/coordinator/internal/placement"
+	"blueis/cmd/coordinator/internal/reshard"
+	"blueis/cmd/coordinator/internal/topology"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type placementNodeResponse struct {
+	Node        string  `json:"node"`
+	CPUs        int     `json:"cpus"`
+	MemoryLimit uint64  `json:"memoryLimit"`
+	MemoryUsed  uint64  `json:"memoryUsed"`
+	Keys        *int    `json:"keys,omitempty"`
+	Weight      float64 `json:"weight"`
+	Target      float64 `json:"target"`
+	Share       float64 `json:"share"`
+	Load        float64 `json:"load"`
+}
+
+type placementResponse struct {
+	Success bool                    `json:"success"`
+	Enabled bool                    `json:"enabled"`
+	Nodes   []placementNodeResponse `json:"nodes,omitempty"`
+	Error   string                  `json:"error,omitempty"`
+}
+
+// tuner moves keys between nodes a little at a time until each holds the
+// share its reported capacity earns it.
+type tuner struct {
+	config    placement.Config
+	announcer *topology.Announcer
+	// maxAge is how old a node's report may be; a node that has not
+	// reported since is treated as not having reported at all
+	maxAge time.Duration
+
+	mu       *sync.RWMutex
+	ring     *node.NodeService
+	mover    *reshard.Mover
+	announce func()
+
+	// moved is when the last move finished
+	moved time.Time
+}
+
+// capacities returns what each node has reported within maxAge.
+func (t *tuner) capacities() map[string]topology.Capacity {
+	capacities := make(map[string]topology.Capacity)
+	for address, report := range t.announcer.Reports() {
+		if time.Since(report.At) <= t.maxAge {
+			capacities[address] = report.Capacity
+		}
+	}
+	return capacities
+}
+
+func (t *tuner) balance() ([]placement.NodeBalance, error) {
+	t.mu.RLock()
+	ranges := t.ring.Ranges()
+	t.mu.RUnlock()
+	return placement.Balance(ranges, t.capacities(), t.config)
+}
+
+// step makes the next move towards balance, if any is needed. Nothing is
+// moved while a node on the ring has not reported its capacity, nor until
+// every node has counted its keys since the last move, as counts from
+// before it would have the tuner move the same keys again.
+func (t *tuner) step() error {
+	capacities := t.capacities()
+	for _, capacity := range capacities {
+		if capacity.Keys >= 0 && capacity.KeysAt.Before(t.moved) {
+			return nil
+		}
+	}
+	t.mu.RLock()
+	ranges := t.ring.Ranges()
+	t.mu.RUnlock()
+	move, ok, err := placement.Plan(ranges, capacities, t.config)
+	if err != nil || !ok {
+		return err
+	}
+
+	// The ring may have changed while the move was planned
+	t.mu.RLock()
+	source, err := t.ring.RangeOwner(move.Start, move.End)
+	t.mu.RUnlock()
+	if err != nil || source != move.From {
+		return err
+	}
+	if err := moveRange(t.mu, t.ring, t.mover, t.announce, move.From, move.To, move.Start, move.End); err != nil {
+		return err
+	}
+	t.moved = time.Now()
+	return nil
+}
+
+// run steps every interval, logging why it cannot when that changes.
+func (t *tuner) run(interval time.Duration) {
+	var last string
+	for range time.Tick(interval) {
+		err := t.step()
+		if err == nil {
+			last = ""
+			continue
+		}
+		if err.Error() != last {
+			log.Printf("Tuning placement: %v", err)
+			last = err.Error()
+		}
+	}
+}
+
+// handlePlacement reports each node's capacity, the share of keys it earns
+// by it and the share it has: GET /admin/placement. Enabled says whether
+// the coordinator moves keys towards those shares.
+func handlePlacement(w http.ResponseWriter, r *http.Request, t *tuner, enabled bool) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(placementResponse{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	nodes, err := t.balance()
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(placementResponse{
+			Success: false,
+			Enabled: enabled,
+			Error:   err.Error(),
+		})
+		return
+	}
+	response := placementResponse{Success: true, Enabled: enabled}
+	for _, n := range nodes {
+		var keys *int
+		if n.Capacity.Keys >= 0 {
+			keys = &n.Capacity.Keys
+		}
+		response.Nodes = append(response.Nodes, placementNodeResponse{
+			Node:        n.Node,
+			CPUs:        n.Capacity.CPUs,
+			MemoryLimit: n.Capacity.MemoryLimit,
+			MemoryUsed:  n.Capacity.MemoryUsed,
+			Keys:        keys,
+			Weight:      n.Weight,
+			Target:      n.Target,
+			Share:       n.Share,
+			Load:        n.Load,
+		})
+	}
+	_ = json.NewEncoder(w).Encode(response)
+}
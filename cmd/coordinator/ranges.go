@@ -0,0 +1,212 @@
+package main
+
+import (
+	"blueis/cmd/coordinator/internal/node"
+	"blueis/cmd/coordinator/internal/reshard"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+type rangeResponse struct {
+	Start uint32 `json:"start"`
+	End   uint32 `json:"end"`
+	Node  string `json:"node"`
+}
+
+// movePreview is what a dry run of a move found it would do: move Keys
+// keys, a Share of the ring's hashes, from one node to another.
+type movePreview struct {
+	Start uint32  `json:"start"`
+	End   uint32  `json:"end"`
+	From  string  `json:"from"`
+	To    string  `json:"to"`
+	Keys  int     `json:"keys"`
+	Share float64 `json:"share"`
+}
+
+type rangesResponse struct {
+	Success bool            `json:"success"`
+	Epoch   uint64          `json:"epoch"`
+	Ranges  []rangeResponse `json:"ranges,omitempty"`
+	Error   string          `json:"error,omitempty"`
+	// DryRun says nothing was moved, and Move what would have been
+	DryRun bool         `json:"dryRun,omitempty"`
+	Move   *movePreview `json:"move,omitempty"`
+}
+
+type moveRequest struct {
+	Start uint32 `json:"start"`
+	End   uint32 `json:"end"`
+	To    string `json:"to"`
+}
+
+// handleRanges lists which node owns each range of key hashes:
+// GET /ranges. The epoch goes up every time ownership changes.
+func handleRanges(w http.ResponseWriter, r *http.Request, mu *sync.RWMutex, ring *node.NodeService) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(rangesResponse{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	mu.RLock()
+	defer mu.RUnlock()
+	_ = json.NewEncoder(w).Encode(rangesResponse{
+		Success: true,
+		Epoch:   ring.Epoch(),
+		Ranges:  rangesOf(ring),
+	})
+}
+
+func rangesOf(ring *node.NodeService) []rangeResponse {
+	var ranges []rangeResponse
+	for _, r := range ring.Ranges() {
+		ranges = append(ranges, rangeResponse{r.Start, r.End, r.URL})
+	}
+	return ranges
+}
+
+// handleMove moves the keys whose hash lies in (start, end] to another
+// node while both keep serving requests:
+// POST /admin/move {"start":100,"end":200,"to":"http://node-b:8080"}.
+// The range must belong to a single node, as listed by /ranges. It replies
+// once the move has finished, with the new epoch and ranges. With
+// ?dryRun=true the move is checked the same way but nothing is moved, and
+// the reply says which node the range would leave and how many keys would
+// go with it.
+func handleMove(w http.ResponseWriter, r *http.Request, mu *sync.RWMutex, ring *node.NodeService, mover *reshard.Mover, announce func()) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(rangesResponse{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+	var req moveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.To == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(rangesResponse{
+			Success: false,
+			Error:   "body must be {\"start\":<hash>,\"end\":<hash>,\"to\":\"<base URL>\"}",
+		})
+		return
+	}
+	target := strings.TrimRight(req.To, "/")
+	dryRun, err := parseDryRun(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(rangesResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+	if req.Start == req.End {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(rangesResponse{
+			Success: false,
+			Error:   "cannot move the whole ring",
+		})
+		return
+	}
+
+	mu.RLock()
+	source, err := ring.RangeOwner(req.Start, req.End)
+	epoch := ring.Epoch()
+	if err == nil && !ring.HasNode(target) {
+		err = errors.New("'to' is not a node on the ring")
+	}
+	if err == nil && source == target {
+		err = errors.New("the range already belongs to " + target)
+	}
+	mu.RUnlock()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(rangesResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	if dryRun {
+		keys, err := mover.Count(source, reshard.Range{Start: req.Start, End: req.End})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_ = json.NewEncoder(w).Encode(rangesResponse{
+				Success: false,
+				DryRun:  true,
+				Error:   err.Error(),
+			})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(rangesResponse{
+			Success: true,
+			Epoch:   epoch,
+			DryRun:  true,
+			Move: &movePreview{
+				Start: req.Start,
+				End:   req.End,
+				From:  source,
+				To:    target,
+				Keys:  keys,
+				Share: arcSize(req.Start, req.End) / hashSpace,
+			},
+		})
+		return
+	}
+
+	if err := moveRange(mu, ring, mover, announce, source, target, req.Start, req.End); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(rangesResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	mu.RLock()
+	defer mu.RUnlock()
+	_ = json.NewEncoder(w).Encode(rangesResponse{
+		Success: true,
+		Epoch:   ring.Epoch(),
+		Ranges:  rangesOf(ring),
+	})
+}
+
+// moveRange moves the keys in (start, end] from source to target, then
+// hands the range to target on the ring and announces the new epoch.
+func moveRange(mu *sync.RWMutex, ring *node.NodeService, mover *reshard.Mover, announce func(), source string, target string, start uint32, end uint32) error {
+	log.Printf("Moving range (%d, %d] from %s to %s", start, end, source, target)
+	err := mover.Move(source, target, reshard.Range{Start: start, End: end}, func() error {
+		mu.Lock()
+		err := ring.MoveRange(start, end, target)
+		mu.Unlock()
+		if err == nil {
+			// Requests routed before the flip are turned away rather than
+			// waiting for the source to release the range
+			announce()
+		}
+		return err
+	})
+	if err != nil {
+		log.Printf("Moving range (%d, %d] to %s: %v", start, end, target, err)
+		return err
+	}
+	mu.RLock()
+	log.Printf("Moved range (%d, %d] to %s, epoch is now %d", start, end, target, ring.Epoch())
+	mu.RUnlock()
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"blueis/cmd/coordinator/internal/node"
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ringPage draws the ring from GET /cluster/ring in a browser.
+//
+//go:embed ring.html
+var ringPage []byte
+
+// hashSpace is how many hashes there are on the ring.
+const hashSpace = 1 << 32
+
+type vnodeResponse struct {
+	Hash uint32 `json:"hash"`
+	Node string `json:"node"`
+}
+
+// arcResponse is a range of hashes owned by one node, with Share the
+// fraction of the ring it covers.
+type arcResponse struct {
+	Start uint32  `json:"start"`
+	End   uint32  `json:"end"`
+	Node  string  `json:"node"`
+	Share float64 `json:"share"`
+}
+
+// ringNodeResponse sums up a node's part of the ring. Share is the fraction
+// of keys the node owns; on a balanced ring every node owns about
+// 1/len(nodes).
+type ringNodeResponse struct {
+	Node   string  `json:"node"`
+	VNodes int     `json:"vnodes"`
+	Arcs   int     `json:"arcs"`
+	Share  float64 `json:"share"`
+}
+
+type ringResponse struct {
+	Success bool               `json:"success"`
+	Epoch   uint64             `json:"epoch"`
+	Nodes   []ringNodeResponse `json:"nodes,omitempty"`
+	VNodes  []vnodeResponse    `json:"vnodes,omitempty"`
+	Arcs    []arcResponse      `json:"arcs,omitempty"`
+	Error   string             `json:"error,omitempty"`
+}
+
+// handleRing shows where every vnode sits on the hash ring and which node
+// owns each arc of it: GET /cluster/ring. Browsers, or any client asking
+// with ?format=html, get a page drawing the ring instead, so an operator
+// can see at a glance when a node owns far more or less than its share.
+func handleRing(w http.ResponseWriter, r *http.Request, mu *sync.RWMutex, ring *node.NodeService) {
+	format := r.URL.Query().Get("format")
+	if format == "" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		format = "html"
+	}
+	if format == "html" && r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write(ringPage)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(ringResponse{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+	if format != "" && format != "json" {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(ringResponse{
+			Success: false,
+			Error:   "'format' must be json or html",
+		})
+		return
+	}
+
+	mu.RLock()
+	epoch := ring.Epoch()
+	positions := ring.Positions()
+	ranges := ring.Ranges()
+	mu.RUnlock()
+
+	response := ringResponse{Success: true, Epoch: epoch}
+	// index holds where each node is in response.Nodes
+	index := make(map[string]int)
+	for _, position := range positions {
+		i, ok := index[position.URL]
+		if !ok {
+			i = len(response.Nodes)
+			index[position.URL] = i
+			response.Nodes = append(response.Nodes, ringNodeResponse{Node: position.URL})
+		}
+		response.Nodes[i].VNodes++
+		response.VNodes = append(response.VNodes, vnodeResponse{position.Hash, position.URL})
+	}
+	for _, r := range ranges {
+		share := arcSize(r.Start, r.End) / hashSpace
+		response.Arcs = append(response.Arcs, arcResponse{r.Start, r.End, r.URL, share})
+		response.Nodes[index[r.URL]].Arcs++
+		response.Nodes[index[r.URL]].Share += share
+	}
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// arcSize is how many hashes lie in (start, end], which is the whole ring
+// when start == end.
+func arcSize(start uint32, end uint32) float64 {
+	if start == end {
+		return hashSpace
+	}
+	// Wraps past the top of the hash space when start > end
+	return float64(end - start)
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"blueis/internal/acl"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// routeCategories gives the command category of each route, which a user
+// must be granted to call it. Routes missing here are admin routes, so one
+// added without thought is not opened up to every user.
+var routeCategories = map[string]func(r *http.Request) acl.Category{
+	"/kv": func(r *http.Request) acl.Category {
+		if r.Method == http.MethodGet {
+			return acl.Read
+		}
+		return acl.Write
+	},
+	"/kv/expireat": always(acl.Write),
+	"/kv/persist":  always(acl.Write),
+	"/kv/ttl":      always(acl.Read),
+	"/kv/pttl":     always(acl.Read),
+	"/kv/object":   always(acl.Read),
+	"/kv/mget":     always(acl.Read),
+	"/kv/mset":     always(acl.Write),
+	// Each command also needs read or write on its key, checked as the
+	// batch is read
+	"/kv/batch": always(acl.Read),
+	// Mutations also need write on the keys they set, checked as they run
+	"/graphql":             always(acl.Read),
+	"/graphql/schema":      always(acl.Read),
+	"/cms/init":            always(acl.Write),
+	"/cms/incrby":          always(acl.Write),
+	"/cms/query":           always(acl.Read),
+	"/cms/merge":           always(acl.Write),
+	"/crdt/counter/get":    always(acl.Read),
+	"/crdt/set/members":    always(acl.Read),
+	"/crdt/counter/incrby": always(acl.Write),
+	"/crdt/set/add":        always(acl.Write),
+	"/crdt/set/remove":     always(acl.Write),
+	"/list/lrange":         always(acl.Read),
+	"/list/llen":           always(acl.Read),
+	"/list/lpush":          always(acl.Write),
+	"/list/rpush":          always(acl.Write),
+	"/list/lpop":           always(acl.Write),
+	"/list/rpop":           always(acl.Write),
+	"/lock":                always(acl.Write),
+	"/unlock":              always(acl.Write),
+	"/lease/grant":         always(acl.Write),
+	"/lease/attach":        always(acl.Write),
+	"/lease/keepalive":     always(acl.Write),
+	"/lease/revoke":        always(acl.Write),
+
+	// These can lose data or stop the node serving its keys
+	"/replication/promote":   always(acl.Dangerous),
+	"/replication/replicaof": always(acl.Dangerous),
+	"/migration/import":      always(acl.Dangerous),
+	"/migration/endimport":   always(acl.Dangerous),
+	"/migration/fence":       always(acl.Dangerous),
+	"/migration/unfence":     always(acl.Dangerous),
+	"/migration/release":     always(acl.Dangerous),
+	"/backup/restore":        always(acl.Dangerous),
+	"/backup/replay":         always(acl.Dangerous),
+	"/admin/flush":           always(acl.Dangerous),
+
+	// Admin is the default, but listing it keeps turning writes off for
+	// every user behind admin if the default ever changes
+	"/admin/readonly": always(acl.Admin),
+}
+
+// openRoutes are answered without authenticating first, so load balancers
+// and orchestrators can check on the node without a key.
+var openRoutes = map[string]bool{
+	"/health": true,
+	"/readyz": true,
+	// Tokens are minted by handleToken, which authenticates the request
+	// itself since a refresh token is not sent as a bearer token
+	"/auth/token": true,
+}
+
+func always(category acl.Category) func(*http.Request) acl.Category {
+	return func(*http.Request) acl.Category { return category }
+}
+
+// aclUserKey holds the user a request was authenticated as in its context,
+// for handlers that read keys from the request body.
+type aclUserKey struct{}
+
+// authenticator finds the ACL user a request was made by.
+type authenticator struct {
+	users *atomic.Pointer[acl.ACL]
+	// bearer accepts API keys sent as bearer tokens, signed, if set,
+	// checks requests signed with HMAC keys and tokens, if set, access
+	// tokens sent as bearer tokens
+	bearer bool
+	signed *acl.Verifier
+	tokens *acl.Tokens
+	// maxBody caps the signed bodies read to check their signature
+	maxBody *atomic.Int64
+}
+
+// parseAuthMethods parses a comma-separated list of the ways requests may
+// authenticate: bearer, hmac and token. Tokens are checked by tokens, which
+// must be set for token.
+func parseAuthMethods(spec string, users *atomic.Pointer[acl.ACL], maxSkew time.Duration, maxBody *atomic.Int64, tokens *acl.Tokens) (*authenticator, error) {
+	auth := &authenticator{users: users, maxBody: maxBody}
+	for _, method := range strings.Split(spec, ",") {
+		switch strings.TrimSpace(method) {
+		case "bearer":
+			auth.bearer = true
+		case "hmac":
+			auth.signed = acl.NewVerifier(maxSkew)
+		case "token":
+			if tokens == nil {
+				return nil, errors.New("token requires -token-secret-file or -token-issuer-key")
+			}
+			auth.tokens = tokens
+		default:
+			return nil, fmt.Errorf("unknown auth method %q, want bearer, hmac or token", method)
+		}
+	}
+	if tokens != nil && auth.tokens == nil {
+		return nil, errors.New("-token-secret-file and -token-issuer-key require the token method")
+	}
+	return auth, nil
+}
+
+// authenticate returns the user r was made by. Access tokens are only
+// accepted if withTokens is set, so a token cannot be used to mint more.
+func (auth *authenticator) authenticate(r *http.Request, withTokens bool) (*acl.User, error) {
+	users := auth.users.Load()
+	key := acl.RequestKey(r)
+	switch {
+	case acl.IsSigned(r) && auth.signed != nil:
+		return auth.signed.Verify(users, r, auth.maxBody.Load())
+	case acl.IsSigned(r):
+		return nil, fmt.Errorf("%w: the node does not accept signed requests", acl.ErrUnauthenticated)
+	case key == "":
+		return nil, acl.ErrUnauthenticated
+	case acl.IsToken(key) && auth.tokens != nil && withTokens:
+		return auth.tokens.Authenticate(users, key)
+	case acl.IsToken(key) && auth.tokens != nil:
+		return nil, fmt.Errorf("%w: an access token cannot be used here", acl.ErrUnauthenticated)
+	case auth.bearer:
+		return users.Authenticate(key)
+	}
+	return nil, fmt.Errorf("%w: the node does not accept API keys", acl.ErrUnauthenticated)
+}
+
+// writeAuthError answers a request that could not be authenticated.
+func writeAuthError(w http.ResponseWriter, auth *authenticator, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		w.Header().Set("Content-Type", "application/json")
+		writeBodyError(w, err, "")
+		return
+	}
+	if auth.bearer || auth.tokens != nil {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="blueis"`)
+	}
+	if auth.signed != nil {
+		w.Header().Add("WWW-Authenticate", acl.SignatureScheme+` realm="blueis"`)
+	}
+	writeACLError(w, err)
+}
+
+// withACL authenticates every request and checks its user may call the
+// route and access the key it names in the query, before the request
+// reaches its handler. Handlers taking keys in their body check those with
+// checkKeys. Each request allowed counts as one operation against its
+// user's limits in meter.
+func withACL(auth *authenticator, meter *acl.Meter, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if openRoutes[r.URL.Path] {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		user, err := auth.authenticate(r, true)
+		if err != nil {
+			writeAuthError(w, auth, err)
+			return
+		}
+
+		category := acl.Admin
+		if categoryOf, ok := routeCategories[r.URL.Path]; ok {
+			category = categoryOf(r)
+		}
+		var keys []string
+		// A key that cannot be decoded is refused by the handler
+		if r.URL.Query().Has("key") {
+			if key, err := requestKey(r); err == nil {
+				keys = append(keys, key)
+			}
+		}
+		if err := user.Allows(category, keys...); err != nil {
+			writeACLError(w, err)
+			return
+		}
+		if retryAfter, err := meter.Admit(user); err != nil {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			writeACLError(w, err)
+			return
+		}
+		ctx := context.WithValue(r.Context(), aclUserKey{}, user)
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// checkKeys returns an error if the user r was authenticated as may not run
+// commands of category on one of keys. Requests to a node without ACLs may
+// run anything.
+func checkKeys(r *http.Request, category acl.Category, keys ...string) error {
+	user, ok := r.Context().Value(aclUserKey{}).(*acl.User)
+	if !ok {
+		return nil
+	}
+	return user.Allows(category, keys...)
+}
+
+func writeACLError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	writeErrorStatus(w, err, http.StatusForbidden)
+	_ = json.NewEncoder(w).Encode(response{
+		Success: false,
+		Error:   err.Error(),
+		Code:    errorCode(err),
+	})
+}
+
+// errNoACL is returned for usage of a node started without -acl-file.
+var errNoACL = errors.New("the node was started without -acl-file")
+
+type usageResponse struct {
+	Success bool                `json:"success"`
+	Users   []userUsageResponse `json:"users,omitempty"`
+	Error   string              `json:"error,omitempty"`
+}
+
+// userUsageResponse is one user's usage. Today counts the operations run on
+// Day, a UTC date; Throttled and OverQuota count those refused by the
+// user's rate limit and quota since the node started.
+type userUsageResponse struct {
+	User      string  `json:"user"`
+	Day       string  `json:"day"`
+	Today     int64   `json:"today"`
+	Total     int64   `json:"total"`
+	Throttled int64   `json:"throttled"`
+	OverQuota int64   `json:"overQuota"`
+	Rate      float64 `json:"rate,omitempty"`
+	Burst     int     `json:"burst,omitempty"`
+	Quota     int64   `json:"quota,omitempty"`
+}
+
+// handleUsage reports the operations each ACL user has run on this node,
+// for billing or limiting the teams behind them: GET /admin/usage[?user=u].
+// Users that have run nothing since the node started are left out.
+func handleUsage(w http.ResponseWriter, r *http.Request, meter *acl.Meter) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(usageResponse{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+	if meter == nil {
+		w.WriteHeader(http.StatusConflict)
+		_ = json.NewEncoder(w).Encode(usageResponse{
+			Success: false,
+			Error:   errNoACL.Error(),
+		})
+		return
+	}
+
+	only := r.URL.Query().Get("user")
+	users := []userUsageResponse{}
+	for _, usage := range meter.Usage() {
+		if only != "" && usage.User != only {
+			continue
+		}
+		users = append(users, userUsageResponse{
+			User:      usage.User,
+			Day:       usage.Day.Format(time.DateOnly),
+			Today:     usage.Today,
+			Total:     usage.Total,
+			Throttled: usage.Throttled,
+			OverQuota: usage.OverQuota,
+			Rate:      usage.Limits.Rate,
+			Burst:     usage.Limits.Burst,
+			Quota:     usage.Limits.Quota,
+		})
+	}
+	_ = json.NewEncoder(w).Encode(usageResponse{
+		Success: true,
+		Users:   users,
+	})
+}
+
+type tokenRequest struct {
+	RefreshToken string `json:"refreshToken,omitempty"`
+}
+
+type tokenResponse struct {
+	Success      bool   `json:"success"`
+	AccessToken  string `json:"accessToken,omitempty"`
+	RefreshToken string `json:"refreshToken,omitempty"`
+	TokenType    string `json:"tokenType,omitempty"`
+	// ExpiresIn is the seconds the access token is valid for
+	ExpiresIn int64  `json:"expiresIn,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Code      string `json:"code,omitempty"`
+}
+
+// handleToken mints an access token, sent as a bearer token until it
+// expires, and a refresh token that exchanges for the next pair:
+//
+//	POST /auth/token                          authenticated with an API key or signature
+//	POST /auth/token {"refreshToken":"..."}
+//
+// Either way the user must still be in the ACL, and the request counts
+// against its limits.
+func handleToken(w http.ResponseWriter, r *http.Request, auth *authenticator, meter *acl.Meter) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(tokenResponse{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+	if auth == nil || auth.tokens == nil || !auth.tokens.Mints() {
+		w.WriteHeader(http.StatusConflict)
+		_ = json.NewEncoder(w).Encode(tokenResponse{
+			Success: false,
+			Error:   "the node was started without -token-secret-file",
+		})
+		return
+	}
+
+	// A signed request's body is read to check it, so it is authenticated
+	// before the body is decoded
+	var user *acl.User
+	var pair acl.TokenPair
+	var err error
+	if acl.IsSigned(r) || acl.RequestKey(r) != "" {
+		if user, err = auth.authenticate(r, false); err == nil {
+			pair, err = auth.tokens.Issue(user)
+		}
+	} else {
+		var req tokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			writeBodyError(w, err, "invalid JSON body")
+			return
+		}
+		err = acl.ErrUnauthenticated
+		if req.RefreshToken != "" {
+			pair, user, err = auth.tokens.Refresh(auth.users.Load(), req.RefreshToken)
+		}
+	}
+	if err != nil {
+		writeAuthError(w, auth, err)
+		return
+	}
+	if retryAfter, err := meter.Admit(user); err != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		writeACLError(w, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(tokenResponse{
+		Success:      true,
+		AccessToken:  pair.AccessToken,
+		RefreshToken: pair.RefreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(pair.ExpiresIn.Seconds()),
+	})
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"blueis/internal/kvstore"
+	"compress/gzip"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// backupKeysTrailer carries the number of keys in a backup. It is sent
+	// after the last one, so a backup without it was cut short
+	backupKeysTrailer = "X-Blueis-Backup-Keys"
+	// backupTimeHeader carries when the backup's snapshot was taken
+	backupTimeHeader = "X-Blueis-Backup-Time"
+	// backupRunHeader and backupOffsetHeader carry the replication run and
+	// offset the backup is as of, from which an incremental backup carries
+	// on
+	backupRunHeader    = "X-Blueis-Backup-Run"
+	backupOffsetHeader = "X-Blueis-Backup-Offset"
+	// restoreBatchSize caps the keys restored in one batch of mutations
+	restoreBatchSize = 1000
+)
+
+// backupRecord is a key in a backup, which is a gzipped sequence of
+// gob-encoded records. Type is the type of value Value holds, and
+// Deadline is the key's expiry in Unix nanoseconds, or 0 if it has none.
+type backupRecord struct {
+	Key      string
+	Value    string
+	Type     kvstore.ValueType
+	Deadline int64
+}
+
+// backupChange is a key changed since the previous backup, in an
+// incremental backup, which is a gzipped sequence of gob-encoded changes.
+// A key that was deleted has Deleted set; otherwise Set says whether Value,
+// of type Type, replaces its value, and Deadline is its new expiry in Unix nanoseconds,
+// -1 if its expiry was removed or 0 if that did not change. List holds the
+// pushes and pops made to a list after that, which are kept as they are so
+// a list is not stored whole for a few values pushed or popped.
+type backupChange struct {
+	Key      string
+	Deleted  bool
+	Set      bool
+	Value    string
+	Type     kvstore.ValueType
+	Deadline int64
+	List     []kvstore.Mutation
+}
+
+type restoreResponse struct {
+	Success bool   `json:"success"`
+	Keys    int    `json:"keys"`
+	Error   string `json:"error,omitempty"`
+	Code    string `json:"code,omitempty"`
+}
+
+// handleBackup streams a snapshot of every key the node holds:
+// GET /backup. The snapshot is taken when the request arrives, so backups
+// requested from every node at once are taken at about the same point.
+// Keys are sent in order, so backing up the same data twice gives the same
+// bytes. The number of keys follows them in a trailer; a stream that ends
+// without it is incomplete.
+//
+// GET /backup?run=<run>&since=<offset> streams an incremental backup
+// instead: the keys changed since the backup whose run and offset headers
+// are given. The changes come from the replication backlog, which starts
+// filling at the first full backup, so an incremental is answered with 409
+// once the backlog has dropped some of them or the node has restarted, and
+// a full backup has to be taken again.
+func handleBackup(w http.ResponseWriter, r *http.Request, kv *kvstore.KeyValueService) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+	if r.URL.Query().Has("since") {
+		handleIncrementalBackup(w, r, kv)
+		return
+	}
+
+	// Changes are retained from before the snapshot, so every change after
+	// it is there for the next incremental backup
+	kv.RetainChanges()
+	snapshot, err := kv.Snapshot()
+	var keys []string
+	if err == nil {
+		defer snapshot.Close()
+		keys, err = snapshot.Keys()
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(errorStatus(err, http.StatusInternalServerError))
+		_ = json.NewEncoder(w).Encode(response{
+			Success: false,
+			Error:   err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+	slices.Sort(keys)
+
+	run, offset := snapshot.Position()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(backupTimeHeader, snapshot.Time().UTC().Format(time.RFC3339Nano))
+	w.Header().Set(backupRunHeader, run)
+	w.Header().Set(backupOffsetHeader, strconv.FormatUint(offset, 10))
+	w.Header().Set("Trailer", backupKeysTrailer)
+	compressed := gzip.NewWriter(w)
+	encoder := gob.NewEncoder(compressed)
+	written := 0
+	for _, key := range keys {
+		value, ok, err := snapshot.Get(key)
+		if err != nil {
+			log.Printf("Backing up key %s: %v", key, err)
+			return
+		}
+		if !ok {
+			continue
+		}
+		record := backupRecord{Key: key, Value: value.Data, Type: value.Type}
+		if deadline, ok := snapshot.Expiry(key); ok {
+			record.Deadline = deadline.UnixNano()
+		}
+		if err := encoder.Encode(record); err != nil {
+			// The client has gone away
+			return
+		}
+		written++
+	}
+	if err := compressed.Close(); err != nil {
+		return
+	}
+	w.Header().Set(backupKeysTrailer, strconv.Itoa(written))
+	log.Printf("Backed up %d keys from a snapshot taken at %s", written, snapshot.Time().Format(time.RFC3339Nano))
+}
+
+func handleIncrementalBackup(w http.ResponseWriter, r *http.Request, kv *kvstore.KeyValueService) {
+	query := r.URL.Query()
+	since, err := strconv.ParseUint(query.Get("since"), 10, 64)
+	if err != nil || query.Get("run") == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(response{
+			Success: false,
+			Error:   "an incremental backup needs run and since, from the previous backup's " + backupRunHeader + " and " + backupOffsetHeader,
+		})
+		return
+	}
+	at := time.Now()
+	mutations, offset, err := kv.ChangesSince(query.Get("run"), since)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(errorStatus(err, http.StatusInternalServerError))
+		_ = json.NewEncoder(w).Encode(response{
+			Success: false,
+			Error:   err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+	changes := coalesceChanges(mutations)
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(backupTimeHeader, at.UTC().Format(time.RFC3339Nano))
+	w.Header().Set(backupRunHeader, query.Get("run"))
+	w.Header().Set(backupOffsetHeader, strconv.FormatUint(offset, 10))
+	w.Header().Set("Trailer", backupKeysTrailer)
+	compressed := gzip.NewWriter(w)
+	encoder := gob.NewEncoder(compressed)
+	for _, change := range changes {
+		if err := encoder.Encode(change); err != nil {
+			return
+		}
+	}
+	if err := compressed.Close(); err != nil {
+		return
+	}
+	w.Header().Set(backupKeysTrailer, strconv.Itoa(len(changes)))
+	log.Printf("Backed up %d keys changed by %d mutations since offset %d", len(changes), len(mutations), since)
+}
+
+// coalesceChanges reduces mutations to the net change to each key, in key
+// order, so a key written many times between backups is stored once.
+func coalesceChanges(mutations []kvstore.Mutation) []backupChange {
+	byKey := make(map[string]*backupChange)
+	for _, mutation := range mutations {
+		change, ok := byKey[mutation.Key]
+		if !ok {
+			change = &backupChange{Key: mutation.Key}
+			byKey[mutation.Key] = change
+		}
+		switch mutation.Type {
+		case kvstore.MutationSet:
+			change.Deleted, change.Set, change.List = false, true, nil
+			change.Value, change.Type = mutation.Value, mutation.ValueType
+		case kvstore.MutationDelete:
+			*change = backupChange{Key: mutation.Key, Deleted: true}
+		case kvstore.MutationExpire:
+			change.Deadline = mutation.Deadline
+		case kvstore.MutationPersist:
+			change.Deadline = -1
+		case kvstore.MutationListPush, kvstore.MutationListPop:
+			change.List = appendListChange(change.List, mutation)
+		}
+	}
+	changes := make([]backupChange, 0, len(byKey))
+	for _, change := range byKey {
+		changes = append(changes, *change)
+	}
+	slices.SortFunc(changes, func(a, b backupChange) int { return strings.Compare(a.Key, b.Key) })
+	return changes
+}
+
+// appendListChange adds a push or pop to those made to a list, folding it
+// into the last one if that was the same at the same end of the list.
+func appendListChange(changes []kvstore.Mutation, mutation kvstore.Mutation) []kvstore.Mutation {
+	mutation.Offset, mutation.Previous = 0, nil
+	if n := len(changes); n > 0 && changes[n-1].Type == mutation.Type && changes[n-1].Left == mutation.Left {
+		last := &changes[n-1]
+		last.Values = append(slices.Clip(last.Values), mutation.Values...)
+		last.Length = mutation.Length
+		return changes
+	}
+	return append(changes, mutation)
+}
+
+// handleRestore replaces every key the node holds with those in a backup
+// sent as the body: POST /backup/restore. Keys that have expired since the
+// backup was taken are left out. POST /backup/restore?incremental=true
+// applies an incremental backup on top of the keys the node holds, which
+// must be those of the backup it was taken after. The keys are replaced as replicated
+// changes, so the node's replicas are restored with it, which also means
+// restoring a replica is refused. Requests should be held off while the
+// node is restored; a restore that fails part way leaves the node holding
+// part of the backup, and can be run again.
+func handleRestore(w http.ResponseWriter, r *http.Request, kv *kvstore.KeyValueService, role *replicationRole) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(restoreResponse{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+	if info := role.info(); info.Role == "replica" {
+		w.WriteHeader(http.StatusConflict)
+		_ = json.NewEncoder(w).Encode(restoreResponse{
+			Success: false,
+			Error:   "node is a replica of " + info.Primary + ", restore the primary instead",
+		})
+		return
+	}
+
+	restore := restoreBackup
+	if r.URL.Query().Get("incremental") == "true" {
+		restore = applyIncrementalBackup
+	}
+	restored, err := restore(kv, r.Body)
+	if err != nil {
+		log.Printf("Restoring a backup: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(restoreResponse{
+			Success: false,
+			Keys:    restored,
+			Error:   err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+	log.Printf("Restored %d keys from a backup", restored)
+	_ = json.NewEncoder(w).Encode(restoreResponse{
+		Success: true,
+		Keys:    restored,
+	})
+}
+
+// restoreBackup deletes every key kv holds, then writes those in backup.
+// It returns how many keys were written.
+func restoreBackup(kv *kvstore.KeyValueService, backup io.Reader) (int, error) {
+	compressed, err := gzip.NewReader(backup)
+	if err != nil {
+		return 0, fmt.Errorf("reading backup: %w", err)
+	}
+	decoder := gob.NewDecoder(compressed)
+
+	if _, err := clearKeys(kv); err != nil {
+		return 0, err
+	}
+
+	restored := 0
+	var mutations []kvstore.Mutation
+	flush := func() error {
+		if len(mutations) == 0 {
+			return nil
+		}
+		if err := kv.ApplyMutations(mutations); err != nil {
+			return err
+		}
+		mutations = mutations[:0]
+		return nil
+	}
+	now := time.Now().UnixNano()
+	for {
+		var record backupRecord
+		err := decoder.Decode(&record)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return restored, fmt.Errorf("reading backup: %w", err)
+		}
+		if record.Deadline != 0 && record.Deadline <= now {
+			continue
+		}
+		mutations = append(mutations, kvstore.Mutation{Type: kvstore.MutationSet, Key: record.Key, Value: record.Value, ValueType: record.Type})
+		if record.Deadline != 0 {
+			mutations = append(mutations, kvstore.Mutation{Type: kvstore.MutationExpire, Key: record.Key, Deadline: record.Deadline})
+		}
+		restored++
+		if restored%restoreBatchSize == 0 {
+			if err := flush(); err != nil {
+				return restored, err
+			}
+		}
+	}
+	return restored, flush()
+}
+
+// applyIncrementalBackup applies the changes in an incremental backup to
+// the keys kv holds. It returns how many keys were changed.
+func applyIncrementalBackup(kv *kvstore.KeyValueService, backup io.Reader) (int, error) {
+	compressed, err := gzip.NewReader(backup)
+	if err != nil {
+		return 0, fmt.Errorf("reading backup: %w", err)
+	}
+	decoder := gob.NewDecoder(compressed)
+
+	applied := 0
+	var mutations []kvstore.Mutation
+	now := time.Now().UnixNano()
+	for {
+		var change backupChange
+		err := decoder.Decode(&change)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return applied, fmt.Errorf("reading backup: %w", err)
+		}
+		switch {
+		case change.Deadline > 0 && change.Deadline <= now:
+			mutations = append(mutations, kvstore.Mutation{Type: kvstore.MutationDelete, Key: change.Key})
+		default:
+			if change.Deleted {
+				mutations = append(mutations, kvstore.Mutation{Type: kvstore.MutationDelete, Key: change.Key})
+			} else if change.Set {
+				mutations = append(mutations, kvstore.Mutation{Type: kvstore.MutationSet, Key: change.Key, Value: change.Value, ValueType: change.Type})
+			}
+			mutations = append(mutations, change.List...)
+			if change.Deadline > 0 {
+				mutations = append(mutations, kvstore.Mutation{Type: kvstore.MutationExpire, Key: change.Key, Deadline: change.Deadline})
+			} else if change.Deadline < 0 {
+				mutations = append(mutations, kvstore.Mutation{Type: kvstore.MutationPersist, Key: change.Key})
+			}
+		}
+		applied++
+		if len(mutations) >= restoreBatchSize {
+			if err := kv.ApplyMutations(mutations); err != nil {
+				return applied, err
+			}
+			mutations = mutations[:0]
+		}
+	}
+	if len(mutations) > 0 {
+		if err := kv.ApplyMutations(mutations); err != nil {
+			return applied, err
+		}
+	}
+	return applied, nil
+}
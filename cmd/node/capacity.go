@@ -0,0 +1,66 @@
+package main
+
+import (
+	"math"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// cgroupMemoryMax is where a node in a cgroup v2 container finds its
+// memory limit.
+const cgroupMemoryMax = "/sys/fs/cgroup/memory.max"
+
+// capacityResponse is what the node has to hold and serve keys with. It is
+// sent with every reply to a coordinator's announcement, so coordinators
+// can place keys by what nodes can take rather than by weights guessed up
+// front. MemoryLimit is 0 when the node knows of no limit. Keys comes from
+// the latest keyspace analysis, so it is left out when analysis is
+// disabled or has not run yet.
+type capacityResponse struct {
+	CPUs        int    `json:"cpus"`
+	MemoryLimit uint64 `json:"memoryLimit"`
+	MemoryUsed  uint64 `json:"memoryUsed"`
+	Keys        *int   `json:"keys,omitempty"`
+	// KeysAt is when Keys was counted, in milliseconds since the epoch
+	KeysAt int64 `json:"keysAt,omitempty"`
+}
+
+func nodeCapacity(keyspace *keyspaceAnalyzer) *capacityResponse {
+	var memory runtime.MemStats
+	runtime.ReadMemStats(&memory)
+	capacity := &capacityResponse{
+		CPUs:        runtime.GOMAXPROCS(0),
+		MemoryLimit: memoryLimit(),
+		MemoryUsed:  memory.Sys - memory.HeapReleased,
+	}
+	// Counting keys takes a trip through the store, which may be held up by
+	// maintenance, so the count from the last analysis is used instead
+	if keyspace != nil {
+		if report := keyspace.latest.Load(); report != nil {
+			capacity.Keys = &report.Keys
+			capacity.KeysAt = report.Time.UnixMilli()
+		}
+	}
+	return capacity
+}
+
+// memoryLimit returns GOMEMLIMIT if it is set, or else the limit of the
+// cgroup the node runs in, or 0 if there is neither.
+func memoryLimit() uint64 {
+	if limit := debug.SetMemoryLimit(-1); limit != math.MaxInt64 {
+		return uint64(limit)
+	}
+	data, err := os.ReadFile(cgroupMemoryMax)
+	if err != nil {
+		return 0
+	}
+	// "max" when the cgroup has no limit
+	limit, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return limit
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"blueis/internal/changelog"
+	"blueis/internal/kvstore"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// changeLogBuffer is how many changes may wait to be archived before
+	// the archiver is too far behind and loses some
+	changeLogBuffer = 100000
+	// changeLogSyncInterval is how often archived changes are made durable
+	changeLogSyncInterval = time.Second
+	// changeLogBatch caps the changes appended to the log at once
+	changeLogBatch = 1000
+)
+
+// changeArchiver follows the store and appends every change it makes to
+// the change log, so the node can be put back as it was at any time since
+// a backup.
+type changeArchiver struct {
+	kv   *kvstore.KeyValueService
+	log  *changelog.Log
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+func newChangeArchiver(kv *kvstore.KeyValueService, log *changelog.Log) *changeArchiver {
+	return &changeArchiver{kv: kv, log: log, stop: make(chan struct{})}
+}
+
+func (archiver *changeArchiver) start() {
+	archiver.done.Add(1)
+	go archiver.run()
+}
+
+func (archiver *changeArchiver) run() {
+	defer archiver.done.Done()
+	ticker := time.NewTicker(changeLogSyncInterval)
+	defer ticker.Stop()
+
+	gap := false
+	for {
+		stream, err := archiver.kv.Follow(changeLogBuffer)
+		if err != nil {
+			log.Printf("Following changes for the change log: %v", err)
+			gap = true
+			select {
+			case <-archiver.stop:
+				return
+			case <-ticker.C:
+				continue
+			}
+		}
+		lost := archiver.archive(stream, ticker, gap)
+		stream.Close()
+		if !lost {
+			return
+		}
+		log.Printf("Change log fell behind and lost changes: %v", stream.Err())
+		gap = true
+	}
+}
+
+// archive appends stream's changes to the log until the archiver is
+// stopped, or the stream fails and it reports that changes were lost. The
+// first change is marked as following a gap if gap is set.
+func (archiver *changeArchiver) archive(stream *kvstore.ReplicationStream, ticker *time.Ticker, gap bool) bool {
+	var entries []changelog.Entry
+	// next appends the changes waiting on stream to entries, up to a batch
+	next := func(at int64) {
+		for len(entries) < changeLogBatch {
+			select {
+			case mutation, ok := <-stream.Mutations():
+				if !ok {
+					return
+				}
+				entries = append(entries, changelog.Entry{Run: stream.ID(), Mutation: mutation, At: at, Gap: gap})
+				gap = false
+			default:
+				return
+			}
+		}
+	}
+	for {
+		select {
+		case mutation, ok := <-stream.Mutations():
+			if !ok {
+				return true
+			}
+			at := time.Now().UnixNano()
+			entries = append(entries[:0], changelog.Entry{Run: stream.ID(), Mutation: mutation, At: at, Gap: gap})
+			gap = false
+			next(at)
+			if err := archiver.log.Append(entries); err != nil {
+				log.Printf("Appending to the change log: %v", err)
+			}
+		case <-ticker.C:
+			if err := archiver.log.Sync(); err != nil {
+				log.Printf("Syncing the change log: %v", err)
+			}
+		case <-archiver.stop:
+			// The store has closed, so what is waiting is the last of it
+			at := time.Now().UnixNano()
+			for {
+				entries = entries[:0]
+				next(at)
+				if len(entries) == 0 {
+					return false
+				}
+				if err := archiver.log.Append(entries); err != nil {
+					log.Printf("Appending to the change log: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// close archives the changes still waiting and closes the log. It must be
+// called after the store has closed, so no more are made.
+func (archiver *changeArchiver) close() {
+	close(archiver.stop)
+	archiver.done.Wait()
+	if err := archiver.log.Close(); err != nil {
+		log.Printf("Closing the change log: %v", err)
+	}
+}
+
+type replayRequest struct {
+	// Run and Since are the position of the backup the node was restored
+	// from, and Until the time to replay changes up to
+	Run   string    `json:"run"`
+	Since uint64    `json:"since"`
+	Until time.Time `json:"until"`
+}
+
+// handleReplay replays the changes the node made after a backup from its
+// change log, up to a point in time: POST /backup/replay
+// {"run":"<run>","since":<offset>,"until":"<RFC 3339 time>"}, with the
+// run and offset the backup's headers reported. Restoring the backup then
+// replaying puts the node back as it was at that time. It is answered with
+// 409 if the log does not hold every change in between, and refused on a
+// replica like a restore.
+func handleReplay(w http.ResponseWriter, r *http.Request, kv *kvstore.KeyValueService, role *replicationRole, changes *changelog.Log) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(restoreResponse{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+	if changes == nil {
+		w.WriteHeader(http.StatusConflict)
+		_ = json.NewEncoder(w).Encode(restoreResponse{
+			Success: false,
+			Error:   "the change log was not enabled at startup",
+		})
+		return
+	}
+	if info := role.info(); info.Role == "replica" {
+		w.WriteHeader(http.StatusConflict)
+		_ = json.NewEncoder(w).Encode(restoreResponse{
+			Success: false,
+			Error:   "node is a replica of " + info.Primary + ", restore the primary instead",
+		})
+		return
+	}
+	var req replayRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Run == "" || req.Until.IsZero() {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(restoreResponse{
+			Success: false,
+			Error:   "body must be {\"run\":\"<run>\",\"since\":<offset>,\"until\":\"<time>\"}",
+		})
+		return
+	}
+
+	replayed, err := replayChanges(kv, changes, req)
+	if err != nil {
+		log.Printf("Replaying the change log: %v", err)
+		w.WriteHeader(errorStatus(err, http.StatusInternalServerError))
+		_ = json.NewEncoder(w).Encode(restoreResponse{
+			Success: false,
+			Keys:    replayed,
+			Error:   err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+	log.Printf("Replayed %d changes up to %s", replayed, req.Until.Format(time.RFC3339Nano))
+	_ = json.NewEncoder(w).Encode(restoreResponse{
+		Success: true,
+		Keys:    replayed,
+	})
+}
+
+// replayChanges applies the changes in the log after req's position up to
+// its time, returning how many it applied. They are applied as replicated
+// changes, so the node's replicas follow.
+func replayChanges(kv *kvstore.KeyValueService, changes *changelog.Log, req replayRequest) (int, error) {
+	replayed := 0
+	var mutations []kvstore.Mutation
+	err := changes.Replay(req.Run, req.Since, req.Until, func(entry changelog.Entry) error {
+		// Offsets restart with each run the log spans, so they cannot tell
+		// a list change applied already from one that is not
+		mutation := entry.Mutation
+		mutation.Offset = 0
+		mutations = append(mutations, mutation)
+		replayed++
+		if len(mutations) < restoreBatchSize {
+			return nil
+		}
+		err := kv.ApplyMutations(mutations)
+		mutations = mutations[:0]
+		return err
+	})
+	if err == nil && len(mutations) > 0 {
+		err = kv.ApplyMutations(mutations)
+	}
+	return replayed, err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// replicationCheckpointInterval is how often a replica records its progress
+// while changes keep arriving.
+const replicationCheckpointInterval = time.Second
+
+// replicationCheckpoint records that the node held every change up to Offset
+// of Primary's run ReplicationID. It is only meaningful alongside data that
+// survives a restart, so it is written after the changes it covers have been
+// applied, and removed before a full sync starts replacing the data.
+type replicationCheckpoint struct {
+	Primary       string `json:"primary"`
+	ReplicationID string `json:"replicationId"`
+	Offset        uint64 `json:"offset"`
+}
+
+// loadReplicationCheckpoint reads the checkpoint at path. A missing file is
+// an empty checkpoint.
+func loadReplicationCheckpoint(path string) (replicationCheckpoint, error) {
+	var checkpoint replicationCheckpoint
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return checkpoint, nil
+	}
+	if err != nil {
+		return checkpoint, err
+	}
+	err = json.Unmarshal(data, &checkpoint)
+	return checkpoint, err
+}
+
+// writeReplicationCheckpoint replaces the checkpoint at path, writing it to
+// a temporary file first so a crash never leaves a torn one.
+func writeReplicationCheckpoint(path string, checkpoint replicationCheckpoint) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// saveCheckpoint records the replica's progress, at most once per
+// replicationCheckpointInterval unless force is set.
+func (replica *replica) saveCheckpoint(force bool) {
+	path := replica.options.checkpoint
+	if path == "" || !force && time.Since(replica.checkpointed) < replicationCheckpointInterval {
+		return
+	}
+	progress := replica.progress()
+	if !progress.synced {
+		return
+	}
+	checkpoint := replicationCheckpoint{replica.primary, progress.primaryID, progress.offset}
+	if err := writeReplicationCheckpoint(path, checkpoint); err != nil {
+		replicationLog.Warnf("Saving replication checkpoint: %v", err)
+		return
+	}
+	replica.checkpointed = time.Now()
+}
+
+func (replica *replica) removeCheckpoint() {
+	path := replica.options.checkpoint
+	if path == "" {
+		return
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		replicationLog.Warnf("Removing replication checkpoint: %v", err)
+	}
+}
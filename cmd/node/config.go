@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errNoConfigFile is returned by a reload of a node started without
+// -config.
+var errNoConfigFile = errors.New("the node was started without -config")
+
+type reloadResponse struct {
+	Success bool `json:"success"`
+	// Applied lists the settings the reload changed or whose files it read
+	// again, RequiresRestart those
+	// that changed in the file but only take effect on a restart, and
+	// Ignored those the file sets but the command line overrides
+	Applied         []string `json:"applied,omitempty"`
+	RequiresRestart []string `json:"requiresRestart,omitempty"`
+	Ignored         []string `json:"ignored,omitempty"`
+	Error           string   `json:"error,omitempty"`
+}
+
+// readConfigFile reads the settings in path, one name = value per line,
+// named after the node's flags. Blank lines and lines starting with # are
+// skipped, and values may be double-quoted.
+func readConfigFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+	defer file.Close()
+
+	settings := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(text, "=")
+		name = strings.TrimLeft(strings.TrimSpace(name), "-")
+		value = strings.TrimSpace(value)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%s:%d: want name = value", path, line)
+		}
+		if strings.HasPrefix(value, `"`) {
+			if value, err = strconv.Unquote(value); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+		}
+		if name == "config" || flag.Lookup(name) == nil {
+			return nil, fmt.Errorf("%s:%d: unknown setting %q", path, line, name)
+		}
+		settings[name] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+	return settings, nil
+}
+
+// commandLineFlags returns the names of the flags set on the command line,
+// which take precedence over the config file.
+func commandLineFlags() map[string]bool {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
+
+// applyConfigFile sets the flags named in the config file at path, other
+// than those set on the command line.
+func applyConfigFile(path string, fixed map[string]bool) error {
+	settings, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	for name, value := range settings {
+		if fixed[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("%s: invalid value %q for %s: %w", path, value, name, err)
+		}
+	}
+	return nil
+}
+
+// configApplier puts a group of reload-safe settings into effect after a
+// reload has changed any of them, reading them from their flags. An
+// applier whose settings name files runs on every reload, so files
+// replaced in place, such as renewed certificates, are picked up too.
+type configApplier struct {
+	settings []string
+	apply    func() error
+	files    bool
+}
+
+// configReloader reloads the node's config file, on SIGHUP or through
+// /admin/reload. Settings with an applier take effect at once; a change to
+// any other setting is left for the next restart and reported. Only the
+// flags of reload-safe settings are changed, so the rest keep describing
+// what the node runs with, and code reading them while the node runs never
+// sees a value it was not started with.
+type configReloader struct {
+	path     string
+	fixed    map[string]bool
+	appliers []configApplier
+
+	mu sync.Mutex
+}
+
+// reload reads the config file and applies it. Settings missing from the
+// file fall back to their defaults, as they would on a restart. If a group
+// fails to apply, its settings are put back and the error returned along
+// with what else was applied.
+func (reloader *configReloader) reload() (reloadResponse, error) {
+	res := reloadResponse{}
+	if reloader.path == "" {
+		return res, errNoConfigFile
+	}
+	reloader.mu.Lock()
+	defer reloader.mu.Unlock()
+
+	settings, err := readConfigFile(reloader.path)
+	if err != nil {
+		return res, err
+	}
+
+	// Work out what changed before changing anything, so an invalid value
+	// leaves every setting as it was
+	changed := make(map[string]string)
+	var invalid error
+	flag.VisitAll(func(f *flag.Flag) {
+		value, inFile := settings[f.Name]
+		if invalid != nil || f.Name == "config" || (!inFile && reloader.fixed[f.Name]) {
+			return
+		}
+		if reloader.fixed[f.Name] {
+			res.Ignored = append(res.Ignored, f.Name)
+			return
+		}
+		if !inFile {
+			value = f.DefValue
+		}
+		normalized, err := parseFlagValue(f, value)
+		if err != nil {
+			invalid = fmt.Errorf("invalid value %q for %s: %w", value, f.Name, err)
+			return
+		}
+		if normalized != f.Value.String() {
+			changed[f.Name] = value
+		}
+	})
+	if invalid != nil {
+		return reloadResponse{}, invalid
+	}
+
+	var errs []error
+	reloadable := make(map[string]bool)
+	for _, applier := range reloader.appliers {
+		previous := make(map[string]string)
+		for _, name := range applier.settings {
+			reloadable[name] = true
+			if value, ok := changed[name]; ok {
+				previous[name] = flag.Lookup(name).Value.String()
+				_ = flag.Set(name, value)
+			}
+		}
+		if len(previous) == 0 && !applier.files {
+			continue
+		}
+		group := slices.Sorted(maps.Keys(previous))
+		if applier.files {
+			group = slices.Sorted(slices.Values(applier.settings))
+		}
+		if err := applier.apply(); err != nil {
+			for name, value := range previous {
+				_ = flag.Set(name, value)
+			}
+			errs = append(errs, fmt.Errorf("applying %s: %w", strings.Join(group, ", "), err))
+			continue
+		}
+		res.Applied = append(res.Applied, group...)
+	}
+	for name := range changed {
+		if !reloadable[name] {
+			res.RequiresRestart = append(res.RequiresRestart, name)
+		}
+	}
+	slices.Sort(res.Applied)
+	slices.Sort(res.RequiresRestart)
+	return res, errors.Join(errs...)
+}
+
+// parseFlagValue parses value as a value of f's type, returning it as f
+// would print it, without changing f.
+func parseFlagValue(f *flag.Flag, value string) (string, error) {
+	scratch := flag.NewFlagSet(f.Name, flag.ContinueOnError)
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return value, nil
+	}
+	switch current := getter.Get().(type) {
+	case bool:
+		scratch.Bool(f.Name, current, "")
+	case int:
+		scratch.Int(f.Name, current, "")
+	case int64:
+		scratch.Int64(f.Name, current, "")
+	case uint:
+		scratch.Uint(f.Name, current, "")
+	case uint64:
+		scratch.Uint64(f.Name, current, "")
+	case float64:
+		scratch.Float64(f.Name, current, "")
+	case time.Duration:
+		scratch.Duration(f.Name, current, "")
+	default:
+		return value, nil
+	}
+	if err := scratch.Set(f.Name, value); err != nil {
+		return "", err
+	}
+	return scratch.Lookup(f.Name).Value.String(), nil
+}
+
+// handleReload reloads the node's config file: POST /admin/reload.
+func handleReload(w http.ResponseWriter, r *http.Request, reloader *configReloader) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(reloadResponse{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	res, err := reloader.reload()
+	logReload(res)
+	if err != nil {
+		if errors.Is(err, errNoConfigFile) {
+			w.WriteHeader(http.StatusConflict)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		res.Error = err.Error()
+		_ = json.NewEncoder(w).Encode(res)
+		return
+	}
+	res.Success = true
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+func logReload(res reloadResponse) {
+	if len(res.Applied) > 0 {
+		log.Printf("Reloaded config, applied %s", strings.Join(res.Applied, ", "))
+	}
+	if len(res.RequiresRestart) > 0 {
+		log.Printf("Reloaded config, %s changed but need a restart", strings.Join(res.RequiresRestart, ", "))
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"blueis/internal/acl"
+	"blueis/internal/kvstore"
+	"encoding/json"
+	"net/http"
+)
+
+type countMinInitRequest struct {
+	Width       int     `json:"width,omitempty"`
+	Depth       int     `json:"depth,omitempty"`
+	ErrorRate   float64 `json:"errorRate,omitempty"`
+	Probability float64 `json:"probability,omitempty"`
+}
+
+type countMinIncrement struct {
+	Item      string `json:"item"`
+	Increment uint32 `json:"increment"`
+}
+
+type countMinIncrByRequest struct {
+	Items []countMinIncrement `json:"items"`
+}
+
+type countMinMergeRequest struct {
+	Sources []string `json:"sources"`
+}
+
+type countMinResponse struct {
+	Success bool     `json:"success"`
+	Counts  []uint32 `json:"counts,omitempty"`
+	Error   string   `json:"error,omitempty"`
+	Code    string   `json:"code,omitempty"`
+}
+
+// handleCountMin serves the count-min sketch routes:
+//
+//	POST /cms/init?key=k    {"width":2000,"depth":5} or {"errorRate":0.001,"probability":0.01}
+//	POST /cms/incrby?key=k  {"items":[{"item":"a","increment":1}]}
+//	GET  /cms/query?key=k&item=a&item=b
+//	POST /cms/merge?key=k   {"sources":["a","b"]}
+func handleCountMin(w http.ResponseWriter, r *http.Request, kv *kvstore.KeyValueService, op string) {
+	w.Header().Set("Content-Type", "application/json")
+
+	wantMethod := http.MethodPost
+	if op == "query" {
+		wantMethod = http.MethodGet
+	}
+	if r.Method != wantMethod {
+		writeCountMinError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	key, err := requestKey(r)
+	if err != nil {
+		writeCountMinError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var counts []uint32
+	switch op {
+	case "init":
+		var req countMinInitRequest
+		if decodeErr := json.NewDecoder(r.Body).Decode(&req); decodeErr != nil {
+			writeCountMinError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		if req.ErrorRate != 0 || req.Probability != 0 {
+			err = kv.CountMinInitWithErrorContext(r.Context(), key, req.ErrorRate, req.Probability)
+		} else {
+			err = kv.CountMinInitContext(r.Context(), key, req.Width, req.Depth)
+		}
+	case "incrby":
+		var req countMinIncrByRequest
+		if decodeErr := json.NewDecoder(r.Body).Decode(&req); decodeErr != nil {
+			writeCountMinError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		items := make([]string, len(req.Items))
+		increments := make([]uint32, len(req.Items))
+		for i, item := range req.Items {
+			items[i], increments[i] = item.Item, item.Increment
+		}
+		counts, err = kv.CountMinIncrByContext(r.Context(), key, items, increments)
+	case "query":
+		counts, err = kv.CountMinQueryContext(r.Context(), key, r.URL.Query()["item"]...)
+	case "merge":
+		var req countMinMergeRequest
+		if decodeErr := json.NewDecoder(r.Body).Decode(&req); decodeErr != nil {
+			writeCountMinError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		// The sources are read, so the user must be allowed to read them
+		// as well as write to key
+		if err = checkKeys(r, acl.Read, req.Sources...); err == nil {
+			err = kv.CountMinMergeContext(r.Context(), key, req.Sources...)
+		}
+	}
+
+	if err != nil {
+		writeErrorStatus(w, err, http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(countMinResponse{
+			Success: false,
+			Error:   err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(countMinResponse{
+		Success: true,
+		Counts:  counts,
+	})
+}
+
+func writeCountMinError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(countMinResponse{
+		Success: false,
+		Error:   message,
+	})
+}
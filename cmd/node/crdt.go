@@ -0,0 +1,105 @@
+package main
+
+import (
+	"blueis/internal/kvstore"
+	"encoding/json"
+	"net/http"
+)
+
+type counterIncrByRequest struct {
+	Delta int64 `json:"delta"`
+}
+
+type setMembersRequest struct {
+	Members []string `json:"members"`
+}
+
+type crdtResponse struct {
+	Success bool     `json:"success"`
+	Value   *int64   `json:"value,omitempty"`
+	Members []string `json:"members,omitempty"`
+	Error   string   `json:"error,omitempty"`
+	Code    string   `json:"code,omitempty"`
+}
+
+// handleCRDT serves the routes for counters and sets under the
+// -crdt-namespaces prefixes, which nodes following each other with -peer-of
+// can update at the same time:
+//
+//	POST /crdt/counter/incrby?key=k  {"delta":-3}
+//	GET  /crdt/counter/get?key=k
+//	POST /crdt/set/add?key=k         {"members":["a","b"]}
+//	POST /crdt/set/remove?key=k      {"members":["a"]}
+//	GET  /crdt/set/members?key=k
+//
+// incrby and get reply with the counter's value, add and remove with how
+// many members they added or removed.
+func handleCRDT(w http.ResponseWriter, r *http.Request, kv *kvstore.KeyValueService, op string) {
+	w.Header().Set("Content-Type", "application/json")
+
+	wantMethod := http.MethodPost
+	if op == "counter/get" || op == "set/members" {
+		wantMethod = http.MethodGet
+	}
+	if r.Method != wantMethod {
+		writeCRDTError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	key, err := requestKey(r)
+	if err != nil {
+		writeCRDTError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var value int64
+	var members []string
+	switch op {
+	case "counter/incrby":
+		var req counterIncrByRequest
+		if decodeErr := json.NewDecoder(r.Body).Decode(&req); decodeErr != nil {
+			writeCRDTError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		value, err = kv.PNCounterIncrByContext(r.Context(), key, req.Delta)
+	case "counter/get":
+		value, err = kv.PNCounterGetContext(r.Context(), key)
+	case "set/add", "set/remove":
+		var req setMembersRequest
+		if decodeErr := json.NewDecoder(r.Body).Decode(&req); decodeErr != nil {
+			writeCRDTError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		if op == "set/add" {
+			value, err = kv.ORSetAddContext(r.Context(), key, req.Members...)
+		} else {
+			value, err = kv.ORSetRemoveContext(r.Context(), key, req.Members...)
+		}
+	case "set/members":
+		members, err = kv.ORSetMembersContext(r.Context(), key)
+	}
+
+	if err != nil {
+		writeErrorStatus(w, err, http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(crdtResponse{
+			Success: false,
+			Error:   err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	res := crdtResponse{Success: true, Members: members}
+	if op != "set/members" {
+		res.Value = &value
+	}
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+func writeCRDTError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(crdtResponse{
+		Success: false,
+		Error:   message,
+	})
+}
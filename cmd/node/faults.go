@@ -0,0 +1,67 @@
+package main
+
+import (
+	"blueis/internal/faults"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+)
+
+type faultsResponse struct {
+	Success bool          `json:"success"`
+	Faults  faults.Faults `json:"faults"`
+	Stats   faults.Stats  `json:"stats"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// newFaultInjector returns the injector /admin/faults sets, which exits the
+// node without shutting down when it is told to crash.
+func newFaultInjector() *faults.Injector {
+	return faults.New(func() {
+		log.Printf("Crashing after the writes set by fault injection")
+		os.Exit(2)
+	})
+}
+
+// handleFaults reports the faults injected into the node on GET, replaces
+// them with the body's on POST or PUT, and clears them on DELETE.
+func handleFaults(w http.ResponseWriter, r *http.Request, injector *faults.Injector) {
+	w.Header().Set("Content-Type", "application/json")
+
+	fail := func(status int, message string) {
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(faultsResponse{
+			Success: false,
+			Faults:  injector.Faults(),
+			Stats:   injector.Stats(),
+			Error:   message,
+		})
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		var req faults.Faults
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			fail(http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		if err := injector.Set(req); err != nil {
+			fail(http.StatusBadRequest, err.Error())
+			return
+		}
+		log.Printf("Fault injection set to %+v\n", injector.Faults())
+	case http.MethodDelete:
+		_ = injector.Set(faults.Faults{})
+		log.Printf("Fault injection cleared\n")
+	default:
+		fail(http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(faultsResponse{
+		Success: true,
+		Faults:  injector.Faults(),
+		Stats:   injector.Stats(),
+	})
+}
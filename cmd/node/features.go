@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// nodeFeature is an optional subsystem that -feature-gates can switch off,
+// to run a node with less exposed, or on, for one that ships disabled until
+// it is ready.
+type nodeFeature struct {
+	name        string
+	description string
+	enabled     bool
+}
+
+var nodeFeatures = []nodeFeature{
+	{"cms", "count-min sketches under /cms", true},
+	{"crdt", "CRDT counters and sets under /crdt, and merging them from -peer-of", true},
+	{"locks", "distributed locks at /lock and /unlock", true},
+	{"leases", "leases under /lease", true},
+	{"transactions", "two-phase transactions under /txn, used by the coordinator for multi-key writes", true},
+	{"notifications", "keyspace notifications streamed from /notifications", true},
+	{"resp", "the Redis protocol listener on -resp-addr", true},
+	{"graphql", "the GraphQL endpoint at /graphql, for reading and writing many keys in one request", false},
+	{"faults", "fault injection at /admin/faults, dropping, delaying and blackholing requests, slowing syncs and crashing, for chaos tests", false},
+}
+
+type featureResponse struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Enabled     bool   `json:"enabled"`
+	Default     bool   `json:"default"`
+}
+
+type featuresResponse struct {
+	Success  bool              `json:"success"`
+	Features []featureResponse `json:"features,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// featureGates says which of nodeFeatures are enabled.
+type featureGates map[string]bool
+
+// parseFeatureGates parses a comma-separated list of name=true|false
+// settings; features not named keep their default.
+func parseFeatureGates(spec string) (featureGates, error) {
+	gates := make(featureGates, len(nodeFeatures))
+	for _, feature := range nodeFeatures {
+		gates[feature.name] = feature.enabled
+	}
+	for _, setting := range strings.Split(spec, ",") {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(setting, "=")
+		if !ok {
+			return nil, fmt.Errorf("feature gate %q is not name=true|false", setting)
+		}
+		if _, known := gates[name]; !known {
+			return nil, fmt.Errorf("unknown feature %q", name)
+		}
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("feature gate %q is not name=true|false", setting)
+		}
+		gates[name] = enabled
+	}
+	return gates, nil
+}
+
+func (gates featureGates) enabled(name string) bool {
+	return gates[name]
+}
+
+// gate returns handler if the feature is enabled, and otherwise a handler
+// that answers every request with 404, as if the route did not exist.
+func (gates featureGates) gate(name string, handler http.HandlerFunc) http.HandlerFunc {
+	if gates.enabled(name) {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(response{
+			Success: false,
+			Error:   "the " + name + " feature is disabled on this node",
+			Code:    "FEATURE_DISABLED",
+		})
+	}
+}
+
+// handleFeatures lists the node's optional features and whether each is
+// enabled: GET /admin/features.
+func handleFeatures(w http.ResponseWriter, r *http.Request, gates featureGates) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(featuresResponse{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	features := make([]featureResponse, len(nodeFeatures))
+	for i, feature := range nodeFeatures {
+		features[i] = featureResponse{
+			Name:        feature.name,
+			Description: feature.description,
+			Enabled:     gates.enabled(feature.name),
+			Default:     feature.enabled,
+		}
+	}
+	_ = json.NewEncoder(w).Encode(featuresResponse{
+		Success:  true,
+		Features: features,
+	})
+}
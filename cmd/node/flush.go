@@ -0,0 +1,147 @@
+package main
+
+import (
+	"blueis/internal/kvstore"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+type flushResponse struct {
+	Success bool `json:"success"`
+	// DryRun says nothing was deleted, and Deleted is how many keys would
+	// have been
+	DryRun  bool   `json:"dryRun,omitempty"`
+	Deleted int    `json:"deleted"`
+	Error   string `json:"error,omitempty"`
+	Code    string `json:"code,omitempty"`
+}
+
+// parseDryRun reads the dryRun query parameter. A value that is not a
+// boolean is an error rather than false, so a mistyped dry run is refused
+// instead of carried out.
+func parseDryRun(r *http.Request) (bool, error) {
+	value := r.URL.Query().Get("dryRun")
+	if value == "" {
+		return false, nil
+	}
+	dryRun, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.New("'dryRun' must be true or false")
+	}
+	return dryRun, nil
+}
+
+// handleFlush deletes every key the node holds: POST /admin/flush. The keys
+// are deleted as replicated changes, so the node's replicas are flushed
+// with it, which also means flushing a replica is refused. With
+// ?dryRun=true nothing is deleted and the reply says how many keys would
+// have been.
+func handleFlush(w http.ResponseWriter, r *http.Request, kv *kvstore.KeyValueService, role *replicationRole) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(flushResponse{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+	dryRun, err := parseDryRun(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(flushResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+	if info := role.info(); info.Role == "replica" {
+		w.WriteHeader(http.StatusConflict)
+		_ = json.NewEncoder(w).Encode(flushResponse{
+			Success: false,
+			Error:   "node is a replica of " + info.Primary + ", flush the primary instead",
+		})
+		return
+	}
+
+	if dryRun {
+		keys, err := countKeys(kv)
+		if err != nil {
+			w.WriteHeader(errorStatus(err, http.StatusInternalServerError))
+			_ = json.NewEncoder(w).Encode(flushResponse{
+				Success: false,
+				DryRun:  true,
+				Error:   err.Error(),
+				Code:    errorCode(err),
+			})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(flushResponse{
+			Success: true,
+			DryRun:  true,
+			Deleted: keys,
+		})
+		return
+	}
+
+	deleted, err := clearKeys(kv)
+	if err != nil {
+		log.Printf("Flushing the node: %v", err)
+		w.WriteHeader(errorStatus(err, http.StatusInternalServerError))
+		_ = json.NewEncoder(w).Encode(flushResponse{
+			Success: false,
+			Deleted: deleted,
+			Error:   err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+	log.Printf("Flushed %d keys", deleted)
+	_ = json.NewEncoder(w).Encode(flushResponse{
+		Success: true,
+		Deleted: deleted,
+	})
+}
+
+// countKeys returns how many keys kv holds, as clearKeys would see them.
+func countKeys(kv *kvstore.KeyValueService) (int, error) {
+	snapshot, err := kv.Snapshot()
+	if err != nil {
+		return 0, err
+	}
+	defer snapshot.Close()
+	keys, err := snapshot.Keys()
+	return len(keys), err
+}
+
+// clearKeys deletes every key kv holds, in batches of restoreBatchSize, and
+// returns how many were deleted.
+func clearKeys(kv *kvstore.KeyValueService) (int, error) {
+	snapshot, err := kv.Snapshot()
+	if err != nil {
+		return 0, err
+	}
+	keys, err := snapshot.Keys()
+	snapshot.Close()
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for batch := range slices.Chunk(keys, restoreBatchSize) {
+		deletes := make([]kvstore.Mutation, len(batch))
+		for i, key := range batch {
+			deletes[i] = kvstore.Mutation{Type: kvstore.MutationDelete, Key: key}
+		}
+		if err := kv.ApplyMutations(deletes); err != nil {
+			return deleted, fmt.Errorf("clearing keys: %w", err)
+		}
+		deleted += len(batch)
+	}
+	return deleted, nil
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"blueis/internal/acl"
+	"blueis/internal/graphql"
+	"blueis/internal/kvstore"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	// graphQLListLimit is how many keys list returns when no limit is given,
+	// and graphQLMaxListLimit the most it may be asked for
+	graphQLListLimit    = 100
+	graphQLMaxListLimit = 1000
+)
+
+// graphQLSchema is the schema /graphql serves. Its fields are resolved by
+// hand by graphQLExecutor, and checked against graphQLFields.
+const graphQLSchema = `
+type Query {
+  get(key: String!): Entry
+  mget(keys: [String!]!): [Entry]
+  list(prefix: String = "", after: String, limit: Int = 100): [Entry!]
+}
+
+type Mutation {
+  set(key: String!, value: String!): Entry
+  mset(entries: [EntryInput!]!): [Entry]
+  delete(key: String!): Entry
+}
+
+type Entry {
+  key: String!
+  value: String
+}
+
+input EntryInput {
+  key: String!
+  value: String!
+}
+`
+
+// graphQLField describes a field of Query or Mutation: the arguments it
+// takes and which of them are required.
+type graphQLField struct {
+	arguments map[string]bool
+}
+
+var graphQLFields = map[graphql.OperationType]map[string]graphQLField{
+	graphql.Query: {
+		"get":  {arguments: map[string]bool{"key": true}},
+		"mget": {arguments: map[string]bool{"keys": true}},
+		"list": {arguments: map[string]bool{"prefix": false, "after": false, "limit": false}},
+	},
+	graphql.Mutation: {
+		"set":    {arguments: map[string]bool{"key": true, "value": true}},
+		"mset":   {arguments: map[string]bool{"entries": true}},
+		"delete": {arguments: map[string]bool{"key": true}},
+	},
+}
+
+// graphQLEntryFields are the fields of Entry.
+var graphQLEntryFields = map[string]bool{"key": true, "value": true, "__typename": true}
+
+// handleGraphQL runs a GraphQL query or mutation over the keyspace, so a
+// client can read and write many keys in one request of its own shape
+// rather than stitching REST calls together: POST /graphql
+// {"query":"...","variables":{...}}, or GET /graphql?query=... for
+// queries. graphQLSchema is the schema served. Fields that fail are null
+// and reported in errors, with the code the REST API would give; the reply
+// is 400 only for a request that cannot run at all. Like /kv/mget, keys are
+// read and written one at a time, not atomically.
+func handleGraphQL(w http.ResponseWriter, r *http.Request, kv *kvstore.KeyValueService) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req graphql.Request
+	switch r.Method {
+	case http.MethodGet:
+		query := r.URL.Query()
+		req.Query, req.OperationName = query.Get("query"), query.Get("operationName")
+		if variables := query.Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &req.Variables); err != nil {
+				writeGraphQLError(w, http.StatusBadRequest, "variables must be a JSON object")
+				return
+			}
+		}
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeGraphQLError(w, http.StatusRequestEntityTooLarge, "request body too large")
+				return
+			}
+			writeGraphQLError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+	default:
+		writeGraphQLError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	doc, err := graphql.Parse(req.Query)
+	if err != nil {
+		writeGraphQLError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	operation, err := doc.Operation(req.OperationName)
+	if err != nil {
+		writeGraphQLError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if operation.Type == graphql.Mutation && r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeGraphQLError(w, http.StatusMethodNotAllowed, "mutations must be sent with POST")
+		return
+	}
+	variables, err := operation.Coerce(req.Variables)
+	if err == nil {
+		err = validateGraphQL(operation, variables)
+	}
+	if err != nil {
+		writeGraphQLError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	executor := &graphQLExecutor{r: r, kv: kv, variables: variables}
+	data := executor.execute(operation)
+	_ = json.NewEncoder(w).Encode(graphql.Response{Data: data, Errors: executor.errors})
+}
+
+func writeGraphQLError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(graphql.Response{
+		Errors: []graphql.Error{{Message: message}},
+	})
+}
+
+// validateGraphQL checks operation only selects fields of the schema, with
+// the arguments they take, before any of it runs.
+func validateGraphQL(operation *graphql.Operation, variables map[string]any) error {
+	fields := graphQLFields[operation.Type]
+	for _, field := range operation.Selections {
+		if _, err := field.Included(variables); err != nil {
+			return err
+		}
+		if field.Name == "__typename" {
+			if len(field.Selections) > 0 {
+				return errors.New("__typename cannot have a selection")
+			}
+			continue
+		}
+		schema, ok := fields[field.Name]
+		if !ok {
+			return fmt.Errorf("cannot query field %q on type %s", field.Name, graphQLTypeName(operation.Type))
+		}
+		for _, argument := range field.Arguments {
+			if _, ok := schema.arguments[argument.Name]; !ok {
+				return fmt.Errorf("unknown argument %q on field %s", argument.Name, field.Name)
+			}
+		}
+		for name, required := range schema.arguments {
+			if _, ok := field.Argument(name, variables); required && !ok {
+				return fmt.Errorf("field %s needs argument %q", field.Name, name)
+			}
+		}
+		if len(field.Selections) == 0 {
+			return fmt.Errorf("field %s of type Entry must have a selection of subfields", field.Name)
+		}
+		for _, subfield := range field.Selections {
+			if _, err := subfield.Included(variables); err != nil {
+				return err
+			}
+			if !graphQLEntryFields[subfield.Name] {
+				return fmt.Errorf("cannot query field %q on type Entry", subfield.Name)
+			}
+			if len(subfield.Arguments) > 0 || len(subfield.Selections) > 0 {
+				return fmt.Errorf("field %s on type Entry takes no arguments or selection", subfield.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func graphQLTypeName(typ graphql.OperationType) string {
+	if typ == graphql.Mutation {
+		return "Mutation"
+	}
+	return "Query"
+}
+
+// graphQLExecutor resolves a validated operation's fields, collecting the
+// errors of those that fail.
+type graphQLExecutor struct {
+	r         *http.Request
+	kv        *kvstore.KeyValueService
+	variables map[string]any
+	errors    []graphql.Error
+}
+
+// execute resolves the operation's fields in order, as mutations must be.
+func (executor *graphQLExecutor) execute(operation *graphql.Operation) *graphql.Object {
+	data := &graphql.Object{}
+	for _, field := range operation.Selections {
+		if included, _ := field.Included(executor.variables); !included {
+			continue
+		}
+		key := field.ResponseKey()
+		var value any
+		var err error
+		switch field.Name {
+		case "__typename":
+			value = graphQLTypeName(operation.Type)
+		case "get":
+			value, err = executor.get(field)
+		case "mget":
+			value, err = executor.mget(field)
+		case "list":
+			value, err = executor.list(field)
+		case "set":
+			value, err = executor.set(field)
+		case "mset":
+			value, err = executor.mset(field)
+		case "delete":
+			value, err = executor.delete(field)
+		}
+		if err != nil {
+			executor.fail(err, key)
+			value = nil
+		}
+		data.Set(key, value)
+	}
+	return data
+}
+
+// fail records err as the error of the field at path.
+func (executor *graphQLExecutor) fail(err error, path ...any) {
+	failure := graphql.Error{Message: err.Error(), Path: path}
+	if code := errorCode(err); code != "" {
+		failure.Extensions = map[string]any{"code": code}
+	}
+	executor.errors = append(executor.errors, failure)
+}
+
+// entry resolves the selections of field on an Entry, or nil if the key
+// has no value.
+func (executor *graphQLExecutor) entry(field *graphql.Field, key string, value *string) any {
+	if value == nil {
+		return nil
+	}
+	entry := &graphql.Object{}
+	for _, subfield := range field.Selections {
+		if included, _ := subfield.Included(executor.variables); !included {
+			continue
+		}
+		switch subfield.Name {
+		case "__typename":
+			entry.Set(subfield.ResponseKey(), "Entry")
+		case "key":
+			entry.Set(subfield.ResponseKey(), key)
+		case "value":
+			entry.Set(subfield.ResponseKey(), *value)
+		}
+	}
+	return entry
+}
+
+func (executor *graphQLExecutor) get(field *graphql.Field) (any, error) {
+	key, err := executor.string(field, "key")
+	if err != nil {
+		return nil, err
+	}
+	if err := checkKeys(executor.r, acl.Read, key); err != nil {
+		return nil, err
+	}
+	value, err := executor.kv.GetContext(executor.r.Context(), key)
+	if errors.Is(err, kvstore.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return executor.entry(field, key, value), nil
+}
+
+func (executor *graphQLExecutor) mget(field *graphql.Field) (any, error) {
+	keys, err := executor.strings(field, "keys")
+	if err != nil {
+		return nil, err
+	}
+	// Like /kv/mget, naming any key the user may not read fails the field
+	if err := checkKeys(executor.r, acl.Read, keys...); err != nil {
+		return nil, err
+	}
+	commands := make([]kvstore.Command, len(keys))
+	for i, key := range keys {
+		commands[i] = kvstore.Command{Type: kvstore.GET, Key: key}
+	}
+	entries := make([]any, len(keys))
+	for i, result := range executor.kv.SendBatchContext(executor.r.Context(), commands) {
+		switch {
+		case errors.Is(result.Err, kvstore.ErrKeyNotFound):
+		case result.Err != nil:
+			executor.fail(result.Err, field.ResponseKey(), i)
+		default:
+			entries[i] = executor.entry(field, keys[i], result.Value)
+		}
+	}
+	return entries, nil
+}
+
+// list returns the keys starting with prefix, in order, after the key
+// after if given. Keys the user may not read are left out.
+func (executor *graphQLExecutor) list(field *graphql.Field) (any, error) {
+	prefix, err := executor.optionalString(field, "prefix")
+	if err != nil {
+		return nil, err
+	}
+	after, err := executor.optionalString(field, "after")
+	if err != nil {
+		return nil, err
+	}
+	limit := graphQLListLimit
+	if value, ok := field.Argument("limit", executor.variables); ok && value != nil {
+		n, isNumber := value.(float64)
+		if !isNumber || n != float64(int(n)) || n < 1 || n > graphQLMaxListLimit {
+			return nil, fmt.Errorf("limit must be an integer from 1 to %d", graphQLMaxListLimit)
+		}
+		limit = int(n)
+	}
+
+	entries := []any{}
+	for key, value := range executor.kv.Range(executor.r.Context(), prefix) {
+		if value.Err != nil {
+			return nil, value.Err
+		}
+		if key <= after || checkKeys(executor.r, acl.Read, key) != nil {
+			continue
+		}
+		entries = append(entries, executor.entry(field, key, &value.Data))
+		if len(entries) == limit {
+			break
+		}
+	}
+	return entries, nil
+}
+
+func (executor *graphQLExecutor) set(field *graphql.Field) (any, error) {
+	key, err := executor.string(field, "key")
+	if err != nil {
+		return nil, err
+	}
+	value, err := executor.string(field, "value")
+	if err != nil {
+		return nil, err
+	}
+	if err := checkKeys(executor.r, acl.Write, key); err != nil {
+		return nil, err
+	}
+	if _, err := executor.kv.SetContext(executor.r.Context(), key, value); err != nil {
+		return nil, err
+	}
+	return executor.entry(field, key, &value), nil
+}
+
+func (executor *graphQLExecutor) mset(field *graphql.Field) (any, error) {
+	value, _ := field.Argument("entries", executor.variables)
+	list, ok := value.([]any)
+	if !ok {
+		return nil, errors.New("entries must be a list of {key, value}")
+	}
+	commands := make([]kvstore.Command, len(list))
+	keys := make([]string, len(list))
+	for i, elem := range list {
+		input, _ := elem.(map[string]any)
+		key, keyOK := input["key"].(string)
+		value, valueOK := input["value"].(string)
+		if !keyOK || !valueOK || len(input) != 2 {
+			return nil, errors.New("entries must be a list of {key, value}")
+		}
+		keys[i] = key
+		commands[i] = kvstore.Command{Type: kvstore.PUT, Key: key, Value: &value}
+	}
+	if err := checkKeys(executor.r, acl.Write, keys...); err != nil {
+		return nil, err
+	}
+	entries := make([]any, len(commands))
+	for i, result := range executor.kv.SendBatchContext(executor.r.Context(), commands) {
+		if result.Err != nil {
+			executor.fail(result.Err, field.ResponseKey(), i)
+			continue
+		}
+		entries[i] = executor.entry(field, keys[i], commands[i].Value)
+	}
+	return entries, nil
+}
+
+// delete deletes a key, returning the entry as it was, or null if there
+// was none.
+func (executor *graphQLExecutor) delete(field *graphql.Field) (any, error) {
+	key, err := executor.string(field, "key")
+	if err != nil {
+		return nil, err
+	}
+	if err := checkKeys(executor.r, acl.Write, key); err != nil {
+		return nil, err
+	}
+	value, err := executor.kv.DeleteContext(executor.r.Context(), key)
+	if err != nil {
+		return nil, err
+	}
+	return executor.entry(field, key, value), nil
+}
+
+func (executor *graphQLExecutor) string(field *graphql.Field, name string) (string, error) {
+	value, _ := field.Argument(name, executor.variables)
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("%s must be a string", name)
+	}
+	return s, nil
+}
+
+func (executor *graphQLExecutor) optionalString(field *graphql.Field, name string) (string, error) {
+	if value, ok := field.Argument(name, executor.variables); !ok || value == nil {
+		return "", nil
+	}
+	return executor.string(field, name)
+}
+
+func (executor *graphQLExecutor) strings(field *graphql.Field, name string) ([]string, error) {
+	value, _ := field.Argument(name, executor.variables)
+	list, ok := value.([]any)
+	if !ok {
+		return nil, fmt.Errorf("%s must be a list of strings", name)
+	}
+	values := make([]string, len(list))
+	for i, elem := range list {
+		if values[i], ok = elem.(string); !ok {
+			return nil, fmt.Errorf("%s must be a list of strings", name)
+		}
+	}
+	return values, nil
+}
+
+// handleGraphQLSchema serves the schema /graphql resolves, in the GraphQL
+// schema language, for clients and tools that generate code from it:
+// GET /graphql/schema.
+func handleGraphQLSchema(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeGraphQLError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = io.WriteString(w, strings.TrimSpace(graphQLSchema)+"\n")
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// base64Keys reports whether a request sends and expects keys encoded in
+// URL-safe base64, as it does with encoding=base64. Keys can then hold any
+// bytes, including those a URL query or a JSON string cannot carry, such
+// as newlines or invalid UTF-8. Padding is optional on keys sent and left
+// off keys returned.
+func base64Keys(r *http.Request) bool {
+	return r.URL.Query().Get("encoding") == "base64"
+}
+
+// requestKey returns the key a request names in its "key" query parameter.
+func requestKey(r *http.Request) (string, error) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		return "", errors.New("missing 'key' query parameter")
+	}
+	if !base64Keys(r) {
+		return key, nil
+	}
+	return decodeKey(key)
+}
+
+func decodeKey(key string) (string, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(key, "="))
+	if err != nil {
+		return "", fmt.Errorf("key %q is not valid base64: %w", key, err)
+	}
+	return string(decoded), nil
+}
+
+// decodeKeys decodes keys in place when the request sends them in base64.
+func decodeKeys(r *http.Request, keys []string) error {
+	if !base64Keys(r) {
+		return nil
+	}
+	for i, key := range keys {
+		decoded, err := decodeKey(key)
+		if err != nil {
+			return err
+		}
+		keys[i] = decoded
+	}
+	return nil
+}
+
+// encodeKey returns key as the request expects keys back.
+func encodeKey(r *http.Request, key string) string {
+	if !base64Keys(r) {
+		return key
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
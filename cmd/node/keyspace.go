@@ -0,0 +1,227 @@
+package main
+
+import (
+	"blueis/internal/kvstore"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxRandomKeys caps how many keys one /kv/randomkeys request can sample.
+	maxRandomKeys = 10000
+	// defaultHotKeys and maxHotKeys are how many keys /admin/hotkeys reports
+	// without and at most with a count.
+	defaultHotKeys = 10
+	maxHotKeys     = 1000
+)
+
+type randomKeysResponse struct {
+	Success bool     `json:"success"`
+	Keys    []string `json:"keys,omitempty"`
+	Error   string   `json:"error,omitempty"`
+	Code    string   `json:"code,omitempty"`
+}
+
+type hotKeyResponse struct {
+	Key       string `json:"key"`
+	Frequency uint32 `json:"frequency"`
+}
+
+type hotKeysResponse struct {
+	Success bool             `json:"success"`
+	Keys    []hotKeyResponse `json:"keys,omitempty"`
+	Error   string           `json:"error,omitempty"`
+	Code    string           `json:"code,omitempty"`
+}
+
+type prefixStatsResponse struct {
+	Prefix string `json:"prefix,omitempty"`
+	Keys   int    `json:"keys"`
+	Bytes  int64  `json:"bytes"`
+}
+
+type keyspaceStatsResponse struct {
+	AnalyzedAt int64                 `json:"analyzedAt"`
+	Keys       int                   `json:"keys"`
+	Sampled    int                   `json:"sampled"`
+	Exact      bool                  `json:"exact"`
+	Prefixes   []prefixStatsResponse `json:"prefixes"`
+	Other      prefixStatsResponse   `json:"other"`
+}
+
+// keyspaceAnalyzer samples the keyspace in the background so /stats and
+// /metrics can show which prefixes dominate the node without scanning it on
+// every request.
+type keyspaceAnalyzer struct {
+	kv       *kvstore.KeyValueService
+	prefixes []string
+	samples  int
+	latest   atomic.Pointer[kvstore.KeyspaceReport]
+}
+
+func (analyzer *keyspaceAnalyzer) run(interval time.Duration) {
+	analyzer.analyze()
+	for range time.Tick(interval) {
+		analyzer.analyze()
+	}
+}
+
+func (analyzer *keyspaceAnalyzer) analyze() {
+	report, err := analyzer.kv.AnalyzeKeyspace(analyzer.prefixes, analyzer.samples)
+	if err != nil {
+		log.Printf("Analysing keyspace: %v", err)
+		return
+	}
+	analyzer.latest.Store(&report)
+}
+
+// stats returns the latest analysis, or nil if there is none yet or
+// analysis is disabled.
+func (analyzer *keyspaceAnalyzer) stats() *keyspaceStatsResponse {
+	if analyzer == nil {
+		return nil
+	}
+	report := analyzer.latest.Load()
+	if report == nil {
+		return nil
+	}
+
+	prefixes := make([]prefixStatsResponse, len(report.Prefixes))
+	for i, stats := range report.Prefixes {
+		prefixes[i] = prefixStatsResponse(stats)
+	}
+	return &keyspaceStatsResponse{
+		AnalyzedAt: report.Time.UnixMilli(),
+		Keys:       report.Keys,
+		Sampled:    report.Sampled,
+		Exact:      report.Exact,
+		Prefixes:   prefixes,
+		Other:      prefixStatsResponse(report.Other),
+	}
+}
+
+func (analyzer *keyspaceAnalyzer) writeMetrics(b *strings.Builder) {
+	// stats handles a nil analyzer
+	stats := analyzer.stats()
+	if stats == nil {
+		return
+	}
+
+	b.WriteString("# HELP blueis_keyspace_keys Keys held by the store.\n")
+	b.WriteString("# TYPE blueis_keyspace_keys gauge\n")
+	fmt.Fprintf(b, "blueis_keyspace_keys %d\n", stats.Keys)
+	b.WriteString("# HELP blueis_keyspace_prefix_keys Estimated keys under each configured prefix.\n")
+	b.WriteString("# TYPE blueis_keyspace_prefix_keys gauge\n")
+	for _, prefix := range stats.Prefixes {
+		fmt.Fprintf(b, "blueis_keyspace_prefix_keys{prefix=%q} %d\n", prefix.Prefix, prefix.Keys)
+	}
+	b.WriteString("# HELP blueis_keyspace_prefix_bytes Estimated bytes used by keys under each configured prefix.\n")
+	b.WriteString("# TYPE blueis_keyspace_prefix_bytes gauge\n")
+	for _, prefix := range stats.Prefixes {
+		fmt.Fprintf(b, "blueis_keyspace_prefix_bytes{prefix=%q} %d\n", prefix.Prefix, prefix.Bytes)
+	}
+	b.WriteString("# HELP blueis_keyspace_unmatched_keys Estimated keys matching none of the configured prefixes.\n")
+	b.WriteString("# TYPE blueis_keyspace_unmatched_keys gauge\n")
+	fmt.Fprintf(b, "blueis_keyspace_unmatched_keys %d\n", stats.Other.Keys)
+	b.WriteString("# HELP blueis_keyspace_unmatched_bytes Estimated bytes used by keys matching none of the configured prefixes.\n")
+	b.WriteString("# TYPE blueis_keyspace_unmatched_bytes gauge\n")
+	fmt.Fprintf(b, "blueis_keyspace_unmatched_bytes %d\n", stats.Other.Bytes)
+}
+
+// handleRandomKeys samples keys at random: GET /kv/randomkeys?count=100.
+// Keys may repeat, and expired keys are left out of the sample.
+func handleRandomKeys(w http.ResponseWriter, r *http.Request, kv *kvstore.KeyValueService) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(randomKeysResponse{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	count, err := strconv.Atoi(r.URL.Query().Get("count"))
+	if err != nil || count < 1 || count > maxRandomKeys {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(randomKeysResponse{
+			Success: false,
+			Error:   fmt.Sprintf("'count' must be between 1 and %d", maxRandomKeys),
+		})
+		return
+	}
+
+	keys, err := kv.RandomKeysContext(r.Context(), count)
+	if err != nil {
+		writeErrorStatus(w, err, http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(randomKeysResponse{
+			Success: false,
+			Error:   err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+	for i, key := range keys {
+		keys[i] = encodeKey(r, key)
+	}
+	_ = json.NewEncoder(w).Encode(randomKeysResponse{
+		Success: true,
+		Keys:    keys,
+	})
+}
+
+// handleHotKeys reports the node's most frequently accessed keys, hottest
+// first: GET /admin/hotkeys[?count=n]. The node must run with
+// -track-frequency.
+func handleHotKeys(w http.ResponseWriter, r *http.Request, kv *kvstore.KeyValueService) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(hotKeysResponse{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	count := defaultHotKeys
+	if raw := r.URL.Query().Get("count"); raw != "" {
+		var err error
+		count, err = strconv.Atoi(raw)
+		if err != nil || count < 1 || count > maxHotKeys {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(hotKeysResponse{
+				Success: false,
+				Error:   fmt.Sprintf("'count' must be between 1 and %d", maxHotKeys),
+			})
+			return
+		}
+	}
+
+	hottest, err := kv.HottestKeys(count)
+	if err != nil {
+		writeErrorStatus(w, err, http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(hotKeysResponse{
+			Success: false,
+			Error:   err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+	keys := make([]hotKeyResponse, len(hottest))
+	for i, key := range hottest {
+		keys[i] = hotKeyResponse{Key: encodeKey(r, key.Key), Frequency: key.Frequency}
+	}
+	_ = json.NewEncoder(w).Encode(hotKeysResponse{
+		Success: true,
+		Keys:    keys,
+	})
+}
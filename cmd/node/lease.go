@@ -0,0 +1,90 @@
+package main
+
+import (
+	"blueis/internal/kvstore"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Lease IDs come from the same clock-seeded sequence as fencing tokens, so
+// they are sent as strings too.
+type leaseRequest struct {
+	TTLMs int64  `json:"ttlMs,omitempty"`
+	ID    uint64 `json:"id,omitempty,string"`
+}
+
+type leaseResponse struct {
+	Success  bool   `json:"success"`
+	ID       uint64 `json:"id,omitempty,string"`
+	TTLMs    int64  `json:"ttlMs,omitempty"`
+	Attached bool   `json:"attached,omitempty"`
+	Revoked  int    `json:"revoked,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Code     string `json:"code,omitempty"`
+}
+
+// handleLease serves the lease routes:
+//
+//	POST /lease/grant            {"ttlMs":10000}
+//	POST /lease/attach?key=k     {"id":"123"}
+//	POST /lease/keepalive        {"id":"123"}
+//	POST /lease/revoke           {"id":"123"}
+func handleLease(w http.ResponseWriter, r *http.Request, kv *kvstore.KeyValueService, op string) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		writeLeaseError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req leaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeLeaseError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+
+	res := leaseResponse{Success: true}
+	var err error
+	switch op {
+	case "grant":
+		if req.TTLMs <= 0 {
+			writeLeaseError(w, http.StatusBadRequest, "body must set a positive 'ttlMs'")
+			return
+		}
+		res.ID, err = kv.GrantLeaseContext(r.Context(), time.Duration(req.TTLMs)*time.Millisecond)
+		res.TTLMs = req.TTLMs
+	case "attach":
+		var key string
+		key, err = requestKey(r)
+		if err != nil {
+			writeLeaseError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		res.Attached, err = kv.AttachLeaseContext(r.Context(), key, req.ID)
+	case "keepalive":
+		var ttl time.Duration
+		ttl, err = kv.KeepAliveLeaseContext(r.Context(), req.ID)
+		res.TTLMs = ttl.Milliseconds()
+	case "revoke":
+		res.Revoked, err = kv.RevokeLeaseContext(r.Context(), req.ID)
+	}
+	if err != nil {
+		writeErrorStatus(w, err, http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(leaseResponse{
+			Success: false,
+			Error:   err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+func writeLeaseError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(leaseResponse{
+		Success: false,
+		Error:   message,
+	})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"blueis/internal/kvstore"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+type listPushRequest struct {
+	Values []string `json:"values"`
+}
+
+type listResponse struct {
+	Success bool     `json:"success"`
+	Value   *string  `json:"value,omitempty"`
+	Values  []string `json:"values,omitempty"`
+	Length  *int64   `json:"length,omitempty"`
+	Error   string   `json:"error,omitempty"`
+	Code    string   `json:"code,omitempty"`
+}
+
+// handleList serves the routes for lists, which make a simple work queue
+// when pushed to at one end and popped at the other:
+//
+//	POST /list/lpush?key=k  {"values":["a","b"]}
+//	POST /list/rpush?key=k  {"values":["a","b"]}
+//	POST /list/lpop?key=k
+//	POST /list/rpop?key=k
+//	GET  /list/lrange?key=k&start=0&stop=-1
+//	GET  /list/llen?key=k
+//
+// lpush and rpush reply with the list's new length, lpop and rpop with the
+// value they removed, or 404 if the list is empty. lrange's start and stop
+// default to the whole list.
+func handleList(w http.ResponseWriter, r *http.Request, kv *kvstore.KeyValueService, op string) {
+	w.Header().Set("Content-Type", "application/json")
+
+	wantMethod := http.MethodPost
+	if op == "lrange" || op == "llen" {
+		wantMethod = http.MethodGet
+	}
+	if r.Method != wantMethod {
+		writeListError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	key, err := requestKey(r)
+	if err != nil {
+		writeListError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var res listResponse
+	var length int64
+	switch op {
+	case "lpush", "rpush":
+		var req listPushRequest
+		if decodeErr := json.NewDecoder(r.Body).Decode(&req); decodeErr != nil {
+			writeBodyError(w, decodeErr, "invalid JSON body")
+			return
+		}
+		if len(req.Values) == 0 {
+			writeListError(w, http.StatusBadRequest, "missing 'values'")
+			return
+		}
+		if op == "lpush" {
+			length, err = kv.LPushContext(r.Context(), key, req.Values...)
+		} else {
+			length, err = kv.RPushContext(r.Context(), key, req.Values...)
+		}
+		res.Length = &length
+	case "lpop":
+		res.Value, err = kv.LPopContext(r.Context(), key)
+	case "rpop":
+		res.Value, err = kv.RPopContext(r.Context(), key)
+	case "lrange":
+		start, stop, parseErr := listRange(r)
+		if parseErr != nil {
+			writeListError(w, http.StatusBadRequest, parseErr.Error())
+			return
+		}
+		res.Values, err = kv.LRangeContext(r.Context(), key, start, stop)
+	case "llen":
+		length, err = kv.LLenContext(r.Context(), key)
+		res.Length = &length
+	}
+
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, kvstore.ErrKeyNotFound) {
+			status = http.StatusNotFound
+		}
+		writeErrorStatus(w, err, status)
+		_ = json.NewEncoder(w).Encode(listResponse{
+			Success: false,
+			Error:   err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	res.Success = true
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// listRange reads lrange's start and stop query parameters.
+func listRange(r *http.Request) (int64, int64, error) {
+	bounds := [2]int64{0, -1}
+	for i, name := range []string{"start", "stop"} {
+		raw := r.URL.Query().Get(name)
+		if raw == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("'%s' must be an integer", name)
+		}
+		bounds[i] = n
+	}
+	return bounds[0], bounds[1], nil
+}
+
+func writeListError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(listResponse{
+		Success: false,
+		Error:   message,
+	})
+}
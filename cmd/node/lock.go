@@ -0,0 +1,126 @@
+package main
+
+import (
+	"blueis/internal/kvstore"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type lockRequest struct {
+	TTLMs int64 `json:"ttlMs"`
+}
+
+// Fencing tokens are seeded from the clock in nanoseconds, beyond the
+// integers JSON numbers carry exactly, so they are sent as strings.
+type lockResponse struct {
+	Success  bool   `json:"success"`
+	Acquired bool   `json:"acquired"`
+	Token    uint64 `json:"token,omitempty,string"`
+	Error    string `json:"error,omitempty"`
+	Code     string `json:"code,omitempty"`
+}
+
+type unlockRequest struct {
+	Token uint64 `json:"token,string"`
+}
+
+type unlockResponse struct {
+	Success  bool   `json:"success"`
+	Released bool   `json:"released"`
+	Error    string `json:"error,omitempty"`
+	Code     string `json:"code,omitempty"`
+}
+
+// handleLock acquires a lock: POST /lock?key=k {"ttlMs":10000}.
+func handleLock(w http.ResponseWriter, r *http.Request, kv *kvstore.KeyValueService) {
+	w.Header().Set("Content-Type", "application/json")
+
+	key, ok := lockKey(w, r)
+	if !ok {
+		return
+	}
+	var req lockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.TTLMs <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(lockResponse{
+			Success: false,
+			Error:   "body must set a positive 'ttlMs'",
+		})
+		return
+	}
+
+	token, acquired, err := kv.LockContext(r.Context(), key, time.Duration(req.TTLMs)*time.Millisecond)
+	if err != nil {
+		writeErrorStatus(w, err, http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(lockResponse{
+			Success: false,
+			Error:   err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(lockResponse{
+		Success:  true,
+		Acquired: acquired,
+		Token:    token,
+	})
+}
+
+// handleUnlock releases a lock: POST /unlock?key=k {"token":"123"}.
+func handleUnlock(w http.ResponseWriter, r *http.Request, kv *kvstore.KeyValueService) {
+	w.Header().Set("Content-Type", "application/json")
+
+	key, ok := lockKey(w, r)
+	if !ok {
+		return
+	}
+	var req unlockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(unlockResponse{
+			Success: false,
+			Error:   "body must set 'token'",
+		})
+		return
+	}
+
+	released, err := kv.UnlockContext(r.Context(), key, req.Token)
+	if err != nil {
+		writeErrorStatus(w, err, http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(unlockResponse{
+			Success: false,
+			Error:   err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(unlockResponse{
+		Success:  true,
+		Released: released,
+	})
+}
+
+func lockKey(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(unlockResponse{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return "", false
+	}
+
+	key, err := requestKey(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(unlockResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return "", false
+	}
+	return key, true
+}
@@ -1,158 +1,1563 @@
-package main
-
-import (
-	"blueis/cmd/node/internal/kv"
-	"context"
-	"encoding/json"
-	"log"
-	"net/http"
-	"os"
-	"os/signal"
-	"syscall"
-	"time"
-)
-
-type setRequest struct {
-	Value string `json:"value"`
-}
-
-type response struct {
-	Success bool    `json:"success"`
-	Value   *string `json:"value,omitempty"`
-	Error   string  `json:"error,omitempty"`
-}
-
-func main() {
-	// Root context for the KV store
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	kv := kv.GetKeyValueService(ctx, cancel)
-
-	mux := http.NewServeMux()
-	mux.HandleFunc("/kv", func(w http.ResponseWriter, r *http.Request) {
-		handleKV(w, r, kv)
-	})
-
-	server := &http.Server{
-		Addr:    ":8080",
-		Handler: mux,
-	}
-
-	// Start HTTP server
-	go func() {
-		log.Printf("HTTP server listening on %s\n", server.Addr)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("HTTP server error: %v", err)
-		}
-	}()
-
-	// Graceful shutdown on Ctrl+C / SIGTERM
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
-
-	<-stop
-	log.Println("Shutting down server...")
-
-	// Close KV service (cancels its context)
-	kv.Close()
-
-	ctxShutdown, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancelShutdown()
-
-	if err := server.Shutdown(ctxShutdown); err != nil {
-		log.Fatalf("Server forced to shutdown: %v", err)
-	}
-
-	log.Println("Server exited gracefully")
-}
-
-func handleKV(w http.ResponseWriter, r *http.Request, kv *kv.KeyValueService) {
-	w.Header().Set("Content-Type", "application/json")
-
-	key := r.URL.Query().Get("key")
-	if key == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(response{
-			Success: false,
-			Error:   "missing 'key' query parameter",
-		})
-		return
-	}
-
-	switch r.Method {
-	case http.MethodGet:
-		handleGet(w, kv, key)
-	case http.MethodPost, http.MethodPut:
-		handleSet(w, r, kv, key)
-	case http.MethodDelete:
-		handleDelete(w, kv, key)
-	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		_ = json.NewEncoder(w).Encode(response{
-			Success: false,
-			Error:   "method not allowed",
-		})
-	}
-}
-
-func handleGet(w http.ResponseWriter, kv *kv.KeyValueService, key string) {
-	val, err := kv.Get(key)
-	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		_ = json.NewEncoder(w).Encode(response{
-			Success: false,
-			Error:   err.Error(),
-		})
-		return
-	}
-
-	_ = json.NewEncoder(w).Encode(response{
-		Success: true,
-		Value:   val,
-	})
-}
-
-func handleSet(w http.ResponseWriter, r *http.Request, kv *kv.KeyValueService, key string) {
-	var req setRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(response{
-			Success: false,
-			Error:   "invalid JSON body",
-		})
-		return
-	}
-
-	val, err := kv.Set(key, req.Value)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_ = json.NewEncoder(w).Encode(response{
-			Success: false,
-			Error:   err.Error(),
-		})
-		return
-	}
-
-	_ = json.NewEncoder(w).Encode(response{
-		Success: true,
-		Value:   val,
-	})
-}
-
-func handleDelete(w http.ResponseWriter, kv *kv.KeyValueService, key string) {
-	val, err := kv.Delete(key)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_ = json.NewEncoder(w).Encode(response{
-			Success: false,
-			Error:   err.Error(),
-		})
-		return
-	}
-
-	_ = json.NewEncoder(w).Encode(response{
-		Success: true,
-		Value:   val, // may be nil if key didn't exist
-	})
-}
+package main
+
+import (
+	"blueis/internal/acl"
+	"blueis/internal/cdc"
+	"blueis/internal/changelog"
+	"blueis/internal/faults"
+	"blueis/internal/kvstore"
+	"blueis/internal/logging"
+	"blueis/internal/resp"
+	"blueis/internal/tlsconfig"
+	"blueis/internal/twophase"
+	"blueis/internal/workerpool"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+type setRequest struct {
+	Value string `json:"value"`
+	// TTL or TTLMs, in seconds or milliseconds, has the key expire that
+	// long after it is set
+	TTL   *int64 `json:"ttl,omitempty"`
+	TTLMs *int64 `json:"ttlMs,omitempty"`
+	// NX only sets a key that does not exist, and IfEqual only one that
+	// holds this value. Neither can be combined with a TTL
+	NX      bool    `json:"nx,omitempty"`
+	IfEqual *string `json:"ifEqual,omitempty"`
+}
+
+// errConditionNotMet is returned for a conditional set that left the key
+// alone.
+var errConditionNotMet = errors.New("condition not met, key left unchanged")
+
+type expireAtRequest struct {
+	At   *int64 `json:"at,omitempty"`
+	AtMs *int64 `json:"atMs,omitempty"`
+	// Jitter overrides -ttl-jitter for this key
+	Jitter *float64 `json:"jitter,omitempty"`
+}
+
+type expiryResponse struct {
+	Success bool   `json:"success"`
+	Updated bool   `json:"updated"`
+	Error   string `json:"error,omitempty"`
+	Code    string `json:"code,omitempty"`
+}
+
+type ttlResponse struct {
+	Success bool   `json:"success"`
+	TTL     int64  `json:"ttl"`
+	Error   string `json:"error,omitempty"`
+	Code    string `json:"code,omitempty"`
+}
+
+type objectResponse struct {
+	Success      bool   `json:"success"`
+	Encoding     string `json:"encoding,omitempty"`
+	Size         int    `json:"size,omitempty"`
+	LastAccessMs *int64 `json:"lastAccessMs,omitempty"`
+	IdleSeconds  *int64 `json:"idleSeconds,omitempty"`
+	Frequency    *int64 `json:"frequency,omitempty"`
+	Error        string `json:"error,omitempty"`
+	Code         string `json:"code,omitempty"`
+}
+
+type readOnlyRequest struct {
+	ReadOnly bool `json:"readOnly"`
+}
+
+type readOnlyResponse struct {
+	Success  bool   `json:"success"`
+	ReadOnly bool   `json:"readOnly"`
+	Error    string `json:"error,omitempty"`
+}
+
+type maintenanceRequest struct {
+	Enabled   bool `json:"enabled"`
+	MaxQueued *int `json:"maxQueued,omitempty"`
+	MaxWaitMs *int `json:"maxWaitMs,omitempty"`
+}
+
+type maintenanceResponse struct {
+	Success     bool   `json:"success"`
+	Maintenance bool   `json:"maintenance"`
+	Error       string `json:"error,omitempty"`
+}
+
+const (
+	defaultMaintenanceMaxQueued = 1000
+	defaultMaintenanceMaxWait   = 2 * time.Second
+	retryAfterSeconds           = "1"
+	defaultMaxBodyBytes         = 16 << 20
+)
+
+// httpLog and replicationLog are the loggers of the node's HTTP server and
+// replication, routed by -log. Everything else logs through the standard
+// logger, which is routed as the "node" component.
+var (
+	httpLog        = logging.Default("http")
+	replicationLog = logging.Default("replication")
+)
+
+type response struct {
+	Success bool    `json:"success"`
+	Value   *string `json:"value,omitempty"`
+	Error   string  `json:"error,omitempty"`
+	Code    string  `json:"code,omitempty"`
+}
+
+func main() {
+	addr := flag.String("addr", ":8080", "address the node listens on")
+	respAddr := flag.String("resp-addr", "", "address the node serves the Redis protocol on, e.g. :6379 (empty disables)")
+	engineName := flag.String("engine", "memory", "storage engine to use (memory, disk, tiered, sharded)")
+	dataDir := flag.String("data-dir", "data", "directory used by the disk and tiered storage engines")
+	hotKeys := flag.Int("hot-keys", 100000, "number of keys the tiered engine keeps in memory")
+	shards := flag.Int("shards", kvstore.DefaultShardCount, "number of shards used by the sharded engine")
+	maxBatchSize := flag.Int("max-batch-size", kvstore.DefaultMaxBatchSize, "maximum number of queued commands the store processes per batch")
+	queueSize := flag.Int("queue-size", 0, "capacity of the store's input queue")
+	backpressure := flag.String("backpressure", "block", "behaviour when the input queue is full (block, fail-fast)")
+	enqueueTimeout := flag.Duration("enqueue-timeout", 0, "how long -backpressure=block waits for queue space before rejecting (0 waits indefinitely)")
+	concurrentReads := flag.Bool("concurrent-reads", false, "serve reads from request goroutines instead of queueing them behind writes")
+	direct := flag.Bool("direct-execution", false, "execute commands on request goroutines instead of the store goroutine (requires -engine=sharded)")
+	readOnly := flag.Bool("read-only", false, "start the node in read-only mode, rejecting writes until POST /admin/readonly turns it off")
+	workers := flag.Int("workers", 256, "maximum number of requests handled concurrently (0 disables the worker pool)")
+	workerQueue := flag.Int("worker-queue", 1024, "requests allowed to wait for a free worker before new ones are rejected")
+	tlsCert := flag.String("tls-cert", "", "certificate presented to cluster peers")
+	tlsKey := flag.String("tls-key", "", "private key for -tls-cert")
+	tlsCA := flag.String("tls-ca", "", "CA used to verify cluster peer certificates")
+	trackAccess := flag.Bool("track-access", false, "record per-key last access times, reported by /kv/object and OBJECT IDLETIME")
+	trackFrequency := flag.Bool("track-frequency", false, "count per-key accesses, reported by /kv/object, OBJECT FREQ and /admin/hotkeys")
+	frequencyDecay := flag.Duration("frequency-decay", kvstore.DefaultFrequencyDecay, "how often per-key access counts are halved")
+	ttlPolicySpec := flag.String("ttl-policies", "", "semicolon-separated TTL policies for key prefixes, each prefix=settings with comma-separated settings default:<duration> (TTL keys are set with), max:<duration> (longest TTL allowed) or none (keys cannot expire), e.g. cache:=default:1h,max:24h;config:=none")
+	ttlJitter := flag.Float64("ttl-jitter", 0, "push each expiry deadline back by a random amount up to this fraction of its remaining time")
+	expirySweepInterval := flag.Duration("expiry-sweep-interval", 100*time.Millisecond, "how often to sample keys with an expiry and remove the expired ones nothing reads again (0 disables; not with -direct-execution)")
+	expirySampleSize := flag.Int("expiry-sample-size", kvstore.DefaultExpirySampleSize, "keys with an expiry each expiry sweep round samples")
+	expiryBudget := flag.Float64("expiry-budget", kvstore.DefaultExpiryBudget, "fraction of -expiry-sweep-interval an expiry sweep may hold up commands for")
+	historyWindow := flag.Duration("history-window", 0, "keep the values keys held for this long, so GET /kv?asOf= can read them (0 disables)")
+	historyVersions := flag.Int("history-versions", kvstore.DefaultHistoryVersions, "most values kept for each key within -history-window")
+	tombstoneGrace := flag.Duration("tombstone-grace", time.Hour, "how long deleted keys are remembered, so replicas syncing from scratch delete them too (0 disables)")
+	keyspaceInterval := flag.Duration("keyspace-interval", time.Minute, "how often to sample the keyspace for /stats and /metrics (0 disables)")
+	keyspacePrefixes := flag.String("keyspace-prefixes", "", "comma-separated key prefixes to break keyspace stats down by")
+	keyspaceSamples := flag.Int("keyspace-samples", 1000, "keys sampled per keyspace analysis")
+	replicaOf := flag.String("replica-of", "", "base URL of a primary node to replicate, e.g. http://primary:8080 (makes this node a read-only replica)")
+	replicationBuffer := flag.Int("replication-buffer", 100000, "mutations held for each replica that is behind before it is disconnected and has to sync again")
+	replicationCompress := flag.Bool("replication-compress", false, "ask the primary to compress the replication stream, for primaries across a WAN")
+	replicationLinger := flag.Duration("replication-linger", 0, "ask the primary to hold changes back up to this long so they are sent in larger batches")
+	replicationCheckpoint := flag.String("replication-checkpoint", "", "file recording how far this replica has got, so it can resume after a restart (requires -engine=disk)")
+	replicationSyncRate := flag.Int64("replication-sync-rate", 0, "bytes per second at which the snapshot is sent to each replica that syncs from scratch (0 is unlimited)")
+	replicationBacklog := flag.Int("replication-backlog", 1<<20, "bytes of recent changes kept so a replica that reconnects can resume instead of syncing again (0 disables)")
+	crdtNamespaces := flag.String("crdt-namespaces", "", "comma-separated key prefixes holding conflict-free counters and sets, served under /crdt")
+	crdtActor := flag.String("crdt-actor", "", "name this node gives its updates to CRDT counters and sets, unique among its peers and stable across restarts (default a new name each start)")
+	peerOf := flag.String("peer-of", "", "comma-separated base URLs of nodes whose CRDT namespaces this node merges, for multi-master counters and sets")
+	epochLease := flag.Duration("epoch-lease", 0, "refuse writes when no coordinator has announced the topology epoch for this long; set it below the coordinator's failover time so a primary cut off from it stops taking writes before a replica replaces it (0 disables)")
+	changeLogDir := flag.String("change-log-dir", "", "directory to archive every change in, so the node can be restored to any time since a backup (empty disables)")
+	changeLogRetention := flag.Duration("change-log-retention", 24*time.Hour, "how long archived changes are kept")
+	changeLogSegment := flag.Int64("change-log-segment-bytes", 64<<20, "size at which the change log starts a new segment file")
+	cdcSink := flag.String("cdc-sink", "", "where to publish every change with its old and new values: http(s)://host/path posts JSON batches, kafka+http(s)://proxy/topic produces to Kafka through its REST proxy, nats://host:port/subject publishes to NATS (empty disables)")
+	cdcNode := flag.String("cdc-node", "", "name this node gives the changes it publishes (default -addr)")
+	cdcBuffer := flag.Int("cdc-buffer", cdc.DefaultBuffer, "changes that may wait to be published before the publisher resumes from the replication backlog, or publishes every key again")
+	txnLogDir := flag.String("txn-log-dir", "", "directory for the log of prepared transactions (default <data-dir>/txn)")
+	aclFile := flag.String("acl-file", "", "file of users allowed to call the node, each with its API keys, key patterns, command categories and rate limits and quotas, read at startup and on reload; requests must then send Authorization: Bearer <key> (see internal/acl)")
+	authMethods := flag.String("auth-methods", "bearer", "comma-separated ways requests may authenticate with -acl-file: bearer, for API keys sent as bearer tokens, hmac, for requests signed with HMAC keys, and token, for short-lived access tokens sent as bearer tokens")
+	tokenSecretFile := flag.String("token-secret-file", "", "file holding the secret, shared by every node, that access tokens minted by POST /auth/token are signed with")
+	tokenIssuer := flag.String("token-issuer", "", "iss of access tokens from an external issuer to accept, signed with -token-issuer-key")
+	tokenIssuerKey := flag.String("token-issuer-key", "", "PEM public key or certificate of -token-issuer, RSA for RS256, P-256 for ES256 or Ed25519 for EdDSA")
+	tokenTTL := flag.Duration("token-ttl", 15*time.Minute, "how long access tokens minted by /auth/token are valid")
+	refreshTTL := flag.Duration("token-refresh-ttl", 24*time.Hour, "how long refresh tokens minted by /auth/token are valid")
+	hmacMaxSkew := flag.Duration("hmac-max-skew", 5*time.Minute, "how far from the node's clock a signed request's timestamp may be; each signature is accepted once within this window")
+	authKeyFile := flag.String("auth-key-file", "", "file holding the API key, or hmac <id> <secret> to sign requests with, this node sends to the primary it replicates, the peers it merges from and the nodes it imports ranges from, when they use -acl-file")
+	tlsPeers := flag.String("tls-allowed-peers", "", "comma-separated SAN identities allowed to connect (empty allows any peer signed by -tls-ca)")
+	maxKeyLength := flag.Int("max-key-length", 0, "longest key accepted by writes, in bytes (0 is unlimited)")
+	maxValueSize := flag.Int("max-value-size", 0, "largest value accepted by writes, in bytes (0 is unlimited)")
+	keyPolicy := flag.String("key-policy", "any", "characters keys may be written with: any, or printable for printable ASCII without spaces")
+	configPath := flag.String("config", "", "file of name = value settings, named after these flags, read at startup and on SIGHUP or POST /admin/reload; flags on the command line take precedence")
+	maxBodyBytes := flag.Int64("max-body-bytes", defaultMaxBodyBytes, "largest request body accepted by writes to /kv, /kv/mset and /kv/batch, in bytes (0 is unlimited)")
+	requestTimeout := flag.Duration("request-timeout", 0, "how long requests to the store-backed routes (/kv/*, /list/*, /cms/*, /crdt/*, /lock, /unlock, /txn/*, /lease/* and /graphql) may wait for the store before failing with 504 DEADLINE_EXCEEDED; a client can ask for less with an X-Request-Timeout header (0 only applies the header)")
+	shutdownTimeout := flag.Duration("shutdown-timeout", defaultShutdownTimeout, "how long shutdown waits for requests in flight")
+	featureSpec := flag.String("feature-gates", "", "comma-separated name=true|false settings switching optional features on or off, e.g. cms=false,resp=false; /admin/features lists them")
+	warmupFile := flag.String("warmup-file", "", "file listing keys, one per line, to read into memory at startup before /readyz reports the node ready")
+	logRoutes := flag.String("log", "", "comma-separated component=level[@sink] log routes, e.g. store=debug@file:/var/log/blueis/store.log,replication=warn@syslog,*=info; components are node, http, store and replication, levels debug, info, warn, error and off, sinks stderr (the default), stdout, file:<path> and syslog[:<tag>]")
+	logMaxSize := flag.Int64("log-max-size", 100<<20, "bytes a log file may grow to before it is rotated (0 disables rotation)")
+	logBackups := flag.Int("log-backups", 5, "rotated files kept for each log file")
+	flag.Parse()
+
+	fixedFlags := commandLineFlags()
+	if *configPath != "" {
+		if err := applyConfigFile(*configPath, fixedFlags); err != nil {
+			log.Fatalf("Invalid -config: %v", err)
+		}
+	}
+
+	logs, err := logging.NewRouter(*logRoutes, logging.Rotation{MaxBytes: *logMaxSize, Backups: *logBackups})
+	if err != nil {
+		log.Fatalf("Invalid -log: %v", err)
+	}
+	defer logs.Close()
+	logs.Logger("node").SetStandard()
+	httpLog = logs.Logger("http")
+	replicationLog = logs.Logger("replication")
+
+	gates, err := parseFeatureGates(*featureSpec)
+	if err != nil {
+		log.Fatalf("Invalid -feature-gates: %v", err)
+	}
+
+	engine, err := newStorageEngine(*engineName, *dataDir, *hotKeys, *shards)
+	if err != nil {
+		log.Fatalf("Failed to initialise storage engine: %v", err)
+	}
+
+	// A checkpoint is only true of data that survives a restart
+	if *replicationCheckpoint != "" && *engineName != "disk" {
+		log.Fatalf("-replication-checkpoint requires -engine=disk")
+	}
+
+	execution := kvstore.ActorExecution
+	if *direct {
+		if *engineName != "sharded" {
+			log.Fatalf("-direct-execution requires -engine=sharded")
+		}
+		execution = kvstore.DirectExecution
+	}
+
+	var backpressurePolicy kvstore.BackpressurePolicy
+	switch *backpressure {
+	case "block":
+		backpressurePolicy = kvstore.BackpressureBlock
+	case "fail-fast":
+		backpressurePolicy = kvstore.BackpressureFailFast
+	default:
+		log.Fatalf("Unknown backpressure policy %q", *backpressure)
+	}
+
+	keys, err := parseKeyPolicy(*keyPolicy)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	ttlPolicies, err := parseTTLPolicies(*ttlPolicySpec)
+	if err != nil {
+		log.Fatalf("Invalid -ttl-policies: %v", err)
+	}
+
+	var namespaces []string
+	if *crdtNamespaces != "" {
+		namespaces = strings.Split(*crdtNamespaces, ",")
+	}
+	if *peerOf != "" && len(namespaces) == 0 {
+		log.Fatalf("-peer-of requires -crdt-namespaces")
+	}
+	if *peerOf != "" && !gates.enabled("crdt") {
+		log.Fatalf("-peer-of requires the crdt feature")
+	}
+	if *respAddr != "" && !gates.enabled("resp") {
+		log.Fatalf("-resp-addr requires the resp feature")
+	}
+	// RESP connections cannot AUTH yet, so they would get round the ACL
+	if *respAddr != "" && *aclFile != "" {
+		log.Fatalf("-resp-addr cannot be used with -acl-file")
+	}
+	var users *atomic.Pointer[acl.ACL]
+	var meter *acl.Meter
+	if *aclFile != "" {
+		loaded, err := acl.Load(*aclFile)
+		if err != nil {
+			log.Fatalf("Invalid -acl-file: %v", err)
+		}
+		users = &atomic.Pointer[acl.ACL]{}
+		users.Store(loaded)
+		meter = acl.NewMeter()
+	}
+	var tokens *acl.Tokens
+	if *tokenSecretFile != "" || *tokenIssuerKey != "" {
+		if users == nil {
+			log.Fatalf("-token-secret-file and -token-issuer-key require -acl-file")
+		}
+		var secret []byte
+		if *tokenSecretFile != "" {
+			if secret, err = os.ReadFile(*tokenSecretFile); err != nil {
+				log.Fatalf("Invalid -token-secret-file: %v", err)
+			}
+			// A secret shorter than the HMAC's output weakens it
+			if secret = bytes.TrimSpace(secret); len(secret) < 32 {
+				log.Fatalf("-token-secret-file must hold at least 32 bytes")
+			}
+		}
+		tokens = acl.NewTokens(secret, *tokenTTL, *refreshTTL)
+		if *tokenIssuerKey != "" {
+			key, err := acl.LoadPublicKey(*tokenIssuerKey)
+			if err != nil {
+				log.Fatalf("Invalid -token-issuer-key: %v", err)
+			}
+			if err := tokens.Trust(*tokenIssuer, key); err != nil {
+				log.Fatalf("Invalid -token-issuer: %v", err)
+			}
+		}
+	}
+	var credentials *acl.Credentials
+	if *authKeyFile != "" {
+		read, err := acl.ReadCredentials(*authKeyFile)
+		if err != nil {
+			log.Fatalf("Invalid -auth-key-file: %v", err)
+		}
+		credentials = &read
+	}
+
+	expirySweep := func() kvstore.ExpirySweep {
+		return kvstore.ExpirySweep{Interval: *expirySweepInterval, SampleSize: *expirySampleSize, Budget: *expiryBudget}
+	}
+	history := func() kvstore.History {
+		return kvstore.History{Window: *historyWindow, MaxVersions: *historyVersions}
+	}
+
+	// Root context for the KV store
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	kv := kvstore.NewKeyValueService(ctx,
+		kvstore.WithEngine(engine),
+		kvstore.WithExecution(execution),
+		kvstore.WithMaxBatchSize(*maxBatchSize),
+		kvstore.WithBufferSize(*queueSize),
+		kvstore.WithBackpressure(backpressurePolicy, *enqueueTimeout),
+		kvstore.WithConcurrentReads(*concurrentReads),
+		kvstore.WithAccessTracking(*trackAccess),
+		kvstore.WithFrequencyTracking(*trackFrequency, *frequencyDecay),
+		kvstore.WithTTLPolicies(ttlPolicies...),
+		kvstore.WithTTLJitter(*ttlJitter),
+		kvstore.WithExpirySweep(expirySweep()),
+		kvstore.WithHistory(history()),
+		kvstore.WithTombstoneGrace(*tombstoneGrace),
+		kvstore.WithReplicationBacklog(*replicationBacklog),
+		kvstore.WithCRDT(namespaces, *crdtActor),
+		kvstore.WithMaxKeyLength(*maxKeyLength),
+		kvstore.WithMaxValueSize(*maxValueSize),
+		kvstore.WithKeyPolicy(keys),
+		// The store only logs failures and its shutdown
+		kvstore.WithLogger(logs.Logger("store").StdLogger(logging.Warn)),
+	)
+	kv.SetReadOnly(*readOnly)
+	role := &replicationRole{kv: kv, ctx: ctx}
+	moves := &migrations{role: role}
+	kv.AddBeforeCommandHook(moves.check)
+	epochs := &topology{lease: *epochLease}
+	kv.AddBeforeCommandHook(epochs.check)
+
+	// Fault injection reaches into the node's syncs, writes, requests and
+	// replication, so none of it is wired in unless the feature is on
+	var injector *faults.Injector
+	if gates.enabled("faults") {
+		injector = newFaultInjector()
+		kv.AddAfterCommandHook(func(command kvstore.Command, result kvstore.Result) {
+			if result.Success && kvstore.IsMutation(command.Type) {
+				injector.Wrote()
+			}
+		})
+	}
+
+	// Changes are archived from before the node serves any, so the log
+	// covers every one made after a backup
+	var changes *changelog.Log
+	var archiver *changeArchiver
+	if *changeLogDir != "" {
+		changes, err = changelog.Open(*changeLogDir, *changeLogSegment, *changeLogRetention)
+		if err != nil {
+			log.Fatalf("Failed to open change log: %v", err)
+		}
+		if injector != nil {
+			changes.OnSync(injector.Sync)
+		}
+		archiver = newChangeArchiver(kv, changes)
+		archiver.start()
+	}
+	var publisher *cdc.Publisher
+	if *cdcSink != "" {
+		sink, err := cdc.ParseSink(*cdcSink, &http.Client{Timeout: 30 * time.Second})
+		if err != nil {
+			log.Fatalf("Invalid -cdc-sink: %v", err)
+		}
+		if *cdcNode == "" {
+			*cdcNode = *addr
+		}
+		publisher = cdc.NewPublisher(kv, sink, cdc.Options{
+			Node:   *cdcNode,
+			Buffer: *cdcBuffer,
+			Logger: logs.Logger("cdc").StdLogger(logging.Warn),
+		})
+		if err := publisher.Start(); err != nil {
+			log.Fatalf("Failed to start change data capture: %v", err)
+		}
+	}
+
+	if *txnLogDir == "" {
+		*txnLogDir = filepath.Join(*dataDir, "txn")
+	}
+	txnLog, err := twophase.OpenLog(*txnLogDir)
+	if err != nil {
+		log.Fatalf("Failed to open transaction log: %v", err)
+	}
+	if injector != nil {
+		txnLog.OnSync(injector.Sync)
+	}
+	txns := &participant{kv, txnLog, moves}
+	if recovered, err := txns.recoverPrepared(); err != nil {
+		log.Fatalf("Failed to recover prepared transactions: %v", err)
+	} else if recovered > 0 {
+		log.Printf("Recovered %d prepared transactions awaiting a decision", recovered)
+	}
+
+	// Only data requests go through the pool so stats and admin routes stay
+	// reachable while the node is overloaded
+	var pool *workerpool.Pool
+	if *workers > 0 {
+		pool = workerpool.New(*workers, *workerQueue)
+	}
+
+	var keyspace *keyspaceAnalyzer
+	if *keyspaceInterval > 0 {
+		keyspace = &keyspaceAnalyzer{kv: kv, samples: *keyspaceSamples}
+		if *keyspacePrefixes != "" {
+			keyspace.prefixes = strings.Split(*keyspacePrefixes, ",")
+		}
+		go keyspace.run(*keyspaceInterval)
+	}
+
+	var maxBody atomic.Int64
+	maxBody.Store(*maxBodyBytes)
+	var requestDeadline atomic.Int64
+	requestDeadline.Store(int64(*requestTimeout))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/kv", withDeadline(&requestDeadline, withWorkerPool(pool, withMaxBody(&maxBody, func(w http.ResponseWriter, r *http.Request) {
+		handleKV(w, r, kv)
+	}))))
+	mux.HandleFunc("/kv/expireat", withDeadline(&requestDeadline, withWorkerPool(pool, func(w http.ResponseWriter, r *http.Request) {
+		handleExpireAt(w, r, kv)
+	})))
+	mux.HandleFunc("/kv/persist", withDeadline(&requestDeadline, withWorkerPool(pool, func(w http.ResponseWriter, r *http.Request) {
+		handlePersist(w, r, kv)
+	})))
+	mux.HandleFunc("/kv/ttl", withDeadline(&requestDeadline, withWorkerPool(pool, func(w http.ResponseWriter, r *http.Request) {
+		handleTTL(w, r, kv, time.Second)
+	})))
+	mux.HandleFunc("/kv/pttl", withDeadline(&requestDeadline, withWorkerPool(pool, func(w http.ResponseWriter, r *http.Request) {
+		handleTTL(w, r, kv, time.Millisecond)
+	})))
+	mux.HandleFunc("/kv/object", withDeadline(&requestDeadline, withWorkerPool(pool, func(w http.ResponseWriter, r *http.Request) {
+		handleObject(w, r, kv)
+	})))
+	mux.HandleFunc("/kv/randomkeys", withDeadline(&requestDeadline, withWorkerPool(pool, func(w http.ResponseWriter, r *http.Request) {
+		handleRandomKeys(w, r, kv)
+	})))
+	for _, op := range []string{"mget", "mset"} {
+		mux.HandleFunc("/kv/"+op, withDeadline(&requestDeadline, withWorkerPool(pool, withMaxBody(&maxBody, func(w http.ResponseWriter, r *http.Request) {
+			handleMultiKey(w, r, kv, op)
+		}))))
+	}
+	mux.HandleFunc("/kv/batch", withDeadline(&requestDeadline, withWorkerPool(pool, withMaxBody(&maxBody, func(w http.ResponseWriter, r *http.Request) {
+		handleBatch(w, r, kv)
+	}))))
+	mux.HandleFunc("/graphql", withDeadline(&requestDeadline, withWorkerPool(pool, gates.gate("graphql", withMaxBody(&maxBody, func(w http.ResponseWriter, r *http.Request) {
+		handleGraphQL(w, r, kv)
+	})))))
+	mux.HandleFunc("/graphql/schema", gates.gate("graphql", handleGraphQLSchema))
+	for _, op := range []string{"init", "incrby", "query", "merge"} {
+		mux.HandleFunc("/cms/"+op, withDeadline(&requestDeadline, withWorkerPool(pool, gates.gate("cms", func(w http.ResponseWriter, r *http.Request) {
+			handleCountMin(w, r, kv, op)
+		}))))
+	}
+	for _, op := range []string{"counter/incrby", "counter/get", "set/add", "set/remove", "set/members"} {
+		mux.HandleFunc("/crdt/"+op, withDeadline(&requestDeadline, withWorkerPool(pool, gates.gate("crdt", func(w http.ResponseWriter, r *http.Request) {
+			handleCRDT(w, r, kv, op)
+		}))))
+	}
+	for _, op := range []string{"lpush", "rpush", "lpop", "rpop", "lrange", "llen"} {
+		mux.HandleFunc("/list/"+op, withDeadline(&requestDeadline, withWorkerPool(pool, withMaxBody(&maxBody, func(w http.ResponseWriter, r *http.Request) {
+			handleList(w, r, kv, op)
+		}))))
+	}
+	mux.HandleFunc("/lock", withDeadline(&requestDeadline, withWorkerPool(pool, gates.gate("locks", func(w http.ResponseWriter, r *http.Request) {
+		handleLock(w, r, kv)
+	}))))
+	mux.HandleFunc("/unlock", withDeadline(&requestDeadline, withWorkerPool(pool, gates.gate("locks", func(w http.ResponseWriter, r *http.Request) {
+		handleUnlock(w, r, kv)
+	}))))
+	for _, op := range []string{"prepare", "commit", "abort"} {
+		mux.HandleFunc("/txn/"+op, withDeadline(&requestDeadline, withWorkerPool(pool, gates.gate("transactions", func(w http.ResponseWriter, r *http.Request) {
+			handleTransaction(w, r, txns, op)
+		}))))
+	}
+	for _, op := range []string{"grant", "attach", "keepalive", "revoke"} {
+		mux.HandleFunc("/lease/"+op, withDeadline(&requestDeadline, withWorkerPool(pool, gates.gate("leases", func(w http.ResponseWriter, r *http.Request) {
+			handleLease(w, r, kv, op)
+		}))))
+	}
+	// Replication streams last as long as the replica is connected, so they
+	// must not hold a worker, and are ended explicitly on shutdown
+	replicationCtx, stopReplication := context.WithCancel(context.Background())
+	mux.HandleFunc("/replication/sync", func(w http.ResponseWriter, r *http.Request) {
+		handleReplicationSync(w, r, role, *replicationBuffer, *replicationSyncRate, replicationCtx)
+	})
+	mux.HandleFunc("/replication/ack", func(w http.ResponseWriter, r *http.Request) {
+		handleReplicationAck(w, r, role)
+	})
+	// Waits block for up to their timeout, so they do not hold a worker
+	// either
+	mux.HandleFunc("/replication/wait", func(w http.ResponseWriter, r *http.Request) {
+		handleReplicationWait(w, r, role)
+	})
+	for _, op := range []string{"info", "promote", "replicaof"} {
+		mux.HandleFunc("/replication/"+op, func(w http.ResponseWriter, r *http.Request) {
+			handleReplication(w, r, role, op)
+		})
+	}
+	for _, op := range []string{"status", "digest", "import", "endimport", "fence", "unfence", "release"} {
+		mux.HandleFunc("/migration/"+op, func(w http.ResponseWriter, r *http.Request) {
+			handleMigration(w, r, moves, txns, op)
+		})
+	}
+	mux.HandleFunc("/topology", func(w http.ResponseWriter, r *http.Request) {
+		handleTopology(w, r, epochs, keyspace)
+	})
+	// Notification streams are long-lived like replication streams
+	notificationCtx, stopNotifications := context.WithCancel(context.Background())
+	mux.HandleFunc("/notifications", gates.gate("notifications", func(w http.ResponseWriter, r *http.Request) {
+		handleNotifications(w, r, kv, notificationCtx)
+	}))
+	// Backups and restores take as long as the node's data takes to send,
+	// so they do not hold a worker
+	mux.HandleFunc("/backup", func(w http.ResponseWriter, r *http.Request) {
+		handleBackup(w, r, kv)
+	})
+	mux.HandleFunc("/backup/restore", func(w http.ResponseWriter, r *http.Request) {
+		handleRestore(w, r, kv, role)
+	})
+	mux.HandleFunc("/backup/replay", func(w http.ResponseWriter, r *http.Request) {
+		handleReplay(w, r, kv, role, changes)
+	})
+	// Health and readiness checks must be answered even when every worker is
+	// busy
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		handleHealth(w, r, kv)
+	})
+	warm := newWarmup()
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		handleReady(w, r, kv, warm, role)
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		handleStats(w, r, kv, pool, keyspace, role, publisher)
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		handleMetrics(w, r, kv, pool, keyspace, role, publisher)
+	})
+	// The report walks every key's count, so it does not hold a worker
+	mux.HandleFunc("/admin/hotkeys", func(w http.ResponseWriter, r *http.Request) {
+		handleHotKeys(w, r, kv)
+	})
+	mux.HandleFunc("/admin/features", func(w http.ResponseWriter, r *http.Request) {
+		handleFeatures(w, r, gates)
+	})
+	mux.HandleFunc("/admin/faults", gates.gate("faults", func(w http.ResponseWriter, r *http.Request) {
+		handleFaults(w, r, injector)
+	}))
+	mux.HandleFunc("/admin/readonly", func(w http.ResponseWriter, r *http.Request) {
+		handleReadOnly(w, r, kv)
+	})
+	mux.HandleFunc("/admin/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		handleMaintenance(w, r, kv)
+	})
+	// Flushing takes as long as the node's keys take to delete, so it does
+	// not hold a worker
+	mux.HandleFunc("/admin/flush", func(w http.ResponseWriter, r *http.Request) {
+		handleFlush(w, r, kv, role)
+	})
+
+	tlsConfig := tlsconfig.Config{CertFile: *tlsCert, KeyFile: *tlsKey, CAFile: *tlsCA}
+	if *tlsPeers != "" {
+		tlsConfig.AllowedPeers = strings.Split(*tlsPeers, ",")
+	}
+	// The served certificates and allowed peers can be reloaded, so the
+	// server takes its TLS configuration from a reloader
+	var serverTLS *tls.Config
+	var tlsReloader *tlsconfig.ServerReloader
+	if tlsConfig.Enabled() {
+		tlsReloader, err = tlsconfig.NewServerReloader(tlsConfig)
+		if err != nil {
+			log.Fatalf("Failed to load TLS configuration: %v", err)
+		}
+		serverTLS = tlsReloader.ServerConfig()
+	}
+
+	reloader := &configReloader{
+		path:  *configPath,
+		fixed: fixedFlags,
+		appliers: []configApplier{
+			{settings: []string{"log", "log-max-size", "log-backups"}, apply: func() error {
+				return logs.Reload(*logRoutes, logging.Rotation{MaxBytes: *logMaxSize, Backups: *logBackups})
+			}},
+			{settings: []string{"max-key-length", "max-value-size", "key-policy"}, apply: func() error {
+				policy, err := parseKeyPolicy(*keyPolicy)
+				if err != nil {
+					return err
+				}
+				kv.SetKeyLimits(*maxKeyLength, *maxValueSize, policy)
+				return nil
+			}},
+			{settings: []string{"ttl-policies"}, apply: func() error {
+				policies, err := parseTTLPolicies(*ttlPolicySpec)
+				if err != nil {
+					return err
+				}
+				return kv.SetTTLPolicies(policies)
+			}},
+			{settings: []string{"max-body-bytes"}, apply: func() error {
+				maxBody.Store(*maxBodyBytes)
+				return nil
+			}},
+			{settings: []string{"request-timeout"}, apply: func() error {
+				requestDeadline.Store(int64(*requestTimeout))
+				return nil
+			}},
+			{settings: []string{"expiry-sweep-interval", "expiry-sample-size", "expiry-budget"}, apply: func() error {
+				kv.SetExpirySweep(expirySweep())
+				return nil
+			}},
+			{settings: []string{"history-window", "history-versions"}, apply: func() error {
+				kv.SetHistory(history())
+				return nil
+			}},
+			{settings: []string{"tombstone-grace"}, apply: func() error {
+				kv.SetTombstoneGrace(*tombstoneGrace)
+				return nil
+			}},
+		},
+	}
+	// Certificates are read again on every reload, so ones renewed in place
+	// are served without a restart
+	tlsSettings := []string{"tls-cert", "tls-key", "tls-ca", "tls-allowed-peers"}
+	if tlsReloader != nil {
+		reloader.appliers = append(reloader.appliers, configApplier{settings: tlsSettings, files: true, apply: func() error {
+			config := tlsconfig.Config{CertFile: *tlsCert, KeyFile: *tlsKey, CAFile: *tlsCA}
+			if *tlsPeers != "" {
+				config.AllowedPeers = strings.Split(*tlsPeers, ",")
+			}
+			return tlsReloader.Reload(config)
+		}})
+	} else {
+		reloader.appliers = append(reloader.appliers, configApplier{settings: tlsSettings, apply: func() error {
+			return errors.New("TLS was not enabled at startup")
+		}})
+	}
+	// Users are read again on every reload too, so keys can be rotated
+	// without a restart
+	if users != nil {
+		reloader.appliers = append(reloader.appliers, configApplier{settings: []string{"acl-file"}, files: true, apply: func() error {
+			loaded, err := acl.Load(*aclFile)
+			if err != nil {
+				return err
+			}
+			users.Store(loaded)
+			return nil
+		}})
+	} else {
+		reloader.appliers = append(reloader.appliers, configApplier{settings: []string{"acl-file"}, apply: func() error {
+			return errors.New("ACLs were not enabled at startup")
+		}})
+	}
+	mux.HandleFunc("/admin/reload", func(w http.ResponseWriter, r *http.Request) {
+		handleReload(w, r, reloader)
+	})
+	mux.HandleFunc("/admin/usage", func(w http.ResponseWriter, r *http.Request) {
+		handleUsage(w, r, meter)
+	})
+	// Requests are authenticated before anything else, so a client without
+	// a key learns nothing about the node, its epoch included
+	handler := withEpoch(epochs, mux)
+	var auth *authenticator
+	if users != nil {
+		auth, err = parseAuthMethods(*authMethods, users, *hmacMaxSkew, &maxBody, tokens)
+		if err != nil {
+			log.Fatalf("Invalid -auth-methods: %v", err)
+		}
+		handler = withACL(auth, meter, handler)
+	}
+	// Requests are dropped and delayed before the node looks at them, as
+	// the network would, though never those setting the faults
+	if injector != nil {
+		handler = injector.Handler(handler, "/admin/faults")
+	}
+	mux.HandleFunc("/auth/token", func(w http.ResponseWriter, r *http.Request) {
+		handleToken(w, r, auth, meter)
+	})
+	server := newNodeServer(*addr, handler,
+		withTLS(serverTLS),
+		withShutdownTimeout(*shutdownTimeout),
+		withOnShutdown(stopReplication),
+		withOnShutdown(stopNotifications),
+	)
+
+	replicationClient := &http.Client{}
+	if tlsConfig.Enabled() {
+		clientTLS, err := tlsconfig.ClientConfig(tlsConfig)
+		if err != nil {
+			log.Fatalf("Failed to load TLS configuration: %v", err)
+		}
+		replicationClient.Transport = &http.Transport{TLSClientConfig: clientTLS}
+	}
+	if credentials != nil {
+		replicationClient.Transport = acl.NewTransport(*credentials, replicationClient.Transport)
+	}
+	if injector != nil {
+		replicationClient.Transport = injector.Transport(replicationClient.Transport)
+	}
+	role.client = replicationClient
+	role.options = replicationOptions{
+		compress:   *replicationCompress,
+		linger:     *replicationLinger,
+		checkpoint: *replicationCheckpoint,
+	}
+	if *replicaOf != "" {
+		role.follow(strings.TrimRight(*replicaOf, "/"))
+	}
+	if *peerOf != "" {
+		for _, peer := range strings.Split(*peerOf, ",") {
+			role.peer(strings.TrimRight(peer, "/"))
+		}
+	}
+
+	server.start()
+	go warm.run(kv, *warmupFile)
+
+	var respServer *resp.Server
+	if *respAddr != "" {
+		respServer = resp.NewServer(respHandler(kv))
+		go func() {
+			log.Printf("RESP server listening on %s\n", *respAddr)
+			if err := respServer.ListenAndServe(*respAddr); err != nil && err != resp.ErrServerClosed {
+				log.Fatalf("RESP server error: %v", err)
+			}
+		}()
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			res, err := reloader.reload()
+			logReload(res)
+			if err != nil {
+				log.Printf("Failed to reload config: %v", err)
+			}
+		}
+	}()
+
+	// Graceful shutdown on Ctrl+C / SIGTERM
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	<-stop
+	log.Println("Shutting down server...")
+	warm.stop()
+
+	if respServer != nil {
+		_ = respServer.Close()
+	}
+
+	// Stop replicating before the store goes away under the replica
+	role.close()
+
+	if err := server.shutdown(); err != nil {
+		httpLog.Warnf("Server forced to shutdown: %v", err)
+	}
+
+	// Close KV service once requests in flight are done, finishing queued
+	// commands and closing the storage engine
+	kv.Close()
+	if archiver != nil {
+		archiver.close()
+	}
+	if publisher != nil {
+		closeCtx, closeCancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		if err := publisher.Close(closeCtx); err != nil {
+			log.Printf("Failed to publish every change: %v", err)
+		}
+		closeCancel()
+	}
+	if pool != nil {
+		pool.Close()
+	}
+
+	log.Println("Server exited gracefully")
+}
+
+func parseKeyPolicy(name string) (kvstore.KeyPolicy, error) {
+	switch name {
+	case "any":
+		return nil, nil
+	case "printable":
+		return kvstore.PrintableKeys, nil
+	}
+	return nil, fmt.Errorf("unknown key policy %q", name)
+}
+
+// parseTTLPolicies parses -ttl-policies: policies separated by semicolons,
+// each a key prefix, =, and its settings separated by commas. The prefix
+// ends at the last =, so it may hold any other character.
+func parseTTLPolicies(spec string) ([]kvstore.TTLPolicy, error) {
+	var policies []kvstore.TTLPolicy
+	for _, entry := range strings.Split(spec, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("policy %q is not prefix=settings", entry)
+		}
+		policy := kvstore.TTLPolicy{Prefix: strings.TrimSpace(entry[:i])}
+		for _, setting := range strings.Split(entry[i+1:], ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(setting), ":")
+			var err error
+			switch name {
+			case "default":
+				policy.Default, err = time.ParseDuration(value)
+			case "max":
+				policy.Max, err = time.ParseDuration(value)
+			case "none":
+				policy.NoExpiry = true
+			default:
+				err = fmt.Errorf("unknown setting %q, want default:<duration>, max:<duration> or none", setting)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("policy %q: %w", entry, err)
+			}
+		}
+		policies = append(policies, policy)
+	}
+	return policies, kvstore.ValidateTTLPolicies(policies)
+}
+
+func newStorageEngine(name string, dataDir string, hotKeys int, shards int) (kvstore.StorageEngine, error) {
+	switch name {
+	case "memory":
+		return kvstore.NewMemoryEngine(), nil
+	case "disk":
+		return kvstore.NewDiskEngine(dataDir)
+	case "tiered":
+		cold, err := kvstore.NewDiskEngine(dataDir)
+		if err != nil {
+			return nil, err
+		}
+		return kvstore.NewTieredEngine(hotKeys, cold), nil
+	case "sharded":
+		return kvstore.NewShardedEngine(shards), nil
+	}
+	return nil, fmt.Errorf("unknown storage engine %q", name)
+}
+
+// withWorkerPool runs handler on one of the pool's workers, rejecting the
+// request with 503 straight away when none is free. A nil pool leaves the
+// handler unchanged.
+func withWorkerPool(pool *workerpool.Pool, handler http.HandlerFunc) http.HandlerFunc {
+	if pool == nil {
+		return handler
+	}
+	// Recover on the worker, so a panic is logged with its own stack rather
+	// than the pool's
+	recovering := withRecovery(handler)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := pool.Do(func() { recovering.ServeHTTP(w, r) }); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			writeErrorStatus(w, err, http.StatusServiceUnavailable)
+			_ = json.NewEncoder(w).Encode(response{
+				Success: false,
+				Error:   err.Error(),
+				Code:    errorCode(err),
+			})
+		}
+	}
+}
+
+// withDeadline gives a request's context a deadline, so the store skips
+// its commands rather than run them for a client that has stopped waiting.
+// The timeout is the shorter of the configured one, read for each request
+// so a reload can change it, and the duration the client sends in
+// X-Request-Timeout, such as "250ms".
+func withDeadline(timeout *atomic.Int64, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := time.Duration(timeout.Load())
+		if header := r.Header.Get("X-Request-Timeout"); header != "" {
+			requested, err := time.ParseDuration(header)
+			if err != nil || requested <= 0 {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				_ = json.NewEncoder(w).Encode(response{
+					Success: false,
+					Error:   "X-Request-Timeout must be a positive duration such as 250ms",
+				})
+				return
+			}
+			if limit <= 0 || requested < limit {
+				limit = requested
+			}
+		}
+		if limit <= 0 {
+			handler(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), limit)
+		defer cancel()
+		handler(w, r.WithContext(ctx))
+	}
+}
+
+// withMaxBody refuses request bodies larger than limit bytes with 413,
+// up front when the body's length is declared and otherwise once that many
+// bytes have been read. The limit is read for each request, so a reload can
+// change it; a limit of 0 leaves bodies unbounded.
+func withMaxBody(maxBody *atomic.Int64, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := maxBody.Load()
+		if limit <= 0 {
+			handler(w, r)
+			return
+		}
+		if r.ContentLength > limit {
+			w.Header().Set("Content-Type", "application/json")
+			writeBodyError(w, &http.MaxBytesError{Limit: limit}, "")
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		handler(w, r)
+	}
+}
+
+// writeBodyError answers a request whose body could not be read: with 413
+// if it went over -max-body-bytes, or with 400 and message otherwise.
+func writeBodyError(w http.ResponseWriter, err error, message string) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		_ = json.NewEncoder(w).Encode(response{
+			Success: false,
+			Error:   fmt.Sprintf("body is larger than %d bytes", tooLarge.Limit),
+			Code:    "BODY_TOO_LARGE",
+		})
+		return
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(response{
+		Success: false,
+		Error:   message,
+	})
+}
+
+func handleKV(w http.ResponseWriter, r *http.Request, kv *kvstore.KeyValueService) {
+	w.Header().Set("Content-Type", "application/json")
+
+	key, err := requestKey(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(response{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		handleGet(w, r, kv, key)
+	case http.MethodPost, http.MethodPut:
+		handleSet(w, r, kv, key)
+	case http.MethodDelete:
+		handleDelete(w, r, kv, key)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+	}
+}
+
+// handleGet reads a key, or with ?asOf=<RFC 3339 time> the value it held
+// then, which needs -history-window to reach back that far.
+func handleGet(w http.ResponseWriter, r *http.Request, kv *kvstore.KeyValueService, key string) {
+	var val *string
+	var err error
+	if asOf := r.URL.Query().Get("asOf"); asOf != "" {
+		at, parseErr := time.Parse(time.RFC3339Nano, asOf)
+		if parseErr != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(response{
+				Success: false,
+				Error:   "asOf must be an RFC 3339 time",
+			})
+			return
+		}
+		val, err = kv.GetAsOf(key, at)
+	} else {
+		val, err = kv.GetContext(r.Context(), key)
+	}
+	if err != nil {
+		writeErrorStatus(w, err, http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(response{
+			Success: false,
+			Error:   err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(response{
+		Success: true,
+		Value:   val,
+	})
+}
+
+func handleSet(w http.ResponseWriter, r *http.Request, kv *kvstore.KeyValueService, key string) {
+	var value string
+	var ttl time.Duration
+	var nx bool
+	var ifEqual *string
+	var err error
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/octet-stream" {
+		// The body is the value as is, read once with no JSON to decode, so
+		// a TTL comes in the query instead
+		if value, err = readRawValue(r); err != nil {
+			writeBodyError(w, err, "reading body: "+err.Error())
+			return
+		}
+		ttl, err = queryTTL(r)
+	} else {
+		var req setRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeBodyError(w, err, "invalid JSON body")
+			return
+		}
+		conditions := 0
+		for _, set := range []bool{req.NX, req.IfEqual != nil, req.TTL != nil || req.TTLMs != nil} {
+			if set {
+				conditions++
+			}
+		}
+		if conditions > 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(response{
+				Success: false,
+				Error:   "set at most one of 'nx', 'ifEqual' or a TTL",
+			})
+			return
+		}
+		value, nx, ifEqual = req.Value, req.NX, req.IfEqual
+		ttl, err = setTTL(req.TTL, req.TTLMs)
+	}
+
+	var val *string
+	switch {
+	case err != nil:
+	case nx, ifEqual != nil:
+		var written bool
+		if nx {
+			written, err = kv.SetNXContext(r.Context(), key, value)
+		} else {
+			written, err = kv.SetIfEqualContext(r.Context(), key, *ifEqual, value)
+		}
+		if err == nil && !written {
+			err = errConditionNotMet
+		}
+		val = &value
+	case ttl > 0:
+		val, err = kv.SetWithTTLContext(r.Context(), key, value, ttl)
+	default:
+		val, err = kv.SetContext(r.Context(), key, value)
+	}
+	if err != nil {
+		writeErrorStatus(w, err, http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(response{
+			Success: false,
+			Error:   err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(response{
+		Success: true,
+		Value:   val,
+	})
+}
+
+// setTTL turns a set's TTL in seconds or milliseconds into a duration,
+// zero if it has neither.
+func setTTL(seconds *int64, millis *int64) (time.Duration, error) {
+	switch {
+	case seconds != nil && millis != nil:
+		return 0, fmt.Errorf("%w: set at most one of 'ttl' or 'ttlMs'", kvstore.ErrInvalidTTL)
+	case seconds != nil && *seconds <= 0, millis != nil && *millis <= 0:
+		return 0, fmt.Errorf("%w: 'ttl' and 'ttlMs' must be positive", kvstore.ErrInvalidTTL)
+	case seconds != nil:
+		return kvstore.TTLIn(*seconds, time.Second)
+	case millis != nil:
+		return kvstore.TTLIn(*millis, time.Millisecond)
+	}
+	return 0, nil
+}
+
+// queryTTL reads a set's TTL from its ttl or ttlMs query parameter.
+func queryTTL(r *http.Request) (time.Duration, error) {
+	var ttls [2]*int64
+	for i, name := range []string{"ttl", "ttlMs"} {
+		if text := r.URL.Query().Get(name); text != "" {
+			n, err := strconv.ParseInt(text, 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("%w: '%s' must be an integer", kvstore.ErrInvalidTTL, name)
+			}
+			ttls[i] = &n
+		}
+	}
+	return setTTL(ttls[0], ttls[1])
+}
+
+// readRawValue reads a request's body into a string, sized up front from
+// its Content-Length so the value is built without growing.
+func readRawValue(r *http.Request) (string, error) {
+	var value strings.Builder
+	if r.ContentLength > 0 {
+		value.Grow(int(r.ContentLength))
+	}
+	_, err := io.Copy(&value, r.Body)
+	return value.String(), err
+}
+
+func handleDelete(w http.ResponseWriter, r *http.Request, kv *kvstore.KeyValueService, key string) {
+	val, err := kv.DeleteContext(r.Context(), key)
+	if err != nil {
+		writeErrorStatus(w, err, http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(response{
+			Success: false,
+			Error:   err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(response{
+		Success: true,
+		Value:   val, // may be nil if key didn't exist
+	})
+}
+
+// handleExpireAt sets an absolute expiry on a key. The body carries the
+// deadline as a Unix timestamp in seconds ("at") or milliseconds ("atMs"),
+// and optionally a "jitter" fraction that overrides -ttl-jitter.
+func handleExpireAt(w http.ResponseWriter, r *http.Request, kv *kvstore.KeyValueService) {
+	w.Header().Set("Content-Type", "application/json")
+
+	key, ok := expiryKey(w, r)
+	if !ok {
+		return
+	}
+
+	var req expireAtRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.At == nil) == (req.AtMs == nil) {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(expiryResponse{
+			Success: false,
+			Error:   "body must set exactly one of 'at' or 'atMs'",
+		})
+		return
+	}
+	var at time.Time
+	if req.At != nil {
+		at = time.Unix(*req.At, 0)
+	} else {
+		at = time.UnixMilli(*req.AtMs)
+	}
+
+	var updated bool
+	var err error
+	if req.Jitter != nil {
+		updated, err = kv.ExpireAtWithJitterContext(r.Context(), key, at, *req.Jitter)
+	} else {
+		updated, err = kv.ExpireAtContext(r.Context(), key, at)
+	}
+	writeExpiryResponse(w, updated, err)
+}
+
+func handlePersist(w http.ResponseWriter, r *http.Request, kv *kvstore.KeyValueService) {
+	w.Header().Set("Content-Type", "application/json")
+
+	key, ok := expiryKey(w, r)
+	if !ok {
+		return
+	}
+
+	updated, err := kv.PersistContext(r.Context(), key)
+	writeExpiryResponse(w, updated, err)
+}
+
+// handleTTL reports a key's remaining time to live in the given unit. Like
+// Redis, it answers -2 for a missing key and -1 for a key without expiry.
+func handleTTL(w http.ResponseWriter, r *http.Request, kv *kvstore.KeyValueService, unit time.Duration) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(ttlResponse{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	key, err := requestKey(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(ttlResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	ttl, err := kv.TTLContext(r.Context(), key)
+	if err != nil {
+		writeErrorStatus(w, err, http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(ttlResponse{
+			Success: false,
+			Error:   err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	reply := int64(-2)
+	switch {
+	case ttl == kvstore.TTLNoExpiry:
+		reply = -1
+	case ttl > 0:
+		reply = int64((ttl + unit/2) / unit)
+	}
+	_ = json.NewEncoder(w).Encode(ttlResponse{
+		Success: true,
+		TTL:     reply,
+	})
+}
+
+// handleObject reports how the store holds a key. Last access and idle time
+// are only included when the node runs with -track-access, and the access
+// count when it runs with -track-frequency.
+func handleObject(w http.ResponseWriter, r *http.Request, kv *kvstore.KeyValueService) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(objectResponse{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	key, err := requestKey(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(objectResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	info, err := kv.ObjectContext(r.Context(), key)
+	if err != nil {
+		writeErrorStatus(w, err, http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(objectResponse{
+			Success: false,
+			Error:   err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	res := objectResponse{
+		Success:  true,
+		Encoding: info.Encoding,
+		Size:     info.Size,
+	}
+	if !info.LastAccess.IsZero() {
+		lastAccess := info.LastAccess.UnixMilli()
+		res.LastAccessMs = &lastAccess
+	}
+	if !info.LastAccess.IsZero() || info.Idle > 0 {
+		idle := int64(info.Idle.Seconds())
+		res.IdleSeconds = &idle
+	}
+	if info.Frequency > 0 {
+		frequency := int64(info.Frequency)
+		res.Frequency = &frequency
+	}
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// expiryKey validates the method and key of an expiry request, writing the
+// error response itself when either is wrong.
+func expiryKey(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(expiryResponse{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return "", false
+	}
+
+	key, err := requestKey(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(expiryResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return "", false
+	}
+	return key, true
+}
+
+func writeExpiryResponse(w http.ResponseWriter, updated bool, err error) {
+	if err != nil {
+		writeErrorStatus(w, err, http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(expiryResponse{
+			Success: false,
+			Error:   err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(expiryResponse{
+		Success: true,
+		Updated: updated,
+	})
+}
+
+func handleReadOnly(w http.ResponseWriter, r *http.Request, kv *kvstore.KeyValueService) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		var req readOnlyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(readOnlyResponse{
+				Success:  false,
+				ReadOnly: kv.IsReadOnly(),
+				Error:    "invalid JSON body",
+			})
+			return
+		}
+		kv.SetReadOnly(req.ReadOnly)
+		log.Printf("Read-only mode set to %t\n", req.ReadOnly)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(readOnlyResponse{
+			Success:  false,
+			ReadOnly: kv.IsReadOnly(),
+			Error:    "method not allowed",
+		})
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(readOnlyResponse{
+		Success:  true,
+		ReadOnly: kv.IsReadOnly(),
+	})
+}
+
+func handleMaintenance(w http.ResponseWriter, r *http.Request, kv *kvstore.KeyValueService) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		var req maintenanceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(maintenanceResponse{
+				Success:     false,
+				Maintenance: kv.InMaintenance(),
+				Error:       "invalid JSON body",
+			})
+			return
+		}
+		if req.Enabled {
+			maxQueued := defaultMaintenanceMaxQueued
+			if req.MaxQueued != nil {
+				maxQueued = *req.MaxQueued
+			}
+			maxWait := defaultMaintenanceMaxWait
+			if req.MaxWaitMs != nil {
+				maxWait = time.Duration(*req.MaxWaitMs) * time.Millisecond
+			}
+			kv.StartMaintenance(maxQueued, maxWait)
+			log.Printf("Entered maintenance mode (max queued %d, max wait %s)\n", maxQueued, maxWait)
+		} else {
+			kv.EndMaintenance()
+			log.Println("Left maintenance mode")
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(maintenanceResponse{
+			Success:     false,
+			Maintenance: kv.InMaintenance(),
+			Error:       "method not allowed",
+		})
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(maintenanceResponse{
+		Success:     true,
+		Maintenance: kv.InMaintenance(),
+	})
+}
+
+// errorStatus maps typed store errors to HTTP status codes, falling back to
+// the handler's default for anything else.
+func errorStatus(err error, fallback int) int {
+	switch {
+	case errors.Is(err, acl.ErrUnauthenticated):
+		return http.StatusUnauthorized
+	case errors.Is(err, kvstore.ErrReadOnly), errors.Is(err, acl.ErrNoPermission):
+		return http.StatusForbidden
+	case errors.Is(err, kvstore.ErrWrongType):
+		return http.StatusConflict
+	case errors.Is(err, errConditionNotMet):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, errMoved), errors.Is(err, errStaleEpoch):
+		return http.StatusMisdirectedRequest
+	case errors.Is(err, kvstore.ErrLeaseNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, kvstore.ErrInvalidKey), errors.Is(err, kvstore.ErrKeyTooLong),
+		errors.Is(err, kvstore.ErrInvalidTTL):
+		return http.StatusBadRequest
+	case errors.Is(err, acl.ErrRateLimited), errors.Is(err, acl.ErrQuotaExceeded):
+		return http.StatusTooManyRequests
+	case errors.Is(err, kvstore.ErrValueTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, kvstore.ErrTransactionConflict), errors.Is(err, kvstore.ErrChangesUnavailable),
+		errors.Is(err, changelog.ErrNotCovered), errors.Is(err, kvstore.ErrHistoryUnavailable),
+		errors.Is(err, kvstore.ErrTTLPolicy):
+		return http.StatusConflict
+	case errors.Is(err, kvstore.ErrAccessNotTracked), errors.Is(err, kvstore.ErrFrequencyNotTracked):
+		return http.StatusNotImplemented
+	case errors.Is(err, kvstore.ErrDeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, kvstore.ErrMaintenance), errors.Is(err, kvstore.ErrOverloaded),
+		errors.Is(err, kvstore.ErrStoreRestarted),
+		errors.Is(err, workerpool.ErrFull), errors.Is(err, errMoving),
+		errors.Is(err, errSplitBrain), errors.Is(err, errLeaseExpired):
+		return http.StatusServiceUnavailable
+	}
+	return fallback
+}
+
+func writeErrorStatus(w http.ResponseWriter, err error, fallback int) {
+	status := errorStatus(err, fallback)
+	if status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", retryAfterSeconds)
+	}
+	w.WriteHeader(status)
+}
+
+// errorCode maps the typed errors behind a failed request to a stable code
+// clients can branch on, sent alongside the message as "code". Errors
+// without a type of their own have no code.
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, kvstore.ErrKeyNotFound):
+		return "KEY_NOT_FOUND"
+	case errors.Is(err, kvstore.ErrWrongType):
+		return "WRONG_TYPE"
+	case errors.Is(err, errConditionNotMet):
+		return "CONDITION_NOT_MET"
+	case errors.Is(err, kvstore.ErrInvalidKey):
+		return "INVALID_KEY"
+	case errors.Is(err, kvstore.ErrKeyTooLong):
+		return "KEY_TOO_LONG"
+	case errors.Is(err, kvstore.ErrValueTooLarge):
+		return "VALUE_TOO_LARGE"
+	case errors.Is(err, kvstore.ErrOverloaded), errors.Is(err, workerpool.ErrFull):
+		return "OVERLOADED"
+	case errors.Is(err, kvstore.ErrDeadlineExceeded):
+		return "DEADLINE_EXCEEDED"
+	case errors.Is(err, kvstore.ErrClosed):
+		return "CLOSED"
+	case errors.Is(err, kvstore.ErrReadOnly):
+		return "READ_ONLY"
+	case errors.Is(err, kvstore.ErrMaintenance):
+		return "MAINTENANCE"
+	case errors.Is(err, kvstore.ErrLeaseNotFound):
+		return "LEASE_NOT_FOUND"
+	case errors.Is(err, kvstore.ErrTransactionConflict):
+		return "TRANSACTION_CONFLICT"
+	case errors.Is(err, kvstore.ErrTransactionNotFound):
+		return "TRANSACTION_NOT_FOUND"
+	case errors.Is(err, kvstore.ErrNotCRDTNamespace):
+		return "NOT_CRDT_NAMESPACE"
+	case errors.Is(err, kvstore.ErrSnapshotClosed):
+		return "SNAPSHOT_CLOSED"
+	case errors.Is(err, kvstore.ErrChangesUnavailable):
+		return "CHANGES_UNAVAILABLE"
+	case errors.Is(err, changelog.ErrNotCovered):
+		return "NOT_COVERED"
+	case errors.Is(err, kvstore.ErrHistoryUnavailable):
+		return "HISTORY_UNAVAILABLE"
+	case errors.Is(err, kvstore.ErrTTLPolicy):
+		return "TTL_POLICY"
+	case errors.Is(err, kvstore.ErrInvalidTTL):
+		return "INVALID_TTL"
+	case errors.Is(err, kvstore.ErrPanicked):
+		return "PANICKED"
+	case errors.Is(err, kvstore.ErrStoreRestarted):
+		return "STORE_RESTARTED"
+	case errors.Is(err, kvstore.ErrAccessNotTracked), errors.Is(err, kvstore.ErrFrequencyNotTracked):
+		return "NOT_TRACKED"
+	case errors.Is(err, errMoved):
+		return "MOVED"
+	case errors.Is(err, errMoving):
+		return "MOVING"
+	case errors.Is(err, errStaleEpoch):
+		return "STALE_EPOCH"
+	case errors.Is(err, errSplitBrain):
+		return "SPLIT_BRAIN"
+	case errors.Is(err, errLeaseExpired):
+		return "FENCED"
+	case errors.Is(err, acl.ErrUnauthenticated):
+		return "UNAUTHENTICATED"
+	case errors.Is(err, acl.ErrNoPermission):
+		return "NO_PERMISSION"
+	case errors.Is(err, acl.ErrRateLimited):
+		return "RATE_LIMITED"
+	case errors.Is(err, acl.ErrQuotaExceeded):
+		return "QUOTA_EXCEEDED"
+	}
+	return ""
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"blueis/internal/cdc"
+	"blueis/internal/kvstore"
+	"blueis/internal/workerpool"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+type commandStatsResponse struct {
+	Count        uint64  `json:"count"`
+	Errors       uint64  `json:"errors"`
+	TotalSeconds float64 `json:"totalSeconds"`
+	AvgSeconds   float64 `json:"avgSeconds"`
+}
+
+type batchStatsResponse struct {
+	Batches      uint64  `json:"batches"`
+	Commands     uint64  `json:"commands"`
+	AvgBatchSize float64 `json:"avgBatchSize"`
+}
+
+type queueStatsResponse struct {
+	Depth      int    `json:"depth"`
+	Capacity   int    `json:"capacity"`
+	Overloaded uint64 `json:"overloaded"`
+	// DeadlineExceeded counts commands skipped because their request's
+	// deadline passed while they were queued
+	DeadlineExceeded uint64 `json:"deadlineExceeded"`
+}
+
+type workerStatsResponse struct {
+	Workers       int    `json:"workers"`
+	QueueDepth    int    `json:"queueDepth"`
+	QueueCapacity int    `json:"queueCapacity"`
+	Rejected      uint64 `json:"rejected"`
+}
+
+type storeStatsResponse struct {
+	UptimeSeconds float64 `json:"uptimeSeconds"`
+	// Keys and MemoryBytes are -1 if the storage engine cannot count keys
+	Keys         int                      `json:"keys"`
+	MemoryBytes  int64                    `json:"memoryBytes"`
+	ExpiringKeys int                      `json:"expiringKeys"`
+	ExpiredKeys  uint64                   `json:"expiredKeys"`
+	ExpirySweep  expirySweepStatsResponse `json:"expirySweep"`
+	History      historyStatsResponse     `json:"history"`
+	Tombstones   tombstoneStatsResponse   `json:"tombstones"`
+	Tiers        *tierStatsResponse       `json:"tiers,omitempty"`
+}
+
+// tierStatsResponse is only served by nodes using the tiered engine.
+type tierStatsResponse struct {
+	HotKeys    int     `json:"hotKeys"`
+	HotHits    uint64  `json:"hotHits"`
+	ColdHits   uint64  `json:"coldHits"`
+	Misses     uint64  `json:"misses"`
+	HotHitRate float64 `json:"hotHitRate"`
+	Promotions uint64  `json:"promotions"`
+	Demotions  uint64  `json:"demotions"`
+}
+
+type tombstoneStatsResponse struct {
+	GraceSeconds float64 `json:"graceSeconds"`
+	Tombstones   int     `json:"tombstones"`
+	Purged       uint64  `json:"purged"`
+}
+
+type historyStatsResponse struct {
+	WindowSeconds float64 `json:"windowSeconds"`
+	Keys          int     `json:"keys"`
+	Versions      int     `json:"versions"`
+}
+
+type expirySweepStatsResponse struct {
+	Sweeps              uint64  `json:"sweeps"`
+	Rounds              uint64  `json:"rounds"`
+	Removed             uint64  `json:"removed"`
+	TotalSeconds        float64 `json:"totalSeconds"`
+	LastDurationSeconds float64 `json:"lastDurationSeconds"`
+	// Backlog estimates the expired keys not removed yet
+	Backlog int `json:"backlog"`
+}
+
+type cdcStatsResponse struct {
+	Published uint64 `json:"published"`
+	Failures  uint64 `json:"failures"`
+	Resyncs   uint64 `json:"resyncs"`
+}
+
+type healthResponse struct {
+	Success     bool       `json:"success"`
+	Running     bool       `json:"running"`
+	Panics      uint64     `json:"panics"`
+	Restarts    uint64     `json:"restarts"`
+	LastPanic   string     `json:"lastPanic,omitempty"`
+	LastPanicAt *time.Time `json:"lastPanicAt,omitempty"`
+}
+
+type statsResponse struct {
+	Store       storeStatsResponse              `json:"store"`
+	Commands    map[string]commandStatsResponse `json:"commands"`
+	Batches     batchStatsResponse              `json:"batches"`
+	Queue       queueStatsResponse              `json:"queue"`
+	Workers     *workerStatsResponse            `json:"workers,omitempty"`
+	Keyspace    *keyspaceStatsResponse          `json:"keyspace,omitempty"`
+	Replication replicationInfoResponse         `json:"replication"`
+	CDC         *cdcStatsResponse               `json:"cdc,omitempty"`
+}
+
+func handleStats(w http.ResponseWriter, r *http.Request, kv *kvstore.KeyValueService, pool *workerpool.Pool, keyspace *keyspaceAnalyzer, role *replicationRole, publisher *cdc.Publisher) {
+	w.Header().Set("Content-Type", "application/json")
+
+	stats, err := kv.Stats()
+	if err != nil {
+		w.WriteHeader(errorStatus(err, http.StatusInternalServerError))
+		_ = json.NewEncoder(w).Encode(response{
+			Success: false,
+			Error:   err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	commands := make(map[string]commandStatsResponse)
+	for name, stats := range stats.Commands {
+		commands[name] = commandStatsResponse{
+			Count:        stats.Count,
+			Errors:       stats.Errors,
+			TotalSeconds: stats.TotalDuration.Seconds(),
+			AvgSeconds:   stats.AverageDuration().Seconds(),
+		}
+	}
+
+	var workers *workerStatsResponse
+	if pool != nil {
+		workers = &workerStatsResponse{
+			Workers:       pool.Workers(),
+			QueueDepth:    pool.QueueDepth(),
+			QueueCapacity: pool.QueueCapacity(),
+			Rejected:      pool.RejectedCount(),
+		}
+	}
+	var changes *cdcStatsResponse
+	if publisher != nil {
+		stats := publisher.Stats()
+		changes = &cdcStatsResponse{
+			Published: stats.Published,
+			Failures:  stats.Failures,
+			Resyncs:   stats.Resyncs,
+		}
+	}
+
+	var tiers *tierStatsResponse
+	if stats.Tiers != nil {
+		tiers = &tierStatsResponse{
+			HotKeys:    stats.Tiers.HotKeys,
+			HotHits:    stats.Tiers.HotHits,
+			ColdHits:   stats.Tiers.ColdHits,
+			Misses:     stats.Tiers.Misses,
+			HotHitRate: stats.Tiers.HotHitRate(),
+			Promotions: stats.Tiers.Promotions,
+			Demotions:  stats.Tiers.Demotions,
+		}
+	}
+
+	_ = json.NewEncoder(w).Encode(statsResponse{
+		Store: storeStatsResponse{
+			UptimeSeconds: stats.Uptime.Seconds(),
+			Keys:          stats.Keys,
+			MemoryBytes:   stats.MemoryBytes,
+			ExpiringKeys:  stats.ExpiringKeys,
+			ExpiredKeys:   stats.ExpiredKeys,
+			ExpirySweep: expirySweepStatsResponse{
+				Sweeps:              stats.ExpirySweep.Sweeps,
+				Rounds:              stats.ExpirySweep.Rounds,
+				Removed:             stats.ExpirySweep.Removed,
+				TotalSeconds:        stats.ExpirySweep.Duration.Seconds(),
+				LastDurationSeconds: stats.ExpirySweep.LastDuration.Seconds(),
+				Backlog:             stats.ExpirySweep.Backlog,
+			},
+			History: historyStatsResponse{
+				WindowSeconds: stats.History.Window.Seconds(),
+				Keys:          stats.History.Keys,
+				Versions:      stats.History.Versions,
+			},
+			Tombstones: tombstoneStatsResponse{
+				GraceSeconds: stats.Tombstones.Grace.Seconds(),
+				Tombstones:   stats.Tombstones.Tombstones,
+				Purged:       stats.Tombstones.Purged,
+			},
+			Tiers: tiers,
+		},
+		Commands: commands,
+		Batches: batchStatsResponse{
+			Batches:      stats.Batches.Batches,
+			Commands:     stats.Batches.Commands,
+			AvgBatchSize: stats.Batches.AverageBatchSize(),
+		},
+		Queue: queueStatsResponse{
+			Depth:            stats.QueueDepth,
+			Capacity:         stats.QueueCapacity,
+			Overloaded:       stats.Overloaded,
+			DeadlineExceeded: stats.DeadlineExceeded,
+		},
+		Workers:     workers,
+		Keyspace:    keyspace.stats(),
+		Replication: role.info(),
+		CDC:         changes,
+	})
+}
+
+// handleHealth reports whether the store is serving commands and the
+// panics it has recovered from: GET /health. A store that has stopped is
+// answered with 503.
+func handleHealth(w http.ResponseWriter, r *http.Request, kv *kvstore.KeyValueService) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(response{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	health := kv.Health()
+	res := healthResponse{
+		Success:   health.Running,
+		Running:   health.Running,
+		Panics:    health.Panics,
+		Restarts:  health.Restarts,
+		LastPanic: health.LastPanic,
+	}
+	if !health.LastPanicAt.IsZero() {
+		res.LastPanicAt = &health.LastPanicAt
+	}
+	if !health.Running {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// handleMetrics renders the store metrics in the Prometheus text exposition
+// format.
+func handleMetrics(w http.ResponseWriter, r *http.Request, kv *kvstore.KeyValueService, pool *workerpool.Pool, keyspace *keyspaceAnalyzer, role *replicationRole, publisher *cdc.Publisher) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	stats := kv.CommandStats()
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var b strings.Builder
+
+	b.WriteString("# HELP blueis_commands_total Commands processed by the store.\n")
+	b.WriteString("# TYPE blueis_commands_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "blueis_commands_total{command=%q} %d\n", name, stats[name].Count)
+	}
+
+	b.WriteString("# HELP blueis_command_errors_total Commands that returned an error.\n")
+	b.WriteString("# TYPE blueis_command_errors_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "blueis_command_errors_total{command=%q} %d\n", name, stats[name].Errors)
+	}
+
+	b.WriteString("# HELP blueis_command_duration_seconds Time spent processing commands in the store.\n")
+	b.WriteString("# TYPE blueis_command_duration_seconds summary\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "blueis_command_duration_seconds_sum{command=%q} %g\n", name, stats[name].TotalDuration.Seconds())
+		fmt.Fprintf(&b, "blueis_command_duration_seconds_count{command=%q} %d\n", name, stats[name].Count)
+	}
+
+	batches := kv.BatchStats()
+	b.WriteString("# HELP blueis_store_batches_total Batches processed by the store loop.\n")
+	b.WriteString("# TYPE blueis_store_batches_total counter\n")
+	fmt.Fprintf(&b, "blueis_store_batches_total %d\n", batches.Batches)
+	b.WriteString("# HELP blueis_store_batched_commands_total Commands processed as part of a batch.\n")
+	b.WriteString("# TYPE blueis_store_batched_commands_total counter\n")
+	fmt.Fprintf(&b, "blueis_store_batched_commands_total %d\n", batches.Commands)
+
+	b.WriteString("# HELP blueis_store_queue_depth Commands waiting in the store's input queue.\n")
+	b.WriteString("# TYPE blueis_store_queue_depth gauge\n")
+	fmt.Fprintf(&b, "blueis_store_queue_depth %d\n", kv.QueueDepth())
+	b.WriteString("# HELP blueis_store_overloaded_total Commands rejected because the input queue was full.\n")
+	b.WriteString("# TYPE blueis_store_overloaded_total counter\n")
+	fmt.Fprintf(&b, "blueis_store_overloaded_total %d\n", kv.OverloadedCount())
+	b.WriteString("# HELP blueis_store_deadline_exceeded_total Commands skipped because their request's deadline passed before the store reached them.\n")
+	b.WriteString("# TYPE blueis_store_deadline_exceeded_total counter\n")
+	fmt.Fprintf(&b, "blueis_store_deadline_exceeded_total %d\n", kv.DeadlineExceededCount())
+
+	sweep := kv.ExpirySweepStats()
+	b.WriteString("# HELP blueis_expiry_sweep_removed_total Expired keys removed by the expiry sweeper before anything read them.\n")
+	b.WriteString("# TYPE blueis_expiry_sweep_removed_total counter\n")
+	fmt.Fprintf(&b, "blueis_expiry_sweep_removed_total %d\n", sweep.Removed)
+	b.WriteString("# HELP blueis_expiry_sweep_duration_seconds Time the expiry sweeper held up the store loop.\n")
+	b.WriteString("# TYPE blueis_expiry_sweep_duration_seconds summary\n")
+	fmt.Fprintf(&b, "blueis_expiry_sweep_duration_seconds_sum %g\n", sweep.Duration.Seconds())
+	fmt.Fprintf(&b, "blueis_expiry_sweep_duration_seconds_count %d\n", sweep.Sweeps)
+	b.WriteString("# HELP blueis_expiry_backlog_keys Estimated expired keys not removed yet.\n")
+	b.WriteString("# TYPE blueis_expiry_backlog_keys gauge\n")
+	fmt.Fprintf(&b, "blueis_expiry_backlog_keys %d\n", sweep.Backlog)
+
+	history := kv.HistoryStats()
+	b.WriteString("# HELP blueis_history_versions Replaced values kept for reads as of an earlier time.\n")
+	b.WriteString("# TYPE blueis_history_versions gauge\n")
+	fmt.Fprintf(&b, "blueis_history_versions %d\n", history.Versions)
+
+	tombstones := kv.TombstoneStats()
+	b.WriteString("# HELP blueis_tombstones Deleted keys remembered for replicas that sync from scratch.\n")
+	b.WriteString("# TYPE blueis_tombstones gauge\n")
+	fmt.Fprintf(&b, "blueis_tombstones %d\n", tombstones.Tombstones)
+	b.WriteString("# HELP blueis_tombstones_purged_total Tombstones dropped after their grace period.\n")
+	b.WriteString("# TYPE blueis_tombstones_purged_total counter\n")
+	fmt.Fprintf(&b, "blueis_tombstones_purged_total %d\n", tombstones.Purged)
+
+	if tiers, ok := kv.TierStats(); ok {
+		b.WriteString("# HELP blueis_tier_hits_total Reads served by each tier of the tiered engine.\n")
+		b.WriteString("# TYPE blueis_tier_hits_total counter\n")
+		fmt.Fprintf(&b, "blueis_tier_hits_total{tier=\"hot\"} %d\n", tiers.HotHits)
+		fmt.Fprintf(&b, "blueis_tier_hits_total{tier=\"cold\"} %d\n", tiers.ColdHits)
+		b.WriteString("# HELP blueis_tier_misses_total Reads of keys neither tier holds.\n")
+		b.WriteString("# TYPE blueis_tier_misses_total counter\n")
+		fmt.Fprintf(&b, "blueis_tier_misses_total %d\n", tiers.Misses)
+		b.WriteString("# HELP blueis_tier_hot_hit_ratio Share of reads served from memory.\n")
+		b.WriteString("# TYPE blueis_tier_hot_hit_ratio gauge\n")
+		fmt.Fprintf(&b, "blueis_tier_hot_hit_ratio %g\n", tiers.HotHitRate())
+		b.WriteString("# HELP blueis_tier_hot_keys Keys cached in memory.\n")
+		b.WriteString("# TYPE blueis_tier_hot_keys gauge\n")
+		fmt.Fprintf(&b, "blueis_tier_hot_keys %d\n", tiers.HotKeys)
+		b.WriteString("# HELP blueis_tier_promotions_total Cold keys cached in memory after a read.\n")
+		b.WriteString("# TYPE blueis_tier_promotions_total counter\n")
+		fmt.Fprintf(&b, "blueis_tier_promotions_total %d\n", tiers.Promotions)
+		b.WriteString("# HELP blueis_tier_demotions_total Keys dropped from memory to make room.\n")
+		b.WriteString("# TYPE blueis_tier_demotions_total counter\n")
+		fmt.Fprintf(&b, "blueis_tier_demotions_total %d\n", tiers.Demotions)
+	}
+
+	health := kv.Health()
+	b.WriteString("# HELP blueis_store_panics_total Commands that panicked and failed on their own.\n")
+	b.WriteString("# TYPE blueis_store_panics_total counter\n")
+	fmt.Fprintf(&b, "blueis_store_panics_total %d\n", health.Panics)
+	b.WriteString("# HELP blueis_store_restarts_total Times the store loop failed and was restarted.\n")
+	b.WriteString("# TYPE blueis_store_restarts_total counter\n")
+	fmt.Fprintf(&b, "blueis_store_restarts_total %d\n", health.Restarts)
+
+	if pool != nil {
+		b.WriteString("# HELP blueis_worker_queue_depth Requests waiting for a free worker.\n")
+		b.WriteString("# TYPE blueis_worker_queue_depth gauge\n")
+		fmt.Fprintf(&b, "blueis_worker_queue_depth %d\n", pool.QueueDepth())
+		b.WriteString("# HELP blueis_worker_rejected_total Requests rejected because every worker was busy.\n")
+		b.WriteString("# TYPE blueis_worker_rejected_total counter\n")
+		fmt.Fprintf(&b, "blueis_worker_rejected_total %d\n", pool.RejectedCount())
+	}
+	if publisher != nil {
+		changes := publisher.Stats()
+		b.WriteString("# HELP blueis_cdc_published_total Changes published to the change data capture sink.\n")
+		b.WriteString("# TYPE blueis_cdc_published_total counter\n")
+		fmt.Fprintf(&b, "blueis_cdc_published_total %d\n", changes.Published)
+		b.WriteString("# HELP blueis_cdc_publish_failures_total Publishes the change data capture sink refused, each retried.\n")
+		b.WriteString("# TYPE blueis_cdc_publish_failures_total counter\n")
+		fmt.Fprintf(&b, "blueis_cdc_publish_failures_total %d\n", changes.Failures)
+		b.WriteString("# HELP blueis_cdc_resyncs_total Times the publisher fell too far behind and published every key again.\n")
+		b.WriteString("# TYPE blueis_cdc_resyncs_total counter\n")
+		fmt.Fprintf(&b, "blueis_cdc_resyncs_total %d\n", changes.Resyncs)
+	}
+	keyspace.writeMetrics(&b)
+	role.writeMetrics(&b)
+
+	_, _ = w.Write([]byte(b.String()))
+}
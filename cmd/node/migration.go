@@ -0,0 +1,450 @@
+package main
+
+import (
+	"blueis/internal/kvstore"
+	"blueis/internal/twophase"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	errMoving = errors.New("key is being moved to another node, retry later")
+	errMoved  = errors.New("MOVED key belongs to another node")
+)
+
+// hashRange is the keys whose FNV-1a hash lies in (Start, End], wrapping
+// past the top of the hash space when Start >= End. It matches how the
+// coordinator's ring assigns keys to nodes, so a range of the ring can be
+// moved from one node to another.
+type hashRange struct {
+	Start uint32 `json:"start"`
+	End   uint32 `json:"end"`
+}
+
+func parseHashRange(start string, end string) (hashRange, error) {
+	s, err := strconv.ParseUint(start, 10, 32)
+	if err != nil {
+		return hashRange{}, errors.New("'hashStart' must be a 32-bit unsigned integer")
+	}
+	e, err := strconv.ParseUint(end, 10, 32)
+	if err != nil {
+		return hashRange{}, errors.New("'hashEnd' must be a 32-bit unsigned integer")
+	}
+	return hashRange{uint32(s), uint32(e)}, nil
+}
+
+func (hashes hashRange) contains(key string) bool {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	hash := h.Sum32()
+	if hashes.Start < hashes.End {
+		return hashes.Start < hash && hash <= hashes.End
+	}
+	return hash > hashes.Start || hash <= hashes.End
+}
+
+// migrations tracks the ranges of keys moving between this node and others.
+// The node a range moves to imports it by following the owner's
+// replication stream filtered to the range. Once the importer has caught
+// up, the owner fences the range so its keys stop changing, and after the
+// coordinator has checked both copies match and routed the range to the
+// importer, the owner releases it: its keys are deleted and requests for
+// them are refused with errMoved from then on.
+type migrations struct {
+	role *replicationRole
+
+	// mu guards the fields below; check takes it for reading on every
+	// command, so it is only held briefly for writing
+	mu      sync.RWMutex
+	imports map[hashRange]*rangeImport
+	fenced  []hashRange
+	moved   []movedRange
+}
+
+type rangeImport struct {
+	source  string
+	replica *replica
+	stop    func()
+}
+
+type movedRange struct {
+	hashRange
+	owner string
+}
+
+// check is a before-command hook refusing commands on keys the node has
+// given away, and writes to keys it is handing over.
+func (moves *migrations) check(command *kvstore.Command) error {
+	if command.Key == "" {
+		return nil
+	}
+	moves.mu.RLock()
+	defer moves.mu.RUnlock()
+	return moves.checkKey(command.Key, kvstore.IsMutation(command.Type))
+}
+
+// checkKeys applies check to transactions, whose keys the hook does not see.
+func (moves *migrations) checkKeys(operations []twophase.Operation) error {
+	moves.mu.RLock()
+	defer moves.mu.RUnlock()
+	for _, operation := range operations {
+		if err := moves.checkKey(operation.Key, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (moves *migrations) checkKey(key string, write bool) error {
+	for _, moved := range moves.moved {
+		if moved.contains(key) {
+			return fmt.Errorf("%w: %s", errMoved, moved.owner)
+		}
+	}
+	if write {
+		for _, fenced := range moves.fenced {
+			if fenced.contains(key) {
+				return errMoving
+			}
+		}
+	}
+	return nil
+}
+
+// startImport starts copying the keys in hashes from source, and keeps
+// them up to date until endImport. Starting an import that is already
+// running is a no-op.
+func (moves *migrations) startImport(source string, hashes hashRange) error {
+	moves.mu.Lock()
+	defer moves.mu.Unlock()
+
+	if running, ok := moves.imports[hashes]; ok {
+		if running.source != source {
+			return fmt.Errorf("already importing the range from %s", running.source)
+		}
+		return nil
+	}
+	role := moves.role
+	options := role.options
+	options.checkpoint = ""
+	replica := &replica{kv: role.kv, primary: source, client: role.client, options: options, hashes: &hashes}
+	ctx, cancel := context.WithCancel(role.ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		replica.run(ctx)
+	}()
+	if moves.imports == nil {
+		moves.imports = make(map[hashRange]*rangeImport)
+	}
+	moves.imports[hashes] = &rangeImport{source, replica, func() {
+		cancel()
+		<-done
+	}}
+	log.Printf("Importing hashes (%d, %d] from %s", hashes.Start, hashes.End, source)
+	return nil
+}
+
+// endImport stops importing hashes. Unless keep is set, as when the move
+// is abandoned, the keys imported so far are deleted again; it returns how
+// many.
+func (moves *migrations) endImport(hashes hashRange, keep bool) (int, error) {
+	moves.mu.Lock()
+	running, ok := moves.imports[hashes]
+	delete(moves.imports, hashes)
+	moves.mu.Unlock()
+
+	if !ok {
+		return 0, fmt.Errorf("not importing hashes (%d, %d]", hashes.Start, hashes.End)
+	}
+	running.stop()
+	if keep {
+		// The range may be coming back to a node that gave it away
+		moves.mu.Lock()
+		moves.moved = slices.DeleteFunc(moves.moved, func(moved movedRange) bool {
+			return moved.hashRange == hashes
+		})
+		moves.mu.Unlock()
+		log.Printf("Finished importing hashes (%d, %d] from %s", hashes.Start, hashes.End, running.source)
+		return 0, nil
+	}
+	removed, err := moves.removeRange(hashes)
+	log.Printf("Abandoned importing hashes (%d, %d] from %s, removed %d keys", hashes.Start, hashes.End, running.source, removed)
+	return removed, err
+}
+
+// fence refuses writes to keys in hashes until unfence or release. It
+// fails, leaving the range unfenced, while a prepared transaction writes
+// to the range, since its commit could otherwise land after the move.
+func (moves *migrations) fence(hashes hashRange, txns *participant) error {
+	moves.mu.Lock()
+	if !slices.Contains(moves.fenced, hashes) {
+		moves.fenced = append(moves.fenced, hashes)
+	}
+	moves.mu.Unlock()
+
+	records, err := txns.log.Records()
+	if err == nil {
+		err = preparedIn(records, hashes)
+	}
+	if err != nil {
+		moves.unfence(hashes)
+		return err
+	}
+	return nil
+}
+
+func preparedIn(records map[string][]byte, hashes hashRange) error {
+	for id, data := range records {
+		var operations []twophase.Operation
+		if err := json.Unmarshal(data, &operations); err != nil {
+			return fmt.Errorf("decoding transaction %s: %w", id, err)
+		}
+		for _, operation := range operations {
+			if hashes.contains(operation.Key) {
+				return fmt.Errorf("transaction %s is prepared for key %s, retry later", id, operation.Key)
+			}
+		}
+	}
+	return nil
+}
+
+func (moves *migrations) unfence(hashes hashRange) {
+	moves.mu.Lock()
+	defer moves.mu.Unlock()
+	moves.fenced = slices.DeleteFunc(moves.fenced, func(fenced hashRange) bool {
+		return fenced == hashes
+	})
+}
+
+// release hands hashes over to owner: requests for its keys are refused
+// with errMoved naming owner, and the keys are deleted. It returns how
+// many keys were deleted.
+func (moves *migrations) release(hashes hashRange, owner string) (int, error) {
+	moves.mu.Lock()
+	moves.moved = append(moves.moved, movedRange{hashes, owner})
+	moves.fenced = slices.DeleteFunc(moves.fenced, func(fenced hashRange) bool {
+		return fenced == hashes
+	})
+	moves.mu.Unlock()
+
+	removed, err := moves.removeRange(hashes)
+	log.Printf("Moved hashes (%d, %d] to %s, removed %d keys", hashes.Start, hashes.End, owner, removed)
+	return removed, err
+}
+
+// removeRange deletes every key in hashes. The deletes are applied as
+// mutations so check does not refuse them, and replicas delete the keys
+// too.
+func (moves *migrations) removeRange(hashes hashRange) (int, error) {
+	keys, _, err := moves.rangeDigest(hashes, false)
+	if err != nil {
+		return 0, err
+	}
+	deletes := make([]kvstore.Mutation, len(keys))
+	for i, key := range keys {
+		deletes[i] = kvstore.Mutation{Type: kvstore.MutationDelete, Key: key}
+	}
+	if len(deletes) == 0 {
+		return 0, nil
+	}
+	return len(deletes), moves.role.kv.ApplyMutations(deletes)
+}
+
+// rangeDigest lists the keys in hashes from a snapshot and, if withValues
+// is set, sums a hash of each key and its value, so two nodes holding the
+// same keys and values get the same digest whatever order they list them
+// in.
+func (moves *migrations) rangeDigest(hashes hashRange, withValues bool) ([]string, uint64, error) {
+	snapshot, err := moves.role.kv.Snapshot()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer snapshot.Close()
+	all, err := snapshot.Keys()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var keys []string
+	var digest uint64
+	for _, key := range all {
+		if !hashes.contains(key) {
+			continue
+		}
+		if !withValues {
+			keys = append(keys, key)
+			continue
+		}
+		value, ok, err := snapshot.Get(key)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !ok {
+			continue
+		}
+		keys = append(keys, key)
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(key))
+		_, _ = h.Write([]byte{0, byte(value.Type)})
+		_, _ = h.Write([]byte(value.Data))
+		digest += h.Sum64()
+	}
+	return keys, digest, nil
+}
+
+func (moves *migrations) status() migrationResponse {
+	moves.mu.RLock()
+	defer moves.mu.RUnlock()
+
+	res := migrationResponse{Success: true, Fenced: slices.Clone(moves.fenced)}
+	for hashes, running := range moves.imports {
+		progress := running.replica.progress()
+		res.Imports = append(res.Imports, rangeImportResponse{
+			Start:  hashes.Start,
+			End:    hashes.End,
+			Source: running.source,
+			Synced: progress.synced,
+			Offset: progress.offset,
+		})
+	}
+	slices.SortFunc(res.Imports, func(a, b rangeImportResponse) int {
+		return cmp.Compare(a.Start, b.Start)
+	})
+	for _, moved := range moves.moved {
+		res.Moved = append(res.Moved, movedRangeResponse{moved.Start, moved.End, moved.owner})
+	}
+	return res
+}
+
+type migrationRequest struct {
+	Start uint32 `json:"start"`
+	End   uint32 `json:"end"`
+	// Source is the node to import from
+	Source string `json:"source,omitempty"`
+	// Owner is the node a released range now belongs to
+	Owner string `json:"owner,omitempty"`
+	// Keep ends an import keeping the keys it copied
+	Keep bool `json:"keep,omitempty"`
+}
+
+type rangeImportResponse struct {
+	Start  uint32 `json:"start"`
+	End    uint32 `json:"end"`
+	Source string `json:"source"`
+	Synced bool   `json:"synced"`
+	// Offset is the source's offset the import has caught up to
+	Offset uint64 `json:"offset"`
+}
+
+type movedRangeResponse struct {
+	Start uint32 `json:"start"`
+	End   uint32 `json:"end"`
+	Owner string `json:"owner"`
+}
+
+type migrationResponse struct {
+	Success bool                  `json:"success"`
+	Imports []rangeImportResponse `json:"imports,omitempty"`
+	Fenced  []hashRange           `json:"fenced,omitempty"`
+	Moved   []movedRangeResponse  `json:"moved,omitempty"`
+	// Keys counts the keys a digest covered or an operation deleted
+	Keys   int    `json:"keys,omitempty"`
+	Digest uint64 `json:"digest,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// handleMigration serves the routes the coordinator moves ranges of keys
+// between nodes with:
+//
+//	GET  /migration/status
+//	GET  /migration/digest?hashStart=a&hashEnd=b
+//	POST /migration/import     {"start":a,"end":b,"source":"http://owner:8080"}
+//	POST /migration/endimport  {"start":a,"end":b,"keep":true}
+//	POST /migration/fence      {"start":a,"end":b}
+//	POST /migration/unfence    {"start":a,"end":b}
+//	POST /migration/release    {"start":a,"end":b,"owner":"http://importer:8080"}
+//
+// Every route replies with the node's migrations.
+func handleMigration(w http.ResponseWriter, r *http.Request, moves *migrations, txns *participant, op string) {
+	w.Header().Set("Content-Type", "application/json")
+
+	want := http.MethodPost
+	if op == "status" || op == "digest" {
+		want = http.MethodGet
+	}
+	if r.Method != want {
+		writeMigrationError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req migrationRequest
+	if op == "digest" {
+		hashes, err := parseHashRange(r.URL.Query().Get("hashStart"), r.URL.Query().Get("hashEnd"))
+		if err != nil {
+			writeMigrationError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		req.Start, req.End = hashes.Start, hashes.End
+	} else if op != "status" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeMigrationError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+	}
+	hashes := hashRange{req.Start, req.End}
+
+	var keys int
+	var digest uint64
+	var err error
+	switch op {
+	case "digest":
+		var listed []string
+		listed, digest, err = moves.rangeDigest(hashes, true)
+		keys = len(listed)
+	case "import":
+		if req.Source == "" {
+			writeMigrationError(w, http.StatusBadRequest, "body must set 'source'")
+			return
+		}
+		err = moves.startImport(strings.TrimRight(req.Source, "/"), hashes)
+	case "endimport":
+		keys, err = moves.endImport(hashes, req.Keep)
+	case "fence":
+		err = moves.fence(hashes, txns)
+	case "unfence":
+		moves.unfence(hashes)
+	case "release":
+		if req.Owner == "" {
+			writeMigrationError(w, http.StatusBadRequest, "body must set 'owner'")
+			return
+		}
+		keys, err = moves.release(hashes, strings.TrimRight(req.Owner, "/"))
+	}
+	if err != nil {
+		writeMigrationError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	res := moves.status()
+	res.Keys, res.Digest = keys, digest
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+func writeMigrationError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(migrationResponse{
+		Success: false,
+		Error:   message,
+	})
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"blueis/internal/acl"
+	"blueis/internal/kvstore"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+type multiKeyEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type multiKeyRequest struct {
+	Keys    []string        `json:"keys,omitempty"`
+	Entries []multiKeyEntry `json:"entries,omitempty"`
+}
+
+// multiKeyResult is the outcome for one key. A key that does not exist has
+// neither a value nor an error. Misrouted marks keys the node no longer
+// owns, which the client should route again.
+type multiKeyResult struct {
+	Key       string  `json:"key"`
+	Value     *string `json:"value,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	Code      string  `json:"code,omitempty"`
+	Misrouted bool    `json:"misrouted,omitempty"`
+	// Deleted is set for a delete that removed the key
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+type multiKeyResponse struct {
+	Success bool             `json:"success"`
+	Results []multiKeyResult `json:"results,omitempty"`
+	Error   string           `json:"error,omitempty"`
+	Code    string           `json:"code,omitempty"`
+}
+
+// handleMultiKey reads or writes several keys in one round trip through
+// the store: POST /kv/mget {"keys":["a","b"]} or
+// POST /kv/mset {"entries":[{"key":"a","value":"1"}]}. The keys are not
+// handled atomically; each gets its own result, in the order sent, and the
+// reply is 200 even when some of them failed. With encoding=base64 the keys
+// are sent and returned in base64.
+func handleMultiKey(w http.ResponseWriter, r *http.Request, kv *kvstore.KeyValueService, op string) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(multiKeyResponse{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+	var req multiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err, "invalid JSON body")
+		return
+	}
+	err := decodeKeys(r, req.Keys)
+	if err == nil && base64Keys(r) {
+		for i := range req.Entries {
+			if req.Entries[i].Key, err = decodeKey(req.Entries[i].Key); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(multiKeyResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	var commands []kvstore.Command
+	keys, category := req.Keys, acl.Read
+	if op == "mset" {
+		category = acl.Write
+		for _, entry := range req.Entries {
+			keys = append(keys, entry.Key)
+		}
+	}
+	// Like MGET and MSET in Redis, a request naming any key the user may
+	// not access is refused as a whole
+	if err := checkKeys(r, category, keys...); err != nil {
+		writeErrorStatus(w, err, http.StatusForbidden)
+		_ = json.NewEncoder(w).Encode(multiKeyResponse{
+			Success: false,
+			Error:   err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	switch op {
+	case "mget":
+		for _, key := range req.Keys {
+			commands = append(commands, kvstore.Command{Type: kvstore.GET, Key: key})
+		}
+	case "mset":
+		for _, entry := range req.Entries {
+			commands = append(commands, kvstore.Command{Type: kvstore.PUT, Key: entry.Key, Value: &entry.Value})
+		}
+	}
+
+	results := make([]multiKeyResult, len(commands))
+	for i, result := range kv.SendBatchContext(r.Context(), commands) {
+		results[i].Key = encodeKey(r, commands[i].Key)
+		switch {
+		case op == "mget" && errors.Is(result.Err, kvstore.ErrKeyNotFound):
+		case result.Err != nil:
+			results[i].Error = result.Err.Error()
+			results[i].Code = errorCode(result.Err)
+			results[i].Misrouted = errorStatus(result.Err, 0) == http.StatusMisdirectedRequest
+		case op == "mget":
+			results[i].Value = result.Value
+		}
+	}
+	_ = json.NewEncoder(w).Encode(multiKeyResponse{
+		Success: true,
+		Results: results,
+	})
+}
+
+// batchCommand is one command of a /kv/batch request. A set may give its
+// key a TTL, as a PUT to /kv may.
+type batchCommand struct {
+	Op    string  `json:"op"`
+	Key   string  `json:"key"`
+	Value *string `json:"value,omitempty"`
+	TTL   *int64  `json:"ttl,omitempty"`
+	TTLMs *int64  `json:"ttlMs,omitempty"`
+}
+
+type batchRequest struct {
+	Commands []batchCommand `json:"commands"`
+}
+
+// handleBatch runs a mix of reads and writes in one round trip through the
+// store: POST /kv/batch
+// {"commands":[{"op":"set","key":"a","value":"1"},{"op":"get","key":"a"},{"op":"delete","key":"b"}]}.
+// The commands run in the order sent without other callers' commands in
+// between, but not atomically; each gets its own result, as with
+// /kv/mget and /kv/mset. A request with a malformed command, or naming any
+// key the user may not read or write as its command needs, is refused as a
+// whole.
+func handleBatch(w http.ResponseWriter, r *http.Request, kv *kvstore.KeyValueService) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(multiKeyResponse{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+	var req batchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err, "invalid JSON body")
+		return
+	}
+
+	commands := make([]kvstore.Command, len(req.Commands))
+	var err error
+	for i, command := range req.Commands {
+		if commands[i], err = batchStoreCommand(r, command); err != nil {
+			err = fmt.Errorf("command %d: %w", i, err)
+			break
+		}
+	}
+	if err != nil {
+		writeErrorStatus(w, err, http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(multiKeyResponse{
+			Success: false,
+			Error:   err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	for _, command := range commands {
+		category := acl.Read
+		if kvstore.IsMutation(command.Type) {
+			category = acl.Write
+		}
+		if err := checkKeys(r, category, command.Key); err != nil {
+			writeErrorStatus(w, err, http.StatusForbidden)
+			_ = json.NewEncoder(w).Encode(multiKeyResponse{
+				Success: false,
+				Error:   err.Error(),
+				Code:    errorCode(err),
+			})
+			return
+		}
+	}
+
+	results := make([]multiKeyResult, len(commands))
+	for i, result := range kv.SendBatchContext(r.Context(), commands) {
+		results[i].Key = encodeKey(r, commands[i].Key)
+		switch {
+		case commands[i].Type == kvstore.GET && errors.Is(result.Err, kvstore.ErrKeyNotFound):
+		case result.Err != nil:
+			results[i].Error = result.Err.Error()
+			results[i].Code = errorCode(result.Err)
+			results[i].Misrouted = errorStatus(result.Err, 0) == http.StatusMisdirectedRequest
+		case commands[i].Type == kvstore.GET:
+			results[i].Value = result.Value
+		case commands[i].Type == kvstore.DELETE:
+			results[i].Deleted = result.Value != nil
+		}
+	}
+	_ = json.NewEncoder(w).Encode(multiKeyResponse{
+		Success: true,
+		Results: results,
+	})
+}
+
+// batchStoreCommand turns a /kv/batch command into the store command it
+// runs.
+func batchStoreCommand(r *http.Request, command batchCommand) (kvstore.Command, error) {
+	key := command.Key
+	if key == "" {
+		return kvstore.Command{}, errors.New("missing 'key'")
+	}
+	if base64Keys(r) {
+		var err error
+		if key, err = decodeKey(key); err != nil {
+			return kvstore.Command{}, err
+		}
+	}
+	if command.Op != "set" && (command.Value != nil || command.TTL != nil || command.TTLMs != nil) {
+		return kvstore.Command{}, fmt.Errorf("only set takes a 'value', 'ttl' or 'ttlMs', not %s", command.Op)
+	}
+	switch command.Op {
+	case "get":
+		return kvstore.Command{Type: kvstore.GET, Key: key}, nil
+	case "delete":
+		return kvstore.Command{Type: kvstore.DELETE, Key: key}, nil
+	case "set":
+		if command.Value == nil {
+			return kvstore.Command{}, errors.New("set is missing 'value'")
+		}
+		ttl, err := setTTL(command.TTL, command.TTLMs)
+		if err != nil {
+			return kvstore.Command{}, err
+		}
+		return kvstore.Command{Type: kvstore.PUT, Key: key, Value: command.Value, TTL: ttl}, nil
+	}
+	return kvstore.Command{}, fmt.Errorf("unknown op %q, want get, set or delete", command.Op)
+}
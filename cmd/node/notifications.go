@@ -0,0 +1,101 @@
+package main
+
+import (
+	"blueis/internal/kvstore"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// notificationHeartbeat is how often an idle notification stream sends
+	// a heartbeat, so subscribers can tell a quiet node from a lost one
+	notificationHeartbeat = time.Second
+	// notificationBuffer is how many events a stream holds for a subscriber
+	// that is behind before dropping them
+	notificationBuffer = 10000
+)
+
+// notification is a line of a notification stream. Besides the store's
+// events, a stream sends "heartbeat" lines while idle and a "dropped" line
+// with Count when events were lost because the subscriber fell behind.
+type notification struct {
+	Type  string    `json:"type"`
+	Key   string    `json:"key,omitempty"`
+	Time  time.Time `json:"time,omitzero"`
+	Count uint64    `json:"count,omitempty"`
+}
+
+// handleNotifications streams keyspace events as lines of JSON until the
+// client goes away: GET /notifications?events=set,del,expired. events
+// defaults to expired. The stream opens with a heartbeat once the node is
+// subscribed, so every change after it is reported. Delivery is
+// best-effort, as for any subscriber, but a subscriber is told when it has
+// missed events, so one caching values can drop what it can no longer
+// trust.
+func handleNotifications(w http.ResponseWriter, r *http.Request, kv *kvstore.KeyValueService, shutdown context.Context) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	eventTypes := []string{kvstore.EventExpired}
+	if value := r.URL.Query().Get("events"); value != "" {
+		eventTypes = strings.Split(value, ",")
+		for _, eventType := range eventTypes {
+			switch eventType {
+			case kvstore.EventSet, kvstore.EventDel, kvstore.EventExpired:
+			default:
+				http.Error(w, "'events' must list set, del or expired, got "+strconv.Quote(eventType), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	subscription := kv.SubscribeTo(notificationBuffer, eventTypes...)
+	defer subscription.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(notification{Type: "heartbeat"}); err != nil {
+		return
+	}
+	flusher.Flush()
+	heartbeat := time.NewTicker(notificationHeartbeat)
+	defer heartbeat.Stop()
+	var dropped uint64
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-shutdown.Done():
+			return
+		case <-heartbeat.C:
+			err = encoder.Encode(notification{Type: "heartbeat"})
+		case event := <-subscription.Events():
+			err = encoder.Encode(notification{Type: event.Type, Key: event.Key, Time: event.Time})
+			// Send whatever else is already waiting along with it
+			for err == nil && len(subscription.Events()) > 0 {
+				event = <-subscription.Events()
+				err = encoder.Encode(notification{Type: event.Type, Key: event.Key, Time: event.Time})
+			}
+		}
+		if now := subscription.Dropped(); err == nil && now > dropped {
+			err = encoder.Encode(notification{Type: "dropped", Count: now - dropped})
+			dropped = now
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
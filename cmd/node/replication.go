@@ -0,0 +1,1012 @@
+package main
+
+import (
+	"blueis/internal/kvstore"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// replicationBatchSize caps the mutations sent in one frame
+	replicationBatchSize = 512
+	// replicationHeartbeat is how often an idle primary sends an empty
+	// frame, so replicas can tell a quiet primary from a dead one
+	replicationHeartbeat = time.Second
+	// replicationTimeout is how long a replica waits for a frame before
+	// reconnecting
+	replicationTimeout = 5 * replicationHeartbeat
+	// replicationRetry is how long a replica waits between attempts to
+	// reach its primary
+	replicationRetry = time.Second
+)
+
+// replicationFrame is the unit of the /replication/sync stream, which is a
+// sequence of gob-encoded frames: a header carrying ID and Offset, the
+// snapshot's mutations, a frame with Synced set, and then the primary's
+// mutations as they happen. A header with Partial set means the stream
+// resumed from the backlog and has no snapshot. The header's Replica names
+// the connection in the replica's acknowledgements. After the header,
+// Offset is the primary's offset when the frame was sent, which replicas
+// measure their lag against, and Through is the offset of the last change
+// the frame accounts for, which is later than its last mutation when a
+// filtered stream left changes out. Gob rather than JSON keeps binary
+// values, such as count-min sketches, intact.
+type replicationFrame struct {
+	ID        string
+	Offset    uint64
+	Through   uint64
+	Partial   bool
+	Replica   string
+	Synced    bool
+	Mutations []kvstore.Mutation
+}
+
+// handleReplicationSync streams the node's data to a replica:
+// GET /replication/sync, or GET /replication/sync?id=<id>&offset=<n> for a
+// replica that already holds everything up to offset n of run id and wants
+// to resume from there. Replicas across a WAN can add compress=gzip to have
+// the stream compressed, and lingerMs=<n> to have changes held back up to n
+// milliseconds so they are sent in fewer, larger frames. A node importing a
+// range of keys adds hashStart=<a>&hashEnd=<b> to be sent only the keys
+// whose hash is in the range. The snapshot is
+// sent at no more than syncRate bytes a second, if it is positive, so
+// bootstrapping a replica does not starve client traffic. The response
+// lasts as long as the replica stays connected and keeps up, or until
+// shutdown is done.
+func handleReplicationSync(w http.ResponseWriter, r *http.Request, role *replicationRole, buffer int, syncRate int64, shutdown context.Context) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	var linger time.Duration
+	if value := query.Get("lingerMs"); value != "" {
+		ms, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || ms < 0 {
+			http.Error(w, "'lingerMs' must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		linger = time.Duration(ms) * time.Millisecond
+	}
+
+	var hashes *hashRange
+	if query.Has("hashStart") || query.Has("hashEnd") {
+		parsed, err := parseHashRange(query.Get("hashStart"), query.Get("hashEnd"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hashes = &parsed
+	}
+	// filter drops the mutations of keys outside hashes in place
+	filter := func(batch []kvstore.Mutation) []kvstore.Mutation {
+		if hashes == nil {
+			return batch
+		}
+		return slices.DeleteFunc(batch, func(mutation kvstore.Mutation) bool {
+			return !hashes.contains(mutation.Key)
+		})
+	}
+
+	kv := role.kv
+	var stream *kvstore.ReplicationStream
+	var err error
+	if id := query.Get("id"); id != "" {
+		offset, parseErr := strconv.ParseUint(query.Get("offset"), 10, 64)
+		if parseErr != nil {
+			http.Error(w, "'offset' must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		stream, err = kv.ReplicateFrom(id, offset, buffer)
+	} else {
+		stream, err = kv.Replicate(buffer)
+	}
+	if err != nil {
+		writeErrorStatus(w, err, http.StatusInternalServerError)
+		_, _ = fmt.Fprintln(w, err.Error())
+		return
+	}
+	defer stream.Close()
+	connection := role.connect(r.RemoteAddr)
+	defer role.disconnect(connection)
+	if stream.Partial() {
+		replicationLog.Printf("Replica %s reconnected, resuming from offset %d", r.RemoteAddr, stream.Offset())
+	} else {
+		replicationLog.Printf("Replica %s connected, syncing from offset %d", r.RemoteAddr, stream.Offset())
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	var out io.Writer = w
+	var compressor *gzip.Writer
+	if query.Get("compress") == "gzip" {
+		w.Header().Set("Content-Encoding", "gzip")
+		compressor, _ = gzip.NewWriterLevel(w, gzip.BestSpeed)
+		defer compressor.Close()
+		out = compressor
+	}
+	encoder := gob.NewEncoder(out)
+	send := func(frame replicationFrame) error {
+		if err := encoder.Encode(frame); err != nil {
+			return err
+		}
+		if compressor != nil {
+			if err := compressor.Flush(); err != nil {
+				return err
+			}
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	if err := send(replicationFrame{ID: stream.ID(), Offset: stream.Offset(), Partial: stream.Partial(), Replica: connection.id}); err != nil {
+		return
+	}
+	// Stop waiting on the throttle if the replica goes or the node shuts down
+	syncCtx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	defer context.AfterFunc(shutdown, cancel)()
+	throttle := newSyncThrottle(syncRate)
+	var keys int
+	var size int64
+	batch := make([]kvstore.Mutation, 0, replicationBatchSize)
+	err = stream.Sync(func(mutation kvstore.Mutation) error {
+		if hashes != nil && !hashes.contains(mutation.Key) {
+			return nil
+		}
+		if mutation.Type == kvstore.MutationSet {
+			keys++
+		}
+		n := int64(len(mutation.Key) + len(mutation.Value))
+		size += n
+		if err := throttle.wait(syncCtx, n); err != nil {
+			return err
+		}
+		batch = append(batch, mutation)
+		if len(batch) < replicationBatchSize {
+			return nil
+		}
+		err := send(replicationFrame{Mutations: batch})
+		batch = batch[:0]
+		return err
+	})
+	if err == nil {
+		err = send(replicationFrame{Mutations: batch, Synced: true})
+	}
+	if err != nil {
+		replicationLog.Warnf("Syncing replica %s: %v", r.RemoteAddr, err)
+		return
+	}
+	if !stream.Partial() {
+		replicationLog.Printf("Sent snapshot of %d keys (%d bytes) to replica %s in %v", keys, size, r.RemoteAddr, throttle.elapsed().Round(time.Millisecond))
+	}
+	connection.sent.Store(stream.Offset())
+
+	heartbeat := time.NewTicker(replicationHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		batch = batch[:0]
+		select {
+		case <-r.Context().Done():
+			replicationLog.Printf("Replica %s disconnected", r.RemoteAddr)
+			return
+		case <-shutdown.Done():
+			return
+		case <-heartbeat.C:
+		case mutation, ok := <-stream.Mutations():
+			if !ok {
+				replicationLog.Warnf("Stopped streaming to replica %s: %v", r.RemoteAddr, stream.Err())
+				return
+			}
+			batch = append(batch, mutation)
+			// Send whatever else is already waiting along with it
+			for len(batch) < replicationBatchSize && len(stream.Mutations()) > 0 {
+				batch = append(batch, <-stream.Mutations())
+			}
+			if linger > 0 {
+				batch = lingerFor(stream, batch, linger)
+			}
+		}
+		var through uint64
+		if len(batch) > 0 {
+			through = batch[len(batch)-1].Offset
+		}
+		batch = filter(batch)
+		_, offset := kv.ReplicationOffset()
+		if err := send(replicationFrame{Offset: offset, Through: through, Mutations: batch}); err != nil {
+			replicationLog.Warnf("Streaming to replica %s: %v", r.RemoteAddr, err)
+			return
+		}
+		if through > 0 {
+			connection.sent.Store(through)
+		}
+	}
+}
+
+// lingerFor adds the mutations that arrive within linger to batch, until it
+// is full.
+func lingerFor(stream *kvstore.ReplicationStream, batch []kvstore.Mutation, linger time.Duration) []kvstore.Mutation {
+	timer := time.NewTimer(linger)
+	defer timer.Stop()
+	for len(batch) < replicationBatchSize {
+		select {
+		case mutation, ok := <-stream.Mutations():
+			if !ok {
+				// The caller finds out on its next receive
+				return batch
+			}
+			batch = append(batch, mutation)
+		case <-timer.C:
+			return batch
+		}
+	}
+	return batch
+}
+
+// syncThrottle paces a snapshot to an average of rate bytes a second from
+// when it started. A rate of zero or less does not limit it.
+type syncThrottle struct {
+	rate  int64
+	start time.Time
+	sent  int64
+}
+
+func newSyncThrottle(rate int64) *syncThrottle {
+	return &syncThrottle{rate: rate, start: time.Now()}
+}
+
+// wait accounts for n more bytes and sleeps until sending them keeps to the
+// rate, or until ctx is done.
+func (throttle *syncThrottle) wait(ctx context.Context, n int64) error {
+	throttle.sent += n
+	if throttle.rate <= 0 {
+		return nil
+	}
+	due := time.Duration(float64(throttle.sent) / float64(throttle.rate) * float64(time.Second))
+	ahead := due - throttle.elapsed()
+	if ahead <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(ahead)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (throttle *syncThrottle) elapsed() time.Duration {
+	return time.Since(throttle.start)
+}
+
+// replicationOptions tune how a replica follows its primary, mostly for
+// primaries in another region.
+type replicationOptions struct {
+	// compress asks the primary to gzip the stream
+	compress bool
+	// linger lets the primary hold changes back to batch them
+	linger time.Duration
+	// checkpoint is a file recording how far the replica has got, so it
+	// can resume after a restart instead of syncing from scratch
+	checkpoint string
+}
+
+// replicationRole tracks whether the node is a primary or a replica, and
+// switches between the two when failover promotes or demotes it.
+type replicationRole struct {
+	kv      *kvstore.KeyValueService
+	client  *http.Client
+	ctx     context.Context
+	options replicationOptions
+
+	mu      sync.Mutex
+	replica *replica
+	// stop ends replication and waits for the replica to finish
+	stop func()
+	// connections are the replicas streaming from this node, by ID
+	connections map[string]*replicaConnection
+	// acked is closed and replaced whenever a replica acknowledges changes
+	acked chan struct{}
+	// peers stop merging from each node this one peers with
+	peers []func()
+}
+
+// replicaConnection is a replica streaming from this node, the offset of
+// the last change sent to it, and the offset of the last change it has
+// acknowledged applying.
+type replicaConnection struct {
+	id    string
+	addr  string
+	sent  atomic.Uint64
+	acked atomic.Uint64
+}
+
+func (role *replicationRole) connect(addr string) *replicaConnection {
+	var id [8]byte
+	_, _ = rand.Read(id[:])
+	connection := &replicaConnection{id: hex.EncodeToString(id[:]), addr: addr}
+
+	role.mu.Lock()
+	defer role.mu.Unlock()
+	if role.connections == nil {
+		role.connections = make(map[string]*replicaConnection)
+	}
+	role.connections[connection.id] = connection
+	return connection
+}
+
+func (role *replicationRole) disconnect(connection *replicaConnection) {
+	role.mu.Lock()
+	defer role.mu.Unlock()
+	delete(role.connections, connection.id)
+}
+
+// acknowledge records that the replica on connection id has applied every
+// change up to offset. It reports whether the connection is still open.
+func (role *replicationRole) acknowledge(id string, offset uint64) bool {
+	role.mu.Lock()
+	defer role.mu.Unlock()
+	connection, ok := role.connections[id]
+	if !ok {
+		return false
+	}
+	if offset > connection.acked.Load() {
+		connection.acked.Store(offset)
+		if role.acked != nil {
+			close(role.acked)
+			role.acked = nil
+		}
+	}
+	return true
+}
+
+// wait blocks until at least replicas connected replicas have acknowledged
+// every change up to offset, or until timeout or ctx is done, and returns
+// how many have.
+func (role *replicationRole) wait(ctx context.Context, offset uint64, replicas int, timeout time.Duration) int {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		role.mu.Lock()
+		acked := 0
+		for _, connection := range role.connections {
+			if connection.acked.Load() >= offset {
+				acked++
+			}
+		}
+		if role.acked == nil {
+			role.acked = make(chan struct{})
+		}
+		signal := role.acked
+		role.mu.Unlock()
+
+		if acked >= replicas {
+			return acked
+		}
+		select {
+		case <-signal:
+		case <-timer.C:
+			return acked
+		case <-ctx.Done():
+			return acked
+		}
+	}
+}
+
+// follow makes the node a read-only replica of primary, replacing whatever
+// it replicated before.
+func (role *replicationRole) follow(primary string) {
+	role.mu.Lock()
+	defer role.mu.Unlock()
+
+	if role.stop != nil {
+		role.stop()
+	}
+	role.kv.SetReadOnly(true)
+	ctx, cancel := context.WithCancel(role.ctx)
+	role.replica = &replica{kv: role.kv, primary: primary, client: role.client, options: role.options}
+	if path := role.options.checkpoint; path != "" {
+		checkpoint, err := loadReplicationCheckpoint(path)
+		if err != nil {
+			replicationLog.Warnf("Ignoring replication checkpoint: %v", err)
+		} else if checkpoint.Primary == primary && checkpoint.ReplicationID != "" {
+			role.replica.state = replicaProgress{primaryID: checkpoint.ReplicationID, offset: checkpoint.Offset, synced: true}
+			replicationLog.Printf("Resuming replication from checkpoint at offset %d", checkpoint.Offset)
+		}
+	}
+	done := make(chan struct{})
+	go func(replica *replica) {
+		defer close(done)
+		replica.run(ctx)
+	}(role.replica)
+	role.stop = func() {
+		cancel()
+		<-done
+	}
+	replicationLog.Printf("Replicating %s", primary)
+}
+
+// promote stops replicating and makes the node a writable primary. It
+// reports whether the node was a replica.
+func (role *replicationRole) promote() bool {
+	role.mu.Lock()
+	defer role.mu.Unlock()
+
+	if role.replica == nil {
+		return false
+	}
+	role.stop()
+	role.replica, role.stop = nil, nil
+	role.kv.SetReadOnly(false)
+	replicationLog.Printf("Promoted to primary")
+	return true
+}
+
+// peer merges the counters and sets of the node at addr into this node's
+// as they change, for as long as the node runs. Unlike following a
+// primary, it leaves the node writable and every other key alone, so two
+// nodes peering with each other both accept writes and converge.
+func (role *replicationRole) peer(addr string) {
+	role.mu.Lock()
+	defer role.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(role.ctx)
+	// A checkpoint records progress against a primary, not a peer
+	options := role.options
+	options.checkpoint = ""
+	peer := &replica{kv: role.kv, primary: addr, client: role.client, options: options, merge: true}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		peer.run(ctx)
+	}()
+	role.peers = append(role.peers, func() {
+		cancel()
+		<-done
+	})
+	replicationLog.Printf("Merging CRDT namespaces from peer %s", addr)
+}
+
+// close stops replicating, leaving the node read-only, and stops merging
+// from peers, for shutdown.
+func (role *replicationRole) close() {
+	role.mu.Lock()
+	defer role.mu.Unlock()
+
+	if role.stop != nil {
+		role.stop()
+		role.stop = nil
+	}
+	for _, stop := range role.peers {
+		stop()
+	}
+	role.peers = nil
+}
+
+func (role *replicationRole) info() replicationInfoResponse {
+	role.mu.Lock()
+	replica := role.replica
+	connections := make([]*replicaConnection, 0, len(role.connections))
+	for _, connection := range role.connections {
+		connections = append(connections, connection)
+	}
+	role.mu.Unlock()
+
+	id, offset := role.kv.ReplicationOffset()
+	info := replicationInfoResponse{Success: true, Role: "primary", ReplicationID: id, Offset: offset}
+	for _, connection := range connections {
+		acked := connection.acked.Load()
+		info.Replicas = append(info.Replicas, replicaConnectionResponse{
+			Addr:   connection.addr,
+			Offset: connection.sent.Load(),
+			Acked:  acked,
+			Lag:    offset - min(acked, offset),
+		})
+	}
+	slices.SortFunc(info.Replicas, func(a, b replicaConnectionResponse) int {
+		return strings.Compare(a.Addr, b.Addr)
+	})
+	if replica != nil {
+		progress := replica.progress()
+		info.Role = "replica"
+		info.Primary = replica.primary
+		info.PrimaryReplicationID = progress.primaryID
+		info.PrimaryOffset = progress.offset
+		info.Synced = progress.synced
+		if progress.synced {
+			info.Lag = progress.primaryOffset - progress.offset
+			info.LagSeconds = time.Since(progress.caughtUpAt).Seconds()
+		}
+	}
+	return info
+}
+
+func (role *replicationRole) writeMetrics(b *strings.Builder) {
+	info := role.info()
+
+	b.WriteString("# HELP blueis_replication_offset Changes made by the store since it started.\n")
+	b.WriteString("# TYPE blueis_replication_offset counter\n")
+	fmt.Fprintf(b, "blueis_replication_offset %d\n", info.Offset)
+	b.WriteString("# HELP blueis_replication_connected_replicas Replicas streaming from this node.\n")
+	b.WriteString("# TYPE blueis_replication_connected_replicas gauge\n")
+	fmt.Fprintf(b, "blueis_replication_connected_replicas %d\n", len(info.Replicas))
+	if len(info.Replicas) > 0 {
+		b.WriteString("# HELP blueis_replication_replica_lag Changes each connected replica has yet to acknowledge.\n")
+		b.WriteString("# TYPE blueis_replication_replica_lag gauge\n")
+		for _, replica := range info.Replicas {
+			fmt.Fprintf(b, "blueis_replication_replica_lag{replica=%q} %d\n", replica.Addr, replica.Lag)
+		}
+	}
+	if info.Role != "replica" {
+		return
+	}
+	synced := 0
+	if info.Synced {
+		synced = 1
+	}
+	b.WriteString("# HELP blueis_replication_synced Whether this replica has finished copying its primary's data.\n")
+	b.WriteString("# TYPE blueis_replication_synced gauge\n")
+	fmt.Fprintf(b, "blueis_replication_synced %d\n", synced)
+	b.WriteString("# HELP blueis_replication_lag Changes the primary has made that this replica has not applied yet.\n")
+	b.WriteString("# TYPE blueis_replication_lag gauge\n")
+	fmt.Fprintf(b, "blueis_replication_lag %d\n", info.Lag)
+	b.WriteString("# HELP blueis_replication_lag_seconds Time since this replica last held every change its primary had made.\n")
+	b.WriteString("# TYPE blueis_replication_lag_seconds gauge\n")
+	fmt.Fprintf(b, "blueis_replication_lag_seconds %g\n", info.LagSeconds)
+}
+
+// replica keeps the node's data in step with a primary.
+type replica struct {
+	kv      *kvstore.KeyValueService
+	primary string
+	client  *http.Client
+	options replicationOptions
+	// merge makes the replica a peer: it merges the primary's counters and
+	// sets into the node's instead of copying everything
+	merge bool
+	// hashes, if set, limits the replica to the keys in the range, for a
+	// node importing the range from its owner
+	hashes *hashRange
+	// checkpointed is when the checkpoint was last saved
+	checkpointed time.Time
+
+	mu    sync.Mutex
+	state replicaProgress
+}
+
+// replicaProgress says how far a replica has caught up: it holds every
+// change up to offset in the primary's run primaryID. primaryOffset is the
+// primary's offset as of the latest frame, and caughtUpAt is when the
+// replica last held every change up to it. Since an idle primary only
+// sends heartbeats, caughtUpAt can be up to a heartbeat old even when the
+// replica is current.
+type replicaProgress struct {
+	primaryID     string
+	offset        uint64
+	synced        bool
+	primaryOffset uint64
+	caughtUpAt    time.Time
+}
+
+func (replica *replica) progress() replicaProgress {
+	replica.mu.Lock()
+	defer replica.mu.Unlock()
+	return replica.state
+}
+
+// startSync records that the replica is copying the primary's data from
+// scratch, so it holds no consistent offset until the sync is done.
+func (replica *replica) startSync(primaryID string) {
+	replica.mu.Lock()
+	defer replica.mu.Unlock()
+	replica.state = replicaProgress{primaryID: primaryID}
+}
+
+// advance records that the replica holds every change up to offset, as of
+// a frame sent when the primary was at primaryOffset.
+func (replica *replica) advance(offset uint64, primaryOffset uint64) {
+	replica.mu.Lock()
+	defer replica.mu.Unlock()
+	state := &replica.state
+	state.synced = true
+	state.offset = max(state.offset, offset)
+	state.primaryOffset = max(state.primaryOffset, primaryOffset, state.offset)
+	if state.offset >= state.primaryOffset {
+		state.caughtUpAt = time.Now()
+	}
+}
+
+// run follows the primary until ctx is done, reconnecting whenever the
+// connection drops.
+func (replica *replica) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		err := replica.follow(ctx)
+		if ctx.Err() != nil {
+			replica.saveCheckpoint(true)
+			return
+		}
+		replicationLog.Warnf("Replication from %s stopped, retrying: %v", replica.primary, err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(replicationRetry):
+		}
+	}
+}
+
+func (replica *replica) follow(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// Give up on a primary that stops sending, even heartbeats
+	watchdog := time.AfterFunc(replicationTimeout, cancel)
+	defer watchdog.Stop()
+
+	// Ask to resume where the last connection left off; the primary decides
+	// whether it can
+	query := url.Values{}
+	if progress := replica.progress(); progress.synced {
+		query.Set("id", progress.primaryID)
+		query.Set("offset", strconv.FormatUint(progress.offset, 10))
+	}
+	if replica.options.compress {
+		query.Set("compress", "gzip")
+	}
+	if replica.options.linger > 0 {
+		query.Set("lingerMs", strconv.FormatInt(replica.options.linger.Milliseconds(), 10))
+	}
+	if replica.hashes != nil {
+		query.Set("hashStart", strconv.FormatUint(uint64(replica.hashes.Start), 10))
+		query.Set("hashEnd", strconv.FormatUint(uint64(replica.hashes.End), 10))
+	}
+	target := replica.primary + "/replication/sync"
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	if replica.options.compress {
+		// Set explicitly, the transport leaves decompression to us
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+	resp, err := replica.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("primary replied %s", resp.Status)
+	}
+
+	var body io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		decompressor, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return fmt.Errorf("reading compressed stream: %w", err)
+		}
+		defer decompressor.Close()
+		body = decompressor
+	}
+	decoder := gob.NewDecoder(body)
+	next := func() (replicationFrame, error) {
+		var frame replicationFrame
+		if err := decoder.Decode(&frame); err != nil {
+			return frame, err
+		}
+		watchdog.Reset(replicationTimeout)
+		return frame, nil
+	}
+
+	header, err := next()
+	if err != nil {
+		return fmt.Errorf("reading header: %w", err)
+	}
+	acks := make(chan struct{}, 1)
+	go replica.acknowledge(ctx, header.Replica, acks)
+	applied := func() {
+		select {
+		case acks <- struct{}{}:
+		default:
+		}
+	}
+	if header.Partial {
+		replicationLog.Printf("Resuming from primary %s at offset %d", replica.primary, header.Offset)
+	} else {
+		replicationLog.Printf("Syncing from primary %s (replication ID %s, offset %d)", replica.primary, header.ID, header.Offset)
+		replica.startSync(header.ID)
+		replica.removeCheckpoint()
+	}
+
+	synced := make(map[string]struct{})
+	for {
+		frame, err := next()
+		if err != nil {
+			return fmt.Errorf("reading snapshot: %w", err)
+		}
+		for _, mutation := range frame.Mutations {
+			synced[mutation.Key] = struct{}{}
+		}
+		if err := replica.apply(frame.Mutations); err != nil {
+			return err
+		}
+		if frame.Synced {
+			break
+		}
+	}
+	if !header.Partial {
+		removed := 0
+		if !replica.merge {
+			removed, err = replica.removeUnsynced(synced)
+			if err != nil {
+				return err
+			}
+		}
+		replica.advance(header.Offset, header.Offset)
+		applied()
+		replica.saveCheckpoint(true)
+		replicationLog.Printf("Synced %d keys from primary %s, removed %d stale keys", len(synced), replica.primary, removed)
+	}
+
+	for {
+		frame, err := next()
+		if err != nil {
+			return err
+		}
+		if err := replica.apply(frame.Mutations); err != nil {
+			return err
+		}
+		through := frame.Through
+		if len(frame.Mutations) > 0 {
+			through = max(through, frame.Mutations[len(frame.Mutations)-1].Offset)
+		}
+		replica.advance(through, frame.Offset)
+		applied()
+		replica.saveCheckpoint(false)
+	}
+}
+
+func (replica *replica) apply(mutations []kvstore.Mutation) error {
+	if len(mutations) == 0 {
+		return nil
+	}
+	if replica.merge {
+		return replica.kv.MergeMutations(mutations)
+	}
+	return replica.kv.ApplyMutations(mutations)
+}
+
+// acknowledge tells the primary how far the replica has got each time
+// applied is signalled, until ctx is done. Signals that arrive while an
+// acknowledgement is in flight are folded into the next one, and nothing is
+// sent while the offset has not moved.
+func (replica *replica) acknowledge(ctx context.Context, connection string, applied <-chan struct{}) {
+	var acked uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-applied:
+		}
+		progress := replica.progress()
+		if !progress.synced || progress.offset == acked {
+			continue
+		}
+		data, _ := json.Marshal(replicationAckRequest{Replica: connection, Offset: progress.offset})
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, replica.primary+"/replication/ack", bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := replica.client.Do(req)
+		if err != nil {
+			// The stream notices if the primary is gone
+			continue
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			acked = progress.offset
+		}
+	}
+}
+
+// removeUnsynced deletes the keys the node held before syncing that the
+// primary's snapshot did not include. A replica limited to a range of
+// hashes only deletes keys in the range.
+func (replica *replica) removeUnsynced(synced map[string]struct{}) (int, error) {
+	snapshot, err := replica.kv.Snapshot()
+	if err != nil {
+		return 0, err
+	}
+	defer snapshot.Close()
+	keys, err := snapshot.Keys()
+	if err != nil {
+		return 0, err
+	}
+
+	var stale []kvstore.Mutation
+	for _, key := range keys {
+		if replica.hashes != nil && !replica.hashes.contains(key) {
+			continue
+		}
+		if _, ok := synced[key]; !ok {
+			stale = append(stale, kvstore.Mutation{Type: kvstore.MutationDelete, Key: key})
+		}
+	}
+	if len(stale) == 0 {
+		return 0, nil
+	}
+	return len(stale), replica.kv.ApplyMutations(stale)
+}
+
+type replicationAckRequest struct {
+	Replica string `json:"replica"`
+	Offset  uint64 `json:"offset"`
+}
+
+type replicationWaitRequest struct {
+	Replicas  int   `json:"replicas"`
+	TimeoutMs int64 `json:"timeoutMs"`
+}
+
+type replicationWaitResponse struct {
+	Success bool `json:"success"`
+	// Offset is the change the replicas were waited for, and Replicas how
+	// many had acknowledged it when the wait ended
+	Offset   uint64 `json:"offset"`
+	Replicas int    `json:"replicas"`
+	Error    string `json:"error,omitempty"`
+}
+
+type replicaOfRequest struct {
+	Primary string `json:"primary"`
+}
+
+type replicaConnectionResponse struct {
+	Addr string `json:"addr"`
+	// Offset is the last change sent to the replica, Acked the last one it
+	// has acknowledged applying, and Lag how many it has yet to acknowledge
+	Offset uint64 `json:"offset"`
+	Acked  uint64 `json:"acked"`
+	Lag    uint64 `json:"lag"`
+}
+
+type replicationInfoResponse struct {
+	Success       bool   `json:"success"`
+	Role          string `json:"role,omitempty"`
+	ReplicationID string `json:"replicationId,omitempty"`
+	// Offset is the last change this node made, including those applied
+	// from its primary
+	Offset   uint64                      `json:"offset"`
+	Replicas []replicaConnectionResponse `json:"replicas,omitempty"`
+	Primary  string                      `json:"primary,omitempty"`
+	// PrimaryOffset is how far a replica has caught up with its primary,
+	// which failover compares to pick the replica to promote
+	PrimaryReplicationID string `json:"primaryReplicationId,omitempty"`
+	PrimaryOffset        uint64 `json:"primaryOffset,omitempty"`
+	Synced               bool   `json:"synced,omitempty"`
+	// Lag counts the changes a synced replica has yet to apply, and
+	// LagSeconds is how long ago it last had all of them
+	Lag        uint64  `json:"lag,omitempty"`
+	LagSeconds float64 `json:"lagSeconds,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// handleReplication serves the replication admin routes:
+// GET /replication/info, POST /replication/promote, and
+// POST /replication/replicaof {"primary":"http://primary:8080"}.
+func handleReplication(w http.ResponseWriter, r *http.Request, role *replicationRole, op string) {
+	w.Header().Set("Content-Type", "application/json")
+
+	want := http.MethodPost
+	if op == "info" {
+		want = http.MethodGet
+	}
+	if r.Method != want {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(replicationInfoResponse{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+
+	switch op {
+	case "promote":
+		role.promote()
+	case "replicaof":
+		var req replicaOfRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Primary == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(replicationInfoResponse{
+				Success: false,
+				Error:   "body must be {\"primary\":\"<base URL>\"}",
+			})
+			return
+		}
+		role.follow(strings.TrimRight(req.Primary, "/"))
+	}
+	_ = json.NewEncoder(w).Encode(role.info())
+}
+
+// handleReplicationAck records a replica's acknowledgement:
+// POST /replication/ack {"replica":"<id from the stream header>","offset":42}.
+func handleReplicationAck(w http.ResponseWriter, r *http.Request, role *replicationRole) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req replicationAckRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if !role.acknowledge(req.Replica, req.Offset) {
+		http.Error(w, "unknown replica connection", http.StatusNotFound)
+	}
+}
+
+// handleReplicationWait blocks until enough replicas have applied every
+// change the node has made so far, like Redis's WAIT:
+// POST /replication/wait {"replicas":2,"timeoutMs":500}. It replies with
+// how many replicas had when the wait ended, which is fewer than asked for
+// if the timeout elapsed first.
+func handleReplicationWait(w http.ResponseWriter, r *http.Request, role *replicationRole) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(replicationWaitResponse{
+			Success: false,
+			Error:   "method not allowed",
+		})
+		return
+	}
+	var req replicationWaitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(replicationWaitResponse{
+			Success: false,
+			Error:   "invalid JSON body",
+		})
+		return
+	}
+	if req.Replicas < 1 || req.TimeoutMs <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(replicationWaitResponse{
+			Success: false,
+			Error:   "'replicas' and 'timeoutMs' must be positive",
+		})
+		return
+	}
+
+	_, offset := role.kv.ReplicationOffset()
+	acked := role.wait(r.Context(), offset, req.Replicas, time.Duration(req.TimeoutMs)*time.Millisecond)
+	_ = json.NewEncoder(w).Encode(replicationWaitResponse{
+		Success:  true,
+		Offset:   offset,
+		Replicas: acked,
+	})
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"blueis/internal/kvstore"
+	"blueis/internal/resp"
+	"errors"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// respHandler serves the string, hash and list commands over RESP, so
+// Redis clients can talk to the node directly: PING [message],
+// ECHO message, GET key, SET key value, SETNX key value, APPEND key value,
+// STRLEN key, GETRANGE key start end, SETRANGE key offset value,
+// MGET key [key ...], MSET key value [key value ...], DEL key [key ...],
+// OBJECT IDLETIME|FREQ key, HSET key field value [field value ...],
+// HGET key field, HDEL key field [field ...], HGETALL key,
+// HINCRBY key field increment, HLEN key, HEXISTS key field,
+// LPUSH|RPUSH key value [value ...], LPOP|RPOP key, LRANGE key start stop,
+// LINDEX key index and LLEN key. Commands go through the same store, and
+// so the same hooks, as the HTTP API.
+func respHandler(kv *kvstore.KeyValueService) resp.Handler {
+	return resp.HandlerFunc(func(w *resp.Writer, args [][]byte) {
+		name := strings.ToUpper(string(args[0]))
+		switch {
+		case name == "PING" && len(args) == 1:
+			_ = w.WriteSimpleString("PONG")
+		case name == "PING" && len(args) == 2, name == "ECHO" && len(args) == 2:
+			_ = w.WriteBulk(args[1])
+		case name == "GET" && len(args) == 2:
+			val, err := kv.Get(string(args[1]))
+			writeBulkOrNullReply(w, val, err)
+		case name == "SET" && len(args) == 3:
+			if _, err := kv.Set(string(args[1]), string(args[2])); err != nil {
+				_ = w.WriteError(respError(err))
+				return
+			}
+			_ = w.WriteSimpleString("OK")
+		case name == "SETNX" && len(args) == 3:
+			ok, err := kv.SetNX(string(args[1]), string(args[2]))
+			writeIntegerReply(w, boolInteger(ok), err)
+		case name == "APPEND" && len(args) == 3:
+			n, err := kv.Append(string(args[1]), string(args[2]))
+			writeIntegerReply(w, n, err)
+		case name == "STRLEN" && len(args) == 2:
+			n, err := kv.StrLen(string(args[1]))
+			writeIntegerReply(w, n, err)
+		case name == "GETRANGE" && len(args) == 4:
+			start, err1 := strconv.ParseInt(string(args[2]), 10, 64)
+			end, err2 := strconv.ParseInt(string(args[3]), 10, 64)
+			if err1 != nil || err2 != nil {
+				_ = w.WriteError(errNotInteger)
+				return
+			}
+			val, err := kv.GetRange(string(args[1]), start, end)
+			if err != nil {
+				_ = w.WriteError(respError(err))
+				return
+			}
+			_ = w.WriteBulkString(val)
+		case name == "SETRANGE" && len(args) == 4:
+			offset, err := strconv.ParseInt(string(args[2]), 10, 64)
+			if err != nil {
+				_ = w.WriteError(errNotInteger)
+				return
+			}
+			n, err := kv.SetRange(string(args[1]), offset, string(args[3]))
+			writeIntegerReply(w, n, err)
+		case name == "MGET" && len(args) >= 2:
+			keys := make([]string, len(args)-1)
+			for i, key := range args[1:] {
+				keys[i] = string(key)
+			}
+			values, err := kv.MGet(keys)
+			if err != nil {
+				_ = w.WriteError(respError(err))
+				return
+			}
+			_ = w.WriteArray(len(values))
+			for _, val := range values {
+				if val == nil {
+					_ = w.WriteNull()
+				} else {
+					_ = w.WriteBulkString(*val)
+				}
+			}
+		case name == "MSET" && len(args) >= 3 && len(args)%2 == 1:
+			entries := make(map[string]string, len(args)/2)
+			for i := 1; i < len(args); i += 2 {
+				entries[string(args[i])] = string(args[i+1])
+			}
+			if err := kv.MSet(entries); err != nil {
+				_ = w.WriteError(respError(err))
+				return
+			}
+			_ = w.WriteSimpleString("OK")
+		case name == "HSET" && len(args) >= 4 && len(args)%2 == 0:
+			values := make(map[string]string, len(args)/2-1)
+			for i := 2; i < len(args); i += 2 {
+				values[string(args[i])] = string(args[i+1])
+			}
+			n, err := kv.HSet(string(args[1]), values)
+			writeIntegerReply(w, n, err)
+		case name == "HGET" && len(args) == 3:
+			val, err := kv.HGet(string(args[1]), string(args[2]))
+			writeBulkOrNullReply(w, val, err)
+		case name == "HDEL" && len(args) >= 3:
+			fields := make([]string, len(args)-2)
+			for i, field := range args[2:] {
+				fields[i] = string(field)
+			}
+			n, err := kv.HDel(string(args[1]), fields...)
+			writeIntegerReply(w, n, err)
+		case name == "HGETALL" && len(args) == 2:
+			values, err := kv.HGetAll(string(args[1]))
+			if err != nil {
+				_ = w.WriteError(respError(err))
+				return
+			}
+			_ = w.WriteMap(len(values))
+			for _, field := range slices.Sorted(maps.Keys(values)) {
+				_ = w.WriteBulkString(field)
+				_ = w.WriteBulkString(values[field])
+			}
+		case name == "HINCRBY" && len(args) == 4:
+			delta, err := strconv.ParseInt(string(args[3]), 10, 64)
+			if err != nil {
+				_ = w.WriteError(errNotInteger)
+				return
+			}
+			n, err := kv.HIncrBy(string(args[1]), string(args[2]), delta)
+			writeIntegerReply(w, n, err)
+		case name == "HLEN" && len(args) == 2:
+			n, err := kv.HLen(string(args[1]))
+			writeIntegerReply(w, n, err)
+		case name == "HEXISTS" && len(args) == 3:
+			ok, err := kv.HExists(string(args[1]), string(args[2]))
+			writeIntegerReply(w, boolInteger(ok), err)
+		case (name == "LPUSH" || name == "RPUSH") && len(args) >= 3:
+			values := make([]string, len(args)-2)
+			for i, value := range args[2:] {
+				values[i] = string(value)
+			}
+			push := kv.RPush
+			if name == "LPUSH" {
+				push = kv.LPush
+			}
+			n, err := push(string(args[1]), values...)
+			writeIntegerReply(w, n, err)
+		case (name == "LPOP" || name == "RPOP") && len(args) == 2:
+			pop := kv.RPop
+			if name == "LPOP" {
+				pop = kv.LPop
+			}
+			val, err := pop(string(args[1]))
+			writeBulkOrNullReply(w, val, err)
+		case name == "LINDEX" && len(args) == 3:
+			index, err := strconv.ParseInt(string(args[2]), 10, 64)
+			if err != nil {
+				_ = w.WriteError(errNotInteger)
+				return
+			}
+			val, err := kv.LIndex(string(args[1]), index)
+			writeBulkOrNullReply(w, val, err)
+		case name == "LRANGE" && len(args) == 4:
+			start, err1 := strconv.ParseInt(string(args[2]), 10, 64)
+			stop, err2 := strconv.ParseInt(string(args[3]), 10, 64)
+			if err1 != nil || err2 != nil {
+				_ = w.WriteError(errNotInteger)
+				return
+			}
+			values, err := kv.LRange(string(args[1]), start, stop)
+			if err != nil {
+				_ = w.WriteError(respError(err))
+				return
+			}
+			_ = w.WriteArray(len(values))
+			for _, value := range values {
+				_ = w.WriteBulkString(value)
+			}
+		case name == "LLEN" && len(args) == 2:
+			n, err := kv.LLen(string(args[1]))
+			writeIntegerReply(w, n, err)
+		case name == "DEL" && len(args) >= 2:
+			var deleted int64
+			for _, key := range args[1:] {
+				val, err := kv.Delete(string(key))
+				if err != nil {
+					_ = w.WriteError(respError(err))
+					return
+				}
+				if val != nil {
+					deleted++
+				}
+			}
+			_ = w.WriteInteger(deleted)
+		case name == "OBJECT" && len(args) == 3 && strings.EqualFold(string(args[1]), "IDLETIME"):
+			idle, err := kv.IdleTime(string(args[2]))
+			switch {
+			case errors.Is(err, kvstore.ErrKeyNotFound):
+				_ = w.WriteNull()
+			case err != nil:
+				_ = w.WriteError(respError(err))
+			default:
+				_ = w.WriteInteger(int64(idle.Seconds()))
+			}
+		case name == "OBJECT" && len(args) == 3 && strings.EqualFold(string(args[1]), "FREQ"):
+			frequency, err := kv.Frequency(string(args[2]))
+			switch {
+			case errors.Is(err, kvstore.ErrKeyNotFound):
+				_ = w.WriteNull()
+			case err != nil:
+				_ = w.WriteError(respError(err))
+			default:
+				_ = w.WriteInteger(int64(frequency))
+			}
+		case name == "OBJECT" && len(args) >= 2:
+			_ = w.WriteError("ERR unknown subcommand '" + string(args[1]) + "'")
+		case name == "PING", name == "ECHO", name == "GET", name == "SET", name == "SETNX", name == "APPEND", name == "STRLEN",
+			name == "GETRANGE", name == "SETRANGE", name == "MGET", name == "MSET",
+			name == "HSET", name == "HGET", name == "HDEL", name == "HGETALL", name == "HINCRBY", name == "HLEN", name == "HEXISTS",
+			name == "LPUSH", name == "RPUSH", name == "LPOP", name == "RPOP", name == "LINDEX", name == "LRANGE", name == "LLEN", name == "DEL", name == "OBJECT":
+			_ = w.WriteError("ERR wrong number of arguments for '" + strings.ToLower(name) + "' command")
+		default:
+			_ = w.WriteError("ERR unknown command '" + string(args[0]) + "'")
+		}
+	})
+}
+
+// errNotInteger is the error Redis replies with for an argument that
+// should be an integer but is not.
+const errNotInteger = "ERR value is not an integer or out of range"
+
+func writeIntegerReply(w *resp.Writer, n int64, err error) {
+	if err != nil {
+		_ = w.WriteError(respError(err))
+		return
+	}
+	_ = w.WriteInteger(n)
+}
+
+// writeBulkOrNullReply writes val, or a null if it was not found.
+func writeBulkOrNullReply(w *resp.Writer, val *string, err error) {
+	switch {
+	case errors.Is(err, kvstore.ErrKeyNotFound):
+		_ = w.WriteNull()
+	case err != nil:
+		_ = w.WriteError(respError(err))
+	default:
+		_ = w.WriteBulkString(*val)
+	}
+}
+
+// boolInteger is the integer Redis replies with for a yes or no answer,
+// such as whether SETNX set its key.
+func boolInteger(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// respError turns err into a RESP error message. Errors whose message
+// already starts with an error code, such as WRONGTYPE or MOVED, keep it;
+// the rest are given one.
+func respError(err error) string {
+	msg := err.Error()
+	if errors.Is(err, kvstore.ErrReadOnly) {
+		return "READONLY " + msg
+	}
+	code, _, _ := strings.Cut(msg, " ")
+	if code != "" && strings.ToUpper(code) == code && strings.ToLower(code) != code {
+		return msg
+	}
+	return "ERR " + msg
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+const (
+	defaultShutdownTimeout = 5 * time.Second
+	// requestIDHeader carries the ID a request is logged under. One is made
+	// up for requests that arrive without it, and sent back either way
+	requestIDHeader = "X-Request-Id"
+)
+
+type panicResponse struct {
+	Success   bool   `json:"success"`
+	Error     string `json:"error"`
+	Code      string `json:"code"`
+	RequestID string `json:"requestId"`
+}
+
+// nodeServer is the node's HTTP server, serving TLS when it has a TLS
+// configuration.
+type nodeServer struct {
+	server          *http.Server
+	shutdownTimeout time.Duration
+}
+
+type serverOption func(*nodeServer)
+
+// withTLS serves HTTPS using config; nil keeps plain HTTP.
+func withTLS(config *tls.Config) serverOption {
+	return func(s *nodeServer) {
+		s.server.TLSConfig = config
+	}
+}
+
+// withShutdownTimeout bounds how long shutdown waits for requests in flight.
+func withShutdownTimeout(timeout time.Duration) serverOption {
+	return func(s *nodeServer) {
+		s.shutdownTimeout = timeout
+	}
+}
+
+// withOnShutdown runs f when shutdown starts, to end long-lived requests
+// such as replication and notification streams that would otherwise hold
+// it up.
+func withOnShutdown(f func()) serverOption {
+	return func(s *nodeServer) {
+		s.server.RegisterOnShutdown(f)
+	}
+}
+
+func newNodeServer(addr string, handler http.Handler, options ...serverOption) *nodeServer {
+	s := &nodeServer{
+		server:          &http.Server{Addr: addr, Handler: withRecovery(handler)},
+		shutdownTimeout: defaultShutdownTimeout,
+	}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+// start serves requests in the background, exiting the process if the
+// server fails.
+func (s *nodeServer) start() {
+	go func() {
+		httpLog.Printf("HTTP server listening on %s", s.server.Addr)
+		var err error
+		if s.server.TLSConfig != nil {
+			err = s.server.ListenAndServeTLS("", "")
+		} else {
+			err = s.server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			httpLog.Fatalf("HTTP server error: %v", err)
+		}
+	}()
+}
+
+// shutdown stops accepting requests and waits up to the shutdown timeout
+// for those in flight.
+func (s *nodeServer) shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
+
+// withRecovery answers a request whose handler panics with a 500 naming the
+// request's ID, and logs the panic under that ID with the stack it was
+// raised from, instead of leaving net/http to drop the connection. Handlers
+// run on the worker pool are wrapped again inside the worker, where that
+// stack is still intact.
+func withRecovery(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" {
+			id = newRequestID()
+			r.Header.Set(requestIDHeader, id)
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		defer func() {
+			value := recover()
+			if value == nil {
+				return
+			}
+			if value == http.ErrAbortHandler {
+				// Handlers abort responses this way on purpose
+				panic(value)
+			}
+			httpLog.Errorf("Request %s %s %s panicked: %v\n%s", id, r.Method, r.URL.Path, value, debug.Stack())
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			_ = json.NewEncoder(w).Encode(panicResponse{
+				Success:   false,
+				Error:     "internal error, see request " + id + " in the node's log",
+				Code:      "INTERNAL",
+				RequestID: id,
+			})
+		}()
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func newRequestID() string {
+	var id [8]byte
+	_, _ = rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"blueis/internal/kvstore"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// epochHeader carries the cluster's topology epoch. Clients send the epoch
+// their routing decision was made at, and every response carries the
+// newest epoch the node knows.
+const epochHeader = "X-Blueis-Epoch"
+
+var (
+	errStaleEpoch   = errors.New("STALE request was routed at an older epoch, fetch the topology and retry")
+	errSplitBrain   = errors.New("SPLITBRAIN two coordinators announced the same epoch, writes are refused until a newer one")
+	errLeaseExpired = errors.New("FENCED no epoch announced within -epoch-lease, writes are refused")
+)
+
+// topology tracks the newest epoch a coordinator has announced, and which
+// coordinator announced it. Epochs only go up, so announcements arriving
+// out of order are harmless. Writes are refused while two coordinators
+// claim the same epoch, or, with a lease, once the node has not heard from
+// its coordinator for that long, so a node cut off from a coordinator that
+// has moved its keys elsewhere stops accepting writes for them.
+type topology struct {
+	lease time.Duration
+
+	mu          sync.RWMutex
+	epoch       uint64
+	coordinator string
+	// conflict names a second coordinator that announced epoch
+	conflict string
+	renewed  time.Time
+}
+
+// current returns the newest epoch the node knows.
+func (t *topology) current() uint64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.epoch
+}
+
+// announce records coordinator announcing epoch. Announcing the current
+// epoch again renews the lease, older epochs are ignored, and the current
+// epoch announced by a different coordinator is a split brain, which is
+// returned as an error and fences writes until a newer epoch arrives.
+// Epoch 0 is no topology at all, so coordinators announce it to learn the
+// node's epoch without claiming one.
+func (t *topology) announce(epoch uint64, coordinator string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch {
+	case epoch > t.epoch, t.epoch == 0:
+		switch {
+		case epoch == t.epoch:
+		case t.coordinator != "" && t.coordinator != coordinator:
+			log.Printf("Coordinator %s took over from %s at epoch %d", coordinator, t.coordinator, epoch)
+		default:
+			log.Printf("Topology epoch is now %d", epoch)
+		}
+		t.epoch, t.coordinator, t.conflict = epoch, coordinator, ""
+		t.renewed = time.Now()
+	case epoch < t.epoch:
+	case coordinator == t.coordinator:
+		t.renewed = time.Now()
+	default:
+		if t.conflict == "" {
+			log.Printf("Coordinators %s and %s both announced epoch %d, refusing writes until a newer one", t.coordinator, coordinator, epoch)
+		}
+		t.conflict = coordinator
+		return fmt.Errorf("%w: %s announced epoch %d first", errSplitBrain, t.coordinator, epoch)
+	}
+	return nil
+}
+
+// writable returns why writes are refused, or nil if they are not.
+func (t *topology) writable() error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if t.conflict != "" {
+		return errSplitBrain
+	}
+	if t.lease > 0 && time.Since(t.renewed) > t.lease {
+		return errLeaseExpired
+	}
+	return nil
+}
+
+// check is a before-command hook refusing writes while the node is fenced.
+// Replicated changes are let through, as they were accepted by the node
+// they came from, and so are commits, whose transactions were prepared
+// before the fence.
+func (t *topology) check(command *kvstore.Command) error {
+	switch command.Type {
+	case kvstore.APPLYMUTATIONS, kvstore.MERGEMUTATIONS, kvstore.TXCOMMIT:
+		return nil
+	}
+	if !kvstore.IsMutation(command.Type) {
+		return nil
+	}
+	return t.writable()
+}
+
+type topologyRequest struct {
+	Epoch       uint64 `json:"epoch"`
+	Coordinator string `json:"coordinator"`
+}
+
+type topologyResponse struct {
+	Success     bool   `json:"success"`
+	Epoch       uint64 `json:"epoch"`
+	Coordinator string `json:"coordinator,omitempty"`
+	Conflict    string `json:"conflict,omitempty"`
+	Writable    bool   `json:"writable"`
+	// Capacity is reported to coordinators in reply to announcements
+	Capacity *capacityResponse `json:"capacity,omitempty"`
+	Error    string            `json:"error,omitempty"`
+	Code     string            `json:"code,omitempty"`
+}
+
+func (t *topology) response() topologyResponse {
+	writable := t.writable() == nil
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return topologyResponse{
+		Success:     true,
+		Epoch:       t.epoch,
+		Coordinator: t.coordinator,
+		Conflict:    t.conflict,
+		Writable:    writable,
+	}
+}
+
+// withEpoch stamps every response with the node's epoch and turns away
+// requests routed at an older one with 421, so the client fetches the
+// topology again instead of acting on a routing decision that may no
+// longer hold. Requests without an epoch, such as those between nodes, are
+// always served.
+func withEpoch(t *topology, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := t.current()
+		w.Header().Set(epochHeader, strconv.FormatUint(current, 10))
+
+		if value := r.Header.Get(epochHeader); value != "" {
+			epoch, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				_ = json.NewEncoder(w).Encode(response{
+					Success: false,
+					Error:   epochHeader + " must be a non-negative integer",
+				})
+				return
+			}
+			if epoch < current {
+				w.Header().Set("Content-Type", "application/json")
+				writeErrorStatus(w, errStaleEpoch, http.StatusMisdirectedRequest)
+				_ = json.NewEncoder(w).Encode(response{
+					Success: false,
+					Error:   errStaleEpoch.Error(),
+					Code:    errorCode(errStaleEpoch),
+				})
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// handleTopology reports the node's epoch and whether it accepts writes,
+// GET /topology, or takes an announcement from a coordinator,
+// POST /topology {"epoch":7,"coordinator":"c1"}. Either way it replies with
+// the epoch the node knows and the coordinator that announced it, which
+// tell a coordinator announcing an older epoch that another has taken
+// over, and with the node's capacity. A split brain is answered with 409.
+func handleTopology(w http.ResponseWriter, r *http.Request, t *topology, keyspace *keyspaceAnalyzer) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		var req topologyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Coordinator == "" {
+			res := t.response()
+			res.Success = false
+			res.Error = "body must be {\"epoch\":<epoch>,\"coordinator\":\"<id>\"}"
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(res)
+			return
+		}
+		err := t.announce(req.Epoch, req.Coordinator)
+		w.Header().Set(epochHeader, strconv.FormatUint(t.current(), 10))
+		if err != nil {
+			res := t.response()
+			res.Success = false
+			res.Error = err.Error()
+			res.Code = errorCode(err)
+			w.WriteHeader(http.StatusConflict)
+			_ = json.NewEncoder(w).Encode(res)
+			return
+		}
+	default:
+		res := t.response()
+		res.Success = false
+		res.Error = "method not allowed"
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	res := t.response()
+	res.Capacity = nodeCapacity(keyspace)
+	_ = json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"blueis/internal/kvstore"
+	"blueis/internal/twophase"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+type transactionRequest struct {
+	ID         string               `json:"id"`
+	Operations []twophase.Operation `json:"ops,omitempty"`
+}
+
+type transactionResponse struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+	Code    string `json:"code,omitempty"`
+}
+
+// participant is the node's side of two-phase commit. A transaction is
+// logged once it is prepared and removed from the log once it commits or
+// aborts, so a node that restarts in between prepares it again and still
+// holds its keys when the coordinator sends the decision.
+type participant struct {
+	kv  *kvstore.KeyValueService
+	log *twophase.Log
+	// moves refuses transactions writing to keys the node is handing over
+	moves *migrations
+}
+
+// recoverPrepared prepares every transaction left in the log by a previous
+// run.
+func (p *participant) recoverPrepared() (int, error) {
+	records, err := p.log.Records()
+	if err != nil {
+		return 0, err
+	}
+	for id, data := range records {
+		var operations []twophase.Operation
+		if err := json.Unmarshal(data, &operations); err != nil {
+			return 0, fmt.Errorf("decoding transaction %s: %w", id, err)
+		}
+		if err := p.kv.PrepareTransaction(id, transactionCommands(operations)); err != nil {
+			return 0, fmt.Errorf("preparing transaction %s: %w", id, err)
+		}
+	}
+	return len(records), nil
+}
+
+func (p *participant) prepare(ctx context.Context, id string, operations []twophase.Operation) error {
+	if err := p.moves.checkKeys(operations); err != nil {
+		return err
+	}
+	data, err := json.Marshal(operations)
+	if err != nil {
+		return err
+	}
+	if err := p.kv.PrepareTransactionContext(ctx, id, transactionCommands(operations)); err != nil {
+		return err
+	}
+	// Vote yes only once the prepare would survive a restart
+	if err := p.log.Write(id, data); err != nil {
+		_ = p.kv.AbortTransaction(id)
+		return err
+	}
+	return nil
+}
+
+func (p *participant) commit(ctx context.Context, id string) error {
+	// A transaction that is not prepared here was committed by an earlier
+	// attempt whose reply the coordinator never received
+	if err := p.kv.CommitTransactionContext(ctx, id); err != nil && !errors.Is(err, kvstore.ErrTransactionNotFound) {
+		return err
+	}
+	return p.log.Remove(id)
+}
+
+func (p *participant) abort(ctx context.Context, id string) error {
+	if err := p.kv.AbortTransactionContext(ctx, id); err != nil {
+		return err
+	}
+	return p.log.Remove(id)
+}
+
+func transactionCommands(operations []twophase.Operation) []kvstore.Command {
+	commands := make([]kvstore.Command, len(operations))
+	for i, operation := range operations {
+		if operation.Op == twophase.OpDelete {
+			commands[i] = kvstore.Command{Type: kvstore.DELETE, Key: operation.Key}
+		} else {
+			value := operation.Value
+			commands[i] = kvstore.Command{Type: kvstore.PUT, Key: operation.Key, Value: &value}
+		}
+	}
+	return commands
+}
+
+// handleTransaction serves the participant routes used by the coordinator:
+//
+//	POST /txn/prepare  {"id":"tx1","ops":[{"op":"set","key":"a","value":"1"},{"op":"delete","key":"b"}]}
+//	POST /txn/commit   {"id":"tx1"}
+//	POST /txn/abort    {"id":"tx1"}
+//
+// A prepare that fails is a no vote: 409 if another prepared transaction
+// holds one of the keys.
+func handleTransaction(w http.ResponseWriter, r *http.Request, p *participant, op string) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		writeTransactionError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req transactionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeTransactionError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if err := twophase.ValidateID(req.ID); err != nil {
+		writeTransactionError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var err error
+	switch op {
+	case "prepare":
+		if len(req.Operations) == 0 {
+			writeTransactionError(w, http.StatusBadRequest, "body must set 'ops'")
+			return
+		}
+		for _, operation := range req.Operations {
+			if validateErr := operation.Validate(); validateErr != nil {
+				writeTransactionError(w, http.StatusBadRequest, validateErr.Error())
+				return
+			}
+		}
+		err = p.prepare(r.Context(), req.ID, req.Operations)
+	case "commit":
+		err = p.commit(r.Context(), req.ID)
+	case "abort":
+		err = p.abort(r.Context(), req.ID)
+	}
+	if err != nil {
+		writeErrorStatus(w, err, http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(transactionResponse{
+			Success: false,
+			Error:   err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(transactionResponse{Success: true})
+}
+
+func writeTransactionError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(transactionResponse{
+		Success: false,
+		Error:   message,
+	})
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"blueis/internal/kvstore"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// warmupProgressInterval is how many keys are warmed between progress
+// messages in the log.
+const warmupProgressInterval = 10000
+
+type warmupResponse struct {
+	Keys      int     `json:"keys"`
+	Total     int     `json:"total"`
+	Missing   int     `json:"missing"`
+	Progress  float64 `json:"progress"`
+	ElapsedMs int64   `json:"elapsedMs"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type readyResponse struct {
+	Ready bool `json:"ready"`
+	// Phase is warming, syncing, stopping, stopped or ready
+	Phase  string         `json:"phase"`
+	Warmup warmupResponse `json:"warmup"`
+	Error  string         `json:"error,omitempty"`
+}
+
+// warmup tracks the node's start-up work, for /readyz. The node listens as
+// soon as its store is open, so health checks and replication can reach it,
+// but is not ready for traffic until it has read every key listed in
+// -warmup-file, pulling them into memory and into the access statistics,
+// and, as a replica, copied its primary's data.
+type warmup struct {
+	mu       sync.Mutex
+	started  time.Time
+	finished time.Time
+	keys     int
+	total    int
+	missing  int
+	err      error
+	stopping bool
+}
+
+func newWarmup() *warmup {
+	return &warmup{started: time.Now()}
+}
+
+// run reads every key listed in path, one per line, skipping blank lines
+// and those starting with #. Keys that no longer exist are counted as
+// missing. A warmup file that cannot be read is logged and the node made
+// ready without it, since a cold node is better than none.
+func (warm *warmup) run(kv *kvstore.KeyValueService, path string) {
+	defer warm.finish()
+	if path == "" {
+		return
+	}
+
+	keys, err := readWarmupFile(path)
+	if err != nil {
+		warm.fail(err)
+		return
+	}
+	warm.mu.Lock()
+	warm.total = len(keys)
+	warm.mu.Unlock()
+	log.Printf("Warming up %d keys from %s", len(keys), path)
+
+	missing := 0
+	for i, key := range keys {
+		_, err := kv.Get(key)
+		gone := errors.Is(err, kvstore.ErrKeyNotFound)
+		if err != nil && !gone {
+			warm.fail(fmt.Errorf("warming up key %s: %w", key, err))
+			return
+		}
+		warm.mu.Lock()
+		warm.keys++
+		if gone {
+			warm.missing++
+			missing++
+		}
+		warm.mu.Unlock()
+		if (i+1)%warmupProgressInterval == 0 {
+			log.Printf("Warmed up %d of %d keys", i+1, len(keys))
+		}
+	}
+	log.Printf("Warmed up %d keys in %v, %d no longer exist", len(keys), time.Since(warm.started).Round(time.Millisecond), missing)
+}
+
+func readWarmupFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading warmup file: %w", err)
+	}
+	defer file.Close()
+
+	var keys []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading warmup file: %w", err)
+	}
+	return keys, nil
+}
+
+func (warm *warmup) fail(err error) {
+	log.Printf("Warmup stopped, starting cold: %v", err)
+	warm.mu.Lock()
+	defer warm.mu.Unlock()
+	warm.err = err
+}
+
+func (warm *warmup) finish() {
+	warm.mu.Lock()
+	defer warm.mu.Unlock()
+	warm.finished = time.Now()
+}
+
+// stop marks the node as no longer ready, so load balancers move traffic
+// away while it shuts down.
+func (warm *warmup) stop() {
+	warm.mu.Lock()
+	defer warm.mu.Unlock()
+	warm.stopping = true
+}
+
+func (warm *warmup) response() (warmupResponse, bool, bool) {
+	warm.mu.Lock()
+	defer warm.mu.Unlock()
+
+	res := warmupResponse{Keys: warm.keys, Total: warm.total, Missing: warm.missing, Progress: 1}
+	if warm.total > 0 {
+		res.Progress = float64(warm.keys) / float64(warm.total)
+	}
+	if warm.err != nil {
+		res.Error = warm.err.Error()
+	}
+	finished := !warm.finished.IsZero()
+	if finished {
+		res.ElapsedMs = warm.finished.Sub(warm.started).Milliseconds()
+	} else {
+		res.ElapsedMs = time.Since(warm.started).Milliseconds()
+	}
+	return res, finished, warm.stopping
+}
+
+// handleReady reports whether the node is ready for traffic: GET /readyz.
+// It answers 503 while the node warms up, while a replica copies its
+// primary's data, once the store has stopped and while the node shuts down.
+func handleReady(w http.ResponseWriter, r *http.Request, kv *kvstore.KeyValueService, warm *warmup, role *replicationRole) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_ = json.NewEncoder(w).Encode(readyResponse{
+			Error: "method not allowed",
+		})
+		return
+	}
+
+	progress, warmed, stopping := warm.response()
+	res := readyResponse{Phase: "ready", Warmup: progress}
+	switch info := role.info(); {
+	case stopping:
+		res.Phase = "stopping"
+	case !kv.Health().Running:
+		res.Phase = "stopped"
+	case !warmed:
+		res.Phase = "warming"
+	case info.Role == "replica" && !info.Synced:
+		res.Phase = "syncing"
+	}
+	res.Ready = res.Phase == "ready"
+	if !res.Ready {
+		w.Header().Set("Retry-After", retryAfterSeconds)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,269 @@
+package acl
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrUnauthenticated is returned for a request without a known API key.
+	ErrUnauthenticated = errors.New("authentication required")
+	// ErrNoPermission is returned for a command a user may not run, or a
+	// key it may not touch.
+	ErrNoPermission = errors.New("no permission")
+)
+
+// Category groups commands by what they can do. Every command belongs to
+// one category, and a user may run the commands of the categories it is
+// granted.
+type Category uint8
+
+const (
+	// Read covers commands that read the keys they name
+	Read Category = 1 << iota
+	// Write covers commands that change the keys they name
+	Write
+	// Admin covers commands about the node or its whole keyspace rather
+	// than named keys, such as stats, replication and listing keys
+	Admin
+	// Dangerous covers commands that can lose data or take the node out of
+	// service, such as flushes, restores and promoting a replica
+	Dangerous
+
+	All = Read | Write | Admin | Dangerous
+)
+
+var categoryNames = []struct {
+	category Category
+	name     string
+}{
+	{Read, "read"},
+	{Write, "write"},
+	{Admin, "admin"},
+	{Dangerous, "dangerous"},
+}
+
+func (category Category) String() string {
+	var names []string
+	for _, c := range categoryNames {
+		if category&c.category != 0 {
+			names = append(names, c.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+// User is who a request was made by, and what it may do.
+type User struct {
+	Name string
+	// Limits caps the operations the user may run, as a Meter enforces
+	// them
+	Limits     Limits
+	categories Category
+	// allKeys is set when one of patterns matches every key, so the common
+	// unrestricted user skips matching altogether
+	allKeys  bool
+	patterns []pattern
+}
+
+// Allows reports whether user may run commands of category on every one of
+// keys, returning an error wrapping ErrNoPermission that says why not.
+func (user *User) Allows(category Category, keys ...string) error {
+	if user.categories&category != category {
+		return fmt.Errorf("%w: user %s may not run %s commands", ErrNoPermission, user.Name, category)
+	}
+	if user.allKeys {
+		return nil
+	}
+	for _, key := range keys {
+		if !user.allowsKey(key) {
+			return fmt.Errorf("%w: user %s may not access key %s", ErrNoPermission, user.Name, key)
+		}
+	}
+	return nil
+}
+
+func (user *User) allowsKey(key string) bool {
+	for _, p := range user.patterns {
+		if p.match(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// ACL is a set of users, found by the API keys they authenticate with.
+// Keys are held as their SHA-256, so an ACL file can list hashes rather
+// than the keys themselves.
+type ACL struct {
+	users map[[sha256.Size]byte]*User
+	// signingKeys holds the HMAC keys users sign requests with, by id
+	signingKeys map[string]signingKey
+	// byName finds the users tokens are minted for
+	byName map[string]*User
+}
+
+// Authenticate returns the user whose API key is key.
+func (acl *ACL) Authenticate(key string) (*User, error) {
+	if key != "" {
+		if user, ok := acl.users[sha256.Sum256([]byte(key))]; ok {
+			return user, nil
+		}
+	}
+	return nil, ErrUnauthenticated
+}
+
+// Load reads the ACL file at path, as Parse does.
+func Load(path string) (*ACL, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading ACL file: %w", err)
+	}
+	defer file.Close()
+
+	acl, err := Parse(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return acl, nil
+}
+
+// Parse reads one user per line, in the style of Redis ACL rules:
+//
+//	user <name> <rule>...
+//
+// with rules
+//
+//	><key>         an API key the user authenticates with
+//	#<sha256>      the hex SHA-256 of such a key
+//	hmac=<id>:<secret>
+//	               a key the user signs requests with, as Sign does
+//	~<pattern>     keys the user may access, where * matches any run of
+//	               characters, ? any one character and \ escapes the next
+//	allkeys        the same as ~*
+//	+@<category>   commands the user may run: read, write, admin,
+//	               dangerous or all
+//	rate=<n>       operations a second the user may sustain
+//	burst=<n>      operations the user may run at once, rate if unset
+//	quota=<n>      operations the user may run each UTC day
+//
+// A user without key patterns may only run commands that name no keys.
+// Blank lines and lines starting with # are skipped.
+func Parse(r io.Reader) (*ACL, error) {
+	acl := &ACL{
+		users:       make(map[[sha256.Size]byte]*User),
+		signingKeys: make(map[string]signingKey),
+		byName:      make(map[string]*User),
+	}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if fields[0] != "user" || len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: want user <name> <rule>...", line)
+		}
+		user := &User{Name: fields[1]}
+		if _, ok := acl.byName[user.Name]; ok {
+			return nil, fmt.Errorf("line %d: user %s is listed twice", line, user.Name)
+		}
+		acl.byName[user.Name] = user
+
+		var hashes [][sha256.Size]byte
+		var signing int
+		for _, rule := range fields[2:] {
+			switch {
+			case strings.HasPrefix(rule, "hmac="):
+				id, secret, _ := strings.Cut(rule[len("hmac="):], ":")
+				if id == "" || secret == "" {
+					return nil, fmt.Errorf("line %d: want hmac=<id>:<secret>", line)
+				}
+				if other, ok := acl.signingKeys[id]; ok {
+					return nil, fmt.Errorf("line %d: HMAC key %s is already user %s's", line, id, other.user.Name)
+				}
+				acl.signingKeys[id] = signingKey{user: user, secret: []byte(secret)}
+				signing++
+			case strings.HasPrefix(rule, ">") && len(rule) > 1:
+				hashes = append(hashes, sha256.Sum256([]byte(rule[1:])))
+			case strings.HasPrefix(rule, "#"):
+				var hash [sha256.Size]byte
+				if n, err := hex.Decode(hash[:], []byte(rule[1:])); err != nil || n != sha256.Size {
+					return nil, fmt.Errorf("line %d: %q is not a hex SHA-256", line, rule)
+				}
+				hashes = append(hashes, hash)
+			case rule == "allkeys":
+				user.allKeys = true
+			case strings.HasPrefix(rule, "~") && len(rule) > 1:
+				p := compilePattern(rule[1:])
+				user.allKeys = user.allKeys || p.matchesAll()
+				user.patterns = append(user.patterns, p)
+			case strings.HasPrefix(rule, "rate="):
+				rate, err := strconv.ParseFloat(rule[len("rate="):], 64)
+				if err != nil || rate <= 0 || math.IsInf(rate, 0) {
+					return nil, fmt.Errorf("line %d: %q must set a positive number", line, rule)
+				}
+				user.Limits.Rate = rate
+			case strings.HasPrefix(rule, "burst="):
+				burst, err := strconv.Atoi(rule[len("burst="):])
+				if err != nil || burst <= 0 {
+					return nil, fmt.Errorf("line %d: %q must set a positive integer", line, rule)
+				}
+				user.Limits.Burst = burst
+			case strings.HasPrefix(rule, "quota="):
+				quota, err := strconv.ParseInt(rule[len("quota="):], 10, 64)
+				if err != nil || quota <= 0 {
+					return nil, fmt.Errorf("line %d: %q must set a positive integer", line, rule)
+				}
+				user.Limits.Quota = quota
+			case strings.HasPrefix(rule, "+@"):
+				category, err := parseCategory(rule[2:])
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", line, err)
+				}
+				user.categories |= category
+			default:
+				return nil, fmt.Errorf("line %d: unknown rule %q", line, rule)
+			}
+		}
+		if user.Limits.Burst > 0 && user.Limits.Rate == 0 {
+			return nil, fmt.Errorf("line %d: user %s sets burst without rate", line, user.Name)
+		}
+		if len(hashes) == 0 && signing == 0 {
+			return nil, fmt.Errorf("line %d: user %s has no API key", line, user.Name)
+		}
+		for _, hash := range hashes {
+			if other, ok := acl.users[hash]; ok {
+				return nil, fmt.Errorf("line %d: user %s shares an API key with user %s", line, user.Name, other.Name)
+			}
+			acl.users[hash] = user
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+func parseCategory(name string) (Category, error) {
+	if name == "all" {
+		return All, nil
+	}
+	for _, c := range categoryNames {
+		if c.name == name {
+			return c.category, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown command category %q, want read, write, admin, dangerous or all", name)
+}
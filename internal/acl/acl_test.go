@@ -0,0 +1,109 @@
+package acl
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func parseTestACL(t *testing.T, text string) *ACL {
+	t.Helper()
+	acl, err := Parse(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("Parse returned error: %v", err)
+	}
+	return acl
+}
+
+func TestACL_AuthenticateByKeyOrHash(t *testing.T) {
+	hash := sha256.Sum256([]byte("ops-key"))
+	acl := parseTestACL(t, `
+# the application, and an operator listed by hash
+user app >app-key ~user:* +@read +@write
+user ops #`+hex.EncodeToString(hash[:])+` allkeys +@all
+`)
+
+	for key, want := range map[string]string{"app-key": "app", "ops-key": "ops"} {
+		user, err := acl.Authenticate(key)
+		if err != nil || user.Name != want {
+			t.Fatalf("Authenticate(%q) = (%v, %v), want %s", key, user, err, want)
+		}
+	}
+	for _, key := range []string{"", "guess"} {
+		if _, err := acl.Authenticate(key); !errors.Is(err, ErrUnauthenticated) {
+			t.Fatalf("Authenticate(%q) returned %v, want ErrUnauthenticated", key, err)
+		}
+	}
+}
+
+func TestUser_AllowsCategoriesAndPatterns(t *testing.T) {
+	acl := parseTestACL(t, `user app >k ~user:* ~session:?? ~config +@read +@write`)
+	user, _ := acl.Authenticate("k")
+
+	tests := []struct {
+		category Category
+		keys     []string
+		allowed  bool
+	}{
+		{Read, []string{"user:1", "config"}, true},
+		{Write, []string{"session:ab"}, true},
+		{Read, []string{"session:abc"}, false},
+		{Read, []string{"user:1", "order:1"}, false},
+		{Read, []string{"config:x"}, false},
+		{Read | Write, nil, true},
+		{Admin, nil, false},
+		{Dangerous, []string{"user:1"}, false},
+	}
+	for _, test := range tests {
+		err := user.Allows(test.category, test.keys...)
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("Allows(%s, %q) returned %v, want allowed %v", test.category, test.keys, err, test.allowed)
+		}
+		if err != nil && !errors.Is(err, ErrNoPermission) {
+			t.Errorf("Allows(%s, %q) returned %v, want ErrNoPermission", test.category, test.keys, err)
+		}
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		glob, key string
+		want      bool
+	}{
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+		{"*:profile", "user:1:profile", true},
+		{"*:profile", "user:1:profiles", false},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{`literal\*`, "literal*", true},
+		{`literal\*`, "literally", false},
+		{"**", "", true},
+	}
+	for _, test := range tests {
+		if got := compilePattern(test.glob).match(test.key); got != test.want {
+			t.Errorf("%q matching %q = %v, want %v", test.glob, test.key, got, test.want)
+		}
+	}
+}
+
+func TestParse_RejectsInvalidRules(t *testing.T) {
+	for _, text := range []string{
+		"user app ~* +@all",
+		"user app >k +@everything",
+		"user app >k -@read",
+		"user app >k\nuser app >j",
+		"user app >k\nuser other >k",
+		"user app #abcd",
+		"app >k",
+		"user app >k rate=0",
+		"user app >k quota=lots",
+		"user app >k burst=5",
+	} {
+		if _, err := Parse(strings.NewReader(text)); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", text)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package acl
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// SignatureScheme is the Authorization scheme of signed requests:
+	//
+	//	Authorization: BLUEIS-HMAC-SHA256 KeyId=<id>, Timestamp=<unix seconds>, Nonce=<nonce>, Signature=<hex>
+	//
+	// The signature is the HMAC-SHA256, under the key's secret, of
+	//
+	//	<method>\n<path and query>\n<timestamp>\n<nonce>\n<content hash>
+	//
+	// where the content hash is ContentHashHeader's value.
+	SignatureScheme = "BLUEIS-HMAC-SHA256"
+	// ContentHashHeader carries the hex SHA-256 of a signed request's body,
+	// or UnsignedPayload for a body too large to hold in memory, which is
+	// then not covered by the signature.
+	ContentHashHeader = "X-Blueis-Content-Sha256"
+	UnsignedPayload   = "UNSIGNED-PAYLOAD"
+)
+
+// ErrReplayed is returned for a signed request whose nonce has been used.
+var ErrReplayed = errors.New("request was already made")
+
+// signingKey is a user's HMAC key, known to the client by its id.
+type signingKey struct {
+	user   *User
+	secret []byte
+}
+
+// Sign signs r with the HMAC key id and secret, as SignatureScheme
+// describes. The body is read and put back to hash it, unless r cannot
+// replay it, in which case it is sent as UnsignedPayload.
+func Sign(r *http.Request, id string, secret string) error {
+	contentHash := UnsignedPayload
+	switch {
+	case r.Body == nil || r.Body == http.NoBody:
+		contentHash = hashHex(nil)
+	case r.GetBody != nil:
+		body, err := r.GetBody()
+		if err != nil {
+			return err
+		}
+		hash := sha256.New()
+		_, err = io.Copy(hash, body)
+		body.Close()
+		if err != nil {
+			return err
+		}
+		contentHash = hex.EncodeToString(hash.Sum(nil))
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signature := signature([]byte(secret), r.Method, r.URL.RequestURI(), timestamp, hex.EncodeToString(nonce), contentHash)
+	r.Header.Set(ContentHashHeader, contentHash)
+	r.Header.Set("Authorization", fmt.Sprintf("%s KeyId=%s, Timestamp=%s, Nonce=%s, Signature=%s",
+		SignatureScheme, id, timestamp, hex.EncodeToString(nonce), signature))
+	return nil
+}
+
+func signature(secret []byte, method, uri, timestamp, nonce, contentHash string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join([]string{method, uri, timestamp, nonce, contentHash}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func hashHex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// IsSigned reports whether r claims to be signed, rather than sending a
+// bearer key or nothing.
+func IsSigned(r *http.Request) bool {
+	scheme, _, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	return strings.EqualFold(scheme, SignatureScheme)
+}
+
+// Verifier checks signed requests. A request is accepted once, and only
+// within maxSkew of the time it was signed, so a captured request cannot be
+// replayed.
+type Verifier struct {
+	maxSkew time.Duration
+	now     func() time.Time
+
+	mu sync.Mutex
+	// seen holds the nonces accepted, until their requests are too old
+	// to be accepted again
+	seen   map[string]time.Time
+	pruned time.Time
+}
+
+// NewVerifier returns a Verifier accepting requests signed up to maxSkew
+// before or after its clock.
+func NewVerifier(maxSkew time.Duration) *Verifier {
+	return &Verifier{maxSkew: maxSkew, now: time.Now, seen: make(map[string]time.Time)}
+}
+
+// Verify returns the user whose key signed r. A body covered by the
+// signature is read to check it, up to maxBody bytes if positive, and put
+// back for the handler. A body over maxBody fails with *http.MaxBytesError;
+// every other failure wraps ErrUnauthenticated.
+func (verifier *Verifier) Verify(acl *ACL, r *http.Request, maxBody int64) (*User, error) {
+	_, params, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	fields := make(map[string]string)
+	for _, param := range strings.Split(params, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		fields[name] = value
+	}
+	id, nonce, sent := fields["KeyId"], fields["Nonce"], fields["Signature"]
+	if id == "" || nonce == "" || sent == "" || fields["Timestamp"] == "" {
+		return nil, fmt.Errorf("%w: signature must set KeyId, Timestamp, Nonce and Signature", ErrUnauthenticated)
+	}
+	unix, err := strconv.ParseInt(fields["Timestamp"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature timestamp must be in unix seconds", ErrUnauthenticated)
+	}
+	signed := time.Unix(unix, 0)
+	now := verifier.now()
+	if signed.Before(now.Add(-verifier.maxSkew)) || signed.After(now.Add(verifier.maxSkew)) {
+		return nil, fmt.Errorf("%w: request was signed more than %v from the node's time", ErrUnauthenticated, verifier.maxSkew)
+	}
+	key, ok := acl.signingKeys[id]
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+
+	contentHash := r.Header.Get(ContentHashHeader)
+	if contentHash != UnsignedPayload {
+		body, err := readBody(r, maxBody)
+		if err != nil {
+			return nil, err
+		}
+		if contentHash != hashHex(body) {
+			return nil, fmt.Errorf("%w: body does not match %s", ErrUnauthenticated, ContentHashHeader)
+		}
+	}
+	// The URI as sent, rather than as parsed, is what the client signed
+	uri := r.RequestURI
+	if uri == "" {
+		uri = r.URL.RequestURI()
+	}
+	want := signature(key.secret, r.Method, uri, fields["Timestamp"], nonce, contentHash)
+	if !hmac.Equal([]byte(want), []byte(sent)) {
+		return nil, fmt.Errorf("%w: signature does not match", ErrUnauthenticated)
+	}
+
+	// Nonces are only remembered for requests that are signed correctly,
+	// so forged requests cannot fill up seen
+	verifier.mu.Lock()
+	defer verifier.mu.Unlock()
+	if now.Sub(verifier.pruned) > verifier.maxSkew {
+		for seen, expires := range verifier.seen {
+			if now.After(expires) {
+				delete(verifier.seen, seen)
+			}
+		}
+		verifier.pruned = now
+	}
+	seen := id + "\x00" + nonce
+	if _, ok := verifier.seen[seen]; ok {
+		return nil, fmt.Errorf("%w: %w", ErrUnauthenticated, ErrReplayed)
+	}
+	verifier.seen[seen] = signed.Add(verifier.maxSkew)
+	return key.user, nil
+}
+
+func readBody(r *http.Request, limit int64) ([]byte, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+	reader := io.Reader(r.Body)
+	if limit > 0 {
+		reader = io.LimitReader(r.Body, limit+1)
+	}
+	body, err := io.ReadAll(reader)
+	r.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading body: %w", ErrUnauthenticated, err)
+	}
+	if limit > 0 && int64(len(body)) > limit {
+		return nil, &http.MaxBytesError{Limit: limit}
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
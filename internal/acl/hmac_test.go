@@ -0,0 +1,81 @@
+package acl
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// signedRequest signs a request as a client would and returns it as the
+// node receives it.
+func signedRequest(t *testing.T, body string, secret string) *http.Request {
+	t.Helper()
+	client, err := http.NewRequest(http.MethodPut, "http://node/kv?key=user:1", bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Fatalf("NewRequest returned error: %v", err)
+	}
+	if err := Sign(client, "app-1", secret); err != nil {
+		t.Fatalf("Sign returned error: %v", err)
+	}
+	server := httptest.NewRequest(client.Method, client.URL.RequestURI(), bytes.NewReader([]byte(body)))
+	server.Header = client.Header.Clone()
+	return server
+}
+
+func TestVerifier_AcceptsEachSignatureOnce(t *testing.T) {
+	acl := parseTestACL(t, `user app hmac=app-1:s3cret ~user:* +@write`)
+	verifier := NewVerifier(time.Minute)
+
+	r := signedRequest(t, `{"value":"x"}`, "s3cret")
+	user, err := verifier.Verify(acl, r, 0)
+	if err != nil || user.Name != "app" {
+		t.Fatalf("Verify = (%v, %v), want app", user, err)
+	}
+	var body bytes.Buffer
+	if _, err := body.ReadFrom(r.Body); err != nil || body.String() != `{"value":"x"}` {
+		t.Fatalf("body after Verify = (%q, %v), want it put back", body.String(), err)
+	}
+
+	replayed := signedRequest(t, `{"value":"x"}`, "s3cret")
+	replayed.Header = r.Header.Clone()
+	if _, err := verifier.Verify(acl, replayed, 0); !errors.Is(err, ErrReplayed) || !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("Verify of a replayed request returned %v, want ErrReplayed", err)
+	}
+}
+
+func TestVerifier_RejectsTamperedAndStaleRequests(t *testing.T) {
+	acl := parseTestACL(t, `user app hmac=app-1:s3cret ~user:* +@write`)
+	verifier := NewVerifier(time.Minute)
+
+	tampered := signedRequest(t, `{"value":"x"}`, "s3cret")
+	tampered.Body = http.NoBody
+	if _, err := verifier.Verify(acl, tampered, 0); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("Verify of a changed body returned %v, want ErrUnauthenticated", err)
+	}
+
+	moved := signedRequest(t, `{"value":"x"}`, "s3cret")
+	moved.RequestURI = "/kv?key=user:2"
+	if _, err := verifier.Verify(acl, moved, 0); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("Verify of a changed key returned %v, want ErrUnauthenticated", err)
+	}
+
+	forged := signedRequest(t, `{"value":"x"}`, "guess")
+	if _, err := verifier.Verify(acl, forged, 0); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("Verify of a wrong secret returned %v, want ErrUnauthenticated", err)
+	}
+
+	stale := signedRequest(t, `{"value":"x"}`, "s3cret")
+	verifier.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if _, err := verifier.Verify(acl, stale, 0); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("Verify of a stale request returned %v, want ErrUnauthenticated", err)
+	}
+
+	large := signedRequest(t, `{"value":"x"}`, "s3cret")
+	var tooLarge *http.MaxBytesError
+	if _, err := NewVerifier(time.Minute).Verify(acl, large, 4); !errors.As(err, &tooLarge) {
+		t.Fatalf("Verify of a body over the limit returned %v, want *http.MaxBytesError", err)
+	}
+}
@@ -0,0 +1,138 @@
+package acl
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrRateLimited is returned for a request over its user's rate limit.
+	ErrRateLimited = errors.New("rate limit exceeded")
+	// ErrQuotaExceeded is returned for a request past its user's daily
+	// quota.
+	ErrQuotaExceeded = errors.New("daily quota exceeded")
+)
+
+// Limits caps how many operations a user may run. Zero values are
+// unlimited.
+type Limits struct {
+	// Rate is the operations a second the user may sustain, and Burst how
+	// many it may run at once after being idle, Rate if zero
+	Rate  float64
+	Burst int
+	// Quota is the operations the user may run each UTC day
+	Quota int64
+}
+
+// Usage is what a user has run, as a Meter counts it.
+type Usage struct {
+	User string
+	// Day is the UTC day Today counts, and Today the operations admitted
+	// on it
+	Day   time.Time
+	Today int64
+	// Total is every operation admitted since the Meter was made, and
+	// Throttled and OverQuota those refused by the user's rate limit and
+	// quota
+	Total     int64
+	Throttled int64
+	OverQuota int64
+	Limits    Limits
+}
+
+// Meter admits operations against their users' limits and counts each
+// user's usage. Users are known by name, so their usage carries over
+// when the ACL is reloaded. Counts are kept in memory and start again
+// when the Meter is made.
+type Meter struct {
+	mu    sync.Mutex
+	now   func() time.Time
+	users map[string]*meterState
+}
+
+type meterState struct {
+	usage Usage
+	// tokens is the token bucket enforcing the rate limit, as of filled
+	tokens float64
+	filled time.Time
+}
+
+// NewMeter returns a Meter with no usage counted.
+func NewMeter() *Meter {
+	return &Meter{now: time.Now, users: make(map[string]*meterState)}
+}
+
+// Admit counts an operation by user. If the user is over its rate limit or
+// quota, the operation is refused with ErrRateLimited or ErrQuotaExceeded,
+// and retryAfter says how long until it would be admitted.
+func (meter *Meter) Admit(user *User) (retryAfter time.Duration, err error) {
+	meter.mu.Lock()
+	defer meter.mu.Unlock()
+
+	now := meter.now()
+	limits := user.Limits
+	state, ok := meter.users[user.Name]
+	if !ok {
+		state = &meterState{tokens: float64(burst(limits)), filled: now}
+		meter.users[user.Name] = state
+	}
+	state.usage.Limits = limits
+	if day := startOfDay(now); !day.Equal(state.usage.Day) {
+		state.usage.Day, state.usage.Today = day, 0
+	}
+
+	if limits.Quota > 0 && state.usage.Today >= limits.Quota {
+		state.usage.OverQuota++
+		return state.usage.Day.AddDate(0, 0, 1).Sub(now), fmt.Errorf("%w: user %s has run its %d operations for today", ErrQuotaExceeded, user.Name, limits.Quota)
+	}
+	if limits.Rate > 0 {
+		elapsed := now.Sub(state.filled).Seconds()
+		state.tokens = math.Min(float64(burst(limits)), state.tokens+elapsed*limits.Rate)
+		state.filled = now
+		if state.tokens < 1 {
+			state.usage.Throttled++
+			wait := time.Duration((1 - state.tokens) / limits.Rate * float64(time.Second))
+			return wait, fmt.Errorf("%w: user %s may run %g operations a second", ErrRateLimited, user.Name, limits.Rate)
+		}
+		state.tokens--
+	}
+	state.usage.Today++
+	state.usage.Total++
+	return 0, nil
+}
+
+// Usage returns the usage of every user that has run an operation, by
+// name.
+func (meter *Meter) Usage() []Usage {
+	meter.mu.Lock()
+	defer meter.mu.Unlock()
+
+	today := startOfDay(meter.now())
+	usage := make([]Usage, 0, len(meter.users))
+	for name, state := range meter.users {
+		u := state.usage
+		u.User = name
+		if !u.Day.Equal(today) {
+			u.Day, u.Today = today, 0
+		}
+		usage = append(usage, u)
+	}
+	slices.SortFunc(usage, func(a, b Usage) int { return strings.Compare(a.User, b.User) })
+	return usage
+}
+
+func burst(limits Limits) int {
+	if limits.Burst > 0 {
+		return limits.Burst
+	}
+	return max(1, int(math.Ceil(limits.Rate)))
+}
+
+func startOfDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
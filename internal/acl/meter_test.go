@@ -0,0 +1,63 @@
+package acl
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMeter_RateLimitRefillsOverTime(t *testing.T) {
+	acl := parseTestACL(t, `user app >k allkeys +@all rate=2 burst=3`)
+	user, _ := acl.Authenticate("k")
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	meter := NewMeter()
+	meter.now = func() time.Time { return now }
+
+	for i := range 3 {
+		if _, err := meter.Admit(user); err != nil {
+			t.Fatalf("operation %d of the burst returned %v", i, err)
+		}
+	}
+	retryAfter, err := meter.Admit(user)
+	if !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("operation past the burst returned %v, want ErrRateLimited", err)
+	}
+	if retryAfter != 500*time.Millisecond {
+		t.Fatalf("retry after %v, want 500ms at 2 a second", retryAfter)
+	}
+
+	now = now.Add(retryAfter)
+	if _, err := meter.Admit(user); err != nil {
+		t.Fatalf("operation after the refill returned %v", err)
+	}
+	usage := meter.Usage()
+	if len(usage) != 1 || usage[0].User != "app" || usage[0].Total != 4 || usage[0].Throttled != 1 {
+		t.Fatalf("Usage = %+v, want app with 4 admitted and 1 throttled", usage)
+	}
+}
+
+func TestMeter_QuotaResetsEachDay(t *testing.T) {
+	acl := parseTestACL(t, `user app >k allkeys +@all quota=2`)
+	user, _ := acl.Authenticate("k")
+	now := time.Date(2026, 1, 1, 23, 0, 0, 0, time.UTC)
+	meter := NewMeter()
+	meter.now = func() time.Time { return now }
+
+	for range 2 {
+		if _, err := meter.Admit(user); err != nil {
+			t.Fatalf("operation within the quota returned %v", err)
+		}
+	}
+	retryAfter, err := meter.Admit(user)
+	if !errors.Is(err, ErrQuotaExceeded) || retryAfter != time.Hour {
+		t.Fatalf("operation past the quota = (%v, %v), want ErrQuotaExceeded until midnight", retryAfter, err)
+	}
+
+	now = now.Add(time.Hour)
+	if usage := meter.Usage(); usage[0].Today != 0 || usage[0].Total != 2 || usage[0].OverQuota != 1 {
+		t.Fatalf("Usage the next day = %+v, want none today of 2 in total", usage[0])
+	}
+	if _, err := meter.Admit(user); err != nil {
+		t.Fatalf("operation the next day returned %v", err)
+	}
+}
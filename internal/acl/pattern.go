@@ -0,0 +1,81 @@
+package acl
+
+import "strings"
+
+// pattern is a compiled key pattern. Most patterns are a literal key or a
+// literal prefix followed by *, which are matched without walking the
+// pattern; the rest fall back to glob matching.
+type pattern struct {
+	glob string
+	// literal is the key the pattern matches, or the prefix it matches
+	// when prefix is set, if the pattern is that simple
+	literal string
+	prefix  bool
+	simple  bool
+}
+
+func compilePattern(glob string) pattern {
+	p := pattern{glob: glob}
+	body, star := strings.CutSuffix(glob, "*")
+	if !strings.ContainsAny(body, `*?\`) {
+		p.literal, p.prefix, p.simple = body, star, true
+	}
+	return p
+}
+
+// matchesAll reports whether the pattern matches every key.
+func (p pattern) matchesAll() bool {
+	return p.simple && p.prefix && p.literal == ""
+}
+
+func (p pattern) match(key string) bool {
+	switch {
+	case p.simple && p.prefix:
+		return strings.HasPrefix(key, p.literal)
+	case p.simple:
+		return key == p.literal
+	}
+	return globMatch(p.glob, key)
+}
+
+// globMatch matches key against glob, where * matches any run of bytes, ?
+// any one byte and \ makes the byte after it literal. Only the most recent
+// * is backtracked to, which keeps matching linear in practice.
+func globMatch(glob string, key string) bool {
+	g, k := 0, 0
+	starG, starK := -1, 0
+	for k < len(key) {
+		if g < len(glob) {
+			switch c := glob[g]; {
+			case c == '*':
+				starG, starK = g, k
+				g++
+				continue
+			case c == '?':
+				g++
+				k++
+				continue
+			case c == '\\' && g+1 < len(glob):
+				if glob[g+1] == key[k] {
+					g += 2
+					k++
+					continue
+				}
+			case c == key[k]:
+				g++
+				k++
+				continue
+			}
+		}
+		if starG < 0 {
+			return false
+		}
+		// Let the last * swallow one more byte and try again from there
+		starK++
+		g, k = starG+1, starK
+	}
+	for g < len(glob) && glob[g] == '*' {
+		g++
+	}
+	return g == len(glob)
+}
@@ -0,0 +1,294 @@
+package acl
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// BuiltinIssuer is the issuer of the tokens Tokens mints.
+const BuiltinIssuer = "blueis"
+
+// ErrTokenExpired is returned for a token past its expiry.
+var ErrTokenExpired = errors.New("token expired")
+
+// TokenPair is a short-lived access token, sent as a bearer token, and the
+// longer-lived refresh token that exchanges for the next pair.
+type TokenPair struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresIn    time.Duration
+}
+
+type tokenClaims struct {
+	Issuer   string `json:"iss"`
+	Subject  string `json:"sub"`
+	IssuedAt int64  `json:"iat"`
+	Expires  int64  `json:"exp"`
+	// Type is "refresh" for refresh tokens, which are not accepted in
+	// place of access tokens
+	Type string `json:"typ,omitempty"`
+	ID   string `json:"jti,omitempty"`
+}
+
+type tokenHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+}
+
+// Tokens mints and checks JWTs naming ACL users as their subject. Tokens
+// it mints are signed HS256 with a secret every node of a cluster shares,
+// so any of them accepts a token another minted. It can also accept access
+// tokens minted by another issuer, signed with that issuer's key.
+//
+// A token authenticates its subject for as long as it is valid and the
+// user is in the ACL, so removing a user revokes its tokens, and a user's
+// API keys can be rotated without clients holding tokens noticing.
+type Tokens struct {
+	secret     []byte
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+	now        func() time.Time
+
+	// issuer and issuerKey are the external issuer trusted, if any
+	issuer    string
+	issuerKey crypto.PublicKey
+}
+
+// NewTokens returns Tokens minting tokens with secret, which may be nil to
+// only accept tokens from a trusted issuer.
+func NewTokens(secret []byte, accessTTL time.Duration, refreshTTL time.Duration) *Tokens {
+	return &Tokens{secret: secret, accessTTL: accessTTL, refreshTTL: refreshTTL, now: time.Now}
+}
+
+// Trust accepts access tokens whose iss is issuer, signed with key: an
+// *rsa.PublicKey for RS256, an *ecdsa.PublicKey on P-256 for ES256 or an
+// ed25519.PublicKey for EdDSA.
+func (tokens *Tokens) Trust(issuer string, key crypto.PublicKey) error {
+	if issuer == "" || issuer == BuiltinIssuer {
+		return fmt.Errorf("the trusted issuer must be named, and not %s", BuiltinIssuer)
+	}
+	switch key := key.(type) {
+	case *rsa.PublicKey, ed25519.PublicKey:
+	case *ecdsa.PublicKey:
+		if key.Curve.Params().Name != "P-256" {
+			return errors.New("ECDSA issuer keys must be on P-256, for ES256")
+		}
+	default:
+		return fmt.Errorf("unsupported issuer key type %T", key)
+	}
+	tokens.issuer, tokens.issuerKey = issuer, key
+	return nil
+}
+
+// Mints reports whether tokens mints tokens of its own.
+func (tokens *Tokens) Mints() bool {
+	return len(tokens.secret) > 0
+}
+
+// Issue mints a token pair for user.
+func (tokens *Tokens) Issue(user *User) (TokenPair, error) {
+	if !tokens.Mints() {
+		return TokenPair{}, errors.New("tokens are only accepted from " + tokens.issuer)
+	}
+	now := tokens.now()
+	access, err := tokens.mint(user.Name, "", now, tokens.accessTTL)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	refresh, err := tokens.mint(user.Name, "refresh", now, tokens.refreshTTL)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	return TokenPair{AccessToken: access, RefreshToken: refresh, ExpiresIn: tokens.accessTTL}, nil
+}
+
+// Refresh exchanges a refresh token for a new pair, for the user it was
+// minted for if that user is still in acl.
+func (tokens *Tokens) Refresh(acl *ACL, refreshToken string) (TokenPair, *User, error) {
+	claims, err := tokens.verify(refreshToken, true)
+	if err != nil {
+		return TokenPair{}, nil, err
+	}
+	if claims.Type != "refresh" {
+		return TokenPair{}, nil, fmt.Errorf("%w: not a refresh token", ErrUnauthenticated)
+	}
+	user, err := acl.user(claims.Subject)
+	if err != nil {
+		return TokenPair{}, nil, err
+	}
+	pair, err := tokens.Issue(user)
+	return pair, user, err
+}
+
+// Authenticate returns the user an access token was minted for, if it is
+// in acl.
+func (tokens *Tokens) Authenticate(acl *ACL, accessToken string) (*User, error) {
+	claims, err := tokens.verify(accessToken, false)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Type == "refresh" {
+		return nil, fmt.Errorf("%w: a refresh token is not an access token", ErrUnauthenticated)
+	}
+	return acl.user(claims.Subject)
+}
+
+// IsToken reports whether key has the shape of a JWT, rather than an API
+// key.
+func IsToken(key string) bool {
+	return strings.Count(key, ".") == 2
+}
+
+func (tokens *Tokens) mint(subject string, kind string, now time.Time, ttl time.Duration) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	header, _ := json.Marshal(tokenHeader{Algorithm: "HS256", Type: "JWT"})
+	claims, _ := json.Marshal(tokenClaims{
+		Issuer:   BuiltinIssuer,
+		Subject:  subject,
+		IssuedAt: now.Unix(),
+		Expires:  now.Add(ttl).Unix(),
+		Type:     kind,
+		ID:       hex.EncodeToString(id),
+	})
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	mac := hmac.New(sha256.New, tokens.secret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verify checks token's signature and expiry, returning its claims. Only
+// tokens this node mints may be refresh tokens.
+func (tokens *Tokens) verify(token string, refresh bool) (tokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return tokenClaims{}, fmt.Errorf("%w: malformed token", ErrUnauthenticated)
+	}
+	var header tokenHeader
+	var claims tokenClaims
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return tokenClaims{}, err
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return tokenClaims{}, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return tokenClaims{}, fmt.Errorf("%w: malformed token signature", ErrUnauthenticated)
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	switch {
+	case claims.Issuer == BuiltinIssuer && tokens.Mints():
+		if header.Algorithm != "HS256" {
+			return tokenClaims{}, fmt.Errorf("%w: %s tokens must be HS256", ErrUnauthenticated, BuiltinIssuer)
+		}
+		mac := hmac.New(sha256.New, tokens.secret)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return tokenClaims{}, fmt.Errorf("%w: token signature does not match", ErrUnauthenticated)
+		}
+	case claims.Issuer == tokens.issuer && tokens.issuerKey != nil && !refresh:
+		if err := verifyIssuerSignature(tokens.issuerKey, header.Algorithm, signed, signature); err != nil {
+			return tokenClaims{}, err
+		}
+	default:
+		return tokenClaims{}, fmt.Errorf("%w: tokens from issuer %q are not accepted", ErrUnauthenticated, claims.Issuer)
+	}
+
+	if claims.Subject == "" || claims.Expires == 0 {
+		return tokenClaims{}, fmt.Errorf("%w: token must set sub and exp", ErrUnauthenticated)
+	}
+	if !tokens.now().Before(time.Unix(claims.Expires, 0)) {
+		return tokenClaims{}, fmt.Errorf("%w: %w", ErrUnauthenticated, ErrTokenExpired)
+	}
+	return claims, nil
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err == nil {
+		err = json.Unmarshal(data, v)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: malformed token", ErrUnauthenticated)
+	}
+	return nil
+}
+
+// verifyIssuerSignature checks a signature made with the private half of
+// key, by the algorithm the token's header names, which must be the one
+// key is for; a token cannot pick a weaker one.
+func verifyIssuerSignature(key crypto.PublicKey, algorithm string, signed []byte, signature []byte) error {
+	digest := sha256.Sum256(signed)
+	valid := false
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		valid = algorithm == "RS256" && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+	case *ecdsa.PublicKey:
+		if algorithm == "ES256" && len(signature) == 64 {
+			r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+			valid = ecdsa.Verify(key, digest[:], r, s)
+		}
+	case ed25519.PublicKey:
+		valid = algorithm == "EdDSA" && ed25519.Verify(key, signed, signature)
+	}
+	if !valid {
+		return fmt.Errorf("%w: token signature does not match", ErrUnauthenticated)
+	}
+	return nil
+}
+
+// LoadPublicKey reads a PEM-encoded public key, or the key of a PEM
+// certificate, from the file at path.
+func LoadPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading public key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s holds no PEM block", path)
+	}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return cert.PublicKey, nil
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s: want a PUBLIC KEY or CERTIFICATE, not %s", path, block.Type)
+}
+
+// user returns the user named name.
+func (acl *ACL) user(name string) (*User, error) {
+	if user, ok := acl.byName[name]; ok {
+		return user, nil
+	}
+	return nil, fmt.Errorf("%w: no user %s", ErrUnauthenticated, name)
+}
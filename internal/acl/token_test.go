@@ -0,0 +1,85 @@
+package acl
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTokens_IssueRefreshAndExpire(t *testing.T) {
+	acl := parseTestACL(t, `user app >app-key ~user:* +@read`)
+	user, _ := acl.Authenticate("app-key")
+	now := time.Now()
+	tokens := NewTokens([]byte("0123456789abcdef0123456789abcdef"), time.Minute, time.Hour)
+	tokens.now = func() time.Time { return now }
+
+	pair, err := tokens.Issue(user)
+	if err != nil {
+		t.Fatalf("Issue returned error: %v", err)
+	}
+	if got, err := tokens.Authenticate(acl, pair.AccessToken); err != nil || got != user {
+		t.Fatalf("Authenticate(access) = (%v, %v), want app", got, err)
+	}
+	if _, err := tokens.Authenticate(acl, pair.RefreshToken); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("Authenticate(refresh) returned %v, want ErrUnauthenticated", err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, err := tokens.Authenticate(acl, pair.AccessToken); !errors.Is(err, ErrTokenExpired) {
+		t.Fatalf("Authenticate of an expired token returned %v, want ErrTokenExpired", err)
+	}
+	next, refreshed, err := tokens.Refresh(acl, pair.RefreshToken)
+	if err != nil || refreshed != user {
+		t.Fatalf("Refresh = (%v, %v), want app", refreshed, err)
+	}
+	if _, err := tokens.Authenticate(acl, next.AccessToken); err != nil {
+		t.Fatalf("Authenticate of the refreshed token returned %v", err)
+	}
+
+	// Removing the user revokes its tokens
+	reloaded := parseTestACL(t, `user other >other-key ~* +@read`)
+	if _, err := tokens.Authenticate(reloaded, next.AccessToken); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("Authenticate for a removed user returned %v, want ErrUnauthenticated", err)
+	}
+
+	other := NewTokens([]byte("another secret, another cluster!"), time.Minute, time.Hour)
+	if _, err := other.Authenticate(acl, next.AccessToken); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("Authenticate under another secret returned %v, want ErrUnauthenticated", err)
+	}
+}
+
+func TestTokens_TrustsExternalIssuer(t *testing.T) {
+	acl := parseTestACL(t, `user app >app-key ~user:* +@read`)
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey returned error: %v", err)
+	}
+	tokens := NewTokens(nil, time.Minute, time.Hour)
+	if err := tokens.Trust("https://sso.example.com", public); err != nil {
+		t.Fatalf("Trust returned error: %v", err)
+	}
+
+	sign := func(header string, claims string) string {
+		signed := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + base64.RawURLEncoding.EncodeToString([]byte(claims))
+		return signed + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(private, []byte(signed)))
+	}
+	exp := time.Now().Add(time.Minute).Unix()
+	claims := `{"iss":"https://sso.example.com","sub":"app","exp":` + strconv.FormatInt(exp, 10) + `}`
+	if user, err := tokens.Authenticate(acl, sign(`{"alg":"EdDSA"}`, claims)); err != nil || user.Name != "app" {
+		t.Fatalf("Authenticate of an issuer's token = (%v, %v), want app", user, err)
+	}
+	if _, err := tokens.Authenticate(acl, sign(`{"alg":"HS256"}`, claims)); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("Authenticate with a mismatched alg returned %v, want ErrUnauthenticated", err)
+	}
+	forged := `{"iss":"https://evil.example.com","sub":"app","exp":` + strconv.FormatInt(exp, 10) + `}`
+	if _, err := tokens.Authenticate(acl, sign(`{"alg":"EdDSA"}`, forged)); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("Authenticate of another issuer's token returned %v, want ErrUnauthenticated", err)
+	}
+	if _, err := tokens.Issue(&User{Name: "app"}); err == nil {
+		t.Fatalf("Issue without a secret succeeded, want an error")
+	}
+}
@@ -0,0 +1,76 @@
+package acl
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// RequestKey returns the API key a request authenticates with, sent as
+// Authorization: Bearer <key>, or "" if it sends none.
+func RequestKey(r *http.Request) string {
+	scheme, key, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(key)
+}
+
+// Credentials are what a client authenticates with: an API key sent as a
+// bearer token, or an HMAC key, by id and secret, to sign requests with.
+type Credentials struct {
+	Key      string
+	SignerID string
+	Secret   string
+}
+
+// ReadCredentials reads credentials from the first line of the file at
+// path, either an API key or
+//
+//	hmac <id> <secret>
+func ReadCredentials(path string) (Credentials, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("reading credentials file: %w", err)
+	}
+	line, _, _ := strings.Cut(string(data), "\n")
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 0:
+		return Credentials{}, errors.New("credentials file is empty")
+	case fields[0] == "hmac" && len(fields) == 3:
+		return Credentials{SignerID: fields[1], Secret: fields[2]}, nil
+	case len(fields) == 1:
+		return Credentials{Key: fields[0]}, nil
+	}
+	return Credentials{}, errors.New("credentials file must hold an API key or hmac <id> <secret>")
+}
+
+// NewTransport returns a RoundTripper that authenticates every request made
+// through base, or http.DefaultTransport if base is nil, with credentials.
+func NewTransport(credentials Credentials, base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{credentials: credentials, base: base}
+}
+
+type transport struct {
+	credentials Credentials
+	base        http.RoundTripper
+}
+
+func (t *transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// A RoundTripper must not change the request it is given
+	r = r.Clone(r.Context())
+	if t.credentials.SignerID != "" {
+		if err := Sign(r, t.credentials.SignerID, t.credentials.Secret); err != nil {
+			return nil, fmt.Errorf("signing request: %w", err)
+		}
+	} else {
+		r.Header.Set("Authorization", "Bearer "+t.credentials.Key)
+	}
+	return t.base.RoundTrip(r)
+}
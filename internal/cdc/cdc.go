@@ -0,0 +1,322 @@
+// Package cdc publishes the changes a store makes to an external sink, so
+// systems downstream of blueis can index or audit its data. Each change is
+// published as an Event carrying the key's old and new values, in the
+// order the store made them, and at least once: a publish that fails is
+// retried until the sink accepts it.
+package cdc
+
+import (
+	"blueis/internal/kvstore"
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultBuffer is how many changes may wait to be published when
+	// Options.Buffer is zero.
+	DefaultBuffer = 100000
+	// DefaultBatchSize caps the events published at once when
+	// Options.BatchSize is zero.
+	DefaultBatchSize = 500
+
+	minRetry = 100 * time.Millisecond
+	maxRetry = 10 * time.Second
+)
+
+// Event is a change to a key, as published.
+type Event struct {
+	// Node is the node that made the change, and Run and Offset its
+	// position in that node's replication stream
+	Node   string `json:"node"`
+	Run    string `json:"run"`
+	Offset uint64 `json:"offset"`
+	// Type is "set", "delete", "expire" or "persist", or for lists
+	// "lpush", "rpush", "lpop" or "rpop"
+	Type string `json:"type"`
+	Key  string `json:"key"`
+	// Old is the value the change replaced, omitted for a new key or one
+	// whose old value is not known. New is the value a set wrote
+	Old *string `json:"old,omitempty"`
+	New *string `json:"new,omitempty"`
+	// ExpiresAt is the deadline an expire set
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// Values are the values a push added to a list or a pop removed from
+	// it, in the order it did so, and Length the list's length after
+	Values []string `json:"values,omitempty"`
+	Length *int64   `json:"length,omitempty"`
+	// At is when the change was published from the node
+	At time.Time `json:"at"`
+	// Resync marks events that recreate the store's keys after the
+	// publisher fell too far behind to know what changed, rather than
+	// changes themselves
+	Resync bool `json:"resync,omitempty"`
+}
+
+func newEvent(node, run string, mutation kvstore.Mutation, at time.Time) Event {
+	event := Event{Node: node, Run: run, Offset: mutation.Offset, Key: mutation.Key, Old: mutation.Previous, At: at}
+	switch mutation.Type {
+	case kvstore.MutationSet:
+		event.Type = "set"
+		value := mutation.Value
+		event.New = &value
+	case kvstore.MutationDelete:
+		event.Type = "delete"
+	case kvstore.MutationExpire:
+		event.Type = "expire"
+		deadline := time.Unix(0, mutation.Deadline).UTC()
+		event.ExpiresAt = &deadline
+	case kvstore.MutationPersist:
+		event.Type = "persist"
+	case kvstore.MutationListPush, kvstore.MutationListPop:
+		side, op := "r", "push"
+		if mutation.Left {
+			side = "l"
+		}
+		if mutation.Type == kvstore.MutationListPop {
+			op = "pop"
+		}
+		event.Type = side + op
+		length := mutation.Length
+		event.Values, event.Length = mutation.Values, &length
+	}
+	return event
+}
+
+// Sink is where events are published.
+type Sink interface {
+	// Publish delivers events in order and returns once the sink has
+	// accepted every one of them. If it fails, the same events are
+	// published again.
+	Publish(ctx context.Context, events []Event) error
+	Close() error
+}
+
+// Options configure a Publisher.
+type Options struct {
+	// Node names the node in every event
+	Node string
+	// Buffer is how many changes may wait to be published, DefaultBuffer if
+	// zero. A publisher further behind resumes from the store's replication
+	// backlog, or resyncs every key if the backlog no longer holds the
+	// changes it missed
+	Buffer int
+	// BatchSize caps the events published at once, DefaultBatchSize if zero
+	BatchSize int
+	// Logger receives the publisher's messages, log.Default() if nil
+	Logger *log.Logger
+}
+
+// Stats is what a Publisher has done.
+type Stats struct {
+	// Published counts the events the sink accepted, and Failures the
+	// publishes it refused, each of which was retried
+	Published uint64
+	Failures  uint64
+	// Resyncs counts the times the publisher fell behind further than the
+	// backlog reaches and published every key again
+	Resyncs uint64
+}
+
+// Publisher follows a store and publishes its changes to a sink.
+type Publisher struct {
+	kv      *kvstore.KeyValueService
+	sink    Sink
+	options Options
+
+	stop   chan struct{}
+	cancel context.CancelFunc
+	done   sync.WaitGroup
+
+	published atomic.Uint64
+	failures  atomic.Uint64
+	resyncs   atomic.Uint64
+}
+
+func NewPublisher(kv *kvstore.KeyValueService, sink Sink, options Options) *Publisher {
+	if options.Buffer <= 0 {
+		options.Buffer = DefaultBuffer
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = DefaultBatchSize
+	}
+	if options.Logger == nil {
+		options.Logger = log.Default()
+	}
+	return &Publisher{kv: kv, sink: sink, options: options, stop: make(chan struct{})}
+}
+
+// Start starts publishing the changes the store makes from now on.
+func (publisher *Publisher) Start() error {
+	stream, err := publisher.kv.Capture("", 0, publisher.options.Buffer)
+	if err != nil {
+		return fmt.Errorf("capturing changes to publish: %w", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	publisher.cancel = cancel
+	publisher.done.Add(1)
+	go publisher.run(ctx, stream)
+	return nil
+}
+
+// Close publishes the changes still waiting, giving up on them once ctx is
+// done, and closes the sink. It should be called after the store has
+// closed, so no more are made.
+func (publisher *Publisher) Close(ctx context.Context) error {
+	close(publisher.stop)
+	finished := make(chan struct{})
+	go func() {
+		publisher.done.Wait()
+		close(finished)
+	}()
+	var err error
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		err = ctx.Err()
+		publisher.cancel()
+		<-finished
+	}
+	publisher.cancel()
+	if closeErr := publisher.sink.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Stats returns what the publisher has done.
+func (publisher *Publisher) Stats() Stats {
+	return Stats{
+		Published: publisher.published.Load(),
+		Failures:  publisher.failures.Load(),
+		Resyncs:   publisher.resyncs.Load(),
+	}
+}
+
+func (publisher *Publisher) run(ctx context.Context, stream *kvstore.ReplicationStream) {
+	defer publisher.done.Done()
+	run, offset := "", uint64(0)
+	for {
+		var stopped bool
+		var err error
+		run, offset, stopped, err = publisher.follow(ctx, stream, run, offset)
+		stream.Close()
+		if stopped || ctx.Err() != nil {
+			return
+		}
+		publisher.options.Logger.Printf("Publishing changes fell behind, resuming after offset %d: %v", offset, err)
+
+		for {
+			if stream, err = publisher.kv.Capture(run, offset, publisher.options.Buffer); err == nil {
+				break
+			}
+			publisher.options.Logger.Printf("Capturing changes to publish: %v", err)
+			select {
+			case <-publisher.stop:
+				return
+			case <-time.After(maxRetry):
+			}
+		}
+	}
+}
+
+// follow publishes stream's changes until the publisher is stopped or the
+// stream fails, returning the position of the last change published.
+func (publisher *Publisher) follow(ctx context.Context, stream *kvstore.ReplicationStream, run string, offset uint64) (string, uint64, bool, error) {
+	batchSize := publisher.options.BatchSize
+	if !stream.Partial() {
+		// Resuming fell back to a snapshot, so which keys changed since is
+		// not known: publish all of them
+		publisher.resyncs.Add(1)
+		at := time.Now().UTC()
+		batch := make([]Event, 0, batchSize)
+		err := stream.Sync(func(mutation kvstore.Mutation) error {
+			event := newEvent(publisher.options.Node, stream.ID(), mutation, at)
+			event.Offset, event.Resync = stream.Offset(), true
+			if batch = append(batch, event); len(batch) < batchSize {
+				return nil
+			}
+			err := publisher.publish(ctx, batch)
+			batch = batch[:0]
+			return err
+		})
+		if err == nil {
+			err = publisher.publish(ctx, batch)
+		}
+		if err != nil {
+			return run, offset, false, err
+		}
+	}
+	run, offset = stream.ID(), stream.Offset()
+
+	batch := make([]Event, 0, batchSize)
+	// next appends the changes waiting on stream to batch, and reports
+	// whether the stream has closed
+	next := func(at time.Time) bool {
+		for len(batch) < batchSize {
+			select {
+			case mutation, ok := <-stream.Mutations():
+				if !ok {
+					return true
+				}
+				batch = append(batch, newEvent(publisher.options.Node, run, mutation, at))
+			default:
+				return false
+			}
+		}
+		return false
+	}
+	for {
+		stopped := false
+		select {
+		case mutation, ok := <-stream.Mutations():
+			if !ok {
+				return run, offset, false, stream.Err()
+			}
+			at := time.Now().UTC()
+			batch = append(batch[:0], newEvent(publisher.options.Node, run, mutation, at))
+			next(at)
+		case <-publisher.stop:
+			// The store has closed, so what is waiting is the last of it
+			batch = batch[:0]
+			next(time.Now().UTC())
+			stopped = true
+		}
+		if err := publisher.publish(ctx, batch); err != nil {
+			return run, offset, stopped, err
+		}
+		if len(batch) > 0 {
+			offset = batch[len(batch)-1].Offset
+		}
+		if stopped && len(batch) < batchSize {
+			return run, offset, true, nil
+		}
+	}
+}
+
+// publish hands events to the sink, retrying until it accepts them or ctx
+// is done.
+func (publisher *Publisher) publish(ctx context.Context, events []Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	retry := minRetry
+	for {
+		err := publisher.sink.Publish(ctx, events)
+		if err == nil {
+			publisher.published.Add(uint64(len(events)))
+			return nil
+		}
+		publisher.failures.Add(1)
+		publisher.options.Logger.Printf("Publishing %d changes failed, retrying in %s: %v", len(events), retry, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retry):
+		}
+		retry = min(retry*2, maxRetry)
+	}
+}
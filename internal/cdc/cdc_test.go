@@ -0,0 +1,289 @@
+package cdc
+
+import (
+	"blueis/internal/kvstore"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSink keeps every event published to it. It refuses the first
+// failures publishes, and blocks publishes while held.
+type recordingSink struct {
+	mu       sync.Mutex
+	events   []Event
+	failures int
+	held     chan struct{}
+}
+
+func (sink *recordingSink) Publish(ctx context.Context, events []Event) error {
+	if sink.held != nil {
+		select {
+		case <-sink.held:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.failures > 0 {
+		sink.failures--
+		return errors.New("sink unavailable")
+	}
+	sink.events = append(sink.events, events...)
+	return nil
+}
+
+func (sink *recordingSink) Close() error {
+	return nil
+}
+
+// waitFor waits until the sink holds n events and returns them.
+func (sink *recordingSink) waitFor(t *testing.T, n int) []Event {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sink.mu.Lock()
+		events := append([]Event(nil), sink.events...)
+		sink.mu.Unlock()
+		if len(events) >= n {
+			return events
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("sink holds %d events, want %d", len(events), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func newTestPublisher(t *testing.T, sink Sink, buffer int) (*kvstore.KeyValueService, *Publisher) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	quiet := log.New(io.Discard, "", 0)
+	kv := kvstore.NewKeyValueService(ctx, kvstore.WithLogger(quiet))
+	publisher := NewPublisher(kv, sink, Options{Node: "node-1", Buffer: buffer, Logger: quiet})
+	if err := publisher.Start(); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		closeCtx, done := context.WithTimeout(context.Background(), time.Second)
+		defer done()
+		_ = publisher.Close(closeCtx)
+	})
+	return kv, publisher
+}
+
+func describe(event Event) string {
+	value := func(v *string) string {
+		if v == nil {
+			return "-"
+		}
+		return *v
+	}
+	return event.Type + " " + event.Key + " " + value(event.Old) + ">" + value(event.New)
+}
+
+func TestPublisher_PublishesChangesWithOldAndNewValues(t *testing.T) {
+	sink := &recordingSink{}
+	kv, publisher := newTestPublisher(t, sink, 0)
+
+	for _, value := range []string{"1", "2"} {
+		if _, err := kv.Set("key", value); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+	}
+	if _, err := kv.Delete("key"); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+
+	events := sink.waitFor(t, 3)
+	var got []string
+	for i, event := range events {
+		got = append(got, describe(event))
+		if event.Node != "node-1" || event.Run == "" || (i > 0 && event.Offset != events[i-1].Offset+1) {
+			t.Fatalf("event %d = %+v, want node-1's changes at consecutive offsets", i, event)
+		}
+	}
+	if strings.Join(got, ", ") != "set key ->1, set key 1>2, delete key 2>-" {
+		t.Fatalf("published %q, want each change with its old and new value", got)
+	}
+	if stats := publisher.Stats(); stats.Published != 3 || stats.Failures != 0 {
+		t.Fatalf("Stats = %+v, want 3 published", stats)
+	}
+}
+
+func TestPublisher_PublishesListChangesAsTheirValues(t *testing.T) {
+	sink := &recordingSink{}
+	kv, _ := newTestPublisher(t, sink, 0)
+
+	if _, err := kv.RPush("queue", "a", "b"); err != nil {
+		t.Fatalf("RPush returned error: %v", err)
+	}
+	for range 2 {
+		if _, err := kv.LPop("queue"); err != nil {
+			t.Fatalf("LPop returned error: %v", err)
+		}
+	}
+
+	var got []string
+	for _, event := range sink.waitFor(t, 3) {
+		if event.Old != nil || event.New != nil || event.Length == nil {
+			t.Fatalf("event %+v, want just the values pushed or popped and the length", event)
+		}
+		got = append(got, fmt.Sprint(event.Type, " ", event.Key, " ", event.Values, " ", *event.Length))
+	}
+	if strings.Join(got, ", ") != "rpush queue [a b] 2, lpop queue [a] 1, lpop queue [b] 0" {
+		t.Fatalf("published %q, want each push and pop with its values", got)
+	}
+}
+
+func TestPublisher_RetriesUntilTheSinkAcceptsChanges(t *testing.T) {
+	sink := &recordingSink{failures: 2}
+	kv, publisher := newTestPublisher(t, sink, 0)
+
+	for _, key := range []string{"a", "b", "c"} {
+		if _, err := kv.Set(key, "value"); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+	}
+	events := sink.waitFor(t, 3)
+	seen := map[string]int{}
+	for _, event := range events {
+		seen[event.Key]++
+	}
+	if len(seen) != 3 {
+		t.Fatalf("published %d distinct keys, want a, b and c", len(seen))
+	}
+	if stats := publisher.Stats(); stats.Failures != 2 {
+		t.Fatalf("Stats = %+v, want 2 failures", stats)
+	}
+}
+
+func TestPublisher_ResyncsAfterFallingBehind(t *testing.T) {
+	sink := &recordingSink{held: make(chan struct{})}
+	kv, publisher := newTestPublisher(t, sink, 1)
+
+	keys := []string{"a", "b", "c", "d", "e"}
+	for _, key := range keys {
+		if _, err := kv.Set(key, "value"); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+	}
+	close(sink.held)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for publisher.Stats().Resyncs == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("publisher never resynced after falling behind")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	events := sink.waitFor(t, len(keys))
+	resynced := map[string]bool{}
+	for _, event := range events {
+		if event.Resync && event.Type == "set" {
+			resynced[event.Key] = true
+		}
+	}
+	for _, key := range keys {
+		if !resynced[key] {
+			t.Fatalf("key %s was not published again by the resync", key)
+		}
+	}
+}
+
+func TestParseSink_PostsToHTTPAndKafkaREST(t *testing.T) {
+	var mu sync.Mutex
+	bodies := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies[r.URL.Path] = r.Header.Get("Content-Type") + " " + string(body)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	value := "v"
+	events := []Event{{Node: "n", Type: "set", Key: "k", New: &value}}
+	for _, spec := range []string{server.URL + "/hook", strings.Replace(server.URL, "http://", "kafka+http://", 1) + "/changes"} {
+		sink, err := ParseSink(spec, nil)
+		if err != nil {
+			t.Fatalf("ParseSink(%s) returned error: %v", spec, err)
+		}
+		if err := sink.Publish(context.Background(), events); err != nil {
+			t.Fatalf("Publish to %s returned error: %v", spec, err)
+		}
+	}
+
+	if got := bodies["/hook"]; !strings.HasPrefix(got, `application/json [{"node":"n"`) {
+		t.Fatalf("HTTP sink posted %q, want a JSON array of events", got)
+	}
+	if got := bodies["/topics/changes"]; !strings.HasPrefix(got, `application/vnd.kafka.json.v2+json {"records":[{"key":"k","value":{"node":"n"`) {
+		t.Fatalf("Kafka sink posted %q, want records keyed by key", got)
+	}
+	for _, spec := range []string{"ftp://host/x", "kafka+http://proxy/", "nats://host:4222"} {
+		if _, err := ParseSink(spec, nil); err == nil {
+			t.Fatalf("ParseSink(%s) returned no error", spec)
+		}
+	}
+}
+
+func TestParseSink_PublishesToNATS(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	defer listener.Close()
+	published := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.WriteString(conn, "INFO {\"server_id\":\"test\"}\r\n")
+		reader := bufio.NewReader(conn)
+		var subjects []string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch fields := strings.Fields(line); fields[0] {
+			case "PUB":
+				payload, _ := reader.ReadString('\n')
+				var event Event
+				if json.Unmarshal([]byte(strings.TrimSpace(payload)), &event) == nil {
+					subjects = append(subjects, fields[1]+":"+event.Key)
+				}
+			case "PING":
+				_, _ = io.WriteString(conn, "PONG\r\n")
+				published <- strings.Join(subjects, ",")
+			}
+		}
+	}()
+
+	sink, err := ParseSink("nats://"+listener.Addr().String()+"/blueis.changes", nil)
+	if err != nil {
+		t.Fatalf("ParseSink returned error: %v", err)
+	}
+	defer sink.Close()
+	if err := sink.Publish(context.Background(), []Event{{Key: "a"}, {Key: "b"}}); err != nil {
+		t.Fatalf("Publish returned error: %v", err)
+	}
+	if got := <-published; got != "blueis.changes:a,blueis.changes:b" {
+		t.Fatalf("NATS server received %q, want both events on the subject", got)
+	}
+}
@@ -0,0 +1,243 @@
+package cdc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ParseSink returns the sink spec names:
+//
+//   - http://host/path or https://host/path posts each batch of events to
+//     the URL as a JSON array
+//   - kafka+http://proxy:8082/topic or kafka+https://... produces the events
+//     to a Kafka topic through a Kafka REST proxy, keyed by the changed key
+//     so each key's events land on one partition in order
+//   - nats://host:4222/subject publishes each event to a NATS subject
+//
+// HTTP requests are made with client, or http.DefaultClient if nil.
+func ParseSink(spec string, client *http.Client) (Sink, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	target, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sink %q: %w", spec, err)
+	}
+	switch target.Scheme {
+	case "http", "https":
+		return &httpSink{url: target.String(), client: client}, nil
+	case "kafka+http", "kafka+https":
+		topic := strings.Trim(target.Path, "/")
+		if topic == "" || strings.Contains(topic, "/") {
+			return nil, fmt.Errorf("invalid sink %q: want kafka+http://<proxy>/<topic>", spec)
+		}
+		target.Scheme = strings.TrimPrefix(target.Scheme, "kafka+")
+		target.Path = path.Join("/topics", topic)
+		return &kafkaRESTSink{url: target.String(), client: client}, nil
+	case "nats":
+		subject := strings.Trim(target.Path, "/")
+		if target.Host == "" || subject == "" || strings.ContainsAny(subject, " \t/") {
+			return nil, fmt.Errorf("invalid sink %q: want nats://<host:port>/<subject>", spec)
+		}
+		return &natsSink{address: target.Host, subject: subject}, nil
+	}
+	return nil, fmt.Errorf("invalid sink %q: the scheme must be http, https, kafka+http, kafka+https or nats", spec)
+}
+
+// httpSink posts events to a URL, which must answer 2xx once it has
+// accepted them.
+type httpSink struct {
+	url    string
+	client *http.Client
+}
+
+func (sink *httpSink) Publish(ctx context.Context, events []Event) error {
+	body, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	return post(ctx, sink.client, sink.url, "application/json", body)
+}
+
+func (sink *httpSink) Close() error {
+	return nil
+}
+
+// kafkaRESTSink produces events to a topic through the Kafka REST proxy's
+// v2 API.
+type kafkaRESTSink struct {
+	url    string
+	client *http.Client
+}
+
+type kafkaRecords struct {
+	Records []kafkaRecord `json:"records"`
+}
+
+type kafkaRecord struct {
+	Key   string `json:"key"`
+	Value Event  `json:"value"`
+}
+
+func (sink *kafkaRESTSink) Publish(ctx context.Context, events []Event) error {
+	records := kafkaRecords{Records: make([]kafkaRecord, len(events))}
+	for i, event := range events {
+		records.Records[i] = kafkaRecord{Key: event.Key, Value: event}
+	}
+	body, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	return post(ctx, sink.client, sink.url, "application/vnd.kafka.json.v2+json", body)
+}
+
+func (sink *kafkaRESTSink) Close() error {
+	return nil
+}
+
+func post(ctx context.Context, client *http.Client, url string, contentType string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s replied %s: %s", url, resp.Status, bytes.TrimSpace(message))
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// natsTimeout bounds connecting to a NATS server and waiting for it to
+// confirm a batch.
+const natsTimeout = 10 * time.Second
+
+// natsSink publishes events to a NATS subject over the server's text
+// protocol. Each batch ends with a PING, and is only published once the
+// server answers PONG, by when it has processed every PUB before it. The
+// connection is dropped on any error and made again for the next batch.
+type natsSink struct {
+	address string
+	subject string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (sink *natsSink) Publish(ctx context.Context, events []Event) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+
+	if err := sink.publish(ctx, events); err != nil {
+		sink.closeConn()
+		return fmt.Errorf("publishing to nats://%s/%s: %w", sink.address, sink.subject, err)
+	}
+	return nil
+}
+
+func (sink *natsSink) publish(ctx context.Context, events []Event) error {
+	if sink.conn == nil {
+		if err := sink.connect(ctx); err != nil {
+			return err
+		}
+	}
+	deadline := time.Now().Add(natsTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if err := sink.conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	for _, event := range events {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&out, "PUB %s %d\r\n", sink.subject, len(payload))
+		out.Write(payload)
+		out.WriteString("\r\n")
+	}
+	out.WriteString("PING\r\n")
+	if _, err := sink.conn.Write(out.Bytes()); err != nil {
+		return err
+	}
+	return sink.awaitPong()
+}
+
+// connect dials the server, reads its INFO and introduces the client.
+func (sink *natsSink) connect(ctx context.Context) error {
+	dialer := net.Dialer{Timeout: natsTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", sink.address)
+	if err != nil {
+		return err
+	}
+	sink.conn, sink.reader = conn, bufio.NewReader(conn)
+	if err := conn.SetDeadline(time.Now().Add(natsTimeout)); err != nil {
+		return err
+	}
+	line, err := sink.reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("server greeted with %q, want INFO", strings.TrimSpace(line))
+	}
+	_, err = io.WriteString(conn, "CONNECT {\"verbose\":false,\"pedantic\":false,\"name\":\"blueis-cdc\"}\r\n")
+	return err
+}
+
+// awaitPong reads until the server answers the batch's PING, answering its
+// own PINGs and failing on -ERR.
+func (sink *natsSink) awaitPong() error {
+	for {
+		line, err := sink.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := io.WriteString(sink.conn, "PONG\r\n"); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("server replied %s", line)
+		}
+	}
+}
+
+func (sink *natsSink) closeConn() {
+	if sink.conn != nil {
+		_ = sink.conn.Close()
+		sink.conn, sink.reader = nil, nil
+	}
+}
+
+func (sink *natsSink) Close() error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	sink.closeConn()
+	return nil
+}
@@ -0,0 +1,290 @@
+// Package changelog archives the changes a node makes, with when each was
+// made, so its keys can be put back as they were at any time the archive
+// covers by replaying the changes on top of a backup taken before then.
+package changelog
+
+import (
+	"blueis/internal/kvstore"
+	"bufio"
+	"cmp"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotCovered is returned by Replay when the log does not hold every
+// change after the position asked for.
+var ErrNotCovered = errors.New("changes are not covered by the change log")
+
+const segmentSuffix = ".changes"
+
+// Entry is a change the log holds.
+type Entry struct {
+	// Run is the replication run of the store that made the change, which
+	// Mutation.Offset counts within
+	Run      string
+	Mutation kvstore.Mutation
+	// At is when the change was archived, in Unix nanoseconds
+	At int64
+	// Gap is set on the first change archived after some were lost
+	Gap bool
+}
+
+// Log appends entries to segment files under dir, starting a new one when
+// the current one reaches segmentBytes and every time the log is opened.
+// Segments holding only entries older than retention are removed as new
+// ones are started.
+type Log struct {
+	dir          string
+	segmentBytes int64
+	retention    time.Duration
+	now          func() time.Time
+	// beforeSync, if set, is called before each sync to disk
+	beforeSync func()
+
+	mu      sync.Mutex
+	file    *os.File
+	buffer  *bufio.Writer
+	encoder *gob.Encoder
+	size    int64
+}
+
+func Open(dir string, segmentBytes int64, retention time.Duration) (*Log, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating change log directory %s: %w", dir, err)
+	}
+	return &Log{dir: dir, segmentBytes: segmentBytes, retention: retention, now: time.Now}, nil
+}
+
+// OnSync sets fn to be called before each sync of the log to disk, for
+// fault injection to slow them down. It must be set before the log is used.
+func (log *Log) OnSync(fn func()) {
+	log.beforeSync = fn
+}
+
+// Append writes entries to the log. They are buffered until the next Sync.
+func (log *Log) Append(entries []Entry) error {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	for _, entry := range entries {
+		if log.file == nil || log.size >= log.segmentBytes {
+			if err := log.rotate(); err != nil {
+				return err
+			}
+		}
+		if err := log.encoder.Encode(entry); err != nil {
+			return fmt.Errorf("writing change log: %w", err)
+		}
+	}
+	return nil
+}
+
+// rotate starts a new segment, named after when it was started so
+// segments sort in the order they were written, and prunes old ones.
+func (log *Log) rotate() error {
+	if err := log.closeSegment(); err != nil {
+		return err
+	}
+	now := log.now()
+	name := fmt.Sprintf("%020d%s", now.UnixNano(), segmentSuffix)
+	file, err := os.OpenFile(filepath.Join(log.dir, name), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o644)
+	if err != nil {
+		return fmt.Errorf("starting change log segment: %w", err)
+	}
+	log.file, log.size = file, 0
+	log.buffer = bufio.NewWriter(&countingWriter{w: file, n: &log.size})
+	log.encoder = gob.NewEncoder(log.buffer)
+	return log.prune(now)
+}
+
+// prune removes the segments whose successor was started before the
+// retention window, since every entry in them is older than it.
+func (log *Log) prune(now time.Time) error {
+	segments, err := log.segments()
+	if err != nil {
+		return err
+	}
+	cutoff := now.Add(-log.retention).UnixNano()
+	for i := 0; i+1 < len(segments); i++ {
+		if segments[i+1].started >= cutoff {
+			break
+		}
+		if err := os.Remove(segments[i].path); err != nil {
+			return fmt.Errorf("pruning change log: %w", err)
+		}
+	}
+	return nil
+}
+
+// Sync writes buffered entries out and makes them durable.
+func (log *Log) Sync() error {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	return log.sync()
+}
+
+func (log *Log) sync() error {
+	if log.file == nil {
+		return nil
+	}
+	if err := log.buffer.Flush(); err != nil {
+		return fmt.Errorf("writing change log: %w", err)
+	}
+	if log.beforeSync != nil {
+		log.beforeSync()
+	}
+	return log.file.Sync()
+}
+
+func (log *Log) closeSegment() error {
+	if log.file == nil {
+		return nil
+	}
+	err := log.sync()
+	if closeErr := log.file.Close(); err == nil {
+		err = closeErr
+	}
+	log.file = nil
+	return err
+}
+
+// Close syncs and closes the log.
+func (log *Log) Close() error {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	return log.closeSegment()
+}
+
+type segment struct {
+	path    string
+	started int64
+	// size is how much of the segment to read, or -1 for all of it
+	size int64
+}
+
+func (log *Log) segments() ([]segment, error) {
+	entries, err := os.ReadDir(log.dir)
+	if err != nil {
+		return nil, fmt.Errorf("listing change log: %w", err)
+	}
+	var segments []segment
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), segmentSuffix)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		started, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment{path: filepath.Join(log.dir, entry.Name()), started: started, size: -1})
+	}
+	slices.SortFunc(segments, func(a, b segment) int { return cmp.Compare(a.started, b.started) })
+	return segments, nil
+}
+
+// Replay calls fn with every change the store made after offset of the
+// run, up to and including those archived at until, in the order they
+// were made. It fails with ErrNotCovered if the log does not hold the
+// changes that followed offset, or some of them were lost before until.
+// Changes made by later runs of the store, after it restarted, follow the
+// run's own.
+func (log *Log) Replay(run string, offset uint64, until time.Time, fn func(Entry) error) error {
+	// The segment being written is read up to what it holds now, so
+	// appends carry on while the log is replayed
+	log.mu.Lock()
+	err := log.sync()
+	segments, listErr := log.segments()
+	if log.file != nil && len(segments) > 0 {
+		segments[len(segments)-1].size = log.size
+	}
+	log.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if listErr != nil {
+		return listErr
+	}
+
+	seenRun, started := false, false
+	for _, segment := range segments {
+		done, err := readSegment(segment, func(entry Entry) (bool, error) {
+			if !started {
+				switch {
+				case entry.Run == run && entry.Mutation.Offset <= offset:
+					seenRun = true
+					return false, nil
+				case entry.Run == run && entry.Mutation.Offset != offset+1:
+					return true, fmt.Errorf("%w: the log skips from offset %d to %d", ErrNotCovered, offset, entry.Mutation.Offset)
+				case entry.Run != run && !seenRun:
+					// From an earlier run, or one the log has no start for
+					return false, nil
+				}
+				started = true
+			} else if entry.Gap {
+				// The changes lost were made after the last one archived,
+				// which was no later than until, so until may fall among them
+				return true, fmt.Errorf("%w: changes were lost at %s", ErrNotCovered, time.Unix(0, entry.At).UTC().Format(time.RFC3339Nano))
+			}
+			if entry.At > until.UnixNano() {
+				return true, nil
+			}
+			return false, fn(entry)
+		})
+		if err != nil || done {
+			return err
+		}
+	}
+	if !started && !seenRun {
+		return fmt.Errorf("%w: the log holds nothing of run %s", ErrNotCovered, run)
+	}
+	return nil
+}
+
+// readSegment calls fn with each entry in segment until it reports done.
+// A segment cut short by a crash is read up to its last whole entry.
+func readSegment(segment segment, fn func(Entry) (done bool, err error)) (bool, error) {
+	file, err := os.Open(segment.path)
+	if err != nil {
+		return false, fmt.Errorf("reading change log: %w", err)
+	}
+	defer file.Close()
+	var reader io.Reader = file
+	if segment.size >= 0 {
+		reader = io.LimitReader(file, segment.size)
+	}
+	decoder := gob.NewDecoder(bufio.NewReader(reader))
+	for {
+		var entry Entry
+		err := decoder.Decode(&entry)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("reading change log segment %s: %w", filepath.Base(segment.path), err)
+		}
+		if done, err := fn(entry); done || err != nil {
+			return done, err
+		}
+	}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (writer *countingWriter) Write(p []byte) (int, error) {
+	n, err := writer.w.Write(p)
+	*writer.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,136 @@
+package changelog
+
+import (
+	"blueis/internal/kvstore"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func entry(run string, offset uint64, at int64) Entry {
+	return Entry{Run: run, At: at, Mutation: kvstore.Mutation{Offset: offset, Type: kvstore.MutationSet, Key: "k", Value: run}}
+}
+
+func replayed(t *testing.T, log *Log, run string, offset uint64, until int64) ([]uint64, error) {
+	t.Helper()
+	var offsets []uint64
+	err := log.Replay(run, offset, time.Unix(0, until), func(e Entry) error {
+		offsets = append(offsets, e.Mutation.Offset)
+		return nil
+	})
+	return offsets, err
+}
+
+func TestLog_ReplaysChangesAfterAPositionUntilATime(t *testing.T) {
+	log, err := Open(t.TempDir(), 1<<20, time.Hour)
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	defer log.Close()
+	if err := log.Append([]Entry{entry("a", 1, 10), entry("a", 2, 20), entry("a", 3, 30), entry("a", 4, 40)}); err != nil {
+		t.Fatalf("Append returned error: %v", err)
+	}
+
+	offsets, err := replayed(t, log, "a", 1, 30)
+	if err != nil || len(offsets) != 2 || offsets[0] != 2 || offsets[1] != 3 {
+		t.Fatalf("Replay = %v, %v, want offsets 2 and 3", offsets, err)
+	}
+	// Nothing has changed since offset 4
+	if offsets, err := replayed(t, log, "a", 4, 50); err != nil || len(offsets) != 0 {
+		t.Fatalf("Replay from the last change = %v, %v, want nothing", offsets, err)
+	}
+}
+
+func TestLog_ReplaysLaterRunsAfterARestart(t *testing.T) {
+	dir := t.TempDir()
+	log, err := Open(dir, 1<<20, time.Hour)
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	if err := log.Append([]Entry{entry("a", 1, 10), entry("a", 2, 20)}); err != nil {
+		t.Fatalf("Append returned error: %v", err)
+	}
+	log.Close()
+
+	reopened, err := Open(dir, 1<<20, time.Hour)
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	defer reopened.Close()
+	if err := reopened.Append([]Entry{entry("b", 1, 30)}); err != nil {
+		t.Fatalf("Append returned error: %v", err)
+	}
+	offsets, err := replayed(t, reopened, "a", 1, 100)
+	if err != nil || len(offsets) != 2 || offsets[1] != 1 {
+		t.Fatalf("Replay = %v, %v, want a's offset 2 then b's offset 1", offsets, err)
+	}
+}
+
+func TestLog_RefusesToReplayWhatItDoesNotHold(t *testing.T) {
+	log, err := Open(t.TempDir(), 1<<20, time.Hour)
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	defer log.Close()
+	gap := entry("a", 6, 60)
+	gap.Gap = true
+	if err := log.Append([]Entry{entry("a", 3, 30), entry("a", 4, 40), gap}); err != nil {
+		t.Fatalf("Append returned error: %v", err)
+	}
+
+	cases := []struct {
+		name   string
+		run    string
+		offset uint64
+		until  int64
+	}{
+		{"unknown run", "other", 0, 100},
+		{"before the log starts", "a", 1, 100},
+		{"up to lost changes", "a", 3, 40},
+		{"across lost changes", "a", 3, 100},
+	}
+	for _, tc := range cases {
+		if _, err := replayed(t, log, tc.run, tc.offset, tc.until); !errors.Is(err, ErrNotCovered) {
+			t.Errorf("%s: Replay returned %v, want ErrNotCovered", tc.name, err)
+		}
+	}
+	// Stopping before the changes were lost is fine
+	if offsets, err := replayed(t, log, "a", 2, 35); err != nil || len(offsets) != 1 || offsets[0] != 3 {
+		t.Fatalf("Replay before the gap = %v, %v, want offset 3", offsets, err)
+	}
+}
+
+func TestLog_RotatesAndPrunesSegments(t *testing.T) {
+	dir := t.TempDir()
+	log, err := Open(dir, 1, time.Hour)
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	defer log.Close()
+	now := time.Unix(1000, 0)
+	log.now = func() time.Time { return now }
+
+	for i := range uint64(3) {
+		if err := log.Append([]Entry{entry("a", i+1, now.UnixNano())}); err != nil {
+			t.Fatalf("Append returned error: %v", err)
+		}
+		if err := log.Sync(); err != nil {
+			t.Fatalf("Sync returned error: %v", err)
+		}
+		now = now.Add(time.Minute)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 3 {
+		t.Fatalf("log has %d segments, want one per entry", len(files))
+	}
+
+	now = now.Add(2 * time.Hour)
+	if err := log.Append([]Entry{entry("a", 4, now.UnixNano())}); err != nil {
+		t.Fatalf("Append returned error: %v", err)
+	}
+	// Only the newest segment before the window is kept, as it holds the
+	// changes up to the window's start
+	if files, _ := os.ReadDir(dir); len(files) != 2 {
+		t.Fatalf("log has %d segments after pruning, want 2", len(files))
+	}
+}
@@ -0,0 +1,200 @@
+// Package compat measures how closely blueis follows Redis over RESP. It
+// runs a corpus of commands against a blueis node and a real Redis server
+// side by side and diffs their replies, so the commands and semantics
+// blueis gets right, and those it does not yet, can be tracked as the
+// RESP surface grows.
+package compat
+
+import (
+	"blueis/internal/resp"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Conn is a client connection to a RESP server.
+type Conn struct {
+	conn    net.Conn
+	reader  *resp.Reader
+	writer  *resp.Writer
+	timeout time.Duration
+}
+
+// Dial connects to the RESP server at addr. Each command sent must be
+// answered within timeout, if it is positive.
+func Dial(addr string, timeout time.Duration) (*Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{conn, resp.NewReader(conn), resp.NewWriter(conn), timeout}, nil
+}
+
+// Do sends a command and returns its reply. An error reply is returned as
+// a Reply; the error is for failing to talk to the server at all.
+func (conn *Conn) Do(args ...string) (resp.Reply, error) {
+	if conn.timeout > 0 {
+		_ = conn.conn.SetDeadline(time.Now().Add(conn.timeout))
+	}
+	_ = conn.writer.WriteArray(len(args))
+	for _, arg := range args {
+		_ = conn.writer.WriteBulkString(arg)
+	}
+	if err := conn.writer.Flush(); err != nil {
+		return resp.Reply{}, err
+	}
+	return conn.reader.ReadReply()
+}
+
+func (conn *Conn) Close() error {
+	return conn.conn.Close()
+}
+
+// Difference is a command blueis and Redis answered differently.
+type Difference struct {
+	Command Command
+	Blueis  resp.Reply
+	Redis   resp.Reply
+}
+
+// Result is how blueis compared with Redis on one case.
+type Result struct {
+	Case        Case
+	Differences []Difference
+}
+
+// Matches reports whether blueis answered every command as Redis did.
+func (result Result) Matches() bool {
+	return len(result.Differences) == 0
+}
+
+// Run runs cases against both servers, with KeyPlaceholder replaced by
+// prefix, and compares their replies. It stops at the first connection
+// that fails, returning the cases run so far.
+func Run(blueis, redis *Conn, cases []Case, prefix string) ([]Result, error) {
+	results := make([]Result, 0, len(cases))
+	for _, c := range cases {
+		result := Result{Case: c}
+		for _, command := range c.Commands {
+			args := make([]string, len(command.Args))
+			for i, arg := range command.Args {
+				args[i] = strings.ReplaceAll(arg, KeyPlaceholder, prefix)
+			}
+			blueisReply, err := blueis.Do(args...)
+			if err != nil {
+				return results, fmt.Errorf("blueis, line %d %s: %w", command.Line, command, err)
+			}
+			redisReply, err := redis.Do(args...)
+			if err != nil {
+				return results, fmt.Errorf("redis, line %d %s: %w", command.Line, command, err)
+			}
+			if !sameReply(blueisReply, redisReply, command.TypeOnly) {
+				result.Differences = append(result.Differences, Difference{command, blueisReply, redisReply})
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func sameReply(a, b resp.Reply, typeOnly bool) bool {
+	if !typeOnly {
+		return a.String() == b.String()
+	}
+	if a.Type != b.Type || a.Null != b.Null {
+		return false
+	}
+	if a.Type == '-' {
+		codeA, _, _ := strings.Cut(a.Text, " ")
+		codeB, _, _ := strings.Cut(b.Text, " ")
+		return codeA == codeB
+	}
+	return true
+}
+
+// Regressions returns the cases blueis is expected to answer as Redis does
+// but did not.
+func Regressions(results []Result) []Result {
+	return slices.DeleteFunc(slices.Clone(results), func(result Result) bool {
+		return result.Case.Known != "" || result.Matches()
+	})
+}
+
+// Fixed returns the cases marked as known differences that blueis now
+// answers as Redis does, whose mark can be removed.
+func Fixed(results []Result) []Result {
+	return slices.DeleteFunc(slices.Clone(results), func(result Result) bool {
+		return result.Case.Known == "" || !result.Matches()
+	})
+}
+
+// CommandStats counts how many times blueis answered a command as Redis
+// did.
+type CommandStats struct {
+	Name    string
+	Matched int
+	Total   int
+}
+
+// Commands tallies results by command name, in name order.
+func Commands(results []Result) []CommandStats {
+	counts := make(map[string]*CommandStats)
+	for _, result := range results {
+		for _, command := range result.Case.Commands {
+			name := strings.ToUpper(command.Args[0])
+			stats := counts[name]
+			if stats == nil {
+				stats = &CommandStats{Name: name}
+				counts[name] = stats
+			}
+			stats.Total++
+			if !slices.ContainsFunc(result.Differences, func(difference Difference) bool {
+				return difference.Command.Line == command.Line
+			}) {
+				stats.Matched++
+			}
+		}
+	}
+	var all []CommandStats
+	for _, stats := range counts {
+		all = append(all, *stats)
+	}
+	slices.SortFunc(all, func(a, b CommandStats) int { return strings.Compare(a.Name, b.Name) })
+	return all
+}
+
+// WriteReport writes each case's outcome, the replies of every command
+// answered differently, and how often each command matched.
+func WriteReport(w io.Writer, results []Result) {
+	matched := 0
+	for _, result := range results {
+		outcome := "ok"
+		switch {
+		case result.Matches() && result.Case.Known != "":
+			outcome = "FIXED"
+		case result.Matches():
+			matched++
+		case result.Case.Known != "":
+			outcome = "known"
+		default:
+			outcome = "DIFF"
+		}
+		fmt.Fprintf(w, "%-5s %s (line %d)\n", outcome, result.Case.Name, result.Case.Line)
+		if result.Case.Known != "" {
+			fmt.Fprintf(w, "      known difference: %s\n", result.Case.Known)
+		}
+		for _, difference := range result.Differences {
+			fmt.Fprintf(w, "      line %d: %s\n        blueis: %s\n        redis:  %s\n",
+				difference.Command.Line, difference.Command, difference.Blueis, difference.Redis)
+		}
+	}
+
+	fmt.Fprintf(w, "\n%d of %d cases match, %d regressed, %d fixed\n\n",
+		matched+len(Fixed(results)), len(results), len(Regressions(results)), len(Fixed(results)))
+	for _, stats := range Commands(results) {
+		fmt.Fprintf(w, "%-16s %d/%d\n", stats.Name, stats.Matched, stats.Total)
+	}
+}
@@ -0,0 +1,201 @@
+package compat
+
+import (
+	"blueis/internal/resp"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startServer serves handler over RESP on a local port and returns a
+// connection to it.
+func startServer(t *testing.T, handler resp.HandlerFunc) *Conn {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen returned error: %v", err)
+	}
+	server := resp.NewServer(handler)
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(func() { _ = server.Close() })
+
+	conn, err := Dial(listener.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("Dial returned error: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+// fakeServer answers ECHO, and GET with a null or with "v" for keys it was
+// told hold it; anything else is an unknown command, worded as given.
+func fakeServer(unknown string, keys ...string) resp.HandlerFunc {
+	return func(w *resp.Writer, args [][]byte) {
+		switch strings.ToUpper(string(args[0])) {
+		case "ECHO":
+			_ = w.WriteBulk(args[1])
+		case "GET":
+			for _, key := range keys {
+				if string(args[1]) == key {
+					_ = w.WriteBulkString("v")
+					return
+				}
+			}
+			_ = w.WriteNull()
+		default:
+			_ = w.WriteError(unknown)
+		}
+	}
+}
+
+func TestParseCorpus(t *testing.T) {
+	cases, err := ParseCorpus(strings.NewReader(`# a comment
+=== echo
+ECHO "two words\n"
+~ NOSUCH  a   b
+
+=== get
+! blueis differs
+GET {k}a
+`))
+	if err != nil {
+		t.Fatalf("ParseCorpus returned error: %v", err)
+	}
+	want := []Case{
+		{Name: "echo", Line: 2, Commands: []Command{
+			{Args: []string{"ECHO", "two words\n"}, Line: 3},
+			{Args: []string{"NOSUCH", "a", "b"}, TypeOnly: true, Line: 4},
+		}},
+		{Name: "get", Known: "blueis differs", Line: 6, Commands: []Command{
+			{Args: []string{"GET", "{k}a"}, Line: 8},
+		}},
+	}
+	if !reflect.DeepEqual(cases, want) {
+		t.Fatalf("ParseCorpus = %+v, want %+v", cases, want)
+	}
+	if got := cases[0].Commands[0].String(); got != `ECHO "two words\n"` {
+		t.Fatalf("String = %s, want the command quoted as written", got)
+	}
+
+	for _, corpus := range []string{
+		"GET a\n",
+		"===\nGET a\n",
+		"=== empty\n",
+		"=== unterminated\nECHO \"oops\n",
+		"=== run on\nECHO \"a\"b\n",
+		"=== no reason\n!\nGET a\n",
+	} {
+		if _, err := ParseCorpus(strings.NewReader(corpus)); err == nil {
+			t.Errorf("ParseCorpus(%q) returned nil, want an error", corpus)
+		}
+	}
+}
+
+func TestDefaultCorpus_Parses(t *testing.T) {
+	cases, err := ParseCorpus(strings.NewReader(DefaultCorpus))
+	if err != nil {
+		t.Fatalf("ParseCorpus(DefaultCorpus) returned error: %v", err)
+	}
+	if len(cases) == 0 {
+		t.Fatal("DefaultCorpus holds no cases")
+	}
+}
+
+func TestRun_DiffsReplies(t *testing.T) {
+	redis := startServer(t, fakeServer("ERR unknown command, with args beginning with:", "p:a", "p:b"))
+	blueis := startServer(t, fakeServer("ERR unknown command", "p:a"))
+	cases, err := ParseCorpus(strings.NewReader(`
+=== matches
+ECHO hi
+GET {k}a
+~NOSUCH
+
+=== regressed
+GET {k}b
+ECHO hi
+
+=== still known
+! b is not stored yet
+GET {k}b
+
+=== fixed
+! unknown commands were worded differently
+~NOSUCH
+`))
+	if err != nil {
+		t.Fatalf("ParseCorpus returned error: %v", err)
+	}
+
+	results, err := Run(blueis, redis, cases, "p:")
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if len(results) != 4 || !results[0].Matches() || results[1].Matches() || results[2].Matches() || !results[3].Matches() {
+		t.Fatalf("Run = %+v, want the second and third cases to differ", results)
+	}
+	difference := results[1].Differences[0]
+	if difference.Command.Line != 8 || difference.Blueis.String() != "(nil)" || difference.Redis.String() != `"v"` {
+		t.Fatalf("difference = %+v, want GET {k}b answered (nil) and \"v\"", difference)
+	}
+	if regressed := Regressions(results); len(regressed) != 1 || regressed[0].Case.Name != "regressed" {
+		t.Fatalf("Regressions = %+v, want the regressed case", regressed)
+	}
+	if fixed := Fixed(results); len(fixed) != 1 || fixed[0].Case.Name != "fixed" {
+		t.Fatalf("Fixed = %+v, want the fixed case", fixed)
+	}
+	wantCommands := []CommandStats{{"ECHO", 2, 2}, {"GET", 1, 3}, {"NOSUCH", 2, 2}}
+	if commands := Commands(results); !reflect.DeepEqual(commands, wantCommands) {
+		t.Fatalf("Commands = %+v, want %+v", commands, wantCommands)
+	}
+
+	var report strings.Builder
+	WriteReport(&report, results)
+	for _, want := range []string{
+		"ok    matches", "DIFF  regressed", "known still known", "FIXED fixed",
+		"line 8: GET {k}b\n        blueis: (nil)\n        redis:  \"v\"",
+		"2 of 4 cases match, 1 regressed, 1 fixed", "GET              1/3",
+	} {
+		if !strings.Contains(report.String(), want) {
+			t.Errorf("report does not contain %q:\n%s", want, report.String())
+		}
+	}
+}
+
+// TestCorpus_AgainstRedis runs the default corpus against a blueis node's
+// RESP listener at $BLUEIS_COMPAT_BLUEIS and a Redis server at
+// $BLUEIS_COMPAT_REDIS, failing on any case expected to match that does
+// not. It is skipped unless both are set.
+func TestCorpus_AgainstRedis(t *testing.T) {
+	blueisAddr, redisAddr := os.Getenv("BLUEIS_COMPAT_BLUEIS"), os.Getenv("BLUEIS_COMPAT_REDIS")
+	if blueisAddr == "" || redisAddr == "" {
+		t.Skip("BLUEIS_COMPAT_BLUEIS and BLUEIS_COMPAT_REDIS are not set")
+	}
+	cases, err := ParseCorpus(strings.NewReader(DefaultCorpus))
+	if err != nil {
+		t.Fatalf("ParseCorpus returned error: %v", err)
+	}
+	blueis, err := Dial(blueisAddr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("dialling blueis: %v", err)
+	}
+	defer blueis.Close()
+	redis, err := Dial(redisAddr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("dialling redis: %v", err)
+	}
+	defer redis.Close()
+
+	results, err := Run(blueis, redis, cases, "compat:"+time.Now().Format("20060102T150405.000000000")+":")
+	var report strings.Builder
+	WriteReport(&report, results)
+	t.Log("\n" + report.String())
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	for _, result := range Regressions(results) {
+		t.Errorf("%s (line %d) no longer matches Redis", result.Case.Name, result.Case.Line)
+	}
+}
@@ -0,0 +1,137 @@
+package compat
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// DefaultCorpus is the corpus kept with the harness, covering the commands
+// blueis serves and those it is expected to grow.
+//
+//go:embed corpus.txt
+var DefaultCorpus string
+
+// KeyPlaceholder is replaced in every argument by the run's key prefix, so
+// runs do not see each other's keys.
+const KeyPlaceholder = "{k}"
+
+// Case is a run of commands sent in order to each server, whose replies
+// are compared one by one.
+type Case struct {
+	Name string
+	// Known is why blueis is known to answer differently, empty if it is
+	// expected to answer as Redis does
+	Known    string
+	Commands []Command
+	// Line is where the case starts in its corpus
+	Line int
+}
+
+type Command struct {
+	Args []string
+	// TypeOnly compares only the type of the replies, and the code of an
+	// error, for replies that differ between runs or in wording, such as
+	// idle times
+	TypeOnly bool
+	Line     int
+}
+
+func (command Command) String() string {
+	quoted := make([]string, len(command.Args))
+	for i, arg := range command.Args {
+		quoted[i] = quoteArg(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// ParseCorpus reads a corpus of cases. Each case starts with a line
+// "=== name" and holds one command per line, its arguments separated by
+// spaces and quoted as Go strings where they hold spaces or escapes. A
+// command line starting with "~" is compared by type only. A line "! why"
+// marks the case as a known difference. Blank lines and lines starting
+// with "#" are ignored.
+func ParseCorpus(r io.Reader) ([]Case, error) {
+	var cases []Case
+	scanner := bufio.NewScanner(r)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "", strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "==="):
+			name := strings.TrimSpace(strings.TrimPrefix(line, "==="))
+			if name == "" {
+				return nil, fmt.Errorf("line %d: case has no name", number)
+			}
+			cases = append(cases, Case{Name: name, Line: number})
+			continue
+		}
+		if len(cases) == 0 {
+			return nil, fmt.Errorf("line %d: command before the first case", number)
+		}
+		current := &cases[len(cases)-1]
+		if why, ok := strings.CutPrefix(line, "!"); ok {
+			current.Known = strings.TrimSpace(why)
+			if current.Known == "" {
+				return nil, fmt.Errorf("line %d: known difference gives no reason", number)
+			}
+			continue
+		}
+		command := Command{Line: number}
+		if rest, ok := strings.CutPrefix(line, "~"); ok {
+			command.TypeOnly, line = true, rest
+		}
+		args, err := splitArgs(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", number, err)
+		}
+		if len(args) == 0 {
+			return nil, fmt.Errorf("line %d: empty command", number)
+		}
+		command.Args = args
+		current.Commands = append(current.Commands, command)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, c := range cases {
+		if len(c.Commands) == 0 {
+			return nil, fmt.Errorf("line %d: case %q has no commands", c.Line, c.Name)
+		}
+	}
+	return cases, nil
+}
+
+// splitArgs splits a command line on spaces, unquoting double-quoted
+// arguments.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	for line = strings.TrimSpace(line); line != ""; line = strings.TrimSpace(line) {
+		if line[0] != '"' {
+			arg, rest, _ := strings.Cut(line, " ")
+			args, line = append(args, arg), rest
+			continue
+		}
+		quoted, err := strconv.QuotedPrefix(line)
+		if err != nil {
+			return nil, fmt.Errorf("unterminated or invalid quoted argument %s", line)
+		}
+		arg, _ := strconv.Unquote(quoted)
+		args, line = append(args, arg), line[len(quoted):]
+		if line != "" && line[0] != ' ' {
+			return nil, fmt.Errorf("quoted argument %s runs into the next", quoted)
+		}
+	}
+	return args, nil
+}
+
+func quoteArg(arg string) string {
+	if arg == "" || strings.ContainsAny(arg, " \"\\") || strconv.Quote(arg) != `"`+arg+`"` {
+		return strconv.Quote(arg)
+	}
+	return arg
+}
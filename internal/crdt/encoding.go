@@ -0,0 +1,120 @@
+package crdt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidEncoding = errors.New("crdt: invalid encoding")
+
+var ErrTypeMismatch = errors.New("crdt: values are of different types")
+
+// Magic prefixes tell encoded values apart from each other and from other
+// values, as sketch does for count-min sketches.
+const (
+	pnCounterMagic = "\x00pnc\x01"
+	orSetMagic     = "\x00ors\x01"
+)
+
+// IsCRDT reports whether data looks like an encoded PNCounter or ORSet.
+func IsCRDT(data string) bool {
+	return IsPNCounter(data) || IsORSet(data)
+}
+
+// Merge merges two encoded values of the same type and returns the encoded
+// result, and whether it differs from local. Encodings are canonical, so
+// merging values that have already converged reports no change.
+func Merge(local string, remote string) (string, bool, error) {
+	var merged string
+	switch {
+	case IsPNCounter(local) && IsPNCounter(remote):
+		counter, err := DecodePNCounter(local)
+		if err != nil {
+			return "", false, err
+		}
+		other, err := DecodePNCounter(remote)
+		if err != nil {
+			return "", false, err
+		}
+		counter.Merge(other)
+		merged = counter.Encode()
+	case IsORSet(local) && IsORSet(remote):
+		set, err := DecodeORSet(local)
+		if err != nil {
+			return "", false, err
+		}
+		other, err := DecodeORSet(remote)
+		if err != nil {
+			return "", false, err
+		}
+		set.Merge(other)
+		merged = set.Encode()
+	default:
+		return "", false, ErrTypeMismatch
+	}
+	return merged, merged != local, nil
+}
+
+// encoder appends uvarints and length-prefixed strings.
+type encoder []byte
+
+func (e *encoder) uint(v uint64) {
+	*e = binary.AppendUvarint(*e, v)
+}
+
+func (e *encoder) string(s string) {
+	e.uint(uint64(len(s)))
+	*e = append(*e, s...)
+}
+
+// decoder reads what encoder wrote, remembering the first error.
+type decoder struct {
+	data string
+	err  error
+}
+
+func (d *decoder) uint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint([]byte(d.data[:min(len(d.data), binary.MaxVarintLen64)]))
+	if n <= 0 {
+		d.err = ErrInvalidEncoding
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	n := d.uint()
+	if d.err != nil {
+		return ""
+	}
+	if n > uint64(len(d.data)) {
+		d.err = ErrInvalidEncoding
+		return ""
+	}
+	s := d.data[:n]
+	d.data = d.data[n:]
+	return s
+}
+
+// count reads a collection size, rejecting sizes the remaining data could
+// not possibly hold so corrupt input cannot cause huge allocations.
+func (d *decoder) count() int {
+	n := d.uint()
+	if n > uint64(len(d.data)) {
+		d.err = ErrInvalidEncoding
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.data) != 0 {
+		d.err = fmt.Errorf("%w: %d trailing bytes", ErrInvalidEncoding, len(d.data))
+	}
+	return d.err
+}
@@ -0,0 +1,141 @@
+package crdt
+
+import (
+	"maps"
+	"slices"
+	"strings"
+)
+
+// ORSet is an observed-remove set that several replicas can update
+// independently and merge. When one replica adds a member that another
+// concurrently removes, the add wins. Each add is tagged with a dot, the
+// adding actor and a per-actor sequence number, and the set remembers the
+// highest sequence number it has seen from each actor. A remove drops the
+// member's dots; merging keeps a dot only if both sides still have it or
+// the other side has never seen it, so removes need no tombstones.
+type ORSet struct {
+	// seen is the highest sequence number observed from each actor
+	seen map[string]uint64
+	// dots holds each member's live dots, as actor to sequence number
+	dots map[string]map[string]uint64
+}
+
+func NewORSet() *ORSet {
+	return &ORSet{seen: make(map[string]uint64), dots: make(map[string]map[string]uint64)}
+}
+
+// Add adds member on behalf of actor, and reports whether it was absent.
+func (set *ORSet) Add(actor string, member string) bool {
+	_, present := set.dots[member]
+	set.seen[actor]++
+	// The new dot supersedes every dot of member this replica has observed
+	set.dots[member] = map[string]uint64{actor: set.seen[actor]}
+	return !present
+}
+
+// Remove removes member, and reports whether it was present.
+func (set *ORSet) Remove(member string) bool {
+	_, present := set.dots[member]
+	delete(set.dots, member)
+	return present
+}
+
+func (set *ORSet) Contains(member string) bool {
+	_, ok := set.dots[member]
+	return ok
+}
+
+// Members returns the set's members in sorted order.
+func (set *ORSet) Members() []string {
+	return slices.Sorted(maps.Keys(set.dots))
+}
+
+func (set *ORSet) Len() int {
+	return len(set.dots)
+}
+
+// Merge folds other's adds and removes into set.
+func (set *ORSet) Merge(other *ORSet) {
+	for member := range other.dots {
+		if _, ok := set.dots[member]; !ok {
+			set.dots[member] = nil
+		}
+	}
+	for member, ours := range set.dots {
+		theirs := other.dots[member]
+		kept := make(map[string]uint64)
+		for actor, seq := range ours {
+			// Keep dots the other side has too, or has not seen yet
+			if theirs[actor] == seq || seq > other.seen[actor] {
+				kept[actor] = seq
+			}
+		}
+		for actor, seq := range theirs {
+			if ours[actor] == seq || seq > set.seen[actor] {
+				kept[actor] = seq
+			}
+		}
+		if len(kept) == 0 {
+			delete(set.dots, member)
+		} else {
+			set.dots[member] = kept
+		}
+	}
+	for actor, seq := range other.seen {
+		set.seen[actor] = max(set.seen[actor], seq)
+	}
+}
+
+// Encode returns the set's canonical encoding: equal sets encode
+// identically.
+func (set *ORSet) Encode() string {
+	e := encoder(orSetMagic)
+	encodeDots(&e, set.seen)
+	members := set.Members()
+	e.uint(uint64(len(members)))
+	for _, member := range members {
+		e.string(member)
+		encodeDots(&e, set.dots[member])
+	}
+	return string(e)
+}
+
+func encodeDots(e *encoder, dots map[string]uint64) {
+	actors := slices.Sorted(maps.Keys(dots))
+	e.uint(uint64(len(actors)))
+	for _, actor := range actors {
+		e.string(actor)
+		e.uint(dots[actor])
+	}
+}
+
+func decodeDots(d *decoder) map[string]uint64 {
+	dots := make(map[string]uint64)
+	for range d.count() {
+		actor := d.string()
+		dots[actor] = d.uint()
+	}
+	return dots
+}
+
+// IsORSet reports whether data looks like an encoded ORSet.
+func IsORSet(data string) bool {
+	return strings.HasPrefix(data, orSetMagic)
+}
+
+func DecodeORSet(data string) (*ORSet, error) {
+	if !IsORSet(data) {
+		return nil, ErrInvalidEncoding
+	}
+	set := NewORSet()
+	d := decoder{data: data[len(orSetMagic):]}
+	set.seen = decodeDots(&d)
+	for range d.count() {
+		member := d.string()
+		set.dots[member] = decodeDots(&d)
+	}
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
@@ -0,0 +1,77 @@
+package crdt
+
+import (
+	"slices"
+	"testing"
+)
+
+// merged returns a copy of a with b merged into it.
+func merged(t *testing.T, a *ORSet, b *ORSet) *ORSet {
+	t.Helper()
+	set, err := DecodeORSet(a.Encode())
+	if err != nil {
+		t.Fatalf("DecodeORSet returned error: %v", err)
+	}
+	set.Merge(b)
+	return set
+}
+
+func TestORSet_ConcurrentAddWinsOverRemove(t *testing.T) {
+	a := NewORSet()
+	a.Add("a", "x")
+	b := merged(t, NewORSet(), a)
+
+	// a removes x while b adds it again
+	a.Remove("x")
+	b.Add("b", "x")
+
+	ab, ba := merged(t, a, b), merged(t, b, a)
+	if !ab.Contains("x") || !ba.Contains("x") {
+		t.Fatalf("concurrently re-added member was lost: %v, %v", ab.Members(), ba.Members())
+	}
+	if ab.Encode() != ba.Encode() {
+		t.Fatalf("merging in different orders gave different encodings")
+	}
+}
+
+func TestORSet_ObservedRemoveWins(t *testing.T) {
+	a := NewORSet()
+	a.Add("a", "x")
+	a.Add("a", "y")
+	b := merged(t, NewORSet(), a)
+
+	b.Remove("x")
+	a = merged(t, a, b)
+	if a.Contains("x") || !a.Contains("y") {
+		t.Fatalf("members after merging a remove = %v, want [y]", a.Members())
+	}
+
+	// A stale copy that still has x does not bring it back
+	stale := NewORSet()
+	stale.Add("a", "x")
+	if merged(t, a, stale).Contains("x") {
+		t.Fatalf("merging a stale copy resurrected a removed member")
+	}
+}
+
+func TestORSet_EncodingRoundTrips(t *testing.T) {
+	set := NewORSet()
+	set.Add("a", "x")
+	set.Add("b", "y")
+	set.Add("a", "z")
+	set.Remove("z")
+
+	decoded, err := DecodeORSet(set.Encode())
+	if err != nil {
+		t.Fatalf("DecodeORSet returned error: %v", err)
+	}
+	if got := decoded.Members(); !slices.Equal(got, []string{"x", "y"}) {
+		t.Fatalf("decoded members = %v, want [x y]", got)
+	}
+	if decoded.Encode() != set.Encode() {
+		t.Fatalf("re-encoding a decoded set changed it")
+	}
+	if _, err := DecodeORSet(NewPNCounter().Encode()); err == nil {
+		t.Fatalf("DecodeORSet accepted a counter")
+	}
+}
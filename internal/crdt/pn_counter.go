@@ -0,0 +1,90 @@
+package crdt
+
+import (
+	"maps"
+	"slices"
+	"strings"
+)
+
+// PNCounter is a counter that several replicas can update independently and
+// merge without losing updates. Each actor keeps its own running totals of
+// increments and decrements, which only grow, so merging takes the larger of
+// each and the value is the difference of their sums.
+type PNCounter struct {
+	increments map[string]uint64
+	decrements map[string]uint64
+}
+
+func NewPNCounter() *PNCounter {
+	return &PNCounter{increments: make(map[string]uint64), decrements: make(map[string]uint64)}
+}
+
+// Add adds delta, which may be negative, on behalf of actor and returns the
+// new value.
+func (counter *PNCounter) Add(actor string, delta int64) int64 {
+	if delta >= 0 {
+		counter.increments[actor] += uint64(delta)
+	} else {
+		counter.decrements[actor] += uint64(-delta)
+	}
+	return counter.Value()
+}
+
+func (counter *PNCounter) Value() int64 {
+	var value uint64
+	for _, n := range counter.increments {
+		value += n
+	}
+	for _, n := range counter.decrements {
+		value -= n
+	}
+	return int64(value)
+}
+
+// Merge folds other's updates into counter.
+func (counter *PNCounter) Merge(other *PNCounter) {
+	for actor, n := range other.increments {
+		counter.increments[actor] = max(counter.increments[actor], n)
+	}
+	for actor, n := range other.decrements {
+		counter.decrements[actor] = max(counter.decrements[actor], n)
+	}
+}
+
+// Encode returns the counter's canonical encoding: equal counters encode
+// identically.
+func (counter *PNCounter) Encode() string {
+	e := encoder(pnCounterMagic)
+	for _, totals := range []map[string]uint64{counter.increments, counter.decrements} {
+		actors := slices.Sorted(maps.Keys(totals))
+		e.uint(uint64(len(actors)))
+		for _, actor := range actors {
+			e.string(actor)
+			e.uint(totals[actor])
+		}
+	}
+	return string(e)
+}
+
+// IsPNCounter reports whether data looks like an encoded PNCounter.
+func IsPNCounter(data string) bool {
+	return strings.HasPrefix(data, pnCounterMagic)
+}
+
+func DecodePNCounter(data string) (*PNCounter, error) {
+	if !IsPNCounter(data) {
+		return nil, ErrInvalidEncoding
+	}
+	counter := NewPNCounter()
+	d := decoder{data: data[len(pnCounterMagic):]}
+	for _, totals := range []map[string]uint64{counter.increments, counter.decrements} {
+		for range d.count() {
+			actor := d.string()
+			totals[actor] = d.uint()
+		}
+	}
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+	return counter, nil
+}
@@ -0,0 +1,70 @@
+package crdt
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPNCounter_ConcurrentUpdatesConverge(t *testing.T) {
+	a, b := NewPNCounter(), NewPNCounter()
+	a.Add("a", 5)
+	a.Add("a", -2)
+	b.Add("b", 10)
+	b.Add("b", -1)
+
+	ab, _ := DecodePNCounter(a.Encode())
+	ab.Merge(b)
+	ba, _ := DecodePNCounter(b.Encode())
+	ba.Merge(a)
+	if ab.Value() != 12 || ba.Value() != 12 {
+		t.Fatalf("merged values = %d and %d, want 12", ab.Value(), ba.Value())
+	}
+	if ab.Encode() != ba.Encode() {
+		t.Fatalf("merging in different orders gave different encodings")
+	}
+
+	// Merging again changes nothing
+	ab.Merge(b)
+	ab.Merge(a)
+	if ab.Value() != 12 {
+		t.Fatalf("value after merging twice = %d, want 12", ab.Value())
+	}
+}
+
+func TestPNCounter_EncodingRoundTrips(t *testing.T) {
+	counter := NewPNCounter()
+	counter.Add("a", 3)
+	counter.Add("b", -7)
+
+	decoded, err := DecodePNCounter(counter.Encode())
+	if err != nil {
+		t.Fatalf("DecodePNCounter returned error: %v", err)
+	}
+	if decoded.Value() != -4 {
+		t.Fatalf("decoded value = %d, want -4", decoded.Value())
+	}
+
+	encoded := counter.Encode()
+	for _, data := range []string{"plain", encoded[:len(encoded)-1], encoded + "x"} {
+		if _, err := DecodePNCounter(data); err == nil {
+			t.Fatalf("DecodePNCounter(%q) succeeded, want an error", data)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a, b := NewPNCounter(), NewPNCounter()
+	a.Add("a", 1)
+	b.Add("b", 2)
+
+	merged, changed, err := Merge(a.Encode(), b.Encode())
+	if err != nil || !changed {
+		t.Fatalf("Merge = (changed %v, %v), want a change", changed, err)
+	}
+	if _, changed, _ := Merge(merged, b.Encode()); changed {
+		t.Fatalf("merging a value already included reported a change")
+	}
+	if _, _, err := Merge(a.Encode(), NewORSet().Encode()); !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("merging a counter with a set returned %v, want ErrTypeMismatch", err)
+	}
+}
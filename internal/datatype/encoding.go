@@ -0,0 +1,85 @@
+// Package datatype holds the values blueis stores under a key other than
+// plain strings, such as hashes and lists. Each is stored as a string
+// encoding that starts with a magic prefix, as crdt and sketch store
+// theirs, so the storage engines, replication, backups and expiry carry
+// them like any other value. The store keeps each value's type next to
+// it, so the prefixes only guard against decoding one type as another.
+package datatype
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidEncoding = errors.New("datatype: invalid encoding")
+
+// Magic prefixes tell encoded values apart from each other and from the
+// values of crdt and sketch.
+const (
+	hashMagic = "\x00hsh\x01"
+	listMagic = "\x00lst\x01"
+)
+
+// encoder appends uvarints and length-prefixed strings.
+type encoder []byte
+
+func (e *encoder) uint(v uint64) {
+	*e = binary.AppendUvarint(*e, v)
+}
+
+func (e *encoder) string(s string) {
+	e.uint(uint64(len(s)))
+	*e = append(*e, s...)
+}
+
+// decoder reads what encoder wrote, remembering the first error.
+type decoder struct {
+	data string
+	err  error
+}
+
+func (d *decoder) uint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint([]byte(d.data[:min(len(d.data), binary.MaxVarintLen64)]))
+	if n <= 0 {
+		d.err = ErrInvalidEncoding
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	n := d.uint()
+	if d.err != nil {
+		return ""
+	}
+	if n > uint64(len(d.data)) {
+		d.err = ErrInvalidEncoding
+		return ""
+	}
+	s := d.data[:n]
+	d.data = d.data[n:]
+	return s
+}
+
+// count reads a collection size, rejecting sizes the remaining data could
+// not possibly hold so corrupt input cannot cause huge allocations.
+func (d *decoder) count() int {
+	n := d.uint()
+	if n > uint64(len(d.data)) {
+		d.err = ErrInvalidEncoding
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.data) != 0 {
+		d.err = fmt.Errorf("%w: %d trailing bytes", ErrInvalidEncoding, len(d.data))
+	}
+	return d.err
+}
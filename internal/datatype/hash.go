@@ -0,0 +1,104 @@
+package datatype
+
+import (
+	"errors"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrNotInteger = errors.New("hash value is not an integer")
+	ErrOverflow   = errors.New("increment or decrement would overflow")
+)
+
+// Hash maps fields to values under a single key.
+type Hash struct {
+	fields map[string]string
+}
+
+func NewHash() *Hash {
+	return &Hash{fields: make(map[string]string)}
+}
+
+// Set sets field to value, and reports whether the field is new.
+func (hash *Hash) Set(field string, value string) bool {
+	_, present := hash.fields[field]
+	hash.fields[field] = value
+	return !present
+}
+
+func (hash *Hash) Get(field string) (string, bool) {
+	value, ok := hash.fields[field]
+	return value, ok
+}
+
+// Delete removes field, and reports whether it was present.
+func (hash *Hash) Delete(field string) bool {
+	_, present := hash.fields[field]
+	delete(hash.fields, field)
+	return present
+}
+
+// IncrBy adds delta to the integer held in field, which counts as 0 if it
+// is missing, and returns the new value.
+func (hash *Hash) IncrBy(field string, delta int64) (int64, error) {
+	var current int64
+	if value, ok := hash.fields[field]; ok {
+		var err error
+		if current, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return 0, ErrNotInteger
+		}
+	}
+	if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+		return 0, ErrOverflow
+	}
+	current += delta
+	hash.fields[field] = strconv.FormatInt(current, 10)
+	return current, nil
+}
+
+// All returns a copy of the hash's fields and values.
+func (hash *Hash) All() map[string]string {
+	return maps.Clone(hash.fields)
+}
+
+func (hash *Hash) Len() int {
+	return len(hash.fields)
+}
+
+// Encode returns the hash's canonical encoding, with its fields in sorted
+// order: equal hashes encode identically.
+func (hash *Hash) Encode() string {
+	e := encoder(hashMagic)
+	fields := slices.Sorted(maps.Keys(hash.fields))
+	e.uint(uint64(len(fields)))
+	for _, field := range fields {
+		e.string(field)
+		e.string(hash.fields[field])
+	}
+	return string(e)
+}
+
+// IsHash reports whether data looks like an encoded Hash.
+func IsHash(data string) bool {
+	return strings.HasPrefix(data, hashMagic)
+}
+
+func DecodeHash(data string) (*Hash, error) {
+	if !IsHash(data) {
+		return nil, ErrInvalidEncoding
+	}
+	hash := NewHash()
+	d := decoder{data: data[len(hashMagic):]}
+	for range d.count() {
+		field := d.string()
+		hash.fields[field] = d.string()
+	}
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+	return hash, nil
+}
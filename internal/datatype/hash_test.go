@@ -0,0 +1,84 @@
+package datatype
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestHash_EncodingRoundTrips(t *testing.T) {
+	hash := NewHash()
+	hash.Set("b", "2")
+	hash.Set("a", "")
+	hash.Set("with\x00nul", "v")
+
+	decoded, err := DecodeHash(hash.Encode())
+	if err != nil {
+		t.Fatalf("DecodeHash returned error: %v", err)
+	}
+	if decoded.Len() != 3 {
+		t.Fatalf("decoded hash has %d fields, want 3", decoded.Len())
+	}
+	for field, want := range hash.All() {
+		if got, ok := decoded.Get(field); !ok || got != want {
+			t.Errorf("decoded field %q = (%q, %t), want %q", field, got, ok, want)
+		}
+	}
+
+	// Fields are encoded in sorted order, whatever order they were set in
+	other := NewHash()
+	other.Set("with\x00nul", "v")
+	other.Set("a", "")
+	other.Set("b", "2")
+	if other.Encode() != hash.Encode() {
+		t.Fatalf("equal hashes encoded differently")
+	}
+
+	if !IsHash(hash.Encode()) || IsHash("plain") {
+		t.Fatalf("IsHash does not tell hashes from plain strings")
+	}
+	if _, err := DecodeHash(hash.Encode() + "x"); !errors.Is(err, ErrInvalidEncoding) {
+		t.Fatalf("DecodeHash with trailing bytes returned %v, want ErrInvalidEncoding", err)
+	}
+	if _, err := DecodeHash(hashMagic + "\xff"); !errors.Is(err, ErrInvalidEncoding) {
+		t.Fatalf("DecodeHash of truncated data returned %v, want ErrInvalidEncoding", err)
+	}
+}
+
+func TestHash_SetAndDeleteReportChanges(t *testing.T) {
+	hash := NewHash()
+	if !hash.Set("f", "1") || hash.Set("f", "2") {
+		t.Fatalf("Set reported the wrong fields as new")
+	}
+	if value, _ := hash.Get("f"); value != "2" {
+		t.Fatalf("Get = %q, want the later value", value)
+	}
+	if !hash.Delete("f") || hash.Delete("f") {
+		t.Fatalf("Delete reported the wrong fields as present")
+	}
+}
+
+func TestHash_IncrBy(t *testing.T) {
+	hash := NewHash()
+	if n, err := hash.IncrBy("n", 5); err != nil || n != 5 {
+		t.Fatalf("IncrBy of missing field = (%d, %v), want (5, nil)", n, err)
+	}
+	if n, err := hash.IncrBy("n", -7); err != nil || n != -2 {
+		t.Fatalf("IncrBy = (%d, %v), want (-2, nil)", n, err)
+	}
+
+	hash.Set("s", "abc")
+	if _, err := hash.IncrBy("s", 1); !errors.Is(err, ErrNotInteger) {
+		t.Fatalf("IncrBy of non-integer = %v, want ErrNotInteger", err)
+	}
+	hash.Set("max", "9223372036854775807")
+	if _, err := hash.IncrBy("max", 1); !errors.Is(err, ErrOverflow) {
+		t.Fatalf("IncrBy past MaxInt64 = %v, want ErrOverflow", err)
+	}
+	if _, err := hash.IncrBy("n", math.MinInt64); !errors.Is(err, ErrOverflow) {
+		t.Fatalf("IncrBy past MinInt64 = %v, want ErrOverflow", err)
+	}
+	if value, _ := hash.Get("max"); value != "9223372036854775807" {
+		t.Fatalf("failed IncrBy changed the field to %q", value)
+	}
+}
@@ -0,0 +1,197 @@
+package datatype
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// List is a sequence of values under a single key, pushed and popped at
+// either end. It is a ring buffer, so pushes and pops at both ends take
+// constant time however long the list grows.
+type List struct {
+	items []string
+	head  int
+	n     int
+	// size is the sum of EncodedItemLen over the values, so EncodedLen
+	// does not have to walk them
+	size int
+}
+
+func NewList() *List {
+	return &List{}
+}
+
+// at returns the position in items of the value at index.
+func (list *List) at(index int) int {
+	return (list.head + index) % len(list.items)
+}
+
+// grow makes room for n more values, unwrapping the ring into a larger
+// buffer when it is full.
+func (list *List) grow(n int) {
+	if list.n+n <= len(list.items) {
+		return
+	}
+	items := make([]string, max(2*len(list.items), list.n+n, 8))
+	for i := range list.n {
+		items[i] = list.items[list.at(i)]
+	}
+	list.items, list.head = items, 0
+}
+
+// PushLeft adds values to the head of the list one after another, so the
+// last one given ends up first, and returns the new length.
+func (list *List) PushLeft(values ...string) int {
+	list.grow(len(values))
+	for _, value := range values {
+		list.head = (list.head - 1 + len(list.items)) % len(list.items)
+		list.items[list.head] = value
+		list.n++
+		list.size += EncodedItemLen(value)
+	}
+	return list.n
+}
+
+// PushRight adds values to the tail of the list in order, and returns the
+// new length.
+func (list *List) PushRight(values ...string) int {
+	list.grow(len(values))
+	for _, value := range values {
+		list.items[list.at(list.n)] = value
+		list.n++
+		list.size += EncodedItemLen(value)
+	}
+	return list.n
+}
+
+// PopLeft removes and returns the head of the list, if it has one.
+func (list *List) PopLeft() (string, bool) {
+	if list.n == 0 {
+		return "", false
+	}
+	value := list.items[list.head]
+	list.items[list.head] = ""
+	list.head = (list.head + 1) % len(list.items)
+	list.n--
+	list.size -= EncodedItemLen(value)
+	return value, true
+}
+
+// PopRight removes and returns the tail of the list, if it has one.
+func (list *List) PopRight() (string, bool) {
+	if list.n == 0 {
+		return "", false
+	}
+	tail := list.at(list.n - 1)
+	value := list.items[tail]
+	list.items[tail] = ""
+	list.n--
+	list.size -= EncodedItemLen(value)
+	return value, true
+}
+
+// Index returns the value at index, where a negative index counts back
+// from the tail.
+func (list *List) Index(index int64) (string, bool) {
+	if index < 0 {
+		index += int64(list.n)
+	}
+	if index < 0 || index >= int64(list.n) {
+		return "", false
+	}
+	return list.items[list.at(int(index))], true
+}
+
+// Range returns the values from start to stop inclusive. Negative indexes
+// count back from the tail, and indexes past either end are clamped to it.
+func (list *List) Range(start int64, stop int64) []string {
+	start, stop, ok := ClampRange(int64(list.n), start, stop)
+	if !ok {
+		return []string{}
+	}
+	values := make([]string, 0, stop-start+1)
+	for i := start; i <= stop; i++ {
+		values = append(values, list.items[list.at(int(i))])
+	}
+	return values
+}
+
+// ClampRange turns the start and stop of a Range over a list of length
+// values into indexes from the head within the list, and reports whether
+// the range holds any values.
+func ClampRange(length int64, start int64, stop int64) (int64, int64, bool) {
+	if start < 0 {
+		start = max(length+start, 0)
+	}
+	if stop < 0 {
+		stop = length + stop
+	}
+	stop = min(stop, length-1)
+	return start, stop, start <= stop
+}
+
+func (list *List) Len() int {
+	return list.n
+}
+
+// Size returns the sum of EncodedItemLen over the list's values.
+func (list *List) Size() int {
+	return list.size
+}
+
+// EncodedLen returns the length of the list's encoding without encoding
+// it.
+func (list *List) EncodedLen() int {
+	return EncodedListLen(list.n, list.size)
+}
+
+// EncodedItemLen returns how many bytes value takes up in the encoding of
+// a list.
+func EncodedItemLen(value string) int {
+	return uvarintLen(uint64(len(value))) + len(value)
+}
+
+// EncodedListLen returns the length of the encoding of a list of length
+// values whose EncodedItemLens add up to size.
+func EncodedListLen(length int, size int) int {
+	return len(listMagic) + uvarintLen(uint64(length)) + size
+}
+
+// Encode returns the list's encoding.
+func (list *List) Encode() string {
+	e := make(encoder, 0, list.EncodedLen())
+	e = append(e, listMagic...)
+	e.uint(uint64(list.n))
+	for i := range list.n {
+		e.string(list.items[list.at(i)])
+	}
+	return string(e)
+}
+
+// IsList reports whether data looks like an encoded List.
+func IsList(data string) bool {
+	return strings.HasPrefix(data, listMagic)
+}
+
+func DecodeList(data string) (*List, error) {
+	if !IsList(data) {
+		return nil, ErrInvalidEncoding
+	}
+	d := decoder{data: data[len(listMagic):]}
+	n := d.count()
+	list := &List{items: make([]string, n)}
+	for i := range n {
+		list.items[i] = d.string()
+		list.size += EncodedItemLen(list.items[i])
+	}
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+	list.n = n
+	return list, nil
+}
+
+func uvarintLen(v uint64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], v)
+}
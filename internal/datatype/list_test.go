@@ -0,0 +1,125 @@
+package datatype
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestList_PushAndPopAtBothEnds(t *testing.T) {
+	list := NewList()
+	if n := list.PushRight("a", "b", "c"); n != 3 {
+		t.Fatalf("PushRight = %d, want 3", n)
+	}
+	if n := list.PushLeft("y", "z"); n != 5 {
+		t.Fatalf("PushLeft = %d, want 5", n)
+	}
+	if got := fmt.Sprint(list.Range(0, -1)); got != "[z y a b c]" {
+		t.Fatalf("Range = %s, want [z y a b c]", got)
+	}
+
+	if value, ok := list.PopLeft(); !ok || value != "z" {
+		t.Fatalf("PopLeft = (%q, %t), want z", value, ok)
+	}
+	if value, ok := list.PopRight(); !ok || value != "c" {
+		t.Fatalf("PopRight = (%q, %t), want c", value, ok)
+	}
+	for list.Len() > 0 {
+		list.PopLeft()
+	}
+	if _, ok := list.PopRight(); ok {
+		t.Fatalf("PopRight of an empty list reported a value")
+	}
+}
+
+func TestList_RangeAndIndex(t *testing.T) {
+	list := NewList()
+	list.PushRight("a", "b", "c", "d")
+
+	tests := []struct {
+		start, stop int64
+		want        string
+	}{
+		{0, -1, "[a b c d]"},
+		{1, 2, "[b c]"},
+		{-2, -1, "[c d]"},
+		{-100, 100, "[a b c d]"},
+		{3, 1, "[]"},
+		{10, 20, "[]"},
+	}
+	for _, test := range tests {
+		if got := fmt.Sprint(list.Range(test.start, test.stop)); got != test.want {
+			t.Errorf("Range(%d, %d) = %s, want %s", test.start, test.stop, got, test.want)
+		}
+	}
+
+	if value, ok := list.Index(-1); !ok || value != "d" {
+		t.Fatalf("Index(-1) = (%q, %t), want d", value, ok)
+	}
+	if _, ok := list.Index(4); ok {
+		t.Fatalf("Index past the end reported a value")
+	}
+}
+
+func TestList_EncodingRoundTrips(t *testing.T) {
+	list := NewList()
+	list.PushRight("a", "", "a\x00b")
+
+	decoded, err := DecodeList(list.Encode())
+	if err != nil {
+		t.Fatalf("DecodeList returned error: %v", err)
+	}
+	if fmt.Sprintf("%q", decoded.Range(0, -1)) != fmt.Sprintf("%q", list.Range(0, -1)) {
+		t.Fatalf("decoded list = %q, want %q", decoded.Range(0, -1), list.Range(0, -1))
+	}
+	if !IsList(list.Encode()) || IsHash(list.Encode()) || IsList(NewHash().Encode()) {
+		t.Fatalf("IsList does not tell lists from other values")
+	}
+	if _, err := DecodeList(listMagic + "\x05"); !errors.Is(err, ErrInvalidEncoding) {
+		t.Fatalf("DecodeList of truncated data returned %v, want ErrInvalidEncoding", err)
+	}
+}
+
+func TestList_WrapsAroundItsBuffer(t *testing.T) {
+	list := NewList()
+	next, want := 0, 0
+	// Pushing at the tail and popping at the head walks the values round
+	// the ring, growing it part way through
+	for round := range 50 {
+		for range round % 7 {
+			list.PushRight(fmt.Sprint(next))
+			next++
+		}
+		for range round % 5 {
+			value, ok := list.PopLeft()
+			if !ok {
+				break
+			}
+			if value != fmt.Sprint(want) {
+				t.Fatalf("PopLeft = %s, want %d", value, want)
+			}
+			want++
+		}
+		if list.Len() != next-want {
+			t.Fatalf("Len = %d, want %d", list.Len(), next-want)
+		}
+		if got := len(list.Encode()); list.EncodedLen() != got {
+			t.Fatalf("EncodedLen = %d, want %d", list.EncodedLen(), got)
+		}
+	}
+
+	list.PushLeft("head")
+	if value, ok := list.Index(0); !ok || value != "head" {
+		t.Fatalf("Index(0) = (%q, %t), want head", value, ok)
+	}
+	if value, ok := list.PopRight(); !ok || value != fmt.Sprint(next-1) {
+		t.Fatalf("PopRight = (%q, %t), want %d", value, ok, next-1)
+	}
+	decoded, err := DecodeList(list.Encode())
+	if err != nil {
+		t.Fatalf("DecodeList returned error: %v", err)
+	}
+	if fmt.Sprint(decoded.Range(0, -1)) != fmt.Sprint(list.Range(0, -1)) || decoded.EncodedLen() != list.EncodedLen() {
+		t.Fatalf("decoded list = %v, want %v", decoded.Range(0, -1), list.Range(0, -1))
+	}
+}
@@ -0,0 +1,208 @@
+// Package faults injects failures into a running node or coordinator, so
+// failover, hinted handoff and rebalancing can be exercised by integration
+// tests and game days without pulling cables. An Injector holds the faults
+// currently switched on; the server wraps its handler, its clients'
+// transports, its log syncs and its writes in it, and each passes through
+// untouched while no fault is set.
+package faults
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// ErrBlackholed is returned by a Transport for a request to a blackholed
+// peer, once the request's context gives up on it.
+var ErrBlackholed = errors.New("peer is blackholed by fault injection")
+
+// Faults are the failures to inject. The zero value injects none.
+type Faults struct {
+	// DropPercent of the requests served have their connection closed
+	// without a reply
+	DropPercent float64 `json:"dropPercent,omitempty"`
+	// DelayPercent of the requests served are held for DelayMs first
+	DelayPercent float64 `json:"delayPercent,omitempty"`
+	DelayMs      int64   `json:"delayMs,omitempty"`
+	// Blackhole lists peers, as host:port or base URLs, whose requests
+	// from here are never answered, as if the network between them dropped
+	// every packet. Blackholing each from the other partitions two servers
+	Blackhole []string `json:"blackhole,omitempty"`
+	// SyncDelayMs is added to every sync of a log to disk
+	SyncDelayMs int64 `json:"syncDelayMs,omitempty"`
+	// CrashAfterWrites exits the process, without shutting down, once
+	// that many more writes have been made. Zero never crashes
+	CrashAfterWrites int64 `json:"crashAfterWrites,omitempty"`
+}
+
+// Validate returns an error if faults cannot be injected as they are.
+func (faults Faults) Validate() error {
+	switch {
+	case faults.DropPercent < 0 || faults.DropPercent > 100, faults.DelayPercent < 0 || faults.DelayPercent > 100:
+		return errors.New("dropPercent and delayPercent must be between 0 and 100")
+	case faults.DelayMs < 0 || faults.SyncDelayMs < 0 || faults.CrashAfterWrites < 0:
+		return errors.New("delayMs, syncDelayMs and crashAfterWrites cannot be negative")
+	case faults.DelayPercent > 0 && faults.DelayMs == 0:
+		return errors.New("delayPercent needs delayMs")
+	}
+	for _, peer := range faults.Blackhole {
+		if peer == "" {
+			return errors.New("blackhole peers cannot be empty")
+		}
+	}
+	return nil
+}
+
+// Stats counts the faults an Injector has injected since it was created.
+type Stats struct {
+	Dropped    uint64 `json:"dropped"`
+	Delayed    uint64 `json:"delayed"`
+	Blackholed uint64 `json:"blackholed"`
+	SlowSyncs  uint64 `json:"slowSyncs"`
+	// WritesUntilCrash is how many more writes the process makes before
+	// crashing, or zero if it is not set to crash
+	WritesUntilCrash int64 `json:"writesUntilCrash"`
+}
+
+// Injector injects the faults it is set to. It is safe for concurrent use.
+type Injector struct {
+	faults atomic.Pointer[Faults]
+	// untilCrash counts down the writes left before crashing; it only
+	// reaches zero by a write when a crash is due
+	untilCrash atomic.Int64
+	crash      func()
+
+	dropped    atomic.Uint64
+	delayed    atomic.Uint64
+	blackholed atomic.Uint64
+	slowSyncs  atomic.Uint64
+}
+
+// New returns an Injector with no faults set, which calls crash when the
+// writes set by CrashAfterWrites have been made.
+func New(crash func()) *Injector {
+	injector := &Injector{crash: crash}
+	injector.faults.Store(&Faults{})
+	return injector
+}
+
+// Set replaces the faults injected, restarting the count of writes before
+// a crash.
+func (injector *Injector) Set(faults Faults) error {
+	if err := faults.Validate(); err != nil {
+		return err
+	}
+	faults.Blackhole = slices.Clone(faults.Blackhole)
+	for i, peer := range faults.Blackhole {
+		// Peers may be given as base URLs, as nodes are named elsewhere
+		if parsed, err := url.Parse(peer); err == nil && parsed.Host != "" {
+			faults.Blackhole[i] = parsed.Host
+		}
+	}
+	injector.faults.Store(&faults)
+	injector.untilCrash.Store(faults.CrashAfterWrites)
+	return nil
+}
+
+// Faults returns the faults injected.
+func (injector *Injector) Faults() Faults {
+	faults := *injector.faults.Load()
+	faults.Blackhole = slices.Clone(faults.Blackhole)
+	return faults
+}
+
+func (injector *Injector) Stats() Stats {
+	return Stats{
+		Dropped:          injector.dropped.Load(),
+		Delayed:          injector.delayed.Load(),
+		Blackholed:       injector.blackholed.Load(),
+		SlowSyncs:        injector.slowSyncs.Load(),
+		WritesUntilCrash: max(injector.untilCrash.Load(), 0),
+	}
+}
+
+// Handler drops and delays the requests next serves as the faults set say,
+// except those for exempt paths, such as the one faults are set through.
+func (injector *Injector) Handler(next http.Handler, exempt ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(exempt, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		faults := injector.faults.Load()
+		if chance(faults.DropPercent) {
+			injector.dropped.Add(1)
+			// net/http closes the connection without a reply or a log line
+			panic(http.ErrAbortHandler)
+		}
+		if chance(faults.DelayPercent) {
+			injector.delayed.Add(1)
+			timer := time.NewTimer(time.Duration(faults.DelayMs) * time.Millisecond)
+			select {
+			case <-timer.C:
+			case <-r.Context().Done():
+				timer.Stop()
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Transport holds the requests made through next to blackholed peers until
+// their context is done, then fails them with ErrBlackholed. A nil next
+// uses http.DefaultTransport.
+func (injector *Injector) Transport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &transport{injector, next}
+}
+
+type transport struct {
+	injector *Injector
+	next     http.RoundTripper
+}
+
+func (transport *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !slices.Contains(transport.injector.faults.Load().Blackhole, req.URL.Host) {
+		return transport.next.RoundTrip(req)
+	}
+	transport.injector.blackholed.Add(1)
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	<-req.Context().Done()
+	return nil, fmt.Errorf("%w: %w", ErrBlackholed, context.Cause(req.Context()))
+}
+
+// Sync slows down a sync to disk by the delay set, and is called before
+// each one.
+func (injector *Injector) Sync() {
+	if delay := injector.faults.Load().SyncDelayMs; delay > 0 {
+		injector.slowSyncs.Add(1)
+		time.Sleep(time.Duration(delay) * time.Millisecond)
+	}
+}
+
+// Wrote counts a write, crashing the process if it was the last one
+// CrashAfterWrites allowed.
+func (injector *Injector) Wrote() {
+	if injector.untilCrash.Load() <= 0 {
+		return
+	}
+	if injector.untilCrash.Add(-1) == 0 {
+		injector.crash()
+	}
+}
+
+// chance reports true percent of the time.
+func chance(percent float64) bool {
+	return percent > 0 && rand.Float64()*100 < percent
+}
@@ -0,0 +1,150 @@
+package faults
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func okHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+func TestInjector_PassesRequestsThroughWithoutFaults(t *testing.T) {
+	injector := New(func() { t.Fatal("crashed without a crash set") })
+	server := httptest.NewServer(injector.Handler(okHandler()))
+	defer server.Close()
+	client := &http.Client{Transport: injector.Transport(nil)}
+
+	for range 10 {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("Get returned error: %v", err)
+		}
+		resp.Body.Close()
+		injector.Wrote()
+		injector.Sync()
+	}
+	if stats := injector.Stats(); stats != (Stats{}) {
+		t.Fatalf("Stats = %+v, want none injected", stats)
+	}
+}
+
+func TestInjector_DropsAndDelaysRequests(t *testing.T) {
+	injector := New(nil)
+	server := httptest.NewServer(injector.Handler(okHandler(), "/admin/faults"))
+	defer server.Close()
+
+	if err := injector.Set(Faults{DropPercent: 100}); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if resp, err := http.Get(server.URL + "/key"); err == nil {
+		resp.Body.Close()
+		t.Fatalf("dropped request got a %s reply", resp.Status)
+	}
+	resp, err := http.Get(server.URL + "/admin/faults")
+	if err != nil {
+		t.Fatalf("exempt request returned error: %v", err)
+	}
+	resp.Body.Close()
+
+	if err := injector.Set(Faults{DelayPercent: 100, DelayMs: 50}); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	start := time.Now()
+	resp, err = http.Get(server.URL + "/key")
+	if err != nil {
+		t.Fatalf("delayed request returned error: %v", err)
+	}
+	resp.Body.Close()
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("delayed request was answered after %v, want at least 50ms", elapsed)
+	}
+	if stats := injector.Stats(); stats.Dropped != 1 || stats.Delayed != 1 {
+		t.Fatalf("Stats = %+v, want one drop and one delay", stats)
+	}
+}
+
+func TestInjector_BlackholesPeers(t *testing.T) {
+	injector := New(nil)
+	blackholed := httptest.NewServer(okHandler())
+	defer blackholed.Close()
+	reachable := httptest.NewServer(okHandler())
+	defer reachable.Close()
+	client := &http.Client{Transport: injector.Transport(nil)}
+	if err := injector.Set(Faults{Blackhole: []string{blackholed.URL + "/"}}); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, blackholed.URL, nil)
+	if _, err := client.Do(req); !errors.Is(err, ErrBlackholed) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("request to a blackholed peer returned %v, want ErrBlackholed once its deadline passed", err)
+	}
+	resp, err := client.Get(reachable.URL)
+	if err != nil {
+		t.Fatalf("request to another peer returned error: %v", err)
+	}
+	resp.Body.Close()
+	if stats := injector.Stats(); stats.Blackholed != 1 {
+		t.Fatalf("Stats = %+v, want one request blackholed", stats)
+	}
+}
+
+func TestInjector_SlowsSyncs(t *testing.T) {
+	injector := New(nil)
+	if err := injector.Set(Faults{SyncDelayMs: 20}); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	start := time.Now()
+	injector.Sync()
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("Sync took %v, want at least 20ms", elapsed)
+	}
+	if stats := injector.Stats(); stats.SlowSyncs != 1 {
+		t.Fatalf("Stats = %+v, want one slow sync", stats)
+	}
+}
+
+func TestInjector_CrashesAfterWrites(t *testing.T) {
+	crashes := 0
+	injector := New(func() { crashes++ })
+	if err := injector.Set(Faults{CrashAfterWrites: 3}); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	injector.Wrote()
+	injector.Wrote()
+	if crashes != 0 || injector.Stats().WritesUntilCrash != 1 {
+		t.Fatalf("crashed %d times with %d writes left, want no crash with 1 left", crashes, injector.Stats().WritesUntilCrash)
+	}
+	for range 3 {
+		injector.Wrote()
+	}
+	if crashes != 1 {
+		t.Fatalf("crashed %d times, want once on the third write", crashes)
+	}
+}
+
+func TestFaults_Validate(t *testing.T) {
+	for _, faults := range []Faults{
+		{DropPercent: 101},
+		{DelayPercent: -1, DelayMs: 10},
+		{DelayPercent: 50},
+		{SyncDelayMs: -1},
+		{CrashAfterWrites: -1},
+		{Blackhole: []string{""}},
+	} {
+		if err := faults.Validate(); err == nil {
+			t.Errorf("Validate(%+v) returned nil, want an error", faults)
+		}
+	}
+	if err := (Faults{DropPercent: 5, DelayPercent: 10, DelayMs: 100, Blackhole: []string{"localhost:8080"}}).Validate(); err != nil {
+		t.Fatalf("Validate returned error: %v", err)
+	}
+}
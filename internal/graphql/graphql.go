@@ -0,0 +1,278 @@
+// Package graphql parses GraphQL requests and encodes their responses, for
+// servers that resolve a small, fixed schema by hand. It covers queries and
+// mutations with variables, aliases, fragments and the @skip and @include
+// directives; schemas, validation against them and execution are left to
+// the server.
+package graphql
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrUnknownOperation is returned by Document.Operation when the document
+// has no operation by the name asked for.
+var ErrUnknownOperation = errors.New("graphql: unknown operation")
+
+// Request is a GraphQL request as sent over HTTP.
+type Request struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName,omitempty"`
+	Variables     map[string]any `json:"variables,omitempty"`
+}
+
+// Response is a GraphQL response. Data is left out for requests that
+// failed before executing, and Errors when nothing failed.
+type Response struct {
+	Data   any     `json:"data,omitempty"`
+	Errors []Error `json:"errors,omitempty"`
+}
+
+// Error is an error in a response. Path leads to the field that failed,
+// through response keys and list indexes.
+type Error struct {
+	Message    string         `json:"message"`
+	Path       []any          `json:"path,omitempty"`
+	Extensions map[string]any `json:"extensions,omitempty"`
+}
+
+// SyntaxError is an error parsing a document, at Offset bytes into it.
+type SyntaxError struct {
+	Message string
+	Offset  int
+}
+
+func (err *SyntaxError) Error() string {
+	return fmt.Sprintf("graphql: %s at offset %d", err.Message, err.Offset)
+}
+
+// Object is a result object, which encodes its fields in the order they
+// were set, as a response must.
+type Object struct {
+	keys   []string
+	values map[string]any
+}
+
+// Set sets the field key to value, keeping the field's place if it was
+// already set.
+func (object *Object) Set(key string, value any) {
+	if object.values == nil {
+		object.values = make(map[string]any)
+	}
+	if _, ok := object.values[key]; !ok {
+		object.keys = append(object.keys, key)
+	}
+	object.values[key] = value
+}
+
+// Get returns the value of the field key.
+func (object *Object) Get(key string) (any, bool) {
+	value, ok := object.values[key]
+	return value, ok
+}
+
+func (object *Object) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, key := range object.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		name, _ := json.Marshal(key)
+		value, err := json.Marshal(object.values[key])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(name)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// Document is a parsed GraphQL document.
+type Document struct {
+	Operations []*Operation
+}
+
+// Operation returns the operation called name, or the document's only
+// operation if name is empty.
+func (doc *Document) Operation(name string) (*Operation, error) {
+	if name == "" {
+		if len(doc.Operations) > 1 {
+			return nil, fmt.Errorf("%w: the document has several operations, so operationName must pick one", ErrUnknownOperation)
+		}
+		return doc.Operations[0], nil
+	}
+	for _, operation := range doc.Operations {
+		if operation.Name == name {
+			return operation, nil
+		}
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnknownOperation, name)
+}
+
+// OperationType is the type of an operation.
+type OperationType string
+
+const (
+	Query    OperationType = "query"
+	Mutation OperationType = "mutation"
+)
+
+// Operation is a query or mutation, with its fragments expanded: every
+// field selected through a fragment is in Selections in its place.
+type Operation struct {
+	Type       OperationType
+	Name       string
+	Variables  []*VariableDefinition
+	Selections []*Field
+}
+
+// VariableDefinition declares one of an operation's variables.
+type VariableDefinition struct {
+	Name string
+	// Type is the variable's type as written, e.g. "[String!]!"
+	Type       string
+	Default    Value
+	HasDefault bool
+}
+
+// Coerce returns the operation's variables given the values sent with the
+// request: each declared variable that was not sent takes its default, and
+// one that must not be null but is, is an error. Values are checked
+// against their types only as far as being null, a list or not.
+func (operation *Operation) Coerce(values map[string]any) (map[string]any, error) {
+	variables := make(map[string]any, len(operation.Variables))
+	for _, definition := range operation.Variables {
+		value, ok := values[definition.Name]
+		if !ok && definition.HasDefault {
+			value, ok = Resolve(definition.Default, nil), true
+		}
+		nonNull := strings.HasSuffix(definition.Type, "!")
+		if value == nil && nonNull {
+			return nil, fmt.Errorf("variable $%s of type %s must not be null", definition.Name, definition.Type)
+		}
+		if _, isList := value.([]any); value != nil && isList != strings.HasPrefix(definition.Type, "[") {
+			return nil, fmt.Errorf("variable $%s is not of type %s", definition.Name, definition.Type)
+		}
+		if ok {
+			variables[definition.Name] = value
+		}
+	}
+	return variables, nil
+}
+
+// Field is a selected field. A field whose selections are empty is a leaf.
+type Field struct {
+	Alias      string
+	Name       string
+	Arguments  []Argument
+	Directives []Directive
+	Selections []*Field
+
+	// spread names the fragment a placeholder field spreads until it is
+	// expanded
+	spread string
+}
+
+// ResponseKey is the key the field's result is given in its object.
+func (field *Field) ResponseKey() string {
+	if field.Alias != "" {
+		return field.Alias
+	}
+	return field.Name
+}
+
+// Argument returns the value of the argument name, with its variables
+// replaced by their values in variables, and whether it was given. An
+// argument set to a variable that was not sent is not given.
+func (field *Field) Argument(name string, variables map[string]any) (any, bool) {
+	return argument(field.Arguments, name, variables)
+}
+
+// Included reports whether the field is selected given its @skip and
+// @include directives.
+func (field *Field) Included(variables map[string]any) (bool, error) {
+	for _, directive := range field.Directives {
+		switch directive.Name {
+		case "skip", "include":
+			value, _ := argument(directive.Arguments, "if", variables)
+			condition, ok := value.(bool)
+			if !ok {
+				return false, fmt.Errorf("@%s needs if: Boolean!", directive.Name)
+			}
+			if condition == (directive.Name == "skip") {
+				return false, nil
+			}
+		default:
+			return false, fmt.Errorf("unknown directive @%s", directive.Name)
+		}
+	}
+	return true, nil
+}
+
+func argument(arguments []Argument, name string, variables map[string]any) (any, bool) {
+	for _, argument := range arguments {
+		if argument.Name != name {
+			continue
+		}
+		if variable, ok := argument.Value.(Variable); ok {
+			value, ok := variables[string(variable)]
+			return value, ok
+		}
+		return Resolve(argument.Value, variables), true
+	}
+	return nil, false
+}
+
+// Argument is an argument given to a field or directive.
+type Argument struct {
+	Name  string
+	Value Value
+}
+
+// Directive is a directive on a field.
+type Directive struct {
+	Name      string
+	Arguments []Argument
+}
+
+// Value is a value literal: a string, a float64 for numbers, a bool, nil,
+// an Enum, a Variable, a []Value or a map[string]Value.
+type Value any
+
+// Variable is a reference to a variable in a value.
+type Variable string
+
+// Enum is an enum value.
+type Enum string
+
+// Resolve returns value as JSON would decode it, with its variables
+// replaced by their values in variables and enums as strings. Variables
+// that were not sent are null.
+func Resolve(value Value, variables map[string]any) any {
+	switch value := value.(type) {
+	case Variable:
+		return variables[string(value)]
+	case Enum:
+		return string(value)
+	case []Value:
+		list := make([]any, len(value))
+		for i, elem := range value {
+			list[i] = Resolve(elem, variables)
+		}
+		return list
+	case map[string]Value:
+		object := make(map[string]any, len(value))
+		for name, elem := range value {
+			object[name] = Resolve(elem, variables)
+		}
+		return object
+	}
+	return value
+}
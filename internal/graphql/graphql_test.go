@@ -0,0 +1,152 @@
+package graphql
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// describe renders the fields selected, with their arguments resolved, as
+// name(argument=value)/alias{children}.
+func describe(t *testing.T, fields []*Field, variables map[string]any) string {
+	t.Helper()
+	var parts []string
+	for _, field := range fields {
+		included, err := field.Included(variables)
+		if err != nil {
+			t.Fatalf("Included returned error: %v", err)
+		}
+		if !included {
+			continue
+		}
+		part := field.Name
+		for _, argument := range field.Arguments {
+			value, _ := field.Argument(argument.Name, variables)
+			encoded, _ := json.Marshal(value)
+			part += "(" + argument.Name + "=" + string(encoded) + ")"
+		}
+		if field.Alias != "" {
+			part += "/" + field.Alias
+		}
+		if len(field.Selections) > 0 {
+			part += "{" + describe(t, field.Selections, variables) + "}"
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestParse_ExpandsFragmentsAndResolvesVariables(t *testing.T) {
+	doc, err := Parse(`
+		# Two operations, so one has to be named
+		query Lookup($key: String!, $keys: [String!]! = ["a", "b"], $full: Boolean = false) {
+			first: get(key: $key) { ...entry }
+			mget(keys: $keys) {
+				key
+				... @include(if: $full) { value }
+			}
+			list(prefix: "user:é\n", limit: 10) { key, __typename }
+		}
+		mutation Write { set(key: "k", value: """
+			  indented
+			block
+		""") { key } }
+		fragment entry on Entry { key value @skip(if: $full) }
+	`)
+	if err != nil {
+		t.Fatalf("Parse returned error: %v", err)
+	}
+
+	lookup, err := doc.Operation("Lookup")
+	if err != nil {
+		t.Fatalf("Operation returned error: %v", err)
+	}
+	variables, err := lookup.Coerce(map[string]any{"key": "k"})
+	if err != nil {
+		t.Fatalf("Coerce returned error: %v", err)
+	}
+	want := `get(key="k")/first{key value} mget(keys=["a","b"]){key} list(prefix="user:é\n")(limit=10){key __typename}`
+	if got := describe(t, lookup.Selections, variables); got != want {
+		t.Fatalf("Lookup selects\n%s\nwant\n%s", got, want)
+	}
+	variables["full"] = true
+	if got := describe(t, lookup.Selections, variables); !strings.Contains(got, "first{key}") || !strings.Contains(got, "{key value}") {
+		t.Fatalf("Lookup with $full selects %s, want the directives flipped", got)
+	}
+
+	write, err := doc.Operation("Write")
+	if err != nil {
+		t.Fatalf("Operation returned error: %v", err)
+	}
+	if write.Type != Mutation {
+		t.Fatalf("Write is a %s, want a mutation", write.Type)
+	}
+	if value, _ := write.Selections[0].Argument("value", nil); value != "  indented\nblock" {
+		t.Fatalf("block string = %q, want its common indentation removed", value)
+	}
+
+	if _, err := doc.Operation(""); !errors.Is(err, ErrUnknownOperation) {
+		t.Fatalf("Operation(\"\") = %v, want ErrUnknownOperation for a document of several", err)
+	}
+	if _, err := lookup.Coerce(nil); err == nil {
+		t.Fatal("Coerce accepted a missing non-null variable")
+	}
+}
+
+func TestParse_RefusesInvalidDocuments(t *testing.T) {
+	for _, source := range []string{
+		``,
+		`{ get(key: "k") `,
+		`{ get(key: "unterminated) { key } }`,
+		`{ get(key: 01) }`,
+		`{ ...missing }`,
+		`{ ...a } fragment a on Entry { ...b } fragment b on Entry { ...a }`,
+		`query { a } query { b }`,
+		`subscription { changes }`,
+		`{ a(x: 1, x: 2) }`,
+		`query($v: String = $other) { a }`,
+		`{ a }}`,
+		strings.Repeat("{ a ", maxDepth+1) + strings.Repeat("}", maxDepth+1),
+		// Each fragment doubles the fields the next one selects
+		`{ ...f0 }` + bomb(16),
+	} {
+		var syntax *SyntaxError
+		if _, err := Parse(source); !errors.As(err, &syntax) {
+			t.Fatalf("Parse(%.60q) = %v, want a SyntaxError", source, err)
+		}
+	}
+}
+
+// bomb returns fragments f0 to fn, each of which spreads the next twice.
+func bomb(n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		next := "f" + strconv.Itoa(i+1)
+		fmt.Fprintf(&b, " fragment f%d on T { a: x { ...%s } b: x { ...%s } }", i, next, next)
+	}
+	fmt.Fprintf(&b, " fragment f%d on T { x }", n)
+	return b.String()
+}
+
+func TestObject_EncodesFieldsInTheOrderSet(t *testing.T) {
+	var object Object
+	object.Set("z", 1)
+	object.Set("a", []any{"x", nil})
+	object.Set("z", 2)
+	encoded, err := json.Marshal(Response{Data: &object})
+	if err != nil {
+		t.Fatalf("Marshal returned error: %v", err)
+	}
+	if string(encoded) != `{"data":{"z":2,"a":["x",null]}}` {
+		t.Fatalf("encoded %s, want z before a", encoded)
+	}
+
+	var decoded map[string]any
+	if err := json.Unmarshal(encoded, &decoded); err != nil || !reflect.DeepEqual(decoded["data"], map[string]any{"z": 2.0, "a": []any{"x", nil}}) {
+		t.Fatalf("decoded %v, %v", decoded, err)
+	}
+}
@@ -0,0 +1,821 @@
+package graphql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// maxDepth caps how deeply selections, lists and objects nest, so a
+	// hostile query cannot exhaust the stack
+	maxDepth = 64
+	// maxFields caps the fields an operation selects once its fragments are
+	// expanded, so fragments spread into each other cannot blow up
+	maxFields = 10000
+)
+
+// Parse parses a GraphQL document: its operations and the fragments they
+// spread, which are expanded into the operations' selections. Schema
+// definitions and subscriptions are not supported.
+func Parse(source string) (*Document, error) {
+	parser := &parser{lexer: lexer{source: source}}
+	if err := parser.advance(); err != nil {
+		return nil, err
+	}
+	doc := &Document{}
+	fragments := make(map[string]*fragment)
+	for parser.token.kind != tokenEOF {
+		switch {
+		case parser.token.is(tokenName, "fragment"):
+			fragment, err := parser.parseFragment()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := fragments[fragment.name]; ok {
+				return nil, parser.errorf("there can be only one fragment named %q", fragment.name)
+			}
+			fragments[fragment.name] = fragment
+		case parser.token.kind == tokenPunctuator && parser.token.value == "{",
+			parser.token.is(tokenName, "query"), parser.token.is(tokenName, "mutation"):
+			operation, err := parser.parseOperation()
+			if err != nil {
+				return nil, err
+			}
+			doc.Operations = append(doc.Operations, operation)
+		case parser.token.is(tokenName, "subscription"):
+			return nil, parser.errorf("subscriptions are not supported")
+		default:
+			return nil, parser.unexpected()
+		}
+	}
+	if len(doc.Operations) == 0 {
+		return nil, &SyntaxError{Message: "the document has no operation"}
+	}
+
+	names := make(map[string]bool)
+	for _, operation := range doc.Operations {
+		if operation.Name == "" && len(doc.Operations) > 1 {
+			return nil, &SyntaxError{Message: "an anonymous operation must be the only one in the document"}
+		}
+		if names[operation.Name] {
+			return nil, &SyntaxError{Message: fmt.Sprintf("there can be only one operation named %q", operation.Name)}
+		}
+		names[operation.Name] = true
+
+		expander := expander{fragments: fragments}
+		selections, err := expander.expand(operation.Selections, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		operation.Selections = selections
+	}
+	return doc, nil
+}
+
+type parser struct {
+	lexer lexer
+	token token
+	depth int
+}
+
+func (parser *parser) advance() error {
+	token, err := parser.lexer.next()
+	if err != nil {
+		return err
+	}
+	parser.token = token
+	return nil
+}
+
+func (parser *parser) errorf(format string, args ...any) error {
+	return &SyntaxError{Message: fmt.Sprintf(format, args...), Offset: parser.token.offset}
+}
+
+func (parser *parser) unexpected() error {
+	if parser.token.kind == tokenEOF {
+		return parser.errorf("unexpected end of document")
+	}
+	return parser.errorf("unexpected %q", parser.token.value)
+}
+
+// peek reports whether the current token is the punctuator p.
+func (parser *parser) peek(p string) bool {
+	return parser.token.kind == tokenPunctuator && parser.token.value == p
+}
+
+// skip consumes the punctuator p if it is next, reporting whether it was.
+func (parser *parser) skip(p string) (bool, error) {
+	if !parser.peek(p) {
+		return false, nil
+	}
+	return true, parser.advance()
+}
+
+func (parser *parser) expect(p string) error {
+	if !parser.peek(p) {
+		if parser.token.kind == tokenEOF {
+			return parser.errorf("expected %q, got the end of the document", p)
+		}
+		return parser.errorf("expected %q, got %q", p, parser.token.value)
+	}
+	return parser.advance()
+}
+
+func (parser *parser) name() (string, error) {
+	if parser.token.kind != tokenName {
+		if parser.token.kind == tokenEOF {
+			return "", parser.errorf("expected a name, got the end of the document")
+		}
+		return "", parser.errorf("expected a name, got %q", parser.token.value)
+	}
+	name := parser.token.value
+	return name, parser.advance()
+}
+
+func (parser *parser) nest() error {
+	if parser.depth++; parser.depth > maxDepth {
+		return parser.errorf("the document nests deeper than %d levels", maxDepth)
+	}
+	return nil
+}
+
+func (parser *parser) parseOperation() (*Operation, error) {
+	operation := &Operation{Type: Query}
+	if parser.token.kind == tokenName {
+		operation.Type = OperationType(parser.token.value)
+		if err := parser.advance(); err != nil {
+			return nil, err
+		}
+		if parser.token.kind == tokenName {
+			operation.Name = parser.token.value
+			if err := parser.advance(); err != nil {
+				return nil, err
+			}
+		}
+		if ok, err := parser.skip("("); err != nil {
+			return nil, err
+		} else if ok {
+			for !parser.peek(")") {
+				variable, err := parser.parseVariableDefinition()
+				if err != nil {
+					return nil, err
+				}
+				operation.Variables = append(operation.Variables, variable)
+			}
+			if err := parser.advance(); err != nil {
+				return nil, err
+			}
+		}
+		if parser.peek("@") {
+			return nil, parser.errorf("directives on operations are not supported")
+		}
+	}
+	selections, err := parser.parseSelectionSet()
+	if err != nil {
+		return nil, err
+	}
+	operation.Selections = selections
+	return operation, nil
+}
+
+func (parser *parser) parseVariableDefinition() (*VariableDefinition, error) {
+	if err := parser.expect("$"); err != nil {
+		return nil, err
+	}
+	name, err := parser.name()
+	if err != nil {
+		return nil, err
+	}
+	if err := parser.expect(":"); err != nil {
+		return nil, err
+	}
+	typ, err := parser.parseType()
+	if err != nil {
+		return nil, err
+	}
+	definition := &VariableDefinition{Name: name, Type: typ}
+	if ok, err := parser.skip("="); err != nil {
+		return nil, err
+	} else if ok {
+		if definition.Default, err = parser.parseValue(true); err != nil {
+			return nil, err
+		}
+		definition.HasDefault = true
+	}
+	return definition, nil
+}
+
+// parseType parses a type reference, returning it as written, e.g.
+// "[String!]!".
+func (parser *parser) parseType() (string, error) {
+	var typ string
+	if ok, err := parser.skip("["); err != nil {
+		return "", err
+	} else if ok {
+		if err := parser.nest(); err != nil {
+			return "", err
+		}
+		elem, err := parser.parseType()
+		if err != nil {
+			return "", err
+		}
+		parser.depth--
+		if err := parser.expect("]"); err != nil {
+			return "", err
+		}
+		typ = "[" + elem + "]"
+	} else if typ, err = parser.name(); err != nil {
+		return "", err
+	}
+	if ok, err := parser.skip("!"); err != nil {
+		return "", err
+	} else if ok {
+		typ += "!"
+	}
+	return typ, nil
+}
+
+// parseSelectionSet parses a selection set, in which fragment spreads and
+// inline fragments are kept as placeholder fields for expand.
+func (parser *parser) parseSelectionSet() ([]*Field, error) {
+	if err := parser.nest(); err != nil {
+		return nil, err
+	}
+	defer func() { parser.depth-- }()
+	if err := parser.expect("{"); err != nil {
+		return nil, err
+	}
+	var selections []*Field
+	for !parser.peek("}") {
+		var field *Field
+		var err error
+		if parser.peek("...") {
+			field, err = parser.parseFragmentSelection()
+		} else {
+			field, err = parser.parseField()
+		}
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, field)
+	}
+	if len(selections) == 0 {
+		return nil, parser.errorf("a selection set must select at least one field")
+	}
+	return selections, parser.advance()
+}
+
+func (parser *parser) parseField() (*Field, error) {
+	field := &Field{}
+	name, err := parser.name()
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := parser.skip(":"); err != nil {
+		return nil, err
+	} else if ok {
+		field.Alias = name
+		if name, err = parser.name(); err != nil {
+			return nil, err
+		}
+	}
+	field.Name = name
+	if field.Arguments, err = parser.parseArguments(); err != nil {
+		return nil, err
+	}
+	if field.Directives, err = parser.parseDirectives(); err != nil {
+		return nil, err
+	}
+	if parser.peek("{") {
+		if field.Selections, err = parser.parseSelectionSet(); err != nil {
+			return nil, err
+		}
+	}
+	return field, nil
+}
+
+// parseFragmentSelection parses a fragment spread or an inline fragment
+// into a field with no name, which spreads the fragment it names or
+// selects its own selections in its place.
+func (parser *parser) parseFragmentSelection() (*Field, error) {
+	if err := parser.advance(); err != nil {
+		return nil, err
+	}
+	field := &Field{}
+	var err error
+	if parser.token.kind == tokenName && parser.token.value != "on" {
+		if field.spread, err = parser.name(); err != nil {
+			return nil, err
+		}
+		field.Directives, err = parser.parseDirectives()
+		return field, err
+	}
+	if parser.token.is(tokenName, "on") {
+		if err := parser.advance(); err != nil {
+			return nil, err
+		}
+		if _, err := parser.name(); err != nil {
+			return nil, err
+		}
+	}
+	if field.Directives, err = parser.parseDirectives(); err != nil {
+		return nil, err
+	}
+	if field.Selections, err = parser.parseSelectionSet(); err != nil {
+		return nil, err
+	}
+	return field, nil
+}
+
+type fragment struct {
+	name       string
+	selections []*Field
+}
+
+func (parser *parser) parseFragment() (*fragment, error) {
+	if err := parser.advance(); err != nil {
+		return nil, err
+	}
+	name, err := parser.name()
+	if err != nil {
+		return nil, err
+	}
+	if name == "on" {
+		return nil, parser.errorf("a fragment cannot be named on")
+	}
+	if !parser.token.is(tokenName, "on") {
+		return nil, parser.errorf("expected a type condition for fragment %q", name)
+	}
+	if err := parser.advance(); err != nil {
+		return nil, err
+	}
+	if _, err := parser.name(); err != nil {
+		return nil, err
+	}
+	if parser.peek("@") {
+		return nil, parser.errorf("directives on fragment definitions are not supported")
+	}
+	selections, err := parser.parseSelectionSet()
+	if err != nil {
+		return nil, err
+	}
+	return &fragment{name: name, selections: selections}, nil
+}
+
+func (parser *parser) parseArguments() ([]Argument, error) {
+	if ok, err := parser.skip("("); err != nil || !ok {
+		return nil, err
+	}
+	var arguments []Argument
+	for !parser.peek(")") {
+		name, err := parser.name()
+		if err != nil {
+			return nil, err
+		}
+		for _, argument := range arguments {
+			if argument.Name == name {
+				return nil, parser.errorf("there can be only one argument named %q", name)
+			}
+		}
+		if err := parser.expect(":"); err != nil {
+			return nil, err
+		}
+		value, err := parser.parseValue(false)
+		if err != nil {
+			return nil, err
+		}
+		arguments = append(arguments, Argument{Name: name, Value: value})
+	}
+	if len(arguments) == 0 {
+		return nil, parser.errorf("an argument list must have at least one argument")
+	}
+	return arguments, parser.advance()
+}
+
+func (parser *parser) parseDirectives() ([]Directive, error) {
+	var directives []Directive
+	for parser.peek("@") {
+		if err := parser.advance(); err != nil {
+			return nil, err
+		}
+		name, err := parser.name()
+		if err != nil {
+			return nil, err
+		}
+		arguments, err := parser.parseArguments()
+		if err != nil {
+			return nil, err
+		}
+		directives = append(directives, Directive{Name: name, Arguments: arguments})
+	}
+	return directives, nil
+}
+
+// parseValue parses a value literal. Constant values, such as variable
+// defaults, cannot refer to variables.
+func (parser *parser) parseValue(constant bool) (Value, error) {
+	token := parser.token
+	switch token.kind {
+	case tokenString:
+		return token.value, parser.advance()
+	case tokenInt, tokenFloat:
+		number, err := strconv.ParseFloat(token.value, 64)
+		if err != nil {
+			return nil, parser.errorf("invalid number %s", token.value)
+		}
+		return number, parser.advance()
+	case tokenName:
+		var value Value
+		switch token.value {
+		case "true":
+			value = true
+		case "false":
+			value = false
+		case "null":
+			value = nil
+		default:
+			value = Enum(token.value)
+		}
+		return value, parser.advance()
+	case tokenPunctuator:
+		switch token.value {
+		case "$":
+			if constant {
+				return nil, parser.errorf("a constant value cannot refer to a variable")
+			}
+			if err := parser.advance(); err != nil {
+				return nil, err
+			}
+			name, err := parser.name()
+			return Variable(name), err
+		case "[":
+			return parser.parseList(constant)
+		case "{":
+			return parser.parseObject(constant)
+		}
+	}
+	return nil, parser.unexpected()
+}
+
+func (parser *parser) parseList(constant bool) (Value, error) {
+	if err := parser.nest(); err != nil {
+		return nil, err
+	}
+	defer func() { parser.depth-- }()
+	if err := parser.advance(); err != nil {
+		return nil, err
+	}
+	list := []Value{}
+	for !parser.peek("]") {
+		value, err := parser.parseValue(constant)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, value)
+	}
+	return list, parser.advance()
+}
+
+func (parser *parser) parseObject(constant bool) (Value, error) {
+	if err := parser.nest(); err != nil {
+		return nil, err
+	}
+	defer func() { parser.depth-- }()
+	if err := parser.advance(); err != nil {
+		return nil, err
+	}
+	object := map[string]Value{}
+	for !parser.peek("}") {
+		name, err := parser.name()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := object[name]; ok {
+			return nil, parser.errorf("there can be only one input field named %q", name)
+		}
+		if err := parser.expect(":"); err != nil {
+			return nil, err
+		}
+		if object[name], err = parser.parseValue(constant); err != nil {
+			return nil, err
+		}
+	}
+	return object, parser.advance()
+}
+
+// expander replaces fragment spreads and inline fragments with the fields
+// they select.
+type expander struct {
+	fragments map[string]*fragment
+	// spreading holds the fragments being expanded, to refuse cycles
+	spreading []string
+	fields    int
+}
+
+// expand returns selections with their fragments expanded, each field
+// carrying the directives of the fragments it was selected through too.
+func (expander *expander) expand(selections []*Field, directives []Directive, depth int) ([]*Field, error) {
+	if depth > maxDepth {
+		return nil, &SyntaxError{Message: fmt.Sprintf("the document nests deeper than %d levels", maxDepth)}
+	}
+	var expanded []*Field
+	for _, selection := range selections {
+		inherited := directives
+		if len(selection.Directives) > 0 {
+			inherited = append(append([]Directive(nil), directives...), selection.Directives...)
+		}
+		switch {
+		case selection.spread != "":
+			fragment, ok := expander.fragments[selection.spread]
+			if !ok {
+				return nil, &SyntaxError{Message: fmt.Sprintf("unknown fragment %q", selection.spread)}
+			}
+			for _, name := range expander.spreading {
+				if name == fragment.name {
+					return nil, &SyntaxError{Message: fmt.Sprintf("fragment %q spreads itself", name)}
+				}
+			}
+			expander.spreading = append(expander.spreading, fragment.name)
+			fields, err := expander.expand(fragment.selections, inherited, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			expander.spreading = expander.spreading[:len(expander.spreading)-1]
+			expanded = append(expanded, fields...)
+		case selection.Name == "":
+			fields, err := expander.expand(selection.Selections, inherited, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			expanded = append(expanded, fields...)
+		default:
+			if expander.fields++; expander.fields > maxFields {
+				return nil, &SyntaxError{Message: fmt.Sprintf("the operation selects more than %d fields", maxFields)}
+			}
+			field := *selection
+			if len(directives) > 0 {
+				field.Directives = append(append([]Directive(nil), directives...), selection.Directives...)
+			}
+			if len(selection.Selections) > 0 {
+				var err error
+				if field.Selections, err = expander.expand(selection.Selections, nil, depth+1); err != nil {
+					return nil, err
+				}
+			}
+			expanded = append(expanded, &field)
+		}
+	}
+	return expanded, nil
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenPunctuator
+	tokenName
+	tokenInt
+	tokenFloat
+	tokenString
+)
+
+type token struct {
+	kind   tokenKind
+	value  string
+	offset int
+}
+
+func (token token) is(kind tokenKind, value string) bool {
+	return token.kind == kind && token.value == value
+}
+
+// lexer splits a document into tokens, skipping whitespace, commas and
+// comments.
+type lexer struct {
+	source string
+	offset int
+}
+
+func (lexer *lexer) next() (token, error) {
+	source := lexer.source
+	for lexer.offset < len(source) {
+		switch c := source[lexer.offset]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			lexer.offset++
+		case c == '#':
+			for lexer.offset < len(source) && source[lexer.offset] != '\n' && source[lexer.offset] != '\r' {
+				lexer.offset++
+			}
+		case strings.HasPrefix(source[lexer.offset:], "\ufeff"):
+			lexer.offset += len("\ufeff")
+		default:
+			return lexer.token()
+		}
+	}
+	return token{kind: tokenEOF, offset: lexer.offset}, nil
+}
+
+func (lexer *lexer) token() (token, error) {
+	source, start := lexer.source, lexer.offset
+	c := source[start]
+	switch {
+	case strings.HasPrefix(source[start:], "..."):
+		lexer.offset += 3
+		return token{kind: tokenPunctuator, value: "...", offset: start}, nil
+	case strings.IndexByte("!$&()[]{}:=@|", c) >= 0:
+		lexer.offset++
+		return token{kind: tokenPunctuator, value: string(c), offset: start}, nil
+	case c == '_' || isLetter(c):
+		for lexer.offset < len(source) && (source[lexer.offset] == '_' || isLetter(source[lexer.offset]) || isDigit(source[lexer.offset])) {
+			lexer.offset++
+		}
+		return token{kind: tokenName, value: source[start:lexer.offset], offset: start}, nil
+	case c == '-' || isDigit(c):
+		return lexer.number()
+	case strings.HasPrefix(source[start:], `"""`):
+		return lexer.blockString()
+	case c == '"':
+		return lexer.string()
+	}
+	r, _ := utf8.DecodeRuneInString(source[start:])
+	return token{}, &SyntaxError{Message: fmt.Sprintf("unexpected character %q", r), Offset: start}
+}
+
+func (lexer *lexer) number() (token, error) {
+	source, start := lexer.source, lexer.offset
+	digits := func() int {
+		from := lexer.offset
+		for lexer.offset < len(source) && isDigit(source[lexer.offset]) {
+			lexer.offset++
+		}
+		return lexer.offset - from
+	}
+	invalid := func() (token, error) {
+		return token{}, &SyntaxError{Message: fmt.Sprintf("invalid number %q", source[start:min(lexer.offset+1, len(source))]), Offset: start}
+	}
+
+	if source[lexer.offset] == '-' {
+		lexer.offset++
+	}
+	intStart := lexer.offset
+	if n := digits(); n == 0 || (n > 1 && source[intStart] == '0') {
+		return invalid()
+	}
+	kind := tokenInt
+	if lexer.offset < len(source) && source[lexer.offset] == '.' {
+		kind = tokenFloat
+		lexer.offset++
+		if digits() == 0 {
+			return invalid()
+		}
+	}
+	if lexer.offset < len(source) && (source[lexer.offset] == 'e' || source[lexer.offset] == 'E') {
+		kind = tokenFloat
+		lexer.offset++
+		if lexer.offset < len(source) && (source[lexer.offset] == '+' || source[lexer.offset] == '-') {
+			lexer.offset++
+		}
+		if digits() == 0 {
+			return invalid()
+		}
+	}
+	if lexer.offset < len(source) && (source[lexer.offset] == '.' || source[lexer.offset] == '_' || isLetter(source[lexer.offset])) {
+		return invalid()
+	}
+	return token{kind: kind, value: source[start:lexer.offset], offset: start}, nil
+}
+
+func (lexer *lexer) string() (token, error) {
+	source, start := lexer.source, lexer.offset
+	lexer.offset++
+	var b strings.Builder
+	for lexer.offset < len(source) {
+		c := source[lexer.offset]
+		switch {
+		case c == '"':
+			lexer.offset++
+			return token{kind: tokenString, value: b.String(), offset: start}, nil
+		case c == '\n' || c == '\r':
+			return token{}, &SyntaxError{Message: "unterminated string", Offset: start}
+		case c == '\\':
+			if lexer.offset+1 >= len(source) {
+				return token{}, &SyntaxError{Message: "unterminated string", Offset: start}
+			}
+			escape := source[lexer.offset+1]
+			lexer.offset += 2
+			switch escape {
+			case '"', '\\', '/':
+				b.WriteByte(escape)
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'u':
+				r, err := lexer.unicodeEscape()
+				if err != nil {
+					return token{}, err
+				}
+				b.WriteRune(r)
+			default:
+				return token{}, &SyntaxError{Message: fmt.Sprintf("invalid escape \\%c", escape), Offset: lexer.offset - 2}
+			}
+		default:
+			b.WriteByte(c)
+			lexer.offset++
+		}
+	}
+	return token{}, &SyntaxError{Message: "unterminated string", Offset: start}
+}
+
+// unicodeEscape reads the code point of a \u escape whose "\u" has been
+// consumed, joining surrogate pairs.
+func (lexer *lexer) unicodeEscape() (rune, error) {
+	hex := func() (rune, bool) {
+		if lexer.offset+4 > len(lexer.source) {
+			return 0, false
+		}
+		n, err := strconv.ParseUint(lexer.source[lexer.offset:lexer.offset+4], 16, 32)
+		if err != nil {
+			return 0, false
+		}
+		lexer.offset += 4
+		return rune(n), true
+	}
+	start := lexer.offset - 2
+	r, ok := hex()
+	if !ok {
+		return 0, &SyntaxError{Message: "invalid unicode escape", Offset: start}
+	}
+	if r >= 0xD800 && r < 0xDC00 && strings.HasPrefix(lexer.source[lexer.offset:], `\u`) {
+		lexer.offset += 2
+		if low, ok := hex(); ok && low >= 0xDC00 && low < 0xE000 {
+			return (r-0xD800)<<10 + (low - 0xDC00) + 0x10000, nil
+		}
+		return 0, &SyntaxError{Message: "invalid unicode escape", Offset: start}
+	}
+	if r >= 0xD800 && r < 0xE000 {
+		return 0, &SyntaxError{Message: "invalid unicode escape", Offset: start}
+	}
+	return r, nil
+}
+
+// blockString reads a """block string""", removing the indentation its
+// lines share and its blank first and last lines.
+func (lexer *lexer) blockString() (token, error) {
+	source, start := lexer.source, lexer.offset
+	lexer.offset += 3
+	var raw strings.Builder
+	for lexer.offset < len(source) {
+		switch {
+		case strings.HasPrefix(source[lexer.offset:], `\"""`):
+			raw.WriteString(`"""`)
+			lexer.offset += 4
+		case strings.HasPrefix(source[lexer.offset:], `"""`):
+			lexer.offset += 3
+			return token{kind: tokenString, value: blockStringValue(raw.String()), offset: start}, nil
+		default:
+			raw.WriteByte(source[lexer.offset])
+			lexer.offset++
+		}
+	}
+	return token{}, &SyntaxError{Message: "unterminated string", Offset: start}
+}
+
+func blockStringValue(raw string) string {
+	lines := strings.Split(strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(raw), "\n")
+	indent := -1
+	for _, line := range lines[1:] {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed != "" && (indent < 0 || len(line)-len(trimmed) < indent) {
+			indent = len(line) - len(trimmed)
+		}
+	}
+	if indent > 0 {
+		for i := 1; i < len(lines); i++ {
+			lines[i] = lines[i][min(indent, len(lines[i])):]
+		}
+	}
+	for len(lines) > 0 && strings.TrimLeft(lines[0], " \t") == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimLeft(lines[len(lines)-1], " \t") == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return strings.Join(lines, "\n")
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,132 @@
+package kvstore
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	accessShardCount = 64
+	// accessResolution is how stale a recorded access time may get before
+	// another access to the key replaces it. Idle times are reported in
+	// seconds, so keys read in a tight loop need not rewrite theirs on
+	// every read.
+	accessResolution = int64(time.Second)
+)
+
+// ErrAccessNotTracked is returned by IdleTime when the store was started
+// without Config.TrackAccess.
+var ErrAccessNotTracked = errors.New("access tracking is not enabled")
+
+// accessTable records when each key was last read or written, in Unix
+// nanoseconds. It is sharded because fast-path reads and DirectExecution
+// update it from many goroutines at once.
+type accessTable struct {
+	shards [accessShardCount]accessShard
+	// since is when the store started recording accesses, the lower bound
+	// on the idle time of keys it holds but has not seen touched
+	since int64
+}
+
+type accessShard struct {
+	mu    sync.Mutex
+	times map[string]int64
+}
+
+func (table *accessTable) shard(key string) *accessShard {
+	return &table.shards[hashKey(key)%accessShardCount]
+}
+
+func (table *accessTable) touch(key string, now int64) {
+	shard := table.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if shard.times == nil {
+		shard.times = make(map[string]int64)
+	}
+	if at, ok := shard.times[key]; ok && now >= at && now-at < accessResolution {
+		return
+	}
+	shard.times[key] = now
+}
+
+func (table *accessTable) lastAccess(key string) (int64, bool) {
+	shard := table.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	at, ok := shard.times[key]
+	return at, ok
+}
+
+func (table *accessTable) forget(key string) {
+	shard := table.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	delete(shard.times, key)
+}
+
+// touch records an access to key when access or frequency tracking is
+// enabled.
+func (kvStore *KeyValueStore) touch(key string) {
+	if !kvStore.trackAccess && !kvStore.trackFrequency {
+		return
+	}
+	now := kvStore.currentTime().UnixNano()
+	if kvStore.trackAccess {
+		kvStore.accesses.touch(key, now)
+	}
+	if kvStore.trackFrequency {
+		kvStore.frequencies.hit(key, now)
+	}
+}
+
+func (kvStore *KeyValueStore) forget(key string) {
+	if kvStore.trackAccess {
+		kvStore.accesses.forget(key)
+	}
+	if kvStore.trackFrequency {
+		kvStore.frequencies.forget(key)
+	}
+}
+
+func (kvStore *KeyValueStore) lastAccess(key string) (time.Time, bool) {
+	if !kvStore.trackAccess {
+		return time.Time{}, false
+	}
+	at, ok := kvStore.accesses.lastAccess(key)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, at), true
+}
+
+// idleTime returns how long key has gone without being read or written.
+// Keys not touched since the store started, such as those a disk engine
+// held from before, have been idle at least since then.
+func (kvStore *KeyValueStore) idleTime(key string) time.Duration {
+	now := kvStore.currentTime().UnixNano()
+	at, ok := kvStore.accesses.lastAccess(key)
+	if !ok {
+		at = kvStore.accesses.since
+	}
+	return time.Duration(max(now-at, 0))
+}
+
+// IdleTime reports how long key has gone without being read or written, to
+// within a second, in the spirit of Redis's OBJECT IDLETIME. It returns
+// ErrAccessNotTracked unless the store was started with
+// Config.TrackAccess, and an error for keys that do not exist.
+func (kvService *KeyValueService) IdleTime(key string) (time.Duration, error) {
+	if !kvService.store.trackAccess {
+		return 0, ErrAccessNotTracked
+	}
+	info, err := kvService.Object(key)
+	if err != nil {
+		return 0, err
+	}
+	return info.Idle, nil
+}
@@ -0,0 +1,212 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrOffsetOutOfRange = errors.New("offset is out of range")
+
+// maxStringSize caps the values APPEND and SETRANGE build when no
+// MaxValueSize is configured, as Redis does, so a large offset cannot have
+// the store allocate without bound.
+const maxStringSize = 512 << 20
+
+// stringRangeCommand carries the byte offsets of a GETRANGE, or a
+// SETRANGE's offset in start.
+type stringRangeCommand struct {
+	start int64
+	end   int64
+}
+
+// loadString reads the string under key, treating an expired key as
+// missing.
+func (kvStore *KeyValueStore) loadString(command KeyValueCommand) (string, bool, error) {
+	if kvStore.expired(command) {
+		return "", false, nil
+	}
+	return kvStore.loadTyped(command.key, TypeString)
+}
+
+// storeString writes a value built from the one under key. The key's
+// expiry is kept, as Redis keeps it; a key that did not exist is given its
+// namespace's default TTL, as a PUT would.
+func (kvStore *KeyValueStore) storeString(key string, value string, existed bool) error {
+	if len(value) > maxStringSize {
+		return fmt.Errorf("%w: %d bytes for key %s, the limit is %d", ErrValueTooLarge, len(value), key, maxStringSize)
+	}
+	if err := kvStore.limits.Load().checkSize(key, len(value)); err != nil {
+		return err
+	}
+	write := kvStore.setValue
+	if !existed {
+		write = func(key string, value TypedValue) error {
+			return kvStore.setValueExpiring(key, value, kvStore.newDeadline(key))
+		}
+	}
+	if err := write(key, stringValue(value)); err != nil {
+		return err
+	}
+	kvStore.touch(key)
+	return nil
+}
+
+// ProcessAppendCommand appends command.value to the key, creating it if it
+// does not exist, and replies with the new length.
+func (kvStore *KeyValueStore) ProcessAppendCommand(command KeyValueCommand) KeyValueOutput {
+	if command.value == nil {
+		return KeyValueOutput{false, nil, fmt.Errorf("value given was nil for append command"), 0}
+	}
+	defer kvStore.keyLocks.lock(command)()
+	current, ok, err := kvStore.loadString(command)
+	if err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	value := current + *command.value
+	if err := kvStore.storeString(command.key, value, ok); err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	return KeyValueOutput{true, nil, nil, int64(len(value))}
+}
+
+// ProcessStrLenCommand replies with the length of the key's value, or 0 if
+// it does not exist.
+func (kvStore *KeyValueStore) ProcessStrLenCommand(command KeyValueCommand) KeyValueOutput {
+	value, ok, err := kvStore.loadString(command)
+	if err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	if ok {
+		kvStore.touch(command.key)
+	}
+	return KeyValueOutput{true, nil, nil, int64(len(value))}
+}
+
+// ProcessGetRangeCommand replies with the bytes of the key's value from
+// start to end inclusive. Negative offsets count back from the end, and
+// offsets past either end are clamped to it, so a range that covers
+// nothing, like a missing key, reads as the empty string.
+func (kvStore *KeyValueStore) ProcessGetRangeCommand(command KeyValueCommand) KeyValueOutput {
+	args := command.strRange
+	if args == nil {
+		return KeyValueOutput{false, nil, fmt.Errorf("%s command has no arguments", GetCommandTypeString(command.commandType)), 0}
+	}
+	value, ok, err := kvStore.loadString(command)
+	if err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	if ok {
+		kvStore.touch(command.key)
+	}
+	length := int64(len(value))
+	start, end := args.start, args.end
+	if start < 0 {
+		start = max(length+start, 0)
+	}
+	if end < 0 {
+		end = length + end
+	}
+	end = min(end, length-1)
+	if start > end {
+		return KeyValueOutput{true, stringPointer(""), nil, 0}
+	}
+	return KeyValueOutput{true, stringPointer(value[start : end+1]), nil, 0}
+}
+
+// ProcessSetRangeCommand overwrites the key's value with command.value from
+// the offset in command.strRange.start, padding it with zero bytes if it is
+// shorter than the offset, and replies with the new length. A missing key
+// counts as empty, and is left missing if there is nothing to write.
+func (kvStore *KeyValueStore) ProcessSetRangeCommand(command KeyValueCommand) KeyValueOutput {
+	args := command.strRange
+	if args == nil || command.value == nil {
+		return KeyValueOutput{false, nil, fmt.Errorf("%s command has no arguments", GetCommandTypeString(command.commandType)), 0}
+	}
+	if args.start < 0 {
+		return KeyValueOutput{false, nil, ErrOffsetOutOfRange, 0}
+	}
+	data := *command.value
+	if args.start+int64(len(data)) > maxStringSize {
+		return KeyValueOutput{false, nil, fmt.Errorf("%w: offset %d for key %s, the limit is %d bytes", ErrValueTooLarge, args.start, command.key, maxStringSize), 0}
+	}
+	defer kvStore.keyLocks.lock(command)()
+	current, ok, err := kvStore.loadString(command)
+	if err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	if data == "" {
+		return KeyValueOutput{true, nil, nil, int64(len(current))}
+	}
+	offset := int(args.start)
+	var b strings.Builder
+	b.Grow(max(len(current), offset+len(data)))
+	b.WriteString(current[:min(offset, len(current))])
+	for range offset - len(current) {
+		b.WriteByte(0)
+	}
+	b.WriteString(data)
+	if end := offset + len(data); end < len(current) {
+		b.WriteString(current[end:])
+	}
+	value := b.String()
+	if err := kvStore.storeString(command.key, value, ok); err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	return KeyValueOutput{true, nil, nil, int64(len(value))}
+}
+
+// Append appends suffix to key's value, creating the key if it does not
+// exist, and returns the new length. Unlike Set, it keeps the key's
+// expiry.
+func (kvService *KeyValueService) Append(key string, suffix string) (int64, error) {
+	return kvService.writeString(KeyValueCommand{commandType: APPEND, key: key, value: &suffix})
+}
+
+// StrLen returns the length in bytes of key's value, or 0 if the key does
+// not exist.
+func (kvService *KeyValueService) StrLen(key string) (int64, error) {
+	res := kvService.readString(KeyValueCommand{commandType: STRLEN, key: key})
+	return res.integer, res.err
+}
+
+// GetRange returns the bytes of key's value from start to end inclusive,
+// where negative offsets count back from the end, so GetRange(key, 0, -1)
+// is the whole value. Offsets past the ends are clamped, and a missing key
+// reads as the empty string.
+func (kvService *KeyValueService) GetRange(key string, start int64, end int64) (string, error) {
+	res := kvService.readString(KeyValueCommand{commandType: GETRANGE, key: key, strRange: &stringRangeCommand{start: start, end: end}})
+	if res.err != nil {
+		return "", res.err
+	}
+	return *res.value, nil
+}
+
+// SetRange overwrites key's value with data from offset on, padding the
+// value with zero bytes if it is shorter, and returns the new length. A
+// negative offset fails with ErrOffsetOutOfRange. Like Append, it keeps
+// the key's expiry.
+func (kvService *KeyValueService) SetRange(key string, offset int64, data string) (int64, error) {
+	return kvService.writeString(KeyValueCommand{commandType: SETRANGE, key: key, value: &data, strRange: &stringRangeCommand{start: offset}})
+}
+
+func (kvService *KeyValueService) writeString(command KeyValueCommand) (int64, error) {
+	if err := kvService.CheckWritable(); err != nil {
+		return 0, err
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return 0, err
+	}
+	res := kvService.dispatch(command)
+	return res.integer, res.err
+}
+
+func (kvService *KeyValueService) readString(command KeyValueCommand) KeyValueOutput {
+	if err := kvService.CheckActive(); err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	return kvService.dispatchRead(command)
+}
@@ -0,0 +1,160 @@
+package kvstore
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAppend_BuildsValueAndKeepsExpiry(t *testing.T) {
+	store := newTestKeyValueService(t)
+	clock := newTestClock(store)
+
+	if n, err := store.Append("greeting", "hello"); err != nil || n != 5 {
+		t.Fatalf("Append to missing key = (%d, %v), want (5, nil)", n, err)
+	}
+	if _, err := store.ExpireAt("greeting", clock.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("ExpireAt returned error: %v", err)
+	}
+	if n, err := store.Append("greeting", " world"); err != nil || n != 11 {
+		t.Fatalf("Append = (%d, %v), want (11, nil)", n, err)
+	}
+	if got, err := store.Get("greeting"); err != nil || deref(got) != "hello world" {
+		t.Fatalf("Get = (%q, %v), want (\"hello world\", nil)", deref(got), err)
+	}
+	if ttl, err := store.TTL("greeting"); err != nil || ttl != time.Minute {
+		t.Fatalf("TTL = (%v, %v), want the expiry kept", ttl, err)
+	}
+
+	// Appending to an expired key starts it afresh
+	clock.Advance(time.Minute)
+	if n, err := store.Append("greeting", "hi"); err != nil || n != 2 {
+		t.Fatalf("Append to expired key = (%d, %v), want (2, nil)", n, err)
+	}
+	if ttl, err := store.TTL("greeting"); err != nil || ttl != TTLNoExpiry {
+		t.Fatalf("TTL = (%v, %v), want no expiry", ttl, err)
+	}
+}
+
+func TestStrLen(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	if n, err := store.StrLen("missing"); err != nil || n != 0 {
+		t.Fatalf("StrLen of missing key = (%d, %v), want (0, nil)", n, err)
+	}
+	if _, err := store.Set("foo", "héllo"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if n, err := store.StrLen("foo"); err != nil || n != 6 {
+		t.Fatalf("StrLen = (%d, %v), want the length in bytes, 6", n, err)
+	}
+}
+
+func TestGetRange(t *testing.T) {
+	store := newTestKeyValueService(t)
+	if _, err := store.Set("foo", "This is a string"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+
+	tests := []struct {
+		key        string
+		start, end int64
+		want       string
+	}{
+		{"foo", 0, 3, "This"},
+		{"foo", -3, -1, "ing"},
+		{"foo", 0, -1, "This is a string"},
+		{"foo", 10, 100, "string"},
+		{"foo", -100, 3, "This"},
+		{"foo", 5, 3, ""},
+		{"foo", 20, 30, ""},
+		{"foo", 0, -100, ""},
+		{"missing", 0, -1, ""},
+	}
+	for _, test := range tests {
+		if got, err := store.GetRange(test.key, test.start, test.end); err != nil || got != test.want {
+			t.Errorf("GetRange(%s, %d, %d) = (%q, %v), want %q", test.key, test.start, test.end, got, err, test.want)
+		}
+	}
+}
+
+func TestSetRange(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	if _, err := store.Set("foo", "Hello World"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if n, err := store.SetRange("foo", 6, "Redis"); err != nil || n != 11 {
+		t.Fatalf("SetRange = (%d, %v), want (11, nil)", n, err)
+	}
+	if got, _ := store.Get("foo"); deref(got) != "Hello Redis" {
+		t.Fatalf("Get = %q, want \"Hello Redis\"", deref(got))
+	}
+	if n, err := store.SetRange("foo", 6, "Go"); err != nil || n != 11 {
+		t.Fatalf("SetRange inside the value = (%d, %v), want (11, nil)", n, err)
+	}
+	if got, _ := store.Get("foo"); deref(got) != "Hello Godis" {
+		t.Fatalf("Get = %q, want \"Hello Godis\"", deref(got))
+	}
+
+	if n, err := store.SetRange("padded", 3, "x"); err != nil || n != 4 {
+		t.Fatalf("SetRange past the end = (%d, %v), want (4, nil)", n, err)
+	}
+	if got, _ := store.Get("padded"); deref(got) != "\x00\x00\x00x" {
+		t.Fatalf("Get = %q, want the gap padded with zero bytes", deref(got))
+	}
+
+	if n, err := store.SetRange("missing", 5, ""); err != nil || n != 0 {
+		t.Fatalf("SetRange of nothing = (%d, %v), want (0, nil)", n, err)
+	}
+	if _, err := store.Get("missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Get = %v, want the key left missing", err)
+	}
+	if _, err := store.SetRange("foo", -1, "x"); !errors.Is(err, ErrOffsetOutOfRange) {
+		t.Fatalf("SetRange with negative offset = %v, want ErrOffsetOutOfRange", err)
+	}
+	if _, err := store.SetRange("foo", maxStringSize, "x"); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("SetRange past the size cap = %v, want ErrValueTooLarge", err)
+	}
+}
+
+func TestAppend_ChecksTheResultingSize(t *testing.T) {
+	store := newTestKeyValueServiceWithConfig(t, Config{MaxValueSize: 8})
+
+	if _, err := store.Append("foo", "12345"); err != nil {
+		t.Fatalf("Append returned error: %v", err)
+	}
+	if _, err := store.Append("foo", "6789"); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("Append past the limit = %v, want ErrValueTooLarge", err)
+	}
+	if _, err := store.SetRange("foo", 6, "xyz"); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("SetRange past the limit = %v, want ErrValueTooLarge", err)
+	}
+	if got, _ := store.Get("foo"); deref(got) != "12345" {
+		t.Fatalf("Get = %q, want the value unchanged", deref(got))
+	}
+}
+
+func TestAppend_ConcurrentAppendsAreNotLost(t *testing.T) {
+	for _, execution := range []ExecutionMode{ActorExecution, DirectExecution} {
+		store := newTestKeyValueServiceWithConfig(t, Config{Execution: execution})
+
+		const appends = 200
+		done := make(chan error, appends)
+		for range appends {
+			go func() {
+				_, err := store.Append("log", "x")
+				done <- err
+			}()
+		}
+		for range appends {
+			if err := <-done; err != nil {
+				t.Fatalf("Append returned error: %v", err)
+			}
+		}
+		if got, _ := store.Get("log"); deref(got) != strings.Repeat("x", appends) {
+			t.Fatalf("execution %d: value has %d bytes, want %d", execution, len(deref(got)), appends)
+		}
+	}
+}
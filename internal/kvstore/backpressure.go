@@ -0,0 +1,80 @@
+package kvstore
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrOverloaded = errors.New("KeyValueService is overloaded, retry later")
+
+// BackpressurePolicy decides what happens when the store's input queue is
+// full.
+type BackpressurePolicy int
+
+const (
+	// BackpressureBlock waits for room in the queue, for at most
+	// Config.EnqueueTimeout when one is set, then fails with ErrOverloaded.
+	BackpressureBlock BackpressurePolicy = iota
+	// BackpressureFailFast rejects the command with ErrOverloaded as soon
+	// as the queue is full.
+	BackpressureFailFast
+)
+
+// enqueue hands a command to the store loop according to the configured
+// backpressure policy. The common case of a queue with room never touches
+// a timer.
+func (kvService *KeyValueService) enqueue(command KeyValueCommand) error {
+	select {
+	case kvService.input <- command:
+		return nil
+	default:
+	}
+
+	if kvService.backpressure == BackpressureFailFast {
+		kvService.overloaded.Add(1)
+		return ErrOverloaded
+	}
+
+	// A caller's deadline also bounds the wait, as the command would only
+	// be skipped once it reached the store
+	timeout, err := kvService.enqueueTimeout, ErrOverloaded
+	if !command.deadline.IsZero() {
+		if untilDeadline := time.Until(command.deadline); timeout <= 0 || untilDeadline < timeout {
+			timeout, err = untilDeadline, ErrDeadlineExceeded
+		}
+	}
+	if timeout <= 0 && err == ErrOverloaded {
+		kvService.input <- command
+		return nil
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case kvService.input <- command:
+		return nil
+	case <-timer.C:
+		if err == ErrDeadlineExceeded {
+			kvService.store.deadlines.skipped.Add(1)
+		} else {
+			kvService.overloaded.Add(1)
+		}
+		return err
+	}
+}
+
+// QueueDepth reports how many commands are waiting in the input queue.
+func (kvService *KeyValueService) QueueDepth() int {
+	return len(kvService.input)
+}
+
+func (kvService *KeyValueService) QueueCapacity() int {
+	return cap(kvService.input)
+}
+
+// OverloadedCount reports how many commands were rejected with
+// ErrOverloaded.
+func (kvService *KeyValueService) OverloadedCount() uint64 {
+	return kvService.overloaded.Load()
+}
@@ -0,0 +1,88 @@
+package kvstore
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stallStore blocks the store loop inside a hook and fills the input queue,
+// returning a function that releases the loop again.
+func stallStore(t *testing.T, store *KeyValueService) func() {
+	t.Helper()
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	var stalled sync.Once
+	store.AddBeforeCommandHook(func(command *Command) error {
+		if command.Key == "stall" {
+			stalled.Do(func() {
+				close(entered)
+				<-release
+			})
+		}
+		return nil
+	})
+
+	go func() { _, _ = store.Set("stall", "x") }()
+	<-entered
+
+	for range store.QueueCapacity() {
+		go func() { _, _ = store.Set("queued", "x") }()
+	}
+	deadline := time.Now().Add(time.Second)
+	for store.QueueDepth() < store.QueueCapacity() {
+		if time.Now().After(deadline) {
+			t.Fatalf("queue depth stuck at %d, want %d", store.QueueDepth(), store.QueueCapacity())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	return func() { close(release) }
+}
+
+func TestBackpressure_FailFastRejectsWhenQueueFull(t *testing.T) {
+	store := newTestKeyValueServiceWithConfig(t, Config{BufferSize: 2, Backpressure: BackpressureFailFast})
+	release := stallStore(t, store)
+	defer release()
+
+	if _, err := store.Get("foo"); !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("Get with a full queue returned %v, want ErrOverloaded", err)
+	}
+	if got := store.OverloadedCount(); got != 1 {
+		t.Fatalf("OverloadedCount() = %d, want 1", got)
+	}
+}
+
+func TestBackpressure_BlockTimesOutWhenQueueStaysFull(t *testing.T) {
+	store := newTestKeyValueServiceWithConfig(t, Config{BufferSize: 1, EnqueueTimeout: 20 * time.Millisecond})
+	release := stallStore(t, store)
+	defer release()
+
+	start := time.Now()
+	if _, err := store.Get("foo"); !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("Get with a full queue returned %v, want ErrOverloaded", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("Get gave up after %v, want it to wait for the enqueue timeout", elapsed)
+	}
+}
+
+func TestBackpressure_BlockSucceedsOnceQueueDrains(t *testing.T) {
+	store := newTestKeyValueServiceWithConfig(t, Config{BufferSize: 1, EnqueueTimeout: time.Second})
+	release := stallStore(t, store)
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := store.Set("foo", "bar")
+		result <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	release()
+
+	if err := <-result; err != nil {
+		t.Fatalf("Set after the queue drained returned error: %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// commandBatch carries the commands of a SendBatch call through the store as
+// a single queued command. The store writes each command's result into
+// results before releasing the caller, so no further synchronisation is
+// needed to read them.
+type commandBatch struct {
+	commands []Command
+	results  []Result
+}
+
+func (kvStore *KeyValueStore) ProcessBatchCommand(command KeyValueCommand) KeyValueOutput {
+	batch := command.batch
+	if batch == nil {
+		return KeyValueOutput{false, nil, fmt.Errorf("batch command has no commands"), 0}
+	}
+
+	for i, sub := range batch.commands {
+		if sub.Type == BATCH {
+			batch.results[i] = Result{false, nil, fmt.Errorf("batch commands cannot be nested"), 0}
+			continue
+		}
+		output := kvStore.process(KeyValueCommand{
+			commandType: sub.Type,
+			key:         sub.Key,
+			value:       sub.Value,
+			expected:    sub.Expected,
+			expireAt:    sub.ExpireAt,
+			ttl:         sub.TTL,
+			deadline:    command.deadline,
+			concurrent:  command.concurrent,
+		})
+		batch.results[i] = Result{output.success, output.value, output.err, output.integer}
+	}
+	return KeyValueOutput{true, nil, nil, 0}
+}
+
+// SendBatch runs commands in order through the store with a single round
+// trip and returns one Result per command. Other callers' commands are not
+// interleaved with the batch, but the batch is not atomic: a failing command
+// does not stop or undo the rest.
+func (kvService *KeyValueService) SendBatch(commands []Command) []Result {
+	return kvService.SendBatchContext(context.Background(), commands)
+}
+
+// SendBatchContext is SendBatch for a caller that stops waiting once ctx's
+// deadline passes. Commands the store has not reached by then are skipped
+// and fail with ErrDeadlineExceeded; those already executed keep their
+// results.
+func (kvService *KeyValueService) SendBatchContext(ctx context.Context, commands []Command) []Result {
+	results := make([]Result, len(commands))
+	if err := kvService.CheckActive(); err != nil {
+		return fillResults(results, err)
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return fillResults(results, err)
+	}
+
+	// Reject mutations up front in read-only mode and only send the rest
+	pending := commands
+	var indexes []int
+	if kvService.IsReadOnly() {
+		pending = make([]Command, 0, len(commands))
+		for i, command := range commands {
+			if IsMutation(command.Type) {
+				results[i] = Result{false, nil, ErrReadOnly, 0}
+				continue
+			}
+			pending = append(pending, command)
+			indexes = append(indexes, i)
+		}
+	}
+	if len(pending) == 0 {
+		return results
+	}
+
+	batch := &commandBatch{pending, make([]Result, len(pending))}
+	res := kvService.dispatch(withDeadline(ctx, KeyValueCommand{commandType: BATCH, batch: batch}))
+	if res.err != nil {
+		return fillResults(results, res.err)
+	}
+
+	if indexes == nil {
+		return batch.results
+	}
+	for i, result := range batch.results {
+		results[indexes[i]] = result
+	}
+	return results
+}
+
+// MGet reads keys with a single batch command and returns their values in
+// the same order, nil for a key that does not exist. It fails with the
+// first error reading any key.
+func (kvService *KeyValueService) MGet(keys []string) ([]*string, error) {
+	commands := make([]Command, len(keys))
+	for i, key := range keys {
+		commands[i] = Command{Type: GET, Key: key}
+	}
+	values := make([]*string, len(keys))
+	for i, result := range kvService.SendBatch(commands) {
+		switch {
+		case errors.Is(result.Err, ErrKeyNotFound):
+		case result.Err != nil:
+			return nil, fmt.Errorf("getting key %s: %w", keys[i], result.Err)
+		default:
+			values[i] = result.Value
+		}
+	}
+	return values, nil
+}
+
+// MSet writes entries with a single batch command, in key order. As with
+// SendBatch the writes are not atomic: a key that fails does not stop the
+// rest, and the error returned joins every key's failure.
+func (kvService *KeyValueService) MSet(entries map[string]string) error {
+	keys := slices.Sorted(maps.Keys(entries))
+	commands := make([]Command, len(keys))
+	for i, key := range keys {
+		value := entries[key]
+		commands[i] = Command{Type: PUT, Key: key, Value: &value}
+	}
+	var errs []error
+	for i, result := range kvService.SendBatch(commands) {
+		if result.Err != nil {
+			errs = append(errs, fmt.Errorf("setting key %s: %w", keys[i], result.Err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func fillResults(results []Result, err error) []Result {
+	for i := range results {
+		results[i] = Result{false, nil, err, 0}
+	}
+	return results
+}
+
+// IsMutation reports whether commands of commandType can change the store,
+// as opposed to only reading it.
+func IsMutation(commandType int) bool {
+	switch commandType {
+	case PUT, DELETE, EXPIREAT, PERSIST, CMSINIT, CMSINCRBY, CMSMERGE, LOCK, UNLOCK,
+		LEASEGRANT, LEASEATTACH, LEASEKEEPALIVE, LEASEREVOKE, TXPREPARE, TXCOMMIT, WRITEBATCH, APPLYMUTATIONS,
+		PNCOUNTERINCRBY, ORSETADD, ORSETREMOVE, MERGEMUTATIONS, SETNX, SETIFEQUAL, APPEND, SETRANGE,
+		HSET, HDEL, HINCRBY, LPUSH, RPUSH, LPOP, RPOP:
+		return true
+	}
+	return false
+}
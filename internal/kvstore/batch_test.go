@@ -0,0 +1,126 @@
+package kvstore
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestSendBatch_ReturnsResultPerCommandInOrder(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	results := store.SendBatch([]Command{
+		{Type: PUT, Key: "a", Value: strPtr("1")},
+		{Type: PUT, Key: "b", Value: strPtr("2")},
+		{Type: GET, Key: "a"},
+		{Type: DELETE, Key: "b"},
+		{Type: GET, Key: "b"},
+		{Type: 999, Key: "x"},
+	})
+
+	want := []struct {
+		success bool
+		value   string
+		err     bool
+	}{
+		{true, "1", false},
+		{true, "2", false},
+		{true, "1", false},
+		{true, "2", false},
+		{false, "<nil>", true},
+		{false, "<nil>", true},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("SendBatch returned %d results, want %d", len(results), len(want))
+	}
+	for i, w := range want {
+		got := results[i]
+		if got.Success != w.success || deref(got.Value) != w.value || (got.Err != nil) != w.err {
+			t.Errorf("result %d = {%v, %s, %v}, want {%v, %s, err=%v}", i, got.Success, deref(got.Value), got.Err, w.success, w.value, w.err)
+		}
+	}
+
+	if got := store.BatchStats().Commands; got != 1 {
+		t.Fatalf("SendBatch used %d store round trips, want 1", got)
+	}
+	if got := store.CommandStats()["PUT"].Count; got != 2 {
+		t.Fatalf("PUT count = %d, want batched commands to be counted individually", got)
+	}
+}
+
+func TestSendBatch_ReadOnlyRejectsOnlyMutations(t *testing.T) {
+	store := newTestKeyValueService(t)
+	if _, err := store.Set("a", "1"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	store.SetReadOnly(true)
+
+	results := store.SendBatch([]Command{
+		{Type: PUT, Key: "b", Value: strPtr("2")},
+		{Type: GET, Key: "a"},
+		{Type: DELETE, Key: "a"},
+	})
+
+	if !errors.Is(results[0].Err, ErrReadOnly) || !errors.Is(results[2].Err, ErrReadOnly) {
+		t.Fatalf("mutations in read-only batch returned %v and %v, want ErrReadOnly", results[0].Err, results[2].Err)
+	}
+	if results[1].Err != nil || deref(results[1].Value) != "1" {
+		t.Fatalf("read in read-only batch = (%s, %v), want %q", deref(results[1].Value), results[1].Err, "1")
+	}
+}
+
+func TestSendBatch_AfterClose(t *testing.T) {
+	store := newTestKeyValueService(t)
+	store.Close()
+
+	for i, result := range store.SendBatch([]Command{{Type: GET, Key: "a"}, {Type: GET, Key: "b"}}) {
+		if result.Err == nil {
+			t.Errorf("result %d after Close() has nil error", i)
+		}
+	}
+}
+
+func TestMGetMSet_UseOneBatch(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	if err := store.MSet(map[string]string{"a": "1", "b": "2", "c": "3"}); err != nil {
+		t.Fatalf("MSet returned error: %v", err)
+	}
+	values, err := store.MGet([]string{"c", "missing", "a"})
+	if err != nil {
+		t.Fatalf("MGet returned error: %v", err)
+	}
+	if len(values) != 3 || deref(values[0]) != "3" || values[1] != nil || deref(values[2]) != "1" {
+		t.Fatalf("MGet = [%s %s %s], want [3 <nil> 1]", deref(values[0]), deref(values[1]), deref(values[2]))
+	}
+	if got := store.BatchStats().Commands; got != 2 {
+		t.Fatalf("MSet and MGet used %d store round trips, want 2", got)
+	}
+}
+
+func TestMSet_ReportsEveryFailedKey(t *testing.T) {
+	store := newTestKeyValueServiceWithConfig(t, Config{MaxValueSize: 1})
+
+	err := store.MSet(map[string]string{"a": "1", "b": "too long", "c": "also too long"})
+	if !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("MSet = %v, want ErrValueTooLarge", err)
+	}
+	if got := len(strings.Split(err.Error(), "\n")); got != 2 {
+		t.Fatalf("MSet reported %d failures, want 2: %v", got, err)
+	}
+	if got, _ := store.Get("a"); deref(got) != "1" {
+		t.Fatalf("Get(a) = %s, want the valid key written", deref(got))
+	}
+
+	store.SetReadOnly(true)
+	if _, err := store.MGet([]string{"a"}); err != nil {
+		t.Fatalf("MGet in read-only mode returned error: %v", err)
+	}
+	if err := store.MSet(map[string]string{"a": "2"}); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("MSet in read-only mode = %v, want ErrReadOnly", err)
+	}
+}
@@ -0,0 +1,127 @@
+package kvstore
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+const benchmarkKeySpace = 1024
+
+type benchmarkSetup struct {
+	name   string
+	config func(b *testing.B) Config
+}
+
+var benchmarkSetups = []benchmarkSetup{
+	{"actor-memory", func(b *testing.B) Config { return Config{} }},
+	{"actor-memory-concurrent-reads", func(b *testing.B) Config { return Config{ConcurrentReads: true} }},
+	{"direct-sharded", func(b *testing.B) Config { return Config{Execution: DirectExecution} }},
+	{"actor-disk", func(b *testing.B) Config {
+		engine, err := NewDiskEngine(b.TempDir())
+		if err != nil {
+			b.Fatalf("NewDiskEngine returned error: %v", err)
+		}
+		return Config{Engine: engine}
+	}},
+}
+
+var (
+	benchmarkConcurrency = []int{1, 16, 128}
+	benchmarkValueSizes  = []int{64, 4096}
+)
+
+func benchmarkKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	return keys
+}
+
+// runConcurrently spreads b.N calls of op over the given number of
+// goroutines. op receives the global iteration index.
+func runConcurrently(b *testing.B, concurrency int, op func(i int)) {
+	var next atomic.Int64
+	var wg sync.WaitGroup
+
+	b.ResetTimer()
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(next.Add(1) - 1)
+				if i >= b.N {
+					return
+				}
+				op(i)
+			}
+		}()
+	}
+	wg.Wait()
+	b.StopTimer()
+
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "ops/s")
+}
+
+func forEachBenchmarkCase(b *testing.B, run func(b *testing.B, store *KeyValueService, concurrency int, value string)) {
+	for _, setup := range benchmarkSetups {
+		for _, concurrency := range benchmarkConcurrency {
+			for _, size := range benchmarkValueSizes {
+				name := fmt.Sprintf("engine=%s/conc=%d/size=%d", setup.name, concurrency, size)
+				b.Run(name, func(b *testing.B) {
+					store := newTestKeyValueServiceWithConfig(b, setup.config(b))
+					b.ReportAllocs()
+					run(b, store, concurrency, strings.Repeat("x", size))
+				})
+			}
+		}
+	}
+}
+
+func BenchmarkSet(b *testing.B) {
+	keys := benchmarkKeys(benchmarkKeySpace)
+	forEachBenchmarkCase(b, func(b *testing.B, store *KeyValueService, concurrency int, value string) {
+		runConcurrently(b, concurrency, func(i int) {
+			if _, err := store.Set(keys[i%len(keys)], value); err != nil {
+				b.Errorf("Set returned error: %v", err)
+			}
+		})
+	})
+}
+
+func BenchmarkGet(b *testing.B) {
+	keys := benchmarkKeys(benchmarkKeySpace)
+	forEachBenchmarkCase(b, func(b *testing.B, store *KeyValueService, concurrency int, value string) {
+		for _, key := range keys {
+			if _, err := store.Set(key, value); err != nil {
+				b.Fatalf("Set returned error: %v", err)
+			}
+		}
+		runConcurrently(b, concurrency, func(i int) {
+			if _, err := store.Get(keys[i%len(keys)]); err != nil {
+				b.Errorf("Get returned error: %v", err)
+			}
+		})
+	})
+}
+
+func BenchmarkDelete(b *testing.B) {
+	forEachBenchmarkCase(b, func(b *testing.B, store *KeyValueService, concurrency int, value string) {
+		// Every timed Delete removes a key that exists
+		keys := benchmarkKeys(b.N)
+		for _, key := range keys {
+			if _, err := store.Set(key, value); err != nil {
+				b.Fatalf("Set returned error: %v", err)
+			}
+		}
+		runConcurrently(b, concurrency, func(i int) {
+			if _, err := store.Delete(keys[i]); err != nil {
+				b.Errorf("Delete returned error: %v", err)
+			}
+		})
+	})
+}
@@ -0,0 +1,69 @@
+package kvstore
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CommandMetrics counts commands processed by the store, labelled by command
+// type. Counters are atomic so commands executed outside the store goroutine
+// (DirectExecution) can record without serialising on a lock.
+type CommandMetrics struct {
+	byType sync.Map // int -> *commandCounters
+}
+
+type commandCounters struct {
+	count         atomic.Uint64
+	errors        atomic.Uint64
+	totalDuration atomic.Int64
+}
+
+type CommandStats struct {
+	Count         uint64
+	Errors        uint64
+	TotalDuration time.Duration
+}
+
+func NewCommandMetrics() *CommandMetrics {
+	return &CommandMetrics{}
+}
+
+func (metrics *CommandMetrics) Record(commandType int, duration time.Duration, err error) {
+	counters, ok := metrics.byType.Load(commandType)
+	if !ok {
+		counters, _ = metrics.byType.LoadOrStore(commandType, &commandCounters{})
+	}
+	c := counters.(*commandCounters)
+	c.count.Add(1)
+	c.totalDuration.Add(int64(duration))
+	if err != nil {
+		c.errors.Add(1)
+	}
+}
+
+// Snapshot returns a copy of the per-command stats keyed by command name.
+func (metrics *CommandMetrics) Snapshot() map[string]CommandStats {
+	out := make(map[string]CommandStats)
+	metrics.byType.Range(func(commandType, counters any) bool {
+		c := counters.(*commandCounters)
+		out[GetCommandTypeString(commandType.(int))] = CommandStats{
+			Count:         c.count.Load(),
+			Errors:        c.errors.Load(),
+			TotalDuration: time.Duration(c.totalDuration.Load()),
+		}
+		return true
+	})
+	return out
+}
+
+func (stats CommandStats) AverageDuration() time.Duration {
+	if stats.Count == 0 {
+		return 0
+	}
+	return stats.TotalDuration / time.Duration(stats.Count)
+}
+
+func (kvService *KeyValueService) CommandStats() map[string]CommandStats {
+	return kvService.store.metrics.Snapshot()
+}
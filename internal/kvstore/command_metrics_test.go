@@ -0,0 +1,36 @@
+package kvstore
+
+import "testing"
+
+func TestCommandStats_CountsByCommandType(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	_, _ = store.Set("foo", "bar")
+	_, _ = store.Set("foo", "baz")
+	_, _ = store.Get("foo")
+	_, _ = store.Get("missing")
+	_, _ = store.Delete("foo")
+
+	stats := store.CommandStats()
+
+	tests := []struct {
+		command string
+		count   uint64
+		errors  uint64
+	}{
+		{"PUT", 2, 0},
+		{"GET", 2, 1},
+		{"DELETE", 1, 0},
+	}
+
+	for _, tt := range tests {
+		got := stats[tt.command]
+		if got.Count != tt.count || got.Errors != tt.errors {
+			t.Errorf("CommandStats()[%q] = {Count: %d, Errors: %d}, want {Count: %d, Errors: %d}",
+				tt.command, got.Count, got.Errors, tt.count, tt.errors)
+		}
+		if got.Count > 0 && got.TotalDuration <= 0 {
+			t.Errorf("CommandStats()[%q].TotalDuration = %v, want > 0", tt.command, got.TotalDuration)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+)
+
+// ProcessSetNXCommand sets the key only if it does not exist, replying with
+// an integer of 1 if it did so and 0 if the key was left alone.
+func (kvStore *KeyValueStore) ProcessSetNXCommand(command KeyValueCommand) KeyValueOutput {
+	key := command.key
+	if command.value == nil {
+		return KeyValueOutput{false, nil, fmt.Errorf("value given was nil for setnx command"), 0}
+	}
+	defer kvStore.keyLocks.lock(command)()
+	// An expired key counts as missing, and is removed by the check
+	if !kvStore.expired(command) {
+		_, ok, err := kvStore.engine.Get(key)
+		if err != nil {
+			return KeyValueOutput{false, nil, err, 0}
+		}
+		if ok {
+			return KeyValueOutput{true, nil, nil, 0}
+		}
+	}
+	return kvStore.conditionalSet(key, *command.value)
+}
+
+// ProcessSetIfEqualCommand sets the key only if it holds the expected
+// value, replying with an integer of 1 if it did so and 0 if the key was
+// missing or held something else.
+func (kvStore *KeyValueStore) ProcessSetIfEqualCommand(command KeyValueCommand) KeyValueOutput {
+	key := command.key
+	if command.value == nil || command.expected == nil {
+		return KeyValueOutput{false, nil, fmt.Errorf("value or expected value given was nil for setifequal command"), 0}
+	}
+	defer kvStore.keyLocks.lock(command)()
+	if kvStore.expired(command) {
+		return KeyValueOutput{true, nil, nil, 0}
+	}
+	current, ok, err := kvStore.loadTyped(key, TypeString)
+	if err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	if !ok || current != *command.expected {
+		return KeyValueOutput{true, nil, nil, 0}
+	}
+	return kvStore.conditionalSet(key, *command.value)
+}
+
+// conditionalSet writes a value whose condition held, as a PUT would.
+func (kvStore *KeyValueStore) conditionalSet(key string, value string) KeyValueOutput {
+	if err := kvStore.setValueExpiring(key, stringValue(value), kvStore.newDeadline(key)); err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	kvStore.touch(key)
+	return KeyValueOutput{true, stringPointer(value), nil, 1}
+}
+
+// SetNX sets key to value only if key does not exist, and reports whether
+// it did. The check and the write are one command, so of many callers
+// racing to create a key exactly one succeeds. Under DirectExecution that
+// holds against other conditional writes, but not against plain Sets.
+func (kvService *KeyValueService) SetNX(key string, value string) (bool, error) {
+	return kvService.SetNXContext(context.Background(), key, value)
+}
+
+// SetNXContext is SetNX with ctx's deadline, as SetContext is Set.
+func (kvService *KeyValueService) SetNXContext(ctx context.Context, key string, value string) (bool, error) {
+	if err := kvService.CheckWritable(); err != nil {
+		return false, err
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return false, err
+	}
+	res := kvService.dispatch(withDeadline(ctx, KeyValueCommand{commandType: SETNX, key: key, value: &value}))
+
+	return res.integer == 1, res.err
+}
+
+// SetIfEqual sets key to value only if it currently holds expected, and
+// reports whether it did, for compare-and-swap updates: a caller reads the
+// value, computes the new one and retries if another write got in first.
+// A missing key never matches. Like Set, a successful write removes any
+// expiry the key had.
+func (kvService *KeyValueService) SetIfEqual(key string, expected string, value string) (bool, error) {
+	return kvService.SetIfEqualContext(context.Background(), key, expected, value)
+}
+
+// SetIfEqualContext is SetIfEqual with ctx's deadline, as SetContext is
+// Set.
+func (kvService *KeyValueService) SetIfEqualContext(ctx context.Context, key string, expected string, value string) (bool, error) {
+	if err := kvService.CheckWritable(); err != nil {
+		return false, err
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return false, err
+	}
+	res := kvService.dispatch(withDeadline(ctx, KeyValueCommand{commandType: SETIFEQUAL, key: key, value: &value, expected: &expected}))
+
+	return res.integer == 1, res.err
+}
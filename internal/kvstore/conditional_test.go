@@ -0,0 +1,157 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSetNX_OnlyCreatesMissingKeys(t *testing.T) {
+	store := newTestKeyValueService(t)
+	clock := newTestClock(store)
+
+	if ok, err := store.SetNX("foo", "first"); err != nil || !ok {
+		t.Fatalf("SetNX of missing key = (%t, %v), want (true, nil)", ok, err)
+	}
+	if ok, err := store.SetNX("foo", "second"); err != nil || ok {
+		t.Fatalf("SetNX of existing key = (%t, %v), want (false, nil)", ok, err)
+	}
+	if got, err := store.Get("foo"); err != nil || deref(got) != "first" {
+		t.Fatalf("Get = (%q, %v), want the first value kept", deref(got), err)
+	}
+
+	// An expired key is missing
+	if _, err := store.ExpireAt("foo", clock.Now().Add(time.Second)); err != nil {
+		t.Fatalf("ExpireAt returned error: %v", err)
+	}
+	clock.Advance(time.Second)
+	if ok, err := store.SetNX("foo", "third"); err != nil || !ok {
+		t.Fatalf("SetNX of expired key = (%t, %v), want (true, nil)", ok, err)
+	}
+	if ttl, err := store.TTL("foo"); err != nil || ttl != TTLNoExpiry {
+		t.Fatalf("TTL = (%v, %v), want the new key without the old expiry", ttl, err)
+	}
+}
+
+func TestSetIfEqual_SwapsOnlyTheExpectedValue(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	if ok, err := store.SetIfEqual("foo", "", "bar"); err != nil || ok {
+		t.Fatalf("SetIfEqual of missing key = (%t, %v), want (false, nil)", ok, err)
+	}
+	if _, err := store.Get("foo"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Get = %v, want the missing key left missing", err)
+	}
+	if _, err := store.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if ok, err := store.SetIfEqual("foo", "baz", "qux"); err != nil || ok {
+		t.Fatalf("SetIfEqual with wrong expectation = (%t, %v), want (false, nil)", ok, err)
+	}
+	if ok, err := store.SetIfEqual("foo", "bar", "qux"); err != nil || !ok {
+		t.Fatalf("SetIfEqual = (%t, %v), want (true, nil)", ok, err)
+	}
+	if got, err := store.Get("foo"); err != nil || deref(got) != "qux" {
+		t.Fatalf("Get = (%q, %v), want (\"qux\", nil)", deref(got), err)
+	}
+}
+
+func TestConditionalWrites_SkippedPastTheirDeadline(t *testing.T) {
+	store := newTestKeyValueService(t)
+	if _, err := store.Set("foo", "old"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	if _, err := store.SetNXContext(ctx, "bar", "new"); !errors.Is(err, ErrDeadlineExceeded) {
+		t.Fatalf("SetNXContext past its deadline = %v, want ErrDeadlineExceeded", err)
+	}
+	if _, err := store.SetIfEqualContext(ctx, "foo", "old", "new"); !errors.Is(err, ErrDeadlineExceeded) {
+		t.Fatalf("SetIfEqualContext past its deadline = %v, want ErrDeadlineExceeded", err)
+	}
+	if _, err := store.Get("bar"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Get(bar) = %v, want the skipped SetNX never to have run", err)
+	}
+	if got, err := store.Get("foo"); err != nil || deref(got) != "old" {
+		t.Fatalf("Get(foo) = (%q, %v), want the skipped SetIfEqual never to have run", deref(got), err)
+	}
+}
+
+func TestConditionalWrites_AreCheckedAndReplicated(t *testing.T) {
+	store := newTestKeyValueServiceWithConfig(t, Config{MaxValueSize: 4})
+	store.SetReadOnly(true)
+	if _, err := store.SetNX("foo", "bar"); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("SetNX in read-only mode = %v, want ErrReadOnly", err)
+	}
+	store.SetReadOnly(false)
+	if _, err := store.SetNX("foo", "too long"); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("SetNX of large value = %v, want ErrValueTooLarge", err)
+	}
+
+	stream, err := store.Replicate(8)
+	if err != nil {
+		t.Fatalf("Replicate returned error: %v", err)
+	}
+	defer stream.Close()
+	if _, err := store.SetNX("foo", "bar"); err != nil {
+		t.Fatalf("SetNX returned error: %v", err)
+	}
+	if _, err := store.SetIfEqual("foo", "bar", "baz"); err != nil {
+		t.Fatalf("SetIfEqual returned error: %v", err)
+	}
+	var values []string
+	for range 2 {
+		select {
+		case mutation := <-stream.Mutations():
+			values = append(values, mutation.Value)
+		case <-time.After(time.Second):
+			t.Fatalf("replicated %v, want both writes", values)
+		}
+	}
+	if fmt.Sprint(values) != "[bar baz]" {
+		t.Fatalf("replicated %v, want [bar baz]", values)
+	}
+}
+
+func TestSetIfEqual_CountsWithoutLostUpdates(t *testing.T) {
+	for _, execution := range []ExecutionMode{ActorExecution, DirectExecution} {
+		store := newTestKeyValueServiceWithConfig(t, Config{Execution: execution})
+		if _, err := store.Set("counter", "0"); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+
+		const workers, increments = 8, 50
+		var retries atomic.Int64
+		var wg sync.WaitGroup
+		for range workers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range increments {
+					for {
+						current, err := store.Get("counter")
+						if err != nil {
+							t.Errorf("Get returned error: %v", err)
+							return
+						}
+						n, _ := strconv.Atoi(*current)
+						if ok, err := store.SetIfEqual("counter", *current, strconv.Itoa(n+1)); err != nil || ok {
+							break
+						}
+						retries.Add(1)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if got, _ := store.Get("counter"); deref(got) != strconv.Itoa(workers*increments) {
+			t.Fatalf("counter = %s after %d retries, want %d", deref(got), retries.Load(), workers*increments)
+		}
+	}
+}
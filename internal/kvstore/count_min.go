@@ -0,0 +1,236 @@
+package kvstore
+
+import (
+	"blueis/internal/sketch"
+	"context"
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+var ErrWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+// countMinCommand carries the arguments of a count-min sketch command and,
+// like commandBatch, receives its estimates before the caller is released.
+type countMinCommand struct {
+	initial    *sketch.CountMin
+	items      []string
+	increments []uint32
+	sources    []string
+	estimates  []uint32
+}
+
+// loadCountMin reads the sketch stored under key. Sketches are stored as
+// encoded values so deletes, expiry and disk persistence apply to them like
+// to any other key.
+func (kvStore *KeyValueStore) loadCountMin(key string, concurrent bool) (*sketch.CountMin, error) {
+	if kvStore.keyExpired(key, concurrent) {
+		return nil, keyNotFound(key)
+	}
+	value, ok, err := kvStore.loadTyped(key, TypeCountMin)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, keyNotFound(key)
+	}
+	return sketch.DecodeCountMin(value)
+}
+
+// storeCountMin writes cms under key. Like APPEND, it keeps the expiry of
+// a key that existed and gives a new one its namespace's default TTL.
+func (kvStore *KeyValueStore) storeCountMin(key string, cms *sketch.CountMin, existed bool) error {
+	data, err := cms.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	// data is never modified again, so the string can share its bytes
+	value := TypedValue{TypeCountMin, unsafe.String(&data[0], len(data))}
+	if !existed {
+		return kvStore.setValueExpiring(key, value, kvStore.newDeadline(key))
+	}
+	return kvStore.setValue(key, value)
+}
+
+func (kvStore *KeyValueStore) ProcessCountMinCommand(command KeyValueCommand) KeyValueOutput {
+	args := command.countMin
+	if args == nil {
+		return KeyValueOutput{false, nil, fmt.Errorf("%s command has no arguments", GetCommandTypeString(command.commandType)), 0}
+	}
+
+	if command.commandType != CMSQUERY {
+		defer kvStore.keyLocks.lock(command)()
+	}
+
+	key := command.key
+	switch command.commandType {
+	case CMSINIT:
+		if !kvStore.expired(command) {
+			_, ok, err := kvStore.engine.Get(key)
+			if err != nil {
+				return KeyValueOutput{false, nil, err, 0}
+			}
+			if ok {
+				return KeyValueOutput{false, nil, fmt.Errorf("key %s already exists", key), 0}
+			}
+		}
+		if err := kvStore.storeCountMin(key, args.initial, false); err != nil {
+			return KeyValueOutput{false, nil, err, 0}
+		}
+
+	case CMSINCRBY:
+		cms, err := kvStore.loadCountMin(key, command.concurrent)
+		if err != nil {
+			return KeyValueOutput{false, nil, err, 0}
+		}
+		for i, item := range args.items {
+			args.estimates[i] = cms.Add(item, args.increments[i])
+		}
+		if err := kvStore.storeCountMin(key, cms, true); err != nil {
+			return KeyValueOutput{false, nil, err, 0}
+		}
+
+	case CMSQUERY:
+		cms, err := kvStore.loadCountMin(key, command.concurrent)
+		if err != nil {
+			return KeyValueOutput{false, nil, err, 0}
+		}
+		for i, item := range args.items {
+			args.estimates[i] = cms.Estimate(item)
+		}
+
+	case CMSMERGE:
+		cms, err := kvStore.loadCountMin(key, command.concurrent)
+		if err != nil {
+			return KeyValueOutput{false, nil, err, 0}
+		}
+		for _, source := range args.sources {
+			other, err := kvStore.loadCountMin(source, command.concurrent)
+			if err != nil {
+				return KeyValueOutput{false, nil, err, 0}
+			}
+			if err := cms.Merge(other); err != nil {
+				return KeyValueOutput{false, nil, err, 0}
+			}
+		}
+		if err := kvStore.storeCountMin(key, cms, true); err != nil {
+			return KeyValueOutput{false, nil, err, 0}
+		}
+	}
+
+	kvStore.touch(key)
+	return KeyValueOutput{true, nil, nil, 0}
+}
+
+// CountMinInit creates an empty count-min sketch under key with depth rows
+// of width counters. It fails if key already exists.
+func (kvService *KeyValueService) CountMinInit(key string, width int, depth int) error {
+	return kvService.CountMinInitContext(context.Background(), key, width, depth)
+}
+
+// CountMinInitContext is CountMinInit with ctx's deadline, as SetContext is
+// Set.
+func (kvService *KeyValueService) CountMinInitContext(ctx context.Context, key string, width int, depth int) error {
+	cms, err := sketch.NewCountMin(width, depth)
+	if err != nil {
+		return err
+	}
+	return kvService.countMinInit(ctx, key, cms)
+}
+
+// CountMinInitWithError creates an empty count-min sketch under key sized so
+// estimates exceed the true count by at most errorRate times the sketch's
+// total count, failing with the given probability.
+func (kvService *KeyValueService) CountMinInitWithError(key string, errorRate float64, probability float64) error {
+	return kvService.CountMinInitWithErrorContext(context.Background(), key, errorRate, probability)
+}
+
+// CountMinInitWithErrorContext is CountMinInitWithError with ctx's
+// deadline, as SetContext is Set.
+func (kvService *KeyValueService) CountMinInitWithErrorContext(ctx context.Context, key string, errorRate float64, probability float64) error {
+	cms, err := sketch.NewCountMinWithError(errorRate, probability)
+	if err != nil {
+		return err
+	}
+	return kvService.countMinInit(ctx, key, cms)
+}
+
+func (kvService *KeyValueService) countMinInit(ctx context.Context, key string, cms *sketch.CountMin) error {
+	res, err := kvService.sendCountMin(ctx, CMSINIT, key, &countMinCommand{initial: cms})
+	if err != nil {
+		return err
+	}
+	return res.err
+}
+
+// CountMinIncrBy adds increments[i] to items[i] in the sketch under key and
+// returns each item's new estimated count.
+func (kvService *KeyValueService) CountMinIncrBy(key string, items []string, increments []uint32) ([]uint32, error) {
+	return kvService.CountMinIncrByContext(context.Background(), key, items, increments)
+}
+
+// CountMinIncrByContext is CountMinIncrBy with ctx's deadline, as
+// SetContext is Set.
+func (kvService *KeyValueService) CountMinIncrByContext(ctx context.Context, key string, items []string, increments []uint32) ([]uint32, error) {
+	if len(items) != len(increments) {
+		return nil, fmt.Errorf("got %d items but %d increments", len(items), len(increments))
+	}
+	args := &countMinCommand{items: items, increments: increments, estimates: make([]uint32, len(items))}
+	res, err := kvService.sendCountMin(ctx, CMSINCRBY, key, args)
+	if err != nil {
+		return nil, err
+	}
+	if res.err != nil {
+		return nil, res.err
+	}
+	return args.estimates, nil
+}
+
+// CountMinQuery returns the estimated count of each item in the sketch
+// under key.
+func (kvService *KeyValueService) CountMinQuery(key string, items ...string) ([]uint32, error) {
+	return kvService.CountMinQueryContext(context.Background(), key, items...)
+}
+
+// CountMinQueryContext is CountMinQuery with ctx's deadline, as GetContext
+// is Get.
+func (kvService *KeyValueService) CountMinQueryContext(ctx context.Context, key string, items ...string) ([]uint32, error) {
+	if err := kvService.CheckActive(); err != nil {
+		return nil, err
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return nil, err
+	}
+	args := &countMinCommand{items: items, estimates: make([]uint32, len(items))}
+	res := kvService.dispatchRead(withDeadline(ctx, KeyValueCommand{commandType: CMSQUERY, key: key, countMin: args}))
+	if res.err != nil {
+		return nil, res.err
+	}
+	return args.estimates, nil
+}
+
+// CountMinMerge adds the counts of every source sketch into the sketch under
+// destination. All sketches must have the same dimensions.
+func (kvService *KeyValueService) CountMinMerge(destination string, sources ...string) error {
+	return kvService.CountMinMergeContext(context.Background(), destination, sources...)
+}
+
+// CountMinMergeContext is CountMinMerge with ctx's deadline, as SetContext
+// is Set.
+func (kvService *KeyValueService) CountMinMergeContext(ctx context.Context, destination string, sources ...string) error {
+	res, err := kvService.sendCountMin(ctx, CMSMERGE, destination, &countMinCommand{sources: sources})
+	if err != nil {
+		return err
+	}
+	return res.err
+}
+
+func (kvService *KeyValueService) sendCountMin(ctx context.Context, commandType int, key string, args *countMinCommand) (KeyValueOutput, error) {
+	if err := kvService.CheckWritable(); err != nil {
+		return KeyValueOutput{}, err
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return KeyValueOutput{}, err
+	}
+	return kvService.dispatch(withDeadline(ctx, KeyValueCommand{commandType: commandType, key: key, countMin: args})), nil
+}
@@ -0,0 +1,140 @@
+package kvstore
+
+import (
+	"blueis/internal/sketch"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCountMin_IncrByAndQuery(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	if err := store.CountMinInit("hits", 256, 4); err != nil {
+		t.Fatalf("CountMinInit returned error: %v", err)
+	}
+	estimates, err := store.CountMinIncrBy("hits", []string{"a", "b", "a"}, []uint32{2, 1, 3})
+	if err != nil {
+		t.Fatalf("CountMinIncrBy returned error: %v", err)
+	}
+	if !slices.Equal(estimates, []uint32{2, 1, 5}) {
+		t.Fatalf("CountMinIncrBy = %v, want [2 1 5]", estimates)
+	}
+
+	counts, err := store.CountMinQuery("hits", "a", "b", "c")
+	if err != nil {
+		t.Fatalf("CountMinQuery returned error: %v", err)
+	}
+	if !slices.Equal(counts, []uint32{5, 1, 0}) {
+		t.Fatalf("CountMinQuery = %v, want [5 1 0]", counts)
+	}
+}
+
+func TestCountMin_InitRejectsExistingKey(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	if _, err := store.Set("hits", "plain"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if err := store.CountMinInitWithError("hits", 0.01, 0.01); err == nil {
+		t.Fatalf("CountMinInitWithError over an existing key succeeded, want error")
+	}
+}
+
+func TestCountMin_WrongTypeAndMissingKey(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	if _, err := store.Set("plain", "value"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := store.CountMinQuery("plain", "a"); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("CountMinQuery on a string returned %v, want ErrWrongType", err)
+	}
+	if _, err := store.CountMinIncrBy("missing", []string{"a"}, []uint32{1}); err == nil {
+		t.Fatalf("CountMinIncrBy on a missing key succeeded, want error")
+	}
+	if _, err := store.CountMinIncrBy("plain", []string{"a"}, nil); err == nil {
+		t.Fatalf("CountMinIncrBy with mismatched increments succeeded, want error")
+	}
+}
+
+func TestCountMin_Merge(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	for _, key := range []string{"total", "day1", "day2"} {
+		if err := store.CountMinInit(key, 128, 4); err != nil {
+			t.Fatalf("CountMinInit(%q) returned error: %v", key, err)
+		}
+	}
+	if _, err := store.CountMinIncrBy("day1", []string{"x"}, []uint32{4}); err != nil {
+		t.Fatalf("CountMinIncrBy returned error: %v", err)
+	}
+	if _, err := store.CountMinIncrBy("day2", []string{"x", "y"}, []uint32{6, 1}); err != nil {
+		t.Fatalf("CountMinIncrBy returned error: %v", err)
+	}
+
+	if err := store.CountMinMerge("total", "day1", "day2"); err != nil {
+		t.Fatalf("CountMinMerge returned error: %v", err)
+	}
+	counts, err := store.CountMinQuery("total", "x", "y")
+	if err != nil {
+		t.Fatalf("CountMinQuery returned error: %v", err)
+	}
+	if !slices.Equal(counts, []uint32{10, 1}) {
+		t.Fatalf("merged counts = %v, want [10 1]", counts)
+	}
+
+	if err := store.CountMinInit("narrow", 64, 4); err != nil {
+		t.Fatalf("CountMinInit returned error: %v", err)
+	}
+	if err := store.CountMinMerge("total", "narrow"); !errors.Is(err, sketch.ErrDimensionMismatch) {
+		t.Fatalf("CountMinMerge of different dimensions returned %v, want ErrDimensionMismatch", err)
+	}
+}
+
+func TestCountMin_KeepsExpiryAndPersistsOnDisk(t *testing.T) {
+	engine, err := NewDiskEngine(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewDiskEngine returned error: %v", err)
+	}
+	store := newTestKeyValueServiceWithConfig(t, Config{Engine: engine})
+	clock := newTestClock(store)
+
+	if err := store.CountMinInit("hits", 64, 3); err != nil {
+		t.Fatalf("CountMinInit returned error: %v", err)
+	}
+	if _, err := store.ExpireAt("hits", clock.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("ExpireAt returned error: %v", err)
+	}
+	if _, err := store.CountMinIncrBy("hits", []string{"a"}, []uint32{1}); err != nil {
+		t.Fatalf("CountMinIncrBy returned error: %v", err)
+	}
+	if ttl, err := store.TTL("hits"); err != nil || ttl != time.Minute {
+		t.Fatalf("TTL after CountMinIncrBy = (%v, %v), want (1m, nil)", ttl, err)
+	}
+
+	value, ok, err := engine.Get("hits")
+	if err != nil || !ok {
+		t.Fatalf("engine Get = (%t, %v), want the stored sketch", ok, err)
+	}
+	cms, err := sketch.DecodeCountMin(value.Data)
+	if err != nil || cms.Estimate("a") != 1 {
+		t.Fatalf("stored sketch decoded with error %v", err)
+	}
+}
+
+func TestCountMin_ReadOnly(t *testing.T) {
+	store := newTestKeyValueService(t)
+	if err := store.CountMinInit("hits", 64, 3); err != nil {
+		t.Fatalf("CountMinInit returned error: %v", err)
+	}
+	store.SetReadOnly(true)
+
+	if _, err := store.CountMinIncrBy("hits", []string{"a"}, []uint32{1}); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("CountMinIncrBy in read-only mode returned %v, want ErrReadOnly", err)
+	}
+	if _, err := store.CountMinQuery("hits", "a"); err != nil {
+		t.Fatalf("CountMinQuery in read-only mode returned error: %v", err)
+	}
+}
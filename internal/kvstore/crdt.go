@@ -0,0 +1,298 @@
+package kvstore
+
+import (
+	"blueis/internal/crdt"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrNotCRDTNamespace = errors.New("key is not in a CRDT namespace")
+
+// crdtCommand carries the arguments of a counter or set command and, like
+// countMinCommand, receives its result before the caller is released.
+type crdtCommand struct {
+	delta   int64
+	members []string
+	value   int64
+	result  []string
+}
+
+// crdtKey reports whether key falls under one of the CRDT namespaces.
+func (kvStore *KeyValueStore) crdtKey(key string) bool {
+	for _, prefix := range kvStore.crdtNamespaces {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadCRDT reads the encoded value of type valueType under key. A missing
+// key reads as an empty counter or set, so ok is false and value is empty.
+func (kvStore *KeyValueStore) loadCRDT(key string, concurrent bool, valueType ValueType) (string, bool, error) {
+	if kvStore.keyExpired(key, concurrent) {
+		return "", false, nil
+	}
+	return kvStore.loadTyped(key, valueType)
+}
+
+func (kvStore *KeyValueStore) loadPNCounter(key string, concurrent bool) (*crdt.PNCounter, error) {
+	value, ok, err := kvStore.loadCRDT(key, concurrent, TypePNCounter)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return crdt.NewPNCounter(), nil
+	}
+	return crdt.DecodePNCounter(value)
+}
+
+func (kvStore *KeyValueStore) loadORSet(key string, concurrent bool) (*crdt.ORSet, error) {
+	value, ok, err := kvStore.loadCRDT(key, concurrent, TypeORSet)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return crdt.NewORSet(), nil
+	}
+	return crdt.DecodeORSet(value)
+}
+
+func (kvStore *KeyValueStore) ProcessCRDTCommand(command KeyValueCommand) KeyValueOutput {
+	args := command.crdt
+	if args == nil {
+		return KeyValueOutput{false, nil, fmt.Errorf("%s command has no arguments", GetCommandTypeString(command.commandType)), 0}
+	}
+	key := command.key
+	if !kvStore.crdtKey(key) {
+		return KeyValueOutput{false, nil, ErrNotCRDTNamespace, 0}
+	}
+
+	if command.commandType != PNCOUNTERGET && command.commandType != ORSETMEMBERS {
+		defer kvStore.keyLocks.lock(command)()
+	}
+
+	switch command.commandType {
+	case PNCOUNTERINCRBY:
+		counter, err := kvStore.loadPNCounter(key, command.concurrent)
+		if err != nil {
+			return KeyValueOutput{false, nil, err, 0}
+		}
+		args.value = counter.Add(kvStore.crdtActor, args.delta)
+		if err := kvStore.setValue(key, TypedValue{TypePNCounter, counter.Encode()}); err != nil {
+			return KeyValueOutput{false, nil, err, 0}
+		}
+
+	case PNCOUNTERGET:
+		counter, err := kvStore.loadPNCounter(key, command.concurrent)
+		if err != nil {
+			return KeyValueOutput{false, nil, err, 0}
+		}
+		args.value = counter.Value()
+
+	case ORSETADD, ORSETREMOVE:
+		set, err := kvStore.loadORSet(key, command.concurrent)
+		if err != nil {
+			return KeyValueOutput{false, nil, err, 0}
+		}
+		changed := int64(0)
+		for _, member := range args.members {
+			var ok bool
+			if command.commandType == ORSETADD {
+				ok = set.Add(kvStore.crdtActor, member)
+			} else {
+				ok = set.Remove(member)
+			}
+			if ok {
+				changed++
+			}
+		}
+		args.value = changed
+		// Adds always record a new dot, so the set is written even when
+		// every member was already present
+		if changed > 0 || command.commandType == ORSETADD {
+			if err := kvStore.setValue(key, TypedValue{TypeORSet, set.Encode()}); err != nil {
+				return KeyValueOutput{false, nil, err, 0}
+			}
+		}
+
+	case ORSETMEMBERS:
+		set, err := kvStore.loadORSet(key, command.concurrent)
+		if err != nil {
+			return KeyValueOutput{false, nil, err, 0}
+		}
+		args.result = set.Members()
+	}
+
+	kvStore.touch(key)
+	return KeyValueOutput{true, nil, nil, 0}
+}
+
+// ProcessMergeMutationsCommand merges counters and sets written by another
+// store into the local ones. Only sets of CRDT values under a CRDT
+// namespace are merged; every other mutation is skipped, as are merges
+// that leave the local value unchanged, so two stores merging each other's
+// changes stop once they agree instead of echoing them back and forth.
+func (kvStore *KeyValueStore) ProcessMergeMutationsCommand(command KeyValueCommand) KeyValueOutput {
+	if command.replication == nil {
+		return KeyValueOutput{false, nil, fmt.Errorf("%s command has no arguments", GetCommandTypeString(command.commandType)), 0}
+	}
+	for _, mutation := range command.replication.mutations {
+		if mutation.Type != MutationSet || !kvStore.crdtKey(mutation.Key) {
+			continue
+		}
+		if mutation.ValueType != TypePNCounter && mutation.ValueType != TypeORSet {
+			continue
+		}
+		remote := TypedValue{mutation.ValueType, mutation.Value}
+		if err := kvStore.mergeValue(mutation.Key, remote, command.concurrent); err != nil {
+			return KeyValueOutput{false, nil, fmt.Errorf("merging mutation %d: %w", mutation.Offset, err), 0}
+		}
+	}
+	return KeyValueOutput{true, nil, nil, 0}
+}
+
+func (kvStore *KeyValueStore) mergeValue(key string, remote TypedValue, concurrent bool) error {
+	defer kvStore.keyLocks.lock(KeyValueCommand{key: key, concurrent: concurrent})()
+
+	if err := remote.decode(); err != nil {
+		return err
+	}
+	local, ok, err := kvStore.loadCRDT(key, concurrent, remote.Type)
+	if err != nil {
+		return err
+	}
+	merged := remote
+	if ok {
+		var changed bool
+		merged.Data, changed, err = crdt.Merge(local, remote.Data)
+		if errors.Is(err, crdt.ErrTypeMismatch) {
+			return ErrWrongType
+		}
+		if err != nil || !changed {
+			return err
+		}
+	}
+	if err := kvStore.setValue(key, merged); err != nil {
+		return err
+	}
+	kvStore.touch(key)
+	return nil
+}
+
+// PNCounterIncrBy adds delta, which may be negative, to the counter under
+// key and returns its new value. A missing key counts from zero.
+func (kvService *KeyValueService) PNCounterIncrBy(key string, delta int64) (int64, error) {
+	return kvService.PNCounterIncrByContext(context.Background(), key, delta)
+}
+
+// PNCounterIncrByContext is PNCounterIncrBy with ctx's deadline, as
+// SetContext is Set.
+func (kvService *KeyValueService) PNCounterIncrByContext(ctx context.Context, key string, delta int64) (int64, error) {
+	args := &crdtCommand{delta: delta}
+	if err := kvService.sendCRDT(ctx, PNCOUNTERINCRBY, key, args); err != nil {
+		return 0, err
+	}
+	return args.value, nil
+}
+
+// PNCounterGet returns the value of the counter under key, or zero if
+// there is none.
+func (kvService *KeyValueService) PNCounterGet(key string) (int64, error) {
+	return kvService.PNCounterGetContext(context.Background(), key)
+}
+
+// PNCounterGetContext is PNCounterGet with ctx's deadline, as GetContext is
+// Get.
+func (kvService *KeyValueService) PNCounterGetContext(ctx context.Context, key string) (int64, error) {
+	args := &crdtCommand{}
+	if err := kvService.readCRDT(ctx, PNCOUNTERGET, key, args); err != nil {
+		return 0, err
+	}
+	return args.value, nil
+}
+
+// ORSetAdd adds members to the set under key and returns how many were not
+// already in it. An add made concurrently with a remove of the same member
+// on another store wins once the two are merged.
+func (kvService *KeyValueService) ORSetAdd(key string, members ...string) (int64, error) {
+	return kvService.ORSetAddContext(context.Background(), key, members...)
+}
+
+// ORSetAddContext is ORSetAdd with ctx's deadline, as SetContext is Set.
+func (kvService *KeyValueService) ORSetAddContext(ctx context.Context, key string, members ...string) (int64, error) {
+	args := &crdtCommand{members: members}
+	if err := kvService.sendCRDT(ctx, ORSETADD, key, args); err != nil {
+		return 0, err
+	}
+	return args.value, nil
+}
+
+// ORSetRemove removes members from the set under key and returns how many
+// were in it. Only the adds this store has seen are removed.
+func (kvService *KeyValueService) ORSetRemove(key string, members ...string) (int64, error) {
+	return kvService.ORSetRemoveContext(context.Background(), key, members...)
+}
+
+// ORSetRemoveContext is ORSetRemove with ctx's deadline, as SetContext is
+// Set.
+func (kvService *KeyValueService) ORSetRemoveContext(ctx context.Context, key string, members ...string) (int64, error) {
+	args := &crdtCommand{members: members}
+	if err := kvService.sendCRDT(ctx, ORSETREMOVE, key, args); err != nil {
+		return 0, err
+	}
+	return args.value, nil
+}
+
+// ORSetMembers returns the members of the set under key in sorted order.
+func (kvService *KeyValueService) ORSetMembers(key string) ([]string, error) {
+	return kvService.ORSetMembersContext(context.Background(), key)
+}
+
+// ORSetMembersContext is ORSetMembers with ctx's deadline, as GetContext is
+// Get.
+func (kvService *KeyValueService) ORSetMembersContext(ctx context.Context, key string) ([]string, error) {
+	args := &crdtCommand{}
+	if err := kvService.readCRDT(ctx, ORSETMEMBERS, key, args); err != nil {
+		return nil, err
+	}
+	return args.result, nil
+}
+
+// MergeMutations merges counters and sets streamed from another store, as
+// from ApplyMutations, except that local values are merged with the
+// incoming ones instead of being replaced and everything outside the CRDT
+// namespaces is ignored. It lets two stores accept writes to the same
+// counters and sets at once and converge by following each other.
+// Deleting or expiring such a key is not merged.
+func (kvService *KeyValueService) MergeMutations(mutations []Mutation) error {
+	if err := kvService.CheckWritable(); err != nil {
+		return err
+	}
+	res := kvService.dispatch(KeyValueCommand{commandType: MERGEMUTATIONS, replication: &replicationCommand{mutations: mutations}})
+	return res.err
+}
+
+func (kvService *KeyValueService) sendCRDT(ctx context.Context, commandType int, key string, args *crdtCommand) error {
+	if err := kvService.CheckWritable(); err != nil {
+		return err
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return err
+	}
+	res := kvService.dispatch(withDeadline(ctx, KeyValueCommand{commandType: commandType, key: key, crdt: args}))
+	return res.err
+}
+
+func (kvService *KeyValueService) readCRDT(ctx context.Context, commandType int, key string, args *crdtCommand) error {
+	if err := kvService.CheckActive(); err != nil {
+		return err
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return err
+	}
+	res := kvService.dispatchRead(withDeadline(ctx, KeyValueCommand{commandType: commandType, key: key, crdt: args}))
+	return res.err
+}
@@ -0,0 +1,167 @@
+package kvstore
+
+import (
+	"blueis/internal/crdt"
+	"errors"
+	"slices"
+	"testing"
+)
+
+// mergeFrom merges every mutation stream has delivered so far into store.
+func mergeFrom(t *testing.T, stream *ReplicationStream, store *KeyValueService) {
+	t.Helper()
+
+	for {
+		select {
+		case mutation, ok := <-stream.Mutations():
+			if !ok {
+				t.Fatalf("stream closed: %v", stream.Err())
+			}
+			if err := store.MergeMutations([]Mutation{mutation}); err != nil {
+				t.Fatalf("MergeMutations returned error: %v", err)
+			}
+		default:
+			return
+		}
+	}
+}
+
+func TestCRDT_CounterAndSetCommands(t *testing.T) {
+	store := newTestKeyValueServiceWithConfig(t, Config{CRDTNamespaces: []string{"crdt:"}})
+
+	if _, err := store.PNCounterIncrBy("crdt:visits", 5); err != nil {
+		t.Fatalf("PNCounterIncrBy returned error: %v", err)
+	}
+	value, err := store.PNCounterIncrBy("crdt:visits", -2)
+	if err != nil || value != 3 {
+		t.Fatalf("PNCounterIncrBy = (%d, %v), want 3", value, err)
+	}
+	if value, err := store.PNCounterGet("crdt:missing"); err != nil || value != 0 {
+		t.Fatalf("PNCounterGet of a missing key = (%d, %v), want 0", value, err)
+	}
+
+	added, err := store.ORSetAdd("crdt:tags", "b", "a", "b")
+	if err != nil || added != 2 {
+		t.Fatalf("ORSetAdd = (%d, %v), want 2", added, err)
+	}
+	removed, err := store.ORSetRemove("crdt:tags", "b", "c")
+	if err != nil || removed != 1 {
+		t.Fatalf("ORSetRemove = (%d, %v), want 1", removed, err)
+	}
+	members, err := store.ORSetMembers("crdt:tags")
+	if err != nil || !slices.Equal(members, []string{"a"}) {
+		t.Fatalf("ORSetMembers = (%v, %v), want [a]", members, err)
+	}
+
+	if _, err := store.PNCounterIncrBy("visits", 1); !errors.Is(err, ErrNotCRDTNamespace) {
+		t.Fatalf("PNCounterIncrBy outside a namespace returned %v, want ErrNotCRDTNamespace", err)
+	}
+	if _, err := store.ORSetAdd("crdt:visits", "a"); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("ORSetAdd on a counter returned %v, want ErrWrongType", err)
+	}
+	if _, err := store.Set("crdt:plain", "value"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := store.PNCounterGet("crdt:plain"); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("PNCounterGet on a string returned %v, want ErrWrongType", err)
+	}
+}
+
+func TestCRDT_CannotBeForgedWithSet(t *testing.T) {
+	store := newTestKeyValueServiceWithConfig(t, Config{CRDTNamespaces: []string{"crdt:"}})
+	if _, err := store.PNCounterIncrBy("crdt:visits", 1); err != nil {
+		t.Fatalf("PNCounterIncrBy returned error: %v", err)
+	}
+
+	// A string holding the encoding of a counter or set is still a string
+	counter := crdt.NewPNCounter()
+	counter.Add("forger", 1000)
+	if _, err := store.Set("crdt:visits", counter.Encode()); err != nil {
+		t.Fatalf("Set of a counter returned error: %v", err)
+	}
+	set := crdt.NewORSet()
+	set.Add("forger", "admin")
+	if _, err := store.Set("crdt:roles", set.Encode()); err != nil {
+		t.Fatalf("Set of a set returned error: %v", err)
+	}
+
+	if _, err := store.PNCounterGet("crdt:visits"); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("PNCounterGet of the string = %v, want ErrWrongType", err)
+	}
+	if _, err := store.ORSetMembers("crdt:roles"); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("ORSetMembers of the string = %v, want ErrWrongType", err)
+	}
+	if got, err := store.Get("crdt:visits"); err != nil || got == nil || *got != counter.Encode() {
+		t.Fatalf("Get of the string = (%v, %v), want the bytes it was set to", got, err)
+	}
+}
+
+func TestMergeMutations_ConcurrentWritesConverge(t *testing.T) {
+	config := Config{CRDTNamespaces: []string{"crdt:"}, CRDTActor: "east"}
+	east := newTestKeyValueServiceWithConfig(t, config)
+	config.CRDTActor = "west"
+	west := newTestKeyValueServiceWithConfig(t, config)
+
+	fromEast, err := east.Replicate(64)
+	if err != nil {
+		t.Fatalf("Replicate returned error: %v", err)
+	}
+	defer fromEast.Close()
+	fromWest, err := west.Replicate(64)
+	if err != nil {
+		t.Fatalf("Replicate returned error: %v", err)
+	}
+	defer fromWest.Close()
+	// Both stores start empty, so there is nothing to sync
+	for _, stream := range []*ReplicationStream{fromEast, fromWest} {
+		if err := stream.Sync(func(Mutation) error { return nil }); err != nil {
+			t.Fatalf("Sync returned error: %v", err)
+		}
+	}
+
+	if _, err := east.ORSetAdd("crdt:tags", "shared"); err != nil {
+		t.Fatalf("ORSetAdd returned error: %v", err)
+	}
+	mergeFrom(t, fromEast, west)
+	mergeFrom(t, fromWest, east)
+
+	// Each side writes while partitioned from the other
+	if _, err := east.PNCounterIncrBy("crdt:visits", 3); err != nil {
+		t.Fatalf("PNCounterIncrBy returned error: %v", err)
+	}
+	if _, err := west.PNCounterIncrBy("crdt:visits", -1); err != nil {
+		t.Fatalf("PNCounterIncrBy returned error: %v", err)
+	}
+	if _, err := east.ORSetRemove("crdt:tags", "shared"); err != nil {
+		t.Fatalf("ORSetRemove returned error: %v", err)
+	}
+	if _, err := west.ORSetAdd("crdt:tags", "shared", "west"); err != nil {
+		t.Fatalf("ORSetAdd returned error: %v", err)
+	}
+	if _, err := west.Set("plain", "west"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+
+	mergeFrom(t, fromEast, west)
+	mergeFrom(t, fromWest, east)
+	mergeFrom(t, fromEast, west)
+	mergeFrom(t, fromWest, east)
+
+	for _, store := range []*KeyValueService{east, west} {
+		if value, err := store.PNCounterGet("crdt:visits"); err != nil || value != 2 {
+			t.Fatalf("PNCounterGet = (%d, %v), want 2", value, err)
+		}
+		// West's concurrent add of shared wins over east's remove
+		if members, err := store.ORSetMembers("crdt:tags"); err != nil || !slices.Equal(members, []string{"shared", "west"}) {
+			t.Fatalf("ORSetMembers = (%v, %v), want [shared west]", members, err)
+		}
+	}
+	assertValue(t, east, "plain", nil)
+
+	// Once converged, merging makes no further changes to echo back
+	_, offset := east.ReplicationOffset()
+	mergeFrom(t, fromWest, east)
+	if _, after := east.ReplicationOffset(); after != offset {
+		t.Fatalf("merging converged values advanced the offset from %d to %d", offset, after)
+	}
+}
@@ -0,0 +1,91 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrDeadlineExceeded is returned for a command whose caller's deadline
+// passed before the store got to it. The command was not executed.
+var ErrDeadlineExceeded = errors.New("deadline exceeded before the command ran")
+
+// deadlineCounter counts the commands skipped because their deadline had
+// passed.
+type deadlineCounter struct {
+	skipped atomic.Uint64
+}
+
+// withDeadline gives command the deadline of ctx, if it has one.
+func withDeadline(ctx context.Context, command KeyValueCommand) KeyValueCommand {
+	if deadline, ok := ctx.Deadline(); ok {
+		command.deadline = deadline
+	}
+	return command
+}
+
+// pastDeadline reports whether the caller of command has given up on it.
+// Deadlines come from the caller's context, so they are measured against
+// the wall clock rather than Config.Clock.
+func (command KeyValueCommand) pastDeadline() bool {
+	return !command.deadline.IsZero() && !time.Now().Before(command.deadline)
+}
+
+// skipPastDeadline fails command with ErrDeadlineExceeded if its deadline
+// has passed, so the store does not spend its time on a result nobody
+// will read.
+func (kvStore *KeyValueStore) skipPastDeadline(command KeyValueCommand) (KeyValueOutput, bool) {
+	if !command.pastDeadline() {
+		return KeyValueOutput{}, false
+	}
+	kvStore.deadlines.skipped.Add(1)
+	return KeyValueOutput{false, nil, ErrDeadlineExceeded, 0}, true
+}
+
+// GetContext is Get for a caller that stops waiting once ctx's deadline
+// passes: if the store has not reached the command by then, it is skipped
+// and fails with ErrDeadlineExceeded.
+func (kvService *KeyValueService) GetContext(ctx context.Context, key string) (*string, error) {
+	if err := kvService.CheckActive(); err != nil {
+		return nil, err
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return nil, err
+	}
+	res := kvService.dispatchRead(withDeadline(ctx, KeyValueCommand{commandType: GET, key: key}))
+
+	return res.value, res.err
+}
+
+// SetContext is Set with ctx's deadline, as GetContext is Get.
+func (kvService *KeyValueService) SetContext(ctx context.Context, key string, value string) (*string, error) {
+	if err := kvService.CheckWritable(); err != nil {
+		return nil, err
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return nil, err
+	}
+	res := kvService.dispatch(withDeadline(ctx, KeyValueCommand{commandType: PUT, key: key, value: &value}))
+
+	return res.value, res.err
+}
+
+// DeleteContext is Delete with ctx's deadline, as GetContext is Get.
+func (kvService *KeyValueService) DeleteContext(ctx context.Context, key string) (*string, error) {
+	if err := kvService.CheckWritable(); err != nil {
+		return nil, err
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return nil, err
+	}
+	res := kvService.dispatch(withDeadline(ctx, KeyValueCommand{commandType: DELETE, key: key}))
+
+	return res.value, res.err
+}
+
+// DeadlineExceededCount reports how many commands were skipped because
+// their caller's deadline had passed.
+func (kvService *KeyValueService) DeadlineExceededCount() uint64 {
+	return kvService.store.deadlines.skipped.Load()
+}
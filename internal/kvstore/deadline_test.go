@@ -0,0 +1,119 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDeadline_SkipsCommandsQueuedPastIt(t *testing.T) {
+	store := newTestKeyValueServiceWithConfig(t, Config{BufferSize: 8})
+	started, release := make(chan struct{}), make(chan struct{})
+	var ran []string
+	store.AddBeforeCommandHook(func(command *Command) error {
+		ran = append(ran, command.Key)
+		if command.Key == "slow" {
+			close(started)
+			<-release
+		}
+		return nil
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := store.Set("slow", "value")
+		done <- err
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	results := make(chan error, 2)
+	go func() {
+		_, err := store.SetContext(ctx, "doomed", "value")
+		results <- err
+	}()
+	go func() {
+		results <- store.SendBatchContext(ctx, []Command{{Type: GET, Key: "doomed"}, {Type: PUT, Key: "doomed", Value: new(string)}})[1].Err
+	}()
+	<-ctx.Done()
+	close(release)
+
+	if err := <-done; err != nil {
+		t.Fatalf("Set without a deadline returned error: %v", err)
+	}
+	for range 2 {
+		if err := <-results; !errors.Is(err, ErrDeadlineExceeded) {
+			t.Fatalf("command queued past its deadline returned %v, want ErrDeadlineExceeded", err)
+		}
+	}
+	for _, key := range ran {
+		if key == "doomed" {
+			t.Fatalf("hooks ran %v, want the skipped commands never to reach them", ran)
+		}
+	}
+	if _, err := store.Get("doomed"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Get = %v, want the skipped writes never to have run", err)
+	}
+	// The batch is skipped as the one command it is queued as
+	if skipped := store.DeadlineExceededCount(); skipped != 2 {
+		t.Fatalf("DeadlineExceededCount = %d, want 2", skipped)
+	}
+}
+
+func TestDeadline_LeavesCommandsWithinItAlone(t *testing.T) {
+	store := newTestKeyValueService(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if _, err := store.SetContext(ctx, "k", "v"); err != nil {
+		t.Fatalf("SetContext returned error: %v", err)
+	}
+	if value, err := store.GetContext(ctx, "k"); err != nil || *value != "v" {
+		t.Fatalf("GetContext = %v, %v, want v", value, err)
+	}
+	if _, err := store.DeleteContext(ctx, "k"); err != nil {
+		t.Fatalf("DeleteContext returned error: %v", err)
+	}
+	if store.DeadlineExceededCount() != 0 {
+		t.Fatalf("DeadlineExceededCount = %d, want 0", store.DeadlineExceededCount())
+	}
+}
+
+func TestDeadline_AppliesToEveryContextCommand(t *testing.T) {
+	store := newTestKeyValueService(t)
+	if _, err := store.RPush("list", "a"); err != nil {
+		t.Fatalf("RPush returned error: %v", err)
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	commands := map[string]func() error{
+		"LPushContext": func() error { _, err := store.LPushContext(ctx, "list", "b"); return err },
+		"LPopContext":  func() error { _, err := store.LPopContext(ctx, "list"); return err },
+		"LLenContext":  func() error { _, err := store.LLenContext(ctx, "list"); return err },
+		"ExpireAtContext": func() error {
+			_, err := store.ExpireAtContext(ctx, "list", time.Now().Add(time.Hour))
+			return err
+		},
+		"TTLContext":              func() error { _, err := store.TTLContext(ctx, "list"); return err },
+		"CountMinInitContext":     func() error { return store.CountMinInitContext(ctx, "sketch", 8, 2) },
+		"PNCounterGetContext":     func() error { _, err := store.PNCounterGetContext(ctx, "counter"); return err },
+		"LockContext":             func() error { _, _, err := store.LockContext(ctx, "lock", time.Minute); return err },
+		"GrantLeaseContext":       func() error { _, err := store.GrantLeaseContext(ctx, time.Minute); return err },
+		"RandomKeysContext":       func() error { _, err := store.RandomKeysContext(ctx, 1); return err },
+		"AbortTransactionContext": func() error { return store.AbortTransactionContext(ctx, "tx") },
+	}
+	for name, command := range commands {
+		if err := command(); !errors.Is(err, ErrDeadlineExceeded) {
+			t.Errorf("%s past its deadline returned %v, want ErrDeadlineExceeded", name, err)
+		}
+	}
+	if values, err := store.LRange("list", 0, -1); err != nil || len(values) != 1 || values[0] != "a" {
+		t.Fatalf("LRange = %v, %v, want the skipped commands to leave [a] alone", values, err)
+	}
+	if ttl, err := store.TTL("list"); err != nil || ttl != TTLNoExpiry {
+		t.Fatalf("TTL = %v, %v, want the skipped ExpireAt never to have run", ttl, err)
+	}
+}
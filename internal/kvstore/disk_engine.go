@@ -0,0 +1,694 @@
+package kvstore
+
+import (
+	"blueis/internal/datatype"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+	"unsafe"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// diskFileName is the bbolt file DiskEngine keeps under its directory, which
+// other files, like the transaction log, may share.
+const diskFileName = "blueis.db"
+
+var (
+	diskBucket         = []byte("keys")
+	diskListBucket     = []byte("lists")
+	diskDeadlineBucket = []byte("deadlines")
+)
+
+// diskInitialMmapSize is how much of the file bbolt maps up front. Growing
+// the map waits for every open read transaction, which a snapshot may hold
+// for a long time, so mapping ahead keeps writes from waiting on snapshots
+// until the file outgrows it.
+const diskInitialMmapSize = 1 << 30
+
+// errStopScan ends a bbolt ForEach early when the caller's fn returns false.
+var errStopScan = errors.New("scan stopped")
+
+// DiskEngine keeps every key in a bbolt database under dir, so the dataset is
+// bounded by disk rather than memory. Each write is its own transaction,
+// synced to disk before it returns. Records are keyed by the SHA-256 of the
+// key, so SampleKeys can seek to a random point in the keyspace, and hold the
+// key itself so hash collisions are detected rather than silently merged.
+// Each record also holds its value's type.
+//
+// A list's record holds just where its values start and end. The values
+// are records of their own in a bucket per list, keyed by position, so a
+// push or pop writes only the values it adds or removes.
+//
+// Expiry deadlines are kept in a bucket of their own under the same IDs,
+// written in the same transaction as the value they belong to, so they
+// survive a restart with it and are removed along with it.
+//
+// bbolt locks its file, so only one DiskEngine can have dir open at a time.
+type DiskEngine struct {
+	db *bolt.DB
+}
+
+func NewDiskEngine(dir string) (*DiskEngine, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating data directory %s: %w", dir, err)
+	}
+	path := filepath.Join(dir, diskFileName)
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second, InitialMmapSize: diskInitialMmapSize})
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{diskBucket, diskListBucket, diskDeadlineBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	return &DiskEngine{db}, nil
+}
+
+func diskRecordID(key string) []byte {
+	sum := sha256.Sum256([]byte(key))
+	return sum[:]
+}
+
+// diskRecord returns the type and payload of the record stored for key,
+// copied out of bbolt, whose slices are only valid inside the transaction.
+func diskRecord(tx *bolt.Tx, id []byte, key string) (ValueType, string, bool, error) {
+	data := tx.Bucket(diskBucket).Get(id)
+	if data == nil {
+		return 0, "", false, nil
+	}
+	kind, storedKey, payload, err := decodeDiskRecord(bytes.Clone(data))
+	if err != nil {
+		return 0, "", false, err
+	}
+	if storedKey != key {
+		return 0, "", false, fmt.Errorf("collides with stored key %s", storedKey)
+	}
+	return kind, payload, true, nil
+}
+
+// diskListRecord returns the header of the list stored for key, or an
+// empty one if there is none.
+func diskListRecord(tx *bolt.Tx, id []byte, key string) (diskListHeader, bool, error) {
+	kind, payload, ok, err := diskRecord(tx, id, key)
+	if err != nil || !ok {
+		return diskListHeader{}, false, err
+	}
+	if kind != TypeList {
+		return diskListHeader{}, false, ErrWrongType
+	}
+	header, err := decodeDiskListHeader(payload)
+	return header, err == nil, err
+}
+
+// diskRecordValue returns what Get reads for a record: its payload, or the
+// encoding of the list it heads.
+func diskRecordValue(tx *bolt.Tx, id []byte, kind ValueType, payload string) (TypedValue, error) {
+	if kind != TypeList {
+		return TypedValue{kind, payload}, nil
+	}
+	list := datatype.NewList()
+	if items := tx.Bucket(diskListBucket).Bucket(id); items != nil {
+		err := items.ForEach(func(_ []byte, value []byte) error {
+			list.PushRight(string(value))
+			return nil
+		})
+		if err != nil {
+			return TypedValue{}, err
+		}
+	}
+	return TypedValue{TypeList, list.Encode()}, nil
+}
+
+func (engine *DiskEngine) Get(key string) (TypedValue, bool, error) {
+	var value TypedValue
+	var ok bool
+	err := engine.db.View(func(tx *bolt.Tx) error {
+		var err error
+		value, ok, err = diskGet(tx, key)
+		return err
+	})
+	if err != nil {
+		return TypedValue{}, false, fmt.Errorf("reading key %s: %w", key, err)
+	}
+	return value, ok, nil
+}
+
+func diskGet(tx *bolt.Tx, key string) (TypedValue, bool, error) {
+	id := diskRecordID(key)
+	kind, payload, found, err := diskRecord(tx, id, key)
+	if err != nil || !found {
+		return TypedValue{}, false, err
+	}
+	value, err := diskRecordValue(tx, id, kind, payload)
+	return value, err == nil, err
+}
+
+// Set stores a list as a list, failing if its encoding does not decode,
+// and anything else as it is. The key keeps its deadline.
+func (engine *DiskEngine) Set(key string, value TypedValue) error {
+	err := engine.db.Update(func(tx *bolt.Tx) error {
+		return putDiskValue(tx, diskRecordID(key), key, value)
+	})
+	if err != nil {
+		return fmt.Errorf("writing key %s: %w", key, err)
+	}
+	return nil
+}
+
+// SetExpiring writes value and its deadline in one transaction.
+func (engine *DiskEngine) SetExpiring(key string, value TypedValue, deadline int64) error {
+	err := engine.db.Update(func(tx *bolt.Tx) error {
+		id := diskRecordID(key)
+		if err := putDiskValue(tx, id, key, value); err != nil {
+			return err
+		}
+		return putDiskDeadline(tx, id, key, deadline)
+	})
+	if err != nil {
+		return fmt.Errorf("writing key %s: %w", key, err)
+	}
+	return nil
+}
+
+// SetDeadline looks for the key in a read transaction first, so clearing
+// the deadline of a key just deleted costs no write.
+func (engine *DiskEngine) SetDeadline(key string, deadline int64) error {
+	id := diskRecordID(key)
+	var unchanged bool
+	err := engine.db.View(func(tx *bolt.Tx) error {
+		_, _, found, err := diskRecord(tx, id, key)
+		unchanged = !found || (deadline == 0 && tx.Bucket(diskDeadlineBucket).Get(id) == nil)
+		return err
+	})
+	if err == nil && !unchanged {
+		err = engine.db.Update(func(tx *bolt.Tx) error {
+			if _, _, found, err := diskRecord(tx, id, key); err != nil || !found {
+				return err
+			}
+			return putDiskDeadline(tx, id, key, deadline)
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("writing deadline of key %s: %w", key, err)
+	}
+	return nil
+}
+
+// Deadlines reads every deadline inside one read transaction.
+func (engine *DiskEngine) Deadlines(fn func(key string, deadline int64) bool) error {
+	err := engine.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(diskDeadlineBucket).ForEach(func(id []byte, data []byte) error {
+			if len(data) < 8 {
+				return fmt.Errorf("%x: deadline record too short", id)
+			}
+			if !fn(string(data[8:]), int64(binary.BigEndian.Uint64(data))) {
+				return errStopScan
+			}
+			return nil
+		})
+	})
+	if err != nil && !errors.Is(err, errStopScan) {
+		return fmt.Errorf("reading deadlines: %w", err)
+	}
+	return nil
+}
+
+func putDiskValue(tx *bolt.Tx, id []byte, key string, value TypedValue) error {
+	if err := deleteDiskListItems(tx, id); err != nil {
+		return err
+	}
+	if value.Type == TypeList {
+		list, err := datatype.DecodeList(value.Data)
+		if err != nil {
+			return err
+		}
+		header := diskListHeader{}
+		return header.push(tx, id, key, false, list.Range(0, -1))
+	}
+	return tx.Bucket(diskBucket).Put(id, encodeDiskRecord(key, value))
+}
+
+// putDiskDeadline records a deadline as the deadline followed by the key,
+// or removes the key's deadline when it is zero.
+func putDiskDeadline(tx *bolt.Tx, id []byte, key string, deadline int64) error {
+	deadlines := tx.Bucket(diskDeadlineBucket)
+	if deadline == 0 {
+		return deadlines.Delete(id)
+	}
+	return deadlines.Put(id, append(binary.BigEndian.AppendUint64(nil, uint64(deadline)), key...))
+}
+
+// deleteDiskRecord removes the record stored under id along with any list
+// values and deadline it has.
+func deleteDiskRecord(tx *bolt.Tx, id []byte) error {
+	if err := deleteDiskListItems(tx, id); err != nil {
+		return err
+	}
+	if err := tx.Bucket(diskDeadlineBucket).Delete(id); err != nil {
+		return err
+	}
+	return tx.Bucket(diskBucket).Delete(id)
+}
+
+func (engine *DiskEngine) Delete(key string) (TypedValue, bool, error) {
+	var value TypedValue
+	var ok bool
+	err := engine.db.Update(func(tx *bolt.Tx) error {
+		id := diskRecordID(key)
+		kind, payload, found, err := diskRecord(tx, id, key)
+		if err != nil || !found {
+			return err
+		}
+		if value, err = diskRecordValue(tx, id, kind, payload); err != nil {
+			return err
+		}
+		ok = true
+		return deleteDiskRecord(tx, id)
+	})
+	if err != nil {
+		return TypedValue{}, false, fmt.Errorf("deleting key %s: %w", key, err)
+	}
+	return value, ok, nil
+}
+
+// Inspect reports the size of the key's record, and of a list's values,
+// without copying them.
+func (engine *DiskEngine) Inspect(key string) (ObjectInfo, bool, error) {
+	size := -1
+	err := engine.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(diskBucket).Get(diskRecordID(key))
+		if data == nil {
+			return nil
+		}
+		size = len(data)
+		kind, _, payload, err := decodeDiskRecord(bytes.Clone(data))
+		if err != nil || kind != TypeList {
+			return err
+		}
+		header, err := decodeDiskListHeader(payload)
+		size += int(header.size)
+		return err
+	})
+	if err != nil {
+		return ObjectInfo{}, false, fmt.Errorf("inspecting key %s: %w", key, err)
+	}
+	if size < 0 {
+		return ObjectInfo{}, false, nil
+	}
+	return ObjectInfo{Encoding: "disk", Size: size}, true, nil
+}
+
+// Scan reads every record inside one read transaction, so it sees a
+// consistent view of the engine.
+func (engine *DiskEngine) Scan(fn func(key string, value TypedValue) bool) error {
+	return engine.db.View(func(tx *bolt.Tx) error {
+		return diskScan(tx, fn)
+	})
+}
+
+func diskScan(tx *bolt.Tx, fn func(key string, value TypedValue) bool) error {
+	err := tx.Bucket(diskBucket).ForEach(func(id []byte, data []byte) error {
+		kind, key, payload, err := decodeDiskRecord(bytes.Clone(data))
+		if err != nil {
+			return fmt.Errorf("%x: %w", id, err)
+		}
+		value, err := diskRecordValue(tx, id, kind, payload)
+		if err != nil {
+			return fmt.Errorf("%x: %w", id, err)
+		}
+		if !fn(key, value) {
+			return errStopScan
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStopScan) {
+		return fmt.Errorf("scanning keys: %w", err)
+	}
+	return nil
+}
+
+// Snapshot is a read transaction kept open until the snapshot is closed.
+// bbolt keeps the pages it reads from until then, so the file grows with
+// the writes made meanwhile, and only reuses them afterwards.
+func (engine *DiskEngine) Snapshot() (EngineSnapshot, error) {
+	tx, err := engine.db.Begin(false)
+	if err != nil {
+		return nil, fmt.Errorf("starting snapshot: %w", err)
+	}
+	return diskSnapshot{tx}, nil
+}
+
+type diskSnapshot struct {
+	tx *bolt.Tx
+}
+
+func (snapshot diskSnapshot) Get(key string) (TypedValue, bool, error) {
+	value, ok, err := diskGet(snapshot.tx, key)
+	if err != nil {
+		return TypedValue{}, false, fmt.Errorf("reading key %s: %w", key, err)
+	}
+	return value, ok, nil
+}
+
+func (snapshot diskSnapshot) Scan(fn func(key string, value TypedValue) bool) error {
+	return diskScan(snapshot.tx, fn)
+}
+
+func (snapshot diskSnapshot) Close() error {
+	return snapshot.tx.Rollback()
+}
+
+// Keys reads the key of every record without copying the values.
+func (engine *DiskEngine) Keys() ([]string, error) {
+	var keys []string
+	err := engine.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(diskBucket).ForEach(func(id []byte, data []byte) error {
+			key, err := decodeDiskRecordKey(data)
+			if err != nil {
+				return fmt.Errorf("%x: %w", id, err)
+			}
+			keys = append(keys, key)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing keys: %w", err)
+	}
+	return keys, nil
+}
+
+// KeyCount walks the database's pages without reading any records.
+func (engine *DiskEngine) KeyCount() (int, error) {
+	var count int
+	err := engine.db.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket(diskBucket).Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("counting keys: %w", err)
+	}
+	return count, nil
+}
+
+// SampleKeys seeks to a random record ID for each key. IDs are hashes, so
+// the records are spread evenly over the ID space and this is close to
+// uniform, and it reads only the records it picks.
+func (engine *DiskEngine) SampleKeys(n int) ([]string, error) {
+	var keys []string
+	err := engine.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(diskBucket).Cursor()
+		seek := make([]byte, sha256.Size)
+		for range n {
+			rand.Read(seek)
+			id, data := cursor.Seek(seek)
+			if id == nil {
+				// Past the last record, so wrap around to the first
+				id, data = cursor.First()
+			}
+			if id == nil {
+				return nil
+			}
+			key, err := decodeDiskRecordKey(data)
+			if err != nil {
+				return fmt.Errorf("%x: %w", id, err)
+			}
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("sampling keys: %w", err)
+	}
+	return keys, nil
+}
+
+// SupportsConcurrentReads reports true, since bbolt serves any number of
+// read transactions alongside its single writer.
+func (engine *DiskEngine) SupportsConcurrentReads() bool {
+	return true
+}
+
+func (engine *DiskEngine) Close() error {
+	return engine.db.Close()
+}
+
+func (engine *DiskEngine) ListLen(key string) (int, int, error) {
+	var header diskListHeader
+	err := engine.db.View(func(tx *bolt.Tx) error {
+		var err error
+		header, _, err = diskListRecord(tx, diskRecordID(key), key)
+		return err
+	})
+	if err != nil {
+		return 0, 0, diskListError("reading", key, err)
+	}
+	return header.len(), int(header.size), nil
+}
+
+func (engine *DiskEngine) ListOffset(key string) (uint64, error) {
+	var header diskListHeader
+	err := engine.db.View(func(tx *bolt.Tx) error {
+		var err error
+		header, _, err = diskListRecord(tx, diskRecordID(key), key)
+		return err
+	})
+	if err != nil {
+		return 0, diskListError("reading", key, err)
+	}
+	return header.offset, nil
+}
+
+// ListRange walks a cursor over just the values in the range.
+func (engine *DiskEngine) ListRange(key string, start int64, stop int64) ([]string, bool, error) {
+	values := []string{}
+	var ok bool
+	err := engine.db.View(func(tx *bolt.Tx) error {
+		id := diskRecordID(key)
+		var header diskListHeader
+		var err error
+		header, ok, err = diskListRecord(tx, id, key)
+		if err != nil || !ok {
+			return err
+		}
+		start, stop, nonEmpty := datatype.ClampRange(int64(header.len()), start, stop)
+		if !nonEmpty {
+			return nil
+		}
+		cursor := tx.Bucket(diskListBucket).Bucket(id).Cursor()
+		end := diskItemKey(header.head + stop)
+		for position, value := cursor.Seek(diskItemKey(header.head + start)); position != nil && bytes.Compare(position, end) <= 0; position, value = cursor.Next() {
+			values = append(values, string(value))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, diskListError("reading", key, err)
+	}
+	return values, ok, nil
+}
+
+// PushList and PopList write offset in the list's header, in the same
+// transaction as its values.
+func (engine *DiskEngine) PushList(key string, left bool, values []string, offset uint64) (int, error) {
+	var length int
+	err := engine.db.Update(func(tx *bolt.Tx) error {
+		id := diskRecordID(key)
+		header, _, err := diskListRecord(tx, id, key)
+		if err != nil {
+			return err
+		}
+		header.offset = offset
+		if err := header.push(tx, id, key, left, values); err != nil {
+			return err
+		}
+		length = header.len()
+		return nil
+	})
+	if err != nil {
+		return 0, diskListError("writing", key, err)
+	}
+	return length, nil
+}
+
+func (engine *DiskEngine) PopList(key string, left bool, count int, offset uint64) ([]string, int, error) {
+	var popped []string
+	var length int
+	err := engine.db.Update(func(tx *bolt.Tx) error {
+		id := diskRecordID(key)
+		header, ok, err := diskListRecord(tx, id, key)
+		if err != nil || !ok {
+			return err
+		}
+		items := tx.Bucket(diskListBucket).Bucket(id)
+		for len(popped) < count && header.len() > 0 {
+			position := header.tail - 1
+			if left {
+				position = header.head
+			}
+			item := diskItemKey(position)
+			value := string(items.Get(item))
+			if err := items.Delete(item); err != nil {
+				return err
+			}
+			if left {
+				header.head++
+			} else {
+				header.tail--
+			}
+			header.size -= int64(datatype.EncodedItemLen(value))
+			popped = append(popped, value)
+		}
+		length = header.len()
+		header.offset = offset
+		if length > 0 {
+			return tx.Bucket(diskBucket).Put(id, encodeDiskListRecord(key, header))
+		}
+		return deleteDiskRecord(tx, id)
+	})
+	if err != nil {
+		return nil, 0, diskListError("writing", key, err)
+	}
+	return popped, length, nil
+}
+
+// diskListError says what failed, except for ErrWrongType, which is
+// returned as it is so it keeps the WRONGTYPE code at its start.
+func diskListError(doing string, key string, err error) error {
+	if errors.Is(err, ErrWrongType) {
+		return err
+	}
+	return fmt.Errorf("%s key %s: %w", doing, key, err)
+}
+
+// diskListHeader is the record of a list: the positions of its head and
+// one past its tail, which pushes at the head take below zero, and the sum
+// of datatype.EncodedItemLen over its values, and the offset PushList or
+// PopList last recorded for it.
+type diskListHeader struct {
+	head   int64
+	tail   int64
+	size   int64
+	offset uint64
+}
+
+func (header diskListHeader) len() int {
+	return int(header.tail - header.head)
+}
+
+// push adds values to the list stored for key and writes its header.
+func (header *diskListHeader) push(tx *bolt.Tx, id []byte, key string, left bool, values []string) error {
+	items, err := tx.Bucket(diskListBucket).CreateBucketIfNotExists(id)
+	if err != nil {
+		return err
+	}
+	for _, value := range values {
+		position := header.tail
+		if left {
+			header.head--
+			position = header.head
+		} else {
+			header.tail++
+		}
+		if err := items.Put(diskItemKey(position), []byte(value)); err != nil {
+			return err
+		}
+		header.size += int64(datatype.EncodedItemLen(value))
+	}
+	return tx.Bucket(diskBucket).Put(id, encodeDiskListRecord(key, *header))
+}
+
+func deleteDiskListItems(tx *bolt.Tx, id []byte) error {
+	lists := tx.Bucket(diskListBucket)
+	if lists.Bucket(id) == nil {
+		return nil
+	}
+	return lists.DeleteBucket(id)
+}
+
+// diskItemKey orders positions as signed integers, so a cursor walks a
+// list's values from head to tail.
+func diskItemKey(position int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(position)^(1<<63))
+}
+
+func encodeDiskListRecord(key string, header diskListHeader) []byte {
+	var payload [32]byte
+	binary.BigEndian.PutUint64(payload[0:], uint64(header.head))
+	binary.BigEndian.PutUint64(payload[8:], uint64(header.tail))
+	binary.BigEndian.PutUint64(payload[16:], uint64(header.size))
+	binary.BigEndian.PutUint64(payload[24:], header.offset)
+	return encodeDiskRecordOf(TypeList, key, string(payload[:]))
+}
+
+func decodeDiskListHeader(payload string) (diskListHeader, error) {
+	if len(payload) != 32 {
+		return diskListHeader{}, fmt.Errorf("list record is %d bytes, want 32", len(payload))
+	}
+	data := []byte(payload)
+	return diskListHeader{
+		head:   int64(binary.BigEndian.Uint64(data[0:])),
+		tail:   int64(binary.BigEndian.Uint64(data[8:])),
+		size:   int64(binary.BigEndian.Uint64(data[16:])),
+		offset: binary.BigEndian.Uint64(data[24:]),
+	}, nil
+}
+
+// A record is the key's length, the value's type, the key, and then the
+// value or, for a list, its header.
+const diskRecordHeaderLen = 5
+
+func encodeDiskRecord(key string, value TypedValue) []byte {
+	return encodeDiskRecordOf(value.Type, key, value.Data)
+}
+
+func encodeDiskRecordOf(kind ValueType, key string, payload string) []byte {
+	buf := make([]byte, 4, diskRecordHeaderLen+len(key)+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(len(key)))
+	buf = append(buf, byte(kind))
+	buf = append(buf, key...)
+	return append(buf, payload...)
+}
+
+// decodeDiskRecord splits a record into its type, key and payload. Both
+// strings alias data, which the caller must own and never modify
+// afterwards; this saves copying the value a second time after reading it
+// from bbolt.
+func decodeDiskRecord(data []byte) (ValueType, string, string, error) {
+	if len(data) < diskRecordHeaderLen {
+		return 0, "", "", fmt.Errorf("record too short")
+	}
+	keyEnd := diskRecordHeaderLen + int(binary.BigEndian.Uint32(data))
+	if len(data) < keyEnd {
+		return 0, "", "", fmt.Errorf("record truncated")
+	}
+	record := unsafe.String(&data[0], len(data))
+	return ValueType(data[4]), record[diskRecordHeaderLen:keyEnd], record[keyEnd:], nil
+}
+
+// decodeDiskRecordKey copies just the key out of a record, which may be
+// memory bbolt owns.
+func decodeDiskRecordKey(data []byte) (string, error) {
+	if len(data) < diskRecordHeaderLen {
+		return "", fmt.Errorf("record too short")
+	}
+	keyEnd := diskRecordHeaderLen + int(binary.BigEndian.Uint32(data))
+	if len(data) < keyEnd {
+		return "", fmt.Errorf("record truncated")
+	}
+	return string(data[diskRecordHeaderLen:keyEnd]), nil
+}
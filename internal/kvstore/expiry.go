@@ -0,0 +1,479 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// TTLNoKey is the TTL reported for a key that does not exist.
+	TTLNoKey time.Duration = -2
+	// TTLNoExpiry is the TTL reported for a key that exists but never
+	// expires.
+	TTLNoExpiry time.Duration = -1
+)
+
+// ErrInvalidTTL is returned for a time to live that is not positive.
+var ErrInvalidTTL = errors.New("invalid TTL")
+
+// TTLIn returns n units as a TTL, for callers that take TTLs as a count of
+// seconds or milliseconds. It returns ErrInvalidTTL if n is not positive or
+// the TTL would overflow a time.Duration, rather than wrapping around to a
+// negative TTL.
+func TTLIn(n int64, unit time.Duration) (time.Duration, error) {
+	if n <= 0 {
+		return 0, fmt.Errorf("%w: %d is not positive", ErrInvalidTTL, n)
+	}
+	if n > math.MaxInt64/int64(unit) {
+		return 0, fmt.Errorf("%w: %d×%s is longer than %s", ErrInvalidTTL, n, unit, time.Duration(math.MaxInt64))
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// unixNanos returns at in Unix nanoseconds, or ErrInvalidTTL for a time
+// before 1678 or after 2262, which Unix nanoseconds cannot represent,
+// rather than let it wrap around to some other deadline.
+func unixNanos(at time.Time) (int64, error) {
+	if at.Before(time.Unix(0, math.MinInt64)) || at.After(time.Unix(0, math.MaxInt64)) {
+		return 0, fmt.Errorf("%w: %s is out of range", ErrInvalidTTL, at.UTC().Format(time.RFC3339))
+	}
+	return at.UnixNano(), nil
+}
+
+// expiryTable holds the expiry deadline, in Unix nanoseconds, of every key
+// that has one. It keeps its own lock because DirectExecution reaches it
+// from many goroutines at once; size lets stores without expiring keys skip
+// the lock entirely.
+type expiryTable struct {
+	mu        sync.RWMutex
+	deadlines map[string]int64
+	size      atomic.Int64
+	// removed counts the keys deleted because they expired
+	removed atomic.Uint64
+}
+
+func (table *expiryTable) deadline(key string) (int64, bool) {
+	if table.size.Load() == 0 {
+		return 0, false
+	}
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+
+	deadline, ok := table.deadlines[key]
+	return deadline, ok
+}
+
+func (table *expiryTable) set(key string, deadline int64) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	if table.deadlines == nil {
+		table.deadlines = make(map[string]int64)
+	}
+	if _, ok := table.deadlines[key]; !ok {
+		table.size.Add(1)
+	}
+	table.deadlines[key] = deadline
+}
+
+// clear removes key's deadline and reports whether it had one.
+func (table *expiryTable) clear(key string) bool {
+	if table.size.Load() == 0 {
+		return false
+	}
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	if _, ok := table.deadlines[key]; !ok {
+		return false
+	}
+	delete(table.deadlines, key)
+	table.size.Add(-1)
+	return true
+}
+
+// replace moves key's deadline from previous to next and reports whether
+// it did. It leaves the key alone if its deadline is no longer previous.
+func (table *expiryTable) replace(key string, previous int64, next int64) bool {
+	if table.size.Load() == 0 {
+		return false
+	}
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	if deadline, ok := table.deadlines[key]; !ok || deadline != previous {
+		return false
+	}
+	table.deadlines[key] = next
+	return true
+}
+
+// DeadlineEngine is implemented by engines that keep each key's expiry
+// deadline, in Unix nanoseconds, next to its value, so deadlines survive a
+// restart along with the data. Set leaves a key's deadline as it is, and
+// Delete, or popping the last value of a list, removes it with the key.
+type DeadlineEngine interface {
+	// SetExpiring writes value and its deadline, or no deadline when it is
+	// zero, in one write.
+	SetExpiring(key string, value TypedValue, deadline int64) error
+	// SetDeadline changes the deadline of key, or clears it when deadline
+	// is zero. It does nothing if key does not exist.
+	SetDeadline(key string, deadline int64) error
+	// Deadlines calls fn with every key that has a deadline, until fn
+	// returns false.
+	Deadlines(fn func(key string, deadline int64) bool) error
+}
+
+// loadDeadlines fills the expiry table from an engine that keeps
+// deadlines. Keys whose deadline passed while the store was down are
+// removed the first time they are touched, as usual.
+func (kvStore *KeyValueStore) loadDeadlines() error {
+	engine, ok := kvStore.engine.(DeadlineEngine)
+	if !ok {
+		return nil
+	}
+	return engine.Deadlines(func(key string, deadline int64) bool {
+		kvStore.expiries.set(key, deadline)
+		return true
+	})
+}
+
+// setDeadline, clearDeadline and replaceDeadline change a key's deadline
+// on behalf of commands, in the engine if it keeps deadlines and then in
+// the expiry table, and publish the change to replicas.
+func (kvStore *KeyValueStore) setDeadline(key string, deadline int64) error {
+	defer kvStore.replication.end(kvStore.replication.begin())
+	if err := kvStore.storeDeadline(key, deadline); err != nil {
+		return err
+	}
+	kvStore.noteDeadline(key, deadline)
+	return nil
+}
+
+func (kvStore *KeyValueStore) clearDeadline(key string) (bool, error) {
+	defer kvStore.replication.end(kvStore.replication.begin())
+	if _, ok := kvStore.expiries.deadline(key); !ok {
+		return false, nil
+	}
+	if err := kvStore.storeDeadline(key, 0); err != nil {
+		return false, err
+	}
+	return kvStore.noteDeadline(key, 0), nil
+}
+
+func (kvStore *KeyValueStore) replaceDeadline(key string, previous int64, next int64) (bool, error) {
+	defer kvStore.replication.end(kvStore.replication.begin())
+	if deadline, ok := kvStore.expiries.deadline(key); !ok || deadline != previous {
+		return false, nil
+	}
+	if err := kvStore.storeDeadline(key, next); err != nil {
+		return false, err
+	}
+	if !kvStore.expiries.replace(key, previous, next) {
+		return false, nil
+	}
+	kvStore.replication.publish(Mutation{Type: MutationExpire, Key: key, Deadline: next})
+	return true, nil
+}
+
+// forgetDeadline drops the deadline of a key just deleted, which the
+// engine removed along with it, and reports whether it had one.
+func (kvStore *KeyValueStore) forgetDeadline(key string) bool {
+	defer kvStore.replication.end(kvStore.replication.begin())
+	return kvStore.noteDeadline(key, 0)
+}
+
+func (kvStore *KeyValueStore) storeDeadline(key string, deadline int64) error {
+	if engine, ok := kvStore.engine.(DeadlineEngine); ok {
+		return engine.SetDeadline(key, deadline)
+	}
+	return nil
+}
+
+// noteDeadline sets key's deadline in the expiry table, or clears it when
+// deadline is zero, and publishes the change. It reports whether the table
+// changed.
+func (kvStore *KeyValueStore) noteDeadline(key string, deadline int64) bool {
+	if deadline == 0 {
+		if !kvStore.expiries.clear(key) {
+			return false
+		}
+		kvStore.replication.publish(Mutation{Type: MutationPersist, Key: key})
+		return true
+	}
+	kvStore.expiries.set(key, deadline)
+	kvStore.replication.publish(Mutation{Type: MutationExpire, Key: key, Deadline: deadline})
+	return true
+}
+
+// pastDeadline reports whether key has an expiry that has already passed.
+func (kvStore *KeyValueStore) pastDeadline(key string) bool {
+	deadline, ok := kvStore.expiries.deadline(key)
+	return ok && kvStore.currentTime().UnixNano() >= deadline
+}
+
+// expired reports whether the command's key has passed its deadline, and
+// removes it if so. Commands executed outside the store loop only hide the
+// key: removing it there could race with a concurrent write to the same key,
+// so it stays in the engine until a store loop command touches it.
+func (kvStore *KeyValueStore) expired(command KeyValueCommand) bool {
+	return kvStore.keyExpired(command.key, command.concurrent)
+}
+
+func (kvStore *KeyValueStore) keyExpired(key string, concurrent bool) bool {
+	if !kvStore.pastDeadline(key) {
+		return false
+	}
+	if !concurrent {
+		// On error the key stays expired and removal is retried next time
+		if _, _, err := kvStore.deleteValue(key); err == nil && kvStore.forgetDeadline(key) {
+			kvStore.forget(key)
+			kvStore.expiries.removed.Add(1)
+			kvStore.notifications.publish(EventExpired, key, kvStore.currentTime)
+		}
+	}
+	return true
+}
+
+func (kvStore *KeyValueStore) ProcessExpireAtCommand(command KeyValueCommand) KeyValueOutput {
+	key := command.key
+	if kvStore.expired(command) {
+		return KeyValueOutput{true, nil, nil, 0}
+	}
+	value, ok, err := kvStore.engine.Get(key)
+	if err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	if !ok {
+		return KeyValueOutput{true, nil, nil, 0}
+	}
+
+	now := kvStore.currentTime()
+	deadline, err := kvStore.jittered(command, now)
+	if err == nil {
+		deadline, err = kvStore.policyDeadline(key, deadline, now)
+	}
+	if err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	if deadline > now.UnixNano() {
+		if err := kvStore.setDeadline(key, deadline); err != nil {
+			return KeyValueOutput{false, nil, err, 0}
+		}
+		return KeyValueOutput{true, stringPointer(value.Data), nil, 0}
+	}
+
+	// A deadline that has already passed deletes the key straight away
+	if _, _, err := kvStore.deleteValue(key); err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	kvStore.forgetDeadline(key)
+	kvStore.forget(key)
+	return KeyValueOutput{true, stringPointer(value.Data), nil, 0}
+}
+
+// jittered returns the command's deadline pushed back by a random amount up
+// to its jitter fraction of the time remaining until it. Jitter only ever
+// delays expiry, so a key always lives at least until the requested time.
+// A deadline out of range fails with ErrInvalidTTL.
+func (kvStore *KeyValueStore) jittered(command KeyValueCommand, now time.Time) (int64, error) {
+	deadline, err := unixNanos(command.expireAt)
+	if err != nil {
+		return 0, err
+	}
+	jitter := command.jitter
+	if jitter == 0 {
+		jitter = kvStore.ttlJitter
+	}
+	spread := min(int64(jitter*float64(deadline-now.UnixNano())), math.MaxInt64-deadline)
+	if spread <= 0 {
+		return deadline, nil
+	}
+	if kvStore.random != nil {
+		return deadline + kvStore.random.Int64N(spread+1), nil
+	}
+	return deadline + rand.Int64N(spread+1), nil
+}
+
+func (kvStore *KeyValueStore) ProcessPersistCommand(command KeyValueCommand) KeyValueOutput {
+	key := command.key
+	if kvStore.expired(command) {
+		return KeyValueOutput{true, nil, nil, 0}
+	}
+	value, ok, err := kvStore.engine.Get(key)
+	if err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	if _, expires := kvStore.expiries.deadline(key); ok && expires {
+		if err := kvStore.checkPersist(key); err != nil {
+			return KeyValueOutput{false, nil, err, 0}
+		}
+	}
+	if !ok {
+		return KeyValueOutput{true, nil, nil, 0}
+	}
+	cleared, err := kvStore.clearDeadline(key)
+	if err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	if !cleared {
+		return KeyValueOutput{true, nil, nil, 0}
+	}
+	return KeyValueOutput{true, stringPointer(value.Data), nil, 0}
+}
+
+// ProcessTTLCommand replies with the key's remaining time to live in
+// nanoseconds, or one of the TTLNoKey and TTLNoExpiry sentinels.
+func (kvStore *KeyValueStore) ProcessTTLCommand(command KeyValueCommand) KeyValueOutput {
+	key := command.key
+	if kvStore.expired(command) {
+		return KeyValueOutput{true, nil, nil, int64(TTLNoKey)}
+	}
+	_, ok, err := kvStore.engine.Get(key)
+	if err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	if !ok {
+		return KeyValueOutput{true, nil, nil, int64(TTLNoKey)}
+	}
+
+	deadline, ok := kvStore.expiries.deadline(key)
+	if !ok {
+		return KeyValueOutput{true, nil, nil, int64(TTLNoExpiry)}
+	}
+	remaining := deadline - kvStore.currentTime().UnixNano()
+	if remaining <= 0 {
+		// The deadline passed since the expired check above
+		return KeyValueOutput{true, nil, nil, int64(TTLNoKey)}
+	}
+	return KeyValueOutput{true, nil, nil, remaining}
+}
+
+// ExpireAt sets an absolute expiry time on key and reports whether the key
+// exists. A time that has already passed deletes the key immediately, and
+// one Unix nanoseconds cannot represent fails with ErrInvalidTTL. Expired
+// keys are removed lazily, when a command next touches them. Deadlines
+// survive a restart only with an engine that keeps them, like DiskEngine,
+// and are otherwise kept in memory. With Config.TTLJitter set, the key may live somewhat past at.
+func (kvService *KeyValueService) ExpireAt(key string, at time.Time) (bool, error) {
+	return kvService.ExpireAtContext(context.Background(), key, at)
+}
+
+// ExpireAtContext is ExpireAt with ctx's deadline, as SetContext is Set.
+func (kvService *KeyValueService) ExpireAtContext(ctx context.Context, key string, at time.Time) (bool, error) {
+	if _, err := unixNanos(at); err != nil {
+		return false, err
+	}
+	if err := kvService.CheckWritable(); err != nil {
+		return false, err
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return false, err
+	}
+	res := kvService.dispatch(withDeadline(ctx, KeyValueCommand{commandType: EXPIREAT, key: key, expireAt: at}))
+
+	return res.value != nil, res.err
+}
+
+// ExpireAtWithJitter is ExpireAt with its own jitter instead of the
+// configured TTLJitter: the deadline is pushed back by a random amount up to
+// jitter times the time remaining until at. Use it when setting the same
+// deadline on many keys at once, so they do not all expire together. Zero
+// uses the configured TTLJitter and a negative jitter disables it.
+func (kvService *KeyValueService) ExpireAtWithJitter(key string, at time.Time, jitter float64) (bool, error) {
+	return kvService.ExpireAtWithJitterContext(context.Background(), key, at, jitter)
+}
+
+// ExpireAtWithJitterContext is ExpireAtWithJitter with ctx's deadline, as
+// SetContext is Set.
+func (kvService *KeyValueService) ExpireAtWithJitterContext(ctx context.Context, key string, at time.Time, jitter float64) (bool, error) {
+	if _, err := unixNanos(at); err != nil {
+		return false, err
+	}
+	if err := kvService.CheckWritable(); err != nil {
+		return false, err
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return false, err
+	}
+	res := kvService.dispatch(withDeadline(ctx, KeyValueCommand{commandType: EXPIREAT, key: key, expireAt: at, jitter: jitter}))
+
+	return res.value != nil, res.err
+}
+
+// Expire sets key to expire ttl from now and reports whether the key
+// exists, as ExpireAt does. A ttl that is not positive deletes the key
+// immediately.
+func (kvService *KeyValueService) Expire(key string, ttl time.Duration) (bool, error) {
+	return kvService.ExpireAt(key, kvService.store.currentTime().Add(ttl))
+}
+
+// SetWithTTL sets key to value and has it expire ttl from now, in one
+// command, so the key is never seen without its expiry. The TTL is subject
+// to Config.TTLPolicies and Config.TTLJitter as ExpireAt's deadline is.
+func (kvService *KeyValueService) SetWithTTL(key string, value string, ttl time.Duration) (*string, error) {
+	return kvService.SetWithTTLContext(context.Background(), key, value, ttl)
+}
+
+// SetWithTTLContext is SetWithTTL with ctx's deadline, as SetContext is
+// Set.
+func (kvService *KeyValueService) SetWithTTLContext(ctx context.Context, key string, value string, ttl time.Duration) (*string, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("%w: %s is not positive", ErrInvalidTTL, ttl)
+	}
+	if err := kvService.CheckWritable(); err != nil {
+		return nil, err
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return nil, err
+	}
+	res := kvService.dispatch(withDeadline(ctx, KeyValueCommand{commandType: PUT, key: key, value: &value, ttl: ttl}))
+
+	return res.value, res.err
+}
+
+// Persist removes key's expiry and reports whether it had one.
+func (kvService *KeyValueService) Persist(key string) (bool, error) {
+	return kvService.PersistContext(context.Background(), key)
+}
+
+// PersistContext is Persist with ctx's deadline, as SetContext is Set.
+func (kvService *KeyValueService) PersistContext(ctx context.Context, key string) (bool, error) {
+	if err := kvService.CheckWritable(); err != nil {
+		return false, err
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return false, err
+	}
+	res := kvService.dispatch(withDeadline(ctx, KeyValueCommand{commandType: PERSIST, key: key}))
+
+	return res.value != nil, res.err
+}
+
+// TTL returns how long key has left to live. It returns TTLNoKey when the
+// key does not exist and TTLNoExpiry when the key exists but never expires.
+func (kvService *KeyValueService) TTL(key string) (time.Duration, error) {
+	return kvService.TTLContext(context.Background(), key)
+}
+
+// TTLContext is TTL with ctx's deadline, as GetContext is Get.
+func (kvService *KeyValueService) TTLContext(ctx context.Context, key string) (time.Duration, error) {
+	if err := kvService.CheckActive(); err != nil {
+		return 0, err
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return 0, err
+	}
+	res := kvService.dispatchRead(withDeadline(ctx, KeyValueCommand{commandType: TTL, key: key}))
+	if res.err != nil {
+		return 0, res.err
+	}
+
+	return time.Duration(res.integer), nil
+}
@@ -0,0 +1,191 @@
+package kvstore
+
+import (
+	"maps"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultExpirySampleSize is how many keys with an expiry a sweep round
+	// samples when ExpirySweep.SampleSize is zero.
+	DefaultExpirySampleSize = 20
+	// DefaultExpiryBudget is the fraction of each interval a sweep may
+	// spend when ExpirySweep.Budget is zero.
+	DefaultExpiryBudget = 0.25
+	// expirySweepRepeat is the fraction of a round's sample that must have
+	// expired for the sweep to go straight on to another round, as there
+	// are probably many more expired keys
+	expirySweepRepeat = 0.25
+)
+
+// ExpirySweep configures the active expiry sweeper. Without it, expired
+// keys are only removed when a command next touches them, so keys that are
+// never read again hold on to their memory. Every Interval the sweeper
+// samples SampleSize keys with an expiry and removes those that have
+// expired, repeating while more than a quarter of a sample had expired and
+// it has spent less than Budget of the interval, like Redis's active
+// expiry. Rounds run on the store loop, so a larger Budget removes expired
+// keys faster at the cost of holding up commands for longer.
+//
+// The sweeper only runs under ActorExecution, and in a Simulation: under
+// DirectExecution a removal could race with a write to the same key.
+type ExpirySweep struct {
+	// Interval is how often a sweep runs. Zero disables the sweeper
+	Interval time.Duration
+	// SampleSize is how many keys each round samples, or
+	// DefaultExpirySampleSize if zero
+	SampleSize int
+	// Budget is the fraction of Interval a sweep may take, or
+	// DefaultExpiryBudget if zero
+	Budget float64
+}
+
+func (sweep ExpirySweep) withDefaults() ExpirySweep {
+	if sweep.SampleSize <= 0 {
+		sweep.SampleSize = DefaultExpirySampleSize
+	}
+	if sweep.Budget <= 0 {
+		sweep.Budget = DefaultExpiryBudget
+	}
+	sweep.Budget = min(sweep.Budget, 1)
+	return sweep
+}
+
+// ExpirySweepStats is what the active expiry sweeper has done.
+type ExpirySweepStats struct {
+	// Sweeps counts the sweeps run, Rounds the rounds they took and
+	// Removed the expired keys they removed
+	Sweeps  uint64
+	Rounds  uint64
+	Removed uint64
+	// Duration is the time spent sweeping in total, and LastDuration that
+	// of the last sweep
+	Duration     time.Duration
+	LastDuration time.Duration
+	// Backlog estimates the expired keys not removed yet, from the share of
+	// the last round's sample that had expired
+	Backlog int
+}
+
+type sweepState struct {
+	config atomic.Pointer[ExpirySweep]
+	// changed wakes the store loop to pick up a new config
+	changed chan struct{}
+
+	sweeps       atomic.Uint64
+	rounds       atomic.Uint64
+	removed      atomic.Uint64
+	duration     atomic.Int64
+	lastDuration atomic.Int64
+	// expiredShare is the math.Float64bits of the share of the last
+	// round's sample that had expired
+	expiredShare atomic.Uint64
+}
+
+// sample returns up to n keys with an expiry, and those of them whose
+// deadline is at or before now. Go randomises where each walk of a map
+// starts, which makes the first n keys a cheap sample. With random set the
+// sample is drawn from it instead, so a Simulation sweeps the same keys
+// every run.
+func (table *expiryTable) sample(n int, now int64, random *rand.Rand) (sampled int, expired []string) {
+	if table.size.Load() == 0 {
+		return 0, nil
+	}
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+
+	if random != nil {
+		keys := slices.Sorted(maps.Keys(table.deadlines))
+		random.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+		for _, key := range keys[:min(n, len(keys))] {
+			sampled++
+			if now >= table.deadlines[key] {
+				expired = append(expired, key)
+			}
+		}
+		return sampled, expired
+	}
+	for key, deadline := range table.deadlines {
+		if sampled == n {
+			break
+		}
+		sampled++
+		if now >= deadline {
+			expired = append(expired, key)
+		}
+	}
+	return sampled, expired
+}
+
+// sweepExpired runs one sweep, on the store loop.
+func (kvStore *KeyValueStore) sweepExpired(sweep ExpirySweep) {
+	start := kvStore.stopwatch()
+	budget := time.Duration(float64(sweep.Interval) * sweep.Budget)
+	for {
+		kvStore.lock.Lock()
+		sampled, expired := kvStore.expiries.sample(sweep.SampleSize, kvStore.currentTime().UnixNano(), kvStore.random)
+		before := kvStore.expiries.removed.Load()
+		for _, key := range expired {
+			kvStore.keyExpired(key, false)
+		}
+		kvStore.sweep.removed.Add(kvStore.expiries.removed.Load() - before)
+		kvStore.lock.Unlock()
+
+		kvStore.sweep.rounds.Add(1)
+		share := 0.0
+		if sampled > 0 {
+			share = float64(len(expired)) / float64(sampled)
+		}
+		kvStore.sweep.expiredShare.Store(math.Float64bits(share))
+		if share <= expirySweepRepeat || kvStore.stopwatch().Sub(start) >= budget {
+			break
+		}
+	}
+	took := kvStore.stopwatch().Sub(start)
+	kvStore.sweep.sweeps.Add(1)
+	kvStore.sweep.duration.Add(int64(took))
+	kvStore.sweep.lastDuration.Store(int64(took))
+}
+
+// sweepTicker returns a ticker for the configured sweep, or nil and a nil
+// channel when the sweeper is off.
+func (kvStore *KeyValueStore) sweepTicker() (*time.Ticker, <-chan time.Time) {
+	sweep := kvStore.sweep.config.Load()
+	if sweep == nil || sweep.Interval <= 0 {
+		return nil, nil
+	}
+	ticker := time.NewTicker(sweep.Interval)
+	return ticker, ticker.C
+}
+
+// SetExpirySweep reconfigures the active expiry sweeper, taking effect from
+// its next sweep. It has no effect under DirectExecution.
+func (kvService *KeyValueService) SetExpirySweep(sweep ExpirySweep) {
+	if kvService.execution == DirectExecution {
+		return
+	}
+	sweep = sweep.withDefaults()
+	kvService.store.sweep.config.Store(&sweep)
+	select {
+	case kvService.store.sweep.changed <- struct{}{}:
+	default:
+	}
+}
+
+// ExpirySweepStats returns what the active expiry sweeper has done.
+func (kvService *KeyValueService) ExpirySweepStats() ExpirySweepStats {
+	sweep := &kvService.store.sweep
+	share := math.Float64frombits(sweep.expiredShare.Load())
+	return ExpirySweepStats{
+		Sweeps:       sweep.sweeps.Load(),
+		Rounds:       sweep.rounds.Load(),
+		Removed:      sweep.removed.Load(),
+		Duration:     time.Duration(sweep.duration.Load()),
+		LastDuration: time.Duration(sweep.lastDuration.Load()),
+		Backlog:      int(math.Round(share * float64(kvService.store.expiries.size.Load()))),
+	}
+}
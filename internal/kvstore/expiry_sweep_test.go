@@ -0,0 +1,92 @@
+package kvstore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newSweptService(t *testing.T, sweep ExpirySweep) (*KeyValueService, *testClock) {
+	t.Helper()
+	clock := &testClock{}
+	clock.nanos.Store(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano())
+	return newTestKeyValueServiceWithConfig(t, Config{Clock: clock.Now, ExpirySweep: sweep}), clock
+}
+
+func waitForSweep(t *testing.T, store *KeyValueService, removed uint64) ExpirySweepStats {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := store.ExpirySweepStats()
+		if stats.Removed >= removed {
+			return stats
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("sweeper removed %d keys, want %d", stats.Removed, removed)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestExpirySweep_RemovesKeysNeverRead(t *testing.T) {
+	store, clock := newSweptService(t, ExpirySweep{Interval: time.Millisecond})
+	for i := range 100 {
+		key := fmt.Sprintf("key-%d", i)
+		if _, err := store.Set(key, "value"); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+		if _, err := store.ExpireAt(key, clock.Now().Add(time.Minute)); err != nil {
+			t.Fatalf("ExpireAt returned error: %v", err)
+		}
+	}
+	if _, err := store.Set("kept", "value"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := store.ExpireAt("kept", clock.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("ExpireAt returned error: %v", err)
+	}
+
+	clock.Advance(time.Minute)
+	sweep := waitForSweep(t, store, 100)
+	if sweep.Removed != 100 || sweep.Sweeps == 0 || sweep.Rounds < sweep.Sweeps {
+		t.Fatalf("sweep stats = %+v, want 100 removed", sweep)
+	}
+	stats, err := store.Stats()
+	if err != nil {
+		t.Fatalf("Stats returned error: %v", err)
+	}
+	if stats.Keys != 1 || stats.ExpiringKeys != 1 || stats.ExpiredKeys != 100 {
+		t.Fatalf("Stats = %d keys, %d expiring, %d expired, want 1, 1 and 100", stats.Keys, stats.ExpiringKeys, stats.ExpiredKeys)
+	}
+	if got, err := store.Get("kept"); err != nil || deref(got) != "value" {
+		t.Fatalf("Get(kept) = (%q, %v), want (\"value\", nil)", deref(got), err)
+	}
+}
+
+func TestExpirySweep_OffByDefault(t *testing.T) {
+	store, clock := newSweptService(t, ExpirySweep{})
+	if _, err := store.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := store.ExpireAt("foo", clock.Now().Add(time.Second)); err != nil {
+		t.Fatalf("ExpireAt returned error: %v", err)
+	}
+	clock.Advance(time.Second)
+	time.Sleep(10 * time.Millisecond)
+	if _, ok, _ := store.store.engine.Get("foo"); !ok {
+		t.Fatalf("expired key removed with the sweeper off")
+	}
+
+	store.SetExpirySweep(ExpirySweep{Interval: time.Millisecond})
+	waitForSweep(t, store, 1)
+	if _, ok, _ := store.store.engine.Get("foo"); ok {
+		t.Fatalf("expired key still in the engine after the sweeper was turned on")
+	}
+}
+
+func TestExpirySweepWithDefaults(t *testing.T) {
+	sweep := ExpirySweep{Interval: time.Second, Budget: 2}.withDefaults()
+	if sweep.SampleSize != DefaultExpirySampleSize || sweep.Budget != 1 {
+		t.Fatalf("withDefaults = %+v, want sample size %d and budget 1", sweep, DefaultExpirySampleSize)
+	}
+}
@@ -0,0 +1,484 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testClock is a manually advanced clock for the store's expiry checks.
+type testClock struct {
+	nanos atomic.Int64
+}
+
+func newTestClock(store *KeyValueService) *testClock {
+	clock := &testClock{}
+	clock.nanos.Store(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano())
+	store.store.now = clock.Now
+	return clock
+}
+
+func (clock *testClock) Now() time.Time {
+	return time.Unix(0, clock.nanos.Load())
+}
+
+func (clock *testClock) Advance(d time.Duration) {
+	clock.nanos.Add(int64(d))
+}
+
+func TestExpireAt_KeyExpiresAtDeadline(t *testing.T) {
+	store := newTestKeyValueService(t)
+	clock := newTestClock(store)
+
+	if _, err := store.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	ok, err := store.ExpireAt("foo", clock.Now().Add(time.Minute))
+	if err != nil || !ok {
+		t.Fatalf("ExpireAt = (%t, %v), want (true, nil)", ok, err)
+	}
+
+	clock.Advance(59 * time.Second)
+	if got, err := store.Get("foo"); err != nil || deref(got) != "bar" {
+		t.Fatalf("Get before deadline = (%q, %v), want (\"bar\", nil)", deref(got), err)
+	}
+
+	clock.Advance(time.Second)
+	if _, err := store.Get("foo"); err == nil {
+		t.Fatalf("Get after deadline succeeded, want error")
+	}
+	if got, err := store.Delete("foo"); err != nil || got != nil {
+		t.Fatalf("Delete of expired key = (%v, %v), want (nil, nil)", got, err)
+	}
+}
+
+func TestExpireAt_PastDeadlineDeletesKey(t *testing.T) {
+	store := newTestKeyValueService(t)
+	clock := newTestClock(store)
+
+	if _, err := store.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	ok, err := store.ExpireAt("foo", clock.Now().Add(-time.Second))
+	if err != nil || !ok {
+		t.Fatalf("ExpireAt = (%t, %v), want (true, nil)", ok, err)
+	}
+	if _, ok, _ := store.store.engine.Get("foo"); ok {
+		t.Fatalf("key still in the engine after ExpireAt in the past")
+	}
+}
+
+func TestExpireAt_RejectsTimesOutOfRange(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	if _, err := store.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	// Past 2262, where Unix nanoseconds used to wrap around to a deadline
+	// decades away
+	far := time.Unix(1e12, 0)
+	if _, err := store.ExpireAt("foo", far); !errors.Is(err, ErrInvalidTTL) {
+		t.Fatalf("ExpireAt(%v) returned %v, want ErrInvalidTTL", far, err)
+	}
+	if _, err := store.ExpireAtWithJitter("foo", far, 0.5); !errors.Is(err, ErrInvalidTTL) {
+		t.Fatalf("ExpireAtWithJitter(%v) returned %v, want ErrInvalidTTL", far, err)
+	}
+	if _, err := store.ExpireAt("foo", time.Unix(-1e12, 0)); !errors.Is(err, ErrInvalidTTL) {
+		t.Fatalf("ExpireAt before 1678 returned %v, want ErrInvalidTTL", err)
+	}
+	if _, err := store.Expire("foo", time.Duration(math.MaxInt64)); !errors.Is(err, ErrInvalidTTL) {
+		t.Fatalf("Expire with a TTL ending after 2262 returned %v, want ErrInvalidTTL", err)
+	}
+	if _, err := store.SetWithTTL("foo", "baz", time.Duration(math.MaxInt64)); !errors.Is(err, ErrInvalidTTL) {
+		t.Fatalf("SetWithTTL with a TTL ending after 2262 returned %v, want ErrInvalidTTL", err)
+	}
+	if ttl, err := store.TTL("foo"); err != nil || ttl != TTLNoExpiry {
+		t.Fatalf("TTL = (%v, %v), want the key left without an expiry", ttl, err)
+	}
+	if got, err := store.Get("foo"); err != nil || deref(got) != "bar" {
+		t.Fatalf("Get = (%q, %v), want the key left as it was", deref(got), err)
+	}
+
+	// The latest time that fits still works
+	if ok, err := store.ExpireAt("foo", time.Unix(0, math.MaxInt64)); err != nil || !ok {
+		t.Fatalf("ExpireAt of the latest representable time = (%t, %v), want (true, nil)", ok, err)
+	}
+}
+
+func TestExpireAt_MissingKey(t *testing.T) {
+	store := newTestKeyValueService(t)
+	clock := newTestClock(store)
+
+	ok, err := store.ExpireAt("missing", clock.Now().Add(time.Minute))
+	if err != nil || ok {
+		t.Fatalf("ExpireAt on missing key = (%t, %v), want (false, nil)", ok, err)
+	}
+}
+
+func TestPersist_RemovesExpiry(t *testing.T) {
+	store := newTestKeyValueService(t)
+	clock := newTestClock(store)
+
+	if _, err := store.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if ok, err := store.Persist("foo"); err != nil || ok {
+		t.Fatalf("Persist without expiry = (%t, %v), want (false, nil)", ok, err)
+	}
+	if _, err := store.ExpireAt("foo", clock.Now().Add(time.Second)); err != nil {
+		t.Fatalf("ExpireAt returned error: %v", err)
+	}
+	if ok, err := store.Persist("foo"); err != nil || !ok {
+		t.Fatalf("Persist = (%t, %v), want (true, nil)", ok, err)
+	}
+
+	clock.Advance(time.Hour)
+	if got, err := store.Get("foo"); err != nil || deref(got) != "bar" {
+		t.Fatalf("Get after Persist = (%q, %v), want (\"bar\", nil)", deref(got), err)
+	}
+}
+
+func TestSet_ClearsExpiry(t *testing.T) {
+	store := newTestKeyValueService(t)
+	clock := newTestClock(store)
+
+	if _, err := store.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := store.ExpireAt("foo", clock.Now().Add(time.Second)); err != nil {
+		t.Fatalf("ExpireAt returned error: %v", err)
+	}
+	if _, err := store.Set("foo", "baz"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+
+	clock.Advance(time.Hour)
+	if got, err := store.Get("foo"); err != nil || deref(got) != "baz" {
+		t.Fatalf("Get after overwrite = (%q, %v), want (\"baz\", nil)", deref(got), err)
+	}
+}
+
+func TestSetWithTTL_SetsValueAndExpiryTogether(t *testing.T) {
+	store := newTestKeyValueService(t)
+	clock := newTestClock(store)
+
+	var seen []Command
+	store.AddAfterCommandHook(func(command Command, result Result) {
+		seen = append(seen, command)
+	})
+	if _, err := store.SetWithTTL("foo", "bar", time.Minute); err != nil {
+		t.Fatalf("SetWithTTL returned error: %v", err)
+	}
+	if ttl, err := store.TTL("foo"); err != nil || ttl != time.Minute {
+		t.Fatalf("TTL = (%v, %v), want (1m0s, nil)", ttl, err)
+	}
+	if len(seen) == 0 || seen[0].Type != PUT || seen[0].TTL != time.Minute {
+		t.Fatalf("hooks saw %+v, want a PUT with its TTL", seen)
+	}
+
+	clock.Advance(time.Minute)
+	if _, err := store.Get("foo"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Get after TTL = %v, want ErrKeyNotFound", err)
+	}
+
+	// A plain Set afterwards leaves the key without an expiry
+	if _, err := store.SetWithTTL("foo", "bar", time.Minute); err != nil {
+		t.Fatalf("SetWithTTL returned error: %v", err)
+	}
+	if _, err := store.Set("foo", "baz"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if ttl, err := store.TTL("foo"); err != nil || ttl != TTLNoExpiry {
+		t.Fatalf("TTL after Set = (%v, %v), want TTLNoExpiry", ttl, err)
+	}
+
+	for _, ttl := range []time.Duration{0, -time.Second} {
+		if _, err := store.SetWithTTL("foo", "bar", ttl); !errors.Is(err, ErrInvalidTTL) {
+			t.Fatalf("SetWithTTL with TTL %v = %v, want ErrInvalidTTL", ttl, err)
+		}
+	}
+}
+
+func TestExpiry_SurvivesReopeningADiskEngine(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	open := func() *KeyValueService {
+		engine, err := NewDiskEngine(dir)
+		if err != nil {
+			t.Fatalf("NewDiskEngine returned error: %v", err)
+		}
+		return NewKeyValueService(context.Background(), WithEngine(engine), WithClock(clock))
+	}
+
+	first := open()
+	if _, err := first.SetWithTTL("session", "alice", time.Minute); err != nil {
+		t.Fatalf("SetWithTTL returned error: %v", err)
+	}
+	if _, err := first.Set("lasting", "value"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := first.Set("persisted", "value"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := first.ExpireAt("persisted", now.Add(time.Minute)); err != nil {
+		t.Fatalf("ExpireAt returned error: %v", err)
+	}
+	if _, err := first.Persist("persisted"); err != nil {
+		t.Fatalf("Persist returned error: %v", err)
+	}
+	first.Close()
+
+	second := open()
+	defer second.Close()
+	for key, want := range map[string]time.Duration{"session": time.Minute, "lasting": TTLNoExpiry, "persisted": TTLNoExpiry} {
+		if ttl, err := second.TTL(key); err != nil || ttl != want {
+			t.Fatalf("TTL(%q) after reopen = (%v, %v), want (%v, nil)", key, ttl, err, want)
+		}
+	}
+
+	now = now.Add(time.Minute)
+	if _, err := second.Get("session"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Get after TTL = %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestTTLIn_RejectsTTLsThatOverflow(t *testing.T) {
+	if ttl, err := TTLIn(90, time.Second); err != nil || ttl != 90*time.Second {
+		t.Fatalf("TTLIn(90, s) = (%v, %v), want 1m30s", ttl, err)
+	}
+	if ttl, err := TTLIn(math.MaxInt64/int64(time.Millisecond), time.Millisecond); err != nil || ttl <= 0 {
+		t.Fatalf("TTLIn of the longest TTL in ms = (%v, %v), want it accepted", ttl, err)
+	}
+
+	tests := []struct {
+		n    int64
+		unit time.Duration
+	}{
+		{0, time.Second},
+		{-1, time.Millisecond},
+		{9999999999999, time.Second},
+		{math.MaxInt64/int64(time.Millisecond) + 1, time.Millisecond},
+		{math.MaxInt64, time.Millisecond},
+	}
+	for _, test := range tests {
+		if ttl, err := TTLIn(test.n, test.unit); !errors.Is(err, ErrInvalidTTL) {
+			t.Errorf("TTLIn(%d, %s) = (%v, %v), want ErrInvalidTTL", test.n, test.unit, ttl, err)
+		}
+	}
+}
+
+func TestExpire_IsRelativeToNow(t *testing.T) {
+	store := newTestKeyValueService(t)
+	clock := newTestClock(store)
+
+	if ok, err := store.Expire("foo", time.Minute); err != nil || ok {
+		t.Fatalf("Expire of missing key = (%t, %v), want (false, nil)", ok, err)
+	}
+	if _, err := store.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	clock.Advance(time.Hour)
+	if ok, err := store.Expire("foo", time.Minute); err != nil || !ok {
+		t.Fatalf("Expire = (%t, %v), want (true, nil)", ok, err)
+	}
+	if ttl, err := store.TTL("foo"); err != nil || ttl != time.Minute {
+		t.Fatalf("TTL = (%v, %v), want (1m0s, nil)", ttl, err)
+	}
+	if ok, err := store.Expire("foo", 0); err != nil || !ok {
+		t.Fatalf("Expire with no TTL = (%t, %v), want (true, nil)", ok, err)
+	}
+	if _, err := store.Get("foo"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Get after Expire with no TTL = %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestExpiry_ConcurrentReadsHideButDoNotRemove(t *testing.T) {
+	store := newTestKeyValueServiceWithConfig(t, Config{ConcurrentReads: true})
+	clock := newTestClock(store)
+
+	if _, err := store.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := store.ExpireAt("foo", clock.Now().Add(time.Second)); err != nil {
+		t.Fatalf("ExpireAt returned error: %v", err)
+	}
+	clock.Advance(time.Second)
+
+	if _, err := store.Get("foo"); err == nil {
+		t.Fatalf("fast-path Get of expired key succeeded, want error")
+	}
+	if _, ok, _ := store.store.engine.Get("foo"); !ok {
+		t.Fatalf("fast-path Get removed the key from the engine")
+	}
+
+	// The next store loop command on the key removes it
+	if ok, err := store.Persist("foo"); err != nil || ok {
+		t.Fatalf("Persist on expired key = (%t, %v), want (false, nil)", ok, err)
+	}
+	if _, ok, _ := store.store.engine.Get("foo"); ok {
+		t.Fatalf("expired key still in the engine after a store loop command")
+	}
+}
+
+func TestExpiry_DirectExecution(t *testing.T) {
+	store := newTestKeyValueServiceWithConfig(t, Config{Execution: DirectExecution})
+	clock := newTestClock(store)
+
+	if _, err := store.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := store.ExpireAt("foo", clock.Now().Add(time.Second)); err != nil {
+		t.Fatalf("ExpireAt returned error: %v", err)
+	}
+	clock.Advance(time.Second)
+
+	if _, err := store.Get("foo"); err == nil {
+		t.Fatalf("Get of expired key succeeded, want error")
+	}
+}
+
+func TestExpiry_SendBatch(t *testing.T) {
+	store := newTestKeyValueService(t)
+	clock := newTestClock(store)
+
+	value := "bar"
+	results := store.SendBatch([]Command{
+		{Type: PUT, Key: "foo", Value: &value},
+		{Type: EXPIREAT, Key: "foo", ExpireAt: clock.Now().Add(time.Second)},
+		{Type: TTL, Key: "foo"},
+		{Type: PERSIST, Key: "foo"},
+	})
+	for i, result := range results {
+		if !result.Success {
+			t.Fatalf("result %d = %+v, want success", i, result)
+		}
+	}
+	if results[1].Value == nil || results[3].Value == nil {
+		t.Fatalf("EXPIREAT and PERSIST results = %+v, %+v, want values", results[1], results[3])
+	}
+	if results[2].Integer != int64(time.Second) {
+		t.Fatalf("TTL result = %d, want %d", results[2].Integer, int64(time.Second))
+	}
+}
+
+func TestExpiry_ReadOnlyRejectsExpiryChanges(t *testing.T) {
+	store := newTestKeyValueService(t)
+	store.SetReadOnly(true)
+
+	if _, err := store.ExpireAt("foo", time.Now()); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("ExpireAt in read-only mode returned %v, want ErrReadOnly", err)
+	}
+	if _, err := store.Persist("foo"); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Persist in read-only mode returned %v, want ErrReadOnly", err)
+	}
+}
+
+func TestTTL_DistinguishesMissingKeyAndNoExpiry(t *testing.T) {
+	store := newTestKeyValueService(t)
+	clock := newTestClock(store)
+
+	if ttl, err := store.TTL("missing"); err != nil || ttl != TTLNoKey {
+		t.Fatalf("TTL of missing key = (%v, %v), want (TTLNoKey, nil)", ttl, err)
+	}
+
+	if _, err := store.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if ttl, err := store.TTL("foo"); err != nil || ttl != TTLNoExpiry {
+		t.Fatalf("TTL of key without expiry = (%v, %v), want (TTLNoExpiry, nil)", ttl, err)
+	}
+
+	if _, err := store.ExpireAt("foo", clock.Now().Add(90*time.Second)); err != nil {
+		t.Fatalf("ExpireAt returned error: %v", err)
+	}
+	clock.Advance(30 * time.Second)
+	if ttl, err := store.TTL("foo"); err != nil || ttl != time.Minute {
+		t.Fatalf("TTL = (%v, %v), want (1m, nil)", ttl, err)
+	}
+
+	clock.Advance(time.Minute)
+	if ttl, err := store.TTL("foo"); err != nil || ttl != TTLNoKey {
+		t.Fatalf("TTL of expired key = (%v, %v), want (TTLNoKey, nil)", ttl, err)
+	}
+}
+
+func TestTTL_ConcurrentReads(t *testing.T) {
+	store := newTestKeyValueServiceWithConfig(t, Config{ConcurrentReads: true})
+	clock := newTestClock(store)
+
+	if _, err := store.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := store.ExpireAt("foo", clock.Now().Add(time.Second)); err != nil {
+		t.Fatalf("ExpireAt returned error: %v", err)
+	}
+	if ttl, err := store.TTL("foo"); err != nil || ttl != time.Second {
+		t.Fatalf("TTL = (%v, %v), want (1s, nil)", ttl, err)
+	}
+}
+
+func TestExpireAtWithJitter_SpreadsDeadlines(t *testing.T) {
+	store := newTestKeyValueService(t)
+	clock := newTestClock(store)
+	at := clock.Now().Add(10 * time.Second)
+
+	ttls := make(map[time.Duration]bool)
+	for i := range 50 {
+		key := fmt.Sprintf("k%d", i)
+		if _, err := store.Set(key, "value"); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+		if _, err := store.ExpireAtWithJitter(key, at, 0.5); err != nil {
+			t.Fatalf("ExpireAtWithJitter returned error: %v", err)
+		}
+		ttl, err := store.TTL(key)
+		if err != nil {
+			t.Fatalf("TTL returned error: %v", err)
+		}
+		if ttl < 10*time.Second || ttl > 15*time.Second {
+			t.Fatalf("TTL(%s) = %v, want between 10s and 15s", key, ttl)
+		}
+		ttls[ttl] = true
+	}
+	if len(ttls) < 2 {
+		t.Fatalf("every key got the same deadline, want them spread out")
+	}
+}
+
+func TestExpireAt_ConfiguredJitter(t *testing.T) {
+	store := newTestKeyValueServiceWithConfig(t, Config{TTLJitter: 1})
+	clock := newTestClock(store)
+	at := clock.Now().Add(time.Minute)
+
+	for _, key := range []string{"jittered", "exact"} {
+		if _, err := store.Set(key, "value"); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+	}
+	if _, err := store.ExpireAt("jittered", at); err != nil {
+		t.Fatalf("ExpireAt returned error: %v", err)
+	}
+	if _, err := store.ExpireAtWithJitter("exact", at, -1); err != nil {
+		t.Fatalf("ExpireAtWithJitter returned error: %v", err)
+	}
+
+	if ttl, _ := store.TTL("jittered"); ttl < time.Minute || ttl > 2*time.Minute {
+		t.Fatalf("TTL with configured jitter = %v, want between 1m and 2m", ttl)
+	}
+	if ttl, _ := store.TTL("exact"); ttl != time.Minute {
+		t.Fatalf("TTL with jitter disabled = %v, want 1m", ttl)
+	}
+
+	// A deadline in the past still deletes the key straight away
+	if _, err := store.ExpireAt("jittered", clock.Now()); err != nil {
+		t.Fatalf("ExpireAt returned error: %v", err)
+	}
+	if ttl, _ := store.TTL("jittered"); ttl != TTLNoKey {
+		t.Fatalf("TTL after expiring in the past = %v, want TTLNoKey", ttl)
+	}
+}
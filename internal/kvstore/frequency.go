@@ -0,0 +1,172 @@
+package kvstore
+
+import (
+	"cmp"
+	"errors"
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DefaultFrequencyDecay is how often access counts are halved when
+// Config.FrequencyDecay is zero.
+const DefaultFrequencyDecay = time.Minute
+
+// ErrFrequencyNotTracked is returned by Frequency and HottestKeys when the
+// store was started without Config.TrackFrequency.
+var ErrFrequencyNotTracked = errors.New("frequency tracking is not enabled")
+
+// KeyFrequency is a key and its decayed access count.
+type KeyFrequency struct {
+	Key       string
+	Frequency uint32
+}
+
+// frequencyTable counts the reads and writes of each key, halving the
+// counts every decay period so keys that have cooled down stop outranking
+// those hot now. Counts are decayed lazily, when a key is next counted or
+// looked at, which comes to the same as decaying them all on a timer. It is
+// sharded like accessTable, and for the same reason.
+type frequencyTable struct {
+	shards [accessShardCount]frequencyShard
+	decay  int64
+}
+
+type frequencyShard struct {
+	mu     sync.Mutex
+	counts map[string]frequencyCount
+}
+
+type frequencyCount struct {
+	count uint32
+	// decayedAt is the start of the decay period count was last decayed
+	// in, in Unix nanoseconds
+	decayedAt int64
+}
+
+// decayed halves count once for every decay period that has ended since
+// it was last decayed.
+func (count frequencyCount) decayed(now int64, period int64) frequencyCount {
+	if now <= count.decayedAt {
+		return count
+	}
+	periods := (now - count.decayedAt) / period
+	if periods == 0 {
+		return count
+	}
+	if periods >= 32 {
+		count.count = 0
+	} else {
+		count.count >>= periods
+	}
+	count.decayedAt += periods * period
+	return count
+}
+
+func (table *frequencyTable) shard(key string) *frequencyShard {
+	return &table.shards[hashKey(key)%accessShardCount]
+}
+
+func (table *frequencyTable) hit(key string, now int64) {
+	shard := table.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if shard.counts == nil {
+		shard.counts = make(map[string]frequencyCount)
+	}
+	count, ok := shard.counts[key]
+	if !ok {
+		count.decayedAt = now
+	}
+	count = count.decayed(now, table.decay)
+	if count.count < math.MaxUint32 {
+		count.count++
+	}
+	shard.counts[key] = count
+}
+
+func (table *frequencyTable) frequency(key string, now int64) uint32 {
+	shard := table.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	return shard.counts[key].decayed(now, table.decay).count
+}
+
+func (table *frequencyTable) forget(key string) {
+	shard := table.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	delete(shard.counts, key)
+}
+
+// hottest returns the n keys with the highest counts, highest first. Ties
+// are broken by key so the report is stable. Only n keys are held at a
+// time, so the report costs little memory however many keys are counted.
+func (table *frequencyTable) hottest(n int, now int64) []KeyFrequency {
+	hotter := func(a, b KeyFrequency) int {
+		if c := cmp.Compare(b.Frequency, a.Frequency); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Key, b.Key)
+	}
+
+	top := make([]KeyFrequency, 0, n)
+	for i := range table.shards {
+		shard := &table.shards[i]
+		shard.mu.Lock()
+		for key, count := range shard.counts {
+			entry := KeyFrequency{key, count.decayed(now, table.decay).count}
+			if entry.Frequency == 0 {
+				continue
+			}
+			if len(top) == n && hotter(entry, top[n-1]) >= 0 {
+				continue
+			}
+			at, _ := slices.BinarySearchFunc(top, entry, hotter)
+			if len(top) == n {
+				top = top[:n-1]
+			}
+			top = slices.Insert(top, at, entry)
+		}
+		shard.mu.Unlock()
+	}
+	return top
+}
+
+// Frequency reports how often key has been read or written recently, in
+// the spirit of Redis's OBJECT FREQ: each access adds one and the count is
+// halved every Config.FrequencyDecay. It returns ErrFrequencyNotTracked
+// unless the store was started with Config.TrackFrequency, and an error for
+// keys that do not exist.
+func (kvService *KeyValueService) Frequency(key string) (uint32, error) {
+	if !kvService.store.trackFrequency {
+		return 0, ErrFrequencyNotTracked
+	}
+	info, err := kvService.Object(key)
+	if err != nil {
+		return 0, err
+	}
+	return info.Frequency, nil
+}
+
+// HottestKeys returns up to n of the most frequently accessed keys, hottest
+// first. It reads the counts without going through the store loop, so it
+// does not hold up commands, and may include keys that have expired but
+// not yet been removed.
+func (kvService *KeyValueService) HottestKeys(n int) ([]KeyFrequency, error) {
+	if err := kvService.CheckActive(); err != nil {
+		return nil, err
+	}
+	if !kvService.store.trackFrequency {
+		return nil, ErrFrequencyNotTracked
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	store := kvService.store
+	return store.frequencies.hottest(n, store.currentTime().UnixNano()), nil
+}
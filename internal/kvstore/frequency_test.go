@@ -0,0 +1,104 @@
+package kvstore
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func newFrequencyTestService(t *testing.T) (*KeyValueService, *testClock) {
+	t.Helper()
+	clock := &testClock{}
+	clock.nanos.Store(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano())
+	store := newTestKeyValueServiceWithConfig(t, Config{TrackFrequency: true, Clock: clock.Now})
+	return store, clock
+}
+
+func TestFrequency_CountsAccessesAndDecays(t *testing.T) {
+	store, clock := newFrequencyTestService(t)
+
+	if _, err := store.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	for range 7 {
+		if _, err := store.Get("foo"); err != nil {
+			t.Fatalf("Get returned error: %v", err)
+		}
+	}
+
+	// Object does not count as an access
+	for _, tt := range []struct {
+		advance time.Duration
+		want    uint32
+	}{
+		{0, 8},
+		{DefaultFrequencyDecay / 2, 8},
+		{DefaultFrequencyDecay / 2, 4},
+		{2 * DefaultFrequencyDecay, 1},
+		{DefaultFrequencyDecay, 0},
+	} {
+		clock.Advance(tt.advance)
+		if got, err := store.Frequency("foo"); err != nil || got != tt.want {
+			t.Fatalf("Frequency = (%d, %v), want (%d, nil)", got, err, tt.want)
+		}
+	}
+
+	// A key that has cooled down counts up again from where it decayed to
+	if _, err := store.Get("foo"); err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	if got, err := store.Frequency("foo"); err != nil || got != 1 {
+		t.Fatalf("Frequency after cooling down = (%d, %v), want (1, nil)", got, err)
+	}
+}
+
+func TestHottestKeys_OrdersByFrequency(t *testing.T) {
+	store, _ := newFrequencyTestService(t)
+
+	accesses := map[string]int{"cold": 1, "warm": 3, "hot": 5, "also-warm": 3, "gone": 9}
+	for key, count := range accesses {
+		if _, err := store.Set(key, "value"); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+		for range count - 1 {
+			if _, err := store.Get(key); err != nil {
+				t.Fatalf("Get returned error: %v", err)
+			}
+		}
+	}
+	if _, err := store.Delete("gone"); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+
+	hottest, err := store.HottestKeys(3)
+	if err != nil {
+		t.Fatalf("HottestKeys returned error: %v", err)
+	}
+	want := []KeyFrequency{{"hot", 5}, {"also-warm", 3}, {"warm", 3}}
+	if !slices.Equal(hottest, want) {
+		t.Fatalf("HottestKeys(3) = %v, want %v", hottest, want)
+	}
+
+	all, err := store.HottestKeys(10)
+	if err != nil {
+		t.Fatalf("HottestKeys returned error: %v", err)
+	}
+	if len(all) != 4 || all[3] != (KeyFrequency{"cold", 1}) {
+		t.Fatalf("HottestKeys(10) = %v, want the 4 remaining keys ending with cold", all)
+	}
+}
+
+func TestFrequency_FailsWithoutTracking(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	if _, err := store.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := store.Frequency("foo"); !errors.Is(err, ErrFrequencyNotTracked) {
+		t.Fatalf("Frequency without tracking returned %v, want ErrFrequencyNotTracked", err)
+	}
+	if _, err := store.HottestKeys(10); !errors.Is(err, ErrFrequencyNotTracked) {
+		t.Fatalf("HottestKeys without tracking returned %v, want ErrFrequencyNotTracked", err)
+	}
+}
@@ -0,0 +1,243 @@
+package kvstore
+
+import (
+	"blueis/internal/datatype"
+	"fmt"
+)
+
+var (
+	ErrHashValueNotInteger = datatype.ErrNotInteger
+	ErrIncrementOverflow   = datatype.ErrOverflow
+)
+
+// hashCommand carries the arguments of a hash command and, like
+// crdtCommand, receives its result before the caller is released.
+type hashCommand struct {
+	fields []string
+	values []string
+	delta  int64
+	result map[string]string
+}
+
+// loadHash reads the hash stored under key. A missing or expired key reads
+// as an empty hash, so ok is false.
+func (kvStore *KeyValueStore) loadHash(key string, concurrent bool) (*datatype.Hash, bool, error) {
+	if kvStore.keyExpired(key, concurrent) {
+		return datatype.NewHash(), false, nil
+	}
+	value, ok, err := kvStore.loadTyped(key, TypeHash)
+	if err != nil {
+		return nil, false, err
+	}
+	if !ok {
+		return datatype.NewHash(), false, nil
+	}
+	hash, err := datatype.DecodeHash(value)
+	return hash, true, err
+}
+
+// storeCollection writes the encoding of a hash back under key, removing
+// the key once the hash is empty, as Redis does. Like APPEND, it keeps the
+// expiry of a key that existed and gives a new one its namespace's default
+// TTL.
+func (kvStore *KeyValueStore) storeCollection(key string, encoded TypedValue, length int, existed bool) error {
+	if length == 0 {
+		if !existed {
+			return nil
+		}
+		if _, _, err := kvStore.deleteValue(key); err != nil {
+			return err
+		}
+		kvStore.forgetDeadline(key)
+		kvStore.forget(key)
+		return nil
+	}
+	if err := kvStore.limits.Load().checkSize(key, len(encoded.Data)); err != nil {
+		return err
+	}
+	write := kvStore.setValue
+	if !existed {
+		write = func(key string, value TypedValue) error {
+			return kvStore.setValueExpiring(key, value, kvStore.newDeadline(key))
+		}
+	}
+	if err := write(key, encoded); err != nil {
+		return err
+	}
+	kvStore.touch(key)
+	return nil
+}
+
+func (kvStore *KeyValueStore) storeHash(key string, hash *datatype.Hash, existed bool) error {
+	return kvStore.storeCollection(key, TypedValue{TypeHash, hash.Encode()}, hash.Len(), existed)
+}
+
+func (kvStore *KeyValueStore) ProcessHashCommand(command KeyValueCommand) KeyValueOutput {
+	args := command.hash
+	if args == nil {
+		return KeyValueOutput{false, nil, fmt.Errorf("%s command has no arguments", GetCommandTypeString(command.commandType)), 0}
+	}
+	key := command.key
+
+	mutation := IsMutation(command.commandType)
+	if mutation {
+		defer kvStore.keyLocks.lock(command)()
+	}
+	hash, existed, err := kvStore.loadHash(key, command.concurrent)
+	if err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	if existed && !mutation {
+		kvStore.touch(key)
+	}
+
+	switch command.commandType {
+	case HSET:
+		if len(args.fields) != len(args.values) {
+			return KeyValueOutput{false, nil, fmt.Errorf("hset command has %d fields but %d values", len(args.fields), len(args.values)), 0}
+		}
+		added := int64(0)
+		for i, field := range args.fields {
+			if hash.Set(field, args.values[i]) {
+				added++
+			}
+		}
+		if err := kvStore.storeHash(key, hash, existed); err != nil {
+			return KeyValueOutput{false, nil, err, 0}
+		}
+		return KeyValueOutput{true, nil, nil, added}
+
+	case HDEL:
+		removed := int64(0)
+		for _, field := range args.fields {
+			if hash.Delete(field) {
+				removed++
+			}
+		}
+		if removed > 0 {
+			if err := kvStore.storeHash(key, hash, existed); err != nil {
+				return KeyValueOutput{false, nil, err, 0}
+			}
+		}
+		return KeyValueOutput{true, nil, nil, removed}
+
+	case HINCRBY:
+		if len(args.fields) != 1 {
+			return KeyValueOutput{false, nil, fmt.Errorf("hincrby command has %d fields, want 1", len(args.fields)), 0}
+		}
+		value, err := hash.IncrBy(args.fields[0], args.delta)
+		if err != nil {
+			return KeyValueOutput{false, nil, err, 0}
+		}
+		if err := kvStore.storeHash(key, hash, existed); err != nil {
+			return KeyValueOutput{false, nil, err, 0}
+		}
+		return KeyValueOutput{true, nil, nil, value}
+
+	case HGET, HEXISTS:
+		if len(args.fields) != 1 {
+			return KeyValueOutput{false, nil, fmt.Errorf("%s command has %d fields, want 1", GetCommandTypeString(command.commandType), len(args.fields)), 0}
+		}
+		value, ok := hash.Get(args.fields[0])
+		if !ok {
+			return KeyValueOutput{true, nil, nil, 0}
+		}
+		return KeyValueOutput{true, stringPointer(value), nil, 1}
+
+	case HGETALL:
+		args.result = hash.All()
+		return KeyValueOutput{true, nil, nil, int64(hash.Len())}
+
+	case HLEN:
+		return KeyValueOutput{true, nil, nil, int64(hash.Len())}
+	}
+	return KeyValueOutput{false, nil, fmt.Errorf("command type %s not found", GetCommandTypeString(command.commandType)), 0}
+}
+
+// HSet sets fields of the hash under key to values, creating the hash if
+// the key does not exist, and returns how many of the fields are new. A
+// key holding something other than a hash fails with ErrWrongType, as do
+// the other hash commands.
+func (kvService *KeyValueService) HSet(key string, values map[string]string) (int64, error) {
+	args := &hashCommand{}
+	for field, value := range values {
+		args.fields = append(args.fields, field)
+		args.values = append(args.values, value)
+	}
+	res := kvService.sendHash(HSET, key, args)
+	return res.integer, res.err
+}
+
+// HGet returns the value of field in the hash under key, or
+// ErrKeyNotFound if the key or the field does not exist.
+func (kvService *KeyValueService) HGet(key string, field string) (*string, error) {
+	res := kvService.readHash(HGET, key, &hashCommand{fields: []string{field}})
+	if res.err != nil {
+		return nil, res.err
+	}
+	if res.value == nil {
+		return nil, fmt.Errorf("%w: field %s of %s", ErrKeyNotFound, field, key)
+	}
+	return res.value, nil
+}
+
+// HExists reports whether the hash under key has field.
+func (kvService *KeyValueService) HExists(key string, field string) (bool, error) {
+	res := kvService.readHash(HEXISTS, key, &hashCommand{fields: []string{field}})
+	return res.integer == 1, res.err
+}
+
+// HDel removes fields from the hash under key and returns how many were
+// present. Removing the last field removes the key.
+func (kvService *KeyValueService) HDel(key string, fields ...string) (int64, error) {
+	res := kvService.sendHash(HDEL, key, &hashCommand{fields: fields})
+	return res.integer, res.err
+}
+
+// HGetAll returns every field of the hash under key and its value, empty
+// if the key does not exist.
+func (kvService *KeyValueService) HGetAll(key string) (map[string]string, error) {
+	args := &hashCommand{}
+	res := kvService.readHash(HGETALL, key, args)
+	if res.err != nil {
+		return nil, res.err
+	}
+	return args.result, nil
+}
+
+// HLen returns the number of fields in the hash under key, or 0 if the key
+// does not exist.
+func (kvService *KeyValueService) HLen(key string) (int64, error) {
+	res := kvService.readHash(HLEN, key, &hashCommand{})
+	return res.integer, res.err
+}
+
+// HIncrBy adds delta, which may be negative, to the integer held in field
+// of the hash under key and returns its new value. A missing field counts
+// from zero; one that does not hold an integer fails with
+// ErrHashValueNotInteger, and one that would overflow with
+// ErrIncrementOverflow.
+func (kvService *KeyValueService) HIncrBy(key string, field string, delta int64) (int64, error) {
+	res := kvService.sendHash(HINCRBY, key, &hashCommand{fields: []string{field}, delta: delta})
+	return res.integer, res.err
+}
+
+func (kvService *KeyValueService) sendHash(commandType int, key string, args *hashCommand) KeyValueOutput {
+	if err := kvService.CheckWritable(); err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	return kvService.dispatch(KeyValueCommand{commandType: commandType, key: key, hash: args})
+}
+
+func (kvService *KeyValueService) readHash(commandType int, key string, args *hashCommand) KeyValueOutput {
+	if err := kvService.CheckActive(); err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	return kvService.dispatchRead(KeyValueCommand{commandType: commandType, key: key, hash: args})
+}
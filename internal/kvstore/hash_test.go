@@ -0,0 +1,186 @@
+package kvstore
+
+import (
+	"blueis/internal/datatype"
+	"errors"
+	"fmt"
+	"maps"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHash_FieldOperations(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	if n, err := store.HSet("user", map[string]string{"name": "alice", "age": "30"}); err != nil || n != 2 {
+		t.Fatalf("HSet = (%d, %v), want (2, nil)", n, err)
+	}
+	if n, err := store.HSet("user", map[string]string{"name": "bob", "city": "paris"}); err != nil || n != 1 {
+		t.Fatalf("HSet of one new field = (%d, %v), want (1, nil)", n, err)
+	}
+	if value, err := store.HGet("user", "name"); err != nil || deref(value) != "bob" {
+		t.Fatalf("HGet = (%q, %v), want (\"bob\", nil)", deref(value), err)
+	}
+	if _, err := store.HGet("user", "missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("HGet of missing field = %v, want ErrKeyNotFound", err)
+	}
+	if _, err := store.HGet("missing", "name"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("HGet of missing key = %v, want ErrKeyNotFound", err)
+	}
+	if ok, err := store.HExists("user", "city"); err != nil || !ok {
+		t.Fatalf("HExists = (%t, %v), want (true, nil)", ok, err)
+	}
+	if n, err := store.HLen("user"); err != nil || n != 3 {
+		t.Fatalf("HLen = (%d, %v), want (3, nil)", n, err)
+	}
+
+	all, err := store.HGetAll("user")
+	if err != nil {
+		t.Fatalf("HGetAll returned error: %v", err)
+	}
+	if want := map[string]string{"name": "bob", "age": "30", "city": "paris"}; !maps.Equal(all, want) {
+		t.Fatalf("HGetAll = %v, want %v", all, want)
+	}
+	if all, err := store.HGetAll("missing"); err != nil || len(all) != 0 {
+		t.Fatalf("HGetAll of missing key = (%v, %v), want an empty hash", all, err)
+	}
+
+	if n, err := store.HDel("user", "age", "city", "missing"); err != nil || n != 2 {
+		t.Fatalf("HDel = (%d, %v), want (2, nil)", n, err)
+	}
+	if n, err := store.HDel("user", "name"); err != nil || n != 1 {
+		t.Fatalf("HDel of the last field = (%d, %v), want (1, nil)", n, err)
+	}
+	if ttl, err := store.TTL("user"); err != nil || ttl != TTLNoKey {
+		t.Fatalf("TTL = (%v, %v), want the emptied hash removed", ttl, err)
+	}
+}
+
+func TestHIncrBy(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	if n, err := store.HIncrBy("stats", "hits", 5); err != nil || n != 5 {
+		t.Fatalf("HIncrBy of missing key = (%d, %v), want (5, nil)", n, err)
+	}
+	if n, err := store.HIncrBy("stats", "hits", -2); err != nil || n != 3 {
+		t.Fatalf("HIncrBy = (%d, %v), want (3, nil)", n, err)
+	}
+	if _, err := store.HSet("stats", map[string]string{"name": "x"}); err != nil {
+		t.Fatalf("HSet returned error: %v", err)
+	}
+	if _, err := store.HIncrBy("stats", "name", 1); !errors.Is(err, ErrHashValueNotInteger) {
+		t.Fatalf("HIncrBy of non-integer = %v, want ErrHashValueNotInteger", err)
+	}
+
+	// Increments are not lost to each other under either execution mode
+	for _, execution := range []ExecutionMode{ActorExecution, DirectExecution} {
+		store := newTestKeyValueServiceWithConfig(t, Config{Execution: execution})
+		var wg sync.WaitGroup
+		for range 100 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := store.HIncrBy("stats", "hits", 1); err != nil {
+					t.Errorf("HIncrBy returned error: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+		if value, _ := store.HGet("stats", "hits"); deref(value) != "100" {
+			t.Fatalf("hits = %s, want 100", deref(value))
+		}
+	}
+}
+
+func TestHash_WrongType(t *testing.T) {
+	store := newTestKeyValueService(t)
+	if _, err := store.Set("plain", "v"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := store.HSet("hash", map[string]string{"f": "v"}); err != nil {
+		t.Fatalf("HSet returned error: %v", err)
+	}
+
+	if _, err := store.HGet("plain", "f"); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("HGet of a string = %v, want ErrWrongType", err)
+	}
+	if _, err := store.HSet("plain", map[string]string{"f": "v"}); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("HSet of a string = %v, want ErrWrongType", err)
+	}
+	if _, err := store.Get("hash"); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("Get of a hash = %v, want ErrWrongType", err)
+	}
+	if _, err := store.Append("hash", "x"); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("Append to a hash = %v, want ErrWrongType", err)
+	}
+	if _, err := store.SetIfEqual("hash", "", "x"); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("SetIfEqual of a hash = %v, want ErrWrongType", err)
+	}
+
+	// Set replaces a key whatever its type
+	if _, err := store.Set("hash", "now a string"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if value, err := store.Get("hash"); err != nil || deref(value) != "now a string" {
+		t.Fatalf("Get = (%q, %v), want the string", deref(value), err)
+	}
+}
+
+func TestHash_KeepsExpiryAndChecksLimits(t *testing.T) {
+	store := newTestKeyValueServiceWithConfig(t, Config{MaxValueSize: 32})
+	clock := newTestClock(store)
+
+	if _, err := store.HSet("h", map[string]string{"a": "1"}); err != nil {
+		t.Fatalf("HSet returned error: %v", err)
+	}
+	if _, err := store.ExpireAt("h", clock.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("ExpireAt returned error: %v", err)
+	}
+	if _, err := store.HSet("h", map[string]string{"b": "2"}); err != nil {
+		t.Fatalf("HSet returned error: %v", err)
+	}
+	if ttl, err := store.TTL("h"); err != nil || ttl != time.Minute {
+		t.Fatalf("TTL = (%v, %v), want the expiry kept", ttl, err)
+	}
+	if _, err := store.HSet("h", map[string]string{"c": fmt.Sprint(make([]byte, 32))}); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("HSet past the limit = %v, want ErrValueTooLarge", err)
+	}
+
+	clock.Advance(time.Minute)
+	if all, err := store.HGetAll("h"); err != nil || len(all) != 0 {
+		t.Fatalf("HGetAll of expired hash = (%v, %v), want an empty hash", all, err)
+	}
+}
+
+func TestHash_PlainStringsCannotPassForHashes(t *testing.T) {
+	store := newTestKeyValueService(t)
+	encoded := datatype.NewHash()
+	encoded.Set("a", "b")
+	value := encoded.Encode()
+
+	// A string is a string whatever it holds
+	if _, err := store.Set("k", value); err != nil {
+		t.Fatalf("Set of a hash encoding returned error: %v", err)
+	}
+	if _, err := store.HGetAll("k"); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("HGetAll of the string = %v, want ErrWrongType", err)
+	}
+	if got, err := store.Get("k"); err != nil || got == nil || *got != value {
+		t.Fatalf("Get of the string = (%v, %v), want the bytes it was set to", got, err)
+	}
+	if _, err := store.Append("k", "x"); err != nil {
+		t.Fatalf("Append to the string returned error: %v", err)
+	}
+
+	// A replicated hash is applied as it is, but not one that is corrupt
+	if err := store.ApplyMutations([]Mutation{{Type: MutationSet, Key: "h", Value: value, ValueType: TypeHash}}); err != nil {
+		t.Fatalf("ApplyMutations of a hash returned error: %v", err)
+	}
+	if all, err := store.HGetAll("h"); err != nil || !maps.Equal(all, map[string]string{"a": "b"}) {
+		t.Fatalf("HGetAll of the replicated hash = (%v, %v), want map[a:b]", all, err)
+	}
+	if err := store.ApplyMutations([]Mutation{{Type: MutationSet, Key: "h", Value: value + "x", ValueType: TypeHash}}); !errors.Is(err, datatype.ErrInvalidEncoding) {
+		t.Fatalf("ApplyMutations of a corrupt hash = %v, want ErrInvalidEncoding", err)
+	}
+}
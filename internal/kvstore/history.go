@@ -0,0 +1,278 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrHistoryUnavailable is returned by GetAsOf for a time the retained
+// history does not reach back to.
+var ErrHistoryUnavailable = errors.New("history is not retained that far back")
+
+// DefaultHistoryVersions is how many replaced values are kept for each key
+// when History.MaxVersions is zero.
+const DefaultHistoryVersions = 100
+
+// History configures how long replaced values are kept, so GetAsOf can
+// read keys as they were before a recent write or delete. Every write then
+// reads the value it replaces, and every key written within Window holds
+// on to its old values, so it costs a little time on each write and memory
+// in proportion to the write rate.
+type History struct {
+	// Window is how far back keys can be read. Zero disables history
+	Window time.Duration
+	// MaxVersions caps the values kept for each key, or
+	// DefaultHistoryVersions if zero. A key written more often than that
+	// within Window can only be read as far back as its oldest kept value
+	MaxVersions int
+}
+
+func (history History) withDefaults() History {
+	if history.MaxVersions <= 0 {
+		history.MaxVersions = DefaultHistoryVersions
+	}
+	return history
+}
+
+// HistoryStats is what the retained history holds.
+type HistoryStats struct {
+	Window time.Duration
+	// Keys is how many keys have old values kept, and Versions how many
+	// values they hold between them
+	Keys     int
+	Versions int
+}
+
+type historyTable struct {
+	config atomic.Pointer[History]
+	size   atomic.Int64
+	count  atomic.Int64
+
+	mu   sync.Mutex
+	keys map[string]*keyHistory
+	// since is when history was enabled, in Unix nanoseconds; nothing
+	// before it can be read
+	since int64
+	// pruned is when every key was last pruned
+	pruned int64
+}
+
+// keyHistory is the values a key held, oldest first.
+type keyHistory struct {
+	versions []version
+	// since is how far back versions go, past the table's since once the
+	// oldest of them have been dropped
+	since int64
+}
+
+// version is a value a key held until it was replaced or removed.
+type version struct {
+	value TypedValue
+	live  bool
+	// deadline is when the value expired, or 0 if it had no expiry
+	deadline int64
+	until    int64
+}
+
+// liveAt reports whether the version had a value that had not expired at
+// at.
+func (v version) liveAt(at int64) bool {
+	return v.live && (v.deadline == 0 || v.deadline > at)
+}
+
+// add keeps v as key's value until now, dropping values that have fallen
+// out of the window or past the key's cap, and now and then those of every
+// other key.
+func (table *historyTable) add(key string, v version, now int64) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	config := table.config.Load()
+	if config == nil {
+		return
+	}
+	history, ok := table.keys[key]
+	if !ok {
+		history = &keyHistory{since: table.since}
+		table.keys[key] = history
+		table.size.Add(1)
+	}
+	history.versions = append(history.versions, v)
+	table.count.Add(1)
+
+	cutoff := now - int64(config.Window)
+	table.trim(history, cutoff, config.MaxVersions)
+	if now-table.pruned >= int64(config.Window) {
+		for key, history := range table.keys {
+			if table.trim(history, cutoff, config.MaxVersions); len(history.versions) == 0 {
+				// Every read it could answer is out of the window, and later
+				// ones are answered by the key's current value
+				delete(table.keys, key)
+				table.size.Add(-1)
+			}
+		}
+		table.pruned = now
+	}
+}
+
+// trim drops history's values that were replaced by cutoff, and its oldest
+// ones past limit.
+func (table *historyTable) trim(history *keyHistory, cutoff int64, limit int) {
+	drop := 0
+	for drop < len(history.versions) && (history.versions[drop].until <= cutoff || len(history.versions)-drop > limit) {
+		history.since = history.versions[drop].until
+		drop++
+	}
+	if drop > 0 {
+		history.versions = append(history.versions[:0], history.versions[drop:]...)
+		table.count.Add(-int64(drop))
+	}
+}
+
+// covers returns ErrHistoryUnavailable unless the history reaches back to
+// at.
+func (table *historyTable) covers(at, now int64) error {
+	config := table.config.Load()
+	if config == nil {
+		return fmt.Errorf("%w: history is not being retained", ErrHistoryUnavailable)
+	}
+	table.mu.Lock()
+	oldest := max(table.since, now-int64(config.Window))
+	table.mu.Unlock()
+	if at < oldest {
+		return fmt.Errorf("%w: history goes back to %s", ErrHistoryUnavailable, time.Unix(0, oldest).UTC().Format(time.RFC3339Nano))
+	}
+	return nil
+}
+
+// lookup returns the value key held at at, if it has been replaced since.
+func (table *historyTable) lookup(key string, at int64) (version, bool, error) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	history, ok := table.keys[key]
+	if !ok {
+		return version{}, false, nil
+	}
+	if at < history.since {
+		return version{}, false, fmt.Errorf("%w: key %s has been written too often to go back before %s", ErrHistoryUnavailable, key, time.Unix(0, history.since).UTC().Format(time.RFC3339Nano))
+	}
+	i := sort.Search(len(history.versions), func(i int) bool { return history.versions[i].until > at })
+	if i == len(history.versions) {
+		return version{}, false, nil
+	}
+	return history.versions[i], true, nil
+}
+
+// set applies config, clearing the history when it is disabled and
+// starting it afresh at now when it is enabled.
+func (table *historyTable) set(config History, now int64) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	if config.Window <= 0 {
+		table.config.Store(nil)
+		table.keys = nil
+		table.size.Store(0)
+		table.count.Store(0)
+		return
+	}
+	config = config.withDefaults()
+	if table.config.Load() == nil {
+		table.keys = make(map[string]*keyHistory)
+		table.since, table.pruned = now, now
+	}
+	table.config.Store(&config)
+}
+
+// retain keeps key's current value in the history before a write replaces
+// it. It must be called before each write to the engine.
+func (kvStore *KeyValueStore) retain(key string) error {
+	if kvStore.history.config.Load() == nil {
+		return nil
+	}
+	value, ok, err := kvStore.engine.Get(key)
+	if err != nil {
+		return fmt.Errorf("retaining history of key %s: %w", key, err)
+	}
+	deadline, hasDeadline := kvStore.expiries.deadline(key)
+	if !hasDeadline {
+		deadline = 0
+	}
+	now := kvStore.currentTime().UnixNano()
+	kvStore.history.add(key, version{value: value, live: ok, deadline: deadline, until: now}, now)
+	return nil
+}
+
+// ProcessGetAsOfCommand reads command.key as it was at command.expireAt.
+// The engine is read before the history: a write that lands in between has
+// already kept the value it replaced, so the value read is never newer than
+// the time asked for.
+func (kvStore *KeyValueStore) ProcessGetAsOfCommand(command KeyValueCommand) KeyValueOutput {
+	key := command.key
+	now, at := kvStore.currentTime().UnixNano(), command.expireAt.UnixNano()
+	if at >= now {
+		return kvStore.ProcessGetCommand(command)
+	}
+	if err := kvStore.history.covers(at, now); err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+
+	value, ok, err := kvStore.engine.Get(key)
+	if err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	old, replaced, err := kvStore.history.lookup(key, at)
+	if err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	if replaced {
+		value, ok = old.value, old.liveAt(at)
+	} else if ok {
+		deadline, hasDeadline := kvStore.expiries.deadline(key)
+		ok = !hasDeadline || deadline > at
+	}
+	if !ok {
+		return KeyValueOutput{false, nil, keyNotFound(key), 0}
+	}
+	if value.Type != TypeString {
+		return KeyValueOutput{false, nil, ErrWrongType, 0}
+	}
+	return KeyValueOutput{true, stringPointer(value.Data), nil, 0}
+}
+
+// GetAsOf returns key's value as it was at a time within the configured
+// History, or ErrKeyNotFound if it did not exist then. A time the history
+// does not reach back to fails with ErrHistoryUnavailable, and one that has
+// not passed yet reads the current value.
+func (kvService *KeyValueService) GetAsOf(key string, at time.Time) (*string, error) {
+	if err := kvService.CheckActive(); err != nil {
+		return nil, err
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return nil, err
+	}
+	res := kvService.dispatchRead(KeyValueCommand{commandType: GETASOF, key: key, expireAt: at})
+	return res.value, res.err
+}
+
+// SetHistory reconfigures how long replaced values are kept. Disabling it
+// drops every value kept, and enabling it starts keeping them from now.
+func (kvService *KeyValueService) SetHistory(history History) {
+	kvService.store.history.set(history, kvService.store.currentTime().UnixNano())
+}
+
+// HistoryStats returns what the retained history holds.
+func (kvService *KeyValueService) HistoryStats() HistoryStats {
+	var stats HistoryStats
+	if config := kvService.store.history.config.Load(); config != nil {
+		stats.Window = config.Window
+	}
+	stats.Keys = int(kvService.store.history.size.Load())
+	stats.Versions = int(kvService.store.history.count.Load())
+	return stats
+}
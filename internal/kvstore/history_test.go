@@ -0,0 +1,125 @@
+package kvstore
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func newHistoryService(t *testing.T, history History) (*KeyValueService, *testClock) {
+	t.Helper()
+	clock := &testClock{}
+	clock.nanos.Store(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano())
+	return newTestKeyValueServiceWithConfig(t, Config{Clock: clock.Now, History: history}), clock
+}
+
+func assertValueAsOf(t *testing.T, store *KeyValueService, key string, at time.Time, want string) {
+	t.Helper()
+	value, err := store.GetAsOf(key, at)
+	if want == "" {
+		if !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("GetAsOf(%s, %s) = %v, %v, want ErrKeyNotFound", key, at.Format(time.TimeOnly), value, err)
+		}
+		return
+	}
+	if err != nil || value == nil || *value != want {
+		t.Fatalf("GetAsOf(%s, %s) = %v, %v, want %q", key, at.Format(time.TimeOnly), value, err, want)
+	}
+}
+
+func TestGetAsOf_ReadsValuesKeysHeldBefore(t *testing.T) {
+	store, clock := newHistoryService(t, History{Window: time.Hour})
+	start := clock.Now()
+
+	clock.Advance(time.Minute)
+	if _, err := store.Set("key", "first"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	first := clock.Now()
+	clock.Advance(time.Minute)
+	if _, err := store.Set("key", "second"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	second := clock.Now()
+	clock.Advance(time.Minute)
+	if _, err := store.Delete("key"); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+	deleted := clock.Now()
+	clock.Advance(time.Minute)
+	if _, err := store.Set("key", "third"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	clock.Advance(time.Minute)
+
+	assertValueAsOf(t, store, "key", start, "")
+	assertValueAsOf(t, store, "key", first, "first")
+	assertValueAsOf(t, store, "key", first.Add(30*time.Second), "first")
+	assertValueAsOf(t, store, "key", second, "second")
+	assertValueAsOf(t, store, "key", deleted, "")
+	assertValueAsOf(t, store, "key", clock.Now(), "third")
+	assertValueAsOf(t, store, "key", clock.Now().Add(time.Hour), "third")
+
+	stats := store.HistoryStats()
+	if stats.Window != time.Hour || stats.Keys != 1 || stats.Versions != 4 {
+		t.Fatalf("HistoryStats = %+v, want 4 values kept for 1 key", stats)
+	}
+}
+
+func TestGetAsOf_KnowsWhenValuesExpired(t *testing.T) {
+	store, clock := newHistoryService(t, History{Window: time.Hour})
+	if _, err := store.Set("key", "value"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := store.ExpireAt("key", clock.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("ExpireAt returned error: %v", err)
+	}
+	set := clock.Now()
+	clock.Advance(2 * time.Minute)
+	if _, err := store.Set("key", "again"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+
+	assertValueAsOf(t, store, "key", set, "value")
+	assertValueAsOf(t, store, "key", set.Add(time.Minute), "")
+	assertValueAsOf(t, store, "key", clock.Now(), "again")
+}
+
+func TestGetAsOf_OnlyReachesBackAsFarAsTheHistory(t *testing.T) {
+	store, clock := newHistoryService(t, History{Window: time.Hour, MaxVersions: 2})
+	if _, err := store.GetAsOf("key", clock.Now().Add(-time.Second)); !errors.Is(err, ErrHistoryUnavailable) {
+		t.Fatalf("GetAsOf before history was kept returned %v, want ErrHistoryUnavailable", err)
+	}
+
+	for _, value := range []string{"a", "b", "c", "d"} {
+		clock.Advance(time.Minute)
+		if _, err := store.Set("key", value); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+	}
+	// Only the two values before d are kept: b and c
+	assertValueAsOf(t, store, "key", clock.Now().Add(-90*time.Second), "b")
+	if _, err := store.GetAsOf("key", clock.Now().Add(-150*time.Second)); !errors.Is(err, ErrHistoryUnavailable) {
+		t.Fatalf("GetAsOf past the kept values returned %v, want ErrHistoryUnavailable", err)
+	}
+
+	clock.Advance(2 * time.Hour)
+	if _, err := store.Set("other", "value"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := store.GetAsOf("key", clock.Now().Add(-61*time.Minute)); !errors.Is(err, ErrHistoryUnavailable) {
+		t.Fatalf("GetAsOf past the window returned %v, want ErrHistoryUnavailable", err)
+	}
+	assertValueAsOf(t, store, "key", clock.Now().Add(-59*time.Minute), "d")
+	if stats := store.HistoryStats(); stats.Keys != 1 || stats.Versions != 1 {
+		t.Fatalf("HistoryStats = %+v, want only other's value kept", stats)
+	}
+
+	store.SetHistory(History{})
+	if _, err := store.GetAsOf("key", clock.Now().Add(-time.Minute)); !errors.Is(err, ErrHistoryUnavailable) {
+		t.Fatalf("GetAsOf with history disabled returned %v, want ErrHistoryUnavailable", err)
+	}
+	if stats := store.HistoryStats(); stats.Keys != 0 || stats.Versions != 0 {
+		t.Fatalf("HistoryStats = %+v, want nothing kept once disabled", stats)
+	}
+}
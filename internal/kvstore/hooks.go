@@ -0,0 +1,120 @@
+package kvstore
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Command is the public view of a store command handed to hooks.
+type Command struct {
+	Type  int
+	Key   string
+	Value *string
+	// ExpireAt is the deadline of an EXPIREAT command.
+	ExpireAt time.Time
+	// TTL is the time to live a PUT gives its key, zero for none.
+	TTL time.Duration
+	// Expected is the value a SETIFEQUAL requires the key to hold.
+	Expected *string
+}
+
+// Result is the public view of a command's outcome handed to hooks.
+type Result struct {
+	Success bool
+	Value   *string
+	Err     error
+	// Integer is the reply of commands that return a number, such as TTL.
+	Integer int64
+}
+
+// BeforeCommandHook runs in the store goroutine before a command executes.
+// It may rewrite the command's key or value; returning an error rejects the
+// command with that error and skips the remaining hooks.
+type BeforeCommandHook func(command *Command) error
+
+// AfterCommandHook runs in the store goroutine once a command has executed,
+// including commands rejected by a before hook.
+type AfterCommandHook func(command Command, result Result)
+
+// Hooks run on the single store goroutine, so they must be quick and must
+// not call back into the KeyValueService or they will deadlock the loop.
+// With DirectExecution, or for Gets with ConcurrentReads, they run on the
+// caller's goroutine instead and must be safe for concurrent use.
+type commandHooks struct {
+	before []BeforeCommandHook
+	after  []AfterCommandHook
+}
+
+// hookRegistry is copy-on-write: registration swaps in a new commandHooks
+// so the store loop can read the current set without taking a lock.
+type hookRegistry struct {
+	mu    sync.Mutex
+	hooks atomic.Pointer[commandHooks]
+}
+
+var noHooks = &commandHooks{}
+
+func (registry *hookRegistry) load() *commandHooks {
+	if hooks := registry.hooks.Load(); hooks != nil {
+		return hooks
+	}
+	return noHooks
+}
+
+func (registry *hookRegistry) addBefore(hook BeforeCommandHook) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	current := registry.load()
+	next := &commandHooks{append(append([]BeforeCommandHook{}, current.before...), hook), current.after}
+	registry.hooks.Store(next)
+}
+
+func (registry *hookRegistry) addAfter(hook AfterCommandHook) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	current := registry.load()
+	next := &commandHooks{current.before, append(append([]AfterCommandHook{}, current.after...), hook)}
+	registry.hooks.Store(next)
+}
+
+func (kvStore *KeyValueStore) runBeforeHooks(hooks *commandHooks, command *KeyValueCommand) error {
+	if len(hooks.before) == 0 {
+		return nil
+	}
+
+	view := Command{command.commandType, command.key, command.value, command.expireAt, command.ttl, command.expected}
+	for _, hook := range hooks.before {
+		if err := hook(&view); err != nil {
+			return err
+		}
+	}
+	command.key = view.Key
+	command.value = view.Value
+	command.expireAt = view.ExpireAt
+	command.ttl = view.TTL
+	command.expected = view.Expected
+	return nil
+}
+
+func (kvStore *KeyValueStore) runAfterHooks(hooks *commandHooks, command KeyValueCommand, output KeyValueOutput) {
+	if len(hooks.after) == 0 {
+		return
+	}
+
+	view := Command{command.commandType, command.key, command.value, command.expireAt, command.ttl, command.expected}
+	result := Result{output.success, output.value, output.err, output.integer}
+	for _, hook := range hooks.after {
+		hook(view, result)
+	}
+}
+
+func (kvService *KeyValueService) AddBeforeCommandHook(hook BeforeCommandHook) {
+	kvService.store.hooks.addBefore(hook)
+}
+
+func (kvService *KeyValueService) AddAfterCommandHook(hook AfterCommandHook) {
+	kvService.store.hooks.addAfter(hook)
+}
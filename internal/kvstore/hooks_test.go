@@ -0,0 +1,68 @@
+package kvstore
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBeforeCommandHook_TransformsCommand(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	store.AddBeforeCommandHook(func(command *Command) error {
+		if command.Type == PUT && command.Value != nil {
+			upper := strings.ToUpper(*command.Value)
+			command.Value = &upper
+		}
+		return nil
+	})
+
+	if _, err := store.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+
+	got, err := store.Get("foo")
+	if err != nil || got == nil || *got != "BAR" {
+		t.Fatalf("Get(%q) = (%v, %v), want %q", "foo", deref(got), err, "BAR")
+	}
+}
+
+func TestBeforeCommandHook_RejectsCommand(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	errForbidden := errors.New("keys under secret/ are not writable")
+	store.AddBeforeCommandHook(func(command *Command) error {
+		if command.Type == PUT && strings.HasPrefix(command.Key, "secret/") {
+			return errForbidden
+		}
+		return nil
+	})
+
+	if _, err := store.Set("secret/token", "x"); !errors.Is(err, errForbidden) {
+		t.Fatalf("Set on rejected key returned %v, want %v", err, errForbidden)
+	}
+	if _, err := store.Get("secret/token"); err == nil {
+		t.Fatalf("Get after rejected Set returned nil error, want missing key")
+	}
+}
+
+func TestAfterCommandHook_ObservesResults(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	var seen []string
+	store.AddAfterCommandHook(func(command Command, result Result) {
+		seen = append(seen, GetCommandTypeString(command.Type)+":"+command.Key+":"+strconv.FormatBool(result.Success))
+	})
+
+	_, _ = store.Set("foo", "bar")
+	_, _ = store.Get("missing")
+	_, _ = store.Delete("foo")
+
+	// The after hook runs before the caller is released, so reading seen
+	// here is ordered after every append.
+	want := []string{"PUT:foo:true", "GET:missing:false", "DELETE:foo:true"}
+	if strings.Join(seen, ",") != strings.Join(want, ",") {
+		t.Fatalf("after hook saw %v, want %v", seen, want)
+	}
+}
@@ -0,0 +1,37 @@
+package kvstore
+
+import "sync"
+
+const keyMutexCount = 256
+
+// keyMutexes serialises read-modify-write commands on the same key when they
+// run outside the store loop, under DirectExecution. Commands in the store
+// loop are already serialised and never take them. Plain Sets and Deletes
+// do not take them either, so they are only atomic with respect to other
+// read-modify-write commands.
+type keyMutexes struct {
+	mutexes [keyMutexCount]sync.Mutex
+}
+
+// lock locks key's mutex if command runs outside the store loop and returns
+// the matching unlock.
+func (mutexes *keyMutexes) lock(command KeyValueCommand) func() {
+	if !command.concurrent {
+		return noUnlock
+	}
+	mu := &mutexes.mutexes[hashKey(command.key)%keyMutexCount]
+	mu.Lock()
+	return mu.Unlock
+}
+
+func noUnlock() {}
+
+// hashKey is an inline FNV-1a, so hashing a key does not allocate.
+func hashKey(key string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h
+}
@@ -1,95 +1,497 @@
-package kvstore
-
-import (
-	"context"
-	"fmt"
-	"sync"
-)
-
-const (
-	DELETE = iota
-	UPDATE = iota
-	PUT    = iota
-	GET    = iota
-)
-
-type KeyValueCommand struct {
-	commandType int
-	key         string
-	value       *string
-	output      chan KeyValueOutput
-}
-
-type KeyValueOutput struct {
-	success bool
-	value   *string
-	err     error
-}
-
-type KeyValueService struct {
-	input    chan KeyValueCommand
-	isActive bool
-	close    context.CancelFunc
-}
-
-var (
-	instance *KeyValueService
-	once     sync.Once
-)
-
-func GetKeyValueService(ctx context.Context, close context.CancelFunc) *KeyValueService {
-	once.Do(func() {
-		input := make(chan KeyValueCommand)
-		InitKeyValueStore(input, ctx)
-		instance = &KeyValueService{input, true, close}
-	})
-	return instance
-}
-
-func (kvService *KeyValueService) Close() {
-	kvService.isActive = false
-	kvService.close()
-}
-
-func (kvService *KeyValueService) CheckActive() error {
-	if kvService.isActive {
-		return nil
-	}
-	return fmt.Errorf("KeyValueService has been closed")
-}
-
-func (kvService *KeyValueService) Set(key string, value string) (*string, error) {
-	if err := kvService.CheckActive(); err != nil {
-		return nil, err
-	}
-	outputCh := make(chan KeyValueOutput)
-	command := KeyValueCommand{PUT, key, &value, outputCh}
-	kvService.input <- command
-	res := <-outputCh
-
-	return res.value, res.err
-}
-
-func (kvService *KeyValueService) Delete(key string) (*string, error) {
-	if err := kvService.CheckActive(); err != nil {
-		return nil, err
-	}
-	outputCh := make(chan KeyValueOutput)
-	command := KeyValueCommand{DELETE, key, nil, outputCh}
-	kvService.input <- command
-	res := <-outputCh
-
-	return res.value, res.err
-}
-
-func (kvService *KeyValueService) Get(key string) (*string, error) {
-	if err := kvService.CheckActive(); err != nil {
-		return nil, err
-	}
-	outputCh := make(chan KeyValueOutput)
-	command := KeyValueCommand{GET, key, nil, outputCh}
-	kvService.input <- command
-	res := <-outputCh
-
-	return res.value, res.err
-}
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DELETE          = iota
+	UPDATE          = iota
+	PUT             = iota
+	GET             = iota
+	BATCH           = iota
+	EXPIREAT        = iota
+	PERSIST         = iota
+	TTL             = iota
+	OBJECT          = iota
+	CMSINIT         = iota
+	CMSINCRBY       = iota
+	CMSQUERY        = iota
+	CMSMERGE        = iota
+	LOCK            = iota
+	UNLOCK          = iota
+	LEASEGRANT      = iota
+	LEASEATTACH     = iota
+	LEASEKEEPALIVE  = iota
+	LEASEREVOKE     = iota
+	TXPREPARE       = iota
+	TXCOMMIT        = iota
+	TXABORT         = iota
+	WRITEBATCH      = iota
+	SNAPSHOT        = iota
+	SNAPSHOTGET     = iota
+	SNAPSHOTKEYS    = iota
+	KEYSPACE        = iota
+	RANDOMKEYS      = iota
+	REPLICATE       = iota
+	APPLYMUTATIONS  = iota
+	PNCOUNTERINCRBY = iota
+	PNCOUNTERGET    = iota
+	ORSETADD        = iota
+	ORSETREMOVE     = iota
+	ORSETMEMBERS    = iota
+	MERGEMUTATIONS  = iota
+	GETASOF         = iota
+	SETNX           = iota
+	SETIFEQUAL      = iota
+	APPEND          = iota
+	STRLEN          = iota
+	GETRANGE        = iota
+	SETRANGE        = iota
+	HSET            = iota
+	HGET            = iota
+	HDEL            = iota
+	HGETALL         = iota
+	HINCRBY         = iota
+	HLEN            = iota
+	HEXISTS         = iota
+	LPUSH           = iota
+	RPUSH           = iota
+	LPOP            = iota
+	RPOP            = iota
+	LRANGE          = iota
+	LINDEX          = iota
+	LLEN            = iota
+)
+
+type KeyValueCommand struct {
+	commandType int
+	key         string
+	value       *string
+	// expected is the value a SETIFEQUAL requires the key to hold
+	expected *string
+	batch    *commandBatch
+	// expireAt is an EXPIREAT's deadline, or the time a GETASOF reads as of
+	expireAt time.Time
+	// ttl is a LEASEGRANT's lease length, or the time to live a PUT gives
+	// its key
+	ttl time.Duration
+	// jitter is the fraction of an EXPIREAT's remaining time that may be
+	// added to its deadline; zero uses the store's configured jitter
+	jitter      float64
+	object      *ObjectInfo
+	countMin    *countMinCommand
+	transaction *transactionCommand
+	snapshot    *snapshotCommand
+	keyspace    *keyspaceCommand
+	replication *replicationCommand
+	crdt        *crdtCommand
+	strRange    *stringRangeCommand
+	hash        *hashCommand
+	list        *listCommand
+	// token carries a lock's fencing token or a lease ID
+	token uint64
+	// deadline is when the caller gives up waiting for the result; the
+	// store skips the command if it is past by the time it gets to it.
+	// Zero waits for ever
+	deadline time.Time
+	// concurrent marks commands executed outside the store loop, which
+	// may run alongside other commands and must not remove expired keys.
+	concurrent bool
+	output     chan KeyValueOutput
+}
+
+type KeyValueOutput struct {
+	success bool
+	value   *string
+	err     error
+	// integer carries the result of commands that reply with a number,
+	// such as TTL.
+	integer int64
+}
+
+// ExecutionMode selects how commands reach the storage engine.
+type ExecutionMode int
+
+const (
+	// ActorExecution funnels every command through the single store
+	// goroutine, so commands are serialised and engines need no locking.
+	ActorExecution ExecutionMode = iota
+	// DirectExecution runs commands on the caller's goroutine. It removes
+	// the store goroutine from the hot path but requires an engine that is
+	// safe for concurrent use, such as ShardedEngine, and hooks that are
+	// safe to call concurrently.
+	DirectExecution
+	// simulatedExecution runs commands on the caller's goroutine like
+	// DirectExecution, but one at a time and as the store loop would, for
+	// a Simulation
+	simulatedExecution
+)
+
+type Config struct {
+	Engine    StorageEngine
+	Execution ExecutionMode
+	// MaxBatchSize caps how many queued commands the store loop processes
+	// per iteration. Zero means DefaultMaxBatchSize.
+	MaxBatchSize int
+	// BufferSize is the capacity of the store's input queue. Zero keeps the
+	// queue unbuffered.
+	BufferSize     int
+	Backpressure   BackpressurePolicy
+	EnqueueTimeout time.Duration
+	// ConcurrentReads lets Gets read the engine from the caller's goroutine
+	// instead of queueing behind writes. It is ignored unless the engine
+	// implements ConcurrentReader and reports support.
+	ConcurrentReads bool
+	// TrackAccess records when each key was last read or written, as
+	// reported by Object and IdleTime. It costs a little time on every Get
+	// and Set and memory for every key.
+	TrackAccess bool
+	// TrackFrequency counts how often each key is read or written, as
+	// reported by Object, Frequency and HottestKeys. Like TrackAccess it
+	// costs a little time on every access and memory for every key.
+	TrackFrequency bool
+	// FrequencyDecay is how often access counts are halved. Zero means
+	// DefaultFrequencyDecay.
+	FrequencyDecay time.Duration
+	// TTLJitter spreads out expiry deadlines so keys given the same one do
+	// not all expire at once: each deadline set by ExpireAt is pushed back by
+	// a random amount up to this fraction of its remaining time. Zero
+	// disables jitter.
+	TTLJitter float64
+	// TTLPolicies give the keys under each prefix a default or maximum
+	// TTL, or keep them from expiring. Policies that contradict themselves,
+	// as ValidateTTLPolicies reports, are applied as they are.
+	TTLPolicies []TTLPolicy
+	// ExpirySweep configures the active expiry sweeper, which removes
+	// expired keys nothing touches. The zero value leaves them to be
+	// removed when next touched.
+	ExpirySweep ExpirySweep
+	// History keeps the values keys held within a recent window, so they
+	// can be read as they were with GetAsOf. The zero value keeps none.
+	History History
+	// TombstoneGrace is how long deleted keys are remembered, so a replica
+	// that syncs from scratch within it deletes its copies of them too.
+	// Zero remembers none.
+	TombstoneGrace time.Duration
+	// ReplicationBacklog is roughly how many bytes of recent changes are kept
+	// once a replica has connected, so a replica that loses its connection
+	// briefly can resume from where it was instead of syncing from scratch.
+	// Like a connected replica, it serialises writes under DirectExecution.
+	// Zero disables the backlog.
+	ReplicationBacklog int
+	// CRDTNamespaces lists the key prefixes that hold conflict-free
+	// replicated counters and sets. Only keys under them accept the
+	// PNCounter and ORSet commands, and only they are merged by
+	// MergeMutations.
+	CRDTNamespaces []string
+	// CRDTActor names this store in the counters and sets it updates. It
+	// must be unique among the stores merging each other's changes and
+	// should stay the same across restarts, or every restart adds another
+	// actor to each value it updates. Empty uses the replication ID.
+	CRDTActor string
+	// Logger receives the store's messages. Nil uses the standard logger.
+	Logger *log.Logger
+	// Clock is the time expiry deadlines and access times are measured
+	// against. Nil uses time.Now.
+	Clock func() time.Time
+	// MaxKeyLength and MaxValueSize cap, in bytes, the keys and values
+	// written. Zero leaves them unbounded.
+	MaxKeyLength int
+	MaxValueSize int
+	// KeyPolicy restricts the characters keys may be written with. Nil
+	// allows any key that is not blank; blank keys are always refused.
+	KeyPolicy KeyPolicy
+
+	// random is a Simulation's seeded source, drawn on instead of the
+	// global one
+	random *rand.Rand
+}
+
+type KeyValueService struct {
+	input          chan KeyValueCommand
+	store          *KeyValueStore
+	execution      ExecutionMode
+	backpressure   BackpressurePolicy
+	enqueueTimeout time.Duration
+	fastReads      bool
+	overloaded     atomic.Uint64
+	closed         atomic.Bool
+	// admission is held for reading by every command from the moment it is
+	// admitted until it is queued, or run when it is not queued, so Shutdown
+	// can tell when no more commands are on their way to the store
+	admission   sync.RWMutex
+	readOnly    atomic.Bool
+	maintenance maintenanceGate
+	started     time.Time
+	close       context.CancelFunc
+}
+
+var (
+	ErrReadOnly = errors.New("KeyValueService is in read-only mode")
+	ErrClosed   = errors.New("KeyValueService has been closed")
+)
+
+var (
+	instance *KeyValueService
+	once     sync.Once
+)
+
+// Output channels are handed back to the pool once their single result has
+// been received, so steady-state traffic does not allocate a channel per
+// command.
+var outputChannelPool = sync.Pool{
+	New: func() any {
+		return make(chan KeyValueOutput)
+	},
+}
+
+func GetKeyValueService(ctx context.Context, close context.CancelFunc) *KeyValueService {
+	return GetKeyValueServiceWithEngine(ctx, close, NewMemoryEngine())
+}
+
+func GetKeyValueServiceWithEngine(ctx context.Context, close context.CancelFunc, engine StorageEngine) *KeyValueService {
+	return GetKeyValueServiceWithConfig(ctx, close, Config{Engine: engine})
+}
+
+// GetKeyValueServiceWithConfig returns the process-wide service, starting it
+// from config on the first call. Later calls return the same service and
+// ignore their arguments; NewKeyValueService builds independent ones.
+func GetKeyValueServiceWithConfig(ctx context.Context, close context.CancelFunc, config Config) *KeyValueService {
+	once.Do(func() {
+		instance = newKeyValueService(ctx, close, config)
+	})
+	return instance
+}
+
+func newKeyValueService(ctx context.Context, close context.CancelFunc, config Config) *KeyValueService {
+	logger := config.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+	engine := config.Engine
+	if engine == nil {
+		if config.Execution == DirectExecution {
+			engine = NewShardedEngine(DefaultShardCount)
+		} else {
+			engine = NewMemoryEngine()
+		}
+	}
+
+	fastReads := false
+	if config.ConcurrentReads {
+		if reader, ok := engine.(ConcurrentReader); ok && reader.SupportsConcurrentReads() {
+			fastReads = true
+		} else {
+			logger.Println("Storage engine does not support concurrent reads, serving reads from the store loop")
+		}
+	}
+
+	input := make(chan KeyValueCommand, max(config.BufferSize, 0))
+	store := newKeyValueStore(engine, config.MaxBatchSize)
+	store.logger = logger
+	store.now = config.Clock
+	store.trackAccess = config.TrackAccess
+	store.accesses.since = store.currentTime().UnixNano()
+	store.trackFrequency = config.TrackFrequency
+	store.frequencies.decay = int64(config.FrequencyDecay)
+	if config.FrequencyDecay <= 0 {
+		store.frequencies.decay = int64(DefaultFrequencyDecay)
+	}
+	if config.random != nil {
+		store.random = config.random
+		store.replication.id = seededReplicationID(config.random)
+		store.stopwatch = store.currentTime
+	}
+	store.ttlJitter = max(config.TTLJitter, 0)
+	store.limits.Store(&keyLimits{max(config.MaxKeyLength, 0), max(config.MaxValueSize, 0), config.KeyPolicy})
+	store.ttlPolicies.Store(newTTLPolicies(config.TTLPolicies))
+	store.replication.backlog.limit = max(config.ReplicationBacklog, 0)
+	store.crdtNamespaces = config.CRDTNamespaces
+	store.crdtActor = config.CRDTActor
+	if store.crdtActor == "" {
+		store.crdtActor = store.replication.id
+	}
+	if config.Execution != DirectExecution && config.ExpirySweep.Interval > 0 {
+		sweep := config.ExpirySweep.withDefaults()
+		store.sweep.config.Store(&sweep)
+	}
+	store.history.set(config.History, store.currentTime().UnixNano())
+	store.tombstones.setGrace(config.TombstoneGrace)
+	if err := store.loadDeadlines(); err != nil {
+		logger.Printf("Error loading expiry deadlines: %v", err)
+	}
+	if config.Execution != simulatedExecution {
+		go store.Start(input, ctx)
+	}
+	return &KeyValueService{
+		input:          input,
+		store:          store,
+		execution:      config.Execution,
+		backpressure:   config.Backpressure,
+		enqueueTimeout: config.EnqueueTimeout,
+		fastReads:      fastReads,
+		started:        time.Now(),
+		close:          close,
+	}
+}
+
+// DefaultCloseTimeout bounds how long Close waits for queued commands.
+const DefaultCloseTimeout = 5 * time.Second
+
+// Close shuts the service down as Shutdown does, giving queued commands up
+// to DefaultCloseTimeout to finish.
+func (kvService *KeyValueService) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultCloseTimeout)
+	defer cancel()
+	if err := kvService.Shutdown(ctx); err != nil {
+		kvService.store.logger.Printf("Closing the key value service: %v", err)
+	}
+}
+
+// Shutdown stops accepting commands, failing new ones with ErrClosed, and
+// waits for those already accepted to finish before closing the storage
+// engine, which writes out anything it buffers. If ctx is done first, the
+// store is stopped anyway and ctx's error returned; commands still queued
+// then are processed before the engine is closed, but without waiting.
+func (kvService *KeyValueService) Shutdown(ctx context.Context) error {
+	kvService.closed.Store(true)
+
+	admitted := make(chan struct{})
+	go func() {
+		kvService.admission.Lock()
+		kvService.admission.Unlock()
+		close(admitted)
+	}()
+	var err error
+	select {
+	case <-admitted:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	kvService.close()
+	if err != nil {
+		return err
+	}
+	select {
+	case <-kvService.store.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (kvService *KeyValueService) CheckActive() error {
+	if kvService.closed.Load() {
+		return ErrClosed
+	}
+	return nil
+}
+
+// admit lets a command through unless the service is closed. A command
+// admitted must call admission.RUnlock once it is queued or done.
+func (kvService *KeyValueService) admit() bool {
+	// Checked first too, so nothing queues up behind a Shutdown that gave
+	// up waiting for admission
+	if kvService.closed.Load() {
+		return false
+	}
+	kvService.admission.RLock()
+	if kvService.closed.Load() {
+		kvService.admission.RUnlock()
+		return false
+	}
+	return true
+}
+
+// SetReadOnly toggles read-only mode. While enabled, mutations fail with
+// ErrReadOnly and reads are served as usual.
+func (kvService *KeyValueService) SetReadOnly(readOnly bool) {
+	kvService.readOnly.Store(readOnly)
+}
+
+func (kvService *KeyValueService) IsReadOnly() bool {
+	return kvService.readOnly.Load()
+}
+
+func (kvService *KeyValueService) CheckWritable() error {
+	if err := kvService.CheckActive(); err != nil {
+		return err
+	}
+	if kvService.readOnly.Load() {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+func (kvService *KeyValueService) Set(key string, value string) (*string, error) {
+	return kvService.SetContext(context.Background(), key, value)
+}
+
+func (kvService *KeyValueService) Delete(key string) (*string, error) {
+	return kvService.DeleteContext(context.Background(), key)
+}
+
+// Get returns the value stored under key. Strings are immutable, so the
+// returned value shares its bytes with the store rather than copying them;
+// only the small string header behind the pointer is allocated per call.
+func (kvService *KeyValueService) Get(key string) (*string, error) {
+	return kvService.GetContext(context.Background(), key)
+}
+
+func (kvService *KeyValueService) BatchStats() BatchStats {
+	return kvService.store.BatchStats()
+}
+
+// dispatchRead takes the concurrent read fast path when it is enabled and
+// otherwise queues the command like any other.
+func (kvService *KeyValueService) dispatchRead(command KeyValueCommand) KeyValueOutput {
+	if kvService.fastReads && kvService.execution == ActorExecution {
+		if !kvService.admit() {
+			return KeyValueOutput{false, nil, ErrClosed, 0}
+		}
+		res := kvService.store.processRead(command)
+		kvService.admission.RUnlock()
+		return res
+	}
+	return kvService.dispatch(command)
+}
+
+func (kvService *KeyValueService) dispatch(command KeyValueCommand) KeyValueOutput {
+	if !kvService.admit() {
+		return KeyValueOutput{false, nil, ErrClosed, 0}
+	}
+	if kvService.execution == DirectExecution {
+		command.concurrent = true
+		res := kvService.store.process(command)
+		kvService.admission.RUnlock()
+		return res
+	}
+	if kvService.execution == simulatedExecution {
+		kvService.store.lock.Lock()
+		res := kvService.store.process(command)
+		kvService.store.lock.Unlock()
+		kvService.admission.RUnlock()
+		return res
+	}
+
+	output := outputChannelPool.Get().(chan KeyValueOutput)
+	command.output = output
+	err := kvService.enqueue(command)
+	kvService.admission.RUnlock()
+	if err != nil {
+		outputChannelPool.Put(output)
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	res := <-output
+	outputChannelPool.Put(output)
+
+	return res
+}
@@ -1,261 +1,475 @@
-package kvstore
-
-import (
-	"context"
-	"fmt"
-	"slices"
-	"sync"
-	"testing"
-)
-
-func deref(s *string) string {
-	if s == nil {
-		return "<nil>"
-	}
-	return *s
-}
-
-func newTestKeyValueService(t *testing.T) *KeyValueService {
-	t.Helper()
-
-	// reset the singleton for a clean state per test
-	instance = nil
-	once = sync.Once{}
-
-	ctx, cancel := context.WithCancel(context.Background())
-	t.Cleanup(cancel)
-
-	return GetKeyValueService(ctx, cancel)
-}
-
-func TestSetAndGet_ReturnsSameValue(t *testing.T) {
-	store := newTestKeyValueService(t)
-
-	key := "foo"
-	value := "bar"
-
-	setVal, err := store.Set(key, value)
-	if err != nil {
-		t.Fatalf("Set(%q, %q) returned error: %v", key, value, err)
-	}
-	if setVal == nil {
-		t.Fatalf("Set(%q, %q) returned nil value", key, value)
-	}
-	if *setVal != value {
-		t.Fatalf("Set(%q, %q) = %q, want %q", key, value, *setVal, value)
-	}
-
-	got, err := store.Get(key)
-	if err != nil {
-		t.Fatalf("Get(%q) returned error: %v", key, err)
-	}
-	if got == nil {
-		t.Fatalf("Get(%q) returned nil value", key)
-	}
-	if *got != value {
-		t.Fatalf("Get(%q) = %q, want %q", key, *got, value)
-	}
-}
-
-func TestGet_MissingKey_ReturnsError(t *testing.T) {
-	store := newTestKeyValueService(t)
-
-	key := "does-not-exist"
-
-	got, err := store.Get(key)
-	if err == nil {
-		t.Fatalf("Get(%q) expected error for missing key, got nil", key)
-	}
-	if got != nil {
-		t.Fatalf("Get(%q) expected nil value for missing key, got %q", key, *got)
-	}
-}
-
-func TestSet_OverwritesExistingValue(t *testing.T) {
-	store := newTestKeyValueService(t)
-
-	key := "foo"
-	first := "bar"
-	second := "baz"
-
-	if _, err := store.Set(key, first); err != nil {
-		t.Fatalf("Set(%q, %q) returned error: %v", key, first, err)
-	}
-
-	if _, err := store.Set(key, second); err != nil {
-		t.Fatalf("Set(%q, %q) returned error: %v", key, second, err)
-	}
-
-	got, err := store.Get(key)
-	if err != nil {
-		t.Fatalf("Get(%q) returned error: %v", key, err)
-	}
-	if got == nil || *got != second {
-		t.Fatalf("Get(%q) = %v, want %q", key, deref(got), second)
-	}
-}
-
-func TestDelete_ExistingKey_RemovesAndReturnsValue(t *testing.T) {
-	store := newTestKeyValueService(t)
-
-	key := "foo"
-	value := "bar"
-
-	if _, err := store.Set(key, value); err != nil {
-		t.Fatalf("Set(%q, %q) returned error: %v", key, value, err)
-	}
-
-	deleted, err := store.Delete(key)
-	if err != nil {
-		t.Fatalf("Delete(%q) returned error: %v", key, err)
-	}
-	if deleted == nil || *deleted != value {
-		t.Fatalf("Delete(%q) = %v, want %q", key, deref(deleted), value)
-	}
-
-	// ensure it's gone
-	got, err := store.Get(key)
-	if err == nil {
-		t.Fatalf("Get(%q) after Delete expected error, got nil", key)
-	}
-	if got != nil {
-		t.Fatalf("Get(%q) after Delete expected nil value, got %q", key, *got)
-	}
-}
-
-func TestDelete_MissingKey_SucceedsWithNilValue(t *testing.T) {
-	store := newTestKeyValueService(t)
-
-	key := "does-not-exist"
-
-	deleted, err := store.Delete(key)
-	if err != nil {
-		t.Fatalf("Delete(%q) expected nil error for missing key, got %v", key, err)
-	}
-	if deleted != nil {
-		t.Fatalf("Delete(%q) expected nil value for missing key, got %q", key, *deleted)
-	}
-}
-
-func TestClose_PreventsFurtherOperations(t *testing.T) {
-	store := newTestKeyValueService(t)
-
-	store.Close()
-
-	// all operations should now fail with CheckActive error
-	if _, err := store.Set("k", "v"); err == nil {
-		t.Fatalf("Set after Close() expected error, got nil")
-	}
-
-	if _, err := store.Get("k"); err == nil {
-		t.Fatalf("Get after Close() expected error, got nil")
-	}
-
-	if _, err := store.Delete("k"); err == nil {
-		t.Fatalf("Delete after Close() expected error, got nil")
-	}
-}
-
-func TestGetCommandTypeString(t *testing.T) {
-	tests := []struct {
-		input int
-		want  string
-	}{
-		{PUT, "PUT"},
-		{DELETE, "DELETE"},
-		{GET, "GET"},
-		{999, "UNKNOWN"},
-	}
-
-	for _, tt := range tests {
-		got := GetCommandTypeString(tt.input)
-		if got != tt.want {
-			t.Errorf("GetCommandTypeString(%d) = %q, want %q", tt.input, got, tt.want)
-		}
-	}
-}
-
-func TestConcurrentSetsAndGets(t *testing.T) {
-	store := newTestKeyValueService(t)
-
-	const numGoroutines = 50
-	const keysPerGoroutine = 20
-
-	var wg sync.WaitGroup
-	wg.Add(numGoroutines)
-
-	for i := range numGoroutines {
-		go func(id int) {
-			defer wg.Done()
-			for j := range keysPerGoroutine {
-				key := fmt.Sprintf("k-%d-%d", id, j)
-				val := fmt.Sprintf("v-%d-%d", id, j)
-
-				if _, err := store.Set(key, val); err != nil {
-					t.Errorf("goroutine %d: Set(%q, %q) returned error: %v", id, key, val, err)
-					return
-				}
-			}
-		}(i)
-	}
-
-	wg.Wait()
-
-	for i := range numGoroutines {
-		for j := range keysPerGoroutine {
-			key := fmt.Sprintf("k-%d-%d", i, j)
-			want := fmt.Sprintf("v-%d-%d", i, j)
-
-			got, err := store.Get(key)
-			if err != nil {
-				t.Fatalf("Get(%q) returned error: %v", key, err)
-			}
-			if got == nil || *got != want {
-				t.Fatalf("Get(%q) = %v, want %q", key, deref(got), want)
-			}
-		}
-	}
-}
-
-func TestConcurrentSetSameKey(t *testing.T) {
-	store := newTestKeyValueService(t)
-
-	const numGoroutines = 100
-	key := "shared-key"
-
-	var wg sync.WaitGroup
-	wg.Add(numGoroutines)
-
-	values := make([]string, numGoroutines)
-	for i := 0; i < numGoroutines; i++ {
-		values[i] = fmt.Sprintf("value-%d", i)
-	}
-
-	// many goroutines writing different values to the same key
-	for i := 0; i < numGoroutines; i++ {
-		v := values[i]
-		go func(val string) {
-			defer wg.Done()
-			if _, err := store.Set(key, val); err != nil {
-				t.Errorf("Set(%q, %q) returned error: %v", key, val, err)
-			}
-		}(v)
-	}
-
-	wg.Wait()
-
-	// final value must be one of the values we wrote, and no error
-	got, err := store.Get(key)
-	if err != nil {
-		t.Fatalf("Get(%q) returned error: %v", key, err)
-	}
-	if got == nil {
-		t.Fatalf("Get(%q) returned nil value", key)
-	}
-
-	final := *got
-	found := slices.Contains(values, final)
-	if !found {
-		t.Fatalf("Final value %q for key %q was not one of the written values", final, key)
-	}
-}
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func deref(s *string) string {
+	if s == nil {
+		return "<nil>"
+	}
+	return *s
+}
+
+func newTestKeyValueService(t *testing.T) *KeyValueService {
+	t.Helper()
+
+	// reset the singleton for a clean state per test
+	instance = nil
+	once = sync.Once{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	return GetKeyValueService(ctx, cancel)
+}
+
+func newTestKeyValueServiceWithConfig(t testing.TB, config Config) *KeyValueService {
+	t.Helper()
+
+	instance = nil
+	once = sync.Once{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	return GetKeyValueServiceWithConfig(ctx, cancel, config)
+}
+
+func TestSetAndGet_ReturnsSameValue(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	key := "foo"
+	value := "bar"
+
+	setVal, err := store.Set(key, value)
+	if err != nil {
+		t.Fatalf("Set(%q, %q) returned error: %v", key, value, err)
+	}
+	if setVal == nil {
+		t.Fatalf("Set(%q, %q) returned nil value", key, value)
+	}
+	if *setVal != value {
+		t.Fatalf("Set(%q, %q) = %q, want %q", key, value, *setVal, value)
+	}
+
+	got, err := store.Get(key)
+	if err != nil {
+		t.Fatalf("Get(%q) returned error: %v", key, err)
+	}
+	if got == nil {
+		t.Fatalf("Get(%q) returned nil value", key)
+	}
+	if *got != value {
+		t.Fatalf("Get(%q) = %q, want %q", key, *got, value)
+	}
+}
+
+func TestGet_MissingKey_ReturnsError(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	key := "does-not-exist"
+
+	got, err := store.Get(key)
+	if err == nil {
+		t.Fatalf("Get(%q) expected error for missing key, got nil", key)
+	}
+	if got != nil {
+		t.Fatalf("Get(%q) expected nil value for missing key, got %q", key, *got)
+	}
+}
+
+func TestSet_OverwritesExistingValue(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	key := "foo"
+	first := "bar"
+	second := "baz"
+
+	if _, err := store.Set(key, first); err != nil {
+		t.Fatalf("Set(%q, %q) returned error: %v", key, first, err)
+	}
+
+	if _, err := store.Set(key, second); err != nil {
+		t.Fatalf("Set(%q, %q) returned error: %v", key, second, err)
+	}
+
+	got, err := store.Get(key)
+	if err != nil {
+		t.Fatalf("Get(%q) returned error: %v", key, err)
+	}
+	if got == nil || *got != second {
+		t.Fatalf("Get(%q) = %v, want %q", key, deref(got), second)
+	}
+}
+
+func TestDelete_ExistingKey_RemovesAndReturnsValue(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	key := "foo"
+	value := "bar"
+
+	if _, err := store.Set(key, value); err != nil {
+		t.Fatalf("Set(%q, %q) returned error: %v", key, value, err)
+	}
+
+	deleted, err := store.Delete(key)
+	if err != nil {
+		t.Fatalf("Delete(%q) returned error: %v", key, err)
+	}
+	if deleted == nil || *deleted != value {
+		t.Fatalf("Delete(%q) = %v, want %q", key, deref(deleted), value)
+	}
+
+	// ensure it's gone
+	got, err := store.Get(key)
+	if err == nil {
+		t.Fatalf("Get(%q) after Delete expected error, got nil", key)
+	}
+	if got != nil {
+		t.Fatalf("Get(%q) after Delete expected nil value, got %q", key, *got)
+	}
+}
+
+func TestDelete_MissingKey_SucceedsWithNilValue(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	key := "does-not-exist"
+
+	deleted, err := store.Delete(key)
+	if err != nil {
+		t.Fatalf("Delete(%q) expected nil error for missing key, got %v", key, err)
+	}
+	if deleted != nil {
+		t.Fatalf("Delete(%q) expected nil value for missing key, got %q", key, *deleted)
+	}
+}
+
+func TestClose_PreventsFurtherOperations(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	store.Close()
+
+	// all operations should now fail with CheckActive error
+	if _, err := store.Set("k", "v"); err == nil {
+		t.Fatalf("Set after Close() expected error, got nil")
+	}
+
+	if _, err := store.Get("k"); err == nil {
+		t.Fatalf("Get after Close() expected error, got nil")
+	}
+
+	if _, err := store.Delete("k"); err == nil {
+		t.Fatalf("Delete after Close() expected error, got nil")
+	}
+}
+
+// stallingEngine holds up the first Set until release is closed, keeping
+// the store loop busy while commands queue behind it.
+type stallingEngine struct {
+	*MemoryEngine
+	stalled chan struct{}
+	release chan struct{}
+	once    sync.Once
+	closed  atomic.Bool
+}
+
+func newStallingEngine() *stallingEngine {
+	return &stallingEngine{MemoryEngine: NewMemoryEngine(), stalled: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (engine *stallingEngine) Set(key string, value TypedValue) error {
+	engine.once.Do(func() {
+		close(engine.stalled)
+		<-engine.release
+	})
+	return engine.MemoryEngine.Set(key, value)
+}
+
+func (engine *stallingEngine) Close() error {
+	engine.closed.Store(true)
+	return nil
+}
+
+func TestClose_FinishesQueuedCommands(t *testing.T) {
+	engine := newStallingEngine()
+	store := newTestKeyValueServiceWithConfig(t, Config{Engine: engine, BufferSize: 8})
+
+	errs := make(chan error, 3)
+	go func() {
+		_, err := store.Set("a", "1")
+		errs <- err
+	}()
+	<-engine.stalled
+	for _, key := range []string{"b", "c"} {
+		go func() {
+			_, err := store.Set(key, "1")
+			errs <- err
+		}()
+	}
+	for store.QueueDepth() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		store.Close()
+		close(closed)
+	}()
+	// Commands are refused as soon as Close is called
+	for store.CheckActive() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := store.Set("d", "1"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Set during Close returned %v, want ErrClosed", err)
+	}
+	close(engine.release)
+	<-closed
+
+	for range 3 {
+		if err := <-errs; err != nil {
+			t.Fatalf("Set queued before Close returned error: %v", err)
+		}
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if _, ok, _ := engine.MemoryEngine.Get(key); !ok {
+			t.Fatalf("key %s queued before Close was not written", key)
+		}
+	}
+	if !engine.closed.Load() {
+		t.Fatalf("Close returned before closing the engine")
+	}
+}
+
+func TestShutdown_GivesUpWhenContextEnds(t *testing.T) {
+	engine := newStallingEngine()
+	store := newTestKeyValueServiceWithConfig(t, Config{Engine: engine})
+	go func() { _, _ = store.Set("a", "1") }()
+	<-engine.stalled
+	defer close(engine.release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := store.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown returned %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestGetCommandTypeString(t *testing.T) {
+	tests := []struct {
+		input int
+		want  string
+	}{
+		{PUT, "PUT"},
+		{DELETE, "DELETE"},
+		{GET, "GET"},
+		{BATCH, "BATCH"},
+		{EXPIREAT, "EXPIREAT"},
+		{PERSIST, "PERSIST"},
+		{TTL, "TTL"},
+		{OBJECT, "OBJECT"},
+		{CMSINIT, "CMSINIT"},
+		{CMSINCRBY, "CMSINCRBY"},
+		{CMSQUERY, "CMSQUERY"},
+		{CMSMERGE, "CMSMERGE"},
+		{LOCK, "LOCK"},
+		{UNLOCK, "UNLOCK"},
+		{LEASEGRANT, "LEASEGRANT"},
+		{LEASEATTACH, "LEASEATTACH"},
+		{LEASEKEEPALIVE, "LEASEKEEPALIVE"},
+		{LEASEREVOKE, "LEASEREVOKE"},
+		{TXPREPARE, "TXPREPARE"},
+		{TXCOMMIT, "TXCOMMIT"},
+		{TXABORT, "TXABORT"},
+		{WRITEBATCH, "WRITEBATCH"},
+		{SNAPSHOT, "SNAPSHOT"},
+		{SNAPSHOTGET, "SNAPSHOTGET"},
+		{SNAPSHOTKEYS, "SNAPSHOTKEYS"},
+		{KEYSPACE, "KEYSPACE"},
+		{RANDOMKEYS, "RANDOMKEYS"},
+		{REPLICATE, "REPLICATE"},
+		{APPLYMUTATIONS, "APPLYMUTATIONS"},
+		{PNCOUNTERINCRBY, "PNCOUNTERINCRBY"},
+		{PNCOUNTERGET, "PNCOUNTERGET"},
+		{ORSETADD, "ORSETADD"},
+		{ORSETREMOVE, "ORSETREMOVE"},
+		{ORSETMEMBERS, "ORSETMEMBERS"},
+		{MERGEMUTATIONS, "MERGEMUTATIONS"},
+		{GETASOF, "GETASOF"},
+		{SETNX, "SETNX"},
+		{SETIFEQUAL, "SETIFEQUAL"},
+		{APPEND, "APPEND"},
+		{STRLEN, "STRLEN"},
+		{GETRANGE, "GETRANGE"},
+		{SETRANGE, "SETRANGE"},
+		{HSET, "HSET"},
+		{HGET, "HGET"},
+		{HDEL, "HDEL"},
+		{HGETALL, "HGETALL"},
+		{HINCRBY, "HINCRBY"},
+		{HLEN, "HLEN"},
+		{HEXISTS, "HEXISTS"},
+		{LPUSH, "LPUSH"},
+		{RPUSH, "RPUSH"},
+		{LPOP, "LPOP"},
+		{RPOP, "RPOP"},
+		{LRANGE, "LRANGE"},
+		{LINDEX, "LINDEX"},
+		{LLEN, "LLEN"},
+		{999, "UNKNOWN"},
+	}
+
+	for _, tt := range tests {
+		got := GetCommandTypeString(tt.input)
+		if got != tt.want {
+			t.Errorf("GetCommandTypeString(%d) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestConcurrentSetsAndGets(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	const numGoroutines = 50
+	const keysPerGoroutine = 20
+
+	var wg sync.WaitGroup
+	wg.Add(numGoroutines)
+
+	for i := range numGoroutines {
+		go func(id int) {
+			defer wg.Done()
+			for j := range keysPerGoroutine {
+				key := fmt.Sprintf("k-%d-%d", id, j)
+				val := fmt.Sprintf("v-%d-%d", id, j)
+
+				if _, err := store.Set(key, val); err != nil {
+					t.Errorf("goroutine %d: Set(%q, %q) returned error: %v", id, key, val, err)
+					return
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	for i := range numGoroutines {
+		for j := range keysPerGoroutine {
+			key := fmt.Sprintf("k-%d-%d", i, j)
+			want := fmt.Sprintf("v-%d-%d", i, j)
+
+			got, err := store.Get(key)
+			if err != nil {
+				t.Fatalf("Get(%q) returned error: %v", key, err)
+			}
+			if got == nil || *got != want {
+				t.Fatalf("Get(%q) = %v, want %q", key, deref(got), want)
+			}
+		}
+	}
+}
+
+func TestConcurrentSetSameKey(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	const numGoroutines = 100
+	key := "shared-key"
+
+	var wg sync.WaitGroup
+	wg.Add(numGoroutines)
+
+	values := make([]string, numGoroutines)
+	for i := 0; i < numGoroutines; i++ {
+		values[i] = fmt.Sprintf("value-%d", i)
+	}
+
+	// many goroutines writing different values to the same key
+	for i := 0; i < numGoroutines; i++ {
+		v := values[i]
+		go func(val string) {
+			defer wg.Done()
+			if _, err := store.Set(key, val); err != nil {
+				t.Errorf("Set(%q, %q) returned error: %v", key, val, err)
+			}
+		}(v)
+	}
+
+	wg.Wait()
+
+	// final value must be one of the values we wrote, and no error
+	got, err := store.Get(key)
+	if err != nil {
+		t.Fatalf("Get(%q) returned error: %v", key, err)
+	}
+	if got == nil {
+		t.Fatalf("Get(%q) returned nil value", key)
+	}
+
+	final := *got
+	found := slices.Contains(values, final)
+	if !found {
+		t.Fatalf("Final value %q for key %q was not one of the written values", final, key)
+	}
+}
+
+func TestReadOnly_RejectsMutationsAndServesReads(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	if _, err := store.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+
+	store.SetReadOnly(true)
+	if !store.IsReadOnly() {
+		t.Fatalf("IsReadOnly() = false after SetReadOnly(true)")
+	}
+
+	if _, err := store.Set("foo", "baz"); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Set in read-only mode returned %v, want ErrReadOnly", err)
+	}
+	if _, err := store.Delete("foo"); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Delete in read-only mode returned %v, want ErrReadOnly", err)
+	}
+
+	got, err := store.Get("foo")
+	if err != nil || got == nil || *got != "bar" {
+		t.Fatalf("Get in read-only mode = (%v, %v), want %q", deref(got), err, "bar")
+	}
+
+	store.SetReadOnly(false)
+	if _, err := store.Set("foo", "baz"); err != nil {
+		t.Fatalf("Set after leaving read-only mode returned error: %v", err)
+	}
+}
+
+func TestOperations_DoNotAllocateOutputChannels(t *testing.T) {
+	store := newTestKeyValueService(t)
+	if _, err := store.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+
+	// Only the returned *string may be heap allocated; the output channel
+	// comes from the pool.
+	tests := []struct {
+		name string
+		op   func()
+		max  float64
+	}{
+		{"Set", func() { _, _ = store.Set("foo", "bar") }, 1},
+		{"Get", func() { _, _ = store.Get("foo") }, 1},
+		{"Delete missing", func() { _, _ = store.Delete("missing") }, 0},
+	}
+
+	for _, tt := range tests {
+		if got := testing.AllocsPerRun(100, tt.op); got > tt.max {
+			t.Errorf("%s allocated %v times per run, want at most %v", tt.name, got, tt.max)
+		}
+	}
+}
@@ -1,83 +1,476 @@
-package kvstore
-
-import (
-	"context"
-	"fmt"
-)
-
-type KeyValueStore struct {
-	store map[string]string
-}
-
-func InitKeyValueStore(input chan KeyValueCommand, ctx context.Context) {
-	store := KeyValueStore{make(map[string]string)}
-	go store.Start(input, ctx)
-}
-
-func (kvStore KeyValueStore) Start(input chan KeyValueCommand, ctx context.Context) {
-	for {
-		select {
-		case msg := <-input:
-			kvStore.ProcessCommand(msg)
-		case <-ctx.Done():
-			fmt.Println("Key value store shutting down")
-			return
-		}
-	}
-}
-
-func (kvStore KeyValueStore) ProcessCommand(command KeyValueCommand) {
-
-	switch command.commandType {
-	case PUT:
-		kvStore.ProcessPutCommand(command)
-	case GET:
-		kvStore.ProcessGetCommand(command)
-	case DELETE:
-		kvStore.ProcessDeleteCommand(command)
-	default:
-		command.output <- KeyValueOutput{false, nil, fmt.Errorf("command type %s not found", GetCommandTypeString(command.commandType))}
-	}
-}
-
-func (kvStore KeyValueStore) ProcessPutCommand(command KeyValueCommand) {
-	key := command.key
-	val := command.value
-	if val == nil {
-		command.output <- KeyValueOutput{false, nil, fmt.Errorf("value given was nil for put command")}
-	} else {
-		kvStore.store[key] = *val
-		command.output <- KeyValueOutput{true, val, nil}
-	}
-}
-
-func (kvStore KeyValueStore) ProcessGetCommand(command KeyValueCommand) {
-	key := command.key
-	if value, ok := kvStore.store[key]; ok {
-		command.output <- KeyValueOutput{true, &value, nil}
-	} else {
-		command.output <- KeyValueOutput{false, nil, fmt.Errorf("key %s does not exist in the store", key)}
-	}
-}
-
-func (kvStore KeyValueStore) ProcessDeleteCommand(command KeyValueCommand) {
-	key := command.key
-	if value, ok := kvStore.store[key]; ok {
-		delete(kvStore.store, key)
-		command.output <- KeyValueOutput{true, &value, nil}
-	} else {
-		command.output <- KeyValueOutput{true, nil, nil}
-	}
-}
-
-func GetCommandTypeString(commandType int) string {
-	switch commandType {
-	case PUT:
-		return "PUT"
-	case DELETE:
-		return "DELETE"
-	case GET:
-		return "GET"
-	}
-	return "UNKNOWN"
-}
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultMaxBatchSize = 64
+
+// ErrKeyNotFound is returned, wrapped with the key, when a read finds no
+// such key.
+var ErrKeyNotFound = errors.New("key does not exist in the store")
+
+func keyNotFound(key string) error {
+	return fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+}
+
+type KeyValueStore struct {
+	engine        StorageEngine
+	metrics       *CommandMetrics
+	hooks         hookRegistry
+	maxBatchSize  int
+	batches       batchCounters
+	expiries      expiryTable
+	notifications notificationBus
+	accesses      accessTable
+	trackAccess   bool
+	ttlJitter     float64
+	// sweep is the active expiry sweeper, run by the store loop
+	sweep        sweepState
+	history      historyTable
+	tombstones   tombstoneTable
+	deadlines    deadlineCounter
+	limits       atomic.Pointer[keyLimits]
+	ttlPolicies  atomic.Pointer[ttlPolicies]
+	keyLocks     keyMutexes
+	fencing      atomic.Uint64
+	leases       leaseTable
+	transactions transactionTable
+	snapshots    snapshotRegistry
+	replication  replicationFeed
+	// crdtNamespaces and crdtActor are set from Config.CRDTNamespaces and
+	// Config.CRDTActor
+	crdtNamespaces []string
+	crdtActor      string
+	// frequencies counts accesses to each key when trackFrequency is set
+	frequencies    frequencyTable
+	trackFrequency bool
+	// now is Config.Clock, the clock used for expiry and access times
+	now func() time.Time
+	// stopwatch times expiry sweeps against their budget. It is time.Now
+	// but in a Simulation, whose clock stands still while a sweep runs
+	stopwatch func() time.Time
+	// random is a Simulation's seeded source, or nil to use the global one
+	random *rand.Rand
+	logger *log.Logger
+	// stopped is closed once the store loop has exited and closed the engine
+	stopped chan struct{}
+	health  healthRecord
+	// lock is only contended when concurrent reads are enabled: the store
+	// loop holds it for writing while executing a batch, and fast-path Gets
+	// hold it for reading.
+	lock sync.RWMutex
+}
+
+type batchCounters struct {
+	batches  atomic.Uint64
+	commands atomic.Uint64
+}
+
+type BatchStats struct {
+	Batches  uint64
+	Commands uint64
+}
+
+func InitKeyValueStore(input chan KeyValueCommand, ctx context.Context, engine StorageEngine, maxBatchSize int) *KeyValueStore {
+	store := newKeyValueStore(engine, maxBatchSize)
+	go store.Start(input, ctx)
+	return store
+}
+
+func newKeyValueStore(engine StorageEngine, maxBatchSize int) *KeyValueStore {
+	if maxBatchSize < 1 {
+		maxBatchSize = DefaultMaxBatchSize
+	}
+	store := &KeyValueStore{engine: engine, metrics: NewCommandMetrics(), maxBatchSize: maxBatchSize, stopwatch: time.Now, logger: log.Default(), stopped: make(chan struct{})}
+	store.replication.id = newReplicationID()
+	store.sweep.changed = make(chan struct{}, 1)
+	return store
+}
+
+// Start runs the store loop. Each iteration takes one command and then
+// drains whatever else is already queued, up to maxBatchSize, so bursts are
+// processed as a single batch. Once ctx is done, commands still queued are
+// processed before the engine is closed, so none is left without a reply.
+func (kvStore *KeyValueStore) Start(input chan KeyValueCommand, ctx context.Context) {
+	defer close(kvStore.stopped)
+	kvStore.supervise(input, ctx)
+
+	kvStore.lock.Lock()
+	if err := kvStore.engine.Close(); err != nil {
+		kvStore.logger.Printf("Error closing storage engine: %v", err)
+	}
+	kvStore.lock.Unlock()
+}
+
+// processRead runs a read-only command on the caller's goroutine, in
+// parallel with other reads but never alongside a batch of writes.
+func (kvStore *KeyValueStore) processRead(command KeyValueCommand) KeyValueOutput {
+	kvStore.lock.RLock()
+	defer kvStore.lock.RUnlock()
+	command.concurrent = true
+	return kvStore.process(command)
+}
+
+func drainInput(input chan KeyValueCommand, batch []KeyValueCommand, maxBatchSize int) []KeyValueCommand {
+	for len(batch) < maxBatchSize {
+		select {
+		case msg := <-input:
+			batch = append(batch, msg)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+func (kvStore *KeyValueStore) ProcessCommand(command KeyValueCommand) {
+	kvStore.lock.Lock()
+	output := kvStore.process(command)
+	kvStore.lock.Unlock()
+
+	command.output <- output
+}
+
+// ProcessBatch executes every command in order before releasing any caller,
+// so per-batch work such as a log flush can be done once for the whole
+// batch. outputs is scratch space reused across calls.
+func (kvStore *KeyValueStore) ProcessBatch(batch []KeyValueCommand, outputs []KeyValueOutput) []KeyValueOutput {
+	kvStore.lock.Lock()
+	for _, command := range batch {
+		outputs = append(outputs, kvStore.process(command))
+	}
+	kvStore.lock.Unlock()
+
+	kvStore.batches.batches.Add(1)
+	kvStore.batches.commands.Add(uint64(len(batch)))
+
+	for i, command := range batch {
+		command.output <- outputs[i]
+	}
+	return outputs
+}
+
+func (kvStore *KeyValueStore) BatchStats() BatchStats {
+	return BatchStats{kvStore.batches.batches.Load(), kvStore.batches.commands.Load()}
+}
+
+func (stats BatchStats) AverageBatchSize() float64 {
+	if stats.Batches == 0 {
+		return 0
+	}
+	return float64(stats.Commands) / float64(stats.Batches)
+}
+
+// process runs a command through hooks, execution and metrics. It is called
+// from the store goroutine, or directly from callers under DirectExecution.
+// A command that panics fails with ErrPanicked rather than taking down the
+// goroutine running it.
+func (kvStore *KeyValueStore) process(command KeyValueCommand) (output KeyValueOutput) {
+	start := time.Now()
+	defer func() {
+		if value := recover(); value != nil {
+			output = KeyValueOutput{false, nil, kvStore.commandPanicked(command, value), 0}
+			kvStore.metrics.Record(command.commandType, time.Since(start), output.err)
+		}
+	}()
+	if output, skipped := kvStore.skipPastDeadline(command); skipped {
+		kvStore.metrics.Record(command.commandType, time.Since(start), output.err)
+		return output
+	}
+	hooks := kvStore.hooks.load()
+
+	if err := kvStore.runBeforeHooks(hooks, &command); err != nil {
+		output = KeyValueOutput{false, nil, err, 0}
+	} else if err := kvStore.limits.Load().check(command.commandType, command.key, command.value); err != nil {
+		output = KeyValueOutput{false, nil, err, 0}
+	} else if kvStore.conflicts(command) {
+		output = KeyValueOutput{false, nil, fmt.Errorf("writing key %s: %w", command.key, ErrTransactionConflict), 0}
+	} else {
+		output = kvStore.executeCommand(command)
+	}
+	kvStore.runAfterHooks(hooks, command, output)
+
+	kvStore.metrics.Record(command.commandType, time.Since(start), output.err)
+	return output
+}
+
+func (kvStore *KeyValueStore) executeCommand(command KeyValueCommand) KeyValueOutput {
+	switch command.commandType {
+	case PUT:
+		return kvStore.ProcessPutCommand(command)
+	case GET:
+		return kvStore.ProcessGetCommand(command)
+	case DELETE:
+		return kvStore.ProcessDeleteCommand(command)
+	case BATCH:
+		return kvStore.ProcessBatchCommand(command)
+	case EXPIREAT:
+		return kvStore.ProcessExpireAtCommand(command)
+	case PERSIST:
+		return kvStore.ProcessPersistCommand(command)
+	case TTL:
+		return kvStore.ProcessTTLCommand(command)
+	case OBJECT:
+		return kvStore.ProcessObjectCommand(command)
+	case CMSINIT, CMSINCRBY, CMSQUERY, CMSMERGE:
+		return kvStore.ProcessCountMinCommand(command)
+	case LOCK:
+		return kvStore.ProcessLockCommand(command)
+	case UNLOCK:
+		return kvStore.ProcessUnlockCommand(command)
+	case LEASEGRANT:
+		return kvStore.ProcessLeaseGrantCommand(command)
+	case LEASEATTACH:
+		return kvStore.ProcessLeaseAttachCommand(command)
+	case LEASEKEEPALIVE:
+		return kvStore.ProcessLeaseKeepAliveCommand(command)
+	case LEASEREVOKE:
+		return kvStore.ProcessLeaseRevokeCommand(command)
+	case TXPREPARE:
+		return kvStore.ProcessTxPrepareCommand(command)
+	case TXCOMMIT:
+		return kvStore.ProcessTxCommitCommand(command)
+	case TXABORT:
+		return kvStore.ProcessTxAbortCommand(command)
+	case WRITEBATCH:
+		return kvStore.ProcessWriteBatchCommand(command)
+	case SNAPSHOT:
+		return kvStore.ProcessSnapshotCommand(command)
+	case SNAPSHOTGET:
+		return kvStore.ProcessSnapshotGetCommand(command)
+	case SNAPSHOTKEYS:
+		return kvStore.ProcessSnapshotKeysCommand(command)
+	case KEYSPACE:
+		return kvStore.ProcessKeyspaceCommand(command)
+	case RANDOMKEYS:
+		return kvStore.ProcessRandomKeysCommand(command)
+	case REPLICATE:
+		return kvStore.ProcessReplicateCommand(command)
+	case APPLYMUTATIONS:
+		return kvStore.ProcessApplyMutationsCommand(command)
+	case PNCOUNTERINCRBY, PNCOUNTERGET, ORSETADD, ORSETREMOVE, ORSETMEMBERS:
+		return kvStore.ProcessCRDTCommand(command)
+	case MERGEMUTATIONS:
+		return kvStore.ProcessMergeMutationsCommand(command)
+	case GETASOF:
+		return kvStore.ProcessGetAsOfCommand(command)
+	case SETNX:
+		return kvStore.ProcessSetNXCommand(command)
+	case SETIFEQUAL:
+		return kvStore.ProcessSetIfEqualCommand(command)
+	case APPEND:
+		return kvStore.ProcessAppendCommand(command)
+	case STRLEN:
+		return kvStore.ProcessStrLenCommand(command)
+	case GETRANGE:
+		return kvStore.ProcessGetRangeCommand(command)
+	case SETRANGE:
+		return kvStore.ProcessSetRangeCommand(command)
+	case HSET, HGET, HDEL, HGETALL, HINCRBY, HLEN, HEXISTS:
+		return kvStore.ProcessHashCommand(command)
+	case LPUSH, RPUSH, LPOP, RPOP, LRANGE, LINDEX, LLEN:
+		return kvStore.ProcessListCommand(command)
+	}
+	return KeyValueOutput{false, nil, fmt.Errorf("command type %s not found", GetCommandTypeString(command.commandType)), 0}
+}
+
+func (kvStore *KeyValueStore) ProcessPutCommand(command KeyValueCommand) KeyValueOutput {
+	key := command.key
+	val := command.value
+	if val == nil {
+		return KeyValueOutput{false, nil, fmt.Errorf("value given was nil for put command"), 0}
+	}
+	// A TTL is checked against the key's policy before the value is
+	// written, so a refused one leaves the key as it was
+	var deadline int64
+	if command.ttl > 0 {
+		now := kvStore.currentTime()
+		command.expireAt = now.Add(command.ttl)
+		var err error
+		if deadline, err = kvStore.jittered(command, now); err == nil {
+			deadline, err = kvStore.policyDeadline(key, deadline, now)
+		}
+		if err != nil {
+			return KeyValueOutput{false, nil, err, 0}
+		}
+	}
+	if deadline == 0 {
+		deadline = kvStore.newDeadline(key)
+	}
+	if err := kvStore.setValueExpiring(key, stringValue(*val), deadline); err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	kvStore.touch(key)
+	return KeyValueOutput{true, val, nil, 0}
+}
+
+func (kvStore *KeyValueStore) ProcessGetCommand(command KeyValueCommand) KeyValueOutput {
+	key := command.key
+	if kvStore.expired(command) {
+		return KeyValueOutput{false, nil, keyNotFound(key), 0}
+	}
+	value, ok, err := kvStore.loadTyped(key, TypeString)
+	if err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	if !ok {
+		return KeyValueOutput{false, nil, keyNotFound(key), 0}
+	}
+	kvStore.touch(key)
+	return KeyValueOutput{true, stringPointer(value), nil, 0}
+}
+
+func (kvStore *KeyValueStore) ProcessDeleteCommand(command KeyValueCommand) KeyValueOutput {
+	key := command.key
+	expired := kvStore.pastDeadline(key)
+	value, ok, err := kvStore.deleteValue(key)
+	if err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	kvStore.forgetDeadline(key)
+	kvStore.forget(key)
+	if !ok || expired {
+		return KeyValueOutput{true, nil, nil, 0}
+	}
+	return KeyValueOutput{true, stringPointer(value.Data), nil, 0}
+}
+
+func (kvStore *KeyValueStore) currentTime() time.Time {
+	if kvStore.now != nil {
+		return kvStore.now()
+	}
+	return time.Now()
+}
+
+// stringPointer copies value to the heap. Taking the address of a local
+// directly would make the compiler heap-allocate it on every path, including
+// misses that never return it.
+func stringPointer(value string) *string {
+	return &value
+}
+
+func GetCommandTypeString(commandType int) string {
+	switch commandType {
+	case PUT:
+		return "PUT"
+	case DELETE:
+		return "DELETE"
+	case GET:
+		return "GET"
+	case BATCH:
+		return "BATCH"
+	case EXPIREAT:
+		return "EXPIREAT"
+	case PERSIST:
+		return "PERSIST"
+	case TTL:
+		return "TTL"
+	case OBJECT:
+		return "OBJECT"
+	case CMSINIT:
+		return "CMSINIT"
+	case CMSINCRBY:
+		return "CMSINCRBY"
+	case CMSQUERY:
+		return "CMSQUERY"
+	case CMSMERGE:
+		return "CMSMERGE"
+	case LOCK:
+		return "LOCK"
+	case UNLOCK:
+		return "UNLOCK"
+	case LEASEGRANT:
+		return "LEASEGRANT"
+	case LEASEATTACH:
+		return "LEASEATTACH"
+	case LEASEKEEPALIVE:
+		return "LEASEKEEPALIVE"
+	case LEASEREVOKE:
+		return "LEASEREVOKE"
+	case TXPREPARE:
+		return "TXPREPARE"
+	case TXCOMMIT:
+		return "TXCOMMIT"
+	case TXABORT:
+		return "TXABORT"
+	case WRITEBATCH:
+		return "WRITEBATCH"
+	case SNAPSHOT:
+		return "SNAPSHOT"
+	case SNAPSHOTGET:
+		return "SNAPSHOTGET"
+	case SNAPSHOTKEYS:
+		return "SNAPSHOTKEYS"
+	case KEYSPACE:
+		return "KEYSPACE"
+	case RANDOMKEYS:
+		return "RANDOMKEYS"
+	case REPLICATE:
+		return "REPLICATE"
+	case APPLYMUTATIONS:
+		return "APPLYMUTATIONS"
+	case PNCOUNTERINCRBY:
+		return "PNCOUNTERINCRBY"
+	case PNCOUNTERGET:
+		return "PNCOUNTERGET"
+	case ORSETADD:
+		return "ORSETADD"
+	case ORSETREMOVE:
+		return "ORSETREMOVE"
+	case ORSETMEMBERS:
+		return "ORSETMEMBERS"
+	case MERGEMUTATIONS:
+		return "MERGEMUTATIONS"
+	case GETASOF:
+		return "GETASOF"
+	case SETNX:
+		return "SETNX"
+	case SETIFEQUAL:
+		return "SETIFEQUAL"
+	case APPEND:
+		return "APPEND"
+	case STRLEN:
+		return "STRLEN"
+	case GETRANGE:
+		return "GETRANGE"
+	case SETRANGE:
+		return "SETRANGE"
+	case HSET:
+		return "HSET"
+	case HGET:
+		return "HGET"
+	case HDEL:
+		return "HDEL"
+	case HGETALL:
+		return "HGETALL"
+	case HINCRBY:
+		return "HINCRBY"
+	case HLEN:
+		return "HLEN"
+	case HEXISTS:
+		return "HEXISTS"
+	case LPUSH:
+		return "LPUSH"
+	case RPUSH:
+		return "RPUSH"
+	case LPOP:
+		return "LPOP"
+	case RPOP:
+		return "RPOP"
+	case LRANGE:
+		return "LRANGE"
+	case LINDEX:
+		return "LINDEX"
+	case LLEN:
+		return "LLEN"
+	}
+	return "UNKNOWN"
+}
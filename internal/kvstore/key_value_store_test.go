@@ -0,0 +1,67 @@
+package kvstore
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestProcessBatch_ExecutesInOrder(t *testing.T) {
+	store := &KeyValueStore{engine: NewMemoryEngine(), metrics: NewCommandMetrics(), maxBatchSize: 8}
+
+	value := "bar"
+	batch := []KeyValueCommand{
+		{commandType: PUT, key: "foo", value: &value, output: make(chan KeyValueOutput, 1)},
+		{commandType: GET, key: "foo", output: make(chan KeyValueOutput, 1)},
+		{commandType: DELETE, key: "foo", output: make(chan KeyValueOutput, 1)},
+		{commandType: GET, key: "foo", output: make(chan KeyValueOutput, 1)},
+	}
+
+	outputs := store.ProcessBatch(batch, nil)
+	if len(outputs) != len(batch) {
+		t.Fatalf("ProcessBatch returned %d outputs, want %d", len(outputs), len(batch))
+	}
+
+	want := []struct {
+		success bool
+		value   string
+	}{
+		{true, "bar"},
+		{true, "bar"},
+		{true, "bar"},
+		{false, "<nil>"},
+	}
+	for i, command := range batch {
+		got := <-command.output
+		if got.success != want[i].success || deref(got.value) != want[i].value {
+			t.Errorf("command %d (%s) = {%v, %s}, want {%v, %s}",
+				i, GetCommandTypeString(command.commandType), got.success, deref(got.value), want[i].success, want[i].value)
+		}
+	}
+
+	if stats := store.BatchStats(); stats != (BatchStats{1, 4}) {
+		t.Fatalf("BatchStats() = %+v, want {Batches: 1, Commands: 4}", stats)
+	}
+}
+
+func TestBatchStats_CountsEveryCommand(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	const numGoroutines = 32
+	var wg sync.WaitGroup
+	for range numGoroutines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = store.Set("foo", "bar")
+		}()
+	}
+	wg.Wait()
+
+	stats := store.BatchStats()
+	if stats.Commands != numGoroutines {
+		t.Fatalf("BatchStats().Commands = %d, want %d", stats.Commands, numGoroutines)
+	}
+	if stats.Batches == 0 || stats.Batches > numGoroutines {
+		t.Fatalf("BatchStats().Batches = %d, want between 1 and %d", stats.Batches, numGoroutines)
+	}
+}
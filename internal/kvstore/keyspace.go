@@ -0,0 +1,233 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+)
+
+// KeySampler is implemented by engines that can count their keys and pick
+// keys at random without listing all of them. Samples are drawn with
+// replacement, so a key may be picked more than once.
+type KeySampler interface {
+	KeyCount() (int, error)
+	SampleKeys(n int) ([]string, error)
+}
+
+// sampleWindow is how many keys sampleMapKeys reads past each random
+// starting point.
+const sampleWindow = 32
+
+// sampleMapKeys picks n keys from m with replacement. Go starts each map
+// iteration at a random position, but keys that follow empty slots are
+// several times more likely to come first, so each pick is made uniformly
+// from the first sampleWindow keys instead.
+func sampleMapKeys[V any](m map[string]V, n int) []string {
+	if len(m) == 0 || n <= 0 {
+		return nil
+	}
+	keys := make([]string, 0, n)
+	for range n {
+		skip := rand.IntN(min(sampleWindow, len(m)))
+		for key := range m {
+			if skip == 0 {
+				keys = append(keys, key)
+				break
+			}
+			skip--
+		}
+	}
+	return keys
+}
+
+// PrefixStats estimates how many keys share a prefix and how many bytes
+// they occupy, scaled up from a sample of the keyspace.
+type PrefixStats struct {
+	Prefix string
+	Keys   int
+	Bytes  int64
+}
+
+// KeyspaceReport breaks the keyspace down by prefix. Each sampled key counts
+// towards the longest prefix it starts with, or towards Other if none
+// matches. Expired keys the store has not removed yet are included in Keys
+// but not in any prefix.
+type KeyspaceReport struct {
+	Time time.Time
+	// Keys is the number of keys held by the engine
+	Keys int
+	// Sampled is how many keys the estimates are based on. It equals Keys
+	// when the keyspace was small enough to analyse exactly.
+	Sampled  int
+	Exact    bool
+	Prefixes []PrefixStats
+	Other    PrefixStats
+}
+
+// keyspaceCommand carries the parameters of KEYSPACE and RANDOMKEYS, and
+// their results back out of the store.
+type keyspaceCommand struct {
+	prefixes []string
+	samples  int
+	report   KeyspaceReport
+	keys     []string
+}
+
+// ProcessKeyspaceCommand samples the engine's keys and fills in
+// command.keyspace.report. Keyspaces no larger than the sample are listed
+// in full.
+func (kvStore *KeyValueStore) ProcessKeyspaceCommand(command KeyValueCommand) KeyValueOutput {
+	sampler, ok := kvStore.engine.(KeySampler)
+	if !ok {
+		return KeyValueOutput{false, nil, fmt.Errorf("storage engine cannot sample keys"), 0}
+	}
+	analysis := command.keyspace
+	count, err := sampler.KeyCount()
+	if err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+
+	var keys []string
+	exact := false
+	if count <= analysis.samples {
+		keys, err = listKeys(kvStore.engine)
+		exact = true
+	} else {
+		keys, err = sampler.SampleKeys(analysis.samples)
+	}
+	if err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+
+	now := kvStore.currentTime()
+	report := KeyspaceReport{Time: now, Keys: count, Sampled: len(keys), Exact: exact}
+	report.Prefixes = make([]PrefixStats, len(analysis.prefixes))
+	for i, prefix := range analysis.prefixes {
+		report.Prefixes[i].Prefix = prefix
+	}
+	for _, key := range keys {
+		if deadline, ok := kvStore.expiries.deadline(key); ok && now.UnixNano() >= deadline {
+			continue
+		}
+		info, ok, err := inspect(kvStore.engine, key)
+		if err != nil {
+			return KeyValueOutput{false, nil, err, 0}
+		}
+		if !ok {
+			// Deleted since it was sampled
+			continue
+		}
+		stats := &report.Other
+		match := -1
+		for i, prefix := range analysis.prefixes {
+			if strings.HasPrefix(key, prefix) && (match < 0 || len(prefix) > len(analysis.prefixes[match])) {
+				match = i
+			}
+		}
+		if match >= 0 {
+			stats = &report.Prefixes[match]
+		}
+		stats.Keys++
+		stats.Bytes += int64(info.Size)
+	}
+
+	if !exact && len(keys) > 0 {
+		scale := float64(count) / float64(len(keys))
+		for i := range report.Prefixes {
+			report.Prefixes[i].scale(scale)
+		}
+		report.Other.scale(scale)
+	}
+	analysis.report = report
+	return KeyValueOutput{true, nil, nil, 0}
+}
+
+func (stats *PrefixStats) scale(factor float64) {
+	stats.Keys = int(float64(stats.Keys)*factor + 0.5)
+	stats.Bytes = int64(float64(stats.Bytes)*factor + 0.5)
+}
+
+// AnalyzeKeyspace estimates how many keys, and how many bytes, each prefix
+// accounts for from a random sample of up to samples keys. The work is
+// bounded by samples rather than by the size of the keyspace, so it is
+// cheap enough to run periodically; the estimates get coarser for prefixes
+// that hold only a small share of the keys.
+func (kvService *KeyValueService) AnalyzeKeyspace(prefixes []string, samples int) (KeyspaceReport, error) {
+	if err := kvService.CheckActive(); err != nil {
+		return KeyspaceReport{}, err
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return KeyspaceReport{}, err
+	}
+	command := &keyspaceCommand{prefixes: prefixes, samples: max(samples, 1)}
+	res := kvService.dispatchRead(KeyValueCommand{commandType: KEYSPACE, keyspace: command})
+	if res.err != nil {
+		return KeyspaceReport{}, res.err
+	}
+	return command.report, nil
+}
+
+// ProcessRandomKeysCommand samples command.keyspace.samples keys into
+// command.keyspace.keys, leaving out any that have expired.
+func (kvStore *KeyValueStore) ProcessRandomKeysCommand(command KeyValueCommand) KeyValueOutput {
+	sampler, ok := kvStore.engine.(KeySampler)
+	if !ok {
+		return KeyValueOutput{false, nil, fmt.Errorf("storage engine cannot sample keys"), 0}
+	}
+	keys, err := sampler.SampleKeys(command.keyspace.samples)
+	if err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+
+	live := keys[:0]
+	for _, key := range keys {
+		if !kvStore.pastDeadline(key) {
+			live = append(live, key)
+		}
+	}
+	command.keyspace.keys = live
+	return KeyValueOutput{true, nil, nil, 0}
+}
+
+// RandomKeys returns up to n keys picked at random, for tools that estimate
+// value sizes or TTL coverage from a sample instead of scanning every key.
+// Keys are picked independently, so one may appear more than once,
+// especially in small keyspaces. Sampled keys that have expired are left
+// out, so fewer than n may be returned.
+func (kvService *KeyValueService) RandomKeys(n int) ([]string, error) {
+	return kvService.RandomKeysContext(context.Background(), n)
+}
+
+// RandomKeysContext is RandomKeys with ctx's deadline, as GetContext is
+// Get.
+func (kvService *KeyValueService) RandomKeysContext(ctx context.Context, n int) ([]string, error) {
+	if err := kvService.CheckActive(); err != nil {
+		return nil, err
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return nil, err
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	command := &keyspaceCommand{samples: n}
+	res := kvService.dispatchRead(withDeadline(ctx, KeyValueCommand{commandType: RANDOMKEYS, keyspace: command}))
+	if res.err != nil {
+		return nil, res.err
+	}
+	return command.keys, nil
+}
+
+// randomIndex picks an index into counts at random, weighted by the counts.
+func randomIndex(counts []int, total int) int {
+	r := rand.IntN(total)
+	for i, count := range counts {
+		if r < count {
+			return i
+		}
+		r -= count
+	}
+	return len(counts) - 1
+}
@@ -0,0 +1,132 @@
+package kvstore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAnalyzeKeyspace_ExactForSmallKeyspaces(t *testing.T) {
+	store := newTestKeyValueService(t)
+	clock := newTestClock(store)
+	for _, key := range []string{"user:1", "user:2", "user:session:1", "other"} {
+		if _, err := store.Set(key, "value"); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+	}
+	expireKey(t, store, clock, "user:expired")
+
+	report, err := store.AnalyzeKeyspace([]string{"user:", "user:session:"}, 100)
+	if err != nil {
+		t.Fatalf("AnalyzeKeyspace returned error: %v", err)
+	}
+	if !report.Exact || report.Keys != 5 || report.Sampled != 5 {
+		t.Fatalf("report = %+v, want an exact analysis of 5 keys", report)
+	}
+
+	// Keys count towards the longest matching prefix, and expired keys
+	// towards none
+	want := map[string]int{"user:": 2, "user:session:": 1}
+	for _, stats := range report.Prefixes {
+		if stats.Keys != want[stats.Prefix] {
+			t.Fatalf("prefix %q has %d keys, want %d", stats.Prefix, stats.Keys, want[stats.Prefix])
+		}
+	}
+	if report.Other.Keys != 1 {
+		t.Fatalf("Other has %d keys, want 1", report.Other.Keys)
+	}
+	wantBytes := int64(len("user:1") + len("value") + approxEntryOverhead)
+	if got := report.Prefixes[0].Bytes; got != 2*wantBytes {
+		t.Fatalf("prefix %q has %d bytes, want %d", "user:", got, 2*wantBytes)
+	}
+	if !report.Time.Equal(clock.Now()) {
+		t.Fatalf("report.Time = %v, want %v", report.Time, clock.Now())
+	}
+}
+
+func TestAnalyzeKeyspace_EstimatesFromSample(t *testing.T) {
+	store := newTestKeyValueServiceWithConfig(t, Config{Execution: DirectExecution})
+	for i := range 1000 {
+		key := fmt.Sprintf("session:%d", i)
+		if i%4 != 0 {
+			key = fmt.Sprintf("user:%d", i)
+		}
+		if _, err := store.Set(key, "value"); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+	}
+
+	report, err := store.AnalyzeKeyspace([]string{"user:", "session:"}, 400)
+	if err != nil {
+		t.Fatalf("AnalyzeKeyspace returned error: %v", err)
+	}
+	if report.Exact || report.Keys != 1000 || report.Sampled != 400 {
+		t.Fatalf("report = %+v, want 400 samples of 1000 keys", report)
+	}
+	// The estimates are random; these bounds are several standard
+	// deviations wide
+	if users := report.Prefixes[0].Keys; users < 600 || users > 900 {
+		t.Fatalf("estimated %d user keys, want about 750", users)
+	}
+	if total := report.Prefixes[0].Keys + report.Prefixes[1].Keys + report.Other.Keys; total < 990 || total > 1010 {
+		t.Fatalf("estimates add up to %d keys, want about 1000", total)
+	}
+}
+
+func TestAnalyzeKeyspace_EmptyStore(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	report, err := store.AnalyzeKeyspace([]string{"user:"}, 10)
+	if err != nil {
+		t.Fatalf("AnalyzeKeyspace returned error: %v", err)
+	}
+	if report.Keys != 0 || report.Prefixes[0].Keys != 0 || report.Other.Keys != 0 {
+		t.Fatalf("report = %+v, want no keys", report)
+	}
+}
+
+func TestRandomKeys(t *testing.T) {
+	store := newTestKeyValueService(t)
+	clock := newTestClock(store)
+
+	if keys, err := store.RandomKeys(5); err != nil || len(keys) != 0 {
+		t.Fatalf("RandomKeys on an empty store = (%q, %v), want no keys", keys, err)
+	}
+
+	want := make(map[string]bool)
+	for i := range 20 {
+		key := fmt.Sprintf("k%d", i)
+		want[key] = true
+		if _, err := store.Set(key, "value"); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+	}
+	keys, err := store.RandomKeys(50)
+	if err != nil {
+		t.Fatalf("RandomKeys returned error: %v", err)
+	}
+	if len(keys) != 50 {
+		t.Fatalf("RandomKeys(50) returned %d keys", len(keys))
+	}
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if !want[key] {
+			t.Fatalf("RandomKeys returned unknown key %q", key)
+		}
+		seen[key] = true
+	}
+	if len(seen) < 2 {
+		t.Fatalf("RandomKeys returned the same key every time")
+	}
+
+	// Expired keys are never returned
+	for key := range want {
+		if _, err := store.ExpireAt(key, clock.Now().Add(time.Second)); err != nil {
+			t.Fatalf("ExpireAt returned error: %v", err)
+		}
+	}
+	clock.Advance(time.Second)
+	if keys, err := store.RandomKeys(10); err != nil || len(keys) != 0 {
+		t.Fatalf("RandomKeys with every key expired = (%q, %v), want no keys", keys, err)
+	}
+}
@@ -0,0 +1,271 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ErrLeaseNotFound = errors.New("lease not found or expired")
+
+// minLeasePrune is the number of leases below which expired leases are
+// never pruned on grant.
+const minLeasePrune = 64
+
+// lease is a TTL that keys are attached to. An attached key carries the
+// lease's deadline as its own expiry, so keys expire with the lease through
+// the ordinary expiry path. A key stays attached only while its deadline is
+// still the lease's: anything that changes or clears its expiry, such as a
+// Set, ExpireAt or Persist, detaches it.
+type lease struct {
+	ttl      time.Duration
+	deadline int64
+	keys     map[string]struct{}
+}
+
+// leaseTable holds the store's live leases. Its lock is taken before the
+// expiry table's when keepalives and revocations update attached keys.
+type leaseTable struct {
+	mu     sync.Mutex
+	leases map[uint64]*lease
+	// pruneAt is the table size at which expired leases are next pruned
+	pruneAt int
+}
+
+// live returns the lease with id if it has not expired, dropping it if it
+// has. The caller must hold table.mu.
+func (table *leaseTable) live(id uint64, now int64) (*lease, bool) {
+	l, ok := table.leases[id]
+	if !ok {
+		return nil, false
+	}
+	if now >= l.deadline {
+		delete(table.leases, id)
+		return nil, false
+	}
+	return l, true
+}
+
+// prune drops expired leases once the table has doubled since the last
+// prune, so leases that are never touched again do not pile up. The caller
+// must hold table.mu.
+func (table *leaseTable) prune(now int64) {
+	if len(table.leases) < table.pruneAt {
+		return
+	}
+	for id, l := range table.leases {
+		if now >= l.deadline {
+			delete(table.leases, id)
+		}
+	}
+	table.pruneAt = max(2*len(table.leases), minLeasePrune)
+}
+
+// ProcessLeaseGrantCommand creates a lease that expires after command.ttl
+// and replies with its ID.
+func (kvStore *KeyValueStore) ProcessLeaseGrantCommand(command KeyValueCommand) KeyValueOutput {
+	if command.ttl <= 0 {
+		return KeyValueOutput{false, nil, fmt.Errorf("lease ttl must be positive, got %s", command.ttl), 0}
+	}
+	now := kvStore.currentTime()
+
+	// IDs come from the fencing token sequence, so an ID issued before a
+	// restart is not handed out again and cannot keep a new lease alive
+	id := kvStore.nextFencingToken()
+	table := &kvStore.leases
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	if table.leases == nil {
+		table.leases = make(map[uint64]*lease)
+	}
+	table.prune(now.UnixNano())
+	table.leases[id] = &lease{
+		ttl:      command.ttl,
+		deadline: now.Add(command.ttl).UnixNano(),
+		keys:     make(map[string]struct{}),
+	}
+	return KeyValueOutput{true, nil, nil, int64(id)}
+}
+
+// ProcessLeaseAttachCommand attaches command.key to the lease command.token,
+// replying with the key's value, or nil if the key does not exist.
+func (kvStore *KeyValueStore) ProcessLeaseAttachCommand(command KeyValueCommand) KeyValueOutput {
+	key := command.key
+	table := &kvStore.leases
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	l, ok := table.live(command.token, kvStore.currentTime().UnixNano())
+	if !ok {
+		return KeyValueOutput{false, nil, ErrLeaseNotFound, 0}
+	}
+	if kvStore.expired(command) {
+		return KeyValueOutput{true, nil, nil, 0}
+	}
+	value, ok, err := kvStore.engine.Get(key)
+	if err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	if !ok {
+		return KeyValueOutput{true, nil, nil, 0}
+	}
+
+	if err := kvStore.setDeadline(key, l.deadline); err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	l.keys[key] = struct{}{}
+	return KeyValueOutput{true, stringPointer(value.Data), nil, 0}
+}
+
+// ProcessLeaseKeepAliveCommand renews the lease command.token for another
+// full TTL, along with every key still attached to it.
+func (kvStore *KeyValueStore) ProcessLeaseKeepAliveCommand(command KeyValueCommand) KeyValueOutput {
+	now := kvStore.currentTime()
+	table := &kvStore.leases
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	l, ok := table.live(command.token, now.UnixNano())
+	if !ok {
+		return KeyValueOutput{false, nil, ErrLeaseNotFound, 0}
+	}
+	previous := l.deadline
+	l.deadline = now.Add(l.ttl).UnixNano()
+	for key := range l.keys {
+		replaced, err := kvStore.replaceDeadline(key, previous, l.deadline)
+		if err != nil {
+			return KeyValueOutput{false, nil, err, 0}
+		}
+		if !replaced {
+			delete(l.keys, key)
+		}
+	}
+	return KeyValueOutput{true, nil, nil, int64(l.ttl)}
+}
+
+// ProcessLeaseRevokeCommand ends the lease command.token early and expires
+// every key still attached to it, replying with how many there were.
+func (kvStore *KeyValueStore) ProcessLeaseRevokeCommand(command KeyValueCommand) KeyValueOutput {
+	now := kvStore.currentTime().UnixNano()
+	table := &kvStore.leases
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	l, ok := table.live(command.token, now)
+	if !ok {
+		return KeyValueOutput{false, nil, ErrLeaseNotFound, 0}
+	}
+	delete(table.leases, command.token)
+
+	revoked := 0
+	for key := range l.keys {
+		// Moving the deadline to now expires the key like any other, which
+		// also hides it from concurrent readers until it is removed
+		replaced, err := kvStore.replaceDeadline(key, l.deadline, now)
+		if err != nil {
+			return KeyValueOutput{false, nil, err, 0}
+		}
+		if replaced {
+			kvStore.keyExpired(key, command.concurrent)
+			revoked++
+		}
+	}
+	return KeyValueOutput{true, nil, nil, int64(revoked)}
+}
+
+// GrantLease creates a lease that expires after ttl unless kept alive and
+// returns its ID. Keys attached to the lease are deleted when it expires.
+// Leases are kept in memory only and do not survive a restart.
+func (kvService *KeyValueService) GrantLease(ttl time.Duration) (uint64, error) {
+	return kvService.GrantLeaseContext(context.Background(), ttl)
+}
+
+// GrantLeaseContext is GrantLease with ctx's deadline, as SetContext is
+// Set.
+func (kvService *KeyValueService) GrantLeaseContext(ctx context.Context, ttl time.Duration) (uint64, error) {
+	if ttl <= 0 {
+		return 0, fmt.Errorf("lease ttl must be positive, got %s", ttl)
+	}
+	if err := kvService.CheckWritable(); err != nil {
+		return 0, err
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return 0, err
+	}
+	res := kvService.dispatch(withDeadline(ctx, KeyValueCommand{commandType: LEASEGRANT, ttl: ttl}))
+	if res.err != nil {
+		return 0, res.err
+	}
+
+	return uint64(res.integer), nil
+}
+
+// AttachLease ties key to the lease id, so the key is deleted when the lease
+// expires or is revoked, and reports whether the key exists. Setting the key
+// again, or changing its expiry, detaches it.
+func (kvService *KeyValueService) AttachLease(key string, id uint64) (bool, error) {
+	return kvService.AttachLeaseContext(context.Background(), key, id)
+}
+
+// AttachLeaseContext is AttachLease with ctx's deadline, as SetContext is
+// Set.
+func (kvService *KeyValueService) AttachLeaseContext(ctx context.Context, key string, id uint64) (bool, error) {
+	if err := kvService.CheckWritable(); err != nil {
+		return false, err
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return false, err
+	}
+	res := kvService.dispatch(withDeadline(ctx, KeyValueCommand{commandType: LEASEATTACH, key: key, token: id}))
+
+	return res.value != nil, res.err
+}
+
+// KeepAliveLease renews the lease id for another full TTL and returns that
+// TTL. It returns ErrLeaseNotFound once the lease has expired.
+func (kvService *KeyValueService) KeepAliveLease(id uint64) (time.Duration, error) {
+	return kvService.KeepAliveLeaseContext(context.Background(), id)
+}
+
+// KeepAliveLeaseContext is KeepAliveLease with ctx's deadline, as
+// SetContext is Set.
+func (kvService *KeyValueService) KeepAliveLeaseContext(ctx context.Context, id uint64) (time.Duration, error) {
+	if err := kvService.CheckWritable(); err != nil {
+		return 0, err
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return 0, err
+	}
+	res := kvService.dispatch(withDeadline(ctx, KeyValueCommand{commandType: LEASEKEEPALIVE, token: id}))
+	if res.err != nil {
+		return 0, res.err
+	}
+
+	return time.Duration(res.integer), nil
+}
+
+// RevokeLease ends the lease id straight away, deleting its keys, and
+// returns how many keys were attached.
+func (kvService *KeyValueService) RevokeLease(id uint64) (int, error) {
+	return kvService.RevokeLeaseContext(context.Background(), id)
+}
+
+// RevokeLeaseContext is RevokeLease with ctx's deadline, as SetContext is
+// Set.
+func (kvService *KeyValueService) RevokeLeaseContext(ctx context.Context, id uint64) (int, error) {
+	if err := kvService.CheckWritable(); err != nil {
+		return 0, err
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return 0, err
+	}
+	res := kvService.dispatch(withDeadline(ctx, KeyValueCommand{commandType: LEASEREVOKE, token: id}))
+	if res.err != nil {
+		return 0, res.err
+	}
+
+	return int(res.integer), nil
+}
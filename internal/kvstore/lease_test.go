@@ -0,0 +1,133 @@
+package kvstore
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func grantLeaseWithKeys(t *testing.T, store *KeyValueService, ttl time.Duration, keys ...string) uint64 {
+	t.Helper()
+
+	id, err := store.GrantLease(ttl)
+	if err != nil {
+		t.Fatalf("GrantLease returned error: %v", err)
+	}
+	for _, key := range keys {
+		if _, err := store.Set(key, "value"); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+		if attached, err := store.AttachLease(key, id); err != nil || !attached {
+			t.Fatalf("AttachLease(%s) = (%t, %v), want (true, nil)", key, attached, err)
+		}
+	}
+	return id
+}
+
+func TestLease_KeysExpireWithLease(t *testing.T) {
+	store := newTestKeyValueService(t)
+	clock := newTestClock(store)
+	id := grantLeaseWithKeys(t, store, time.Second, "a", "b")
+
+	if ttl, err := store.TTL("a"); err != nil || ttl != time.Second {
+		t.Fatalf("TTL of attached key = (%v, %v), want (1s, nil)", ttl, err)
+	}
+
+	clock.Advance(time.Second)
+	for _, key := range []string{"a", "b"} {
+		if _, err := store.Get(key); err == nil {
+			t.Fatalf("Get(%s) after the lease expired succeeded, want error", key)
+		}
+	}
+	if _, err := store.KeepAliveLease(id); !errors.Is(err, ErrLeaseNotFound) {
+		t.Fatalf("KeepAliveLease after expiry returned %v, want ErrLeaseNotFound", err)
+	}
+	if _, err := store.AttachLease("a", id); !errors.Is(err, ErrLeaseNotFound) {
+		t.Fatalf("AttachLease after expiry returned %v, want ErrLeaseNotFound", err)
+	}
+}
+
+func TestLease_KeepAliveRenewsAttachedKeys(t *testing.T) {
+	store := newTestKeyValueService(t)
+	clock := newTestClock(store)
+	id := grantLeaseWithKeys(t, store, time.Second, "a", "b")
+
+	clock.Advance(800 * time.Millisecond)
+	if ttl, err := store.KeepAliveLease(id); err != nil || ttl != time.Second {
+		t.Fatalf("KeepAliveLease = (%v, %v), want (1s, nil)", ttl, err)
+	}
+	clock.Advance(800 * time.Millisecond)
+	if _, err := store.Get("a"); err != nil {
+		t.Fatalf("Get after keepalive returned error: %v", err)
+	}
+	if ttl, err := store.TTL("b"); err != nil || ttl != 200*time.Millisecond {
+		t.Fatalf("TTL after keepalive = (%v, %v), want (200ms, nil)", ttl, err)
+	}
+}
+
+func TestLease_SetDetachesKey(t *testing.T) {
+	store := newTestKeyValueService(t)
+	clock := newTestClock(store)
+	id := grantLeaseWithKeys(t, store, time.Second, "a")
+
+	if _, err := store.Set("a", "replaced"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := store.KeepAliveLease(id); err != nil {
+		t.Fatalf("KeepAliveLease returned error: %v", err)
+	}
+	if ttl, err := store.TTL("a"); err != nil || ttl != TTLNoExpiry {
+		t.Fatalf("TTL of detached key = (%v, %v), want TTLNoExpiry", ttl, err)
+	}
+
+	clock.Advance(time.Second)
+	value, err := store.Get("a")
+	if err != nil {
+		t.Fatalf("Get of detached key returned error: %v", err)
+	}
+	if *value != "replaced" {
+		t.Fatalf("Get of detached key = %q, want replaced", *value)
+	}
+}
+
+func TestLease_RevokeDeletesKeys(t *testing.T) {
+	store := newTestKeyValueService(t)
+	newTestClock(store)
+	subscription := store.Subscribe(10)
+	defer subscription.Close()
+	id := grantLeaseWithKeys(t, store, time.Minute, "a", "b")
+
+	if attached, err := store.AttachLease("missing", id); err != nil || attached {
+		t.Fatalf("AttachLease of a missing key = (%t, %v), want (false, nil)", attached, err)
+	}
+
+	if revoked, err := store.RevokeLease(id); err != nil || revoked != 2 {
+		t.Fatalf("RevokeLease = (%d, %v), want (2, nil)", revoked, err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if _, err := store.Get(key); err == nil {
+			t.Fatalf("Get(%s) after revoke succeeded, want error", key)
+		}
+		if event := <-subscription.Events(); event.Type != EventExpired {
+			t.Fatalf("event after revoke = %+v, want an expired event", event)
+		}
+	}
+	if _, err := store.RevokeLease(id); !errors.Is(err, ErrLeaseNotFound) {
+		t.Fatalf("second RevokeLease returned %v, want ErrLeaseNotFound", err)
+	}
+}
+
+func TestLease_RevokeUnderDirectExecution(t *testing.T) {
+	store := newTestKeyValueServiceWithConfig(t, Config{Execution: DirectExecution})
+	id := grantLeaseWithKeys(t, store, time.Minute, "a")
+
+	if revoked, err := store.RevokeLease(id); err != nil || revoked != 1 {
+		t.Fatalf("RevokeLease = (%d, %v), want (1, nil)", revoked, err)
+	}
+	if _, err := store.Get("a"); err == nil {
+		t.Fatalf("Get after revoke succeeded, want error")
+	}
+	if _, err := store.GrantLease(0); err == nil {
+		t.Fatalf("GrantLease with zero ttl succeeded, want error")
+	}
+}
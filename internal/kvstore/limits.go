@@ -0,0 +1,94 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrInvalidKey is returned when a key is blank or refused by the
+	// configured KeyPolicy.
+	ErrInvalidKey    = errors.New("invalid key")
+	ErrKeyTooLong    = errors.New("key is too long")
+	ErrValueTooLarge = errors.New("value is too large")
+)
+
+// KeyPolicy reports whether a key may be written.
+type KeyPolicy func(key string) bool
+
+// PrintableKeys allows keys made of printable ASCII characters other than
+// space, which need no quoting in logs, URLs or the RESP inline protocol.
+func PrintableKeys(key string) bool {
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// AllowedKeyCharacters returns a KeyPolicy allowing keys made only of the
+// characters in allowed.
+func AllowedKeyCharacters(allowed string) KeyPolicy {
+	return func(key string) bool {
+		for _, c := range key {
+			if !strings.ContainsRune(allowed, c) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// keyLimits holds Config.MaxKeyLength, MaxValueSize and KeyPolicy.
+type keyLimits struct {
+	maxKeyLength int
+	maxValueSize int
+	policy       KeyPolicy
+}
+
+// check validates the key a command writes, and the value it stores.
+// Commands that only read or remove keys are let through, so keys written
+// before the limits were tightened can still be read and deleted. A store
+// that never had limits set checks keys as if none were configured.
+func (limits *keyLimits) check(commandType int, key string, value *string) error {
+	if limits == nil {
+		limits = &keyLimits{}
+	}
+	switch commandType {
+	case PUT, UPDATE, CMSINIT, CMSMERGE, LOCK, PNCOUNTERINCRBY, ORSETADD, SETNX, SETIFEQUAL, APPEND, SETRANGE,
+		HSET, HINCRBY, LPUSH, RPUSH:
+	default:
+		return nil
+	}
+	if strings.TrimSpace(key) == "" {
+		return fmt.Errorf("%w: key is blank", ErrInvalidKey)
+	}
+	if limits.maxKeyLength > 0 && len(key) > limits.maxKeyLength {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrKeyTooLong, len(key), limits.maxKeyLength)
+	}
+	if limits.policy != nil && !limits.policy(key) {
+		return fmt.Errorf("%w: %q has characters that are not allowed", ErrInvalidKey, key)
+	}
+	if value != nil {
+		return limits.checkSize(key, len(*value))
+	}
+	return nil
+}
+
+// checkSize validates the size of a value to be stored under key, for
+// commands such as APPEND whose value is only known once they run.
+func (limits *keyLimits) checkSize(key string, size int) error {
+	if limits != nil && limits.maxValueSize > 0 && size > limits.maxValueSize {
+		return fmt.Errorf("%w: %d bytes for key %s, the limit is %d", ErrValueTooLarge, size, key, limits.maxValueSize)
+	}
+	return nil
+}
+
+// SetKeyLimits replaces Config.MaxKeyLength, MaxValueSize and KeyPolicy
+// while the service runs. Commands not yet processed are checked against
+// the new limits.
+func (kvService *KeyValueService) SetKeyLimits(maxKeyLength int, maxValueSize int, policy KeyPolicy) {
+	kvService.store.limits.Store(&keyLimits{max(maxKeyLength, 0), max(maxValueSize, 0), policy})
+}
@@ -0,0 +1,93 @@
+package kvstore
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLimits_RefuseBlankKeys(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	for _, key := range []string{"", "   ", "\t\n"} {
+		if _, err := store.Set(key, "value"); !errors.Is(err, ErrInvalidKey) {
+			t.Fatalf("Set(%q) returned %v, want ErrInvalidKey", key, err)
+		}
+	}
+	if _, err := store.Set(" padded ", "value"); err != nil {
+		t.Fatalf("Set of a key with surrounding spaces returned error: %v", err)
+	}
+}
+
+func TestLimits_RefuseLongKeysAndLargeValues(t *testing.T) {
+	store := newTestKeyValueServiceWithConfig(t, Config{MaxKeyLength: 8, MaxValueSize: 16})
+
+	if _, err := store.Set(strings.Repeat("k", 9), "value"); !errors.Is(err, ErrKeyTooLong) {
+		t.Fatalf("Set of a 9 byte key returned %v, want ErrKeyTooLong", err)
+	}
+	if _, err := store.Set("key", strings.Repeat("v", 17)); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("Set of a 17 byte value returned %v, want ErrValueTooLarge", err)
+	}
+	if _, err := store.Set(strings.Repeat("k", 8), strings.Repeat("v", 16)); err != nil {
+		t.Fatalf("Set at the limits returned error: %v", err)
+	}
+
+	// Batches and transactions are held to the same limits
+	value := strings.Repeat("v", 17)
+	results := store.SendBatch([]Command{{Type: PUT, Key: "key", Value: &value}})
+	if !errors.Is(results[0].Err, ErrValueTooLarge) {
+		t.Fatalf("SendBatch PUT returned %v, want ErrValueTooLarge", results[0].Err)
+	}
+	if err := store.PrepareTransaction("t1", []Command{{Type: PUT, Key: "key", Value: &value}}); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("PrepareTransaction returned %v, want ErrValueTooLarge", err)
+	}
+}
+
+func TestLimits_KeyPolicy(t *testing.T) {
+	store := newTestKeyValueServiceWithConfig(t, Config{KeyPolicy: PrintableKeys})
+
+	for _, key := range []string{"has space", "new\nline", "café"} {
+		if _, err := store.Set(key, "value"); !errors.Is(err, ErrInvalidKey) {
+			t.Fatalf("Set(%q) returned %v, want ErrInvalidKey", key, err)
+		}
+	}
+	if _, err := store.Set("user:1/profile", "value"); err != nil {
+		t.Fatalf("Set of a printable key returned error: %v", err)
+	}
+
+	allowed := AllowedKeyCharacters("abc:")
+	if !allowed("a:b") || allowed("a:d") {
+		t.Fatalf("AllowedKeyCharacters(%q) accepted the wrong keys", "abc:")
+	}
+}
+
+func TestLimits_LetKeysBeReadAndDeleted(t *testing.T) {
+	store := newTestKeyValueServiceWithConfig(t, Config{MaxKeyLength: 4})
+
+	long := strings.Repeat("k", 5)
+	if _, err := store.Get(long); errors.Is(err, ErrKeyTooLong) {
+		t.Fatalf("Get of a long key was refused: %v", err)
+	}
+	if _, err := store.Delete(long); err != nil {
+		t.Fatalf("Delete of a long key returned error: %v", err)
+	}
+}
+
+func TestSetKeyLimits_AppliesToLaterWrites(t *testing.T) {
+	store := newTestKeyValueServiceWithConfig(t, Config{MaxValueSize: 4})
+
+	if _, err := store.Set("key", "too long"); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("Set of an 8 byte value returned %v, want ErrValueTooLarge", err)
+	}
+
+	store.SetKeyLimits(2, 0, PrintableKeys)
+	if _, err := store.Set("ab", "no longer too long"); err != nil {
+		t.Fatalf("Set after lifting the value limit returned error: %v", err)
+	}
+	if _, err := store.Set("abc", "value"); !errors.Is(err, ErrKeyTooLong) {
+		t.Fatalf("Set of a 3 byte key returned %v, want ErrKeyTooLong", err)
+	}
+	if _, err := store.Set("a\n", "value"); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("Set of a key with a newline returned %v, want ErrInvalidKey", err)
+	}
+}
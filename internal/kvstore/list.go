@@ -0,0 +1,350 @@
+package kvstore
+
+import (
+	"blueis/internal/datatype"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// listCommand carries the arguments of a list command and, like
+// hashCommand, receives its result before the caller is released. LINDEX
+// takes its index in start.
+type listCommand struct {
+	values []string
+	start  int64
+	stop   int64
+	result []string
+}
+
+func (kvStore *KeyValueStore) ProcessListCommand(command KeyValueCommand) KeyValueOutput {
+	args := command.list
+	if args == nil {
+		return KeyValueOutput{false, nil, fmt.Errorf("%s command has no arguments", GetCommandTypeString(command.commandType)), 0}
+	}
+	if !IsMutation(command.commandType) {
+		return kvStore.processListRead(command)
+	}
+	key := command.key
+	defer kvStore.keyLocks.lock(command)()
+	// The key is locked, so an expired list can be removed even outside the
+	// store loop, and a push starts a new list rather than extending it
+	kvStore.keyExpired(key, false)
+	length, size, err := engineListLen(kvStore.engine, key)
+	if err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	left := command.commandType == LPUSH || command.commandType == LPOP
+
+	switch command.commandType {
+	case LPUSH, RPUSH:
+		if len(args.values) == 0 {
+			return KeyValueOutput{true, nil, nil, int64(length)}
+		}
+		for _, value := range args.values {
+			size += datatype.EncodedItemLen(value)
+		}
+		if err := kvStore.limits.Load().checkSize(key, datatype.EncodedListLen(length+len(args.values), size)); err != nil {
+			return KeyValueOutput{false, nil, err, 0}
+		}
+		pushed, err := kvStore.pushList(key, left, args.values, 0)
+		if err != nil {
+			return KeyValueOutput{false, nil, err, 0}
+		}
+		// Like APPEND, a push keeps the expiry of a list that existed and
+		// gives a new one its namespace's default TTL
+		if deadline := kvStore.newDeadline(key); length == 0 && deadline > 0 {
+			if err := kvStore.setDeadline(key, deadline); err != nil {
+				return KeyValueOutput{false, nil, err, 0}
+			}
+		}
+		kvStore.touch(key)
+		return KeyValueOutput{true, nil, nil, int64(pushed)}
+
+	case LPOP, RPOP:
+		if length == 0 {
+			return KeyValueOutput{true, nil, nil, 0}
+		}
+		popped, err := kvStore.popList(key, left, 1, 0)
+		if err != nil {
+			return KeyValueOutput{false, nil, err, 0}
+		}
+		if length > 1 {
+			kvStore.touch(key)
+		}
+		return KeyValueOutput{true, stringPointer(popped[0]), nil, int64(length - 1)}
+	}
+	return KeyValueOutput{false, nil, fmt.Errorf("command type %s not found", GetCommandTypeString(command.commandType)), 0}
+}
+
+// processListRead serves LRANGE, LINDEX and LLEN. A missing or expired key reads
+// as an empty list.
+func (kvStore *KeyValueStore) processListRead(command KeyValueCommand) KeyValueOutput {
+	args := command.list
+	key := command.key
+	if kvStore.keyExpired(key, command.concurrent) {
+		args.result = []string{}
+		return KeyValueOutput{true, nil, nil, 0}
+	}
+
+	switch command.commandType {
+	case LRANGE, LINDEX:
+		start, stop := args.start, args.stop
+		if command.commandType == LINDEX {
+			stop = start
+		}
+		values, ok, err := engineListRange(kvStore.engine, key, start, stop)
+		if err != nil {
+			return KeyValueOutput{false, nil, err, 0}
+		}
+		if ok {
+			kvStore.touch(key)
+		}
+		if command.commandType == LINDEX {
+			if len(values) == 0 {
+				return KeyValueOutput{true, nil, nil, 0}
+			}
+			return KeyValueOutput{true, stringPointer(values[0]), nil, 0}
+		}
+		args.result = values
+		return KeyValueOutput{true, nil, nil, int64(len(values))}
+
+	case LLEN:
+		length, _, err := engineListLen(kvStore.engine, key)
+		if err != nil {
+			return KeyValueOutput{false, nil, err, 0}
+		}
+		if length > 0 {
+			kvStore.touch(key)
+		}
+		return KeyValueOutput{true, nil, nil, int64(length)}
+	}
+	return KeyValueOutput{false, nil, fmt.Errorf("command type %s not found", GetCommandTypeString(command.commandType)), 0}
+}
+
+// pushList and popList change a list in the engine on behalf of commands,
+// as setValue and deleteValue write other values, but publish just the
+// values pushed or popped rather than the whole list. popList removes a
+// list it leaves empty, as deleteValue would, and must only be called for
+// a list that is not. offset is recorded with the list, as the offset of
+// the replicated change being applied or 0 for a command. They return the
+// list's new length, and the values popped.
+func (kvStore *KeyValueStore) pushList(key string, left bool, values []string, offset uint64) (int, error) {
+	defer kvStore.replication.end(kvStore.replication.begin())
+	if err := kvStore.preserve(key); err != nil {
+		return 0, err
+	}
+	if err := kvStore.retain(key); err != nil {
+		return 0, err
+	}
+	length, err := enginePushList(kvStore.engine, key, left, values, offset)
+	if err != nil {
+		return 0, err
+	}
+	kvStore.tombstones.clear(key)
+	kvStore.replication.publish(Mutation{Type: MutationListPush, Key: key, Values: slices.Clone(values), Left: left, Length: int64(length)})
+	kvStore.notifications.publish(EventSet, key, kvStore.currentTime)
+	return length, nil
+}
+
+func (kvStore *KeyValueStore) popList(key string, left bool, count int, offset uint64) ([]string, error) {
+	popped, length, err := kvStore.popListValues(key, left, count, offset)
+	if err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		kvStore.forgetDeadline(key)
+		kvStore.forget(key)
+	}
+	return popped, nil
+}
+
+func (kvStore *KeyValueStore) popListValues(key string, left bool, count int, offset uint64) ([]string, int, error) {
+	defer kvStore.replication.end(kvStore.replication.begin())
+	if err := kvStore.preserve(key); err != nil {
+		return nil, 0, err
+	}
+	if err := kvStore.retain(key); err != nil {
+		return nil, 0, err
+	}
+	popped, length, err := enginePopList(kvStore.engine, key, left, count, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	kvStore.replication.publish(Mutation{Type: MutationListPop, Key: key, Values: popped, Left: left, Length: int64(length)})
+	if length > 0 {
+		kvStore.notifications.publish(EventSet, key, kvStore.currentTime)
+		return popped, length, nil
+	}
+	kvStore.tombstones.add(key, kvStore.currentTime().UnixNano())
+	kvStore.notifications.publish(EventDel, key, kvStore.currentTime)
+	return popped, length, nil
+}
+
+// applyListMutation applies a push or pop from a primary, recording its
+// offset with the list so that, replayed after a replica resumes from an
+// older checkpoint, it is skipped rather than applied twice. One with no
+// offset is always applied.
+//
+// A replayed change can also find its key deleted or holding another type
+// by a later change, which is replayed after it and leaves the key as the
+// primary has it, so such a change is skipped too.
+func (kvStore *KeyValueStore) applyListMutation(mutation Mutation) error {
+	key := mutation.Key
+	applied, err := engineListOffset(kvStore.engine, key)
+	if errors.Is(err, ErrWrongType) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if mutation.Offset > 0 && mutation.Offset <= applied {
+		return nil
+	}
+	length := 0
+	if mutation.Type == MutationListPush {
+		length, err = kvStore.pushList(key, mutation.Left, mutation.Values, mutation.Offset)
+	} else {
+		if length, _, err = engineListLen(kvStore.engine, key); err != nil || length == 0 {
+			return err
+		}
+		var popped []string
+		popped, err = kvStore.popList(key, mutation.Left, len(mutation.Values), mutation.Offset)
+		length -= len(popped)
+	}
+	if err == nil && length > 0 {
+		kvStore.touch(key)
+	}
+	return err
+}
+
+// LPush adds values to the head of the list under key, creating the list
+// if the key does not exist, and returns its new length. The values are
+// pushed one after another, so the last one given ends up first. A key
+// holding something other than a list fails with ErrWrongType, as do the
+// other list commands.
+func (kvService *KeyValueService) LPush(key string, values ...string) (int64, error) {
+	return kvService.LPushContext(context.Background(), key, values...)
+}
+
+// LPushContext is LPush with ctx's deadline, as SetContext is Set.
+func (kvService *KeyValueService) LPushContext(ctx context.Context, key string, values ...string) (int64, error) {
+	res := kvService.sendList(ctx, LPUSH, key, &listCommand{values: values})
+	return res.integer, res.err
+}
+
+// RPush adds values to the tail of the list under key in order, creating
+// the list if the key does not exist, and returns its new length.
+func (kvService *KeyValueService) RPush(key string, values ...string) (int64, error) {
+	return kvService.RPushContext(context.Background(), key, values...)
+}
+
+// RPushContext is RPush with ctx's deadline, as SetContext is Set.
+func (kvService *KeyValueService) RPushContext(ctx context.Context, key string, values ...string) (int64, error) {
+	res := kvService.sendList(ctx, RPUSH, key, &listCommand{values: values})
+	return res.integer, res.err
+}
+
+// LPop removes and returns the head of the list under key, or
+// ErrKeyNotFound if the list is empty. Popping the last value removes the
+// key, so a list pushed to at the tail and popped at the head is a queue.
+func (kvService *KeyValueService) LPop(key string) (*string, error) {
+	return kvService.LPopContext(context.Background(), key)
+}
+
+// LPopContext is LPop with ctx's deadline, as SetContext is Set.
+func (kvService *KeyValueService) LPopContext(ctx context.Context, key string) (*string, error) {
+	return kvService.popList(ctx, LPOP, key)
+}
+
+// RPop removes and returns the tail of the list under key, or
+// ErrKeyNotFound if the list is empty.
+func (kvService *KeyValueService) RPop(key string) (*string, error) {
+	return kvService.RPopContext(context.Background(), key)
+}
+
+// RPopContext is RPop with ctx's deadline, as SetContext is Set.
+func (kvService *KeyValueService) RPopContext(ctx context.Context, key string) (*string, error) {
+	return kvService.popList(ctx, RPOP, key)
+}
+
+// LRange returns the values of the list under key from start to stop
+// inclusive, where negative indexes count back from the tail, so
+// LRange(key, 0, -1) is the whole list. Indexes past the ends are clamped,
+// and a missing key reads as an empty list.
+func (kvService *KeyValueService) LRange(key string, start int64, stop int64) ([]string, error) {
+	return kvService.LRangeContext(context.Background(), key, start, stop)
+}
+
+// LRangeContext is LRange with ctx's deadline, as GetContext is Get.
+func (kvService *KeyValueService) LRangeContext(ctx context.Context, key string, start int64, stop int64) ([]string, error) {
+	args := &listCommand{start: start, stop: stop}
+	res := kvService.readList(ctx, LRANGE, key, args)
+	if res.err != nil {
+		return nil, res.err
+	}
+	return args.result, nil
+}
+
+// LIndex returns the value at index in the list under key, where a
+// negative index counts back from the tail, or ErrKeyNotFound if there is
+// none.
+func (kvService *KeyValueService) LIndex(key string, index int64) (*string, error) {
+	return kvService.LIndexContext(context.Background(), key, index)
+}
+
+// LIndexContext is LIndex with ctx's deadline, as GetContext is Get.
+func (kvService *KeyValueService) LIndexContext(ctx context.Context, key string, index int64) (*string, error) {
+	res := kvService.readList(ctx, LINDEX, key, &listCommand{start: index})
+	if res.err != nil {
+		return nil, res.err
+	}
+	if res.value == nil {
+		return nil, fmt.Errorf("%w: index %d of %s", ErrKeyNotFound, index, key)
+	}
+	return res.value, nil
+}
+
+// LLen returns the length of the list under key, or 0 if the key does not
+// exist.
+func (kvService *KeyValueService) LLen(key string) (int64, error) {
+	return kvService.LLenContext(context.Background(), key)
+}
+
+// LLenContext is LLen with ctx's deadline, as GetContext is Get.
+func (kvService *KeyValueService) LLenContext(ctx context.Context, key string) (int64, error) {
+	res := kvService.readList(ctx, LLEN, key, &listCommand{})
+	return res.integer, res.err
+}
+
+func (kvService *KeyValueService) popList(ctx context.Context, commandType int, key string) (*string, error) {
+	res := kvService.sendList(ctx, commandType, key, &listCommand{})
+	if res.err != nil {
+		return nil, res.err
+	}
+	if res.value == nil {
+		return nil, keyNotFound(key)
+	}
+	return res.value, nil
+}
+
+func (kvService *KeyValueService) sendList(ctx context.Context, commandType int, key string, args *listCommand) KeyValueOutput {
+	if err := kvService.CheckWritable(); err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	return kvService.dispatch(withDeadline(ctx, KeyValueCommand{commandType: commandType, key: key, list: args}))
+}
+
+func (kvService *KeyValueService) readList(ctx context.Context, commandType int, key string, args *listCommand) KeyValueOutput {
+	if err := kvService.CheckActive(); err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	return kvService.dispatchRead(withDeadline(ctx, KeyValueCommand{commandType: commandType, key: key, list: args}))
+}
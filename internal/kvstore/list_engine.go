@@ -0,0 +1,339 @@
+package kvstore
+
+import (
+	"blueis/internal/datatype"
+	"math/rand/v2"
+)
+
+// ListEngine is implemented by engines that hold lists as lists rather than
+// as their encoding, so pushing to or popping from one touches just the
+// values pushed or popped instead of rewriting the whole list. Get, Scan
+// and the other StorageEngine methods still see a list as a TypeList value
+// holding its datatype encoding, and a Set of one is held as a list.
+// Engines that do not implement it have lists read, changed and written
+// back whole.
+//
+// A ListEngine also keeps, with each list, the offset of the replicated
+// push or pop that last changed it, so one replayed to a replica is
+// skipped rather than applied twice. It must be written along with the
+// change, so a crash never leaves one without the other.
+//
+// Each method fails with ErrWrongType for a key holding something other
+// than a list, and treats a missing key as an empty list.
+type ListEngine interface {
+	// ListLen returns the length of the list under key, and the sum of
+	// datatype.EncodedItemLen over its values.
+	ListLen(key string) (int, int, error)
+	// ListRange returns the values of the list under key from start to
+	// stop inclusive, as datatype.List.Range does, and whether the key
+	// exists.
+	ListRange(key string, start int64, stop int64) ([]string, bool, error)
+	// ListOffset returns the offset PushList or PopList last recorded for
+	// the list under key, or 0 if it has none.
+	ListOffset(key string) (uint64, error)
+	// PushList adds values to the head of the list under key if left is
+	// set, as datatype.List.PushLeft does, or else to its tail, records
+	// offset as its ListOffset, and returns its new length.
+	PushList(key string, left bool, values []string, offset uint64) (int, error)
+	// PopList removes up to count values from the head of the list under
+	// key if left is set, or else from its tail, records offset as its
+	// ListOffset, and returns the values in the order they were removed
+	// along with the length left. The key is removed with its last value.
+	PopList(key string, left bool, count int, offset uint64) ([]string, int, error)
+}
+
+// decodeList decodes the list held as value.
+func decodeList(value TypedValue) (*datatype.List, error) {
+	if value.Type != TypeList {
+		return nil, ErrWrongType
+	}
+	return datatype.DecodeList(value.Data)
+}
+
+// loadEngineList reads the list under key from an engine that does not
+// implement ListEngine.
+func loadEngineList(engine StorageEngine, key string) (*datatype.List, bool, error) {
+	value, ok, err := engine.Get(key)
+	if err != nil || !ok {
+		return datatype.NewList(), false, err
+	}
+	list, err := decodeList(value)
+	return list, err == nil, err
+}
+
+// storeEngineList writes a list changed in place back to an engine that
+// does not implement ListEngine, removing the key once the list is empty.
+func storeEngineList(engine StorageEngine, key string, list *datatype.List, existed bool) error {
+	if list.Len() > 0 {
+		return engine.Set(key, TypedValue{TypeList, list.Encode()})
+	}
+	if existed {
+		_, _, err := engine.Delete(key)
+		return err
+	}
+	return nil
+}
+
+// engineListLen, engineListRange, engineListOffset, enginePushList and
+// enginePopList call the engine's ListEngine method, or do the same by way
+// of Get and Set if it has none. Offsets are only kept by ListEngines; the
+// others read every list as having none.
+func engineListLen(engine StorageEngine, key string) (int, int, error) {
+	if lists, ok := engine.(ListEngine); ok {
+		return lists.ListLen(key)
+	}
+	list, _, err := loadEngineList(engine, key)
+	if err != nil {
+		return 0, 0, err
+	}
+	return list.Len(), list.Size(), nil
+}
+
+func engineListRange(engine StorageEngine, key string, start int64, stop int64) ([]string, bool, error) {
+	if lists, ok := engine.(ListEngine); ok {
+		return lists.ListRange(key, start, stop)
+	}
+	list, ok, err := loadEngineList(engine, key)
+	if err != nil {
+		return nil, false, err
+	}
+	return list.Range(start, stop), ok, nil
+}
+
+func engineListOffset(engine StorageEngine, key string) (uint64, error) {
+	if lists, ok := engine.(ListEngine); ok {
+		return lists.ListOffset(key)
+	}
+	return 0, nil
+}
+
+func enginePushList(engine StorageEngine, key string, left bool, values []string, offset uint64) (int, error) {
+	if lists, ok := engine.(ListEngine); ok {
+		return lists.PushList(key, left, values, offset)
+	}
+	list, existed, err := loadEngineList(engine, key)
+	if err != nil {
+		return 0, err
+	}
+	pushValues(list, left, values)
+	return list.Len(), storeEngineList(engine, key, list, existed)
+}
+
+func enginePopList(engine StorageEngine, key string, left bool, count int, offset uint64) ([]string, int, error) {
+	if lists, ok := engine.(ListEngine); ok {
+		return lists.PopList(key, left, count, offset)
+	}
+	list, existed, err := loadEngineList(engine, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	popped := popValues(list, left, count)
+	if len(popped) == 0 {
+		return nil, list.Len(), nil
+	}
+	return popped, list.Len(), storeEngineList(engine, key, list, existed)
+}
+
+func pushValues(list *datatype.List, left bool, values []string) {
+	if left {
+		list.PushLeft(values...)
+	} else {
+		list.PushRight(values...)
+	}
+}
+
+func popValues(list *datatype.List, left bool, count int) []string {
+	var popped []string
+	for len(popped) < count {
+		var value string
+		var ok bool
+		if left {
+			value, ok = list.PopLeft()
+		} else {
+			value, ok = list.PopRight()
+		}
+		if !ok {
+			break
+		}
+		popped = append(popped, value)
+	}
+	return popped
+}
+
+// memoryKeys holds the keys of an in-memory engine: lists as
+// datatype.Lists, so they can be pushed and popped in place, with the
+// offsets recorded for them, and every other value as it was set. MemoryEngine holds one, and each of
+// ShardedEngine's shards one under its lock. Its read methods never change
+// it, so they can run in parallel with each other.
+type memoryKeys struct {
+	values  map[string]TypedValue
+	lists   map[string]*datatype.List
+	offsets map[string]uint64
+}
+
+func newMemoryKeys() memoryKeys {
+	return memoryKeys{make(map[string]TypedValue), make(map[string]*datatype.List), make(map[string]uint64)}
+}
+
+func (keys memoryKeys) get(key string) (TypedValue, bool) {
+	if list, ok := keys.lists[key]; ok {
+		return TypedValue{TypeList, list.Encode()}, true
+	}
+	value, ok := keys.values[key]
+	return value, ok
+}
+
+// set holds a list as a list, failing if its encoding does not decode, and
+// anything else as it is.
+func (keys memoryKeys) set(key string, value TypedValue) error {
+	if value.Type == TypeList {
+		list, err := datatype.DecodeList(value.Data)
+		if err != nil {
+			return err
+		}
+		delete(keys.values, key)
+		delete(keys.offsets, key)
+		keys.lists[key] = list
+		return nil
+	}
+	delete(keys.lists, key)
+	delete(keys.offsets, key)
+	keys.values[key] = value
+	return nil
+}
+
+func (keys memoryKeys) delete(key string) (TypedValue, bool) {
+	value, ok := keys.get(key)
+	delete(keys.values, key)
+	delete(keys.lists, key)
+	delete(keys.offsets, key)
+	return value, ok
+}
+
+func (keys memoryKeys) scan(fn func(key string, value TypedValue) bool) bool {
+	for key, value := range keys.values {
+		if !fn(key, value) {
+			return false
+		}
+	}
+	for key, list := range keys.lists {
+		if !fn(key, TypedValue{TypeList, list.Encode()}) {
+			return false
+		}
+	}
+	return true
+}
+
+func (keys memoryKeys) appendKeys(dst []string) []string {
+	for key := range keys.values {
+		dst = append(dst, key)
+	}
+	for key := range keys.lists {
+		dst = append(dst, key)
+	}
+	return dst
+}
+
+func (keys memoryKeys) len() int {
+	return len(keys.values) + len(keys.lists)
+}
+
+// sample picks from values and lists in proportion to their size, so
+// every key is about equally likely to be picked.
+func (keys memoryKeys) sample(n int) []string {
+	total := keys.len()
+	if total == 0 || n <= 0 {
+		return nil
+	}
+	sample := make([]string, 0, n)
+	for range n {
+		if rand.IntN(total) < len(keys.values) {
+			sample = append(sample, sampleMapKeys(keys.values, 1)...)
+		} else {
+			sample = append(sample, sampleMapKeys(keys.lists, 1)...)
+		}
+	}
+	return sample
+}
+
+func (keys memoryKeys) inspect(encoding string, key string) (ObjectInfo, bool) {
+	if list, ok := keys.lists[key]; ok {
+		return ObjectInfo{Encoding: encoding, Size: len(key) + list.EncodedLen() + approxEntryOverhead}, true
+	}
+	value, ok := keys.values[key]
+	if !ok {
+		return ObjectInfo{}, false
+	}
+	return inMemoryObjectInfo(encoding, key, value.Data), true
+}
+
+// list returns the list under key, or an empty one if there is none. Every
+// list is held as one, so a value held as it was set is of another type.
+func (keys memoryKeys) list(key string) (*datatype.List, bool, error) {
+	if list, ok := keys.lists[key]; ok {
+		return list, true, nil
+	}
+	if _, ok := keys.values[key]; ok {
+		return nil, false, ErrWrongType
+	}
+	return datatype.NewList(), false, nil
+}
+
+// storeList holds a list changed in place along with offset, removing the
+// key once it is empty.
+func (keys memoryKeys) storeList(key string, list *datatype.List, offset uint64) {
+	delete(keys.values, key)
+	if list.Len() > 0 {
+		keys.lists[key] = list
+	} else {
+		delete(keys.lists, key)
+	}
+	if list.Len() > 0 && offset > 0 {
+		keys.offsets[key] = offset
+	} else {
+		delete(keys.offsets, key)
+	}
+}
+
+func (keys memoryKeys) listLen(key string) (int, int, error) {
+	list, _, err := keys.list(key)
+	if err != nil {
+		return 0, 0, err
+	}
+	return list.Len(), list.Size(), nil
+}
+
+func (keys memoryKeys) listRange(key string, start int64, stop int64) ([]string, bool, error) {
+	list, ok, err := keys.list(key)
+	if err != nil {
+		return nil, false, err
+	}
+	return list.Range(start, stop), ok, nil
+}
+
+func (keys memoryKeys) listOffset(key string) (uint64, error) {
+	if _, _, err := keys.list(key); err != nil {
+		return 0, err
+	}
+	return keys.offsets[key], nil
+}
+
+func (keys memoryKeys) pushList(key string, left bool, values []string, offset uint64) (int, error) {
+	list, _, err := keys.list(key)
+	if err != nil {
+		return 0, err
+	}
+	pushValues(list, left, values)
+	keys.storeList(key, list, offset)
+	return list.Len(), nil
+}
+
+func (keys memoryKeys) popList(key string, left bool, count int, offset uint64) ([]string, int, error) {
+	list, ok, err := keys.list(key)
+	if err != nil || !ok {
+		return nil, 0, err
+	}
+	popped := popValues(list, left, count)
+	keys.storeList(key, list, offset)
+	return popped, list.Len(), nil
+}
@@ -0,0 +1,285 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestList_PushPopAndRange(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	if n, err := store.RPush("list", "a", "b", "c"); err != nil || n != 3 {
+		t.Fatalf("RPush = (%d, %v), want (3, nil)", n, err)
+	}
+	if n, err := store.LPush("list", "y", "z"); err != nil || n != 5 {
+		t.Fatalf("LPush = (%d, %v), want (5, nil)", n, err)
+	}
+	if values, err := store.LRange("list", 0, -1); err != nil || fmt.Sprint(values) != "[z y a b c]" {
+		t.Fatalf("LRange = (%v, %v), want [z y a b c]", values, err)
+	}
+	if values, err := store.LRange("list", -2, 10); err != nil || fmt.Sprint(values) != "[b c]" {
+		t.Fatalf("LRange(-2, 10) = (%v, %v), want [b c]", values, err)
+	}
+	if n, err := store.LLen("list"); err != nil || n != 5 {
+		t.Fatalf("LLen = (%d, %v), want (5, nil)", n, err)
+	}
+	if value, err := store.LIndex("list", -1); err != nil || deref(value) != "c" {
+		t.Fatalf("LIndex(-1) = (%q, %v), want c", deref(value), err)
+	}
+	if _, err := store.LIndex("list", 5); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("LIndex past the end = %v, want ErrKeyNotFound", err)
+	}
+
+	if value, err := store.LPop("list"); err != nil || deref(value) != "z" {
+		t.Fatalf("LPop = (%q, %v), want z", deref(value), err)
+	}
+	if value, err := store.RPop("list"); err != nil || deref(value) != "c" {
+		t.Fatalf("RPop = (%q, %v), want c", deref(value), err)
+	}
+	for range 3 {
+		if _, err := store.LPop("list"); err != nil {
+			t.Fatalf("LPop returned error: %v", err)
+		}
+	}
+	if _, err := store.LPop("list"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("LPop of an empty list = %v, want ErrKeyNotFound", err)
+	}
+	if ttl, err := store.TTL("list"); err != nil || ttl != TTLNoKey {
+		t.Fatalf("TTL = (%v, %v), want the emptied list removed", ttl, err)
+	}
+	if values, err := store.LRange("missing", 0, -1); err != nil || len(values) != 0 {
+		t.Fatalf("LRange of missing key = (%v, %v), want an empty list", values, err)
+	}
+	if n, err := store.LLen("missing"); err != nil || n != 0 {
+		t.Fatalf("LLen of missing key = (%d, %v), want (0, nil)", n, err)
+	}
+}
+
+func TestList_WrongTypeAndExpiry(t *testing.T) {
+	store := newTestKeyValueService(t)
+	clock := newTestClock(store)
+
+	if _, err := store.Set("plain", "v"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := store.HSet("hash", map[string]string{"f": "v"}); err != nil {
+		t.Fatalf("HSet returned error: %v", err)
+	}
+	if _, err := store.RPush("plain", "x"); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("RPush to a string = %v, want ErrWrongType", err)
+	}
+	if _, err := store.LRange("hash", 0, -1); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("LRange of a hash = %v, want ErrWrongType", err)
+	}
+	if _, err := store.RPush("list", "a"); err != nil {
+		t.Fatalf("RPush returned error: %v", err)
+	}
+	if _, err := store.Get("list"); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("Get of a list = %v, want ErrWrongType", err)
+	}
+	if _, err := store.HGet("list", "f"); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("HGet of a list = %v, want ErrWrongType", err)
+	}
+
+	if _, err := store.ExpireAt("list", clock.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("ExpireAt returned error: %v", err)
+	}
+	if _, err := store.RPush("list", "b"); err != nil {
+		t.Fatalf("RPush returned error: %v", err)
+	}
+	if ttl, err := store.TTL("list"); err != nil || ttl != time.Minute {
+		t.Fatalf("TTL = (%v, %v), want the expiry kept", ttl, err)
+	}
+	clock.Advance(time.Minute)
+	if n, err := store.LLen("list"); err != nil || n != 0 {
+		t.Fatalf("LLen of expired list = (%d, %v), want (0, nil)", n, err)
+	}
+}
+
+func TestList_ConsumersPopEachValueOnce(t *testing.T) {
+	for _, execution := range []ExecutionMode{ActorExecution, DirectExecution} {
+		store := newTestKeyValueServiceWithConfig(t, Config{Execution: execution})
+
+		const values = 200
+		for i := range values {
+			if _, err := store.RPush("queue", fmt.Sprint(i)); err != nil {
+				t.Fatalf("RPush returned error: %v", err)
+			}
+		}
+
+		var mu sync.Mutex
+		popped := make(map[string]int)
+		var wg sync.WaitGroup
+		for range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					value, err := store.LPop("queue")
+					if errors.Is(err, ErrKeyNotFound) {
+						return
+					}
+					if err != nil {
+						t.Errorf("LPop returned error: %v", err)
+						return
+					}
+					mu.Lock()
+					popped[*value]++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		if len(popped) != values {
+			t.Fatalf("popped %d distinct values, want %d", len(popped), values)
+		}
+		for value, count := range popped {
+			if count != 1 {
+				t.Fatalf("value %s was popped %d times", value, count)
+			}
+		}
+	}
+}
+
+// setCountingEngine counts the values written to a MemoryEngine whole.
+type setCountingEngine struct {
+	*MemoryEngine
+	sets int
+}
+
+func (engine *setCountingEngine) Set(key string, value TypedValue) error {
+	engine.sets++
+	return engine.MemoryEngine.Set(key, value)
+}
+
+func TestList_PushAndPopDoNotRewriteTheList(t *testing.T) {
+	engine := &setCountingEngine{MemoryEngine: NewMemoryEngine()}
+	store := newTestKeyValueServiceWithConfig(t, Config{Engine: engine})
+
+	for i := range 1000 {
+		if _, err := store.RPush("queue", fmt.Sprint(i)); err != nil {
+			t.Fatalf("RPush returned error: %v", err)
+		}
+	}
+	for i := range 1000 {
+		if value, err := store.LPop("queue"); err != nil || deref(value) != fmt.Sprint(i) {
+			t.Fatalf("LPop = (%q, %v), want %d", deref(value), err, i)
+		}
+	}
+	if engine.sets != 0 {
+		t.Fatalf("pushes and pops wrote the list whole %d times, want none", engine.sets)
+	}
+}
+
+func TestList_ReplicatesPushesAndPopsAsTheirValues(t *testing.T) {
+	primary := newTestKeyValueService(t)
+	if _, err := primary.RPush("queue", "a", "b", "c"); err != nil {
+		t.Fatalf("RPush returned error: %v", err)
+	}
+	stream, err := primary.Replicate(100)
+	if err != nil {
+		t.Fatalf("Replicate returned error: %v", err)
+	}
+	defer stream.Close()
+	replica := newTestKeyValueService(t)
+	syncReplica(t, stream, replica)
+
+	if _, err := primary.LPush("queue", "y", "z"); err != nil {
+		t.Fatalf("LPush returned error: %v", err)
+	}
+	if _, err := primary.RPop("queue"); err != nil {
+		t.Fatalf("RPop returned error: %v", err)
+	}
+
+	var mutations []Mutation
+	for len(stream.Mutations()) > 0 {
+		mutations = append(mutations, <-stream.Mutations())
+	}
+	want := []Mutation{
+		{Type: MutationListPush, Key: "queue", Values: []string{"y", "z"}, Left: true, Length: 5},
+		{Type: MutationListPop, Key: "queue", Values: []string{"c"}, Length: 4},
+	}
+	if len(mutations) != len(want) {
+		t.Fatalf("streamed %+v, want %+v", mutations, want)
+	}
+	for i, mutation := range mutations {
+		mutation.Offset = 0
+		if fmt.Sprint(mutation) != fmt.Sprint(want[i]) {
+			t.Fatalf("mutation %d = %+v, want %+v", i, mutation, want[i])
+		}
+	}
+
+	// Applying a change twice leaves the list as the first left it
+	for _, mutation := range mutations {
+		if err := replica.ApplyMutations([]Mutation{mutation, mutation}); err != nil {
+			t.Fatalf("ApplyMutations returned error: %v", err)
+		}
+	}
+	if values, err := replica.LRange("queue", 0, -1); err != nil || fmt.Sprint(values) != "[z y a b]" {
+		t.Fatalf("replica LRange = (%v, %v), want [z y a b]", values, err)
+	}
+
+	// A pop that empties the list removes it
+	drain := Mutation{Type: MutationListPop, Key: "queue", Values: []string{"z", "y", "a", "b"}, Left: true}
+	if err := replica.ApplyMutations([]Mutation{drain}); err != nil {
+		t.Fatalf("ApplyMutations returned error: %v", err)
+	}
+	if ttl, err := replica.TTL("queue"); err != nil || ttl != TTLNoKey {
+		t.Fatalf("replica TTL = (%v, %v), want the emptied list removed", ttl, err)
+	}
+}
+
+func TestList_ReplayedChangesAreSkippedByOffset(t *testing.T) {
+	primary := newTestKeyValueService(t)
+	stream, err := primary.Replicate(100)
+	if err != nil {
+		t.Fatalf("Replicate returned error: %v", err)
+	}
+	defer stream.Close()
+	replica := newTestKeyValueService(t)
+	syncReplica(t, stream, replica)
+
+	if _, err := primary.RPush("queue", "a", "b"); err != nil {
+		t.Fatalf("RPush returned error: %v", err)
+	}
+	if _, err := primary.LPop("queue"); err != nil {
+		t.Fatalf("LPop returned error: %v", err)
+	}
+	if _, err := primary.RPush("queue", "c"); err != nil {
+		t.Fatalf("RPush returned error: %v", err)
+	}
+	var mutations []Mutation
+	for len(stream.Mutations()) > 0 {
+		mutations = append(mutations, <-stream.Mutations())
+	}
+	if len(mutations) != 3 {
+		t.Fatalf("streamed %+v, want a push, a pop and a push", mutations)
+	}
+
+	// Resuming from an older checkpoint replays the pop and the push that
+	// followed it, which leave the list as it was
+	if err := replica.ApplyMutations(mutations); err != nil {
+		t.Fatalf("ApplyMutations returned error: %v", err)
+	}
+	if err := replica.ApplyMutations(mutations[1:]); err != nil {
+		t.Fatalf("ApplyMutations of the replayed changes returned error: %v", err)
+	}
+	if values, err := replica.LRange("queue", 0, -1); err != nil || fmt.Sprint(values) != "[b c]" {
+		t.Fatalf("replica LRange = (%v, %v), want [b c]", values, err)
+	}
+
+	// A replayed change to a key a later change made a string is skipped,
+	// and the later change is replayed after it
+	if _, err := primary.Set("queue", "now a string"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	set := <-stream.Mutations()
+	if err := replica.ApplyMutations([]Mutation{set, mutations[2], set}); err != nil {
+		t.Fatalf("ApplyMutations of the replayed changes returned error: %v", err)
+	}
+	assertValue(t, replica, "queue", stringPointer("now a string"))
+}
@@ -0,0 +1,154 @@
+package kvstore
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// encodeLock stores a lock's fencing token as 8 little-endian bytes, held
+// as a TypeLock value.
+func encodeLock(token uint64) string {
+	return string(binary.LittleEndian.AppendUint64(nil, token))
+}
+
+func decodeLock(value string) (uint64, bool) {
+	if len(value) != 8 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint64([]byte(value)), true
+}
+
+// nextFencingToken returns a token greater than every token issued before.
+// Tokens are seeded from the clock, so they keep increasing across restarts
+// as long as the clock does not go backwards.
+func (kvStore *KeyValueStore) nextFencingToken() uint64 {
+	now := uint64(kvStore.currentTime().UnixNano())
+	for {
+		last := kvStore.fencing.Load()
+		next := max(last+1, now)
+		if kvStore.fencing.CompareAndSwap(last, next) {
+			return next
+		}
+	}
+}
+
+// ProcessLockCommand acquires the lock under command.key until
+// command.expireAt and replies with its fencing token, or 0 if the lock is
+// already held.
+func (kvStore *KeyValueStore) ProcessLockCommand(command KeyValueCommand) KeyValueOutput {
+	if !command.expireAt.After(kvStore.currentTime()) {
+		return KeyValueOutput{false, nil, fmt.Errorf("lock %s has no expiry in the future", command.key), 0}
+	}
+	deadline, err := unixNanos(command.expireAt)
+	if err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	defer kvStore.keyLocks.lock(command)()
+
+	key := command.key
+	if !kvStore.expired(command) {
+		value, ok, err := kvStore.engine.Get(key)
+		if err != nil {
+			return KeyValueOutput{false, nil, err, 0}
+		}
+		if ok {
+			if value.Type != TypeLock {
+				return KeyValueOutput{false, nil, ErrWrongType, 0}
+			}
+			return KeyValueOutput{true, nil, nil, 0}
+		}
+	}
+
+	token := kvStore.nextFencingToken()
+	if err := kvStore.setValueExpiring(key, TypedValue{TypeLock, encodeLock(token)}, deadline); err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	return KeyValueOutput{true, nil, nil, int64(token)}
+}
+
+// ProcessUnlockCommand releases the lock under command.key if it is still
+// held with command.token, replying with 1 if it was released and 0
+// otherwise.
+func (kvStore *KeyValueStore) ProcessUnlockCommand(command KeyValueCommand) KeyValueOutput {
+	defer kvStore.keyLocks.lock(command)()
+
+	key := command.key
+	if kvStore.expired(command) {
+		return KeyValueOutput{true, nil, nil, 0}
+	}
+	value, ok, err := kvStore.engine.Get(key)
+	if err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	if !ok {
+		return KeyValueOutput{true, nil, nil, 0}
+	}
+	if value.Type != TypeLock {
+		return KeyValueOutput{false, nil, ErrWrongType, 0}
+	}
+	token, isLock := decodeLock(value.Data)
+	if !isLock {
+		return KeyValueOutput{false, nil, fmt.Errorf("lock under key %s is corrupt", key), 0}
+	}
+	if token != command.token {
+		return KeyValueOutput{true, nil, nil, 0}
+	}
+
+	if _, _, err := kvStore.deleteValue(key); err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	kvStore.forgetDeadline(key)
+	kvStore.forget(key)
+	return KeyValueOutput{true, nil, nil, 1}
+}
+
+// Lock acquires the lock named key for ttl. On success it returns a fencing
+// token that is greater than any token issued before it, which the holder
+// should pass along to resources it protects so they can reject requests
+// from a previous holder whose lock expired. acquired is false, with no
+// error, if the lock is already held.
+func (kvService *KeyValueService) Lock(key string, ttl time.Duration) (token uint64, acquired bool, err error) {
+	return kvService.LockContext(context.Background(), key, ttl)
+}
+
+// LockContext is Lock with ctx's deadline, as SetContext is Set.
+func (kvService *KeyValueService) LockContext(ctx context.Context, key string, ttl time.Duration) (token uint64, acquired bool, err error) {
+	if ttl <= 0 {
+		return 0, false, fmt.Errorf("lock ttl must be positive, got %s", ttl)
+	}
+	if err := kvService.CheckWritable(); err != nil {
+		return 0, false, err
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return 0, false, err
+	}
+	deadline := kvService.store.currentTime().Add(ttl)
+	res := kvService.dispatch(withDeadline(ctx, KeyValueCommand{commandType: LOCK, key: key, expireAt: deadline}))
+	if res.err != nil {
+		return 0, false, res.err
+	}
+
+	return uint64(res.integer), res.integer != 0, nil
+}
+
+// Unlock releases the lock named key if it is still held with token, and
+// reports whether it was. A lock that expired, or was taken over by another
+// holder, is left alone.
+func (kvService *KeyValueService) Unlock(key string, token uint64) (bool, error) {
+	return kvService.UnlockContext(context.Background(), key, token)
+}
+
+// UnlockContext is Unlock with ctx's deadline, as SetContext is Set.
+func (kvService *KeyValueService) UnlockContext(ctx context.Context, key string, token uint64) (bool, error) {
+	if err := kvService.CheckWritable(); err != nil {
+		return false, err
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return false, err
+	}
+	res := kvService.dispatch(withDeadline(ctx, KeyValueCommand{commandType: UNLOCK, key: key, token: token}))
+
+	return res.integer == 1, res.err
+}
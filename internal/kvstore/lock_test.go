@@ -0,0 +1,153 @@
+package kvstore
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLock_ExclusiveUntilUnlocked(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	token, acquired, err := store.Lock("job", time.Minute)
+	if err != nil || !acquired || token == 0 {
+		t.Fatalf("Lock = (%d, %t, %v), want a token", token, acquired, err)
+	}
+	if _, acquired, err := store.Lock("job", time.Minute); err != nil || acquired {
+		t.Fatalf("second Lock = (%t, %v), want (false, nil)", acquired, err)
+	}
+
+	if released, err := store.Unlock("job", token+1); err != nil || released {
+		t.Fatalf("Unlock with the wrong token = (%t, %v), want (false, nil)", released, err)
+	}
+	if released, err := store.Unlock("job", token); err != nil || !released {
+		t.Fatalf("Unlock = (%t, %v), want (true, nil)", released, err)
+	}
+
+	next, acquired, err := store.Lock("job", time.Minute)
+	if err != nil || !acquired || next <= token {
+		t.Fatalf("Lock after Unlock = (%d, %t, %v), want a token above %d", next, acquired, err, token)
+	}
+}
+
+func TestLock_ExpiresAndFencesPreviousHolder(t *testing.T) {
+	store := newTestKeyValueService(t)
+	clock := newTestClock(store)
+
+	first, _, err := store.Lock("job", time.Second)
+	if err != nil {
+		t.Fatalf("Lock returned error: %v", err)
+	}
+	if ttl, err := store.TTL("job"); err != nil || ttl != time.Second {
+		t.Fatalf("TTL of lock = (%v, %v), want (1s, nil)", ttl, err)
+	}
+
+	clock.Advance(time.Second)
+	second, acquired, err := store.Lock("job", time.Second)
+	if err != nil || !acquired || second <= first {
+		t.Fatalf("Lock after expiry = (%d, %t, %v), want a token above %d", second, acquired, err, first)
+	}
+
+	// The expired holder cannot release the new holder's lock
+	if released, err := store.Unlock("job", first); err != nil || released {
+		t.Fatalf("Unlock by the expired holder = (%t, %v), want (false, nil)", released, err)
+	}
+}
+
+func TestLock_RejectsPlainValuesAndBadTTL(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	if _, err := store.Set("plain", "value"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, _, err := store.Lock("plain", time.Minute); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("Lock on a plain value returned %v, want ErrWrongType", err)
+	}
+	if _, err := store.Unlock("plain", 1); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("Unlock on a plain value returned %v, want ErrWrongType", err)
+	}
+	if _, _, err := store.Lock("job", 0); err == nil {
+		t.Fatalf("Lock with zero ttl succeeded, want error")
+	}
+}
+
+func TestLock_CannotBeForgedWithSet(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	// A string holding a lock's encoding is a string, not a lock
+	if _, err := store.Set("free", encodeLock(1<<40)); err != nil {
+		t.Fatalf("Set of a lock value returned error: %v", err)
+	}
+	if _, _, err := store.Lock("free", time.Minute); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("Lock of the string = %v, want ErrWrongType", err)
+	}
+	if _, err := store.Unlock("free", 1<<40); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("Unlock of the string = %v, want ErrWrongType", err)
+	}
+
+	token, _, err := store.Lock("job", time.Minute)
+	if err != nil {
+		t.Fatalf("Lock returned error: %v", err)
+	}
+	forged := token + 1
+	if _, err := store.SetIfEqual("job", encodeLock(token), encodeLock(forged)); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("SetIfEqual on a held lock = %v, want ErrWrongType", err)
+	}
+	if released, err := store.Unlock("job", forged); err != nil || released {
+		t.Fatalf("Unlock with the forged token = (%t, %v), want (false, nil)", released, err)
+	}
+	if released, err := store.Unlock("job", token); err != nil || !released {
+		t.Fatalf("Unlock by the holder = (%t, %v), want (true, nil)", released, err)
+	}
+}
+
+func TestLock_SingleWinnerUnderDirectExecution(t *testing.T) {
+	store := newTestKeyValueServiceWithConfig(t, Config{Execution: DirectExecution})
+
+	var winners atomic.Int64
+	var wg sync.WaitGroup
+	for range 64 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, acquired, err := store.Lock("job", time.Minute)
+			if err != nil {
+				t.Errorf("Lock returned error: %v", err)
+			}
+			if acquired {
+				winners.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if winners.Load() != 1 {
+		t.Fatalf("%d goroutines acquired the lock, want 1", winners.Load())
+	}
+}
+
+func TestCountMin_NoLostUpdatesUnderDirectExecution(t *testing.T) {
+	store := newTestKeyValueServiceWithConfig(t, Config{Execution: DirectExecution})
+	if err := store.CountMinInit("hits", 64, 2); err != nil {
+		t.Fatalf("CountMinInit returned error: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for range 32 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := store.CountMinIncrBy("hits", []string{"a"}, []uint32{1}); err != nil {
+				t.Errorf("CountMinIncrBy returned error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	counts, err := store.CountMinQuery("hits", "a")
+	if err != nil || counts[0] != 32 {
+		t.Fatalf("CountMinQuery = (%v, %v), want ([32], nil)", counts, err)
+	}
+}
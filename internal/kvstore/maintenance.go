@@ -0,0 +1,96 @@
+package kvstore
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrMaintenance = errors.New("KeyValueService is in maintenance mode, retry later")
+
+// maintenanceGate holds requests back while the node is in maintenance. Up
+// to maxQueued callers wait for at most maxWait for maintenance to end;
+// anyone beyond that bound, or still waiting when maxWait elapses, gets
+// ErrMaintenance so the client can back off and retry.
+type maintenanceGate struct {
+	mu        sync.Mutex
+	done      chan struct{}
+	queued    int
+	maxQueued int
+	maxWait   time.Duration
+}
+
+func (gate *maintenanceGate) start(maxQueued int, maxWait time.Duration) {
+	gate.mu.Lock()
+	defer gate.mu.Unlock()
+
+	gate.maxQueued = maxQueued
+	gate.maxWait = maxWait
+	if gate.done == nil {
+		gate.done = make(chan struct{})
+	}
+}
+
+func (gate *maintenanceGate) end() {
+	gate.mu.Lock()
+	defer gate.mu.Unlock()
+
+	if gate.done != nil {
+		close(gate.done)
+		gate.done = nil
+	}
+}
+
+func (gate *maintenanceGate) active() bool {
+	gate.mu.Lock()
+	defer gate.mu.Unlock()
+	return gate.done != nil
+}
+
+func (gate *maintenanceGate) wait() error {
+	gate.mu.Lock()
+	done := gate.done
+	if done == nil {
+		gate.mu.Unlock()
+		return nil
+	}
+	if gate.queued >= gate.maxQueued {
+		gate.mu.Unlock()
+		return ErrMaintenance
+	}
+	gate.queued++
+	maxWait := gate.maxWait
+	gate.mu.Unlock()
+
+	defer func() {
+		gate.mu.Lock()
+		gate.queued--
+		gate.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+		return ErrMaintenance
+	}
+}
+
+// StartMaintenance puts the service into maintenance mode. Requests arriving
+// while it is active queue for up to maxWait, with at most maxQueued waiting
+// at once; the rest are rejected with ErrMaintenance.
+func (kvService *KeyValueService) StartMaintenance(maxQueued int, maxWait time.Duration) {
+	kvService.maintenance.start(maxQueued, maxWait)
+}
+
+// EndMaintenance leaves maintenance mode and releases all queued requests.
+func (kvService *KeyValueService) EndMaintenance() {
+	kvService.maintenance.end()
+}
+
+func (kvService *KeyValueService) InMaintenance() bool {
+	return kvService.maintenance.active()
+}
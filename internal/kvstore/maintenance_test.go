@@ -0,0 +1,61 @@
+package kvstore
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMaintenance_QueuedRequestCompletesAfterEnd(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	store.StartMaintenance(1, time.Minute)
+	if !store.InMaintenance() {
+		t.Fatalf("InMaintenance() = false after StartMaintenance")
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := store.Set("foo", "bar")
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		t.Fatalf("Set returned %v during maintenance, want it to stay queued", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	store.EndMaintenance()
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("queued Set returned error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("queued Set did not complete after EndMaintenance")
+	}
+}
+
+func TestMaintenance_RejectsBeyondQueueBound(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	store.StartMaintenance(0, time.Minute)
+	defer store.EndMaintenance()
+
+	if _, err := store.Get("foo"); !errors.Is(err, ErrMaintenance) {
+		t.Fatalf("Get with a full maintenance queue returned %v, want ErrMaintenance", err)
+	}
+}
+
+func TestMaintenance_QueuedRequestTimesOut(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	store.StartMaintenance(10, 20*time.Millisecond)
+	defer store.EndMaintenance()
+
+	if _, err := store.Delete("foo"); !errors.Is(err, ErrMaintenance) {
+		t.Fatalf("Delete outlasting maintenance wait returned %v, want ErrMaintenance", err)
+	}
+}
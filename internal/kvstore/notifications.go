@@ -0,0 +1,238 @@
+package kvstore
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// EventExpired is published when an expired key is removed from the
+	// store.
+	EventExpired = "expired"
+	// EventSet is published whenever a key's value is written, by any
+	// command or by replication.
+	EventSet = "set"
+	// EventDel is published whenever a key is removed, including when it is
+	// removed because it expired, which is followed by EventExpired.
+	EventDel = "del"
+)
+
+// Event describes a change to a key, delivered to subscribers.
+type Event struct {
+	Type string
+	Key  string
+	Time time.Time
+}
+
+// Subscription receives events published by the store. Delivery is
+// best-effort and at-most-once: each event is offered to every subscriber
+// once, without blocking, and is dropped for a subscriber whose buffer is
+// full. Nothing is replayed after a restart or to late subscribers.
+type Subscription struct {
+	events  chan Event
+	types   []string
+	dropped atomic.Uint64
+	bus     *notificationBus
+	// queue replaces events for subscriptions made by Watch
+	queue *eventQueue
+	// mu guards closed so publish never sends on a closed channel
+	mu     sync.RWMutex
+	closed bool
+}
+
+// Events returns the channel events are delivered on. It is closed by
+// Close.
+func (subscription *Subscription) Events() <-chan Event {
+	return subscription.events
+}
+
+// Dropped reports how many events were discarded because the subscriber's
+// buffer was full.
+func (subscription *Subscription) Dropped() uint64 {
+	return subscription.dropped.Load()
+}
+
+func (subscription *Subscription) Close() {
+	subscription.bus.remove(subscription)
+
+	subscription.mu.Lock()
+	defer subscription.mu.Unlock()
+	if !subscription.closed {
+		subscription.closed = true
+		if subscription.events != nil {
+			close(subscription.events)
+		}
+		if subscription.queue != nil {
+			close(subscription.queue.done)
+		}
+	}
+}
+
+func (subscription *Subscription) deliver(event Event) {
+	if !slices.Contains(subscription.types, event.Type) {
+		return
+	}
+	subscription.mu.RLock()
+	defer subscription.mu.RUnlock()
+	if subscription.closed {
+		return
+	}
+	if subscription.queue != nil {
+		subscription.queue.push(event)
+		return
+	}
+
+	select {
+	case subscription.events <- event:
+	default:
+		subscription.dropped.Add(1)
+	}
+}
+
+// eventQueue holds a watcher's events until its callback takes them. It
+// grows instead of dropping events, so the store never waits on a slow
+// callback and a callback never misses an event.
+type eventQueue struct {
+	mu     sync.Mutex
+	events []Event
+	// ready holds a signal while events are queued; done is closed when
+	// the watch is stopped
+	ready chan struct{}
+	done  chan struct{}
+}
+
+func (queue *eventQueue) push(event Event) {
+	queue.mu.Lock()
+	queue.events = append(queue.events, event)
+	queue.mu.Unlock()
+	select {
+	case queue.ready <- struct{}{}:
+	default:
+	}
+}
+
+// run calls fn with each queued event, in order, until the watch is
+// stopped.
+func (queue *eventQueue) run(fn func(Event)) {
+	for {
+		select {
+		case <-queue.done:
+			return
+		case <-queue.ready:
+		}
+		queue.mu.Lock()
+		events := queue.events
+		queue.events = nil
+		queue.mu.Unlock()
+		for _, event := range events {
+			select {
+			case <-queue.done:
+				return
+			default:
+			}
+			fn(event)
+		}
+	}
+}
+
+// notificationBus is copy-on-write like hookRegistry, so publishing with no
+// subscribers costs a single atomic load.
+type notificationBus struct {
+	mu          sync.Mutex
+	subscribers atomic.Pointer[[]*Subscription]
+}
+
+func (bus *notificationBus) add(subscription *Subscription) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+
+	var next []*Subscription
+	if current := bus.subscribers.Load(); current != nil {
+		next = append(next, *current...)
+	}
+	next = append(next, subscription)
+	bus.subscribers.Store(&next)
+}
+
+func (bus *notificationBus) remove(subscription *Subscription) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+
+	current := bus.subscribers.Load()
+	if current == nil {
+		return
+	}
+	next := make([]*Subscription, 0, len(*current))
+	for _, s := range *current {
+		if s != subscription {
+			next = append(next, s)
+		}
+	}
+	bus.subscribers.Store(&next)
+}
+
+// publish offers an event to every subscriber, only reading the clock if
+// there is one.
+func (bus *notificationBus) publish(eventType string, key string, now func() time.Time) {
+	subscribers := bus.subscribers.Load()
+	if subscribers == nil || len(*subscribers) == 0 {
+		return
+	}
+
+	event := Event{eventType, key, now()}
+	for _, subscription := range *subscribers {
+		subscription.deliver(event)
+	}
+}
+
+// Subscribe registers for store events, buffering up to buffer undelivered
+// events before further ones are dropped. Expired events are published when
+// the store removes an expired key, which happens lazily: the first store
+// loop command to touch the key after its deadline removes it, and reads
+// served outside the store loop only hide it. A key that is overwritten or
+// deleted before it is removed produces no expired event.
+func (kvService *KeyValueService) Subscribe(buffer int) *Subscription {
+	return kvService.SubscribeTo(buffer, EventExpired)
+}
+
+// SubscribeTo is Subscribe for events of the given types, such as EventSet
+// and EventDel, which together tell a subscriber of every change to a
+// key's value.
+func (kvService *KeyValueService) SubscribeTo(buffer int, eventTypes ...string) *Subscription {
+	subscription := &Subscription{
+		events: make(chan Event, max(buffer, 0)),
+		types:  eventTypes,
+		bus:    &kvService.store.notifications,
+	}
+	kvService.store.notifications.add(subscription)
+	return subscription
+}
+
+// Watch calls fn for every event of the given types, one at a time and in
+// the order they were published, on a goroutine of its own. Unlike a
+// Subscription it never drops events: they are queued for as long as fn
+// takes, so fn should keep up with the store. It returns a function that
+// stops the watch; events still queued then are discarded.
+func (kvService *KeyValueService) Watch(fn func(Event), eventTypes ...string) (stop func()) {
+	queue := &eventQueue{ready: make(chan struct{}, 1), done: make(chan struct{})}
+	subscription := &Subscription{
+		types: eventTypes,
+		bus:   &kvService.store.notifications,
+		queue: queue,
+	}
+	kvService.store.notifications.add(subscription)
+	go queue.run(fn)
+	return subscription.Close
+}
+
+// OnExpire calls fn with each key the store removes because it expired, so
+// an application embedding the store can release what it kept for the key.
+// Keys are removed lazily, as described for Subscribe. It returns a
+// function that stops the calls.
+func (kvService *KeyValueService) OnExpire(fn func(key string)) (stop func()) {
+	return kvService.Watch(func(event Event) {
+		fn(event.Key)
+	}, EventExpired)
+}
@@ -0,0 +1,254 @@
+package kvstore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func expireKey(t *testing.T, store *KeyValueService, clock *testClock, key string) {
+	t.Helper()
+
+	if _, err := store.Set(key, "value"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := store.ExpireAt(key, clock.Now().Add(time.Second)); err != nil {
+		t.Fatalf("ExpireAt returned error: %v", err)
+	}
+	clock.Advance(time.Second)
+}
+
+func TestSubscribe_ExpiredEventPublishedOnce(t *testing.T) {
+	store := newTestKeyValueService(t)
+	clock := newTestClock(store)
+	subscription := store.Subscribe(10)
+	defer subscription.Close()
+
+	expireKey(t, store, clock, "session:1")
+
+	// Both reads see the key as expired, but only the first removes it
+	for range 2 {
+		if _, err := store.Get("session:1"); err == nil {
+			t.Fatalf("Get of expired key succeeded, want error")
+		}
+	}
+
+	select {
+	case event := <-subscription.Events():
+		if event.Type != EventExpired || event.Key != "session:1" || !event.Time.Equal(clock.Now()) {
+			t.Fatalf("event = %+v, want expired event for session:1 at %v", event, clock.Now())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no expired event published")
+	}
+
+	select {
+	case event := <-subscription.Events():
+		t.Fatalf("unexpected second event %+v", event)
+	default:
+	}
+}
+
+func TestSubscribe_NoEventForOverwrittenKey(t *testing.T) {
+	store := newTestKeyValueService(t)
+	clock := newTestClock(store)
+	subscription := store.Subscribe(10)
+	defer subscription.Close()
+
+	expireKey(t, store, clock, "foo")
+	if _, err := store.Set("foo", "fresh"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := store.Get("foo"); err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+
+	select {
+	case event := <-subscription.Events():
+		t.Fatalf("unexpected event %+v for an overwritten key", event)
+	default:
+	}
+}
+
+func TestSubscribe_FastPathReadsDoNotPublish(t *testing.T) {
+	store := newTestKeyValueServiceWithConfig(t, Config{ConcurrentReads: true})
+	clock := newTestClock(store)
+	subscription := store.Subscribe(10)
+	defer subscription.Close()
+
+	expireKey(t, store, clock, "foo")
+	if _, err := store.Get("foo"); err == nil {
+		t.Fatalf("Get of expired key succeeded, want error")
+	}
+	if len(subscription.Events()) != 0 {
+		t.Fatalf("fast-path read published an event")
+	}
+
+	// Removal by a store loop command publishes the event
+	if _, err := store.Persist("foo"); err != nil {
+		t.Fatalf("Persist returned error: %v", err)
+	}
+	if len(subscription.Events()) != 1 {
+		t.Fatalf("got %d events after removal, want 1", len(subscription.Events()))
+	}
+}
+
+func TestSubscribe_SlowSubscriberDropsEvents(t *testing.T) {
+	store := newTestKeyValueService(t)
+	clock := newTestClock(store)
+	slow := store.Subscribe(1)
+	defer slow.Close()
+	fast := store.Subscribe(10)
+	defer fast.Close()
+
+	for _, key := range []string{"a", "b", "c"} {
+		expireKey(t, store, clock, key)
+		if _, err := store.Get(key); err == nil {
+			t.Fatalf("Get of expired key %s succeeded, want error", key)
+		}
+	}
+
+	if len(slow.Events()) != 1 || slow.Dropped() != 2 {
+		t.Fatalf("slow subscriber has %d events and %d dropped, want 1 and 2", len(slow.Events()), slow.Dropped())
+	}
+	if len(fast.Events()) != 3 || fast.Dropped() != 0 {
+		t.Fatalf("fast subscriber has %d events and %d dropped, want 3 and 0", len(fast.Events()), fast.Dropped())
+	}
+}
+
+func TestSubscription_CloseStopsDelivery(t *testing.T) {
+	store := newTestKeyValueService(t)
+	clock := newTestClock(store)
+	subscription := store.Subscribe(10)
+	subscription.Close()
+	subscription.Close()
+
+	expireKey(t, store, clock, "foo")
+	if _, err := store.Get("foo"); err == nil {
+		t.Fatalf("Get of expired key succeeded, want error")
+	}
+
+	if _, ok := <-subscription.Events(); ok {
+		t.Fatalf("received an event after Close")
+	}
+	if subscription.Dropped() != 0 {
+		t.Fatalf("Dropped = %d after Close, want 0", subscription.Dropped())
+	}
+}
+
+func TestSubscribeTo_PublishesWrites(t *testing.T) {
+	store := newTestKeyValueService(t)
+	clock := newTestClock(store)
+	subscription := store.SubscribeTo(10, EventSet, EventDel)
+	defer subscription.Close()
+
+	if _, err := store.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := store.Delete("foo"); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+	// Deleting a missing key changes nothing
+	if _, err := store.Delete("foo"); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+	// and an expiry is only seen as the key's removal
+	expireKey(t, store, clock, "session:1")
+	if _, err := store.Get("session:1"); err == nil {
+		t.Fatalf("Get of expired key succeeded, want error")
+	}
+
+	want := []Event{
+		{EventSet, "foo", clock.Now().Add(-time.Second)},
+		{EventDel, "foo", clock.Now().Add(-time.Second)},
+		{EventSet, "session:1", clock.Now().Add(-time.Second)},
+		{EventDel, "session:1", clock.Now()},
+	}
+	if len(subscription.Events()) != len(want) {
+		t.Fatalf("got %d events, want %d", len(subscription.Events()), len(want))
+	}
+	for _, expected := range want {
+		if event := <-subscription.Events(); event.Type != expected.Type || event.Key != expected.Key || !event.Time.Equal(expected.Time) {
+			t.Fatalf("event = %+v, want %+v", event, expected)
+		}
+	}
+}
+
+func TestOnExpire_CallsBackWithExpiredKeys(t *testing.T) {
+	store := newTestKeyValueService(t)
+	clock := newTestClock(store)
+	expiredKeys := make(chan string, 10)
+	stop := store.OnExpire(func(key string) {
+		expiredKeys <- key
+	})
+	defer stop()
+
+	expireKey(t, store, clock, "session:1")
+	if _, err := store.Get("session:1"); err == nil {
+		t.Fatalf("Get of expired key succeeded, want error")
+	}
+
+	select {
+	case key := <-expiredKeys:
+		if key != "session:1" {
+			t.Fatalf("OnExpire called with %q, want session:1", key)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("OnExpire callback not called")
+	}
+	select {
+	case key := <-expiredKeys:
+		t.Fatalf("unexpected callback for %q", key)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestWatch_SlowCallbackMissesNothing(t *testing.T) {
+	store := newTestKeyValueService(t)
+	release := make(chan struct{})
+	keys := make(chan string, 100)
+	stop := store.Watch(func(event Event) {
+		<-release
+		keys <- event.Key
+	}, EventSet)
+	defer stop()
+
+	// Far more writes than a Subscription would buffer, while the callback
+	// is stuck on the first
+	for i := range 100 {
+		if _, err := store.Set(fmt.Sprintf("k%d", i), "value"); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+	}
+	close(release)
+
+	for i := range 100 {
+		select {
+		case key := <-keys:
+			if want := fmt.Sprintf("k%d", i); key != want {
+				t.Fatalf("callback %d got %q, want %q", i, key, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("callback got %d of 100 events", i)
+		}
+	}
+}
+
+func TestWatch_StopEndsCallbacks(t *testing.T) {
+	store := newTestKeyValueService(t)
+	calls := make(chan string, 10)
+	stop := store.Watch(func(event Event) {
+		calls <- event.Key
+	}, EventSet)
+	stop()
+	stop()
+
+	if _, err := store.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	select {
+	case key := <-calls:
+		t.Fatalf("callback called for %q after stop", key)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
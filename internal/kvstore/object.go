@@ -0,0 +1,112 @@
+package kvstore
+
+import (
+	"context"
+	"time"
+)
+
+// approxEntryOverhead estimates the bytes an in-memory engine spends on a
+// key beyond the key and value themselves: string headers and map bucket
+// space.
+const approxEntryOverhead = 48
+
+// ObjectInfo describes how the store holds a key, for debugging memory use
+// and eviction.
+type ObjectInfo struct {
+	// Encoding names how the engine holds the key, such as "memory",
+	// "disk" or "tiered-hot".
+	Encoding string
+	// Size is an approximation of the bytes the key occupies.
+	Size int
+	// LastAccess is when the key was last read or written. It is zero
+	// unless Config.TrackAccess is set, and for keys not touched since the
+	// store started.
+	LastAccess time.Time
+	// Idle is how long the key has gone without being read or written. It
+	// is zero unless Config.TrackAccess is set; keys not touched since the
+	// store started count as idle since then.
+	Idle time.Duration
+	// Frequency is the key's decayed access count. It is zero unless
+	// Config.TrackFrequency is set.
+	Frequency uint32
+}
+
+// KeyInspector is implemented by engines that can describe how they hold a
+// key without otherwise touching it; in particular without changing
+// recency, promoting or loading the key. Engines that do not implement it
+// are inspected through Get.
+type KeyInspector interface {
+	Inspect(key string) (ObjectInfo, bool, error)
+}
+
+func inspect(engine StorageEngine, key string) (ObjectInfo, bool, error) {
+	if inspector, ok := engine.(KeyInspector); ok {
+		return inspector.Inspect(key)
+	}
+	value, ok, err := engine.Get(key)
+	if err != nil || !ok {
+		return ObjectInfo{}, false, err
+	}
+	return ObjectInfo{Encoding: "unknown", Size: len(key) + len(value.Data)}, true, nil
+}
+
+func inMemoryObjectInfo(encoding string, key string, value string) ObjectInfo {
+	return ObjectInfo{Encoding: encoding, Size: len(key) + len(value) + approxEntryOverhead}
+}
+
+// ProcessObjectCommand fills command.object with the key's details and
+// replies with 1 if the key exists and 0 otherwise. It does not count as an
+// access to the key.
+func (kvStore *KeyValueStore) ProcessObjectCommand(command KeyValueCommand) KeyValueOutput {
+	key := command.key
+	if kvStore.expired(command) {
+		return KeyValueOutput{true, nil, nil, 0}
+	}
+	info, ok, err := inspect(kvStore.engine, key)
+	if err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	if !ok {
+		return KeyValueOutput{true, nil, nil, 0}
+	}
+
+	if at, ok := kvStore.lastAccess(key); ok {
+		info.LastAccess = at
+	}
+	if kvStore.trackAccess {
+		info.Idle = kvStore.idleTime(key)
+	}
+	if kvStore.trackFrequency {
+		info.Frequency = kvStore.frequencies.frequency(key, kvStore.currentTime().UnixNano())
+	}
+	if command.object != nil {
+		*command.object = info
+	}
+	return KeyValueOutput{true, nil, nil, 1}
+}
+
+// Object reports how key is held by the store, in the spirit of Redis's
+// OBJECT command. It returns an error for keys that do not exist.
+func (kvService *KeyValueService) Object(key string) (ObjectInfo, error) {
+	return kvService.ObjectContext(context.Background(), key)
+}
+
+// ObjectContext is Object with ctx's deadline, as GetContext is Get.
+func (kvService *KeyValueService) ObjectContext(ctx context.Context, key string) (ObjectInfo, error) {
+	if err := kvService.CheckActive(); err != nil {
+		return ObjectInfo{}, err
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return ObjectInfo{}, err
+	}
+
+	var info ObjectInfo
+	res := kvService.dispatchRead(withDeadline(ctx, KeyValueCommand{commandType: OBJECT, key: key, object: &info}))
+	if res.err != nil {
+		return ObjectInfo{}, res.err
+	}
+	if res.integer == 0 {
+		return ObjectInfo{}, keyNotFound(key)
+	}
+	return info, nil
+}
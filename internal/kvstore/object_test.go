@@ -0,0 +1,197 @@
+package kvstore
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestObject_ReportsEncodingSizeAndLastAccess(t *testing.T) {
+	store := newTestKeyValueServiceWithConfig(t, Config{TrackAccess: true})
+	clock := newTestClock(store)
+
+	if _, err := store.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	setAt := clock.Now()
+
+	clock.Advance(time.Minute)
+	info, err := store.Object("foo")
+	if err != nil {
+		t.Fatalf("Object returned error: %v", err)
+	}
+	if info.Encoding != "memory" {
+		t.Errorf("Encoding = %q, want %q", info.Encoding, "memory")
+	}
+	if info.Size != len("foo")+len("bar")+approxEntryOverhead {
+		t.Errorf("Size = %d, want %d", info.Size, len("foo")+len("bar")+approxEntryOverhead)
+	}
+	if !info.LastAccess.Equal(setAt) {
+		t.Errorf("LastAccess = %v, want %v", info.LastAccess, setAt)
+	}
+
+	// Object itself is not an access, Get is
+	if _, err := store.Get("foo"); err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	info, err = store.Object("foo")
+	if err != nil {
+		t.Fatalf("Object returned error: %v", err)
+	}
+	if !info.LastAccess.Equal(clock.Now()) {
+		t.Errorf("LastAccess after Get = %v, want %v", info.LastAccess, clock.Now())
+	}
+}
+
+func TestObject_MissingAndExpiredKeys(t *testing.T) {
+	store := newTestKeyValueService(t)
+	clock := newTestClock(store)
+
+	if _, err := store.Object("missing"); err == nil {
+		t.Fatalf("Object of missing key succeeded, want error")
+	}
+
+	expireKey(t, store, clock, "foo")
+	if _, err := store.Object("foo"); err == nil {
+		t.Fatalf("Object of expired key succeeded, want error")
+	}
+}
+
+func TestObject_TieredEngineDoesNotPromote(t *testing.T) {
+	cold, err := NewDiskEngine(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewDiskEngine returned error: %v", err)
+	}
+	engine := NewTieredEngine(1, cold)
+	store := newTestKeyValueServiceWithConfig(t, Config{Engine: engine})
+
+	for _, key := range []string{"cold", "hot"} {
+		if _, err := store.Set(key, "value"); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+	}
+
+	tests := []struct {
+		key      string
+		encoding string
+		size     int
+	}{
+		{"hot", "tiered-hot", len("hot") + len("value") + approxEntryOverhead},
+		{"cold", "tiered-cold", len(encodeDiskRecord("cold", stringValue("value")))},
+	}
+	for _, tt := range tests {
+		info, err := store.Object(tt.key)
+		if err != nil {
+			t.Fatalf("Object(%q) returned error: %v", tt.key, err)
+		}
+		if info.Encoding != tt.encoding || info.Size != tt.size {
+			t.Errorf("Object(%q) = %q/%d, want %q/%d", tt.key, info.Encoding, info.Size, tt.encoding, tt.size)
+		}
+	}
+
+	if promotions := engine.Stats().Promotions; promotions != 0 {
+		t.Fatalf("Object promoted %d keys, want 0", promotions)
+	}
+
+	// Empty the hot tier so closing the store, which happens asynchronously
+	// after the test, has nothing to flush into the removed temp dir
+	if _, err := store.Delete("hot"); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+}
+
+func TestObject_ShardedEngineWithDirectExecution(t *testing.T) {
+	store := newTestKeyValueServiceWithConfig(t, Config{Execution: DirectExecution, TrackAccess: true})
+
+	if _, err := store.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	info, err := store.Object("foo")
+	if err != nil {
+		t.Fatalf("Object returned error: %v", err)
+	}
+	if info.Encoding != "sharded" || info.LastAccess.IsZero() {
+		t.Fatalf("Object = %+v, want sharded encoding with a last access time", info)
+	}
+}
+
+func TestObject_NoLastAccessWithoutTracking(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	if _, err := store.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	info, err := store.Object("foo")
+	if err != nil {
+		t.Fatalf("Object returned error: %v", err)
+	}
+	if !info.LastAccess.IsZero() {
+		t.Fatalf("LastAccess = %v without tracking, want zero", info.LastAccess)
+	}
+}
+
+func TestIdleTime_MeasuresFromLastAccess(t *testing.T) {
+	clock := &testClock{}
+	clock.nanos.Store(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano())
+	store := newTestKeyValueServiceWithConfig(t, Config{TrackAccess: true, Clock: clock.Now})
+
+	if _, err := store.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	clock.Advance(time.Minute)
+	if idle, err := store.IdleTime("foo"); err != nil || idle != time.Minute {
+		t.Fatalf("IdleTime = (%v, %v), want (%v, nil)", idle, err, time.Minute)
+	}
+
+	// Reads within accessResolution of the recorded access leave it be
+	if _, err := store.Get("foo"); err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	clock.Advance(time.Second / 2)
+	if _, err := store.Get("foo"); err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	if idle, err := store.IdleTime("foo"); err != nil || idle != time.Second/2 {
+		t.Fatalf("IdleTime after Get = (%v, %v), want (%v, nil)", idle, err, time.Second/2)
+	}
+
+	if _, err := store.IdleTime("missing"); err == nil {
+		t.Fatalf("IdleTime of missing key succeeded, want error")
+	}
+}
+
+func TestIdleTime_UntouchedKeysIdleSinceStart(t *testing.T) {
+	clock := &testClock{}
+	clock.nanos.Store(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano())
+	store := newTestKeyValueServiceWithConfig(t, Config{TrackAccess: true, Clock: clock.Now})
+
+	// Mutations applied from a primary count as accesses, keys the store
+	// has not seen written are idle since it started
+	if err := store.ApplyMutations([]Mutation{{Type: MutationSet, Key: "replicated", Value: "value"}}); err != nil {
+		t.Fatalf("ApplyMutations returned error: %v", err)
+	}
+	clock.Advance(time.Hour)
+	if _, err := store.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	store.store.accesses.forget("foo")
+	clock.Advance(time.Minute)
+
+	if idle, err := store.IdleTime("replicated"); err != nil || idle != time.Hour+time.Minute {
+		t.Fatalf("IdleTime(replicated) = (%v, %v), want (%v, nil)", idle, err, time.Hour+time.Minute)
+	}
+	if idle, err := store.IdleTime("foo"); err != nil || idle != time.Hour+time.Minute {
+		t.Fatalf("IdleTime(foo) = (%v, %v), want (%v, nil)", idle, err, time.Hour+time.Minute)
+	}
+}
+
+func TestIdleTime_FailsWithoutTracking(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	if _, err := store.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := store.IdleTime("foo"); !errors.Is(err, ErrAccessNotTracked) {
+		t.Fatalf("IdleTime without tracking returned %v, want ErrAccessNotTracked", err)
+	}
+}
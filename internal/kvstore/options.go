@@ -0,0 +1,153 @@
+package kvstore
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Option configures a KeyValueService built by NewKeyValueService. Each one
+// sets the Config field of the same name, and options left out keep that
+// field's zero-value default.
+type Option func(*Config)
+
+// NewKeyValueService starts a KeyValueService over the options given, by
+// default an in-memory engine with commands run on a single store
+// goroutine. Unlike GetKeyValueService it returns a new service on every
+// call, so one process can hold several. The service stops when ctx is
+// cancelled or it is closed.
+func NewKeyValueService(ctx context.Context, options ...Option) *KeyValueService {
+	var config Config
+	for _, option := range options {
+		option(&config)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return newKeyValueService(ctx, cancel, config)
+}
+
+func WithEngine(engine StorageEngine) Option {
+	return func(c *Config) {
+		c.Engine = engine
+	}
+}
+
+func WithExecution(mode ExecutionMode) Option {
+	return func(c *Config) {
+		c.Execution = mode
+	}
+}
+
+func WithMaxBatchSize(size int) Option {
+	return func(c *Config) {
+		c.MaxBatchSize = size
+	}
+}
+
+func WithBufferSize(size int) Option {
+	return func(c *Config) {
+		c.BufferSize = size
+	}
+}
+
+// WithBackpressure sets what Dispatch does when the input queue is full,
+// and how long BackpressureBlock waits for room (zero waits indefinitely).
+func WithBackpressure(policy BackpressurePolicy, enqueueTimeout time.Duration) Option {
+	return func(c *Config) {
+		c.Backpressure = policy
+		c.EnqueueTimeout = enqueueTimeout
+	}
+}
+
+func WithConcurrentReads(enabled bool) Option {
+	return func(c *Config) {
+		c.ConcurrentReads = enabled
+	}
+}
+
+func WithAccessTracking(enabled bool) Option {
+	return func(c *Config) {
+		c.TrackAccess = enabled
+	}
+}
+
+func WithFrequencyTracking(enabled bool, decay time.Duration) Option {
+	return func(c *Config) {
+		c.TrackFrequency = enabled
+		c.FrequencyDecay = decay
+	}
+}
+
+func WithTTLJitter(fraction float64) Option {
+	return func(c *Config) {
+		c.TTLJitter = fraction
+	}
+}
+
+func WithTTLPolicies(policies ...TTLPolicy) Option {
+	return func(c *Config) {
+		c.TTLPolicies = policies
+	}
+}
+
+func WithExpirySweep(sweep ExpirySweep) Option {
+	return func(c *Config) {
+		c.ExpirySweep = sweep
+	}
+}
+
+func WithHistory(history History) Option {
+	return func(c *Config) {
+		c.History = history
+	}
+}
+
+func WithTombstoneGrace(grace time.Duration) Option {
+	return func(c *Config) {
+		c.TombstoneGrace = grace
+	}
+}
+
+func WithReplicationBacklog(bytes int) Option {
+	return func(c *Config) {
+		c.ReplicationBacklog = bytes
+	}
+}
+
+// WithCRDT sets the namespaces holding conflict-free counters and sets, and
+// the name this store gives its updates to them.
+func WithCRDT(namespaces []string, actor string) Option {
+	return func(c *Config) {
+		c.CRDTNamespaces = namespaces
+		c.CRDTActor = actor
+	}
+}
+
+func WithLogger(logger *log.Logger) Option {
+	return func(c *Config) {
+		c.Logger = logger
+	}
+}
+
+func WithClock(now func() time.Time) Option {
+	return func(c *Config) {
+		c.Clock = now
+	}
+}
+
+func WithMaxKeyLength(bytes int) Option {
+	return func(c *Config) {
+		c.MaxKeyLength = bytes
+	}
+}
+
+func WithMaxValueSize(bytes int) Option {
+	return func(c *Config) {
+		c.MaxValueSize = bytes
+	}
+}
+
+func WithKeyPolicy(policy KeyPolicy) Option {
+	return func(c *Config) {
+		c.KeyPolicy = policy
+	}
+}
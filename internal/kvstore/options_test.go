@@ -0,0 +1,76 @@
+package kvstore
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewKeyValueService_ReturnsIndependentServices(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	first := NewKeyValueService(ctx)
+	second := NewKeyValueService(ctx, WithEngine(NewShardedEngine(4)), WithBufferSize(16))
+	if _, err := first.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if got, err := second.Get("foo"); err == nil {
+		t.Fatalf("second service Get = %q, want the key missing", deref(got))
+	}
+
+	first.Close()
+	if _, err := second.Set("foo", "baz"); err != nil {
+		t.Fatalf("closing one service stopped the other: %v", err)
+	}
+}
+
+func TestNewKeyValueService_WithClock(t *testing.T) {
+	var mu sync.Mutex
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	store := NewKeyValueService(ctx, WithClock(clock))
+
+	if _, err := store.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := store.ExpireAt("foo", now.Add(time.Minute)); err != nil {
+		t.Fatalf("ExpireAt returned error: %v", err)
+	}
+	if ttl, err := store.TTL("foo"); err != nil || ttl != time.Minute {
+		t.Fatalf("TTL = (%v, %v), want a minute by the given clock", ttl, err)
+	}
+
+	mu.Lock()
+	now = now.Add(time.Minute)
+	mu.Unlock()
+	if got, err := store.Get("foo"); err == nil {
+		t.Fatalf("Get after the deadline = %q, want the key expired", deref(got))
+	}
+}
+
+func TestNewKeyValueService_WithLogger(t *testing.T) {
+	var buf bytes.Buffer
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	// The tiered engine cannot serve concurrent reads, which is logged
+	NewKeyValueService(ctx,
+		WithEngine(NewTieredEngine(1, NewMemoryEngine())),
+		WithConcurrentReads(true),
+		WithLogger(log.New(&buf, "", 0)),
+	)
+	if !strings.Contains(buf.String(), "concurrent reads") {
+		t.Fatalf("logger got %q, want the message about concurrent reads", buf.String())
+	}
+}
@@ -0,0 +1,72 @@
+package kvstore
+
+import (
+	"context"
+	"iter"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Value is a key's value as Range yields it.
+type Value struct {
+	Data string
+	// Type is the type of value Data holds
+	Type ValueType
+	// Expires is when the key expires, or the zero time if it does not
+	Expires time.Time
+	// Err is set on the last value yielded when iteration stopped early
+	// because reading failed or ctx was done; its key is empty
+	Err error
+}
+
+// Range iterates over the keys starting with prefix, in order, and their
+// values as of a snapshot taken when iteration starts. Writes carry on
+// while it runs and are not seen by it. Listing the keys is a single
+// command; each value is then read by a command of its own, so other
+// callers' commands are served in between and a slow consumer never holds
+// up the store. Iteration stops when ctx is done.
+func (kvService *KeyValueService) Range(ctx context.Context, prefix string) iter.Seq2[string, Value] {
+	return func(yield func(string, Value) bool) {
+		snapshot, err := kvService.Snapshot()
+		if err != nil {
+			yield("", Value{Err: err})
+			return
+		}
+		defer snapshot.Close()
+
+		keys, err := snapshot.Keys()
+		if err != nil {
+			yield("", Value{Err: err})
+			return
+		}
+		if prefix != "" {
+			keys = slices.DeleteFunc(keys, func(key string) bool {
+				return !strings.HasPrefix(key, prefix)
+			})
+		}
+		slices.Sort(keys)
+
+		for _, key := range keys {
+			if err := ctx.Err(); err != nil {
+				yield("", Value{Err: err})
+				return
+			}
+			stored, ok, err := snapshot.Get(key)
+			if err != nil {
+				yield("", Value{Err: err})
+				return
+			}
+			if !ok {
+				continue
+			}
+			value := Value{Data: stored.Data, Type: stored.Type}
+			if expires, ok := snapshot.Expiry(key); ok {
+				value.Expires = expires
+			}
+			if !yield(key, value) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRange_YieldsPrefixedKeysInOrder(t *testing.T) {
+	store := newTestKeyValueService(t)
+	for _, key := range []string{"user:2", "user:1", "order:1", "user:3"} {
+		if _, err := store.Set(key, "v-"+key); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+	}
+	deadline := time.Now().Add(time.Hour)
+	if _, err := store.ExpireAt("user:3", deadline); err != nil {
+		t.Fatalf("ExpireAt returned error: %v", err)
+	}
+
+	var keys []string
+	for key, value := range store.Range(context.Background(), "user:") {
+		if value.Err != nil {
+			t.Fatalf("Range yielded error: %v", value.Err)
+		}
+		if value.Data != "v-"+key {
+			t.Fatalf("Range yielded %q = %q, want %q", key, value.Data, "v-"+key)
+		}
+		if (key == "user:3") != !value.Expires.IsZero() {
+			t.Fatalf("Range yielded %q expiring at %v", key, value.Expires)
+		}
+		keys = append(keys, key)
+	}
+	if !slices.Equal(keys, []string{"user:1", "user:2", "user:3"}) {
+		t.Fatalf("Range yielded %q, want [user:1 user:2 user:3]", keys)
+	}
+}
+
+func TestRange_DoesNotSeeWritesMadeWhileIterating(t *testing.T) {
+	store := newTestKeyValueService(t)
+	for _, key := range []string{"a", "b"} {
+		if _, err := store.Set(key, "old"); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+	}
+
+	var seen []string
+	for key, value := range store.Range(context.Background(), "") {
+		// The store keeps serving writes while the consumer runs
+		if key == "a" {
+			if _, err := store.Set("b", "new"); err != nil {
+				t.Fatalf("Set during Range returned error: %v", err)
+			}
+			if _, err := store.Set("c", "new"); err != nil {
+				t.Fatalf("Set during Range returned error: %v", err)
+			}
+		}
+		seen = append(seen, key+"="+value.Data)
+	}
+	if !slices.Equal(seen, []string{"a=old", "b=old"}) {
+		t.Fatalf("Range yielded %q, want [a=old b=old]", seen)
+	}
+}
+
+func TestRange_StopsWhenContextIsDone(t *testing.T) {
+	store := newTestKeyValueService(t)
+	for _, key := range []string{"a", "b", "c"} {
+		if _, err := store.Set(key, "value"); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var keys []string
+	var err error
+	for key, value := range store.Range(ctx, "") {
+		if value.Err != nil {
+			err = value.Err
+			break
+		}
+		keys = append(keys, key)
+		cancel()
+	}
+	if !slices.Equal(keys, []string{"a"}) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("Range yielded %q then %v, want [a] then context.Canceled", keys, err)
+	}
+}
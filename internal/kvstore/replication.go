@@ -0,0 +1,567 @@
+package kvstore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	mathrand "math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	ErrReplicaTooSlow = errors.New("replica fell too far behind the primary")
+	// ErrChangesUnavailable is returned by ChangesSince when the backlog no
+	// longer holds every change asked for, or they were made by an earlier
+	// run of the store.
+	ErrChangesUnavailable = errors.New("changes are no longer in the replication backlog")
+)
+
+// MutationType says how a Mutation changes its key.
+type MutationType uint8
+
+const (
+	// MutationSet sets the key's value without touching its expiry.
+	MutationSet MutationType = iota + 1
+	// MutationDelete removes the key and its expiry.
+	MutationDelete
+	// MutationExpire sets the key's expiry to Deadline.
+	MutationExpire
+	// MutationPersist removes the key's expiry.
+	MutationPersist
+	// MutationListPush pushes Values onto the list under the key, at its
+	// head as LPUSH does if Left is set or else at its tail, leaving it
+	// Length long.
+	MutationListPush
+	// MutationListPop pops Values off the list under the key, from its
+	// head if Left is set or else from its tail, leaving it Length long.
+	// A list left empty is removed with its expiry.
+	MutationListPop
+)
+
+// Mutation is one change the store made to a key. Mutations describe the
+// resulting state rather than the command that caused it, so replaying
+// them in order reproduces the primary's data whatever the command was,
+// and replaying one twice is harmless.
+//
+// List pushes and pops are the exception, so that a long list is not sent
+// whole for each value pushed or popped: they carry just those values, and
+// the length they leave the list at. A replica records the offset of the
+// last one it applied to each list along with the list, and skips one at
+// or below it, so these are harmless to replay too. Ones with no offset,
+// as a change log replays, are always applied.
+type Mutation struct {
+	// Offset numbers the mutations a store has made since it started
+	Offset uint64
+	Type   MutationType
+	Key    string
+	// Value and ValueType are the value of a MutationSet
+	Value     string
+	ValueType ValueType
+	// Deadline is the expiry of a MutationExpire in Unix nanoseconds
+	Deadline int64
+	// Values, Left and Length describe a MutationListPush or
+	// MutationListPop
+	Values []string
+	Left   bool
+	Length int64
+	// Previous is the value a MutationSet or MutationDelete replaced, nil
+	// if the key was new. It is only set on streams from Capture
+	Previous *string
+}
+
+// replicationFeed numbers every change the store makes and hands it to the
+// replicas following the store. Engine writes happen between begin and
+// end, which hold a shared lock while nothing is following and an
+// exclusive one otherwise, so under DirectExecution the order mutations are
+// published in matches the order they reached the engine. A filling backlog
+// counts as following.
+type replicationFeed struct {
+	id        string
+	mu        sync.RWMutex
+	offset    atomic.Uint64
+	following atomic.Int64
+	// capturing counts the followers that want each change's previous
+	// value
+	capturing atomic.Int64
+	followers []*ReplicationStream
+	backlog   replicationBacklog
+}
+
+func newReplicationID() string {
+	var id [20]byte
+	_, _ = rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// seededReplicationID draws a replication ID from random, so a Simulation
+// names its runs the same way every time.
+func seededReplicationID(random *mathrand.Rand) string {
+	var id [20]byte
+	for i := range id {
+		id[i] = byte(random.Uint32())
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// begin and end must wrap every change to the engine or the expiry table,
+// and the call to publish for it. begin reports whether it took the lock
+// exclusively, which end needs to know. They are separate calls rather
+// than begin returning the unlock so the write path does not allocate.
+func (feed *replicationFeed) begin() bool {
+	feed.mu.RLock()
+	if feed.following.Load() == 0 {
+		return false
+	}
+	feed.mu.RUnlock()
+	feed.mu.Lock()
+	return true
+}
+
+func (feed *replicationFeed) end(exclusive bool) {
+	if exclusive {
+		feed.mu.Unlock()
+	} else {
+		feed.mu.RUnlock()
+	}
+}
+
+// pause waits for in-flight writes and holds new ones back until the
+// returned function is called.
+func (feed *replicationFeed) pause() func() {
+	feed.mu.Lock()
+	return feed.mu.Unlock
+}
+
+func (feed *replicationFeed) publish(mutation Mutation) {
+	mutation.Offset = feed.offset.Add(1)
+	if feed.following.Load() == 0 {
+		return
+	}
+
+	// begin holds the lock exclusively while anyone is following
+	captured := mutation
+	mutation.Previous = nil
+	if feed.backlog.active {
+		feed.backlog.add(mutation)
+	}
+	kept := feed.followers[:0]
+	for _, stream := range feed.followers {
+		next := mutation
+		if stream.capture {
+			next = captured
+		}
+		select {
+		case stream.mutations <- next:
+			kept = append(kept, stream)
+		default:
+			stream.fail(ErrReplicaTooSlow)
+		}
+	}
+	clear(feed.followers[len(kept):])
+	feed.followers = kept
+	feed.track()
+}
+
+// track must be called with the lock held whenever followers or the
+// backlog change.
+func (feed *replicationFeed) track() {
+	following, capturing := len(feed.followers), 0
+	if feed.backlog.active {
+		following++
+	}
+	for _, stream := range feed.followers {
+		if stream.capture {
+			capturing++
+		}
+	}
+	feed.following.Store(int64(following))
+	feed.capturing.Store(int64(capturing))
+}
+
+// remove must be called with the lock held.
+func (feed *replicationFeed) remove(stream *ReplicationStream) {
+	for i, follower := range feed.followers {
+		if follower == stream {
+			feed.followers = append(feed.followers[:i], feed.followers[i+1:]...)
+			feed.track()
+			return
+		}
+	}
+}
+
+// replicationBacklog holds the most recent mutations, up to about limit
+// bytes of them. It starts filling when the first replica connects rather
+// than when the store starts, so a store without replicas does not pay for
+// it.
+type replicationBacklog struct {
+	limit   int
+	active  bool
+	entries []Mutation
+	start   int
+	size    int
+}
+
+func mutationSize(mutation Mutation) int {
+	// Roughly what a Mutation holds besides its key and values
+	const overhead = 32
+	size := len(mutation.Key) + len(mutation.Value) + overhead
+	for _, value := range mutation.Values {
+		size += len(value)
+	}
+	return size
+}
+
+func (backlog *replicationBacklog) add(mutation Mutation) {
+	backlog.entries = append(backlog.entries, mutation)
+	backlog.size += mutationSize(mutation)
+	for backlog.size > backlog.limit && backlog.start < len(backlog.entries) {
+		backlog.size -= mutationSize(backlog.entries[backlog.start])
+		backlog.entries[backlog.start] = Mutation{}
+		backlog.start++
+	}
+	if backlog.start > len(backlog.entries)/2 {
+		n := copy(backlog.entries, backlog.entries[backlog.start:])
+		clear(backlog.entries[n:])
+		backlog.entries = backlog.entries[:n]
+		backlog.start = 0
+	}
+}
+
+// since returns the mutations after offset, up to and including current,
+// or false if the backlog no longer holds all of them.
+func (backlog *replicationBacklog) since(offset uint64, current uint64) ([]Mutation, bool) {
+	if !backlog.active || offset > current {
+		return nil, false
+	}
+	held := backlog.entries[backlog.start:]
+	if len(held) == 0 {
+		return nil, offset == current
+	}
+	first := held[0].Offset
+	if offset+1 < first {
+		return nil, false
+	}
+	return slices.Clone(held[offset+1-first:]), true
+}
+
+// ReplicationStream follows a store for a replica: a snapshot of the store
+// to copy first, then every change made after it. A stream that resumes
+// from the backlog has no snapshot, and only the changes the replica
+// missed.
+type ReplicationStream struct {
+	id       string
+	offset   uint64
+	snapshot *Snapshot
+	feed     *replicationFeed
+	// capture is set on streams from Capture
+	capture bool
+
+	mutations chan Mutation
+	once      sync.Once
+	err       atomic.Pointer[error]
+}
+
+func (stream *ReplicationStream) fail(err error) {
+	stream.once.Do(func() {
+		stream.err.Store(&err)
+		close(stream.mutations)
+	})
+}
+
+// ID identifies the primary's run; offsets from different IDs are not
+// comparable.
+func (stream *ReplicationStream) ID() string {
+	return stream.id
+}
+
+// Offset is the offset of the last mutation included in the snapshot, or
+// the offset a partial stream resumed from.
+func (stream *ReplicationStream) Offset() uint64 {
+	return stream.offset
+}
+
+// Partial reports whether the stream resumed from the backlog, in which
+// case the replica keeps its data and there is nothing to Sync.
+func (stream *ReplicationStream) Partial() bool {
+	return stream.snapshot == nil
+}
+
+// Mutations delivers the changes made after the snapshot, in order. It is
+// closed by Close, or when the replica falls so far behind that the
+// stream's buffer fills up; Err then reports ErrReplicaTooSlow.
+func (stream *ReplicationStream) Mutations() <-chan Mutation {
+	return stream.mutations
+}
+
+func (stream *ReplicationStream) Err() error {
+	if err := stream.err.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// Sync calls emit with the mutations that recreate the snapshot on a
+// replica: a MutationSet for each key, followed by a MutationExpire or a
+// MutationPersist so any expiry left over on the replica is replaced, then
+// a MutationDelete for each key with a tombstone, so the replica drops the
+// keys deleted while it was away. Keys deleted longer ago than
+// Config.TombstoneGrace are not removed from the replica. Expiries
+// are read as they are now rather than as of the snapshot, but every later
+// change to them is in Mutations too, so the replica converges once it has
+// applied those. Sync emits nothing for a partial stream.
+func (stream *ReplicationStream) Sync(emit func(Mutation) error) error {
+	if stream.Partial() {
+		return nil
+	}
+	keys, err := stream.snapshot.Keys()
+	if err != nil {
+		return fmt.Errorf("listing snapshot keys: %w", err)
+	}
+	for _, key := range keys {
+		value, ok, err := stream.snapshot.Get(key)
+		if err != nil {
+			return fmt.Errorf("reading snapshot key %s: %w", key, err)
+		}
+		if !ok {
+			continue
+		}
+		if err := emit(Mutation{Type: MutationSet, Key: key, Value: value.Data, ValueType: value.Type}); err != nil {
+			return err
+		}
+		expiry := Mutation{Type: MutationPersist, Key: key}
+		if deadline, ok := stream.snapshot.Expiry(key); ok {
+			expiry = Mutation{Type: MutationExpire, Key: key, Deadline: deadline.UnixNano()}
+		}
+		if err := emit(expiry); err != nil {
+			return err
+		}
+	}
+	for _, key := range stream.snapshot.tombstones {
+		if err := emit(Mutation{Type: MutationDelete, Key: key}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops following the store and releases the snapshot.
+func (stream *ReplicationStream) Close() {
+	defer stream.feed.pause()()
+	stream.feed.remove(stream)
+	if stream.snapshot != nil {
+		stream.snapshot.Close()
+	}
+	stream.fail(errors.New("replication stream closed"))
+}
+
+// replicationCommand carries a new stream into the store, and the
+// mutations a replica applies. resume is set when the replica asks to
+// continue from resumeOffset of the run resumeID, and follow when it only
+// wants the changes made from now on.
+type replicationCommand struct {
+	stream       *ReplicationStream
+	buffer       int
+	follow       bool
+	capture      bool
+	resume       bool
+	resumeID     string
+	resumeOffset uint64
+	mutations    []Mutation
+}
+
+// ProcessReplicateCommand starts a stream, resuming from the backlog when
+// the replica asked to and the backlog still holds every change it missed.
+// The stream, and its snapshot if it needs one, are registered with writes
+// paused, so every change is either in the snapshot or in the stream.
+func (kvStore *KeyValueStore) ProcessReplicateCommand(command KeyValueCommand) KeyValueOutput {
+	if command.replication == nil || command.replication.stream == nil {
+		return KeyValueOutput{false, nil, fmt.Errorf("%s command has no arguments", GetCommandTypeString(command.commandType)), 0}
+	}
+	replication := command.replication
+	stream := replication.stream
+	feed := &kvStore.replication
+	defer feed.pause()()
+
+	stream.id = feed.id
+	stream.offset = feed.offset.Load()
+	stream.capture = replication.capture
+	var missed []Mutation
+	resumed := false
+	if replication.resume && replication.resumeID == feed.id {
+		missed, resumed = feed.backlog.since(replication.resumeOffset, stream.offset)
+	}
+	if replication.follow {
+		stream.snapshot = nil
+		stream.mutations = make(chan Mutation, replication.buffer)
+	} else if resumed {
+		stream.snapshot = nil
+		stream.offset = replication.resumeOffset
+		stream.mutations = make(chan Mutation, replication.buffer+len(missed))
+		for _, mutation := range missed {
+			stream.mutations <- mutation
+		}
+	} else {
+		stream.snapshot.at = kvStore.currentTime().UnixNano()
+		stream.snapshot.tombstones = kvStore.tombstones.keys()
+		kvStore.snapshots.add(stream.snapshot)
+		stream.mutations = make(chan Mutation, replication.buffer)
+	}
+
+	feed.followers = append(feed.followers, stream)
+	feed.backlog.active = feed.backlog.limit > 0
+	feed.track()
+	return KeyValueOutput{true, nil, nil, 0}
+}
+
+// ProcessApplyMutationsCommand applies mutations received from a primary.
+// They are published again in turn, so a replica can have replicas of its
+// own.
+func (kvStore *KeyValueStore) ProcessApplyMutationsCommand(command KeyValueCommand) KeyValueOutput {
+	if command.replication == nil {
+		return KeyValueOutput{false, nil, fmt.Errorf("%s command has no arguments", GetCommandTypeString(command.commandType)), 0}
+	}
+	for _, mutation := range command.replication.mutations {
+		key := mutation.Key
+		var err error
+		switch mutation.Type {
+		case MutationSet:
+			// The store only writes values that decode as their type, so
+			// one that does not is corrupt
+			value := TypedValue{mutation.ValueType, mutation.Value}
+			if err = value.decode(); err == nil {
+				err = kvStore.setValue(key, value)
+				kvStore.touch(key)
+			}
+		case MutationDelete:
+			_, _, err = kvStore.deleteValue(key)
+			kvStore.forgetDeadline(key)
+			kvStore.forget(key)
+		case MutationExpire:
+			err = kvStore.setDeadline(key, mutation.Deadline)
+		case MutationPersist:
+			_, err = kvStore.clearDeadline(key)
+		case MutationListPush, MutationListPop:
+			err = kvStore.applyListMutation(mutation)
+		default:
+			err = fmt.Errorf("unknown mutation type %d", mutation.Type)
+		}
+		if err != nil {
+			return KeyValueOutput{false, nil, fmt.Errorf("applying mutation %d: %w", mutation.Offset, err), 0}
+		}
+	}
+	return KeyValueOutput{true, nil, nil, 0}
+}
+
+// Replicate starts streaming the store to a replica. The replica copies the
+// stream's snapshot through Sync, then applies Mutations as they arrive.
+// Up to buffer mutations are held for a replica that is behind; beyond that
+// the stream fails with ErrReplicaTooSlow and the replica has to sync
+// again. While any stream is open, writes under DirectExecution are
+// serialised so they are streamed in the order they were applied. The
+// stream must be closed when the replica disconnects.
+func (kvService *KeyValueService) Replicate(buffer int) (*ReplicationStream, error) {
+	return kvService.replicate(&replicationCommand{buffer: buffer})
+}
+
+// ReplicateFrom starts streaming the store to a replica that has applied
+// every change up to offset of the run id, as reported by an earlier
+// stream's ID and its mutations' offsets. If the backlog still holds the
+// changes made since, the stream is partial and carries just those;
+// otherwise it falls back to a full sync, as from Replicate.
+func (kvService *KeyValueService) ReplicateFrom(id string, offset uint64, buffer int) (*ReplicationStream, error) {
+	return kvService.replicate(&replicationCommand{buffer: buffer, resume: true, resumeID: id, resumeOffset: offset})
+}
+
+// Follow starts a partial stream of the changes made from now on, for
+// archiving them rather than copying the store. It is held to buffer
+// mutations like a replica's stream, and must be closed when done.
+func (kvService *KeyValueService) Follow(buffer int) (*ReplicationStream, error) {
+	return kvService.replicate(&replicationCommand{buffer: buffer, follow: true})
+}
+
+// Capture starts a stream for change data capture, whose MutationSet and
+// MutationDelete mutations carry the value they replaced in Previous. With
+// an empty id it follows the changes made from now on, as Follow does;
+// otherwise it resumes after offset of the run id as ReplicateFrom does,
+// falling back to a snapshot to Sync if the backlog no longer holds the
+// changes since. Mutations resumed from the backlog or emitted by Sync
+// carry no previous value. While a capture stream is open, every write
+// reads the value it replaces first.
+func (kvService *KeyValueService) Capture(id string, offset uint64, buffer int) (*ReplicationStream, error) {
+	if id == "" {
+		return kvService.replicate(&replicationCommand{buffer: buffer, follow: true, capture: true})
+	}
+	return kvService.replicate(&replicationCommand{buffer: buffer, resume: true, resumeID: id, resumeOffset: offset, capture: true})
+}
+
+func (kvService *KeyValueService) replicate(command *replicationCommand) (*ReplicationStream, error) {
+	if err := kvService.CheckActive(); err != nil {
+		return nil, err
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return nil, err
+	}
+	command.buffer = max(command.buffer, 1)
+	command.stream = &ReplicationStream{
+		snapshot: &Snapshot{service: kvService, preimages: make(map[string]preimage)},
+		feed:     &kvService.store.replication,
+	}
+	res := kvService.dispatch(KeyValueCommand{commandType: REPLICATE, replication: command})
+	if res.err != nil {
+		return nil, res.err
+	}
+	return command.stream, nil
+}
+
+// ReplicationOffset returns the store's replication ID, which changes every
+// time the store starts, and the offset of the last change it made.
+func (kvService *KeyValueService) ReplicationOffset() (string, uint64) {
+	return kvService.store.replication.id, kvService.store.replication.offset.Load()
+}
+
+// RetainChanges starts filling the backlog, if it is enabled, so that
+// ChangesSince can return the changes made from now on without a replica
+// having connected. It reports whether the backlog is enabled.
+func (kvService *KeyValueService) RetainChanges() bool {
+	feed := &kvService.store.replication
+	defer feed.pause()()
+	feed.backlog.active = feed.backlog.limit > 0
+	feed.track()
+	return feed.backlog.active
+}
+
+// ChangesSince returns the changes made after offset of the run id, as
+// reported by a Snapshot's Position or an earlier call, and the offset of
+// the last of them. It fails with ErrChangesUnavailable if the backlog no
+// longer holds them all, in which case the caller has to copy the store
+// afresh.
+func (kvService *KeyValueService) ChangesSince(id string, offset uint64) ([]Mutation, uint64, error) {
+	if err := kvService.CheckActive(); err != nil {
+		return nil, 0, err
+	}
+	feed := &kvService.store.replication
+	defer feed.pause()()
+	if id != feed.id {
+		return nil, 0, fmt.Errorf("%w: the store has restarted since", ErrChangesUnavailable)
+	}
+	current := feed.offset.Load()
+	changes, ok := feed.backlog.since(offset, current)
+	if !ok {
+		return nil, 0, fmt.Errorf("%w: changes after offset %d have been dropped", ErrChangesUnavailable, offset)
+	}
+	return changes, current, nil
+}
+
+// ApplyMutations applies mutations streamed from a primary. Unlike other
+// writes it is allowed in read-only mode, which is how replicas keep
+// clients from writing to them.
+func (kvService *KeyValueService) ApplyMutations(mutations []Mutation) error {
+	if err := kvService.CheckActive(); err != nil {
+		return err
+	}
+	res := kvService.dispatch(KeyValueCommand{commandType: APPLYMUTATIONS, replication: &replicationCommand{mutations: mutations}})
+	return res.err
+}
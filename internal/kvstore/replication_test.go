@@ -0,0 +1,425 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncReplica copies stream's snapshot into replica.
+func syncReplica(t *testing.T, stream *ReplicationStream, replica *KeyValueService) {
+	t.Helper()
+
+	var mutations []Mutation
+	if err := stream.Sync(func(mutation Mutation) error {
+		mutations = append(mutations, mutation)
+		return nil
+	}); err != nil {
+		t.Fatalf("Sync returned error: %v", err)
+	}
+	if err := replica.ApplyMutations(mutations); err != nil {
+		t.Fatalf("ApplyMutations returned error: %v", err)
+	}
+}
+
+// catchUp applies every mutation the stream has delivered so far and
+// returns the offset of the last one, or the stream's offset if there were
+// none.
+func catchUp(t *testing.T, stream *ReplicationStream, replica *KeyValueService) uint64 {
+	t.Helper()
+
+	offset := stream.Offset()
+	for {
+		select {
+		case mutation, ok := <-stream.Mutations():
+			if !ok {
+				t.Fatalf("stream closed: %v", stream.Err())
+			}
+			if err := replica.ApplyMutations([]Mutation{mutation}); err != nil {
+				t.Fatalf("ApplyMutations returned error: %v", err)
+			}
+			offset = mutation.Offset
+		default:
+			return offset
+		}
+	}
+}
+
+func assertValue(t *testing.T, store *KeyValueService, key string, want *string) {
+	t.Helper()
+
+	got, err := store.Get(key)
+	if want == nil {
+		if err == nil {
+			t.Fatalf("Get(%s) = %q, want missing", key, *got)
+		}
+		return
+	}
+	if err != nil || *got != *want {
+		t.Fatalf("Get(%s) = (%v, %v), want %q", key, deref(got), err, *want)
+	}
+}
+
+func TestReplicate_ReplicaConvergesWithPrimary(t *testing.T) {
+	primary := newTestKeyValueService(t)
+	primaryClock := newTestClock(primary)
+	for _, key := range []string{"a", "b", "expiring"} {
+		if _, err := primary.Set(key, "old"); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+	}
+	deadline := primaryClock.Now().Add(time.Hour)
+	if _, err := primary.ExpireAt("expiring", deadline); err != nil {
+		t.Fatalf("ExpireAt returned error: %v", err)
+	}
+
+	stream, err := primary.Replicate(100)
+	if err != nil {
+		t.Fatalf("Replicate returned error: %v", err)
+	}
+	defer stream.Close()
+	if stream.ID() == "" {
+		t.Fatalf("stream has no replication ID")
+	}
+
+	// Changes made after the snapshot arrive through the stream
+	if _, err := primary.Set("a", "new"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := primary.Delete("b"); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+	if _, err := primary.Set("c", "new"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := primary.Persist("expiring"); err != nil {
+		t.Fatalf("Persist returned error: %v", err)
+	}
+	if _, err := primary.ExpireAt("c", deadline); err != nil {
+		t.Fatalf("ExpireAt returned error: %v", err)
+	}
+
+	replica := newTestKeyValueService(t)
+	replicaClock := newTestClock(replica)
+	syncReplica(t, stream, replica)
+	catchUp(t, stream, replica)
+
+	assertValue(t, replica, "a", stringPointer("new"))
+	assertValue(t, replica, "b", nil)
+	assertValue(t, replica, "c", stringPointer("new"))
+	assertValue(t, replica, "expiring", stringPointer("old"))
+	if ttl, _ := replica.TTL("expiring"); ttl != TTLNoExpiry {
+		t.Fatalf("replica TTL(expiring) = %v, want TTLNoExpiry", ttl)
+	}
+	if ttl, _ := replica.TTL("c"); ttl != deadline.Sub(replicaClock.Now()) {
+		t.Fatalf("replica TTL(c) = %v, want %v", ttl, deadline.Sub(replicaClock.Now()))
+	}
+}
+
+func TestReplicate_SlowReplicaFails(t *testing.T) {
+	primary := newTestKeyValueService(t)
+
+	stream, err := primary.Replicate(1)
+	if err != nil {
+		t.Fatalf("Replicate returned error: %v", err)
+	}
+	defer stream.Close()
+
+	for i := range 3 {
+		if _, err := primary.Set(fmt.Sprintf("k%d", i), "value"); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+	}
+	<-stream.Mutations()
+	if _, ok := <-stream.Mutations(); ok {
+		t.Fatalf("stream still open after its buffer overflowed")
+	}
+	if !errors.Is(stream.Err(), ErrReplicaTooSlow) {
+		t.Fatalf("Err = %v, want ErrReplicaTooSlow", stream.Err())
+	}
+
+	// The primary carries on without the replica
+	if _, err := primary.Set("after", "value"); err != nil {
+		t.Fatalf("Set after the replica failed returned error: %v", err)
+	}
+}
+
+func TestApplyMutations_AllowedInReadOnlyMode(t *testing.T) {
+	replica := newTestKeyValueService(t)
+	replica.SetReadOnly(true)
+
+	if err := replica.ApplyMutations([]Mutation{{Type: MutationSet, Key: "foo", Value: "bar"}}); err != nil {
+		t.Fatalf("ApplyMutations returned error: %v", err)
+	}
+	assertValue(t, replica, "foo", stringPointer("bar"))
+	if _, err := replica.Set("foo", "client"); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Set on a read-only replica returned %v, want ErrReadOnly", err)
+	}
+}
+
+func TestReplicate_DirectExecutionPreservesWriteOrder(t *testing.T) {
+	primary := newTestKeyValueServiceWithConfig(t, Config{Execution: DirectExecution})
+	stream, err := primary.Replicate(100000)
+	if err != nil {
+		t.Fatalf("Replicate returned error: %v", err)
+	}
+	defer stream.Close()
+
+	// Writers race on the same few keys, so the replica only ends up equal
+	// if mutations are streamed in the order they were applied
+	var wg sync.WaitGroup
+	for writer := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 500 {
+				key := fmt.Sprintf("k%d", i%5)
+				if i%7 == 0 {
+					_, _ = primary.Delete(key)
+				} else {
+					_, _ = primary.Set(key, fmt.Sprintf("%d-%d", writer, i))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	replica := newTestKeyValueService(t)
+	syncReplica(t, stream, replica)
+	catchUp(t, stream, replica)
+
+	for i := range 5 {
+		key := fmt.Sprintf("k%d", i)
+		want, err := primary.Get(key)
+		if err != nil {
+			want = nil
+		}
+		assertValue(t, replica, key, want)
+	}
+}
+
+func TestReplicationOffset_CountsChanges(t *testing.T) {
+	store := newTestKeyValueService(t)
+	id, before := store.ReplicationOffset()
+
+	if _, err := store.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := store.Delete("missing"); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+
+	// Only the Set changed anything
+	if gotID, after := store.ReplicationOffset(); gotID != id || after != before+1 {
+		t.Fatalf("ReplicationOffset = (%s, %d), want (%s, %d)", gotID, after, id, before+1)
+	}
+}
+
+func TestReplicateFrom_ResumesFromBacklog(t *testing.T) {
+	primary := newTestKeyValueServiceWithConfig(t, Config{ReplicationBacklog: 1 << 20})
+	if _, err := primary.Set("a", "1"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+
+	stream, err := primary.Replicate(100)
+	if err != nil {
+		t.Fatalf("Replicate returned error: %v", err)
+	}
+	replica := newTestKeyValueService(t)
+	syncReplica(t, stream, replica)
+	if _, err := primary.Set("b", "2"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	offset := catchUp(t, stream, replica)
+	stream.Close()
+
+	// Changes made while the replica is disconnected
+	if _, err := primary.Set("a", "3"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := primary.Delete("b"); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+
+	resumed, err := primary.ReplicateFrom(stream.ID(), offset, 100)
+	if err != nil {
+		t.Fatalf("ReplicateFrom returned error: %v", err)
+	}
+	defer resumed.Close()
+	if !resumed.Partial() || resumed.Offset() != offset {
+		t.Fatalf("ReplicateFrom = partial %v at offset %d, want partial at %d", resumed.Partial(), resumed.Offset(), offset)
+	}
+	catchUp(t, resumed, replica)
+
+	assertValue(t, replica, "a", stringPointer("3"))
+	assertValue(t, replica, "b", nil)
+}
+
+func TestReplicateFrom_FallsBackToFullSync(t *testing.T) {
+	primary := newTestKeyValueServiceWithConfig(t, Config{ReplicationBacklog: 256})
+	stream, err := primary.Replicate(100)
+	if err != nil {
+		t.Fatalf("Replicate returned error: %v", err)
+	}
+	stream.Close()
+	id, offset := primary.ReplicationOffset()
+
+	// Fills the backlog past what it keeps
+	for i := range 20 {
+		if _, err := primary.Set(fmt.Sprintf("key-%d", i), "value"); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+	}
+	_, current := primary.ReplicationOffset()
+
+	cases := []struct {
+		name   string
+		id     string
+		offset uint64
+	}{
+		{"evicted from backlog", id, offset},
+		{"other run", "other", current},
+		{"ahead of primary", id, current + 1},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			stream, err := primary.ReplicateFrom(tc.id, tc.offset, 100)
+			if err != nil {
+				t.Fatalf("ReplicateFrom returned error: %v", err)
+			}
+			defer stream.Close()
+			if stream.Partial() {
+				t.Fatalf("ReplicateFrom resumed, want a full sync")
+			}
+			if stream.Offset() != current {
+				t.Fatalf("stream offset = %d, want %d", stream.Offset(), current)
+			}
+		})
+	}
+
+	// The latest changes are still held
+	stream, err = primary.ReplicateFrom(id, current-1, 100)
+	if err != nil {
+		t.Fatalf("ReplicateFrom returned error: %v", err)
+	}
+	defer stream.Close()
+	if !stream.Partial() || len(stream.Mutations()) != 1 {
+		t.Fatalf("ReplicateFrom = partial %v with %d mutations, want partial with 1", stream.Partial(), len(stream.Mutations()))
+	}
+}
+
+func TestChangesSince_ReturnsChangesAfterSnapshot(t *testing.T) {
+	store := newTestKeyValueServiceWithConfig(t, Config{ReplicationBacklog: 1 << 20})
+	if !store.RetainChanges() {
+		t.Fatalf("RetainChanges = false with a backlog configured")
+	}
+	if _, err := store.Set("a", "1"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	snapshot, err := store.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot returned error: %v", err)
+	}
+	snapshot.Close()
+	id, offset := snapshot.Position()
+
+	if _, err := store.Set("b", "2"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := store.Delete("a"); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+	changes, current, err := store.ChangesSince(id, offset)
+	if err != nil {
+		t.Fatalf("ChangesSince returned error: %v", err)
+	}
+	if len(changes) != 2 || changes[0].Key != "b" || changes[1].Type != MutationDelete || current != offset+2 {
+		t.Fatalf("ChangesSince = (%+v, %d), want b set and a deleted up to %d", changes, current, offset+2)
+	}
+
+	if _, _, err := store.ChangesSince("other", offset); !errors.Is(err, ErrChangesUnavailable) {
+		t.Fatalf("ChangesSince of another run returned %v, want ErrChangesUnavailable", err)
+	}
+}
+
+func TestRetainChanges_DisabledWithoutBacklog(t *testing.T) {
+	store := newTestKeyValueService(t)
+	if store.RetainChanges() {
+		t.Fatalf("RetainChanges = true without a backlog")
+	}
+	id, offset := store.ReplicationOffset()
+	if _, err := store.Set("a", "1"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, _, err := store.ChangesSince(id, offset); !errors.Is(err, ErrChangesUnavailable) {
+		t.Fatalf("ChangesSince returned %v, want ErrChangesUnavailable", err)
+	}
+}
+
+func TestFollow_StreamsOnlyLaterChanges(t *testing.T) {
+	store := newTestKeyValueService(t)
+	if _, err := store.Set("before", "1"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	stream, err := store.Follow(10)
+	if err != nil {
+		t.Fatalf("Follow returned error: %v", err)
+	}
+	defer stream.Close()
+	if !stream.Partial() {
+		t.Fatalf("Follow returned a stream with a snapshot to sync")
+	}
+	if _, err := store.Set("after", "2"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+
+	select {
+	case mutation := <-stream.Mutations():
+		if mutation.Key != "after" || mutation.Offset != stream.Offset()+1 {
+			t.Fatalf("first mutation = %+v, want after at offset %d", mutation, stream.Offset()+1)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no mutation streamed")
+	}
+}
+
+func TestCapture_CarriesPreviousValues(t *testing.T) {
+	store := newTestKeyValueService(t)
+	captured, err := store.Capture("", 0, 10)
+	if err != nil {
+		t.Fatalf("Capture returned error: %v", err)
+	}
+	defer captured.Close()
+	followed, err := store.Follow(10)
+	if err != nil {
+		t.Fatalf("Follow returned error: %v", err)
+	}
+	defer followed.Close()
+
+	for _, value := range []string{"1", "2"} {
+		if _, err := store.Set("key", value); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+	}
+	if _, err := store.Delete("key"); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+
+	var previous []string
+	for range 3 {
+		mutation := <-captured.Mutations()
+		if mutation.Previous == nil {
+			previous = append(previous, "<nil>")
+		} else {
+			previous = append(previous, *mutation.Previous)
+		}
+		if other := <-followed.Mutations(); other.Previous != nil {
+			t.Fatalf("Follow streamed %+v with a previous value", other)
+		}
+	}
+	if got := fmt.Sprint(previous); got != "[<nil> 1 2]" {
+		t.Fatalf("captured previous values %s, want [<nil> 1 2]", got)
+	}
+}
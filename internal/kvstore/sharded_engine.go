@@ -0,0 +1,212 @@
+package kvstore
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+const DefaultShardCount = 64
+
+// ShardedEngine splits the keyspace over a fixed number of maps, each guarded
+// by its own lock. Unlike the other engines it is safe for concurrent use, so
+// it can back a service running with DirectExecution.
+type ShardedEngine struct {
+	shards []*engineShard
+}
+
+type engineShard struct {
+	mu   sync.RWMutex
+	keys memoryKeys
+}
+
+func NewShardedEngine(shardCount int) *ShardedEngine {
+	if shardCount < 1 {
+		shardCount = DefaultShardCount
+	}
+	shards := make([]*engineShard, shardCount)
+	for i := range shards {
+		shards[i] = &engineShard{keys: newMemoryKeys()}
+	}
+	return &ShardedEngine{shards}
+}
+
+func (engine *ShardedEngine) shard(key string) *engineShard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return engine.shards[h.Sum32()%uint32(len(engine.shards))]
+}
+
+func (engine *ShardedEngine) Get(key string) (TypedValue, bool, error) {
+	shard := engine.shard(key)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	value, ok := shard.keys.get(key)
+	return value, ok, nil
+}
+
+func (engine *ShardedEngine) Set(key string, value TypedValue) error {
+	shard := engine.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	return shard.keys.set(key, value)
+}
+
+func (engine *ShardedEngine) Delete(key string) (TypedValue, bool, error) {
+	shard := engine.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	value, ok := shard.keys.delete(key)
+	return value, ok, nil
+}
+
+func (engine *ShardedEngine) Inspect(key string) (ObjectInfo, bool, error) {
+	shard := engine.shard(key)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	info, ok := shard.keys.inspect("sharded", key)
+	return info, ok, nil
+}
+
+// Scan copies one shard at a time and calls fn outside its lock, so fn may
+// read from the engine. With concurrent writers the entries seen are not a
+// point-in-time view of the whole engine.
+func (engine *ShardedEngine) Scan(fn func(key string, value TypedValue) bool) error {
+	var entries []struct {
+		key   string
+		value TypedValue
+	}
+	for _, shard := range engine.shards {
+		shard.mu.RLock()
+		entries = entries[:0]
+		shard.keys.scan(func(key string, value TypedValue) bool {
+			entries = append(entries, struct {
+				key   string
+				value TypedValue
+			}{key, value})
+			return true
+		})
+		shard.mu.RUnlock()
+		for _, entry := range entries {
+			if !fn(entry.key, entry.value) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// Snapshot holds every shard's lock while it copies the keys, so unlike
+// Scan it is a point-in-time view of the whole engine.
+func (engine *ShardedEngine) Snapshot() (EngineSnapshot, error) {
+	for _, shard := range engine.shards {
+		shard.mu.RLock()
+		defer shard.mu.RUnlock()
+	}
+	snapshot := make(memorySnapshot)
+	for _, shard := range engine.shards {
+		shard.keys.scan(func(key string, value TypedValue) bool {
+			snapshot[key] = value
+			return true
+		})
+	}
+	return snapshot, nil
+}
+
+// Keys locks one shard at a time, so with concurrent writers the list is
+// not a point-in-time view of the whole engine.
+func (engine *ShardedEngine) Keys() ([]string, error) {
+	var keys []string
+	for _, shard := range engine.shards {
+		shard.mu.RLock()
+		keys = shard.keys.appendKeys(keys)
+		shard.mu.RUnlock()
+	}
+	return keys, nil
+}
+
+func (engine *ShardedEngine) KeyCount() (int, error) {
+	total := 0
+	for _, shard := range engine.shards {
+		shard.mu.RLock()
+		total += shard.keys.len()
+		shard.mu.RUnlock()
+	}
+	return total, nil
+}
+
+// SampleKeys picks shards in proportion to their size, then a key within
+// each, so every key is about equally likely to be picked.
+func (engine *ShardedEngine) SampleKeys(n int) ([]string, error) {
+	counts := make([]int, len(engine.shards))
+	total := 0
+	for i, shard := range engine.shards {
+		shard.mu.RLock()
+		counts[i] = shard.keys.len()
+		shard.mu.RUnlock()
+		total += counts[i]
+	}
+	if total == 0 || n <= 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, 0, n)
+	for range n {
+		shard := engine.shards[randomIndex(counts, total)]
+		shard.mu.RLock()
+		keys = append(keys, shard.keys.sample(1)...)
+		shard.mu.RUnlock()
+	}
+	return keys, nil
+}
+
+func (engine *ShardedEngine) ListLen(key string) (int, int, error) {
+	shard := engine.shard(key)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	return shard.keys.listLen(key)
+}
+
+func (engine *ShardedEngine) ListRange(key string, start int64, stop int64) ([]string, bool, error) {
+	shard := engine.shard(key)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	return shard.keys.listRange(key, start, stop)
+}
+
+func (engine *ShardedEngine) ListOffset(key string) (uint64, error) {
+	shard := engine.shard(key)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	return shard.keys.listOffset(key)
+}
+
+func (engine *ShardedEngine) PushList(key string, left bool, values []string, offset uint64) (int, error) {
+	shard := engine.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	return shard.keys.pushList(key, left, values, offset)
+}
+
+func (engine *ShardedEngine) PopList(key string, left bool, count int, offset uint64) ([]string, int, error) {
+	shard := engine.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	return shard.keys.popList(key, left, count, offset)
+}
+
+func (engine *ShardedEngine) SupportsConcurrentReads() bool {
+	return true
+}
+
+func (engine *ShardedEngine) Close() error {
+	return nil
+}
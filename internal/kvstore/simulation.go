@@ -0,0 +1,237 @@
+package kvstore
+
+import (
+	"context"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+// simulationEpoch is the time a Simulation's clock starts at.
+var simulationEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Simulation runs a store deterministically, so tests of expiry, sweeping
+// and replication play out the same way on every run, and a fuzzer can
+// explore them from a seed. Commands run on the calling goroutine, one at
+// a time, as the store loop would run them. Time only moves when Advance
+// moves it: deadlines are measured against the simulated clock, and the
+// expiry sweeper, tombstone purges and the events scheduled with After and
+// Every fire in order as Advance passes their times. Jitter, the sweeper's
+// samples and the replication ID are drawn from a source seeded with the
+// seed given, and the default engine scans and samples its keys in a
+// seeded order rather than Go's random map order.
+//
+// A Simulation is the KeyValueService it drives, so commands are called on
+// it directly. It is not safe for concurrent use.
+type Simulation struct {
+	*KeyValueService
+	random *rand.Rand
+	now    time.Time
+	// events are fired in order of time, then of scheduling
+	events   []*simulatedEvent
+	sequence uint64
+	// sweep is the expiry sweeper's event, nil while it is off
+	sweep    *simulatedEvent
+	stopOnce sync.Once
+}
+
+type simulatedEvent struct {
+	at       time.Time
+	sequence uint64
+	// every is the interval a repeating event fires at, zero for one that
+	// fires once
+	every time.Duration
+	run   func()
+}
+
+// NewSimulation starts a simulated store from config, seeded with seed.
+// Config.Clock and Config.Execution are replaced by the simulation's, and
+// Config.ConcurrentReads is ignored. Without Config.Engine the store runs
+// on a MemoryEngine that scans and samples in a seeded order; an engine
+// given in Config is only as deterministic as it is itself.
+func NewSimulation(seed uint64, config Config) *Simulation {
+	sim := &Simulation{
+		random: rand.New(rand.NewPCG(seed, seed)),
+		now:    simulationEpoch,
+	}
+	config.Clock = sim.Now
+	config.Execution = simulatedExecution
+	config.ConcurrentReads = false
+	config.random = sim.random
+	if config.Engine == nil {
+		config.Engine = &simulatedEngine{NewMemoryEngine(), sim.random}
+	}
+	sim.KeyValueService = newKeyValueService(context.Background(), sim.stop, config)
+	sim.Every(tombstoneGCInterval, func() {
+		sim.store.lock.Lock()
+		defer sim.store.lock.Unlock()
+		sim.store.tombstones.purge(sim.Now().UnixNano())
+	})
+	sim.scheduleSweep()
+	return sim
+}
+
+// Now returns the simulated time.
+func (sim *Simulation) Now() time.Time {
+	return sim.now
+}
+
+// Rand returns the simulation's seeded source, for tests to draw their
+// workload from so it is reproduced along with the store's own choices.
+func (sim *Simulation) Rand() *rand.Rand {
+	return sim.random
+}
+
+// Advance moves the simulated clock forward by d, firing every event due
+// on the way at the time it was due.
+func (sim *Simulation) Advance(d time.Duration) {
+	until := sim.now.Add(d)
+	for {
+		sim.scheduleSweep()
+		event := sim.next(until)
+		if event == nil {
+			break
+		}
+		sim.now = event.at
+		if event.every > 0 {
+			sim.sequence++
+			event.at, event.sequence = event.at.Add(event.every), sim.sequence
+		} else {
+			sim.cancel(event)
+		}
+		event.run()
+	}
+	sim.now = until
+}
+
+// After schedules fn to run once d from now, for tests to simulate events
+// of their own, such as a snapshot being saved or a replica reconnecting.
+// The returned function cancels it.
+func (sim *Simulation) After(d time.Duration, fn func()) (cancel func()) {
+	return sim.schedule(d, 0, fn)
+}
+
+// Every schedules fn to run each interval from now. The returned function
+// cancels it.
+func (sim *Simulation) Every(interval time.Duration, fn func()) (cancel func()) {
+	return sim.schedule(interval, interval, fn)
+}
+
+func (sim *Simulation) schedule(d time.Duration, every time.Duration, fn func()) func() {
+	sim.sequence++
+	event := &simulatedEvent{at: sim.now.Add(d), sequence: sim.sequence, every: every, run: fn}
+	sim.events = append(sim.events, event)
+	return func() { sim.cancel(event) }
+}
+
+func (sim *Simulation) cancel(event *simulatedEvent) {
+	sim.events = slices.DeleteFunc(sim.events, func(scheduled *simulatedEvent) bool {
+		return scheduled == event
+	})
+}
+
+// next returns the first event due by until, if any.
+func (sim *Simulation) next(until time.Time) *simulatedEvent {
+	var first *simulatedEvent
+	for _, event := range sim.events {
+		if event.at.After(until) {
+			continue
+		}
+		if first == nil || event.at.Before(first.at) || event.at.Equal(first.at) && event.sequence < first.sequence {
+			first = event
+		}
+	}
+	return first
+}
+
+// scheduleSweep picks up the sweeper's configuration when it has changed,
+// as the store loop does, and reschedules the sweep to match.
+func (sim *Simulation) scheduleSweep() {
+	select {
+	case <-sim.store.sweep.changed:
+		if sim.sweep != nil {
+			sim.cancel(sim.sweep)
+			sim.sweep = nil
+		}
+	default:
+		if sim.sweep != nil {
+			return
+		}
+	}
+	config := sim.store.sweep.config.Load()
+	if config == nil || config.Interval <= 0 {
+		return
+	}
+	sim.Every(config.Interval, func() {
+		sim.store.sweepExpired(*sim.store.sweep.config.Load())
+	})
+	sim.sweep = sim.events[len(sim.events)-1]
+}
+
+// stop closes the engine once the service has shut down, in place of the
+// store loop.
+func (sim *Simulation) stop() {
+	sim.stopOnce.Do(func() {
+		sim.store.lock.Lock()
+		if err := sim.store.engine.Close(); err != nil {
+			sim.store.logger.Printf("Error closing storage engine: %v", err)
+		}
+		sim.store.lock.Unlock()
+		close(sim.store.stopped)
+	})
+}
+
+// Deliver applies the mutations stream holds so far to the simulation, as
+// a replica's connection to its primary would, and returns how many it
+// applied, along with the stream's error if it has failed. A stream with a
+// snapshot must be synced with Sync first.
+func (sim *Simulation) Deliver(stream *ReplicationStream) (int, error) {
+	var mutations []Mutation
+	for pending := stream.Mutations(); len(pending) > 0; {
+		mutations = append(mutations, <-pending)
+	}
+	if len(mutations) > 0 {
+		if err := sim.ApplyMutations(mutations); err != nil {
+			return 0, err
+		}
+	}
+	return len(mutations), stream.Err()
+}
+
+// simulatedEngine is a MemoryEngine that scans its keys in order and
+// samples them from a seeded source, where a MemoryEngine would follow Go's
+// random map order.
+type simulatedEngine struct {
+	*MemoryEngine
+	random *rand.Rand
+}
+
+func (engine *simulatedEngine) Scan(fn func(key string, value TypedValue) bool) error {
+	keys, _ := engine.Keys()
+	for _, key := range keys {
+		value, _, _ := engine.Get(key)
+		if !fn(key, value) {
+			break
+		}
+	}
+	return nil
+}
+
+func (engine *simulatedEngine) Keys() ([]string, error) {
+	keys, err := engine.MemoryEngine.Keys()
+	slices.Sort(keys)
+	return keys, err
+}
+
+func (engine *simulatedEngine) SampleKeys(n int) ([]string, error) {
+	keys, _ := engine.Keys()
+	if len(keys) == 0 || n <= 0 {
+		return nil, nil
+	}
+	sample := make([]string, n)
+	for i := range sample {
+		sample[i] = keys[engine.random.IntN(len(keys))]
+	}
+	return sample, nil
+}
@@ -0,0 +1,173 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// simulate runs a random workload of writes, expiries and reads against a
+// simulation seeded with seed and returns a trace of what it saw.
+func simulate(t *testing.T, seed uint64) string {
+	t.Helper()
+	sim := NewSimulation(seed, Config{
+		TTLJitter:   0.5,
+		ExpirySweep: ExpirySweep{Interval: 100 * time.Millisecond, SampleSize: 4},
+	})
+	defer sim.Close()
+
+	var trace strings.Builder
+	random := sim.Rand()
+	for range 300 {
+		key := fmt.Sprintf("k%d", random.IntN(40))
+		switch random.IntN(4) {
+		case 0:
+			_, err := sim.Set(key, key)
+			fmt.Fprintf(&trace, "set %s %v\n", key, err)
+		case 1:
+			ok, err := sim.ExpireAt(key, sim.Now().Add(time.Duration(random.IntN(2000))*time.Millisecond))
+			ttl, _ := sim.TTL(key)
+			fmt.Fprintf(&trace, "expire %s %t %v %v\n", key, ok, err, ttl)
+		case 2:
+			value, err := sim.Get(key)
+			fmt.Fprintf(&trace, "get %s %v %v\n", key, value != nil, err)
+		case 3:
+			sim.Advance(time.Duration(random.IntN(300)) * time.Millisecond)
+		}
+	}
+	keys, err := sim.RandomKeys(5)
+	id, offset := sim.ReplicationOffset()
+	sweep := sim.ExpirySweepStats()
+	fmt.Fprintf(&trace, "random %v %v\nreplication %s %d\nswept %d in %d rounds\n", keys, err, id, offset, sweep.Removed, sweep.Rounds)
+	return trace.String()
+}
+
+func TestSimulation_ReplaysTheSameRunFromASeed(t *testing.T) {
+	first := simulate(t, 42)
+	if again := simulate(t, 42); again != first {
+		t.Fatalf("two runs from the same seed differ:\n%s\nthen\n%s", first, again)
+	}
+	if other := simulate(t, 43); other == first {
+		t.Fatal("runs from different seeds are the same")
+	}
+	if !strings.Contains(first, "swept") || strings.Contains(first, "swept 0 ") {
+		t.Fatalf("the sweeper removed nothing in\n%s", first)
+	}
+}
+
+func TestSimulation_FiresEventsInOrder(t *testing.T) {
+	sim := NewSimulation(1, Config{})
+	defer sim.Close()
+
+	var fired []string
+	record := func(name string) func() {
+		return func() { fired = append(fired, fmt.Sprintf("%s@%s", name, sim.Now().Sub(simulationEpoch))) }
+	}
+	stopTick := sim.Every(time.Second, record("tick"))
+	sim.After(1500*time.Millisecond, record("later"))
+	sim.After(time.Second, record("soon"))
+	cancelled := sim.After(time.Second, record("cancelled"))
+	cancelled()
+
+	sim.Advance(2 * time.Second)
+	stopTick()
+	sim.Advance(time.Hour)
+	want := []string{"tick@1s", "soon@1s", "later@1.5s", "tick@2s"}
+	if !reflect.DeepEqual(fired, want) {
+		t.Fatalf("fired %v, want %v", fired, want)
+	}
+	if elapsed := sim.Now().Sub(simulationEpoch); elapsed != time.Hour+2*time.Second {
+		t.Fatalf("clock advanced by %v, want 1h0m2s", elapsed)
+	}
+}
+
+func TestSimulation_SweepsOnSchedule(t *testing.T) {
+	sim := NewSimulation(1, Config{})
+	defer sim.Close()
+	for i := range 10 {
+		key := fmt.Sprintf("k%d", i)
+		if _, err := sim.Set(key, "v"); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+		if _, err := sim.ExpireAt(key, sim.Now().Add(time.Second)); err != nil {
+			t.Fatalf("ExpireAt returned error: %v", err)
+		}
+	}
+
+	// Switched on mid-run, the sweeper first runs an interval later
+	sim.SetExpirySweep(ExpirySweep{Interval: time.Minute, SampleSize: 4})
+	sim.Advance(59 * time.Second)
+	if stats := sim.ExpirySweepStats(); stats.Sweeps != 0 {
+		t.Fatalf("swept %d times before the first interval was up", stats.Sweeps)
+	}
+	sim.Advance(time.Second)
+	stats := sim.ExpirySweepStats()
+	if stats.Sweeps != 1 || stats.Removed != 10 {
+		t.Fatalf("sweeper stats %+v, want one sweep removing all 10 keys", stats)
+	}
+}
+
+// FuzzSimulation_ReplicaConverges drives a primary with a workload decoded
+// from ops and checks that a replica following it holds the same keys once
+// it has caught up.
+func FuzzSimulation_ReplicaConverges(f *testing.F) {
+	f.Add(uint64(1), []byte{0, 1, 2, 3, 4, 5, 6, 7})
+	f.Add(uint64(7), []byte("set some keys, expire some, delete some, wait"))
+	f.Fuzz(func(t *testing.T, seed uint64, ops []byte) {
+		primary := NewSimulation(seed, Config{TTLJitter: 0.2, TombstoneGrace: time.Minute})
+		defer primary.Close()
+		replica := NewSimulation(seed+1, Config{})
+		defer replica.Close()
+
+		stream, err := primary.Replicate(len(ops) + 1)
+		if err != nil {
+			t.Fatalf("Replicate returned error: %v", err)
+		}
+		defer stream.Close()
+		if err := stream.Sync(func(mutation Mutation) error {
+			return replica.ApplyMutations([]Mutation{mutation})
+		}); err != nil {
+			t.Fatalf("Sync returned error: %v", err)
+		}
+
+		for i, op := range ops {
+			key := fmt.Sprintf("k%d", op%8)
+			switch op % 4 {
+			case 0:
+				_, err = primary.Set(key, fmt.Sprint(i))
+			case 1:
+				_, err = primary.ExpireAt(key, primary.Now().Add(time.Duration(op)*10*time.Millisecond))
+			case 2:
+				_, err = primary.Delete(key)
+			case 3:
+				primary.Advance(time.Duration(op) * time.Millisecond)
+				replica.Advance(time.Duration(op) * time.Millisecond)
+			}
+			if err != nil {
+				t.Fatalf("op %d returned error: %v", op, err)
+			}
+			if _, err := replica.Deliver(stream); err != nil {
+				t.Fatalf("Deliver returned error: %v", err)
+			}
+		}
+
+		if want, got := contents(t, primary), contents(t, replica); !reflect.DeepEqual(got, want) {
+			t.Fatalf("replica holds %v, want the primary's %v", got, want)
+		}
+	})
+}
+
+func contents(t *testing.T, sim *Simulation) map[string]Value {
+	t.Helper()
+	values := make(map[string]Value)
+	for key, value := range sim.Range(context.Background(), "") {
+		if value.Err != nil {
+			t.Fatalf("Range returned error: %v", value.Err)
+		}
+		values[key] = value
+	}
+	return values
+}
@@ -0,0 +1,365 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrSnapshotClosed = errors.New("snapshot is closed")
+
+// KeyLister is implemented by engines that can list their keys without
+// reading every value, as StorageEngine.Scan does.
+type KeyLister interface {
+	Keys() ([]string, error)
+}
+
+// Snapshot is a read-only, point-in-time view of the store. It is
+// copy-on-write: while it is open, the first write to each key saves the
+// key's previous value into the snapshot, and everything else is read from
+// the engine. Opening one is cheap and never blocks writers, but it holds
+// a copy of every key overwritten since, so it should be closed as soon as
+// it is no longer needed.
+type Snapshot struct {
+	service *KeyValueService
+	// at is the snapshot time in Unix nanoseconds; keys whose expiry had
+	// passed by then are not part of it
+	at     int64
+	closed atomic.Bool
+	// id and offset are the replication run and offset of the last change
+	// the snapshot includes
+	id     string
+	offset uint64
+	// tombstones are the keys deleted within the grace period before the
+	// snapshot was taken
+	tombstones []string
+
+	mu        sync.RWMutex
+	preimages map[string]preimage
+}
+
+// preimage is a key's value when the snapshot was taken.
+type preimage struct {
+	value TypedValue
+	live  bool
+}
+
+// snapshotCommand carries a snapshot through the store, and the value read
+// by SNAPSHOTGET or the keys listed by SNAPSHOTKEYS back out of it.
+type snapshotCommand struct {
+	snapshot *Snapshot
+	value    TypedValue
+	keys     []string
+}
+
+func (snapshot *Snapshot) preimage(key string) (preimage, bool) {
+	snapshot.mu.RLock()
+	defer snapshot.mu.RUnlock()
+
+	image, ok := snapshot.preimages[key]
+	return image, ok
+}
+
+// liveAt reports whether a key with the given expiry was still live at the
+// snapshot time.
+func (snapshot *Snapshot) liveAt(deadline int64, hasDeadline bool) bool {
+	return !hasDeadline || deadline > snapshot.at
+}
+
+// snapshotRegistry is copy-on-write like notificationBus, so writes with no
+// open snapshots cost a single atomic load.
+type snapshotRegistry struct {
+	mu        sync.Mutex
+	snapshots atomic.Pointer[[]*Snapshot]
+}
+
+func (registry *snapshotRegistry) add(snapshot *Snapshot) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	var next []*Snapshot
+	if current := registry.snapshots.Load(); current != nil {
+		next = append(next, *current...)
+	}
+	next = append(next, snapshot)
+	registry.snapshots.Store(&next)
+}
+
+func (registry *snapshotRegistry) remove(snapshot *Snapshot) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	current := registry.snapshots.Load()
+	if current == nil {
+		return
+	}
+	next := make([]*Snapshot, 0, len(*current))
+	for _, s := range *current {
+		if s != snapshot {
+			next = append(next, s)
+		}
+	}
+	registry.snapshots.Store(&next)
+}
+
+// preserve saves key's current value into every open snapshot that does not
+// have it yet. It must be called before each write to the engine.
+func (kvStore *KeyValueStore) preserve(key string) error {
+	snapshots := kvStore.snapshots.snapshots.Load()
+	if snapshots == nil || len(*snapshots) == 0 {
+		return nil
+	}
+
+	var image preimage
+	var read bool
+	for _, snapshot := range *snapshots {
+		if _, ok := snapshot.preimage(key); ok {
+			continue
+		}
+		if !read {
+			value, ok, err := kvStore.engine.Get(key)
+			if err != nil {
+				return fmt.Errorf("preserving key %s for snapshots: %w", key, err)
+			}
+			image.value, image.live, read = value, ok, true
+		}
+
+		deadline, hasDeadline := kvStore.expiries.deadline(key)
+		snapshot.mu.Lock()
+		// A closed snapshot has dropped its preimages
+		if _, ok := snapshot.preimages[key]; !ok && snapshot.preimages != nil {
+			snapshot.preimages[key] = preimage{image.value, image.live && snapshot.liveAt(deadline, hasDeadline)}
+		}
+		snapshot.mu.Unlock()
+	}
+	return nil
+}
+
+// setValue and deleteValue write to the engine on behalf of commands,
+// preserving the previous value for open snapshots and the history first
+// and publishing the change to replicas and subscribers after. Deletes
+// leave a tombstone, which a later write clears.
+func (kvStore *KeyValueStore) setValue(key string, value TypedValue) error {
+	defer kvStore.replication.end(kvStore.replication.begin())
+	return kvStore.writeValue(key, value, kvStore.engine.Set)
+}
+
+// setValueExpiring is setValue for a write that also replaces the key's
+// deadline, or clears it when deadline is zero. An engine that keeps
+// deadlines takes both in one write, so a restart never finds the value
+// without its deadline.
+func (kvStore *KeyValueStore) setValueExpiring(key string, value TypedValue, deadline int64) error {
+	defer kvStore.replication.end(kvStore.replication.begin())
+	write := kvStore.engine.Set
+	if engine, ok := kvStore.engine.(DeadlineEngine); ok {
+		write = func(key string, value TypedValue) error {
+			return engine.SetExpiring(key, value, deadline)
+		}
+	}
+	if err := kvStore.writeValue(key, value, write); err != nil {
+		return err
+	}
+	kvStore.noteDeadline(key, deadline)
+	return nil
+}
+
+func (kvStore *KeyValueStore) writeValue(key string, value TypedValue, write func(key string, value TypedValue) error) error {
+	if err := kvStore.preserve(key); err != nil {
+		return err
+	}
+	if err := kvStore.retain(key); err != nil {
+		return err
+	}
+	var previous *string
+	if kvStore.replication.capturing.Load() > 0 {
+		old, ok, err := kvStore.engine.Get(key)
+		if err != nil {
+			return fmt.Errorf("capturing previous value of key %s: %w", key, err)
+		}
+		if ok {
+			previous = stringPointer(old.Data)
+		}
+	}
+	if err := write(key, value); err != nil {
+		return err
+	}
+	kvStore.tombstones.clear(key)
+	kvStore.replication.publish(Mutation{Type: MutationSet, Key: key, Value: value.Data, ValueType: value.Type, Previous: previous})
+	kvStore.notifications.publish(EventSet, key, kvStore.currentTime)
+	return nil
+}
+
+func (kvStore *KeyValueStore) deleteValue(key string) (TypedValue, bool, error) {
+	defer kvStore.replication.end(kvStore.replication.begin())
+	if err := kvStore.preserve(key); err != nil {
+		return TypedValue{}, false, err
+	}
+	if err := kvStore.retain(key); err != nil {
+		return TypedValue{}, false, err
+	}
+	value, ok, err := kvStore.engine.Delete(key)
+	if ok {
+		kvStore.tombstones.add(key, kvStore.currentTime().UnixNano())
+		mutation := Mutation{Type: MutationDelete, Key: key}
+		if kvStore.replication.capturing.Load() > 0 {
+			mutation.Previous = stringPointer(value.Data)
+		}
+		kvStore.replication.publish(mutation)
+		kvStore.notifications.publish(EventDel, key, kvStore.currentTime)
+	}
+	return value, ok, err
+}
+
+func (kvStore *KeyValueStore) ProcessSnapshotCommand(command KeyValueCommand) KeyValueOutput {
+	snapshot := command.snapshot.snapshot
+	// Pausing writes keeps one that has already read its preimage from
+	// landing in the engine after the snapshot is taken
+	defer kvStore.replication.pause()()
+	snapshot.at = kvStore.currentTime().UnixNano()
+	snapshot.id, snapshot.offset = kvStore.replication.id, kvStore.replication.offset.Load()
+	snapshot.tombstones = kvStore.tombstones.keys()
+	kvStore.snapshots.add(snapshot)
+	return KeyValueOutput{true, nil, nil, 0}
+}
+
+// ProcessSnapshotGetCommand reads command.key as of the snapshot into
+// command.snapshot.value, replying with its data if it existed. The
+// engine is read before the preimages: a write that lands in between has
+// already saved its preimage, so the value read is never newer than the
+// snapshot.
+func (kvStore *KeyValueStore) ProcessSnapshotGetCommand(command KeyValueCommand) KeyValueOutput {
+	snapshot := command.snapshot.snapshot
+	key := command.key
+	value, ok, err := kvStore.engine.Get(key)
+	if err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+	if image, saved := snapshot.preimage(key); saved {
+		value, ok = image.value, image.live
+	} else if ok {
+		ok = snapshot.liveAt(kvStore.expiries.deadline(key))
+	}
+	if !ok {
+		return KeyValueOutput{true, nil, nil, 0}
+	}
+	command.snapshot.value = value
+	return KeyValueOutput{true, stringPointer(value.Data), nil, 0}
+}
+
+// ProcessSnapshotKeysCommand lists the keys in the snapshot: the engine's
+// keys that have not changed since, and the saved keys that were live.
+func (kvStore *KeyValueStore) ProcessSnapshotKeysCommand(command KeyValueCommand) KeyValueOutput {
+	snapshot := command.snapshot.snapshot
+	keys, err := listKeys(kvStore.engine)
+	if err != nil {
+		return KeyValueOutput{false, nil, err, 0}
+	}
+
+	out := keys[:0]
+	for _, key := range keys {
+		if _, saved := snapshot.preimage(key); saved {
+			continue
+		}
+		if snapshot.liveAt(kvStore.expiries.deadline(key)) {
+			out = append(out, key)
+		}
+	}
+	snapshot.mu.RLock()
+	for key, image := range snapshot.preimages {
+		if image.live {
+			out = append(out, key)
+		}
+	}
+	snapshot.mu.RUnlock()
+
+	command.snapshot.keys = out
+	return KeyValueOutput{true, nil, nil, 0}
+}
+
+// Snapshot opens a point-in-time view of the store for exports, backups and
+// long scans. Writes carry on while it is open and are not visible through
+// it. It must be closed when done.
+func (kvService *KeyValueService) Snapshot() (*Snapshot, error) {
+	if err := kvService.CheckActive(); err != nil {
+		return nil, err
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return nil, err
+	}
+	snapshot := &Snapshot{service: kvService, preimages: make(map[string]preimage)}
+	res := kvService.dispatch(KeyValueCommand{commandType: SNAPSHOT, snapshot: &snapshotCommand{snapshot: snapshot}})
+	if res.err != nil {
+		return nil, res.err
+	}
+	return snapshot, nil
+}
+
+// Time returns when the snapshot was taken.
+func (snapshot *Snapshot) Time() time.Time {
+	return time.Unix(0, snapshot.at)
+}
+
+// Position returns the replication run and offset of the last change the
+// snapshot includes, from which ChangesSince picks up.
+func (snapshot *Snapshot) Position() (id string, offset uint64) {
+	return snapshot.id, snapshot.offset
+}
+
+// Get returns key's value as of the snapshot, and whether it existed.
+func (snapshot *Snapshot) Get(key string) (TypedValue, bool, error) {
+	if snapshot.closed.Load() {
+		return TypedValue{}, false, ErrSnapshotClosed
+	}
+	if err := snapshot.service.CheckActive(); err != nil {
+		return TypedValue{}, false, err
+	}
+	command := &snapshotCommand{snapshot: snapshot}
+	res := snapshot.service.dispatchRead(KeyValueCommand{commandType: SNAPSHOTGET, key: key, snapshot: command})
+	if res.err != nil || res.value == nil {
+		return TypedValue{}, false, res.err
+	}
+	return command.value, true, nil
+}
+
+// Expiry returns when key expires, and whether it has an expiry. Expiries
+// are not saved by the snapshot, so this is the key's expiry as it is now;
+// it reports no expiry for a key that has since been deleted.
+func (snapshot *Snapshot) Expiry(key string) (time.Time, bool) {
+	deadline, ok := snapshot.service.store.expiries.deadline(key)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, deadline), true
+}
+
+// Keys returns every key in the snapshot, in no particular order. Listing
+// the engine's keys runs as a single command, so it holds up other commands
+// for as long as the engine takes to list them.
+func (snapshot *Snapshot) Keys() ([]string, error) {
+	if snapshot.closed.Load() {
+		return nil, ErrSnapshotClosed
+	}
+	if err := snapshot.service.CheckActive(); err != nil {
+		return nil, err
+	}
+	command := &snapshotCommand{snapshot: snapshot}
+	res := snapshot.service.dispatchRead(KeyValueCommand{commandType: SNAPSHOTKEYS, snapshot: command})
+	if res.err != nil {
+		return nil, res.err
+	}
+	return command.keys, nil
+}
+
+// Close releases the snapshot and the values it saved.
+func (snapshot *Snapshot) Close() {
+	if snapshot.closed.Swap(true) {
+		return
+	}
+	snapshot.service.store.snapshots.remove(snapshot)
+
+	snapshot.mu.Lock()
+	defer snapshot.mu.Unlock()
+	snapshot.preimages = nil
+}
@@ -0,0 +1,174 @@
+package kvstore
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func snapshotKeys(t *testing.T, snapshot *Snapshot) []string {
+	t.Helper()
+
+	keys, err := snapshot.Keys()
+	if err != nil {
+		t.Fatalf("Keys returned error: %v", err)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func TestSnapshot_HidesLaterWrites(t *testing.T) {
+	store := newTestKeyValueService(t)
+	for _, key := range []string{"a", "b"} {
+		if _, err := store.Set(key, "old"); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+	}
+
+	snapshot, err := store.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot returned error: %v", err)
+	}
+	defer snapshot.Close()
+
+	if _, err := store.Set("a", "new"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := store.Delete("b"); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+	if _, err := store.Set("c", "new"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+
+	for _, key := range []string{"a", "b"} {
+		if value, ok, err := snapshot.Get(key); err != nil || !ok || value != stringValue("old") {
+			t.Fatalf("snapshot Get(%s) = (%q, %t, %v), want (old, true, nil)", key, value, ok, err)
+		}
+	}
+	if _, ok, err := snapshot.Get("c"); err != nil || ok {
+		t.Fatalf("snapshot Get of a later key = (%t, %v), want (false, nil)", ok, err)
+	}
+	if keys := snapshotKeys(t, snapshot); !slices.Equal(keys, []string{"a", "b"}) {
+		t.Fatalf("snapshot Keys = %q, want [a b]", keys)
+	}
+
+	if value, err := store.Get("a"); err != nil || *value != "new" {
+		t.Fatalf("Get outside the snapshot = (%v, %v), want new", value, err)
+	}
+}
+
+func TestSnapshot_ExpiryAsOfSnapshotTime(t *testing.T) {
+	store := newTestKeyValueService(t)
+	clock := newTestClock(store)
+	expireKey(t, store, clock, "expired")
+	if _, err := store.Set("expiring", "value"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := store.ExpireAt("expiring", clock.Now().Add(time.Second)); err != nil {
+		t.Fatalf("ExpireAt returned error: %v", err)
+	}
+
+	snapshot, err := store.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot returned error: %v", err)
+	}
+	defer snapshot.Close()
+
+	clock.Advance(time.Second)
+	if _, err := store.Get("expiring"); err == nil {
+		t.Fatalf("Get after expiry succeeded, want error")
+	}
+
+	if _, ok, _ := snapshot.Get("expired"); ok {
+		t.Fatalf("snapshot includes a key that had expired before it was taken")
+	}
+	if _, ok, _ := snapshot.Get("expiring"); !ok {
+		t.Fatalf("snapshot lost a key that expired after it was taken")
+	}
+	if keys := snapshotKeys(t, snapshot); !slices.Equal(keys, []string{"expiring"}) {
+		t.Fatalf("snapshot Keys = %q, want [expiring]", keys)
+	}
+}
+
+func TestSnapshot_Expiry(t *testing.T) {
+	store := newTestKeyValueService(t)
+	clock := newTestClock(store)
+	for _, key := range []string{"expiring", "persistent"} {
+		if _, err := store.Set(key, "value"); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+	}
+	deadline := clock.Now().Add(time.Minute)
+	if _, err := store.ExpireAt("expiring", deadline); err != nil {
+		t.Fatalf("ExpireAt returned error: %v", err)
+	}
+
+	snapshot, err := store.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot returned error: %v", err)
+	}
+	defer snapshot.Close()
+
+	if at, ok := snapshot.Expiry("expiring"); !ok || !at.Equal(deadline) {
+		t.Fatalf("Expiry = (%v, %t), want (%v, true)", at, ok, deadline)
+	}
+	if at, ok := snapshot.Expiry("persistent"); ok {
+		t.Fatalf("Expiry of a key without one = %v, want none", at)
+	}
+}
+
+func TestSnapshot_ClosedSnapshotRejectsReads(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	snapshot, err := store.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot returned error: %v", err)
+	}
+	snapshot.Close()
+	snapshot.Close()
+
+	if _, _, err := snapshot.Get("a"); !errors.Is(err, ErrSnapshotClosed) {
+		t.Fatalf("Get on a closed snapshot returned %v, want ErrSnapshotClosed", err)
+	}
+	// Writes after Close no longer save preimages
+	if _, err := store.Set("a", "value"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+}
+
+func TestSnapshot_ConsistentUnderConcurrentWrites(t *testing.T) {
+	store := newTestKeyValueServiceWithConfig(t, Config{Execution: DirectExecution})
+	const keyCount = 100
+	for i := range keyCount {
+		if _, err := store.Set(strconv.Itoa(i), "0"); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+	}
+
+	snapshot, err := store.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot returned error: %v", err)
+	}
+	defer snapshot.Close()
+
+	var wg sync.WaitGroup
+	for writer := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range keyCount {
+				_, _ = store.Set(strconv.Itoa(i), strconv.Itoa(writer+1))
+			}
+		}()
+	}
+	for i := range keyCount {
+		if value, ok, err := snapshot.Get(strconv.Itoa(i)); err != nil || !ok || value != stringValue("0") {
+			t.Errorf("snapshot Get(%d) = (%q, %t, %v), want (0, true, nil)", i, value, ok, err)
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,84 @@
+package kvstore
+
+import "time"
+
+// statsSamples is how many keys Stats samples to estimate how much memory
+// the keyspace takes.
+const statsSamples = 100
+
+// Stats is a point-in-time view of the service, for embedders that want
+// the numbers the node's stats endpoint serves without going through HTTP.
+type Stats struct {
+	Uptime time.Duration
+	// Keys is the number of keys the engine holds, including expired ones
+	// not removed yet, or -1 if the engine cannot count them
+	Keys int
+	// MemoryBytes estimates the bytes taken by keys and values, scaled up
+	// from a sample of statsSamples keys, or -1 if the engine cannot
+	// sample them
+	MemoryBytes int64
+	// ExpiringKeys is the number of keys with an expiry
+	ExpiringKeys int
+	// ExpiredKeys counts the keys removed because they expired, whether
+	// by the sweeper or when next touched
+	ExpiredKeys uint64
+	// ExpirySweep is what the active expiry sweeper has done
+	ExpirySweep ExpirySweepStats
+	// History is what the retained history holds
+	History HistoryStats
+	// Tombstones is what the tombstone table holds
+	Tombstones TombstoneStats
+	// Tiers is how reads split between a TieredEngine's tiers, nil for
+	// other engines
+	Tiers      *TierStats
+	Commands   map[string]CommandStats
+	Batches    BatchStats
+	QueueDepth int
+	// QueueCapacity is the size of the input queue, 0 when unbuffered
+	QueueCapacity int
+	// Overloaded counts commands rejected with ErrOverloaded
+	Overloaded uint64
+	// DeadlineExceeded counts commands skipped with ErrDeadlineExceeded
+	DeadlineExceeded uint64
+}
+
+// Stats returns the service's statistics. Counting keys and estimating
+// their memory is a single sampled command, so Stats is cheap enough to
+// poll; it is not held up by maintenance, when the counters are what
+// callers most want to see.
+func (kvService *KeyValueService) Stats() (Stats, error) {
+	if err := kvService.CheckActive(); err != nil {
+		return Stats{}, err
+	}
+	stats := Stats{
+		Uptime:           time.Since(kvService.started),
+		Keys:             -1,
+		MemoryBytes:      -1,
+		ExpiringKeys:     int(kvService.store.expiries.size.Load()),
+		ExpiredKeys:      kvService.store.expiries.removed.Load(),
+		ExpirySweep:      kvService.ExpirySweepStats(),
+		History:          kvService.HistoryStats(),
+		Tombstones:       kvService.TombstoneStats(),
+		Commands:         kvService.CommandStats(),
+		Batches:          kvService.BatchStats(),
+		QueueDepth:       kvService.QueueDepth(),
+		QueueCapacity:    kvService.QueueCapacity(),
+		Overloaded:       kvService.OverloadedCount(),
+		DeadlineExceeded: kvService.DeadlineExceededCount(),
+	}
+	if tiers, ok := kvService.TierStats(); ok {
+		stats.Tiers = &tiers
+	}
+	if _, ok := kvService.store.engine.(KeySampler); !ok {
+		return stats, nil
+	}
+
+	command := &keyspaceCommand{samples: statsSamples}
+	res := kvService.dispatchRead(KeyValueCommand{commandType: KEYSPACE, keyspace: command})
+	if res.err != nil {
+		return Stats{}, res.err
+	}
+	stats.Keys = command.report.Keys
+	stats.MemoryBytes = command.report.Other.Bytes
+	return stats, nil
+}
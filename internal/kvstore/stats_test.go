@@ -0,0 +1,105 @@
+package kvstore
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStats_CountsKeysExpiriesAndCommands(t *testing.T) {
+	store := newTestKeyValueService(t)
+	clock := newTestClock(store)
+	for _, key := range []string{"a", "b"} {
+		if _, err := store.Set(key, "value"); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+	}
+	if _, err := store.ExpireAt("b", clock.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("ExpireAt returned error: %v", err)
+	}
+	expireKey(t, store, clock, "gone")
+	if _, err := store.Get("gone"); err == nil {
+		t.Fatalf("Get of an expired key returned no error")
+	}
+
+	stats, err := store.Stats()
+	if err != nil {
+		t.Fatalf("Stats returned error: %v", err)
+	}
+	if stats.Keys != 2 || stats.ExpiringKeys != 1 || stats.ExpiredKeys != 1 {
+		t.Fatalf("Stats = {Keys: %d, ExpiringKeys: %d, ExpiredKeys: %d}, want {2, 1, 1}",
+			stats.Keys, stats.ExpiringKeys, stats.ExpiredKeys)
+	}
+	if want := int64(2 * (len("a") + len("value") + approxEntryOverhead)); stats.MemoryBytes != want {
+		t.Fatalf("MemoryBytes = %d, want %d", stats.MemoryBytes, want)
+	}
+	if got := stats.Commands["PUT"].Count; got != 3 {
+		t.Fatalf("Commands[PUT].Count = %d, want 3", got)
+	}
+	if stats.Uptime <= 0 {
+		t.Fatalf("Uptime = %v, want > 0", stats.Uptime)
+	}
+}
+
+func TestStats_LeavesOutKeysEnginesCannotCount(t *testing.T) {
+	instance = nil
+	once = sync.Once{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	store := GetKeyValueServiceWithEngine(ctx, cancel, scanOnlyEngine{NewMemoryEngine()})
+	if _, err := store.Set("a", "value"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+
+	stats, err := store.Stats()
+	if err != nil {
+		t.Fatalf("Stats returned error: %v", err)
+	}
+	if stats.Keys != -1 || stats.MemoryBytes != -1 {
+		t.Fatalf("Stats = {Keys: %d, MemoryBytes: %d}, want -1 for both", stats.Keys, stats.MemoryBytes)
+	}
+	if got := stats.Commands["PUT"].Count; got != 1 {
+		t.Fatalf("Commands[PUT].Count = %d, want 1", got)
+	}
+}
+
+func TestStats_FailsOnceClosed(t *testing.T) {
+	store := newTestKeyValueService(t)
+	store.Close()
+
+	if _, err := store.Stats(); err == nil {
+		t.Fatalf("Stats on a closed service returned no error")
+	}
+}
+
+func TestStats_ReportsTierHits(t *testing.T) {
+	store := newTestKeyValueServiceWithConfig(t, Config{Engine: NewTieredEngine(1, NewMemoryEngine())})
+	for _, key := range []string{"a", "b"} {
+		if _, err := store.Set(key, "value"); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+	}
+	for _, key := range []string{"b", "a", "missing"} {
+		_, _ = store.Get(key)
+	}
+
+	stats, err := store.Stats()
+	if err != nil {
+		t.Fatalf("Stats returned error: %v", err)
+	}
+	if stats.Tiers == nil {
+		t.Fatalf("Stats().Tiers = nil for a tiered engine")
+	}
+	if stats.Tiers.HotHits != 1 || stats.Tiers.ColdHits != 1 || stats.Tiers.Misses != 1 {
+		t.Fatalf("Tiers = %+v, want one hot hit, one cold hit and one miss", *stats.Tiers)
+	}
+	if rate := stats.Tiers.HotHitRate(); rate < 0.33 || rate > 0.34 {
+		t.Fatalf("HotHitRate = %v, want 1/3", rate)
+	}
+
+	if stats, _ := newTestKeyValueService(t).Stats(); stats.Tiers != nil {
+		t.Fatalf("Stats().Tiers = %+v for an in-memory engine, want nil", *stats.Tiers)
+	}
+}
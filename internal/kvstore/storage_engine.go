@@ -0,0 +1,163 @@
+package kvstore
+
+// StorageEngine is the backing store the KeyValueStore command loop reads from
+// and writes to. Engines are only touched from the store goroutine, so they do
+// not need to be safe for concurrent use.
+//
+// Any implementation can be passed as Config.Engine. Expiry, replication
+// and notifications are layered on top by the store, so an engine only
+// holds values, each with its type, which it must hand back as it was set;
+// the optional interfaces below (ConcurrentReader,
+// KeyLister, KeySampler, KeyInspector, ListEngine) let it offer faster
+// paths, and DeadlineEngine lets it keep expiry deadlines across restarts.
+type StorageEngine interface {
+	Get(key string) (TypedValue, bool, error)
+	Set(key string, value TypedValue) error
+	Delete(key string) (TypedValue, bool, error)
+	// Scan calls fn with every key and its value, in no particular order,
+	// until fn returns false. fn must not write to the engine.
+	Scan(fn func(key string, value TypedValue) bool) error
+	// Snapshot returns a view of the engine as it is now, which later
+	// writes do not change. The store's own snapshots are copy-on-write
+	// over Get and Scan and do not need one.
+	Snapshot() (EngineSnapshot, error)
+	Close() error
+}
+
+// EngineSnapshot is a read-only, point-in-time view of a StorageEngine.
+// Unlike the engine, it may be read while the engine is written to, from
+// another goroutine, though by one goroutine at a time. Close releases
+// what it holds, and must be called before the engine is closed.
+type EngineSnapshot interface {
+	Get(key string) (TypedValue, bool, error)
+	// Scan calls fn with every key and its value, in no particular order,
+	// until fn returns false.
+	Scan(fn func(key string, value TypedValue) bool) error
+	Close() error
+}
+
+// memorySnapshot is the snapshot of the in-memory engines: a copy of every
+// value, with lists encoded.
+type memorySnapshot map[string]TypedValue
+
+func (snapshot memorySnapshot) Get(key string) (TypedValue, bool, error) {
+	value, ok := snapshot[key]
+	return value, ok, nil
+}
+
+func (snapshot memorySnapshot) Scan(fn func(key string, value TypedValue) bool) error {
+	for key, value := range snapshot {
+		if !fn(key, value) {
+			break
+		}
+	}
+	return nil
+}
+
+func (snapshot memorySnapshot) Close() error {
+	return nil
+}
+
+// listKeys lists engine's keys, through KeyLister if the engine has a
+// faster way than reading every value.
+func listKeys(engine StorageEngine) ([]string, error) {
+	if lister, ok := engine.(KeyLister); ok {
+		return lister.Keys()
+	}
+	var keys []string
+	err := engine.Scan(func(key string, _ TypedValue) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys, err
+}
+
+// ConcurrentReader is implemented by engines that can serve Gets in parallel
+// with each other while no write is running. Engines whose Get mutates
+// internal state, like TieredEngine's LRU bookkeeping, must report false.
+type ConcurrentReader interface {
+	SupportsConcurrentReads() bool
+}
+
+type MemoryEngine struct {
+	keys memoryKeys
+}
+
+func NewMemoryEngine() *MemoryEngine {
+	return &MemoryEngine{newMemoryKeys()}
+}
+
+func (engine *MemoryEngine) Get(key string) (TypedValue, bool, error) {
+	value, ok := engine.keys.get(key)
+	return value, ok, nil
+}
+
+func (engine *MemoryEngine) Set(key string, value TypedValue) error {
+	return engine.keys.set(key, value)
+}
+
+func (engine *MemoryEngine) Delete(key string) (TypedValue, bool, error) {
+	value, ok := engine.keys.delete(key)
+	return value, ok, nil
+}
+
+func (engine *MemoryEngine) Scan(fn func(key string, value TypedValue) bool) error {
+	engine.keys.scan(fn)
+	return nil
+}
+
+// Snapshot copies every key, which costs memory in proportion to the
+// dataset until the snapshot is dropped.
+func (engine *MemoryEngine) Snapshot() (EngineSnapshot, error) {
+	snapshot := make(memorySnapshot, engine.keys.len())
+	engine.keys.scan(func(key string, value TypedValue) bool {
+		snapshot[key] = value
+		return true
+	})
+	return snapshot, nil
+}
+
+func (engine *MemoryEngine) Keys() ([]string, error) {
+	return engine.keys.appendKeys(make([]string, 0, engine.keys.len())), nil
+}
+
+func (engine *MemoryEngine) KeyCount() (int, error) {
+	return engine.keys.len(), nil
+}
+
+func (engine *MemoryEngine) SampleKeys(n int) ([]string, error) {
+	return engine.keys.sample(n), nil
+}
+
+func (engine *MemoryEngine) Close() error {
+	return nil
+}
+
+func (engine *MemoryEngine) SupportsConcurrentReads() bool {
+	return true
+}
+
+func (engine *MemoryEngine) Inspect(key string) (ObjectInfo, bool, error) {
+	info, ok := engine.keys.inspect("memory", key)
+	return info, ok, nil
+}
+
+func (engine *MemoryEngine) ListLen(key string) (int, int, error) {
+	return engine.keys.listLen(key)
+}
+
+func (engine *MemoryEngine) ListRange(key string, start int64, stop int64) ([]string, bool, error) {
+	return engine.keys.listRange(key, start, stop)
+}
+
+func (engine *MemoryEngine) ListOffset(key string) (uint64, error) {
+	return engine.keys.listOffset(key)
+}
+
+func (engine *MemoryEngine) PushList(key string, left bool, values []string, offset uint64) (int, error) {
+	return engine.keys.pushList(key, left, values, offset)
+}
+
+func (engine *MemoryEngine) PopList(key string, left bool, count int, offset uint64) ([]string, int, error) {
+	return engine.keys.popList(key, left, count, offset)
+}
@@ -0,0 +1,699 @@
+package kvstore
+
+import (
+	"blueis/internal/datatype"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func newTestEngines(t *testing.T) map[string]StorageEngine {
+	t.Helper()
+
+	disk, err := NewDiskEngine(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewDiskEngine returned error: %v", err)
+	}
+
+	return map[string]StorageEngine{
+		"memory":  NewMemoryEngine(),
+		"disk":    disk,
+		"tiered":  NewTieredEngine(1, NewMemoryEngine()),
+		"sharded": NewShardedEngine(4),
+	}
+}
+
+func TestStorageEngines_SetGetDelete(t *testing.T) {
+	for name, engine := range newTestEngines(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, ok, err := engine.Get("foo"); err != nil || ok {
+				t.Fatalf("Get(%q) on empty engine = (_, %v, %v), want (_, false, nil)", "foo", ok, err)
+			}
+
+			if err := engine.Set("foo", stringValue("bar")); err != nil {
+				t.Fatalf("Set(%q, %q) returned error: %v", "foo", "bar", err)
+			}
+			if err := engine.Set("foo", stringValue("baz")); err != nil {
+				t.Fatalf("Set(%q, %q) returned error: %v", "foo", "baz", err)
+			}
+
+			got, ok, err := engine.Get("foo")
+			if err != nil || !ok || got != stringValue("baz") {
+				t.Fatalf("Get(%q) = (%q, %v, %v), want (%q, true, nil)", "foo", got, ok, err, "baz")
+			}
+
+			deleted, ok, err := engine.Delete("foo")
+			if err != nil || !ok || deleted != stringValue("baz") {
+				t.Fatalf("Delete(%q) = (%q, %v, %v), want (%q, true, nil)", "foo", deleted, ok, err, "baz")
+			}
+
+			if _, ok, err := engine.Delete("foo"); err != nil || ok {
+				t.Fatalf("Delete(%q) on missing key = (_, %v, %v), want (_, false, nil)", "foo", ok, err)
+			}
+		})
+	}
+}
+
+func TestStorageEngines_Keys(t *testing.T) {
+	for name, engine := range newTestEngines(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, key := range []string{"a", "b", "c"} {
+				if err := engine.Set(key, stringValue("value")); err != nil {
+					t.Fatalf("Set(%q) returned error: %v", key, err)
+				}
+			}
+			if _, _, err := engine.Delete("b"); err != nil {
+				t.Fatalf("Delete returned error: %v", err)
+			}
+
+			keys, err := engine.(KeyLister).Keys()
+			if err != nil {
+				t.Fatalf("Keys returned error: %v", err)
+			}
+			slices.Sort(keys)
+			if !slices.Equal(keys, []string{"a", "c"}) {
+				t.Fatalf("Keys = %q, want [a c]", keys)
+			}
+		})
+	}
+}
+
+func TestStorageEngines_Scan(t *testing.T) {
+	for name, engine := range newTestEngines(t) {
+		t.Run(name, func(t *testing.T) {
+			want := map[string]string{"a": "1", "b": "2", "c": "3"}
+			for key, value := range want {
+				if err := engine.Set(key, stringValue(value)); err != nil {
+					t.Fatalf("Set(%q) returned error: %v", key, err)
+				}
+			}
+
+			got := make(map[string]string)
+			err := engine.Scan(func(key string, value TypedValue) bool {
+				if value.Type == TypeString {
+					got[key] = value.Data
+				}
+				return true
+			})
+			if err != nil || !maps.Equal(got, want) {
+				t.Fatalf("Scan = (%v, %v), want %v", got, err, want)
+			}
+
+			calls := 0
+			if err := engine.Scan(func(string, TypedValue) bool {
+				calls++
+				return false
+			}); err != nil || calls != 1 {
+				t.Fatalf("Scan stopped by fn made %d calls with error %v, want 1 call", calls, err)
+			}
+		})
+	}
+}
+
+// scanOnlyEngine is an engine with none of the optional interfaces, as a
+// third-party engine might be.
+type scanOnlyEngine struct {
+	engine *MemoryEngine
+}
+
+func (engine scanOnlyEngine) Get(key string) (TypedValue, bool, error) {
+	return engine.engine.Get(key)
+}
+
+func (engine scanOnlyEngine) Set(key string, value TypedValue) error {
+	return engine.engine.Set(key, value)
+}
+
+func (engine scanOnlyEngine) Delete(key string) (TypedValue, bool, error) {
+	return engine.engine.Delete(key)
+}
+
+func (engine scanOnlyEngine) Scan(fn func(key string, value TypedValue) bool) error {
+	return engine.engine.Scan(fn)
+}
+
+func (engine scanOnlyEngine) Snapshot() (EngineSnapshot, error) {
+	return engine.engine.Snapshot()
+}
+
+func (engine scanOnlyEngine) Close() error {
+	return nil
+}
+
+func TestKeyValueService_SnapshotsEnginesThatOnlyScan(t *testing.T) {
+	instance = nil
+	once = sync.Once{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	store := GetKeyValueServiceWithEngine(ctx, cancel, scanOnlyEngine{NewMemoryEngine()})
+	for _, key := range []string{"a", "b"} {
+		if _, err := store.Set(key, "value"); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+	}
+
+	snapshot, err := store.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot returned error: %v", err)
+	}
+	defer snapshot.Close()
+	if keys := snapshotKeys(t, snapshot); !slices.Equal(keys, []string{"a", "b"}) {
+		t.Fatalf("snapshot keys = %q, want [a b]", keys)
+	}
+}
+
+func TestStorageEngines_SampleKeys(t *testing.T) {
+	for name, engine := range newTestEngines(t) {
+		t.Run(name, func(t *testing.T) {
+			sampler := engine.(KeySampler)
+			if keys, err := sampler.SampleKeys(5); err != nil || len(keys) != 0 {
+				t.Fatalf("SampleKeys on empty engine = (%q, %v), want no keys", keys, err)
+			}
+
+			want := make(map[string]bool)
+			for i := range 10 {
+				key := fmt.Sprintf("k%d", i)
+				want[key] = true
+				if err := engine.Set(key, stringValue("value")); err != nil {
+					t.Fatalf("Set(%q) returned error: %v", key, err)
+				}
+			}
+
+			if count, err := sampler.KeyCount(); err != nil || count != 10 {
+				t.Fatalf("KeyCount = (%d, %v), want (10, nil)", count, err)
+			}
+			keys, err := sampler.SampleKeys(30)
+			if err != nil {
+				t.Fatalf("SampleKeys returned error: %v", err)
+			}
+			if len(keys) != 30 {
+				t.Fatalf("SampleKeys(30) returned %d keys", len(keys))
+			}
+			for _, key := range keys {
+				if !want[key] {
+					t.Fatalf("SampleKeys returned unknown key %q", key)
+				}
+			}
+		})
+	}
+}
+
+func TestStorageEngines_SnapshotIsPointInTime(t *testing.T) {
+	for name, engine := range newTestEngines(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, key := range []string{"kept", "changed", "deleted"} {
+				if err := engine.Set(key, stringValue("before")); err != nil {
+					t.Fatalf("Set(%q) returned error: %v", key, err)
+				}
+			}
+			if _, err := enginePushList(engine, "list", false, []string{"a"}, 0); err != nil {
+				t.Fatalf("PushList returned error: %v", err)
+			}
+
+			snapshot, err := engine.Snapshot()
+			if err != nil {
+				t.Fatalf("Snapshot returned error: %v", err)
+			}
+			if err := engine.Set("changed", stringValue("after")); err != nil {
+				t.Fatalf("Set returned error: %v", err)
+			}
+			if err := engine.Set("added", stringValue("after")); err != nil {
+				t.Fatalf("Set returned error: %v", err)
+			}
+			if _, _, err := engine.Delete("deleted"); err != nil {
+				t.Fatalf("Delete returned error: %v", err)
+			}
+			if _, err := enginePushList(engine, "list", false, []string{"b"}, 0); err != nil {
+				t.Fatalf("PushList returned error: %v", err)
+			}
+
+			want := datatype.NewList()
+			want.PushRight("a")
+			before := stringValue("before")
+			for key, value := range map[string]TypedValue{"kept": before, "changed": before, "deleted": before, "list": {TypeList, want.Encode()}} {
+				if got, ok, err := snapshot.Get(key); err != nil || !ok || got != value {
+					t.Fatalf("snapshot Get(%q) = (%q, %v, %v), want %q", key, got, ok, err, value)
+				}
+			}
+			if _, ok, err := snapshot.Get("added"); err != nil || ok {
+				t.Fatalf("snapshot Get of a key added afterwards = (%v, %v), want missing", ok, err)
+			}
+			var keys []string
+			if err := snapshot.Scan(func(key string, _ TypedValue) bool {
+				keys = append(keys, key)
+				return true
+			}); err != nil {
+				t.Fatalf("snapshot Scan returned error: %v", err)
+			}
+			slices.Sort(keys)
+			if fmt.Sprint(keys) != "[changed deleted kept list]" {
+				t.Fatalf("snapshot Scan saw %v, want [changed deleted kept list]", keys)
+			}
+			if err := snapshot.Close(); err != nil {
+				t.Fatalf("snapshot Close returned error: %v", err)
+			}
+
+			if got, _, err := engine.Get("changed"); err != nil || got != stringValue("after") {
+				t.Fatalf("Get after the snapshot = (%q, %v), want %q", got, err, "after")
+			}
+		})
+	}
+}
+
+func TestStorageEngines_Lists(t *testing.T) {
+	engines := newTestEngines(t)
+	engines["scan-only"] = scanOnlyEngine{NewMemoryEngine()}
+	for name, engine := range engines {
+		t.Run(name, func(t *testing.T) {
+			if length, err := enginePushList(engine, "list", false, []string{"a", "b", "c"}, 0); err != nil || length != 3 {
+				t.Fatalf("pushing right = (%d, %v), want 3", length, err)
+			}
+			if length, err := enginePushList(engine, "list", true, []string{"y", "z"}, 0); err != nil || length != 5 {
+				t.Fatalf("pushing left = (%d, %v), want 5", length, err)
+			}
+			if values, ok, err := engineListRange(engine, "list", 0, -1); err != nil || !ok || fmt.Sprint(values) != "[z y a b c]" {
+				t.Fatalf("range = (%v, %v, %v), want [z y a b c]", values, ok, err)
+			}
+			if values, _, err := engineListRange(engine, "list", -2, 10); err != nil || fmt.Sprint(values) != "[b c]" {
+				t.Fatalf("range -2 10 = (%v, %v), want [b c]", values, err)
+			}
+
+			// Get sees the list as its encoding, and the length and size
+			// match it
+			value, ok, err := engine.Get("list")
+			if err != nil || !ok || value.Type != TypeList {
+				t.Fatalf("Get = (%v, %v, %v), want the list", value.Type, ok, err)
+			}
+			encoded := value.Data
+			list, err := datatype.DecodeList(encoded)
+			if err != nil || fmt.Sprint(list.Range(0, -1)) != "[z y a b c]" {
+				t.Fatalf("Get decoded to (%v, %v), want [z y a b c]", list, err)
+			}
+			length, size, err := engineListLen(engine, "list")
+			if err != nil || length != 5 || datatype.EncodedListLen(length, size) != len(encoded) {
+				t.Fatalf("length = (%d, %d, %v), want 5 values encoded in %d bytes", length, size, err, len(encoded))
+			}
+
+			if values, length, err := enginePopList(engine, "list", true, 2, 0); err != nil || length != 3 || fmt.Sprint(values) != "[z y]" {
+				t.Fatalf("popping left = (%v, %d, %v), want [z y] leaving 3", values, length, err)
+			}
+			if values, length, err := enginePopList(engine, "list", false, 5, 0); err != nil || length != 0 || fmt.Sprint(values) != "[c b a]" {
+				t.Fatalf("popping right = (%v, %d, %v), want [c b a] leaving 0", values, length, err)
+			}
+			if _, ok, err := engine.Get("list"); err != nil || ok {
+				t.Fatalf("Get of an emptied list = (_, %v, %v), want it removed", ok, err)
+			}
+
+			// Each push or pop records its offset with the list, which
+			// engines without lists of their own do not keep
+			want := uint64(7)
+			if _, ok := engine.(ListEngine); !ok {
+				want = 0
+			}
+			if _, err := enginePushList(engine, "counted", false, []string{"a", "b"}, 6); err != nil {
+				t.Fatalf("pushing with an offset returned error: %v", err)
+			}
+			if _, _, err := enginePopList(engine, "counted", true, 1, 7); err != nil {
+				t.Fatalf("popping with an offset returned error: %v", err)
+			}
+			if offset, err := engineListOffset(engine, "counted"); err != nil || offset != want {
+				t.Fatalf("offset = (%d, %v), want %d", offset, err, want)
+			}
+			if err := engine.Set("counted", value); err != nil {
+				t.Fatalf("Set returned error: %v", err)
+			}
+			if offset, err := engineListOffset(engine, "counted"); err != nil || offset != 0 {
+				t.Fatalf("offset of a list set whole = (%d, %v), want 0", offset, err)
+			}
+
+			// A list set whole is a list like any other
+			if err := engine.Set("set", value); err != nil {
+				t.Fatalf("Set returned error: %v", err)
+			}
+			if values, length, err := enginePopList(engine, "set", false, 1, 0); err != nil || length != 4 || fmt.Sprint(values) != "[c]" {
+				t.Fatalf("popping a list set whole = (%v, %d, %v), want [c] leaving 4", values, length, err)
+			}
+
+			if err := engine.Set("plain", stringValue("value")); err != nil {
+				t.Fatalf("Set returned error: %v", err)
+			}
+			if _, err := enginePushList(engine, "plain", false, []string{"a"}, 0); !errors.Is(err, ErrWrongType) {
+				t.Fatalf("pushing to a plain value returned %v, want ErrWrongType", err)
+			}
+			if _, _, err := engineListLen(engine, "plain"); !errors.Is(err, ErrWrongType) {
+				t.Fatalf("length of a plain value returned %v, want ErrWrongType", err)
+			}
+
+			// A string holding a list's encoding is still a string
+			if err := engine.Set("lookalike", stringValue(encoded)); err != nil {
+				t.Fatalf("Set returned error: %v", err)
+			}
+			if _, err := enginePushList(engine, "lookalike", false, []string{"a"}, 0); !errors.Is(err, ErrWrongType) {
+				t.Fatalf("pushing to a string holding a list encoding returned %v, want ErrWrongType", err)
+			}
+			if got, _, err := engine.Get("lookalike"); err != nil || got != stringValue(encoded) {
+				t.Fatalf("Get of a string holding a list encoding = (%v, %v), want the string", got, err)
+			}
+		})
+	}
+}
+
+func TestDiskEngine_PersistsAcrossInstances(t *testing.T) {
+	dir := t.TempDir()
+
+	first, err := NewDiskEngine(dir)
+	if err != nil {
+		t.Fatalf("NewDiskEngine returned error: %v", err)
+	}
+	if err := first.Set("key/with/slashes", stringValue("value")); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := first.PushList("list", false, []string{"a", "b"}, 3); err != nil {
+		t.Fatalf("PushList returned error: %v", err)
+	}
+	list := datatype.NewList()
+	list.PushRight("a")
+	typed := map[string]TypedValue{
+		"hash":      {TypeHash, datatype.NewHash().Encode()},
+		"lookalike": stringValue(list.Encode()),
+	}
+	for key, value := range typed {
+		if err := first.Set(key, value); err != nil {
+			t.Fatalf("Set(%q) returned error: %v", key, err)
+		}
+	}
+	if err := first.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	second, err := NewDiskEngine(dir)
+	if err != nil {
+		t.Fatalf("NewDiskEngine returned error: %v", err)
+	}
+	got, ok, err := second.Get("key/with/slashes")
+	if err != nil || !ok || got != stringValue("value") {
+		t.Fatalf("Get after reopen = (%q, %v, %v), want (%q, true, nil)", got, ok, err, "value")
+	}
+	if values, ok, err := second.ListRange("list", 0, -1); err != nil || !ok || fmt.Sprint(values) != "[a b]" {
+		t.Fatalf("ListRange after reopen = (%v, %v, %v), want [a b]", values, ok, err)
+	}
+	if offset, err := second.ListOffset("list"); err != nil || offset != 3 {
+		t.Fatalf("ListOffset after reopen = (%d, %v), want 3", offset, err)
+	}
+	// Each value keeps its type, so a string holding a list's encoding is
+	// still a string
+	for key, value := range typed {
+		if got, ok, err := second.Get(key); err != nil || !ok || got != value {
+			t.Fatalf("Get(%q) after reopen = (%v, %v, %v), want (%v, true, nil)", key, got, ok, err, value)
+		}
+	}
+}
+
+func TestDiskEngine_KeepsDeadlinesWithTheirKeys(t *testing.T) {
+	dir := t.TempDir()
+
+	first, err := NewDiskEngine(dir)
+	if err != nil {
+		t.Fatalf("NewDiskEngine returned error: %v", err)
+	}
+	if err := first.SetExpiring("session", stringValue("alice"), 100); err != nil {
+		t.Fatalf("SetExpiring returned error: %v", err)
+	}
+	if err := first.Set("session", stringValue("bob")); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if err := first.SetExpiring("cleared", stringValue("value"), 200); err != nil {
+		t.Fatalf("SetExpiring returned error: %v", err)
+	}
+	if err := first.SetDeadline("cleared", 0); err != nil {
+		t.Fatalf("SetDeadline returned error: %v", err)
+	}
+	if err := first.SetExpiring("deleted", stringValue("value"), 300); err != nil {
+		t.Fatalf("SetExpiring returned error: %v", err)
+	}
+	if _, _, err := first.Delete("deleted"); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+	if _, err := first.PushList("queue", false, []string{"a"}, 0); err != nil {
+		t.Fatalf("PushList returned error: %v", err)
+	}
+	if err := first.SetDeadline("queue", 400); err != nil {
+		t.Fatalf("SetDeadline returned error: %v", err)
+	}
+	if _, _, err := first.PopList("queue", true, 1, 0); err != nil {
+		t.Fatalf("PopList returned error: %v", err)
+	}
+	// A missing key gets no deadline
+	if err := first.SetDeadline("missing", 500); err != nil {
+		t.Fatalf("SetDeadline returned error: %v", err)
+	}
+	if err := first.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	second, err := NewDiskEngine(dir)
+	if err != nil {
+		t.Fatalf("NewDiskEngine returned error: %v", err)
+	}
+	defer second.Close()
+	deadlines := map[string]int64{}
+	err = second.Deadlines(func(key string, deadline int64) bool {
+		deadlines[key] = deadline
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Deadlines returned error: %v", err)
+	}
+	if fmt.Sprint(deadlines) != "map[session:100]" {
+		t.Fatalf("Deadlines after reopen = %v, want map[session:100]", deadlines)
+	}
+}
+
+func TestTieredEngine_DemotesAndPromotes(t *testing.T) {
+	cold := NewMemoryEngine()
+	engine := NewTieredEngine(2, cold)
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := engine.Set(key, stringValue("v-"+key)); err != nil {
+			t.Fatalf("Set(%q) returned error: %v", key, err)
+		}
+	}
+
+	// "a" is least recently used and must have been demoted
+	if _, ok := engine.hot["a"]; ok {
+		t.Fatalf("expected %q to be demoted out of the hot tier", "a")
+	}
+
+	got, ok, err := engine.Get("a")
+	if err != nil || !ok || got != stringValue("v-a") {
+		t.Fatalf("Get(%q) = (%q, %v, %v), want (%q, true, nil)", "a", got, ok, err, "v-a")
+	}
+	if _, ok, _ := cold.Get("a"); !ok {
+		t.Fatalf("expected promoting %q to keep its cold copy", "a")
+	}
+
+	if _, _, err := engine.Get("c"); err != nil {
+		t.Fatalf("Get(%q) returned error: %v", "c", err)
+	}
+	if _, _, err := engine.Get("missing"); err != nil {
+		t.Fatalf("Get(%q) returned error: %v", "missing", err)
+	}
+
+	stats := engine.Stats()
+	want := TierStats{HotKeys: 2, HotHits: 1, ColdHits: 1, Misses: 1, Promotions: 1, Demotions: 2}
+	if stats != want {
+		t.Fatalf("Stats() = %+v, want %+v", stats, want)
+	}
+}
+
+func TestTieredEngine_WritesThrough(t *testing.T) {
+	cold := NewMemoryEngine()
+	engine := NewTieredEngine(10, cold)
+
+	if err := engine.Set("foo", stringValue("bar")); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if got, ok, _ := cold.Get("foo"); !ok || got != stringValue("bar") {
+		t.Fatalf("cold.Get(%q) after Set = (%q, %v), want (%q, true)", "foo", got, ok, "bar")
+	}
+	if _, _, err := engine.Get("foo"); err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+
+	if _, ok, err := engine.Delete("foo"); err != nil || !ok {
+		t.Fatalf("Delete = (%v, %v), want (true, nil)", ok, err)
+	}
+	if _, ok, _ := cold.Get("foo"); ok {
+		t.Fatalf("expected Delete to remove %q from the cold tier", "foo")
+	}
+	if _, ok, _ := engine.Get("foo"); ok {
+		t.Fatalf("expected Delete to remove %q from the hot tier", "foo")
+	}
+	if stats := engine.Stats(); stats.HotKeys != 0 {
+		t.Fatalf("Stats().HotKeys = %d, want 0", stats.HotKeys)
+	}
+}
+
+func TestKeyValueService_WithDiskEngine(t *testing.T) {
+	instance = nil
+	once = sync.Once{}
+
+	engine, err := NewDiskEngine(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewDiskEngine returned error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	store := GetKeyValueServiceWithEngine(ctx, cancel, engine)
+
+	if _, err := store.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	got, err := store.Get("foo")
+	if err != nil || got == nil || *got != "bar" {
+		t.Fatalf("Get(%q) = (%v, %v), want %q", "foo", deref(got), err, "bar")
+	}
+}
+
+func TestKeyValueService_DirectExecutionWithShardedEngine(t *testing.T) {
+	store := newTestKeyValueServiceWithConfig(t, Config{Execution: DirectExecution})
+
+	const numGoroutines = 20
+	const keysPerGoroutine = 50
+
+	var wg sync.WaitGroup
+	for i := range numGoroutines {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for j := range keysPerGoroutine {
+				key := fmt.Sprintf("k-%d-%d", id, j)
+				if _, err := store.Set(key, key); err != nil {
+					t.Errorf("Set(%q) returned error: %v", key, err)
+					return
+				}
+				if got, err := store.Get(key); err != nil || got == nil || *got != key {
+					t.Errorf("Get(%q) = (%v, %v), want %q", key, deref(got), err, key)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if got := store.CommandStats()["PUT"].Count; got != numGoroutines*keysPerGoroutine {
+		t.Fatalf("PUT count = %d, want %d", got, numGoroutines*keysPerGoroutine)
+	}
+}
+
+func TestKeyValueService_ConcurrentReadsBypassStoreLoop(t *testing.T) {
+	store := newTestKeyValueServiceWithConfig(t, Config{ConcurrentReads: true})
+
+	if _, err := store.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for j := range 50 {
+				if id%2 == 0 {
+					if _, err := store.Set(fmt.Sprintf("k-%d-%d", id, j), "v"); err != nil {
+						t.Errorf("Set returned error: %v", err)
+						return
+					}
+				} else if got, err := store.Get("foo"); err != nil || got == nil || *got != "bar" {
+					t.Errorf("Get(%q) = (%v, %v), want %q", "foo", deref(got), err, "bar")
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Only the writes went through the store loop
+	if got := store.BatchStats().Commands; got != 1+10*50 {
+		t.Fatalf("BatchStats().Commands = %d, want %d", got, 1+10*50)
+	}
+	if got := store.CommandStats()["GET"].Count; got != 10*50 {
+		t.Fatalf("GET count = %d, want %d", got, 10*50)
+	}
+}
+
+func TestKeyValueService_ConcurrentReadsIgnoredForTieredEngine(t *testing.T) {
+	store := newTestKeyValueServiceWithConfig(t, Config{
+		Engine:          NewTieredEngine(10, NewMemoryEngine()),
+		ConcurrentReads: true,
+	})
+
+	if _, err := store.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := store.Get("foo"); err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+
+	if got := store.BatchStats().Commands; got != 2 {
+		t.Fatalf("BatchStats().Commands = %d, want reads to go through the store loop", got)
+	}
+}
+
+// bytesAllocatedPerRun reports the average heap bytes allocated by op
+// across all goroutines, including the store loop.
+func bytesAllocatedPerRun(runs int, op func()) float64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	for range runs {
+		op()
+	}
+	runtime.ReadMemStats(&after)
+	return float64(after.TotalAlloc-before.TotalAlloc) / float64(runs)
+}
+
+func TestGet_DoesNotCopyLargeValues(t *testing.T) {
+	const valueSize = 64 * 1024
+	value := strings.Repeat("x", valueSize)
+
+	disk, err := NewDiskEngine(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewDiskEngine returned error: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		config Config
+		// maxBytes is the allowed allocation per Get
+		maxBytes float64
+	}{
+		{"memory", Config{}, 1024},
+		{"concurrent-reads", Config{ConcurrentReads: true}, 1024},
+		{"direct-sharded", Config{Execution: DirectExecution}, 1024},
+		// The disk engine has to read the value once, but must not copy it again
+		{"disk", Config{Engine: disk}, 1.5 * valueSize},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestKeyValueServiceWithConfig(t, tt.config)
+			if _, err := store.Set("big", value); err != nil {
+				t.Fatalf("Set returned error: %v", err)
+			}
+
+			got := bytesAllocatedPerRun(50, func() { _, _ = store.Get("big") })
+			if got > tt.maxBytes {
+				t.Fatalf("Get of a %d byte value allocated %.0f bytes per call, want at most %.0f", valueSize, got, tt.maxBytes)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrPanicked is returned, wrapped with the panic's value, by a command
+	// that panicked. It may have applied part of its change.
+	ErrPanicked = errors.New("command panicked")
+	// ErrStoreRestarted is returned to commands in the batch the store loop
+	// was processing when it failed. None of them was run past the failure,
+	// so they can be retried.
+	ErrStoreRestarted = errors.New("store loop restarted, retry")
+)
+
+// StoreHealth reports whether the store loop is serving commands and the
+// panics it has survived.
+type StoreHealth struct {
+	// Running is false once the store has been closed
+	Running bool
+	// Panics counts commands that panicked. Each failed on its own, with
+	// ErrPanicked, and the store went on serving
+	Panics uint64
+	// Restarts counts the times the store loop failed outside any command
+	// and was started again
+	Restarts    uint64
+	LastPanic   string
+	LastPanicAt time.Time
+}
+
+// healthRecord keeps the counts behind StoreHealth.
+type healthRecord struct {
+	panics   atomic.Uint64
+	restarts atomic.Uint64
+
+	mu          sync.Mutex
+	lastPanic   string
+	lastPanicAt time.Time
+}
+
+func (record *healthRecord) recordPanic(value any, at time.Time) {
+	record.mu.Lock()
+	defer record.mu.Unlock()
+	record.lastPanic = fmt.Sprint(value)
+	record.lastPanicAt = at
+}
+
+// commandPanicked records a panic raised by command, logging it with the
+// stack it was raised from, and returns the error the command fails with.
+func (kvStore *KeyValueStore) commandPanicked(command KeyValueCommand, value any) error {
+	kvStore.health.panics.Add(1)
+	kvStore.health.recordPanic(value, time.Now())
+	kvStore.logger.Printf("%s %s panicked: %v\n%s", GetCommandTypeString(command.commandType), command.key, value, debug.Stack())
+	return fmt.Errorf("%w: %v", ErrPanicked, value)
+}
+
+// supervise runs the store loop until ctx is done. Commands recover from
+// their own panics, so the loop only fails on a fault of its own; when it
+// does, the batch it was processing is failed with ErrStoreRestarted and
+// the loop is started again. The engine and the store's tables outlive the
+// loop, so the restarted loop carries on from the state they hold.
+func (kvStore *KeyValueStore) supervise(input chan KeyValueCommand, ctx context.Context) {
+	for !kvStore.serve(input, ctx) {
+		kvStore.health.restarts.Add(1)
+	}
+}
+
+// serve runs the store loop, returning true once ctx is done and every
+// queued command has been processed, or false if the loop panicked.
+func (kvStore *KeyValueStore) serve(input chan KeyValueCommand, ctx context.Context) (done bool) {
+	batch := make([]KeyValueCommand, 0, kvStore.maxBatchSize)
+	outputs := make([]KeyValueOutput, 0, kvStore.maxBatchSize)
+	defer func() {
+		if value := recover(); value != nil {
+			kvStore.health.recordPanic(value, time.Now())
+			kvStore.logger.Printf("Key value store loop panicked, restarting it: %v\n%s", value, debug.Stack())
+			for _, command := range batch {
+				command.output <- KeyValueOutput{false, nil, ErrStoreRestarted, 0}
+			}
+			done = false
+		}
+	}()
+
+	ticker, sweeps := kvStore.sweepTicker()
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+	gc := time.NewTicker(tombstoneGCInterval)
+	defer gc.Stop()
+	for {
+		select {
+		case msg := <-input:
+			batch = append(batch[:0], msg)
+			batch = drainInput(input, batch, kvStore.maxBatchSize)
+			outputs = kvStore.ProcessBatch(batch, outputs[:0])
+			batch = batch[:0]
+		case <-sweeps:
+			kvStore.sweepExpired(*kvStore.sweep.config.Load())
+		case <-gc.C:
+			kvStore.tombstones.purge(kvStore.currentTime().UnixNano())
+		case <-kvStore.sweep.changed:
+			if ticker != nil {
+				ticker.Stop()
+			}
+			ticker, sweeps = kvStore.sweepTicker()
+		case <-ctx.Done():
+			kvStore.logger.Println("Key value store shutting down")
+			for {
+				batch = drainInput(input, batch[:0], kvStore.maxBatchSize)
+				if len(batch) == 0 {
+					return true
+				}
+				outputs = kvStore.ProcessBatch(batch, outputs[:0])
+			}
+		}
+	}
+}
+
+// Health reports whether the store is serving commands and the panics it
+// has recovered from.
+func (kvService *KeyValueService) Health() StoreHealth {
+	running := kvService.CheckActive() == nil
+	select {
+	case <-kvService.store.stopped:
+		running = false
+	default:
+	}
+
+	record := &kvService.store.health
+	record.mu.Lock()
+	defer record.mu.Unlock()
+	return StoreHealth{
+		Running:     running,
+		Panics:      record.panics.Load(),
+		Restarts:    record.restarts.Load(),
+		LastPanic:   record.lastPanic,
+		LastPanicAt: record.lastPanicAt,
+	}
+}
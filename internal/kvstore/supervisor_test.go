@@ -0,0 +1,57 @@
+package kvstore
+
+import (
+	"errors"
+	"io"
+	"log"
+	"testing"
+)
+
+func panicOn(key string) BeforeCommandHook {
+	return func(command *Command) error {
+		if command.Key == key {
+			panic("boom")
+		}
+		return nil
+	}
+}
+
+func TestProcess_PanickingCommandFailsAlone(t *testing.T) {
+	for name, execution := range map[string]ExecutionMode{"actor": ActorExecution, "direct": DirectExecution} {
+		t.Run(name, func(t *testing.T) {
+			store := newTestKeyValueServiceWithConfig(t, Config{Execution: execution, Logger: log.New(io.Discard, "", 0)})
+			store.AddBeforeCommandHook(panicOn("bad"))
+
+			if _, err := store.Set("bad", "value"); !errors.Is(err, ErrPanicked) {
+				t.Fatalf("Set of a panicking command returned %v, want ErrPanicked", err)
+			}
+			// The store goes on serving other commands
+			if _, err := store.Set("good", "value"); err != nil {
+				t.Fatalf("Set after a panic returned error: %v", err)
+			}
+			if got, err := store.Get("good"); err != nil || deref(got) != "value" {
+				t.Fatalf("Get after a panic = (%v, %v), want %q", deref(got), err, "value")
+			}
+
+			health := store.Health()
+			if !health.Running || health.Panics != 1 || health.LastPanic != "boom" || health.LastPanicAt.IsZero() {
+				t.Fatalf("Health = %+v, want a running store that recovered from one panic", health)
+			}
+			if got := store.CommandStats()["PUT"]; got.Count != 2 || got.Errors != 1 {
+				t.Fatalf("CommandStats()[PUT] = {Count: %d, Errors: %d}, want {2, 1}", got.Count, got.Errors)
+			}
+		})
+	}
+}
+
+func TestHealth_NotRunningOnceClosed(t *testing.T) {
+	store := newTestKeyValueService(t)
+	if !store.Health().Running {
+		t.Fatalf("Health reports a new store as not running")
+	}
+
+	store.Close()
+	if store.Health().Running {
+		t.Fatalf("Health reports a closed store as running")
+	}
+}
@@ -0,0 +1,265 @@
+package kvstore
+
+import (
+	"container/list"
+	"fmt"
+	"sync/atomic"
+)
+
+// TieredEngine keeps up to hotCapacity recently used keys in memory in front
+// of a cold engine (usually a DiskEngine). Writes go through to the cold
+// engine before they return, so it always holds every key and the hot tier
+// is only a cache: reading a cold key promotes a copy into memory, and
+// demoting the least recently used key just drops it from memory.
+type TieredEngine struct {
+	hotCapacity int
+	hot         map[string]*list.Element
+	recency     *list.List
+	cold        StorageEngine
+	stats       tierCounters
+}
+
+type tieredEntry struct {
+	key   string
+	value TypedValue
+}
+
+type tierCounters struct {
+	hotKeys    atomic.Int64
+	hotHits    atomic.Uint64
+	coldHits   atomic.Uint64
+	misses     atomic.Uint64
+	promotions atomic.Uint64
+	demotions  atomic.Uint64
+}
+
+type TierStats struct {
+	HotKeys    int
+	HotHits    uint64
+	ColdHits   uint64
+	Misses     uint64
+	Promotions uint64
+	Demotions  uint64
+}
+
+func NewTieredEngine(hotCapacity int, cold StorageEngine) *TieredEngine {
+	if hotCapacity < 1 {
+		hotCapacity = 1
+	}
+	return &TieredEngine{
+		hotCapacity: hotCapacity,
+		hot:         make(map[string]*list.Element),
+		recency:     list.New(),
+		cold:        cold,
+	}
+}
+
+func (engine *TieredEngine) Get(key string) (TypedValue, bool, error) {
+	if elem, ok := engine.hot[key]; ok {
+		engine.stats.hotHits.Add(1)
+		engine.recency.MoveToFront(elem)
+		return elem.Value.(*tieredEntry).value, true, nil
+	}
+
+	value, ok, err := engine.cold.Get(key)
+	if err != nil {
+		return TypedValue{}, false, err
+	}
+	if !ok {
+		engine.stats.misses.Add(1)
+		return TypedValue{}, false, nil
+	}
+
+	engine.stats.coldHits.Add(1)
+	engine.stats.promotions.Add(1)
+	engine.insertHot(key, value)
+	return value, true, nil
+}
+
+// Set writes value to the cold engine first, so a failed write leaves the
+// hot tier holding what the cold engine does.
+func (engine *TieredEngine) Set(key string, value TypedValue) error {
+	if err := engine.cold.Set(key, value); err != nil {
+		return err
+	}
+	engine.setHot(key, value)
+	return nil
+}
+
+// SetExpiring, SetDeadline and Deadlines keep deadlines in the cold
+// engine when it can, and otherwise do without, as the store keeps
+// deadlines in memory regardless.
+func (engine *TieredEngine) SetExpiring(key string, value TypedValue, deadline int64) error {
+	cold, ok := engine.cold.(DeadlineEngine)
+	if !ok {
+		return engine.Set(key, value)
+	}
+	if err := cold.SetExpiring(key, value, deadline); err != nil {
+		return err
+	}
+	engine.setHot(key, value)
+	return nil
+}
+
+func (engine *TieredEngine) SetDeadline(key string, deadline int64) error {
+	if cold, ok := engine.cold.(DeadlineEngine); ok {
+		return cold.SetDeadline(key, deadline)
+	}
+	return nil
+}
+
+func (engine *TieredEngine) Deadlines(fn func(key string, deadline int64) bool) error {
+	if cold, ok := engine.cold.(DeadlineEngine); ok {
+		return cold.Deadlines(fn)
+	}
+	return nil
+}
+
+func (engine *TieredEngine) Delete(key string) (TypedValue, bool, error) {
+	value, ok, err := engine.cold.Delete(key)
+	if err != nil {
+		return TypedValue{}, false, err
+	}
+	engine.dropHot(key)
+	return value, ok, nil
+}
+
+// Inspect reports which tier holds the key without promoting it or
+// changing its recency.
+func (engine *TieredEngine) Inspect(key string) (ObjectInfo, bool, error) {
+	if elem, ok := engine.hot[key]; ok {
+		return inMemoryObjectInfo("tiered-hot", key, elem.Value.(*tieredEntry).value.Data), true, nil
+	}
+	info, ok, err := inspect(engine.cold, key)
+	if err != nil || !ok {
+		return ObjectInfo{}, false, err
+	}
+	info.Encoding = "tiered-cold"
+	return info, true, nil
+}
+
+// Scan, Keys, KeyCount and SampleKeys read the cold engine, which holds
+// every key, without promoting anything.
+func (engine *TieredEngine) Scan(fn func(key string, value TypedValue) bool) error {
+	return engine.cold.Scan(fn)
+}
+
+// Snapshot is the cold engine's, since it holds every key.
+func (engine *TieredEngine) Snapshot() (EngineSnapshot, error) {
+	return engine.cold.Snapshot()
+}
+
+func (engine *TieredEngine) Keys() ([]string, error) {
+	return listKeys(engine.cold)
+}
+
+func (engine *TieredEngine) KeyCount() (int, error) {
+	sampler, ok := engine.cold.(KeySampler)
+	if !ok {
+		return 0, fmt.Errorf("cold storage engine cannot sample keys")
+	}
+	return sampler.KeyCount()
+}
+
+func (engine *TieredEngine) SampleKeys(n int) ([]string, error) {
+	sampler, ok := engine.cold.(KeySampler)
+	if !ok {
+		return nil, fmt.Errorf("cold storage engine cannot sample keys")
+	}
+	return sampler.SampleKeys(n)
+}
+
+// ListLen, ListRange and ListOffset read lists from the cold engine
+// without promoting them, and PushList and PopList change them there and drop any copy from
+// the hot tier, so a list is never rewritten whole just to keep it hot.
+func (engine *TieredEngine) ListLen(key string) (int, int, error) {
+	return engineListLen(engine.cold, key)
+}
+
+func (engine *TieredEngine) ListRange(key string, start int64, stop int64) ([]string, bool, error) {
+	return engineListRange(engine.cold, key, start, stop)
+}
+
+func (engine *TieredEngine) ListOffset(key string) (uint64, error) {
+	return engineListOffset(engine.cold, key)
+}
+
+func (engine *TieredEngine) PushList(key string, left bool, values []string, offset uint64) (int, error) {
+	engine.dropHot(key)
+	return enginePushList(engine.cold, key, left, values, offset)
+}
+
+func (engine *TieredEngine) PopList(key string, left bool, count int, offset uint64) ([]string, int, error) {
+	engine.dropHot(key)
+	return enginePopList(engine.cold, key, left, count, offset)
+}
+
+func (engine *TieredEngine) SupportsConcurrentReads() bool {
+	return false
+}
+
+func (engine *TieredEngine) Close() error {
+	return engine.cold.Close()
+}
+
+// Stats is safe to call from any goroutine.
+func (engine *TieredEngine) Stats() TierStats {
+	return TierStats{
+		HotKeys:    int(engine.stats.hotKeys.Load()),
+		HotHits:    engine.stats.hotHits.Load(),
+		ColdHits:   engine.stats.coldHits.Load(),
+		Misses:     engine.stats.misses.Load(),
+		Promotions: engine.stats.promotions.Load(),
+		Demotions:  engine.stats.demotions.Load(),
+	}
+}
+
+// TierStats returns the hit counts of the service's TieredEngine, or false
+// if it uses another engine.
+func (kvService *KeyValueService) TierStats() (TierStats, bool) {
+	engine, ok := kvService.store.engine.(*TieredEngine)
+	if !ok {
+		return TierStats{}, false
+	}
+	return engine.Stats(), true
+}
+
+// HotHitRate is the share of reads served from memory.
+func (stats TierStats) HotHitRate() float64 {
+	total := stats.HotHits + stats.ColdHits + stats.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(stats.HotHits) / float64(total)
+}
+
+// setHot updates the hot copy of a key just written, or promotes it.
+func (engine *TieredEngine) setHot(key string, value TypedValue) {
+	if elem, ok := engine.hot[key]; ok {
+		elem.Value.(*tieredEntry).value = value
+		engine.recency.MoveToFront(elem)
+		return
+	}
+	engine.insertHot(key, value)
+}
+
+func (engine *TieredEngine) insertHot(key string, value TypedValue) {
+	engine.hot[key] = engine.recency.PushFront(&tieredEntry{key, value})
+	engine.stats.hotKeys.Add(1)
+	for engine.recency.Len() > engine.hotCapacity {
+		engine.removeHot(engine.recency.Back())
+		engine.stats.demotions.Add(1)
+	}
+}
+
+func (engine *TieredEngine) removeHot(elem *list.Element) {
+	engine.recency.Remove(elem)
+	delete(engine.hot, elem.Value.(*tieredEntry).key)
+	engine.stats.hotKeys.Add(-1)
+}
+
+func (engine *TieredEngine) dropHot(key string) {
+	if elem, ok := engine.hot[key]; ok {
+		engine.removeHot(elem)
+	}
+}
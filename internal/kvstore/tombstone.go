@@ -0,0 +1,161 @@
+package kvstore
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tombstoneGCInterval is how often the store loop purges tombstones past
+// their grace period.
+const tombstoneGCInterval = time.Second
+
+// TombstoneStats is what the tombstone table holds.
+type TombstoneStats struct {
+	Grace time.Duration
+	// Tombstones is how many deleted keys are remembered, and Purged how
+	// many tombstones have been dropped after their grace period
+	Tombstones int
+	Purged     uint64
+}
+
+// tombstoneTable remembers the keys deleted within the grace period, in
+// Unix nanoseconds, so a replica syncing from scratch learns of them and
+// drops its own copies rather than keeping keys the store no longer has.
+// Like expiryTable it keeps its own lock, and size lets stores without
+// tombstones skip it.
+type tombstoneTable struct {
+	grace  atomic.Int64
+	size   atomic.Int64
+	purged atomic.Uint64
+
+	mu      sync.Mutex
+	deleted map[string]int64
+	// order holds tombstones oldest first, for purging them. A key written
+	// or deleted again since leaves a stale entry, skipped when purged
+	order []tombstone
+}
+
+type tombstone struct {
+	key string
+	at  int64
+}
+
+// add records that key was deleted at now.
+func (table *tombstoneTable) add(key string, now int64) {
+	if table.grace.Load() <= 0 {
+		return
+	}
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	if table.deleted == nil {
+		table.deleted = make(map[string]int64)
+	}
+	if _, ok := table.deleted[key]; !ok {
+		table.size.Add(1)
+	}
+	table.deleted[key] = now
+	table.order = append(table.order, tombstone{key, now})
+}
+
+// clear forgets key's tombstone when it is written again.
+func (table *tombstoneTable) clear(key string) {
+	if table.size.Load() == 0 {
+		return
+	}
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	if _, ok := table.deleted[key]; ok {
+		delete(table.deleted, key)
+		table.size.Add(-1)
+	}
+}
+
+// lookup returns when key was deleted, if it has a tombstone.
+func (table *tombstoneTable) lookup(key string) (int64, bool) {
+	if table.size.Load() == 0 {
+		return 0, false
+	}
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	at, ok := table.deleted[key]
+	return at, ok
+}
+
+// keys lists the keys with tombstones.
+func (table *tombstoneTable) keys() []string {
+	if table.size.Load() == 0 {
+		return nil
+	}
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	keys := make([]string, 0, len(table.deleted))
+	for key := range table.deleted {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// purge drops the tombstones whose grace period has passed by now.
+func (table *tombstoneTable) purge(now int64) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	cutoff := now - table.grace.Load()
+	i := 0
+	for ; i < len(table.order) && table.order[i].at <= cutoff; i++ {
+		entry := table.order[i]
+		if at, ok := table.deleted[entry.key]; ok && at == entry.at {
+			delete(table.deleted, entry.key)
+			table.size.Add(-1)
+			table.purged.Add(1)
+		}
+	}
+	if i > 0 {
+		table.order = append(table.order[:0], table.order[i:]...)
+	}
+}
+
+// setGrace changes the grace period, dropping every tombstone when it is
+// disabled.
+func (table *tombstoneTable) setGrace(grace time.Duration) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	table.grace.Store(int64(max(grace, 0)))
+	if grace <= 0 {
+		table.deleted, table.order = nil, nil
+		table.size.Store(0)
+	}
+}
+
+// SetTombstoneGrace changes how long deleted keys are remembered, taking
+// effect from the next purge. Zero stops remembering them and drops every
+// tombstone held.
+func (kvService *KeyValueService) SetTombstoneGrace(grace time.Duration) {
+	kvService.store.tombstones.setGrace(grace)
+}
+
+// Tombstone returns when key was deleted, if that was within the tombstone
+// grace period and it has not been written since.
+func (kvService *KeyValueService) Tombstone(key string) (time.Time, bool) {
+	at, ok := kvService.store.tombstones.lookup(key)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, at), true
+}
+
+// TombstoneStats returns what the tombstone table holds.
+func (kvService *KeyValueService) TombstoneStats() TombstoneStats {
+	table := &kvService.store.tombstones
+	return TombstoneStats{
+		Grace:      time.Duration(table.grace.Load()),
+		Tombstones: int(table.size.Load()),
+		Purged:     table.purged.Load(),
+	}
+}
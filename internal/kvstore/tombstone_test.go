@@ -0,0 +1,114 @@
+package kvstore
+
+import (
+	"testing"
+	"time"
+)
+
+func newTombstoneService(t *testing.T, grace time.Duration) (*KeyValueService, *testClock) {
+	t.Helper()
+	clock := &testClock{}
+	clock.nanos.Store(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano())
+	return newTestKeyValueServiceWithConfig(t, Config{Clock: clock.Now, TombstoneGrace: grace}), clock
+}
+
+func TestTombstones_RememberDeletesUntilWrittenAgain(t *testing.T) {
+	store, clock := newTombstoneService(t, time.Hour)
+	for _, key := range []string{"a", "b"} {
+		if _, err := store.Set(key, "value"); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+	}
+	if _, err := store.Delete("a"); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+	// Deleting a key that does not exist leaves nothing to remember
+	if _, err := store.Delete("missing"); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+
+	if at, ok := store.Tombstone("a"); !ok || !at.Equal(clock.Now()) {
+		t.Fatalf("Tombstone(a) = %v, %v, want the time it was deleted", at, ok)
+	}
+	if _, ok := store.Tombstone("missing"); ok {
+		t.Fatal("Tombstone(missing) was set for a key that never existed")
+	}
+	if _, err := store.Set("a", "again"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, ok := store.Tombstone("a"); ok {
+		t.Fatal("Tombstone(a) was kept after a was written again")
+	}
+}
+
+func TestTombstones_ArePurgedAfterTheirGracePeriod(t *testing.T) {
+	store, clock := newTombstoneService(t, time.Hour)
+	for _, key := range []string{"a", "b"} {
+		if _, err := store.Set(key, "value"); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+	}
+	if _, err := store.Delete("a"); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+	clock.Advance(30 * time.Minute)
+	if _, err := store.Delete("b"); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+
+	clock.Advance(45 * time.Minute)
+	store.store.tombstones.purge(clock.Now().UnixNano())
+	if _, ok := store.Tombstone("a"); ok {
+		t.Fatal("Tombstone(a) was kept past its grace period")
+	}
+	if _, ok := store.Tombstone("b"); !ok {
+		t.Fatal("Tombstone(b) was purged within its grace period")
+	}
+	if stats := store.TombstoneStats(); stats.Tombstones != 1 || stats.Purged != 1 || stats.Grace != time.Hour {
+		t.Fatalf("TombstoneStats = %+v, want 1 held and 1 purged", stats)
+	}
+
+	store.SetTombstoneGrace(0)
+	if stats := store.TombstoneStats(); stats.Tombstones != 0 {
+		t.Fatalf("TombstoneStats = %+v, want none held once disabled", stats)
+	}
+	if _, err := store.Set("c", "value"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := store.Delete("c"); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+	if _, ok := store.Tombstone("c"); ok {
+		t.Fatal("Tombstone(c) was set with tombstones disabled")
+	}
+}
+
+func TestTombstones_RemoveDeletedKeysFromAResyncedReplica(t *testing.T) {
+	primary, _ := newTombstoneService(t, time.Hour)
+	replica := newTestKeyValueService(t)
+	for _, key := range []string{"kept", "deleted"} {
+		if _, err := primary.Set(key, "value"); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+		if _, err := replica.Set(key, "value"); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+	}
+	// The replica is away while the key is deleted, then syncs from scratch
+	if _, err := primary.Delete("deleted"); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+	stream, err := primary.Replicate(16)
+	if err != nil {
+		t.Fatalf("Replicate returned error: %v", err)
+	}
+	defer stream.Close()
+	syncReplica(t, stream, replica)
+
+	if _, err := replica.Get("deleted"); err == nil {
+		t.Fatal("replica kept a key deleted on the primary")
+	}
+	if value, err := replica.Get("kept"); err != nil || *value != "value" {
+		t.Fatalf("replica Get(kept) = %v, %v, want value", value, err)
+	}
+}
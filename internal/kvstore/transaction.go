@@ -0,0 +1,223 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	ErrTransactionConflict = errors.New("key is held by a prepared transaction")
+	ErrTransactionNotFound = errors.New("transaction not prepared")
+)
+
+// transactionCommand carries a transaction through the store. commands is
+// only set for prepares.
+type transactionCommand struct {
+	id       string
+	commands []Command
+}
+
+// transactionTable holds the transactions prepared on this store, waiting
+// for a coordinator's decision, and which transaction holds each of their
+// keys. It keeps its own lock for DirectExecution; size lets stores with no
+// prepared transactions skip the lock on every write.
+type transactionTable struct {
+	mu       sync.RWMutex
+	prepared map[string][]Command
+	owners   map[string]string
+	size     atomic.Int64
+}
+
+// owner returns the transaction holding key, if any.
+func (table *transactionTable) owner(key string) (string, bool) {
+	if table.size.Load() == 0 {
+		return "", false
+	}
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+
+	id, ok := table.owners[key]
+	return id, ok
+}
+
+func (table *transactionTable) release(id string) {
+	for _, command := range table.prepared[id] {
+		delete(table.owners, command.Key)
+	}
+	delete(table.prepared, id)
+	table.size.Add(-1)
+}
+
+// conflicts reports whether command writes a key held by a prepared
+// transaction other than the one it belongs to.
+func (kvStore *KeyValueStore) conflicts(command KeyValueCommand) bool {
+	if !IsMutation(command.commandType) || isTransactionCommand(command.commandType) {
+		return false
+	}
+	owner, ok := kvStore.transactions.owner(command.key)
+	if !ok {
+		return false
+	}
+	return command.transaction == nil || command.transaction.id != owner
+}
+
+func isTransactionCommand(commandType int) bool {
+	return commandType == TXPREPARE || commandType == TXCOMMIT || commandType == TXABORT
+}
+
+// ProcessTxPrepareCommand holds every key the transaction writes so no other
+// write can change them until it commits or aborts. Preparing a transaction
+// that is already prepared succeeds, so a participant can replay its log.
+func (kvStore *KeyValueStore) ProcessTxPrepareCommand(command KeyValueCommand) KeyValueOutput {
+	txn := command.transaction
+	for _, sub := range txn.commands {
+		if sub.Type != PUT && sub.Type != DELETE {
+			return KeyValueOutput{false, nil, fmt.Errorf("transactions only support PUT and DELETE, got %s", GetCommandTypeString(sub.Type)), 0}
+		}
+		if sub.Type == PUT && sub.Value == nil {
+			return KeyValueOutput{false, nil, fmt.Errorf("value given was nil for put of key %s", sub.Key), 0}
+		}
+		// Checked now so a prepared transaction cannot fail to commit
+		if err := kvStore.limits.Load().check(sub.Type, sub.Key, sub.Value); err != nil {
+			return KeyValueOutput{false, nil, err, 0}
+		}
+	}
+
+	table := &kvStore.transactions
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	if _, ok := table.prepared[txn.id]; ok {
+		return KeyValueOutput{true, nil, nil, 0}
+	}
+	for _, sub := range txn.commands {
+		if owner, ok := table.owners[sub.Key]; ok {
+			return KeyValueOutput{false, nil, fmt.Errorf("key %s held by transaction %s: %w", sub.Key, owner, ErrTransactionConflict), 0}
+		}
+	}
+
+	if table.prepared == nil {
+		table.prepared = make(map[string][]Command)
+		table.owners = make(map[string]string)
+	}
+	table.prepared[txn.id] = txn.commands
+	for _, sub := range txn.commands {
+		table.owners[sub.Key] = txn.id
+	}
+	table.size.Add(1)
+	return KeyValueOutput{true, nil, nil, 0}
+}
+
+// ProcessTxCommitCommand applies a prepared transaction's writes and then
+// releases its keys. Plain writes to those keys are rejected until then, but
+// reads may see some of the writes before others.
+func (kvStore *KeyValueStore) ProcessTxCommitCommand(command KeyValueCommand) KeyValueOutput {
+	txn := command.transaction
+	table := &kvStore.transactions
+	table.mu.RLock()
+	commands, ok := table.prepared[txn.id]
+	table.mu.RUnlock()
+	if !ok {
+		return KeyValueOutput{false, nil, ErrTransactionNotFound, 0}
+	}
+
+	for _, sub := range commands {
+		output := kvStore.process(KeyValueCommand{
+			commandType: sub.Type,
+			key:         sub.Key,
+			value:       sub.Value,
+			transaction: txn,
+			concurrent:  command.concurrent,
+		})
+		if output.err != nil {
+			// The transaction stays prepared so the coordinator can retry
+			return KeyValueOutput{false, nil, fmt.Errorf("committing transaction %s: %w", txn.id, output.err), 0}
+		}
+	}
+
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	if _, ok := table.prepared[txn.id]; ok {
+		table.release(txn.id)
+	}
+	return KeyValueOutput{true, nil, nil, 0}
+}
+
+// ProcessTxAbortCommand releases a prepared transaction's keys without
+// applying its writes. Aborting an unknown transaction succeeds, since a
+// participant that voted no never prepared it.
+func (kvStore *KeyValueStore) ProcessTxAbortCommand(command KeyValueCommand) KeyValueOutput {
+	table := &kvStore.transactions
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	if _, ok := table.prepared[command.transaction.id]; ok {
+		table.release(command.transaction.id)
+	}
+	return KeyValueOutput{true, nil, nil, 0}
+}
+
+// PrepareTransaction is the first phase of a two-phase commit. It checks
+// that commands, which may only be PUTs and DELETEs, can be applied and
+// holds their keys against other writes until CommitTransaction or
+// AbortTransaction is called with the same id. It returns an error wrapping
+// ErrTransactionConflict if another prepared transaction holds one of the
+// keys. Prepared transactions are kept in memory only; a participant that
+// must survive restarts logs them and prepares them again on startup.
+func (kvService *KeyValueService) PrepareTransaction(id string, commands []Command) error {
+	return kvService.PrepareTransactionContext(context.Background(), id, commands)
+}
+
+// PrepareTransactionContext is PrepareTransaction with ctx's deadline, as
+// SetContext is Set.
+func (kvService *KeyValueService) PrepareTransactionContext(ctx context.Context, id string, commands []Command) error {
+	if err := kvService.CheckWritable(); err != nil {
+		return err
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return err
+	}
+	txn := &transactionCommand{id, commands}
+	return kvService.dispatch(withDeadline(ctx, KeyValueCommand{commandType: TXPREPARE, transaction: txn})).err
+}
+
+// CommitTransaction applies the writes of the prepared transaction id. It
+// returns ErrTransactionNotFound if id is not prepared, which for a
+// coordinator retrying a commit means it has already been applied.
+func (kvService *KeyValueService) CommitTransaction(id string) error {
+	return kvService.CommitTransactionContext(context.Background(), id)
+}
+
+// CommitTransactionContext is CommitTransaction with ctx's deadline, as
+// SetContext is Set.
+func (kvService *KeyValueService) CommitTransactionContext(ctx context.Context, id string) error {
+	if err := kvService.CheckWritable(); err != nil {
+		return err
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return err
+	}
+	txn := &transactionCommand{id: id}
+	return kvService.dispatch(withDeadline(ctx, KeyValueCommand{commandType: TXCOMMIT, transaction: txn})).err
+}
+
+// AbortTransaction discards the prepared transaction id, if there is one.
+func (kvService *KeyValueService) AbortTransaction(id string) error {
+	return kvService.AbortTransactionContext(context.Background(), id)
+}
+
+// AbortTransactionContext is AbortTransaction with ctx's deadline, as
+// SetContext is Set.
+func (kvService *KeyValueService) AbortTransactionContext(ctx context.Context, id string) error {
+	if err := kvService.CheckActive(); err != nil {
+		return err
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return err
+	}
+	txn := &transactionCommand{id: id}
+	return kvService.dispatch(withDeadline(ctx, KeyValueCommand{commandType: TXABORT, transaction: txn})).err
+}
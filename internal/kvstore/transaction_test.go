@@ -0,0 +1,90 @@
+package kvstore
+
+import (
+	"errors"
+	"testing"
+)
+
+func transactionCommands() []Command {
+	return []Command{
+		{Type: PUT, Key: "a", Value: stringPointer("1")},
+		{Type: DELETE, Key: "b"},
+	}
+}
+
+func TestTransaction_CommitAppliesWritesAndReleasesKeys(t *testing.T) {
+	for _, config := range []Config{{}, {Execution: DirectExecution}} {
+		store := newTestKeyValueServiceWithConfig(t, config)
+		if _, err := store.Set("b", "old"); err != nil {
+			t.Fatalf("Set returned error: %v", err)
+		}
+
+		if err := store.PrepareTransaction("tx1", transactionCommands()); err != nil {
+			t.Fatalf("PrepareTransaction returned error: %v", err)
+		}
+		if _, err := store.Set("a", "other"); !errors.Is(err, ErrTransactionConflict) {
+			t.Fatalf("Set of a prepared key returned %v, want ErrTransactionConflict", err)
+		}
+		if _, err := store.Get("b"); err != nil {
+			t.Fatalf("Get of a prepared key returned error: %v", err)
+		}
+
+		if err := store.CommitTransaction("tx1"); err != nil {
+			t.Fatalf("CommitTransaction returned error: %v", err)
+		}
+		if value, err := store.Get("a"); err != nil || *value != "1" {
+			t.Fatalf("Get after commit = (%v, %v), want 1", value, err)
+		}
+		if _, err := store.Get("b"); err == nil {
+			t.Fatalf("Get of a key deleted by the transaction succeeded, want error")
+		}
+		if _, err := store.Set("a", "other"); err != nil {
+			t.Fatalf("Set after commit returned error: %v", err)
+		}
+		if err := store.CommitTransaction("tx1"); !errors.Is(err, ErrTransactionNotFound) {
+			t.Fatalf("second CommitTransaction returned %v, want ErrTransactionNotFound", err)
+		}
+	}
+}
+
+func TestTransaction_AbortDiscardsWrites(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	if err := store.PrepareTransaction("tx1", transactionCommands()); err != nil {
+		t.Fatalf("PrepareTransaction returned error: %v", err)
+	}
+	if err := store.AbortTransaction("tx1"); err != nil {
+		t.Fatalf("AbortTransaction returned error: %v", err)
+	}
+	if _, err := store.Get("a"); err == nil {
+		t.Fatalf("Get after abort succeeded, want error")
+	}
+	if _, err := store.Set("a", "other"); err != nil {
+		t.Fatalf("Set after abort returned error: %v", err)
+	}
+	if err := store.AbortTransaction("unknown"); err != nil {
+		t.Fatalf("AbortTransaction of an unknown transaction returned error: %v", err)
+	}
+}
+
+func TestTransaction_PrepareConflictsAndReplays(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	if err := store.PrepareTransaction("tx1", transactionCommands()); err != nil {
+		t.Fatalf("PrepareTransaction returned error: %v", err)
+	}
+	// Replaying a participant log prepares the same transaction again
+	if err := store.PrepareTransaction("tx1", transactionCommands()); err != nil {
+		t.Fatalf("repeated PrepareTransaction returned error: %v", err)
+	}
+
+	other := []Command{{Type: PUT, Key: "b", Value: stringPointer("2")}}
+	if err := store.PrepareTransaction("tx2", other); !errors.Is(err, ErrTransactionConflict) {
+		t.Fatalf("PrepareTransaction of a held key returned %v, want ErrTransactionConflict", err)
+	}
+
+	reads := []Command{{Type: GET, Key: "c"}}
+	if err := store.PrepareTransaction("tx3", reads); err == nil {
+		t.Fatalf("PrepareTransaction with a GET succeeded, want error")
+	}
+}
@@ -0,0 +1,156 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrTTLPolicy is returned for an expiry the policy of the key's namespace
+// does not allow.
+var ErrTTLPolicy = errors.New("refused by the namespace's TTL policy")
+
+// TTLPolicy governs the expiry of the keys starting with Prefix, so one
+// namespace can expire everything written to it while another keeps its
+// keys for good. A key follows the policy with the longest prefix it has.
+// Locks and leases keep their own expiry, and replicas apply the deadlines
+// their primary set rather than policies of their own.
+type TTLPolicy struct {
+	Prefix string
+	// Default is the TTL keys are given each time they are set, until
+	// another is set on them. Zero leaves them without
+	Default time.Duration
+	// Max caps the TTL keys may be given: a later deadline is brought
+	// forward to it, persisting a key is refused, and keys are set with it
+	// if there is no Default. Zero leaves TTLs unbounded
+	Max time.Duration
+	// NoExpiry refuses to give keys a TTL at all
+	NoExpiry bool
+}
+
+func (policy TTLPolicy) String() string {
+	var settings []string
+	if policy.NoExpiry {
+		settings = append(settings, "none")
+	}
+	if policy.Default > 0 {
+		settings = append(settings, "default:"+policy.Default.String())
+	}
+	if policy.Max > 0 {
+		settings = append(settings, "max:"+policy.Max.String())
+	}
+	return policy.Prefix + "=" + strings.Join(settings, ",")
+}
+
+// ttlPolicies holds the configured policies, longest prefix first so the
+// first that matches a key is the one it follows.
+type ttlPolicies []TTLPolicy
+
+func newTTLPolicies(policies []TTLPolicy) *ttlPolicies {
+	sorted := ttlPolicies(slices.Clone(policies))
+	slices.SortStableFunc(sorted, func(a, b TTLPolicy) int {
+		return len(b.Prefix) - len(a.Prefix)
+	})
+	return &sorted
+}
+
+// lookup returns the policy key follows, if any.
+func (policies *ttlPolicies) lookup(key string) (TTLPolicy, bool) {
+	if policies == nil {
+		return TTLPolicy{}, false
+	}
+	for _, policy := range *policies {
+		if strings.HasPrefix(key, policy.Prefix) {
+			return policy, true
+		}
+	}
+	return TTLPolicy{}, false
+}
+
+// ValidateTTLPolicies returns an error if policies contradict themselves
+// or each other.
+func ValidateTTLPolicies(policies []TTLPolicy) error {
+	seen := make(map[string]bool, len(policies))
+	for _, policy := range policies {
+		switch {
+		case seen[policy.Prefix]:
+			return fmt.Errorf("more than one TTL policy for prefix %q", policy.Prefix)
+		case policy.Default < 0 || policy.Max < 0:
+			return fmt.Errorf("TTL policy %s: TTLs cannot be negative", policy)
+		case policy.NoExpiry && (policy.Default > 0 || policy.Max > 0):
+			return fmt.Errorf("TTL policy %s: a namespace without TTLs cannot have a default or maximum one", policy)
+		case policy.Max > 0 && policy.Default > policy.Max:
+			return fmt.Errorf("TTL policy %s: the default TTL is longer than the maximum", policy)
+		}
+		seen[policy.Prefix] = true
+	}
+	return nil
+}
+
+// defaultDeadline returns the deadline, in Unix nanoseconds, a key written
+// without a TTL is given by its namespace's policy, if it has one.
+func (kvStore *KeyValueStore) defaultDeadline(key string) (int64, bool) {
+	policy, ok := kvStore.ttlPolicies.Load().lookup(key)
+	ttl := policy.Default
+	if ttl <= 0 {
+		ttl = policy.Max
+	}
+	if !ok || ttl <= 0 {
+		return 0, false
+	}
+	return kvStore.currentTime().Add(ttl).UnixNano(), true
+}
+
+// newDeadline returns the deadline a key just created starts with: its
+// namespace's default TTL from now, or zero for none.
+func (kvStore *KeyValueStore) newDeadline(key string) int64 {
+	deadline, _ := kvStore.defaultDeadline(key)
+	return deadline
+}
+
+// policyDeadline checks deadline against the policy of key's namespace,
+// returning it brought forward to the maximum TTL if it is later.
+func (kvStore *KeyValueStore) policyDeadline(key string, deadline int64, now time.Time) (int64, error) {
+	policy, ok := kvStore.ttlPolicies.Load().lookup(key)
+	switch {
+	case !ok:
+		return deadline, nil
+	case policy.NoExpiry:
+		return 0, fmt.Errorf("%w: keys under %q cannot expire", ErrTTLPolicy, policy.Prefix)
+	case policy.Max > 0:
+		return min(deadline, now.Add(policy.Max).UnixNano()), nil
+	}
+	return deadline, nil
+}
+
+// checkPersist returns an error if the policy of key's namespace does not
+// let it go without a TTL.
+func (kvStore *KeyValueStore) checkPersist(key string) error {
+	policy, ok := kvStore.ttlPolicies.Load().lookup(key)
+	if ok && policy.Max > 0 {
+		return fmt.Errorf("%w: keys under %q must expire within %s", ErrTTLPolicy, policy.Prefix, policy.Max)
+	}
+	return nil
+}
+
+// SetTTLPolicies replaces Config.TTLPolicies while the service runs. The
+// new policies apply to keys as they are next written or given a TTL; keys
+// already stored keep their expiry.
+func (kvService *KeyValueService) SetTTLPolicies(policies []TTLPolicy) error {
+	if err := ValidateTTLPolicies(policies); err != nil {
+		return err
+	}
+	kvService.store.ttlPolicies.Store(newTTLPolicies(policies))
+	return nil
+}
+
+// TTLPolicies returns the TTL policies in effect, longest prefix first.
+func (kvService *KeyValueService) TTLPolicies() []TTLPolicy {
+	policies := kvService.store.ttlPolicies.Load()
+	if policies == nil {
+		return nil
+	}
+	return slices.Clone(*policies)
+}
@@ -0,0 +1,141 @@
+package kvstore
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTTLPolicyService(t *testing.T, policies ...TTLPolicy) (*KeyValueService, *testClock) {
+	t.Helper()
+	clock := &testClock{}
+	clock.nanos.Store(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano())
+	return newTestKeyValueServiceWithConfig(t, Config{Clock: clock.Now, TTLPolicies: policies}), clock
+}
+
+func TestTTLPolicies_GiveKeysTheirNamespaceDefault(t *testing.T) {
+	store, clock := newTTLPolicyService(t,
+		TTLPolicy{Prefix: "cache:", Default: time.Minute},
+		TTLPolicy{Prefix: "cache:session:", Default: time.Hour},
+		TTLPolicy{Prefix: "capped:", Max: 10 * time.Minute},
+	)
+	for key, want := range map[string]time.Duration{
+		"cache:page":      time.Minute,
+		"cache:session:1": time.Hour,
+		"capped:x":        10 * time.Minute,
+		"other":           TTLNoExpiry,
+	} {
+		if _, err := store.Set(key, "value"); err != nil {
+			t.Fatalf("Set(%s) returned error: %v", key, err)
+		}
+		if ttl, err := store.TTL(key); err != nil || ttl != want {
+			t.Fatalf("TTL(%s) = %v, %v, want %v", key, ttl, err, want)
+		}
+	}
+
+	// Setting the key again starts its default TTL over
+	clock.Advance(30 * time.Second)
+	if _, err := store.Set("cache:page", "again"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if ttl, _ := store.TTL("cache:page"); ttl != time.Minute {
+		t.Fatalf("TTL after setting again = %v, want a minute", ttl)
+	}
+	// An explicit TTL replaces the default
+	if _, err := store.ExpireAt("cache:page", clock.Now().Add(5*time.Minute)); err != nil {
+		t.Fatalf("ExpireAt returned error: %v", err)
+	}
+	if ttl, _ := store.TTL("cache:page"); ttl != 5*time.Minute {
+		t.Fatalf("TTL after ExpireAt = %v, want 5m", ttl)
+	}
+	clock.Advance(5 * time.Minute)
+	if _, err := store.Get("cache:page"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Get after the TTL = %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestTTLPolicies_CapAndForbidTTLs(t *testing.T) {
+	store, clock := newTTLPolicyService(t,
+		TTLPolicy{Prefix: "cache:", Default: time.Minute, Max: time.Hour},
+		TTLPolicy{Prefix: "config:", NoExpiry: true},
+	)
+	for _, key := range []string{"cache:a", "config:a"} {
+		if _, err := store.Set(key, "value"); err != nil {
+			t.Fatalf("Set(%s) returned error: %v", key, err)
+		}
+	}
+
+	if _, err := store.ExpireAt("cache:a", clock.Now().Add(24*time.Hour)); err != nil {
+		t.Fatalf("ExpireAt returned error: %v", err)
+	}
+	if ttl, _ := store.TTL("cache:a"); ttl != time.Hour {
+		t.Fatalf("TTL = %v, want the day asked for brought down to the hour allowed", ttl)
+	}
+	if _, err := store.Persist("cache:a"); !errors.Is(err, ErrTTLPolicy) {
+		t.Fatalf("Persist = %v, want ErrTTLPolicy under a maximum TTL", err)
+	}
+
+	if _, err := store.ExpireAt("config:a", clock.Now().Add(time.Minute)); !errors.Is(err, ErrTTLPolicy) {
+		t.Fatalf("ExpireAt = %v, want ErrTTLPolicy in a namespace without TTLs", err)
+	}
+	if ttl, _ := store.TTL("config:a"); ttl != TTLNoExpiry {
+		t.Fatalf("TTL = %v, want none after a refused ExpireAt", ttl)
+	}
+	if ok, err := store.Persist("config:a"); err != nil || ok {
+		t.Fatalf("Persist = %t, %v, want a no-op on a key without a TTL", ok, err)
+	}
+
+	// New policies apply from the next write
+	if err := store.SetTTLPolicies(nil); err != nil {
+		t.Fatalf("SetTTLPolicies returned error: %v", err)
+	}
+	if _, err := store.ExpireAt("config:a", clock.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("ExpireAt without policies returned error: %v", err)
+	}
+}
+
+func TestValidateTTLPolicies_RefusesContradictions(t *testing.T) {
+	for _, policies := range [][]TTLPolicy{
+		{{Prefix: "a", NoExpiry: true, Default: time.Minute}},
+		{{Prefix: "a", Default: time.Hour, Max: time.Minute}},
+		{{Prefix: "a", Default: -time.Minute}},
+		{{Prefix: "a", Default: time.Minute}, {Prefix: "a", Max: time.Hour}},
+	} {
+		if err := ValidateTTLPolicies(policies); err == nil {
+			t.Fatalf("ValidateTTLPolicies(%v) returned no error", policies)
+		}
+	}
+	if err := ValidateTTLPolicies([]TTLPolicy{{Prefix: "a", Default: time.Minute, Max: time.Hour}, {Prefix: "b", NoExpiry: true}}); err != nil {
+		t.Fatalf("ValidateTTLPolicies returned error: %v", err)
+	}
+}
+
+func TestTTLPolicies_ApplyToSetWithTTL(t *testing.T) {
+	store, _ := newTTLPolicyService(t,
+		TTLPolicy{Prefix: "cache:", Default: time.Minute, Max: time.Hour},
+		TTLPolicy{Prefix: "config:", NoExpiry: true},
+	)
+
+	if _, err := store.SetWithTTL("cache:a", "value", 10*time.Second); err != nil {
+		t.Fatalf("SetWithTTL returned error: %v", err)
+	}
+	if ttl, _ := store.TTL("cache:a"); ttl != 10*time.Second {
+		t.Fatalf("TTL = %v, want the 10s asked for rather than the default", ttl)
+	}
+	if _, err := store.SetWithTTL("cache:b", "value", 24*time.Hour); err != nil {
+		t.Fatalf("SetWithTTL returned error: %v", err)
+	}
+	if ttl, _ := store.TTL("cache:b"); ttl != time.Hour {
+		t.Fatalf("TTL = %v, want the day asked for brought down to the hour allowed", ttl)
+	}
+
+	if _, err := store.Set("config:a", "old"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := store.SetWithTTL("config:a", "new", time.Minute); !errors.Is(err, ErrTTLPolicy) {
+		t.Fatalf("SetWithTTL = %v, want ErrTTLPolicy in a namespace without TTLs", err)
+	}
+	if value, _ := store.Get("config:a"); value == nil || *value != "old" {
+		t.Fatalf("Get = %v, want the refused write to leave the old value", value)
+	}
+}
@@ -0,0 +1,82 @@
+package kvstore
+
+import (
+	"blueis/internal/crdt"
+	"blueis/internal/datatype"
+	"blueis/internal/sketch"
+	"fmt"
+)
+
+// ValueType says what a stored value holds. Engines keep it next to the
+// value's bytes and hand it back with them, so the store never tells a
+// key's type from its value: a string a client sets is read back as a
+// string whatever bytes it holds, and only the commands of a type write
+// values of that type.
+type ValueType uint8
+
+const (
+	// TypeString is a plain string, held as its bytes.
+	TypeString ValueType = iota
+	// TypeHash is a datatype.Hash.
+	TypeHash
+	// TypeList is a datatype.List.
+	TypeList
+	// TypeCountMin is a sketch.CountMin.
+	TypeCountMin
+	// TypePNCounter and TypeORSet are the counters and sets of crdt.
+	TypePNCounter
+	TypeORSet
+	// TypeLock is a lock, held as its fencing token.
+	TypeLock
+)
+
+// TypedValue is a value as engines hold it: the bytes of a string, or the
+// encoding of one of the other types, and the type that says which.
+type TypedValue struct {
+	Type ValueType
+	Data string
+}
+
+func stringValue(data string) TypedValue {
+	return TypedValue{TypeString, data}
+}
+
+// decode checks that value's data is an encoding of its type, for values
+// that come from outside the store, such as a primary's mutations, rather
+// than from its own commands.
+func (value TypedValue) decode() error {
+	var err error
+	switch value.Type {
+	case TypeString:
+	case TypeHash:
+		_, err = datatype.DecodeHash(value.Data)
+	case TypeList:
+		_, err = datatype.DecodeList(value.Data)
+	case TypeCountMin:
+		_, err = sketch.DecodeCountMin(value.Data)
+	case TypePNCounter:
+		_, err = crdt.DecodePNCounter(value.Data)
+	case TypeORSet:
+		_, err = crdt.DecodeORSet(value.Data)
+	case TypeLock:
+		if _, ok := decodeLock(value.Data); !ok {
+			err = fmt.Errorf("invalid lock encoding")
+		}
+	default:
+		err = fmt.Errorf("unknown value type %d", value.Type)
+	}
+	return err
+}
+
+// loadTyped reads the value under key if it is of type valueType, failing
+// with ErrWrongType if the key holds another type.
+func (kvStore *KeyValueStore) loadTyped(key string, valueType ValueType) (string, bool, error) {
+	value, ok, err := kvStore.engine.Get(key)
+	if err != nil || !ok {
+		return "", false, err
+	}
+	if value.Type != valueType {
+		return "", false, ErrWrongType
+	}
+	return value.Data, true, nil
+}
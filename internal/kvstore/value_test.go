@@ -0,0 +1,60 @@
+package kvstore
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTypedValues_StringsAreNeverReadAsAnotherType(t *testing.T) {
+	store := newTestKeyValueServiceWithConfig(t, Config{CRDTNamespaces: []string{"crdt:"}})
+	if err := store.CountMinInit("sketch", 16, 2); err != nil {
+		t.Fatalf("CountMinInit returned error: %v", err)
+	}
+	if _, err := store.HSet("hash", map[string]string{"a": "b"}); err != nil {
+		t.Fatalf("HSet returned error: %v", err)
+	}
+	if _, err := store.RPush("list", "a"); err != nil {
+		t.Fatalf("RPush returned error: %v", err)
+	}
+
+	for _, key := range []string{"sketch", "hash", "list"} {
+		value, _, err := store.store.engine.Get(key)
+		if err != nil {
+			t.Fatalf("reading %s returned error: %v", key, err)
+		}
+		if _, err := store.Get(key); !errors.Is(err, ErrWrongType) {
+			t.Fatalf("Get(%q) = %v, want ErrWrongType", key, err)
+		}
+
+		// A copy of the encoding is a string holding those bytes
+		if _, err := store.Set("copy", value.Data); err != nil {
+			t.Fatalf("Set of the value of %s returned error: %v", key, err)
+		}
+		if got, err := store.Get("copy"); err != nil || got == nil || *got != value.Data {
+			t.Fatalf("Get of the copy of %s = (%v, %v), want the bytes it was set to", key, got, err)
+		}
+		if _, err := store.CountMinQuery("copy", "a"); !errors.Is(err, ErrWrongType) {
+			t.Fatalf("CountMinQuery of the copy of %s = %v, want ErrWrongType", key, err)
+		}
+		if _, err := store.HGet("copy", "a"); !errors.Is(err, ErrWrongType) {
+			t.Fatalf("HGet of the copy of %s = %v, want ErrWrongType", key, err)
+		}
+		if _, err := store.LLen("copy"); !errors.Is(err, ErrWrongType) {
+			t.Fatalf("LLen of the copy of %s = %v, want ErrWrongType", key, err)
+		}
+	}
+}
+
+func TestApplyMutations_RefusesValuesThatDoNotDecodeAsTheirType(t *testing.T) {
+	store := newTestKeyValueService(t)
+
+	for _, valueType := range []ValueType{TypeHash, TypeList, TypeCountMin, TypePNCounter, TypeORSet, TypeLock, 99} {
+		mutation := Mutation{Type: MutationSet, Key: "k", Value: "plain", ValueType: valueType}
+		if err := store.ApplyMutations([]Mutation{mutation}); err == nil {
+			t.Fatalf("ApplyMutations of a string typed %d succeeded, want error", valueType)
+		}
+	}
+	if err := store.ApplyMutations([]Mutation{{Type: MutationSet, Key: "k", Value: "plain"}}); err != nil {
+		t.Fatalf("ApplyMutations of a string returned error: %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+package kvstore
+
+import (
+	"fmt"
+	"time"
+)
+
+// WriteBatch collects sets, deletes and expiries to be applied together by
+// KeyValueService.Write. Its methods return the batch so calls can be
+// chained.
+type WriteBatch struct {
+	commands []Command
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+func (batch *WriteBatch) Set(key string, value string) *WriteBatch {
+	batch.commands = append(batch.commands, Command{Type: PUT, Key: key, Value: &value})
+	return batch
+}
+
+func (batch *WriteBatch) Delete(key string) *WriteBatch {
+	batch.commands = append(batch.commands, Command{Type: DELETE, Key: key})
+	return batch
+}
+
+// ExpireAt sets an absolute expiry on key, or deletes it if at has already
+// passed when the batch is applied.
+func (batch *WriteBatch) ExpireAt(key string, at time.Time) *WriteBatch {
+	batch.commands = append(batch.commands, Command{Type: EXPIREAT, Key: key, ExpireAt: at})
+	return batch
+}
+
+func (batch *WriteBatch) Len() int {
+	return len(batch.commands)
+}
+
+// undoEntry is the state of a key before a write batch first touched it.
+type undoEntry struct {
+	key         string
+	value       TypedValue
+	existed     bool
+	deadline    int64
+	hadDeadline bool
+}
+
+// ProcessWriteBatchCommand applies every write in the batch or none of
+// them. Each write runs through hooks and metrics like a standalone command;
+// if one fails, the keys written before it are restored from an undo log.
+func (kvStore *KeyValueStore) ProcessWriteBatchCommand(command KeyValueCommand) KeyValueOutput {
+	batch := command.batch
+	if batch == nil {
+		return KeyValueOutput{false, nil, fmt.Errorf("write batch has no commands"), 0}
+	}
+	for _, sub := range batch.commands {
+		if sub.Type != PUT && sub.Type != DELETE && sub.Type != EXPIREAT {
+			return KeyValueOutput{false, nil, fmt.Errorf("write batches only support PUT, DELETE and EXPIREAT, got %s", GetCommandTypeString(sub.Type)), 0}
+		}
+	}
+
+	undo := make([]undoEntry, 0, len(batch.commands))
+	seen := make(map[string]struct{}, len(batch.commands))
+	for _, sub := range batch.commands {
+		if _, ok := seen[sub.Key]; !ok {
+			seen[sub.Key] = struct{}{}
+			entry, err := kvStore.undoEntry(sub.Key, command.concurrent)
+			if err != nil {
+				kvStore.rollback(undo)
+				return KeyValueOutput{false, nil, err, 0}
+			}
+			undo = append(undo, entry)
+		}
+
+		output := kvStore.process(KeyValueCommand{
+			commandType: sub.Type,
+			key:         sub.Key,
+			value:       sub.Value,
+			expireAt:    sub.ExpireAt,
+			ttl:         sub.TTL,
+			concurrent:  command.concurrent,
+		})
+		if output.err != nil {
+			kvStore.rollback(undo)
+			return KeyValueOutput{false, nil, fmt.Errorf("applying write batch to key %s: %w", sub.Key, output.err), 0}
+		}
+	}
+	return KeyValueOutput{true, nil, nil, 0}
+}
+
+func (kvStore *KeyValueStore) undoEntry(key string, concurrent bool) (undoEntry, error) {
+	entry := undoEntry{key: key}
+	if kvStore.keyExpired(key, concurrent) {
+		return entry, nil
+	}
+	value, ok, err := kvStore.engine.Get(key)
+	if err != nil {
+		return entry, err
+	}
+	entry.value, entry.existed = value, ok
+	entry.deadline, entry.hadDeadline = kvStore.expiries.deadline(key)
+	return entry, nil
+}
+
+// rollback restores keys to their state before the batch, newest first.
+// Restoring goes straight to the engine, bypassing hooks, so a hook that
+// rejected a write cannot also block undoing the writes before it.
+func (kvStore *KeyValueStore) rollback(undo []undoEntry) {
+	for i := len(undo) - 1; i >= 0; i-- {
+		entry := undo[i]
+		var err error
+		if entry.existed {
+			err = kvStore.setValue(entry.key, entry.value)
+		} else {
+			_, _, err = kvStore.deleteValue(entry.key)
+		}
+		if err != nil {
+			kvStore.logger.Printf("Error rolling back key %s: %v", entry.key, err)
+			continue
+		}
+		if entry.hadDeadline {
+			err = kvStore.setDeadline(entry.key, entry.deadline)
+		} else {
+			_, err = kvStore.clearDeadline(entry.key)
+		}
+		if err != nil {
+			kvStore.logger.Printf("Error rolling back the deadline of key %s: %v", entry.key, err)
+		}
+	}
+}
+
+// Write applies every write in batch atomically: either all of them take
+// effect or, if one fails, none do. With ActorExecution no other command
+// runs while the batch is applied, so readers never see part of it; with
+// DirectExecution commands on other goroutines may still interleave with
+// it.
+func (kvService *KeyValueService) Write(batch *WriteBatch) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+	if err := kvService.CheckWritable(); err != nil {
+		return err
+	}
+	if err := kvService.maintenance.wait(); err != nil {
+		return err
+	}
+	commands := &commandBatch{commands: batch.commands}
+	return kvService.dispatch(KeyValueCommand{commandType: WRITEBATCH, batch: commands}).err
+}
@@ -0,0 +1,77 @@
+package kvstore
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWrite_AppliesEveryEntry(t *testing.T) {
+	store := newTestKeyValueService(t)
+	clock := newTestClock(store)
+	if _, err := store.Set("old", "value"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+
+	batch := NewWriteBatch().
+		Set("a", "1").
+		Set("b", "2").
+		Delete("old").
+		ExpireAt("b", clock.Now().Add(time.Second))
+	if err := store.Write(batch); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+
+	if value, err := store.Get("a"); err != nil || *value != "1" {
+		t.Fatalf("Get(a) = (%v, %v), want 1", value, err)
+	}
+	if _, err := store.Get("old"); err == nil {
+		t.Fatalf("Get of a key deleted by the batch succeeded, want error")
+	}
+	if ttl, err := store.TTL("b"); err != nil || ttl != time.Second {
+		t.Fatalf("TTL(b) = (%v, %v), want (1s, nil)", ttl, err)
+	}
+}
+
+func TestWrite_FailureRollsBackEarlierEntries(t *testing.T) {
+	store := newTestKeyValueService(t)
+	clock := newTestClock(store)
+	if _, err := store.Set("a", "old"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if _, err := store.ExpireAt("a", clock.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("ExpireAt returned error: %v", err)
+	}
+
+	rejected := errors.New("rejected")
+	store.AddBeforeCommandHook(func(command *Command) error {
+		if command.Key == "bad" {
+			return rejected
+		}
+		return nil
+	})
+
+	batch := NewWriteBatch().Set("a", "new").Set("b", "new").Set("bad", "x")
+	if err := store.Write(batch); !errors.Is(err, rejected) {
+		t.Fatalf("Write returned %v, want the hook's error", err)
+	}
+
+	if value, err := store.Get("a"); err != nil || *value != "old" {
+		t.Fatalf("Get(a) after rollback = (%v, %v), want old", value, err)
+	}
+	if ttl, err := store.TTL("a"); err != nil || ttl != time.Minute {
+		t.Fatalf("TTL(a) after rollback = (%v, %v), want (1m, nil)", ttl, err)
+	}
+	if _, err := store.Get("b"); err == nil {
+		t.Fatalf("Get(b) after rollback succeeded, want error")
+	}
+}
+
+func TestWrite_RejectedInReadOnlyMode(t *testing.T) {
+	store := newTestKeyValueService(t)
+	store.SetReadOnly(true)
+
+	if err := store.Write(NewWriteBatch().Set("a", "1")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Write in read-only mode returned %v, want ErrReadOnly", err)
+	}
+}
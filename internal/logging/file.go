@@ -0,0 +1,100 @@
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// rotatingFile is a log file that is rotated as Rotation describes.
+type rotatingFile struct {
+	path     string
+	rotation Rotation
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(path string, rotation Rotation) (*rotatingFile, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("opening log file: %w", err)
+	}
+	return &rotatingFile{path: path, rotation: rotation, file: file, size: info.Size()}, nil
+}
+
+func (file *rotatingFile) Write(p []byte) (int, error) {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+
+	if file.file == nil {
+		return 0, os.ErrClosed
+	}
+	if limit := file.rotation.MaxBytes; limit > 0 && file.size > 0 && file.size+int64(len(p)) > limit {
+		if err := file.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := file.file.Write(p)
+	file.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file out of the way and starts a new one. A
+// failure to rename leaves the current file in place, growing past the
+// limit, rather than losing messages.
+func (file *rotatingFile) rotate() error {
+	if err := file.file.Close(); err != nil {
+		return err
+	}
+	var err error
+	if file.rotation.Backups > 0 {
+		for i := file.rotation.Backups - 1; i >= 1; i-- {
+			err = os.Rename(fmt.Sprintf("%s.%d", file.path, i), fmt.Sprintf("%s.%d", file.path, i+1))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				break
+			}
+			err = nil
+		}
+		if err == nil {
+			err = os.Rename(file.path, file.path+".1")
+		}
+	} else {
+		err = os.Remove(file.path)
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if err == nil {
+		flags |= os.O_TRUNC
+	}
+	reopened, openErr := os.OpenFile(file.path, flags, 0o644)
+	if openErr != nil {
+		file.file = nil
+		return openErr
+	}
+	file.file = reopened
+	if err == nil {
+		file.size = 0
+	}
+	return nil
+}
+
+func (file *rotatingFile) Close() error {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+
+	if file.file == nil {
+		return nil
+	}
+	err := file.file.Close()
+	file.file = nil
+	return err
+}
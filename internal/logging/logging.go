@@ -0,0 +1,145 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Level is how serious a message is. A Logger drops messages below its
+// level.
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+	// Off drops every message
+	Off
+)
+
+var levelNames = [...]string{"debug", "info", "warn", "error", "off"}
+
+func (level Level) String() string {
+	if level < Debug || level > Off {
+		return fmt.Sprintf("Level(%d)", int(level))
+	}
+	return levelNames[level]
+}
+
+func ParseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(level), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, want one of %s", name, strings.Join(levelNames[:], ", "))
+}
+
+// Logger writes one component's messages to its sink, dropping those below
+// its level. Each line carries the level and component after the time, so
+// components sharing a sink can be told apart. The sink and level can be
+// changed while the logger is in use, as when a Router is reloaded.
+type Logger struct {
+	component string
+	target    atomic.Pointer[target]
+}
+
+type target struct {
+	level Level
+	sink  io.Writer
+	out   *log.Logger
+}
+
+func New(component string, level Level, sink io.Writer) *Logger {
+	logger := &Logger{component: component}
+	logger.retarget(level, sink)
+	return logger
+}
+
+func (logger *Logger) retarget(level Level, sink io.Writer) {
+	logger.target.Store(&target{level, sink, log.New(sink, "", log.LstdFlags)})
+}
+
+// Default returns a Logger writing component's messages at Info and above
+// to stderr, which is where they go until a Router says otherwise.
+func Default(component string) *Logger {
+	return New(component, Info, os.Stderr)
+}
+
+func (logger *Logger) Enabled(level Level) bool {
+	current := logger.target.Load().level
+	return level >= current && current != Off
+}
+
+func (logger *Logger) output(level Level, message string) {
+	if logger.Enabled(level) {
+		logger.write(level, message)
+	}
+}
+
+func (logger *Logger) write(level Level, message string) {
+	target := logger.target.Load()
+	if writer, ok := target.sink.(levelWriter); ok {
+		_ = writer.writeLevel(level, logger.component+": "+message)
+		return
+	}
+	_ = target.out.Output(0, strings.ToUpper(level.String())+" "+logger.component+": "+message)
+}
+
+func (logger *Logger) Debugf(format string, args ...any) {
+	logger.output(Debug, fmt.Sprintf(format, args...))
+}
+
+// Printf logs at Info, so loggers can stand in for the standard logger.
+func (logger *Logger) Printf(format string, args ...any) {
+	logger.output(Info, fmt.Sprintf(format, args...))
+}
+
+func (logger *Logger) Warnf(format string, args ...any) {
+	logger.output(Warn, fmt.Sprintf(format, args...))
+}
+
+func (logger *Logger) Errorf(format string, args ...any) {
+	logger.output(Error, fmt.Sprintf(format, args...))
+}
+
+// Fatalf logs at Error, whatever the logger's level, and exits.
+func (logger *Logger) Fatalf(format string, args ...any) {
+	logger.write(Error, fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+// StdLogger returns a standard logger writing through logger at level, for
+// code that takes a *log.Logger.
+func (logger *Logger) StdLogger(level Level) *log.Logger {
+	return log.New(stdWriter{logger, level}, "", 0)
+}
+
+// SetStandard routes the standard logger, and so everything logged through
+// the log package, through logger at Info.
+func (logger *Logger) SetStandard() {
+	log.SetFlags(0)
+	log.SetPrefix("")
+	log.SetOutput(stdWriter{logger, Info})
+}
+
+type stdWriter struct {
+	logger *Logger
+	level  Level
+}
+
+func (writer stdWriter) Write(p []byte) (int, error) {
+	writer.logger.output(writer.level, strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+// levelWriter is implemented by sinks that record each message's level
+// themselves, such as syslog, rather than in the message.
+type levelWriter interface {
+	writeLevel(level Level, message string) error
+}
@@ -0,0 +1,169 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogger_DropsMessagesBelowItsLevel(t *testing.T) {
+	var out bytes.Buffer
+	logger := New("store", Warn, &out)
+
+	logger.Debugf("debug %d", 1)
+	logger.Printf("info %d", 2)
+	logger.Warnf("warn %d", 3)
+	logger.Errorf("error %d", 4)
+	logger.StdLogger(Error).Printf("std %d", 5)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	want := []string{"WARN store: warn 3", "ERROR store: error 4", "ERROR store: std 5"}
+	if len(lines) != len(want) {
+		t.Fatalf("logged %q, want %d lines", out.String(), len(want))
+	}
+	for i, line := range lines {
+		if !strings.HasSuffix(line, want[i]) {
+			t.Errorf("line %d = %q, want it to end with %q", i, line, want[i])
+		}
+	}
+}
+
+func TestParseRoutes(t *testing.T) {
+	routes, err := ParseRoutes("store=debug@file:/tmp/store.log, replication=WARN@syslog:blueis, *=error")
+	if err != nil {
+		t.Fatalf("ParseRoutes returned error: %v", err)
+	}
+	want := map[string]Route{
+		"store":       {Debug, "file:/tmp/store.log"},
+		"replication": {Warn, "syslog:blueis"},
+		"*":           {Error, "stderr"},
+	}
+	if fmt.Sprint(routes) != fmt.Sprint(want) {
+		t.Fatalf("ParseRoutes = %v, want %v", routes, want)
+	}
+
+	for _, spec := range []string{"store", "=info", "store=loud", "store=info,store=warn"} {
+		if _, err := ParseRoutes(spec); err == nil {
+			t.Errorf("ParseRoutes(%q) succeeded, want error", spec)
+		}
+	}
+}
+
+func TestRouter_RoutesComponentsToTheirSinks(t *testing.T) {
+	dir := t.TempDir()
+	storeLog := filepath.Join(dir, "store.log")
+	otherLog := filepath.Join(dir, "other.log")
+	router, err := NewRouter(fmt.Sprintf("store=debug@file:%s,http=error@file:%s,*=warn@file:%s", storeLog, otherLog, otherLog), Rotation{})
+	if err != nil {
+		t.Fatalf("NewRouter returned error: %v", err)
+	}
+
+	router.Logger("store").Debugf("loading")
+	router.Logger("http").Warnf("slow request")
+	router.Logger("http").Errorf("request failed")
+	router.Logger("replication").Warnf("replica behind")
+	router.Logger("replication").Printf("replica connected")
+	if err := router.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	for path, want := range map[string][]string{
+		storeLog: {"DEBUG store: loading"},
+		otherLog: {"ERROR http: request failed", "WARN replication: replica behind"},
+	} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("reading %s: %v", path, err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if len(lines) != len(want) {
+			t.Fatalf("%s holds %q, want %d lines", filepath.Base(path), data, len(want))
+		}
+		for i, line := range lines {
+			if !strings.HasSuffix(line, want[i]) {
+				t.Errorf("%s line %d = %q, want it to end with %q", filepath.Base(path), i, line, want[i])
+			}
+		}
+	}
+
+	if _, err := NewRouter("store=info@carrier-pigeon", Rotation{}); err == nil {
+		t.Fatalf("NewRouter with an unknown sink succeeded, want error")
+	}
+}
+
+func TestRotatingFile_KeepsBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.log")
+	file, err := openRotatingFile(path, Rotation{MaxBytes: 10, Backups: 2})
+	if err != nil {
+		t.Fatalf("openRotatingFile returned error: %v", err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := file.Write([]byte(line)); err != nil {
+			t.Fatalf("Write returned error: %v", err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	for name, want := range map[string]string{
+		"node.log":   "fourth\n",
+		"node.log.1": "third\n",
+		"node.log.2": "second\n",
+	} {
+		data, err := os.ReadFile(filepath.Join(filepath.Dir(path), name))
+		if err != nil || string(data) != want {
+			t.Errorf("%s = (%q, %v), want %q", name, data, err, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3 exists, want only 2 backups kept", path)
+	}
+}
+
+func TestRouter_ReloadRetargetsLoggers(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.log")
+	second := filepath.Join(dir, "second.log")
+	router, err := NewRouter("store=info@file:"+first, Rotation{})
+	if err != nil {
+		t.Fatalf("NewRouter returned error: %v", err)
+	}
+	defer router.Close()
+	logger := router.Logger("store")
+	logger.Debugf("dropped")
+	logger.Printf("before")
+
+	if err := router.Reload("store=debug@file:"+second, Rotation{}); err != nil {
+		t.Fatalf("Reload returned error: %v", err)
+	}
+	logger.Debugf("after")
+
+	// An invalid spec leaves the routes as they were
+	if err := router.Reload("store=loud", Rotation{}); err == nil {
+		t.Fatalf("Reload with an invalid level succeeded, want error")
+	}
+	logger.Debugf("still routed")
+
+	for path, want := range map[string][]string{
+		first:  {"INFO store: before"},
+		second: {"DEBUG store: after", "DEBUG store: still routed"},
+	} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("reading %s: %v", path, err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if len(lines) != len(want) {
+			t.Fatalf("%s holds %q, want %d lines", filepath.Base(path), data, len(want))
+		}
+		for i, line := range lines {
+			if !strings.HasSuffix(line, want[i]) {
+				t.Errorf("%s line %d = %q, want it to end with %q", filepath.Base(path), i, line, want[i])
+			}
+		}
+	}
+}
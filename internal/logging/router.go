@@ -0,0 +1,221 @@
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// DefaultComponent names the route for components the spec does not name.
+const DefaultComponent = "*"
+
+// Route is where one component's messages go and the least serious level
+// sent there.
+type Route struct {
+	Level Level
+	// Sink is "stderr", "stdout", "file:<path>" or "syslog[:<tag>]"
+	Sink string
+}
+
+// Rotation bounds the files routes write to. A file that would grow past
+// MaxBytes is renamed with a ".1" suffix, those before it shifted along
+// to ".2" and so on, and a new file started. Only Backups renamed files are
+// kept. Zero MaxBytes disables rotation.
+type Rotation struct {
+	MaxBytes int64
+	Backups  int
+}
+
+// ParseRoutes parses a comma-separated list of component=level[@sink]
+// routes, such as "store=debug@file:/var/log/blueis/store.log,
+// replication=warn@syslog,*=info". A route without a sink writes to stderr;
+// the "*" route applies to components not named.
+func ParseRoutes(spec string) (map[string]Route, error) {
+	routes := make(map[string]Route)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		component, target, ok := strings.Cut(entry, "=")
+		component = strings.TrimSpace(component)
+		if !ok || component == "" {
+			return nil, fmt.Errorf("log route %q is not component=level[@sink]", entry)
+		}
+		levelName, sink, _ := strings.Cut(target, "@")
+		level, err := ParseLevel(strings.TrimSpace(levelName))
+		if err != nil {
+			return nil, fmt.Errorf("log route %q: %w", entry, err)
+		}
+		sink = strings.TrimSpace(sink)
+		if sink == "" {
+			sink = "stderr"
+		}
+		if _, ok := routes[component]; ok {
+			return nil, fmt.Errorf("component %q is routed twice", component)
+		}
+		routes[component] = Route{Level: level, Sink: sink}
+	}
+	return routes, nil
+}
+
+// Router hands out a Logger per component, writing to the sink and at the
+// level the component's route names. Components sharing a sink share the
+// file or connection behind it.
+type Router struct {
+	mu       sync.Mutex
+	routes   map[string]Route
+	fallback Route
+	rotation Rotation
+	sinks    map[string]io.Writer
+	closers  map[string]io.Closer
+	loggers  map[string]*Logger
+}
+
+// NewRouter parses spec, as ParseRoutes does, and opens every sink it names
+// so a bad path or unreachable syslog is reported at startup rather than
+// when the component first logs.
+func NewRouter(spec string, rotation Rotation) (*Router, error) {
+	router := &Router{loggers: make(map[string]*Logger)}
+	if err := router.Reload(spec, rotation); err != nil {
+		return nil, err
+	}
+	return router, nil
+}
+
+// Reload routes components as spec says from now on. Loggers already handed
+// out follow the new routes. Sinks still in use are kept open, files too if
+// rotation is unchanged; the rest are closed. If spec is invalid or a sink
+// cannot be opened, the routes in place are kept.
+func (router *Router) Reload(spec string, rotation Rotation) error {
+	routes, err := ParseRoutes(spec)
+	if err != nil {
+		return err
+	}
+	fallback := Route{Level: Info, Sink: "stderr"}
+	if route, ok := routes[DefaultComponent]; ok {
+		fallback = route
+	}
+
+	router.mu.Lock()
+	defer router.mu.Unlock()
+
+	sinks := make(map[string]io.Writer)
+	closers := make(map[string]io.Closer)
+	closeOpened := func() {
+		for sink, closer := range closers {
+			if router.closers[sink] != closer {
+				closer.Close()
+			}
+		}
+	}
+	for _, route := range append(mapValues(routes), fallback) {
+		if _, ok := sinks[route.Sink]; ok {
+			continue
+		}
+		if writer, ok := router.sinks[route.Sink]; ok && rotation == router.rotation {
+			sinks[route.Sink] = writer
+			if closer, ok := router.closers[route.Sink]; ok {
+				closers[route.Sink] = closer
+			}
+			continue
+		}
+		writer, closer, err := openSink(route.Sink, rotation)
+		if err != nil {
+			closeOpened()
+			return err
+		}
+		sinks[route.Sink] = writer
+		if closer != nil {
+			closers[route.Sink] = closer
+		}
+	}
+
+	previous := router.closers
+	router.routes, router.fallback, router.rotation = routes, fallback, rotation
+	router.sinks, router.closers = sinks, closers
+	for component, logger := range router.loggers {
+		route := router.route(component)
+		logger.retarget(route.Level, router.sinks[route.Sink])
+	}
+	for sink, closer := range previous {
+		if closers[sink] != closer {
+			closer.Close()
+		}
+	}
+	return nil
+}
+
+func mapValues(routes map[string]Route) []Route {
+	values := make([]Route, 0, len(routes))
+	for _, route := range routes {
+		values = append(values, route)
+	}
+	return values
+}
+
+// openSink opens the sink named, returning the closer to release it with
+// if it holds a file or connection.
+func openSink(sink string, rotation Rotation) (io.Writer, io.Closer, error) {
+	kind, arg, _ := strings.Cut(sink, ":")
+	switch {
+	case sink == "stderr":
+		return os.Stderr, nil, nil
+	case sink == "stdout":
+		return os.Stdout, nil, nil
+	case kind == "file" && arg != "":
+		file, err := openRotatingFile(arg, rotation)
+		if err != nil {
+			return nil, nil, err
+		}
+		return file, file, nil
+	case kind == "syslog":
+		if arg == "" {
+			arg = "blueis"
+		}
+		syslog, err := openSyslog(arg)
+		if err != nil {
+			return nil, nil, fmt.Errorf("opening syslog: %w", err)
+		}
+		return syslog, syslog, nil
+	}
+	return nil, nil, fmt.Errorf("unknown log sink %q, want stderr, stdout, file:<path> or syslog[:<tag>]", sink)
+}
+
+func (router *Router) route(component string) Route {
+	if route, ok := router.routes[component]; ok {
+		return route
+	}
+	return router.fallback
+}
+
+// Logger returns the logger for component, the same one each time.
+func (router *Router) Logger(component string) *Logger {
+	router.mu.Lock()
+	defer router.mu.Unlock()
+
+	if logger, ok := router.loggers[component]; ok {
+		return logger
+	}
+	route := router.route(component)
+	logger := New(component, route.Level, router.sinks[route.Sink])
+	router.loggers[component] = logger
+	return logger
+}
+
+// Close closes the files and syslog connections the router opened.
+// Loggers it handed out must not be used afterwards.
+func (router *Router) Close() error {
+	router.mu.Lock()
+	defer router.mu.Unlock()
+
+	var errs []error
+	for _, closer := range router.closers {
+		errs = append(errs, closer.Close())
+	}
+	router.closers = nil
+	return errors.Join(errs...)
+}
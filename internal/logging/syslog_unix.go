@@ -0,0 +1,39 @@
+//go:build !windows && !plan9
+
+package logging
+
+import "log/syslog"
+
+// syslogSink sends each message to the local syslog daemon at the priority
+// matching its level.
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+func openSyslog(tag string) (*syslogSink, error) {
+	writer, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{writer}, nil
+}
+
+func (sink *syslogSink) Write(p []byte) (int, error) {
+	return sink.writer.Write(p)
+}
+
+func (sink *syslogSink) writeLevel(level Level, message string) error {
+	switch level {
+	case Debug:
+		return sink.writer.Debug(message)
+	case Warn:
+		return sink.writer.Warning(message)
+	case Error:
+		return sink.writer.Err(message)
+	}
+	return sink.writer.Info(message)
+}
+
+func (sink *syslogSink) Close() error {
+	return sink.writer.Close()
+}
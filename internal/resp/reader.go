@@ -0,0 +1,183 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+var ErrProtocol = errors.New("resp: protocol error")
+
+const (
+	defaultBufferSize = 16 * 1024
+	maxArrayLength    = 1024 * 1024
+	maxBulkLength     = 512 * 1024 * 1024
+)
+
+// Reader parses client commands, either RESP arrays of bulk strings or
+// inline commands, from a connection. It reuses its buffers between calls, so
+// steady-state parsing does not allocate.
+type Reader struct {
+	r       *bufio.Reader
+	buf     []byte
+	offsets []int
+	args    [][]byte
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReaderSize(r, defaultBufferSize)}
+}
+
+// Buffered reports how many bytes are already read from the connection but
+// not yet parsed, which tells a server whether more pipelined commands are
+// waiting.
+func (reader *Reader) Buffered() int {
+	return reader.r.Buffered()
+}
+
+// ReadCommand returns the arguments of the next command. The returned slices
+// alias the Reader's internal buffer and are only valid until the next call;
+// callers that keep an argument must copy it.
+func (reader *Reader) ReadCommand() ([][]byte, error) {
+	reader.buf = reader.buf[:0]
+	reader.offsets = reader.offsets[:0]
+
+	for {
+		line, err := reader.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] != '*' {
+			reader.parseInline(line)
+		} else if err := reader.readArray(line); err != nil {
+			return nil, err
+		}
+		if len(reader.offsets) == 0 {
+			// Empty inline lines and empty arrays are no-ops
+			continue
+		}
+		return reader.buildArgs(), nil
+	}
+}
+
+func (reader *Reader) readArray(header []byte) error {
+	count, err := parseInt(header[1:])
+	if err != nil || count > maxArrayLength {
+		return ErrProtocol
+	}
+
+	for range count {
+		line, err := reader.readLine()
+		if err != nil {
+			return err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return ErrProtocol
+		}
+		size, err := parseInt(line[1:])
+		if err != nil || size < 0 || size > maxBulkLength {
+			return ErrProtocol
+		}
+
+		start := len(reader.buf)
+		reader.buf = grow(reader.buf, size+2)
+		if _, err := io.ReadFull(reader.r, reader.buf[start:start+size+2]); err != nil {
+			return err
+		}
+		if reader.buf[start+size] != '\r' || reader.buf[start+size+1] != '\n' {
+			return ErrProtocol
+		}
+		reader.buf = reader.buf[:start+size]
+		reader.offsets = append(reader.offsets, start, start+size)
+	}
+	return nil
+}
+
+func (reader *Reader) parseInline(line []byte) {
+	start := len(reader.buf)
+	reader.buf = append(reader.buf, line...)
+	fields := reader.buf[start:]
+
+	i := 0
+	for i < len(fields) {
+		for i < len(fields) && isSpace(fields[i]) {
+			i++
+		}
+		begin := i
+		for i < len(fields) && !isSpace(fields[i]) {
+			i++
+		}
+		if i > begin {
+			reader.offsets = append(reader.offsets, start+begin, start+i)
+		}
+	}
+}
+
+func (reader *Reader) buildArgs() [][]byte {
+	reader.args = reader.args[:0]
+	for i := 0; i < len(reader.offsets); i += 2 {
+		reader.args = append(reader.args, reader.buf[reader.offsets[i]:reader.offsets[i+1]:reader.offsets[i+1]])
+	}
+	return reader.args
+}
+
+// readLine returns the next line without its trailing CRLF. The slice points
+// into the bufio buffer and is only valid until the next read.
+func (reader *Reader) readLine() ([]byte, error) {
+	line, err := reader.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, ErrProtocol
+	}
+	if err != nil {
+		return nil, err
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, nil
+}
+
+func grow(buf []byte, n int) []byte {
+	if cap(buf)-len(buf) < n {
+		next := make([]byte, len(buf), 2*cap(buf)+n)
+		copy(next, buf)
+		buf = next
+	}
+	return buf[:len(buf)+n]
+}
+
+func parseInt(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, ErrProtocol
+	}
+	negative := b[0] == '-'
+	if negative {
+		b = b[1:]
+		if len(b) == 0 {
+			return 0, ErrProtocol
+		}
+	}
+
+	n := 0
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, ErrProtocol
+		}
+		n = n*10 + int(c-'0')
+		if n > maxBulkLength {
+			return 0, ErrProtocol
+		}
+	}
+	if negative {
+		return -n, nil
+	}
+	return n, nil
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r'
+}
@@ -0,0 +1,149 @@
+package resp
+
+import (
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Reply is a reply read back from a RESP server, for clients and tests
+// that talk to one.
+type Reply struct {
+	// Type is the reply's RESP type byte, such as '+' for a simple string
+	// or '*' for an array
+	Type byte
+	// Text holds a string, error, integer, double, boolean or big number
+	// as it was sent
+	Text string
+	// Null is set for a null, including RESP2's null bulk string and null
+	// array
+	Null bool
+	// Elements holds an array's, set's or push's elements, or a map's keys
+	// and values in turn
+	Elements []Reply
+}
+
+// String renders reply on one line in the style of redis-cli, so two
+// replies can be compared and shown in a diff.
+func (reply Reply) String() string {
+	var b strings.Builder
+	reply.render(&b)
+	return b.String()
+}
+
+func (reply Reply) render(b *strings.Builder) {
+	if reply.Null {
+		b.WriteString("(nil)")
+		return
+	}
+	switch reply.Type {
+	case '+':
+		b.WriteString(reply.Text)
+	case '-':
+		b.WriteString("(error) " + reply.Text)
+	case ':':
+		b.WriteString("(integer) " + reply.Text)
+	case ',':
+		b.WriteString("(double) " + reply.Text)
+	case '(':
+		b.WriteString("(big number) " + reply.Text)
+	case '#':
+		if reply.Text == "t" {
+			b.WriteString("(true)")
+		} else {
+			b.WriteString("(false)")
+		}
+	case '$':
+		b.WriteString(strconv.Quote(reply.Text))
+	case '%':
+		b.WriteByte('{')
+		for i, element := range reply.Elements {
+			switch {
+			case i%2 == 1:
+				b.WriteString(": ")
+			case i > 0:
+				b.WriteString(", ")
+			}
+			element.render(b)
+		}
+		b.WriteByte('}')
+	default:
+		if len(reply.Elements) == 0 {
+			b.WriteString("(empty array)")
+			return
+		}
+		b.WriteByte('[')
+		for i, element := range reply.Elements {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			element.render(b)
+		}
+		b.WriteByte(']')
+	}
+}
+
+// ReadReply reads the next reply a server sent, in RESP2 or RESP3.
+// Verbatim strings are read as bulk strings, blob errors as errors, and
+// attributes are skipped, as they annotate the reply after them.
+func (reader *Reader) ReadReply() (Reply, error) {
+	line, err := reader.readLine()
+	if err != nil {
+		return Reply{}, err
+	}
+	if len(line) == 0 {
+		return Reply{}, ErrProtocol
+	}
+	reply := Reply{Type: line[0]}
+	switch reply.Type {
+	case '+', '-', ':', ',', '(', '#':
+		reply.Text = string(line[1:])
+	case '_':
+		reply.Null = true
+	case '$', '=', '!':
+		size, err := parseInt(line[1:])
+		if err != nil || size < -1 {
+			return Reply{}, ErrProtocol
+		}
+		if size == -1 {
+			reply.Null = true
+			break
+		}
+		text := make([]byte, size+2)
+		if _, err := io.ReadFull(reader.r, text); err != nil {
+			return Reply{}, err
+		}
+		reply.Text = string(text[:size])
+		switch reply.Type {
+		case '=':
+			// A verbatim string starts with its format, such as "txt:"
+			reply.Type, reply.Text = '$', reply.Text[min(4, len(reply.Text)):]
+		case '!':
+			reply.Type = '-'
+		}
+	case '*', '~', '>', '%', '|':
+		count, err := parseInt(line[1:])
+		if err != nil || count < -1 || count > maxArrayLength {
+			return Reply{}, ErrProtocol
+		}
+		if count == -1 {
+			reply.Null = true
+			break
+		}
+		if reply.Type == '%' || reply.Type == '|' {
+			count *= 2
+		}
+		reply.Elements = make([]Reply, count)
+		for i := range reply.Elements {
+			if reply.Elements[i], err = reader.ReadReply(); err != nil {
+				return Reply{}, err
+			}
+		}
+		if reply.Type == '|' {
+			return reader.ReadReply()
+		}
+	default:
+		return Reply{}, ErrProtocol
+	}
+	return reply, nil
+}
@@ -0,0 +1,291 @@
+package resp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func argsToStrings(args [][]byte) []string {
+	out := make([]string, len(args))
+	for i, arg := range args {
+		out[i] = string(arg)
+	}
+	return out
+}
+
+func TestReader_ParsesArraysAndInlineCommands(t *testing.T) {
+	input := "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$7\r\nbar baz\r\n" +
+		"PING\r\n" +
+		"\r\n" +
+		"*0\r\n" +
+		"  GET   foo \r\n" +
+		"*2\r\n$3\r\nGET\r\n$0\r\n\r\n"
+
+	reader := NewReader(strings.NewReader(input))
+
+	want := [][]string{
+		{"SET", "foo", "bar baz"},
+		{"PING"},
+		{"GET", "foo"},
+		{"GET", ""},
+	}
+	for i, w := range want {
+		args, err := reader.ReadCommand()
+		if err != nil {
+			t.Fatalf("command %d: ReadCommand returned error: %v", i, err)
+		}
+		if got := argsToStrings(args); strings.Join(got, "|") != strings.Join(w, "|") {
+			t.Fatalf("command %d = %q, want %q", i, got, w)
+		}
+	}
+
+	if _, err := reader.ReadCommand(); err != io.EOF {
+		t.Fatalf("ReadCommand at end of input returned %v, want io.EOF", err)
+	}
+}
+
+func TestReader_BinarySafeBulkStrings(t *testing.T) {
+	value := "line1\r\nline2\x00\xff"
+	input := "*2\r\n$4\r\nECHO\r\n$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+
+	args, err := NewReader(strings.NewReader(input)).ReadCommand()
+	if err != nil {
+		t.Fatalf("ReadCommand returned error: %v", err)
+	}
+	if string(args[1]) != value {
+		t.Fatalf("bulk argument = %q, want %q", args[1], value)
+	}
+}
+
+func TestReader_RejectsMalformedInput(t *testing.T) {
+	tests := []string{
+		"*1\r\n:5\r\n",
+		"*1\r\n$abc\r\n",
+		"*1\r\n$3\r\nfoobar\r\n",
+		"*x\r\n",
+	}
+
+	for _, input := range tests {
+		if _, err := NewReader(strings.NewReader(input)).ReadCommand(); !errors.Is(err, ErrProtocol) {
+			t.Errorf("ReadCommand(%q) returned %v, want ErrProtocol", input, err)
+		}
+	}
+}
+
+func TestWriter_SerialisesReplies(t *testing.T) {
+	var out bytes.Buffer
+	writer := NewWriter(&out)
+
+	_ = writer.WriteSimpleString("OK")
+	_ = writer.WriteError("ERR unknown command")
+	_ = writer.WriteInteger(-42)
+	_ = writer.WriteBulkString("hello")
+	_ = writer.WriteBulk([]byte(""))
+	_ = writer.WriteNull()
+	_ = writer.WriteArray(2)
+	_ = writer.WriteBulkString("a")
+	_ = writer.WriteInteger(1)
+
+	if out.Len() != 0 {
+		t.Fatalf("Writer sent %d bytes before Flush", out.Len())
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("Flush returned error: %v", err)
+	}
+
+	want := "+OK\r\n-ERR unknown command\r\n:-42\r\n$5\r\nhello\r\n$0\r\n\r\n$-1\r\n*2\r\n$1\r\na\r\n:1\r\n"
+	if out.String() != want {
+		t.Fatalf("Writer output = %q, want %q", out.String(), want)
+	}
+}
+
+func TestWriter_KeepsErrorsOnOneLine(t *testing.T) {
+	var out bytes.Buffer
+	writer := NewWriter(&out)
+
+	_ = writer.WriteError("ERR setting key a: too large\nsetting key b:\r\ntoo large")
+	_ = writer.Flush()
+
+	if want := "-ERR setting key a: too large setting key b: too large\r\n"; out.String() != want {
+		t.Fatalf("Writer output = %q, want %q", out.String(), want)
+	}
+}
+
+// repeatingReader replays the same bytes forever so parsing can be measured
+// without the input itself allocating.
+type repeatingReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *repeatingReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		c := copy(p[n:], r.data[r.pos:])
+		n += c
+		r.pos = (r.pos + c) % len(r.data)
+	}
+	return n, nil
+}
+
+const setCommand = "*3\r\n$3\r\nSET\r\n$8\r\nkey:1234\r\n$16\r\n0123456789abcdef\r\n"
+
+func TestReader_SteadyStateDoesNotAllocate(t *testing.T) {
+	reader := NewReader(&repeatingReader{data: []byte(setCommand)})
+	// Warm up the internal buffers
+	for range 10 {
+		if _, err := reader.ReadCommand(); err != nil {
+			t.Fatalf("ReadCommand returned error: %v", err)
+		}
+	}
+
+	allocs := testing.AllocsPerRun(1000, func() {
+		_, _ = reader.ReadCommand()
+	})
+	if allocs != 0 {
+		t.Fatalf("ReadCommand allocated %v times per command, want 0", allocs)
+	}
+}
+
+func TestWriter_DoesNotAllocate(t *testing.T) {
+	writer := NewWriter(io.Discard)
+	value := []byte("0123456789abcdef")
+
+	allocs := testing.AllocsPerRun(1000, func() {
+		_ = writer.WriteArray(3)
+		_ = writer.WriteInteger(123456)
+		_ = writer.WriteBulk(value)
+		_ = writer.WriteSimpleString("OK")
+		_ = writer.Flush()
+	})
+	if allocs != 0 {
+		t.Fatalf("Writer allocated %v times per reply, want 0", allocs)
+	}
+}
+
+func BenchmarkReader_ReadCommand(b *testing.B) {
+	reader := NewReader(&repeatingReader{data: []byte(setCommand)})
+	b.ReportAllocs()
+	b.SetBytes(int64(len(setCommand)))
+	for b.Loop() {
+		if _, err := reader.ReadCommand(); err != nil {
+			b.Fatalf("ReadCommand returned error: %v", err)
+		}
+	}
+}
+
+func BenchmarkWriter_BulkReply(b *testing.B) {
+	writer := NewWriter(io.Discard)
+	value := []byte("0123456789abcdef")
+	b.ReportAllocs()
+	for b.Loop() {
+		_ = writer.WriteBulk(value)
+	}
+	_ = writer.Flush()
+}
+
+func TestWriter_SerialisesRESP3Replies(t *testing.T) {
+	write := func(writer *Writer) {
+		_ = writer.WriteNull()
+		_ = writer.WriteMap(1)
+		_ = writer.WriteBulkString("k")
+		_ = writer.WriteBoolean(true)
+		_ = writer.WriteSet(2)
+		_ = writer.WriteDouble(1.5)
+		_ = writer.WriteDouble(math.Inf(-1))
+		_ = writer.WritePush(2)
+		_ = writer.WriteBulkString("invalidate")
+		_ = writer.WriteBoolean(false)
+		_ = writer.Flush()
+	}
+
+	var resp2 bytes.Buffer
+	write(NewWriter(&resp2))
+	want := "$-1\r\n*2\r\n$1\r\nk\r\n:1\r\n*2\r\n$3\r\n1.5\r\n$4\r\n-inf\r\n*2\r\n$10\r\ninvalidate\r\n:0\r\n"
+	if resp2.String() != want {
+		t.Fatalf("RESP2 output = %q, want %q", resp2.String(), want)
+	}
+
+	var resp3 bytes.Buffer
+	writer := NewWriter(&resp3)
+	if err := writer.SetProtocol(3); err != nil {
+		t.Fatalf("SetProtocol(3) returned error: %v", err)
+	}
+	write(writer)
+	want = "_\r\n%1\r\n$1\r\nk\r\n#t\r\n~2\r\n,1.5\r\n,-inf\r\n>2\r\n$10\r\ninvalidate\r\n#f\r\n"
+	if resp3.String() != want {
+		t.Fatalf("RESP3 output = %q, want %q", resp3.String(), want)
+	}
+
+	if err := writer.SetProtocol(4); !errors.Is(err, ErrUnsupportedProtocol) {
+		t.Fatalf("SetProtocol(4) returned %v, want ErrUnsupportedProtocol", err)
+	}
+	if writer.Protocol() != 3 {
+		t.Fatalf("Protocol = %d after a rejected switch, want 3", writer.Protocol())
+	}
+
+	allocs := testing.AllocsPerRun(1000, func() {
+		_ = writer.WritePush(2)
+		_ = writer.WriteDouble(3.25)
+		_ = writer.WriteBoolean(true)
+		_ = writer.Flush()
+	})
+	if allocs != 0 {
+		t.Fatalf("RESP3 replies allocated %v times, want 0", allocs)
+	}
+}
+
+func TestReader_ReadsRepliesWritten(t *testing.T) {
+	var buf bytes.Buffer
+	writer := NewWriter(&buf)
+	_ = writer.WriteSimpleString("OK")
+	_ = writer.WriteError("ERR no such key")
+	_ = writer.WriteInteger(-42)
+	_ = writer.WriteBulkString("a \"quoted\"\r\nvalue")
+	_ = writer.WriteNull()
+	_ = writer.WriteArray(3)
+	_ = writer.WriteBulkString("x")
+	_ = writer.WriteArray(0)
+	_ = writer.WriteNull()
+	_ = writer.SetProtocol(3)
+	_ = writer.WriteMap(1)
+	_ = writer.WriteBulkString("k")
+	_ = writer.WriteDouble(1.5)
+	_ = writer.WriteBoolean(false)
+	_ = writer.Flush()
+	buf.WriteString("|1\r\n+ttl\r\n:3\r\n=8\r\ntxt:text\r\n*-1\r\n")
+
+	reader := NewReader(&buf)
+	want := []string{
+		"OK",
+		"(error) ERR no such key",
+		"(integer) -42",
+		`"a \"quoted\"\r\nvalue"`,
+		"(nil)",
+		`["x", (empty array), (nil)]`,
+		`{"k": (double) 1.5}`,
+		"(false)",
+		`"text"`,
+		"(nil)",
+	}
+	for i, w := range want {
+		reply, err := reader.ReadReply()
+		if err != nil {
+			t.Fatalf("reply %d: ReadReply returned error: %v", i, err)
+		}
+		if reply.String() != w {
+			t.Fatalf("reply %d = %s, want %s", i, reply, w)
+		}
+	}
+	if _, err := reader.ReadReply(); err != io.EOF {
+		t.Fatalf("ReadReply at end of input returned %v, want io.EOF", err)
+	}
+	if _, err := NewReader(strings.NewReader("?oops\r\n")).ReadReply(); !errors.Is(err, ErrProtocol) {
+		t.Fatalf("ReadReply of an unknown type returned %v, want ErrProtocol", err)
+	}
+}
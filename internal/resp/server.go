@@ -0,0 +1,212 @@
+package resp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrServerClosed = errors.New("resp: server closed")
+
+// Handler answers a command by writing its reply to w. The arguments alias
+// the connection's read buffer and are only valid until ServeRESP returns.
+// Handlers must not flush w; the server decides when replies are sent.
+type Handler interface {
+	ServeRESP(w *Writer, args [][]byte)
+}
+
+type HandlerFunc func(w *Writer, args [][]byte)
+
+func (f HandlerFunc) ServeRESP(w *Writer, args [][]byte) {
+	f(w, args)
+}
+
+// Server serves RESP clients over TCP. Each connection is read by a single
+// goroutine that answers commands into the connection's write buffer as
+// they arrive and only flushes it once no more input is waiting, so a client
+// that pipelines commands has them all read and answered without waiting
+// for each reply, and gets the replies back in as few writes as it sent
+// the commands in.
+//
+// HELLO and QUIT are answered by the server itself; every other command is
+// passed to the Handler.
+type Server struct {
+	handler Handler
+	nextID  atomic.Int64
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+func NewServer(handler Handler) *Server {
+	return &Server{
+		handler:   handler,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// ListenAndServe listens on addr and serves connections until Close.
+func (server *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return server.Serve(listener)
+}
+
+// Serve accepts connections on listener until Close, serving each on its own
+// goroutine. It always returns a non-nil error, ErrServerClosed after Close.
+func (server *Server) Serve(listener net.Listener) error {
+	server.mu.Lock()
+	if server.closed {
+		server.mu.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	server.listeners[listener] = struct{}{}
+	server.mu.Unlock()
+	defer func() {
+		server.mu.Lock()
+		delete(server.listeners, listener)
+		server.mu.Unlock()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			server.mu.Lock()
+			closed := server.closed
+			server.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if !server.addConn(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go func() {
+			defer server.removeConn(conn)
+			server.ServeConn(conn)
+		}()
+	}
+}
+
+// Close stops every listener, closes every connection and waits for their
+// goroutines to return. Replies not yet flushed are dropped.
+func (server *Server) Close() error {
+	server.mu.Lock()
+	server.closed = true
+	for listener := range server.listeners {
+		listener.Close()
+	}
+	for conn := range server.conns {
+		conn.Close()
+	}
+	server.mu.Unlock()
+
+	server.wg.Wait()
+	return nil
+}
+
+// addConn records conn so Close can close it. It reports false once the
+// server is closed.
+func (server *Server) addConn(conn net.Conn) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.closed {
+		return false
+	}
+	server.conns[conn] = struct{}{}
+	server.wg.Add(1)
+	return true
+}
+
+func (server *Server) removeConn(conn net.Conn) {
+	conn.Close()
+	server.mu.Lock()
+	delete(server.conns, conn)
+	server.mu.Unlock()
+	server.wg.Done()
+}
+
+// ServeConn serves commands read from conn until it is closed, the client
+// sends QUIT or a protocol error. It does not close conn.
+func (server *Server) ServeConn(conn io.ReadWriter) {
+	id := server.nextID.Add(1)
+	reader := NewReader(conn)
+	writer := NewWriter(conn)
+
+	for {
+		args, err := reader.ReadCommand()
+		if err != nil {
+			if errors.Is(err, ErrProtocol) {
+				_ = writer.WriteError("ERR Protocol error")
+			}
+			_ = writer.Flush()
+			return
+		}
+
+		quit := false
+		switch {
+		case bytes.EqualFold(args[0], []byte("HELLO")):
+			server.hello(writer, args, id)
+		case bytes.EqualFold(args[0], []byte("QUIT")):
+			_ = writer.WriteSimpleString("OK")
+			quit = true
+		default:
+			server.handler.ServeRESP(writer, args)
+		}
+
+		// Later commands that have already arrived are answered before
+		// anything is sent, so a pipeline is never held up waiting on the
+		// client to read each reply
+		if quit || reader.Buffered() == 0 {
+			if err := writer.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// hello negotiates the protocol version, HELLO [protover], and describes
+// the server.
+func (server *Server) hello(writer *Writer, args [][]byte, id int64) {
+	if len(args) > 1 {
+		version, err := strconv.Atoi(string(args[1]))
+		if err != nil {
+			_ = writer.WriteError("ERR Protocol version is not an integer or out of range")
+			return
+		}
+		if writer.SetProtocol(version) != nil {
+			_ = writer.WriteError("NOPROTO unsupported protocol version")
+			return
+		}
+	}
+
+	_ = writer.WriteMap(6)
+	_ = writer.WriteBulkString("server")
+	_ = writer.WriteBulkString("blueis")
+	_ = writer.WriteBulkString("proto")
+	_ = writer.WriteInteger(int64(writer.Protocol()))
+	_ = writer.WriteBulkString("id")
+	_ = writer.WriteInteger(id)
+	_ = writer.WriteBulkString("mode")
+	_ = writer.WriteBulkString("standalone")
+	_ = writer.WriteBulkString("role")
+	_ = writer.WriteBulkString("master")
+	_ = writer.WriteBulkString("modules")
+	_ = writer.WriteArray(0)
+}
@@ -0,0 +1,182 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+var testHandler = HandlerFunc(func(w *Writer, args [][]byte) {
+	switch strings.ToUpper(string(args[0])) {
+	case "PING":
+		_ = w.WriteSimpleString("PONG")
+	case "ECHO":
+		_ = w.WriteBulk(args[1])
+	case "GET":
+		_ = w.WriteNull()
+	default:
+		_ = w.WriteError("ERR unknown command")
+	}
+})
+
+// countingConn reads from in and counts the writes made to out.
+type countingConn struct {
+	in     io.Reader
+	out    bytes.Buffer
+	writes int
+}
+
+func (conn *countingConn) Read(p []byte) (int, error) {
+	return conn.in.Read(p)
+}
+
+func (conn *countingConn) Write(p []byte) (int, error) {
+	conn.writes++
+	return conn.out.Write(p)
+}
+
+func startTestServer(t testing.TB) (*Server, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen returned error: %v", err)
+	}
+	server := NewServer(testHandler)
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(func() { _ = server.Close() })
+	return server, listener.Addr().String()
+}
+
+func TestServer_AnswersPipelinedCommandsInOrder(t *testing.T) {
+	_, addr := startTestServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial returned error: %v", err)
+	}
+	defer conn.Close()
+
+	// Every command is sent before any reply is read, which would
+	// deadlock a server answering one command per round trip once the
+	// socket buffers filled
+	const commands = 10000
+	sent := make(chan error, 1)
+	go func() {
+		w := bufio.NewWriter(conn)
+		for i := range commands {
+			fmt.Fprintf(w, "*2\r\n$4\r\nECHO\r\n$%d\r\n%d\r\n", len(fmt.Sprint(i)), i)
+		}
+		sent <- w.Flush()
+	}()
+
+	r := bufio.NewReader(conn)
+	for i := range commands {
+		want := fmt.Sprintf("$%d\r\n%d\r\n", len(fmt.Sprint(i)), i)
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(r, got); err != nil {
+			t.Fatalf("reading reply %d: %v", i, err)
+		}
+		if string(got) != want {
+			t.Fatalf("reply %d = %q, want %q", i, got, want)
+		}
+	}
+	if err := <-sent; err != nil {
+		t.Fatalf("writing commands: %v", err)
+	}
+}
+
+func TestServer_FlushesOncePerPipeline(t *testing.T) {
+	conn := &countingConn{in: strings.NewReader(strings.Repeat("PING\r\n", 100))}
+	NewServer(testHandler).ServeConn(conn)
+
+	if want := strings.Repeat("+PONG\r\n", 100); conn.out.String() != want {
+		t.Fatalf("ServeConn wrote %q, want 100 PONGs", conn.out.String())
+	}
+	if conn.writes != 1 {
+		t.Fatalf("ServeConn wrote %d times, want the pipeline answered in 1 write", conn.writes)
+	}
+}
+
+func TestServer_NegotiatesProtocolWithHello(t *testing.T) {
+	conn := &countingConn{in: strings.NewReader("GET k\r\nHELLO 4\r\nHELLO 3\r\nGET k\r\nQUIT\r\nPING\r\n")}
+	NewServer(testHandler).ServeConn(conn)
+
+	hello := "%6\r\n$6\r\nserver\r\n$6\r\nblueis\r\n$5\r\nproto\r\n:3\r\n$2\r\nid\r\n:1\r\n" +
+		"$4\r\nmode\r\n$10\r\nstandalone\r\n$4\r\nrole\r\n$6\r\nmaster\r\n$7\r\nmodules\r\n*0\r\n"
+	want := "$-1\r\n-NOPROTO unsupported protocol version\r\n" + hello + "_\r\n+OK\r\n"
+	if conn.out.String() != want {
+		t.Fatalf("ServeConn wrote %q, want %q", conn.out.String(), want)
+	}
+}
+
+func TestServer_CloseDisconnectsClients(t *testing.T) {
+	server, addr := startTestServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial returned error: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("PING\r\n")); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+	r := bufio.NewReader(conn)
+	if line, err := r.ReadString('\n'); err != nil || line != "+PONG\r\n" {
+		t.Fatalf("PING = %q, %v, want +PONG", line, err)
+	}
+
+	if err := server.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	if _, err := r.ReadString('\n'); !errors.Is(err, io.EOF) {
+		t.Fatalf("read after Close returned %v, want EOF", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen returned error: %v", err)
+	}
+	if err := server.Serve(listener); !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("Serve after Close returned %v, want ErrServerClosed", err)
+	}
+}
+
+// benchmarkPipeline sends b.N PINGs in pipelines of depth commands,
+// reading a pipeline's replies before sending the next, and reports the
+// commands answered per second.
+func benchmarkPipeline(b *testing.B, depth int) {
+	_, addr := startTestServer(b)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		b.Fatalf("Dial returned error: %v", err)
+	}
+	defer conn.Close()
+
+	pipeline := []byte(strings.Repeat("*1\r\n$4\r\nPING\r\n", depth))
+	replies := make([]byte, depth*len("+PONG\r\n"))
+	b.SetBytes(int64(len(pipeline) / depth))
+	b.ResetTimer()
+
+	for sent := 0; sent < b.N; sent += depth {
+		if _, err := conn.Write(pipeline); err != nil {
+			b.Fatalf("Write returned error: %v", err)
+		}
+		if _, err := io.ReadFull(conn, replies); err != nil {
+			b.Fatalf("reading replies: %v", err)
+		}
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "cmds/s")
+}
+
+func BenchmarkServer_Lockstep(b *testing.B) {
+	benchmarkPipeline(b, 1)
+}
+
+func BenchmarkServer_Pipelined16(b *testing.B) {
+	benchmarkPipeline(b, 16)
+}
+
+func BenchmarkServer_Pipelined128(b *testing.B) {
+	benchmarkPipeline(b, 128)
+}
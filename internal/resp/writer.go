@@ -0,0 +1,190 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var ErrUnsupportedProtocol = errors.New("resp: unsupported protocol version")
+
+var lineBreaks = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ")
+
+// Writer serialises RESP replies into a buffered connection. Nothing is sent
+// until Flush, which lets a server answer a run of pipelined commands with a
+// single write.
+//
+// Writers start out speaking RESP2. After SetProtocol(3) the typed replies,
+// such as maps, booleans and doubles, use their RESP3 encodings; under RESP2
+// each falls back to the nearest RESP2 reply, so a server can write the
+// same replies whichever version the client chose.
+type Writer struct {
+	w        *bufio.Writer
+	scratch  [32]byte
+	protocol int
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriterSize(w, defaultBufferSize), protocol: 2}
+}
+
+// SetProtocol switches the writer to RESP version 2 or 3, as a client asks
+// with HELLO.
+func (writer *Writer) SetProtocol(version int) error {
+	if version != 2 && version != 3 {
+		return ErrUnsupportedProtocol
+	}
+	writer.protocol = version
+	return nil
+}
+
+func (writer *Writer) Protocol() int {
+	return writer.protocol
+}
+
+func (writer *Writer) WriteSimpleString(s string) error {
+	writer.w.WriteByte('+')
+	writer.w.WriteString(s)
+	_, err := writer.w.WriteString("\r\n")
+	return err
+}
+
+// WriteError writes an error reply. msg should start with an error prefix
+// such as "ERR" or "WRONGTYPE", as clients use it to classify errors. Line
+// breaks in msg, such as those joining several errors, are sent as spaces,
+// as an error reply is a single line.
+func (writer *Writer) WriteError(msg string) error {
+	writer.w.WriteByte('-')
+	writer.w.WriteString(lineBreaks.Replace(msg))
+	_, err := writer.w.WriteString("\r\n")
+	return err
+}
+
+func (writer *Writer) WriteInteger(n int64) error {
+	return writer.writePrefixed(':', n)
+}
+
+func (writer *Writer) WriteBulk(b []byte) error {
+	writer.writePrefixed('$', int64(len(b)))
+	writer.w.Write(b)
+	_, err := writer.w.WriteString("\r\n")
+	return err
+}
+
+func (writer *Writer) WriteBulkString(s string) error {
+	writer.writePrefixed('$', int64(len(s)))
+	writer.w.WriteString(s)
+	_, err := writer.w.WriteString("\r\n")
+	return err
+}
+
+// WriteNull writes a null, which is the null bulk string under RESP2.
+func (writer *Writer) WriteNull() error {
+	if writer.protocol == 2 {
+		_, err := writer.w.WriteString("$-1\r\n")
+		return err
+	}
+	_, err := writer.w.WriteString("_\r\n")
+	return err
+}
+
+// WriteArray writes an array header; the caller then writes n elements.
+func (writer *Writer) WriteArray(n int) error {
+	return writer.writePrefixed('*', int64(n))
+}
+
+// WriteMap writes a map header; the caller then writes n keys, each
+// followed by its value. Under RESP2 it is an array of 2n elements.
+func (writer *Writer) WriteMap(n int) error {
+	if writer.protocol == 2 {
+		return writer.writePrefixed('*', 2*int64(n))
+	}
+	return writer.writePrefixed('%', int64(n))
+}
+
+// WriteSet writes a set header; the caller then writes n elements. Under
+// RESP2 it is an array.
+func (writer *Writer) WriteSet(n int) error {
+	if writer.protocol == 2 {
+		return writer.writePrefixed('*', int64(n))
+	}
+	return writer.writePrefixed('~', int64(n))
+}
+
+// WriteBoolean writes a boolean, which is the integer 1 or 0 under RESP2.
+func (writer *Writer) WriteBoolean(b bool) error {
+	if writer.protocol == 2 {
+		if b {
+			return writer.WriteInteger(1)
+		}
+		return writer.WriteInteger(0)
+	}
+	var err error
+	if b {
+		_, err = writer.w.WriteString("#t\r\n")
+	} else {
+		_, err = writer.w.WriteString("#f\r\n")
+	}
+	return err
+}
+
+// WriteDouble writes a floating point number, which is a bulk string of the
+// same text under RESP2.
+func (writer *Writer) WriteDouble(f float64) error {
+	var text []byte
+	switch {
+	case math.IsInf(f, 1):
+		text = append(writer.scratch[:0], "inf"...)
+	case math.IsInf(f, -1):
+		text = append(writer.scratch[:0], "-inf"...)
+	case math.IsNaN(f):
+		text = append(writer.scratch[:0], "nan"...)
+	default:
+		text = strconv.AppendFloat(writer.scratch[:0], f, 'g', -1, 64)
+	}
+	if writer.protocol == 2 {
+		// text is in scratch, which writePrefixed would overwrite
+		var size [4]byte
+		writer.w.WriteByte('$')
+		writer.w.Write(strconv.AppendInt(size[:0], int64(len(text)), 10))
+		writer.w.WriteString("\r\n")
+	} else {
+		writer.w.WriteByte(',')
+	}
+	writer.w.Write(text)
+	_, err := writer.w.WriteString("\r\n")
+	return err
+}
+
+// WritePush writes the header of an out-of-band push, such as a pub/sub
+// message or an invalidation; the caller then writes n elements, the first
+// naming the kind of push. Pushes may be written between any two replies,
+// but not inside one, so a server must hand them to the goroutine writing
+// replies rather than write them from elsewhere. Under RESP2 a push is an
+// array, which clients only expect on a connection in pub/sub mode.
+func (writer *Writer) WritePush(n int) error {
+	if writer.protocol == 2 {
+		return writer.writePrefixed('*', int64(n))
+	}
+	return writer.writePrefixed('>', int64(n))
+}
+
+func (writer *Writer) Flush() error {
+	return writer.w.Flush()
+}
+
+// Buffered reports how many reply bytes are waiting to be flushed.
+func (writer *Writer) Buffered() int {
+	return writer.w.Buffered()
+}
+
+func (writer *Writer) writePrefixed(prefix byte, n int64) error {
+	buf := append(writer.scratch[:0], prefix)
+	buf = strconv.AppendInt(buf, n, 10)
+	buf = append(buf, '\r', '\n')
+	_, err := writer.w.Write(buf)
+	return err
+}
@@ -0,0 +1,175 @@
+package sketch
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+var ErrDimensionMismatch = errors.New("sketch: sketches have different dimensions")
+
+var ErrInvalidEncoding = errors.New("sketch: invalid count-min sketch encoding")
+
+// countMinMagic prefixes encoded sketches so they can be told apart from
+// other values.
+const countMinMagic = "\x00cms\x01"
+
+const countMinHeaderSize = len(countMinMagic) + 4 + 4 + 8
+
+// CountMin is a count-min sketch: an approximate frequency counter that
+// answers "how often was this item added" in fixed memory, never
+// underestimating and overestimating by at most errorRate * Count() with
+// the configured probability. Counters saturate at math.MaxUint32.
+type CountMin struct {
+	width  uint32
+	depth  uint32
+	total  uint64
+	counts []uint32
+}
+
+// NewCountMin creates a sketch with depth rows of width counters.
+func NewCountMin(width int, depth int) (*CountMin, error) {
+	if width < 1 || depth < 1 {
+		return nil, fmt.Errorf("sketch: width and depth must be positive, got %dx%d", width, depth)
+	}
+	if int64(width)*int64(depth) > math.MaxInt32 {
+		return nil, fmt.Errorf("sketch: %dx%d counters is too large", width, depth)
+	}
+	return &CountMin{width: uint32(width), depth: uint32(depth), counts: make([]uint32, width*depth)}, nil
+}
+
+// NewCountMinWithError sizes a sketch so estimates exceed the true count by
+// at most errorRate * Count() with the given probability of failure.
+func NewCountMinWithError(errorRate float64, probability float64) (*CountMin, error) {
+	if errorRate <= 0 || errorRate >= 1 || probability <= 0 || probability >= 1 {
+		return nil, fmt.Errorf("sketch: error rate and probability must be between 0 and 1")
+	}
+	width := int(math.Ceil(math.E / errorRate))
+	depth := int(math.Ceil(math.Log(1 / probability)))
+	return NewCountMin(width, depth)
+}
+
+func (cms *CountMin) Width() int {
+	return int(cms.width)
+}
+
+func (cms *CountMin) Depth() int {
+	return int(cms.depth)
+}
+
+// Count returns the total of every increment added to the sketch.
+func (cms *CountMin) Count() uint64 {
+	return cms.total
+}
+
+// Add increments item by n and returns its new estimated count.
+func (cms *CountMin) Add(item string, n uint32) uint32 {
+	h1, h2 := hash(item)
+	estimate := uint32(math.MaxUint32)
+	for row := range cms.depth {
+		i := cms.index(row, h1, h2)
+		cms.counts[i] = saturatingAdd(cms.counts[i], n)
+		estimate = min(estimate, cms.counts[i])
+	}
+	cms.total += uint64(n)
+	return estimate
+}
+
+// Estimate returns the estimated count of item.
+func (cms *CountMin) Estimate(item string) uint32 {
+	h1, h2 := hash(item)
+	estimate := uint32(math.MaxUint32)
+	for row := range cms.depth {
+		estimate = min(estimate, cms.counts[cms.index(row, h1, h2)])
+	}
+	return estimate
+}
+
+// Merge adds other's counts into cms. Both sketches must have the same
+// dimensions.
+func (cms *CountMin) Merge(other *CountMin) error {
+	if cms.width != other.width || cms.depth != other.depth {
+		return ErrDimensionMismatch
+	}
+	for i, count := range other.counts {
+		cms.counts[i] = saturatingAdd(cms.counts[i], count)
+	}
+	cms.total += other.total
+	return nil
+}
+
+func (cms *CountMin) MarshalBinary() ([]byte, error) {
+	data := make([]byte, countMinHeaderSize+4*len(cms.counts))
+	n := copy(data, countMinMagic)
+	binary.LittleEndian.PutUint32(data[n:], cms.width)
+	binary.LittleEndian.PutUint32(data[n+4:], cms.depth)
+	binary.LittleEndian.PutUint64(data[n+8:], cms.total)
+	for i, count := range cms.counts {
+		binary.LittleEndian.PutUint32(data[countMinHeaderSize+4*i:], count)
+	}
+	return data, nil
+}
+
+func (cms *CountMin) UnmarshalBinary(data []byte) error {
+	return cms.decode(string(data))
+}
+
+// DecodeCountMin decodes a sketch produced by MarshalBinary from a string,
+// as stored by the key value store.
+func DecodeCountMin(data string) (*CountMin, error) {
+	cms := &CountMin{}
+	if err := cms.decode(data); err != nil {
+		return nil, err
+	}
+	return cms, nil
+}
+
+// IsCountMin reports whether data looks like an encoded sketch.
+func IsCountMin(data string) bool {
+	return len(data) >= countMinHeaderSize && data[:len(countMinMagic)] == countMinMagic
+}
+
+func (cms *CountMin) decode(data string) error {
+	if !IsCountMin(data) {
+		return ErrInvalidEncoding
+	}
+	n := len(countMinMagic)
+	width := binary.LittleEndian.Uint32([]byte(data[n : n+4]))
+	depth := binary.LittleEndian.Uint32([]byte(data[n+4 : n+8]))
+	total := binary.LittleEndian.Uint64([]byte(data[n+8 : n+16]))
+	if width == 0 || depth == 0 || uint64(len(data)-countMinHeaderSize) != 4*uint64(width)*uint64(depth) {
+		return ErrInvalidEncoding
+	}
+
+	counts := make([]uint32, int(width)*int(depth))
+	for i := range counts {
+		offset := countMinHeaderSize + 4*i
+		counts[i] = binary.LittleEndian.Uint32([]byte(data[offset : offset+4]))
+	}
+	cms.width, cms.depth, cms.total, cms.counts = width, depth, total, counts
+	return nil
+}
+
+func (cms *CountMin) index(row uint32, h1 uint32, h2 uint32) uint32 {
+	// Kirsch-Mitzenmacher: derive each row's hash from two base hashes
+	return row*cms.width + (h1+row*h2)%cms.width
+}
+
+// hash splits a 64-bit FNV-1a hash of item into two 32-bit hashes.
+func hash(item string) (uint32, uint32) {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(item); i++ {
+		h ^= uint64(item[i])
+		h *= 1099511628211
+	}
+	// An odd second hash keeps rows distinct for power-of-two widths
+	return uint32(h), uint32(h>>32) | 1
+}
+
+func saturatingAdd(a uint32, b uint32) uint32 {
+	if a > math.MaxUint32-b {
+		return math.MaxUint32
+	}
+	return a + b
+}
@@ -0,0 +1,121 @@
+package sketch
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestCountMin_NeverUnderestimates(t *testing.T) {
+	cms, err := NewCountMinWithError(0.001, 0.01)
+	if err != nil {
+		t.Fatalf("NewCountMinWithError returned error: %v", err)
+	}
+
+	truth := make(map[string]uint32)
+	for i := range 20000 {
+		// Zipf-ish: low item numbers are much more frequent
+		item := fmt.Sprintf("item-%d", (i*i)%997)
+		truth[item]++
+		cms.Add(item, 1)
+	}
+
+	maxError := uint32(math.Ceil(0.001 * float64(cms.Count())))
+	overBound := 0
+	for item, count := range truth {
+		estimate := cms.Estimate(item)
+		if estimate < count {
+			t.Fatalf("Estimate(%q) = %d, below the true count %d", item, estimate, count)
+		}
+		if estimate-count > maxError {
+			overBound++
+		}
+	}
+	if overBound > len(truth)/100+1 {
+		t.Fatalf("%d of %d estimates exceed the error bound of %d", overBound, len(truth), maxError)
+	}
+}
+
+func TestCountMin_AddReturnsEstimate(t *testing.T) {
+	cms, _ := NewCountMin(64, 4)
+
+	if got := cms.Add("a", 3); got != 3 {
+		t.Fatalf("Add returned %d, want 3", got)
+	}
+	if got := cms.Add("a", 2); got != 5 {
+		t.Fatalf("Add returned %d, want 5", got)
+	}
+	if got := cms.Estimate("missing"); got != 0 {
+		t.Fatalf("Estimate of an unseen item on a sparse sketch = %d, want 0", got)
+	}
+	if cms.Count() != 5 {
+		t.Fatalf("Count = %d, want 5", cms.Count())
+	}
+}
+
+func TestCountMin_Merge(t *testing.T) {
+	a, _ := NewCountMin(128, 4)
+	b, _ := NewCountMin(128, 4)
+	a.Add("x", 4)
+	b.Add("x", 6)
+	b.Add("y", 1)
+
+	if err := a.Merge(b); err != nil {
+		t.Fatalf("Merge returned error: %v", err)
+	}
+	if a.Estimate("x") != 10 || a.Estimate("y") != 1 || a.Count() != 11 {
+		t.Fatalf("merged estimates x=%d y=%d count=%d, want 10, 1 and 11", a.Estimate("x"), a.Estimate("y"), a.Count())
+	}
+
+	c, _ := NewCountMin(64, 4)
+	if err := a.Merge(c); !errors.Is(err, ErrDimensionMismatch) {
+		t.Fatalf("Merge of different dimensions returned %v, want ErrDimensionMismatch", err)
+	}
+}
+
+func TestCountMin_Saturates(t *testing.T) {
+	cms, _ := NewCountMin(8, 2)
+	cms.Add("a", math.MaxUint32-1)
+	if got := cms.Add("a", 5); got != math.MaxUint32 {
+		t.Fatalf("Add past the counter limit = %d, want %d", got, uint32(math.MaxUint32))
+	}
+}
+
+func TestCountMin_EncodingRoundTrip(t *testing.T) {
+	cms, _ := NewCountMin(32, 3)
+	cms.Add("a", 7)
+	cms.Add("b", 2)
+
+	data, err := cms.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary returned error: %v", err)
+	}
+	if !IsCountMin(string(data)) {
+		t.Fatalf("IsCountMin of an encoded sketch = false")
+	}
+
+	decoded, err := DecodeCountMin(string(data))
+	if err != nil {
+		t.Fatalf("DecodeCountMin returned error: %v", err)
+	}
+	if decoded.Width() != 32 || decoded.Depth() != 3 || decoded.Count() != 9 || decoded.Estimate("a") != 7 {
+		t.Fatalf("decoded sketch %dx%d count=%d a=%d, want 32x3 count=9 a=7",
+			decoded.Width(), decoded.Depth(), decoded.Count(), decoded.Estimate("a"))
+	}
+
+	for _, bad := range []string{"", "plain value", string(data[:len(data)-1])} {
+		if _, err := DecodeCountMin(bad); !errors.Is(err, ErrInvalidEncoding) {
+			t.Errorf("DecodeCountMin(%q) returned %v, want ErrInvalidEncoding", bad, err)
+		}
+	}
+}
+
+func TestNewCountMin_RejectsInvalidDimensions(t *testing.T) {
+	if _, err := NewCountMin(0, 4); err == nil {
+		t.Errorf("NewCountMin(0, 4) succeeded, want error")
+	}
+	if _, err := NewCountMinWithError(0, 0.5); err == nil {
+		t.Errorf("NewCountMinWithError(0, 0.5) succeeded, want error")
+	}
+}
@@ -0,0 +1,148 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"slices"
+	"sync/atomic"
+)
+
+// Config describes the certificate material a cluster component uses for
+// mutual TLS. Every component presents its own certificate and only trusts
+// peers signed by CAFile. When AllowedPeers is non-empty, the peer's
+// certificate must additionally carry one of the listed identities as a DNS
+// or URI SAN.
+type Config struct {
+	CertFile     string
+	KeyFile      string
+	CAFile       string
+	AllowedPeers []string
+}
+
+func (config Config) Enabled() bool {
+	return config.CertFile != "" || config.KeyFile != "" || config.CAFile != ""
+}
+
+// ServerConfig returns a tls.Config that requires and verifies client
+// certificates.
+func ServerConfig(config Config) (*tls.Config, error) {
+	cert, pool, err := config.load()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:            tls.VersionTLS12,
+		Certificates:          []tls.Certificate{cert},
+		ClientCAs:             pool,
+		ClientAuth:            tls.RequireAndVerifyClientCert,
+		VerifyPeerCertificate: VerifyPeerIdentity(config.AllowedPeers),
+	}, nil
+}
+
+// ServerReloader serves the certificate material of a Config that can be
+// replaced while the server runs, so certificates can be rotated without a
+// restart. Connections already established keep the material they were
+// accepted with.
+type ServerReloader struct {
+	current atomic.Pointer[tls.Config]
+}
+
+func NewServerReloader(config Config) (*ServerReloader, error) {
+	reloader := &ServerReloader{}
+	if err := reloader.Reload(config); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// Reload loads config and serves it to new connections. If it cannot be
+// loaded the material already served is kept.
+func (reloader *ServerReloader) Reload(config Config) error {
+	serverTLS, err := ServerConfig(config)
+	if err != nil {
+		return err
+	}
+	// Handshakes get this config in place of the server's, so it has to
+	// offer HTTP/2 itself
+	serverTLS.NextProtos = []string{"h2", "http/1.1"}
+	reloader.current.Store(serverTLS)
+	return nil
+}
+
+// ServerConfig returns a tls.Config handing each handshake the material
+// most recently loaded.
+func (reloader *ServerReloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return reloader.current.Load(), nil
+		},
+	}
+}
+
+// ClientConfig returns a tls.Config for dialing another cluster component.
+// The server's certificate is checked against the CA and, if configured,
+// against AllowedPeers.
+func ClientConfig(config Config) (*tls.Config, error) {
+	cert, pool, err := config.load()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:            tls.VersionTLS12,
+		Certificates:          []tls.Certificate{cert},
+		RootCAs:               pool,
+		VerifyPeerCertificate: VerifyPeerIdentity(config.AllowedPeers),
+	}, nil
+}
+
+// VerifyPeerIdentity checks that the verified leaf certificate carries one of
+// the allowed identities. It runs after standard chain verification, so it
+// only ever sees certificates already signed by the cluster CA.
+func VerifyPeerIdentity(allowed []string) func([][]byte, [][]*x509.Certificate) error {
+	return func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(allowed) == 0 {
+			return nil
+		}
+		for _, chain := range verifiedChains {
+			if len(chain) == 0 {
+				continue
+			}
+			for _, identity := range PeerIdentities(chain[0]) {
+				if slices.Contains(allowed, identity) {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("peer certificate does not carry an allowed identity")
+	}
+}
+
+// PeerIdentities lists the SAN identities of a certificate, DNS names first
+// followed by URIs.
+func PeerIdentities(cert *x509.Certificate) []string {
+	identities := slices.Clone(cert.DNSNames)
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+	return identities
+}
+
+func (config Config) load() (tls.Certificate, *x509.CertPool, error) {
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("loading certificate: %w", err)
+	}
+
+	caPEM, err := os.ReadFile(config.CAFile)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("loading CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return tls.Certificate{}, nil, fmt.Errorf("no certificates found in CA file %s", config.CAFile)
+	}
+	return cert, pool, nil
+}
@@ -0,0 +1,211 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating CA key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "blueis-test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parsing CA certificate: %v", err)
+	}
+
+	ca := &testCA{cert, key, t.TempDir()}
+	writePEM(t, filepath.Join(ca.dir, "ca.pem"), "CERTIFICATE", der)
+	return ca
+}
+
+func (ca *testCA) issue(t *testing.T, name string, serial int64) Config {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key for %s: %v", name, err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name, "localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("creating certificate for %s: %v", name, err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshalling key for %s: %v", name, err)
+	}
+
+	config := Config{
+		CertFile: filepath.Join(ca.dir, name+".pem"),
+		KeyFile:  filepath.Join(ca.dir, name+"-key.pem"),
+		CAFile:   filepath.Join(ca.dir, "ca.pem"),
+	}
+	writePEM(t, config.CertFile, "CERTIFICATE", der)
+	writePEM(t, config.KeyFile, "EC PRIVATE KEY", keyDER)
+	return config
+}
+
+func writePEM(t *testing.T, path string, blockType string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("writing %s: %v", path, err)
+	}
+}
+
+func newMutualTLSServer(t *testing.T, config Config) *httptest.Server {
+	t.Helper()
+
+	serverTLS, err := ServerConfig(config)
+	if err != nil {
+		t.Fatalf("ServerConfig returned error: %v", err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	server.TLS = serverTLS
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func get(t *testing.T, url string, config Config) error {
+	t.Helper()
+
+	clientTLS, err := ClientConfig(config)
+	if err != nil {
+		t.Fatalf("ClientConfig returned error: %v", err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func TestMutualTLS_AllowedPeerConnects(t *testing.T) {
+	ca := newTestCA(t)
+
+	serverConfig := ca.issue(t, "node-1", 2)
+	serverConfig.AllowedPeers = []string{"coordinator"}
+	server := newMutualTLSServer(t, serverConfig)
+
+	clientConfig := ca.issue(t, "coordinator", 3)
+	clientConfig.AllowedPeers = []string{"node-1"}
+	if err := get(t, server.URL, clientConfig); err != nil {
+		t.Fatalf("request from allowed peer failed: %v", err)
+	}
+}
+
+func TestMutualTLS_RejectsUnlistedPeer(t *testing.T) {
+	ca := newTestCA(t)
+
+	serverConfig := ca.issue(t, "node-1", 2)
+	serverConfig.AllowedPeers = []string{"coordinator"}
+	server := newMutualTLSServer(t, serverConfig)
+
+	if err := get(t, server.URL, ca.issue(t, "node-2", 3)); err == nil {
+		t.Fatalf("request from unlisted peer succeeded, want handshake failure")
+	}
+}
+
+func TestMutualTLS_RejectsClientFromOtherCA(t *testing.T) {
+	server := newMutualTLSServer(t, newTestCA(t).issue(t, "node-1", 2))
+
+	clientTLS, err := ClientConfig(newTestCA(t).issue(t, "coordinator", 3))
+	if err != nil {
+		t.Fatalf("ClientConfig returned error: %v", err)
+	}
+	// Skip server verification so only the client certificate is at fault
+	clientTLS.InsecureSkipVerify = true
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+	if resp, err := client.Get(server.URL); err == nil {
+		resp.Body.Close()
+		t.Fatalf("request with certificate from another CA succeeded, want handshake failure")
+	}
+}
+
+func TestServerReloader_ServesReloadedPeers(t *testing.T) {
+	ca := newTestCA(t)
+
+	serverConfig := ca.issue(t, "node-1", 2)
+	serverConfig.AllowedPeers = []string{"coordinator"}
+	reloader, err := NewServerReloader(serverConfig)
+	if err != nil {
+		t.Fatalf("NewServerReloader returned error: %v", err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	server.TLS = reloader.ServerConfig()
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	client := ca.issue(t, "coordinator-2", 3)
+	if err := get(t, server.URL, client); err == nil {
+		t.Fatalf("request from unlisted peer succeeded, want handshake failure")
+	}
+
+	serverConfig.AllowedPeers = []string{"coordinator", "coordinator-2"}
+	if err := reloader.Reload(serverConfig); err != nil {
+		t.Fatalf("Reload returned error: %v", err)
+	}
+	if err := get(t, server.URL, client); err != nil {
+		t.Fatalf("request from peer allowed by the reload failed: %v", err)
+	}
+
+	// A reload that cannot be loaded keeps serving what was loaded before
+	serverConfig.CertFile = filepath.Join(t.TempDir(), "missing.pem")
+	if err := reloader.Reload(serverConfig); err == nil {
+		t.Fatalf("Reload of a missing certificate succeeded, want error")
+	}
+	if err := get(t, server.URL, client); err != nil {
+		t.Fatalf("request after a failed reload failed: %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package twophase
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const recordSuffix = ".txn"
+
+// Log keeps one record per unfinished transaction, each in its own file
+// under dir. Writes are synced before they return, so a record that was
+// written survives a crash; a record is removed once its transaction is
+// finished.
+type Log struct {
+	dir string
+	// beforeSync, if set, is called before each sync to disk
+	beforeSync func()
+}
+
+func OpenLog(dir string) (*Log, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating transaction log %s: %w", dir, err)
+	}
+	return &Log{dir: dir}, nil
+}
+
+// OnSync sets fn to be called before each sync of the log to disk, for
+// fault injection to slow them down. It must be set before the log is used.
+func (log *Log) OnSync(fn func()) {
+	log.beforeSync = fn
+}
+
+func (log *Log) sync(file *os.File) error {
+	if log.beforeSync != nil {
+		log.beforeSync()
+	}
+	return file.Sync()
+}
+
+func (log *Log) path(id string) string {
+	return filepath.Join(log.dir, id+recordSuffix)
+}
+
+// Write replaces the record of transaction id with data.
+func (log *Log) Write(id string, data []byte) error {
+	if err := ValidateID(id); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(log.dir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("logging transaction %s: %w", id, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("logging transaction %s: %w", id, err)
+	}
+	if err := log.sync(tmp); err != nil {
+		tmp.Close()
+		return fmt.Errorf("logging transaction %s: %w", id, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("logging transaction %s: %w", id, err)
+	}
+	if err := os.Rename(tmp.Name(), log.path(id)); err != nil {
+		return fmt.Errorf("logging transaction %s: %w", id, err)
+	}
+	return log.syncDir()
+}
+
+// Remove deletes the record of transaction id, if there is one.
+func (log *Log) Remove(id string) error {
+	if err := ValidateID(id); err != nil {
+		return err
+	}
+	if err := os.Remove(log.path(id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing transaction %s from log: %w", id, err)
+	}
+	return log.syncDir()
+}
+
+// Records returns every record in the log keyed by transaction id.
+func (log *Log) Records() (map[string][]byte, error) {
+	entries, err := os.ReadDir(log.dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading transaction log %s: %w", log.dir, err)
+	}
+
+	records := make(map[string][]byte)
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), recordSuffix)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(log.dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("reading transaction %s from log: %w", id, err)
+		}
+		records[id] = data
+	}
+	return records, nil
+}
+
+// syncDir makes a rename or removal in the log directory durable.
+func (log *Log) syncDir() error {
+	dir, err := os.Open(log.dir)
+	if err != nil {
+		return fmt.Errorf("syncing transaction log %s: %w", log.dir, err)
+	}
+	defer dir.Close()
+	if err := log.sync(dir); err != nil {
+		return fmt.Errorf("syncing transaction log %s: %w", log.dir, err)
+	}
+	return nil
+}
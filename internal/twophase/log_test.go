@@ -0,0 +1,59 @@
+package twophase
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLog_WriteRemoveAndReload(t *testing.T) {
+	dir := t.TempDir()
+	log, err := OpenLog(dir)
+	if err != nil {
+		t.Fatalf("OpenLog returned error: %v", err)
+	}
+
+	if err := log.Write("tx1", []byte("first")); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+	if err := log.Write("tx1", []byte("second")); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+	if err := log.Write("tx2", []byte("other")); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+	if err := log.Remove("tx2"); err != nil {
+		t.Fatalf("Remove returned error: %v", err)
+	}
+	if err := log.Remove("missing"); err != nil {
+		t.Fatalf("Remove of a missing record returned error: %v", err)
+	}
+
+	reopened, err := OpenLog(dir)
+	if err != nil {
+		t.Fatalf("OpenLog returned error: %v", err)
+	}
+	records, err := reopened.Records()
+	if err != nil {
+		t.Fatalf("Records returned error: %v", err)
+	}
+	if len(records) != 1 || string(records["tx1"]) != "second" {
+		t.Fatalf("Records = %q, want only tx1 = second", records)
+	}
+}
+
+func TestValidateID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want error
+	}{
+		{"tx-1_A", nil},
+		{"", ErrInvalidID},
+		{"../escape", ErrInvalidID},
+		{"a b", ErrInvalidID},
+	}
+	for _, tt := range tests {
+		if err := ValidateID(tt.id); !errors.Is(err, tt.want) {
+			t.Errorf("ValidateID(%q) = %v, want %v", tt.id, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Package twophase holds what the coordinator and nodes share for two-phase
+// commit: the operations a transaction is made of and the durable log each
+// side keeps so a transaction can be finished after a restart.
+package twophase
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+const (
+	OpSet    = "set"
+	OpDelete = "delete"
+)
+
+var ErrInvalidID = errors.New("twophase: transaction id must be 1-64 letters, digits, '-' or '_'")
+
+// Operation is a single write in a transaction.
+type Operation struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+// operationJSON is an Operation as it is encoded. A JSON string cannot hold
+// bytes that are not valid UTF-8, so a key or value with any is sent
+// base64-encoded in KeyBase64 or ValueBase64 instead.
+type operationJSON struct {
+	Op          string `json:"op"`
+	Key         string `json:"key"`
+	KeyBase64   []byte `json:"keyBase64,omitempty"`
+	Value       string `json:"value,omitempty"`
+	ValueBase64 []byte `json:"valueBase64,omitempty"`
+}
+
+func (operation Operation) MarshalJSON() ([]byte, error) {
+	encoded := operationJSON{Op: operation.Op, Key: operation.Key, Value: operation.Value}
+	if !utf8.ValidString(operation.Key) {
+		encoded.Key, encoded.KeyBase64 = "", []byte(operation.Key)
+	}
+	if !utf8.ValidString(operation.Value) {
+		encoded.Value, encoded.ValueBase64 = "", []byte(operation.Value)
+	}
+	return json.Marshal(encoded)
+}
+
+func (operation *Operation) UnmarshalJSON(data []byte) error {
+	var encoded operationJSON
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+	*operation = Operation{Op: encoded.Op, Key: encoded.Key, Value: encoded.Value}
+	if encoded.KeyBase64 != nil {
+		operation.Key = string(encoded.KeyBase64)
+	}
+	if encoded.ValueBase64 != nil {
+		operation.Value = string(encoded.ValueBase64)
+	}
+	return nil
+}
+
+func (operation Operation) Validate() error {
+	if operation.Key == "" {
+		return fmt.Errorf("operation has no key")
+	}
+	if operation.Op != OpSet && operation.Op != OpDelete {
+		return fmt.Errorf("unknown operation %q on key %s", operation.Op, operation.Key)
+	}
+	return nil
+}
+
+// ValidateID checks that id is safe to use as a log file name.
+func ValidateID(id string) error {
+	if len(id) == 0 || len(id) > 64 {
+		return ErrInvalidID
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return ErrInvalidID
+		}
+	}
+	return nil
+}
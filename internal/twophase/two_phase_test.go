@@ -0,0 +1,32 @@
+package twophase
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestOperation_EncodesAnyBytes(t *testing.T) {
+	operations := []Operation{
+		{Op: OpSet, Key: "plain", Value: "value"},
+		{Op: OpSet, Key: "bin\xff\x00ary", Value: "\xfe\nvalue"},
+		{Op: OpDelete, Key: "line\nbreak"},
+	}
+	data, err := json.Marshal(operations)
+	if err != nil {
+		t.Fatalf("Marshal returned error: %v", err)
+	}
+	var decoded []Operation
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal returned error: %v", err)
+	}
+	for i, want := range operations {
+		if decoded[i] != want {
+			t.Fatalf("operation %d decoded as %+q, want %+q", i, decoded[i], want)
+		}
+	}
+
+	// Operations that JSON can carry as they are keep the plain encoding
+	if plain, _ := json.Marshal(operations[0]); string(plain) != `{"op":"set","key":"plain","value":"value"}` {
+		t.Fatalf("plain operation encoded as %s", plain)
+	}
+}
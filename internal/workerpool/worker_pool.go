@@ -0,0 +1,113 @@
+package workerpool
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrFull = errors.New("worker pool is full, retry later")
+
+// Pool runs tasks on a fixed number of worker goroutines fed from a bounded
+// queue. When every worker is busy and the queue is full, new tasks are
+// rejected with ErrFull instead of waiting, so overload shows up as fast
+// explicit errors rather than an ever growing number of blocked goroutines.
+type Pool struct {
+	tasks    chan task
+	workers  int
+	rejected atomic.Uint64
+	wg       sync.WaitGroup
+}
+
+type task struct {
+	run  func()
+	done chan any
+}
+
+var doneChannelPool = sync.Pool{
+	New: func() any {
+		return make(chan any)
+	},
+}
+
+// New starts a pool with the given number of workers and room for queueSize
+// tasks waiting for a free worker.
+func New(workers int, queueSize int) *Pool {
+	if workers <= 0 {
+		workers = 1
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+
+	pool := &Pool{
+		tasks:   make(chan task, queueSize),
+		workers: workers,
+	}
+	pool.wg.Add(workers)
+	for range workers {
+		go pool.work()
+	}
+	return pool
+}
+
+func (pool *Pool) work() {
+	defer pool.wg.Done()
+	for t := range pool.tasks {
+		t.done <- run(t.run)
+	}
+}
+
+// run calls fn and returns anything it panicked with, so a panicking task is
+// re-raised on the caller's goroutine instead of killing the worker.
+func run(fn func()) (recovered any) {
+	defer func() {
+		recovered = recover()
+	}()
+	fn()
+	return nil
+}
+
+// Do runs fn on a worker and waits for it to finish. It returns ErrFull
+// without running fn when no worker or queue slot is free.
+func (pool *Pool) Do(fn func()) error {
+	done := doneChannelPool.Get().(chan any)
+	select {
+	case pool.tasks <- task{run: fn, done: done}:
+	default:
+		doneChannelPool.Put(done)
+		pool.rejected.Add(1)
+		return ErrFull
+	}
+	recovered := <-done
+	doneChannelPool.Put(done)
+	if recovered != nil {
+		panic(recovered)
+	}
+	return nil
+}
+
+// Close stops the workers once queued tasks have run. Do must not be called
+// after Close.
+func (pool *Pool) Close() {
+	close(pool.tasks)
+	pool.wg.Wait()
+}
+
+func (pool *Pool) Workers() int {
+	return pool.workers
+}
+
+// QueueDepth reports how many tasks are waiting for a free worker.
+func (pool *Pool) QueueDepth() int {
+	return len(pool.tasks)
+}
+
+func (pool *Pool) QueueCapacity() int {
+	return cap(pool.tasks)
+}
+
+// RejectedCount reports how many tasks were rejected with ErrFull.
+func (pool *Pool) RejectedCount() uint64 {
+	return pool.rejected.Load()
+}
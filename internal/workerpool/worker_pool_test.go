@@ -0,0 +1,134 @@
+package workerpool
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPool_RunsTasks(t *testing.T) {
+	pool := New(4, 16)
+	defer pool.Close()
+
+	var count atomic.Int64
+	var wg sync.WaitGroup
+	for range 100 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				err := pool.Do(func() { count.Add(1) })
+				if err == nil {
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if count.Load() != 100 {
+		t.Fatalf("ran %d tasks, want 100", count.Load())
+	}
+}
+
+func TestPool_CapsConcurrency(t *testing.T) {
+	const workers = 3
+	pool := New(workers, 100)
+	defer pool.Close()
+
+	var running, peak atomic.Int64
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = pool.Do(func() {
+				n := running.Add(1)
+				for {
+					p := peak.Load()
+					if n <= p || peak.CompareAndSwap(p, n) {
+						break
+					}
+				}
+				time.Sleep(time.Millisecond)
+				running.Add(-1)
+			})
+		}()
+	}
+	wg.Wait()
+
+	if peak.Load() > workers {
+		t.Fatalf("peak concurrency = %d, want at most %d", peak.Load(), workers)
+	}
+}
+
+func TestPool_RejectsWhenFull(t *testing.T) {
+	pool := New(1, 1)
+	defer pool.Close()
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go func() {
+		_ = pool.Do(func() {
+			close(started)
+			<-release
+		})
+	}()
+	<-started
+
+	// Fill the single queue slot behind the busy worker
+	queued := make(chan error, 1)
+	go func() {
+		queued <- pool.Do(func() {})
+	}()
+	deadline := time.Now().Add(time.Second)
+	for pool.QueueDepth() < 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("task was never queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	if err := pool.Do(func() { t.Error("rejected task ran") }); !errors.Is(err, ErrFull) {
+		t.Fatalf("Do on a full pool returned %v, want ErrFull", err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("rejection took %s, want it to be immediate", elapsed)
+	}
+	if pool.RejectedCount() != 1 {
+		t.Fatalf("RejectedCount = %d, want 1", pool.RejectedCount())
+	}
+
+	close(release)
+	if err := <-queued; err != nil {
+		t.Fatalf("queued task returned %v, want nil", err)
+	}
+}
+
+func TestPool_PropagatesPanics(t *testing.T) {
+	pool := New(1, 0)
+	defer pool.Close()
+
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Fatalf("recovered %v, want boom", r)
+			}
+		}()
+		for pool.Do(func() { panic("boom") }) != nil {
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	// The worker survives the panic
+	ran := false
+	for !ran {
+		if err := pool.Do(func() { ran = true }); err != nil {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
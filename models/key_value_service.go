@@ -1,95 +1,86 @@
-package models
-
-import (
-	"context"
-	"fmt"
-	"sync"
-)
-
-const (
-	DELETE = iota
-	UPDATE = iota
-	PUT    = iota
-	GET    = iota
-)
-
-type KeyValueCommand struct {
-	commandType int
-	key         string
-	value       *string
-	output      chan KeyValueOutput
-}
-
-type KeyValueOutput struct {
-	success bool
-	value   *string
-	err     error
-}
-
-type KeyValueService struct {
-	input    chan KeyValueCommand
-	isActive bool
-	close    context.CancelFunc
-}
-
-var (
-	instance *KeyValueService
-	once     sync.Once
-)
-
-func GetKeyValueService(ctx context.Context, close context.CancelFunc) *KeyValueService {
-	once.Do(func() {
-		input := make(chan KeyValueCommand)
-		InitKeyValueStore(input, ctx)
-		instance = &KeyValueService{input, true, close}
-	})
-	return instance
-}
-
-func (kvService *KeyValueService) Close() {
-	kvService.isActive = false
-	kvService.close()
-}
-
-func (kvService *KeyValueService) CheckActive() error {
-	if kvService.isActive {
-		return nil
-	}
-	return fmt.Errorf("KeyValueService has been closed")
-}
-
-func (kvService *KeyValueService) Set(key string, value string) (*string, error) {
-	if err := kvService.CheckActive(); err != nil {
-		return nil, err
-	}
-	outputCh := make(chan KeyValueOutput)
-	command := KeyValueCommand{PUT, key, &value, outputCh}
-	kvService.input <- command
-	res := <-outputCh
-
-	return res.value, res.err
-}
-
-func (kvService *KeyValueService) Delete(key string) (*string, error) {
-	if err := kvService.CheckActive(); err != nil {
-		return nil, err
-	}
-	outputCh := make(chan KeyValueOutput)
-	command := KeyValueCommand{DELETE, key, nil, outputCh}
-	kvService.input <- command
-	res := <-outputCh
-
-	return res.value, res.err
-}
-
-func (kvService *KeyValueService) Get(key string) (*string, error) {
-	if err := kvService.CheckActive(); err != nil {
-		return nil, err
-	}
-	outputCh := make(chan KeyValueOutput)
-	command := KeyValueCommand{GET, key, nil, outputCh}
-	kvService.input <- command
-	res := <-outputCh
-
-	return res.value, res.err
-}
+// Package models is the key value service the first blueis server was
+// built on.
+//
+// Deprecated: use blueis/pkg/blueis, which this package now wraps.
+package models
+
+import (
+	"blueis/pkg/blueis"
+	"context"
+	"errors"
+	"sync"
+)
+
+const (
+	DELETE = iota
+	UPDATE = iota
+	PUT    = iota
+	GET    = iota
+)
+
+type KeyValueService struct {
+	db    *blueis.DB
+	close context.CancelFunc
+}
+
+var (
+	instance *KeyValueService
+	once     sync.Once
+)
+
+// GetKeyValueService returns the process-wide service, opening an in-memory
+// blueis.DB on the first call. close is called when the service is closed.
+func GetKeyValueService(ctx context.Context, close context.CancelFunc) *KeyValueService {
+	once.Do(func() {
+		// Opening an in-memory DB cannot fail
+		db, _ := blueis.Open(blueis.Options{})
+		instance = &KeyValueService{db, close}
+		context.AfterFunc(ctx, func() { _ = db.Close() })
+	})
+	return instance
+}
+
+func (kvService *KeyValueService) Close() {
+	_ = kvService.db.Close()
+	kvService.close()
+}
+
+func (kvService *KeyValueService) Set(key string, value string) (*string, error) {
+	if err := kvService.db.Set(key, value); err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
+
+// Delete removes key and returns the value it had, or nil if it did not
+// exist.
+func (kvService *KeyValueService) Delete(key string) (*string, error) {
+	value, err := kvService.db.GetDel(key)
+	if errors.Is(err, blueis.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
+
+func (kvService *KeyValueService) Get(key string) (*string, error) {
+	value, err := kvService.db.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
+
+func GetCommandTypeString(commandType int) string {
+	switch commandType {
+	case PUT:
+		return "PUT"
+	case DELETE:
+		return "DELETE"
+	case GET:
+		return "GET"
+	}
+	return "UNKNOWN"
+}
@@ -0,0 +1,394 @@
+// Package blueis runs the blueis key value store inside a Go program. It is
+// the store a node serves over HTTP, with its expiry, persistence and
+// keyspace notifications, called directly: there is no server, coordinator
+// or network hop in between.
+//
+//	db, err := blueis.Open(blueis.Options{Dir: "data"})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer db.Close()
+//
+//	err = db.SetWithTTL("session:42", "alice", time.Hour)
+//	value, err := db.Get("session:42")
+//
+// A DB is safe for concurrent use. Several DBs can be open in one process,
+// as long as no two share a directory.
+package blueis
+
+import (
+	"blueis/internal/kvstore"
+	"context"
+	"errors"
+	"iter"
+	"log"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned for a key that does not exist, or has expired.
+	ErrNotFound = kvstore.ErrKeyNotFound
+	// ErrClosed is returned by every call made after Close.
+	ErrClosed = kvstore.ErrClosed
+	// ErrInvalidKey, ErrKeyTooLong and ErrValueTooLarge are returned for
+	// writes refused by Options.MaxKeyLength and Options.MaxValueSize, or
+	// for a blank key.
+	ErrInvalidKey    = kvstore.ErrInvalidKey
+	ErrKeyTooLong    = kvstore.ErrKeyTooLong
+	ErrValueTooLarge = kvstore.ErrValueTooLarge
+	// ErrHistoryUnavailable is returned by GetAsOf for a time further back
+	// than Options.HistoryWindow.
+	ErrHistoryUnavailable = kvstore.ErrHistoryUnavailable
+	// ErrInvalidTTL is returned by SetWithTTL for a TTL that is not
+	// positive.
+	ErrInvalidTTL = kvstore.ErrInvalidTTL
+	// ErrOffsetOutOfRange is returned by SetRange for a negative offset.
+	ErrOffsetOutOfRange = kvstore.ErrOffsetOutOfRange
+	// ErrWrongType is returned for a command against a key holding another
+	// type of value, such as Get of a hash.
+	ErrWrongType = kvstore.ErrWrongType
+	// ErrHashValueNotInteger is returned by HIncrBy for a field that does
+	// not hold an integer.
+	ErrHashValueNotInteger = kvstore.ErrHashValueNotInteger
+)
+
+const (
+	// EventSet is delivered whenever a key's value is written.
+	EventSet = kvstore.EventSet
+	// EventDel is delivered whenever a key is removed, including when it
+	// expired, which is followed by EventExpired.
+	EventDel = kvstore.EventDel
+	// EventExpired is delivered when an expired key is removed.
+	EventExpired = kvstore.EventExpired
+)
+
+const (
+	// TTLNoKey is the TTL reported for a key that does not exist.
+	TTLNoKey = kvstore.TTLNoKey
+	// TTLNoExpiry is the TTL reported for a key that never expires.
+	TTLNoExpiry = kvstore.TTLNoExpiry
+)
+
+// Event describes a change to a key, delivered to Watch.
+type Event = kvstore.Event
+
+// Value is a key's value as Scan yields it, with when it expires.
+type Value = kvstore.Value
+
+// Engine is what a DB keeps its keys in, for Options.Engine. An engine
+// holds each key's value as an opaque string with its type, which it hands
+// back unchanged; the DB layers expiry, history and notifications on top,
+// and only ever calls the engine from one goroutine at a time. An engine
+// that also implements DeadlineEngine keeps expiry deadlines across
+// restarts.
+type Engine = kvstore.StorageEngine
+
+// TypedValue is a value as an Engine holds it: its data and the ValueType
+// that says whether it is a string, a hash, a list or another type.
+type TypedValue = kvstore.TypedValue
+
+// ValueType is the type of a TypedValue. Engines store it without
+// interpreting it.
+type ValueType = kvstore.ValueType
+
+// EngineSnapshot is the point-in-time view Engine.Snapshot returns.
+type EngineSnapshot = kvstore.EngineSnapshot
+
+// DeadlineEngine is implemented by engines that keep each key's expiry
+// deadline next to its value.
+type DeadlineEngine = kvstore.DeadlineEngine
+
+// Options configure a DB. The zero value keeps every key in memory, with
+// no limits on keys or values.
+type Options struct {
+	// Dir keeps keys on disk in a bbolt database under this directory, so
+	// they and their expiry deadlines survive the DB being closed and
+	// opened again. Empty keeps keys in memory only
+	Dir string
+	// Engine keeps keys in an engine of the caller's own instead, which the
+	// DB closes when it is closed. It cannot be combined with Dir
+	Engine Engine
+	// CachedKeys, with Dir or Engine, keeps up to this many recently used
+	// keys in memory in front of it. Zero reads every key from it
+	CachedKeys int
+	// MaxKeyLength and MaxValueSize cap, in bytes, the keys and values
+	// written. Zero leaves them unbounded
+	MaxKeyLength int
+	MaxValueSize int
+	// TTLJitter pushes every expiry back by a random amount up to this
+	// fraction of the TTL, so keys given the same TTL together do not all
+	// expire at once
+	TTLJitter float64
+	// HistoryWindow keeps the values keys held for this long, so GetAsOf
+	// can read them. Zero keeps none
+	HistoryWindow time.Duration
+	// Logger receives the store's messages, log.Default() if nil
+	Logger *log.Logger
+}
+
+// DB is an open blueis store.
+type DB struct {
+	kv *kvstore.KeyValueService
+}
+
+// Open opens a store as options describe. Close it to release it, which for
+// a store with a Dir writes out anything still buffered.
+func Open(options Options) (*DB, error) {
+	engine := options.Engine
+	switch {
+	case engine != nil && options.Dir != "":
+		return nil, errors.New("blueis: Options.Engine and Options.Dir cannot both be set")
+	case options.Dir != "":
+		disk, err := kvstore.NewDiskEngine(options.Dir)
+		if err != nil {
+			return nil, err
+		}
+		engine = disk
+	}
+	if engine == nil {
+		engine = kvstore.NewMemoryEngine()
+	} else if options.CachedKeys > 0 {
+		engine = kvstore.NewTieredEngine(options.CachedKeys, engine)
+	}
+	kv := kvstore.NewKeyValueService(context.Background(),
+		kvstore.WithEngine(engine),
+		kvstore.WithMaxKeyLength(options.MaxKeyLength),
+		kvstore.WithMaxValueSize(options.MaxValueSize),
+		kvstore.WithTTLJitter(options.TTLJitter),
+		kvstore.WithHistory(kvstore.History{Window: options.HistoryWindow}),
+		kvstore.WithLogger(options.Logger),
+	)
+	return &DB{kv}, nil
+}
+
+// Close waits for calls in progress to finish, for up to
+// kvstore.DefaultCloseTimeout, and closes the store. Calls made afterwards
+// fail with ErrClosed.
+func (db *DB) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), kvstore.DefaultCloseTimeout)
+	defer cancel()
+	return db.kv.Shutdown(ctx)
+}
+
+// Get returns key's value, or ErrNotFound.
+func (db *DB) Get(key string) (string, error) {
+	return derefValue(db.kv.Get(key))
+}
+
+// GetAsOf returns the value key held at a time within
+// Options.HistoryWindow, or ErrNotFound if it did not exist then.
+func (db *DB) GetAsOf(key string, at time.Time) (string, error) {
+	value, err := db.kv.GetAsOf(key, at)
+	if err != nil {
+		return "", err
+	}
+	return *value, nil
+}
+
+// Set sets key to value, removing any expiry it had.
+func (db *DB) Set(key string, value string) error {
+	_, err := db.kv.Set(key, value)
+	return err
+}
+
+// SetWithTTL sets key to value and has it expire after ttl, in one step so
+// the key is never seen without its expiry.
+func (db *DB) SetWithTTL(key string, value string, ttl time.Duration) error {
+	_, err := db.kv.SetWithTTL(key, value, ttl)
+	return err
+}
+
+// SetNX sets key to value only if it does not exist, and reports whether
+// it did.
+func (db *DB) SetNX(key string, value string) (bool, error) {
+	return db.kv.SetNX(key, value)
+}
+
+// SetIfEqual sets key to value only if it holds expected, and reports
+// whether it did, for compare-and-swap updates.
+func (db *DB) SetIfEqual(key string, expected string, value string) (bool, error) {
+	return db.kv.SetIfEqual(key, expected, value)
+}
+
+// Append appends suffix to key's value, creating the key if it does not
+// exist, and returns the new length. The key's expiry is kept.
+func (db *DB) Append(key string, suffix string) (int64, error) {
+	return db.kv.Append(key, suffix)
+}
+
+// StrLen returns the length in bytes of key's value, or 0 if it does not
+// exist.
+func (db *DB) StrLen(key string) (int64, error) {
+	return db.kv.StrLen(key)
+}
+
+// GetRange returns the bytes of key's value from start to end inclusive.
+// Negative offsets count back from the end, and a missing key reads as the
+// empty string.
+func (db *DB) GetRange(key string, start int64, end int64) (string, error) {
+	return db.kv.GetRange(key, start, end)
+}
+
+// SetRange overwrites key's value with data from offset on, padding it
+// with zero bytes if it is shorter, and returns the new length.
+func (db *DB) SetRange(key string, offset int64, data string) (int64, error) {
+	return db.kv.SetRange(key, offset, data)
+}
+
+// MGet reads keys in one step and returns the values of those that exist.
+func (db *DB) MGet(keys ...string) (map[string]string, error) {
+	values, err := db.kv.MGet(keys)
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]string, len(keys))
+	for i, value := range values {
+		if value != nil {
+			found[keys[i]] = *value
+		}
+	}
+	return found, nil
+}
+
+// MSet writes entries in one step. The writes are not atomic: a key that
+// is refused does not stop the others being written.
+func (db *DB) MSet(entries map[string]string) error {
+	return db.kv.MSet(entries)
+}
+
+// HSet sets fields of the hash under key, creating it if needed, and
+// returns how many of the fields are new.
+func (db *DB) HSet(key string, values map[string]string) (int64, error) {
+	return db.kv.HSet(key, values)
+}
+
+// HGet returns the value of field in the hash under key, or ErrNotFound if
+// the key or the field does not exist.
+func (db *DB) HGet(key string, field string) (string, error) {
+	return derefValue(db.kv.HGet(key, field))
+}
+
+// HDel removes fields from the hash under key and returns how many were
+// present. Removing the last field removes the key.
+func (db *DB) HDel(key string, fields ...string) (int64, error) {
+	return db.kv.HDel(key, fields...)
+}
+
+// HGetAll returns the fields and values of the hash under key, empty if
+// it does not exist.
+func (db *DB) HGetAll(key string) (map[string]string, error) {
+	return db.kv.HGetAll(key)
+}
+
+// HIncrBy adds delta to the integer in field of the hash under key and
+// returns its new value. A missing field counts from zero.
+func (db *DB) HIncrBy(key string, field string, delta int64) (int64, error) {
+	return db.kv.HIncrBy(key, field, delta)
+}
+
+// LPush adds values to the head of the list under key, creating it if
+// needed, and returns its new length. The last value given ends up first.
+func (db *DB) LPush(key string, values ...string) (int64, error) {
+	return db.kv.LPush(key, values...)
+}
+
+// RPush adds values to the tail of the list under key in order, creating
+// it if needed, and returns its new length.
+func (db *DB) RPush(key string, values ...string) (int64, error) {
+	return db.kv.RPush(key, values...)
+}
+
+// LPop removes and returns the head of the list under key, or ErrNotFound
+// if it is empty.
+func (db *DB) LPop(key string) (string, error) {
+	return derefValue(db.kv.LPop(key))
+}
+
+// RPop removes and returns the tail of the list under key, or ErrNotFound
+// if it is empty.
+func (db *DB) RPop(key string) (string, error) {
+	return derefValue(db.kv.RPop(key))
+}
+
+// LRange returns the values of the list under key from start to stop
+// inclusive. Negative indexes count back from the tail, so LRange(key, 0,
+// -1) is the whole list.
+func (db *DB) LRange(key string, start int64, stop int64) ([]string, error) {
+	return db.kv.LRange(key, start, stop)
+}
+
+// LLen returns the length of the list under key, or 0 if it does not
+// exist.
+func (db *DB) LLen(key string) (int64, error) {
+	return db.kv.LLen(key)
+}
+
+// Delete removes key and reports whether it existed.
+func (db *DB) Delete(key string) (bool, error) {
+	value, err := db.kv.Delete(key)
+	return value != nil, err
+}
+
+// GetDel removes key and returns the value it had, or ErrNotFound.
+func (db *DB) GetDel(key string) (string, error) {
+	value, err := db.kv.Delete(key)
+	if err != nil {
+		return "", err
+	}
+	if value == nil {
+		return "", ErrNotFound
+	}
+	return *value, nil
+}
+
+// Expire has key expire after ttl and reports whether the key exists. A ttl
+// that is not positive deletes the key. Expired keys stop being returned
+// straight away, and are removed when next touched.
+func (db *DB) Expire(key string, ttl time.Duration) (bool, error) {
+	return db.kv.Expire(key, ttl)
+}
+
+// ExpireAt is Expire with an absolute time.
+func (db *DB) ExpireAt(key string, at time.Time) (bool, error) {
+	return db.kv.ExpireAt(key, at)
+}
+
+// Persist removes key's expiry and reports whether it had one.
+func (db *DB) Persist(key string) (bool, error) {
+	return db.kv.Persist(key)
+}
+
+// TTL returns how long key has left to live, TTLNoKey if it does not exist
+// and TTLNoExpiry if it never expires.
+func (db *DB) TTL(key string) (time.Duration, error) {
+	return db.kv.TTL(key)
+}
+
+// Scan iterates over the keys starting with prefix, in order, with their
+// values as of when iteration starts; writes made meanwhile are not seen.
+// If reading fails or ctx is done, the last value yielded has an empty key
+// and Value.Err set.
+func (db *DB) Scan(ctx context.Context, prefix string) iter.Seq2[string, Value] {
+	return db.kv.Range(ctx, prefix)
+}
+
+// Watch calls fn for every change of the given types, EventSet, EventDel
+// and EventExpired, or of every type if none are given. Calls are made one
+// at a time, in order, on a goroutine of their own, and queue up rather
+// than being dropped while fn runs. It returns a function that stops the
+// calls.
+func (db *DB) Watch(fn func(Event), eventTypes ...string) (stop func()) {
+	if len(eventTypes) == 0 {
+		eventTypes = []string{EventSet, EventDel, EventExpired}
+	}
+	return db.kv.Watch(fn, eventTypes...)
+}
+
+// derefValue unwraps the value a store read returns, which is set whenever
+// err is not.
+func derefValue(value *string, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	return *value, nil
+}
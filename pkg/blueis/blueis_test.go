@@ -0,0 +1,308 @@
+package blueis
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+)
+
+func openTestDB(t *testing.T, options Options) *DB {
+	t.Helper()
+	db, err := Open(options)
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func TestDB_SetGetDelete(t *testing.T) {
+	db := openTestDB(t, Options{})
+
+	if err := db.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if got, err := db.Get("foo"); err != nil || got != "bar" {
+		t.Fatalf("Get = (%q, %v), want bar", got, err)
+	}
+	if got, err := db.GetDel("foo"); err != nil || got != "bar" {
+		t.Fatalf("GetDel = (%q, %v), want bar", got, err)
+	}
+	if _, err := db.Get("foo"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get after GetDel returned %v, want ErrNotFound", err)
+	}
+	if existed, err := db.Delete("foo"); err != nil || existed {
+		t.Fatalf("Delete of a missing key = (%v, %v), want false", existed, err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	if err := db.Set("foo", "bar"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Set after Close returned %v, want ErrClosed", err)
+	}
+}
+
+func TestDB_SetWithTTLExpires(t *testing.T) {
+	db := openTestDB(t, Options{})
+	expired := make(chan string, 1)
+	stop := db.Watch(func(event Event) { expired <- event.Key }, EventExpired)
+	defer stop()
+
+	if err := db.SetWithTTL("session", "alice", 20*time.Millisecond); err != nil {
+		t.Fatalf("SetWithTTL returned error: %v", err)
+	}
+	if ttl, err := db.TTL("session"); err != nil || ttl <= 0 || ttl > 20*time.Millisecond {
+		t.Fatalf("TTL = (%v, %v), want up to 20ms", ttl, err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, err := db.Get("session"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get after the TTL returned %v, want ErrNotFound", err)
+	}
+	select {
+	case key := <-expired:
+		if key != "session" {
+			t.Fatalf("expired %q, want session", key)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no expired event was delivered")
+	}
+}
+
+func TestDB_ConditionalWrites(t *testing.T) {
+	db := openTestDB(t, Options{})
+
+	if ok, err := db.SetNX("lock", "a"); err != nil || !ok {
+		t.Fatalf("SetNX = (%t, %v), want (true, nil)", ok, err)
+	}
+	if ok, err := db.SetNX("lock", "b"); err != nil || ok {
+		t.Fatalf("second SetNX = (%t, %v), want (false, nil)", ok, err)
+	}
+	if ok, err := db.SetIfEqual("lock", "b", "c"); err != nil || ok {
+		t.Fatalf("SetIfEqual with wrong expectation = (%t, %v), want (false, nil)", ok, err)
+	}
+	if ok, err := db.SetIfEqual("lock", "a", "c"); err != nil || !ok {
+		t.Fatalf("SetIfEqual = (%t, %v), want (true, nil)", ok, err)
+	}
+	if value, err := db.Get("lock"); err != nil || value != "c" {
+		t.Fatalf("Get = (%q, %v), want (\"c\", nil)", value, err)
+	}
+}
+
+func TestDB_StringRanges(t *testing.T) {
+	db := openTestDB(t, Options{})
+
+	if _, err := db.Append("log", "hello"); err != nil {
+		t.Fatalf("Append returned error: %v", err)
+	}
+	if n, err := db.SetRange("log", 5, " world"); err != nil || n != 11 {
+		t.Fatalf("SetRange = (%d, %v), want (11, nil)", n, err)
+	}
+	if n, err := db.StrLen("log"); err != nil || n != 11 {
+		t.Fatalf("StrLen = (%d, %v), want (11, nil)", n, err)
+	}
+	if got, err := db.GetRange("log", -5, -1); err != nil || got != "world" {
+		t.Fatalf("GetRange = (%q, %v), want (\"world\", nil)", got, err)
+	}
+	if _, err := db.SetRange("log", -1, "x"); !errors.Is(err, ErrOffsetOutOfRange) {
+		t.Fatalf("SetRange with negative offset = %v, want ErrOffsetOutOfRange", err)
+	}
+}
+
+func TestDB_MGetMSet(t *testing.T) {
+	db := openTestDB(t, Options{})
+
+	if err := db.MSet(map[string]string{"a": "1", "b": "2"}); err != nil {
+		t.Fatalf("MSet returned error: %v", err)
+	}
+	values, err := db.MGet("a", "b", "missing")
+	if err != nil {
+		t.Fatalf("MGet returned error: %v", err)
+	}
+	if len(values) != 2 || values["a"] != "1" || values["b"] != "2" {
+		t.Fatalf("MGet = %v, want map[a:1 b:2]", values)
+	}
+}
+
+func TestDB_Hashes(t *testing.T) {
+	db := openTestDB(t, Options{})
+
+	if n, err := db.HSet("user", map[string]string{"name": "alice", "visits": "1"}); err != nil || n != 2 {
+		t.Fatalf("HSet = (%d, %v), want (2, nil)", n, err)
+	}
+	if n, err := db.HIncrBy("user", "visits", 2); err != nil || n != 3 {
+		t.Fatalf("HIncrBy = (%d, %v), want (3, nil)", n, err)
+	}
+	if name, err := db.HGet("user", "name"); err != nil || name != "alice" {
+		t.Fatalf("HGet = (%q, %v), want (\"alice\", nil)", name, err)
+	}
+	if _, err := db.HGet("user", "missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("HGet of missing field = %v, want ErrNotFound", err)
+	}
+	if _, err := db.Get("user"); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("Get of a hash = %v, want ErrWrongType", err)
+	}
+	if n, err := db.HDel("user", "name"); err != nil || n != 1 {
+		t.Fatalf("HDel = (%d, %v), want (1, nil)", n, err)
+	}
+	if all, err := db.HGetAll("user"); err != nil || len(all) != 1 || all["visits"] != "3" {
+		t.Fatalf("HGetAll = (%v, %v), want map[visits:3]", all, err)
+	}
+}
+
+func TestDB_ListAsQueue(t *testing.T) {
+	db := openTestDB(t, Options{})
+
+	if n, err := db.RPush("jobs", "a", "b", "c"); err != nil || n != 3 {
+		t.Fatalf("RPush = (%d, %v), want (3, nil)", n, err)
+	}
+	if n, err := db.LPush("jobs", "urgent"); err != nil || n != 4 {
+		t.Fatalf("LPush = (%d, %v), want (4, nil)", n, err)
+	}
+	if values, err := db.LRange("jobs", 0, -1); err != nil || len(values) != 4 || values[0] != "urgent" {
+		t.Fatalf("LRange = (%v, %v), want [urgent a b c]", values, err)
+	}
+	if job, err := db.LPop("jobs"); err != nil || job != "urgent" {
+		t.Fatalf("LPop = (%q, %v), want urgent", job, err)
+	}
+	if job, err := db.RPop("jobs"); err != nil || job != "c" {
+		t.Fatalf("RPop = (%q, %v), want c", job, err)
+	}
+	if n, err := db.LLen("jobs"); err != nil || n != 2 {
+		t.Fatalf("LLen = (%d, %v), want (2, nil)", n, err)
+	}
+	if _, err := db.LPop("empty"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("LPop of an empty list = %v, want ErrNotFound", err)
+	}
+}
+
+func TestDB_GetAsOfReadsEarlierValues(t *testing.T) {
+	db := openTestDB(t, Options{HistoryWindow: time.Hour})
+
+	if err := db.Set("foo", "old"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	before := time.Now()
+	time.Sleep(2 * time.Millisecond)
+	if err := db.Set("foo", "new"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+
+	if got, err := db.GetAsOf("foo", before); err != nil || got != "old" {
+		t.Fatalf("GetAsOf before the second Set = (%q, %v), want old", got, err)
+	}
+	if got, err := db.Get("foo"); err != nil || got != "new" {
+		t.Fatalf("Get = (%q, %v), want new", got, err)
+	}
+	if _, err := db.GetAsOf("foo", before.Add(-2*time.Hour)); !errors.Is(err, ErrHistoryUnavailable) {
+		t.Fatalf("GetAsOf past the window returned %v, want ErrHistoryUnavailable", err)
+	}
+}
+
+func TestDB_DirSurvivesReopening(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(Options{Dir: dir, CachedKeys: 1})
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	for _, key := range []string{"user:2", "user:1", "order:1"} {
+		if err := db.Set(key, "v-"+key); err != nil {
+			t.Fatalf("Set(%q) returned error: %v", key, err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	db = openTestDB(t, Options{Dir: dir})
+	var keys []string
+	for key, value := range db.Scan(context.Background(), "user:") {
+		if value.Err != nil {
+			t.Fatalf("Scan failed: %v", value.Err)
+		}
+		if value.Data != "v-"+key {
+			t.Fatalf("Scan yielded %q = %q, want v-%s", key, value.Data, key)
+		}
+		keys = append(keys, key)
+	}
+	if !slices.Equal(keys, []string{"user:1", "user:2"}) {
+		t.Fatalf("Scan yielded %q, want user:1 and user:2", keys)
+	}
+}
+
+// mapEngine is an Engine of the test's own, over a plain map. A copy of it
+// serves as its snapshot.
+type mapEngine struct {
+	values map[string]TypedValue
+	closed *bool
+}
+
+func (engine mapEngine) Get(key string) (TypedValue, bool, error) {
+	value, ok := engine.values[key]
+	return value, ok, nil
+}
+
+func (engine mapEngine) Set(key string, value TypedValue) error {
+	engine.values[key] = value
+	return nil
+}
+
+func (engine mapEngine) Delete(key string) (TypedValue, bool, error) {
+	value, ok := engine.values[key]
+	delete(engine.values, key)
+	return value, ok, nil
+}
+
+func (engine mapEngine) Scan(fn func(key string, value TypedValue) bool) error {
+	for key, value := range engine.values {
+		if !fn(key, value) {
+			break
+		}
+	}
+	return nil
+}
+
+func (engine mapEngine) Snapshot() (EngineSnapshot, error) {
+	return mapEngine{maps.Clone(engine.values), new(bool)}, nil
+}
+
+func (engine mapEngine) Close() error {
+	*engine.closed = true
+	return nil
+}
+
+func TestDB_OwnEngine(t *testing.T) {
+	engine := mapEngine{map[string]TypedValue{}, new(bool)}
+	db, err := Open(Options{Engine: engine, CachedKeys: 1})
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if err := db.Set(key, "v-"+key); err != nil {
+			t.Fatalf("Set(%q) returned error: %v", key, err)
+		}
+	}
+	if _, err := db.HSet("h", map[string]string{"f": "v"}); err != nil {
+		t.Fatalf("HSet returned error: %v", err)
+	}
+	if got, err := db.Get("a"); err != nil || got != "v-a" {
+		t.Fatalf("Get = (%q, %v), want v-a", got, err)
+	}
+	if engine.values["b"].Data != "v-b" || len(engine.values) != 3 {
+		t.Fatalf("engine holds %q, want a, b and h", engine.values)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	if !*engine.closed {
+		t.Fatalf("Close left the engine open")
+	}
+
+	if _, err := Open(Options{Engine: mapEngine{map[string]TypedValue{}, new(bool)}, Dir: t.TempDir()}); err == nil {
+		t.Fatalf("Open with both Engine and Dir succeeded, want error")
+	}
+}